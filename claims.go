@@ -91,6 +91,20 @@ type Claims struct {
 	// even when the authorized party is the same as the sole audience. The azp
 	// value is a case sensitive string containing a StringOrURI value.
 	AZP string `json:"azp,omitempty"`
+	// Access Token hash value. Its value is the base64url encoding of the
+	// left-most half of the hash of the octets of the ASCII representation of
+	// the access_token value, where the hash algorithm used is the hash
+	// algorithm used in the alg Header Parameter of the ID Token's JOSE
+	// Header. If the ID Token is issued with an access_token in an Implicit
+	// Flow, this is REQUIRED; otherwise, its inclusion is OPTIONAL.
+	AccessTokenHash string `json:"at_hash,omitempty"`
+	// Code hash value. Its value is the base64url encoding of the left-most
+	// half of the hash of the octets of the ASCII representation of the code
+	// value, where the hash algorithm used is the hash algorithm used in the
+	// alg Header Parameter of the ID Token's JOSE Header. If the ID Token is
+	// issued from the Authorization Endpoint with a code in a Hybrid Flow,
+	// this is REQUIRED; otherwise, its inclusion is OPTIONAL.
+	CodeHash string `json:"c_hash,omitempty"`
 
 	// Extra are additional claims, that the standard claims will be merged in
 	// to. If a key is overridden here, the struct value wins.
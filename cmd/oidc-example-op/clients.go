@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
-	"strings"
+
+	"github.com/pardot/oidc/core"
+	"gopkg.in/square/go-jose.v2"
 )
 
 type client struct {
@@ -10,6 +12,60 @@ type client struct {
 	ClientSecret string
 	RedirectURL  string
 	Public       bool
+	// PostLogoutRedirectURIs the user can be sent to after logging out
+	PostLogoutRedirectURIs []string
+	// BackchannelLogoutURI logout tokens are POSTed to, if set
+	BackchannelLogoutURI string
+	// BackchannelLogoutSessionRequired indicates the client requires the
+	// sid claim in logout tokens
+	BackchannelLogoutSessionRequired bool
+	// FrontchannelLogoutURI is loaded in an iframe when the user logs out,
+	// if set
+	FrontchannelLogoutURI string
+	// FrontchannelLogoutSessionRequired indicates the client requires the
+	// iss and sid query parameters on the front-channel logout URI
+	FrontchannelLogoutSessionRequired bool
+	// JWKS the client signs private_key_jwt assertions with, if it uses
+	// them to authenticate
+	JWKS *jose.JSONWebKeySet
+	// TLSClientAuthSubjectDN is the subject of the certificate the client
+	// can authenticate with, if it uses tls_client_auth
+	TLSClientAuthSubjectDN string
+	// RequestObjectSigningAlg request objects must be signed with. If empty,
+	// any algorithm supported by the client's JWKS is accepted
+	RequestObjectSigningAlg jose.SignatureAlgorithm
+	// RequestURIs request objects can be fetched from
+	RequestURIs []string
+	// UserinfoSignedResponseAlg userinfo responses are signed with. If
+	// empty, they are returned as plain JSON unless a JWT is requested
+	UserinfoSignedResponseAlg jose.SignatureAlgorithm
+	// AllowTokenExchange lets the client exchange tokens for the user
+	AllowTokenExchange bool
+	// AllowedScopes the client can request. If empty, any scope can be
+	// requested
+	AllowedScopes []string
+	// AllowedGrantTypes the client can use. If empty, any grant type can be
+	// used
+	AllowedGrantTypes []string
+	// IDTokenSignedResponseAlg ID tokens are signed with. If empty, the
+	// signer's default is used
+	IDTokenSignedResponseAlg jose.SignatureAlgorithm
+	// IDTokenEncryptedResponseAlg and IDTokenEncryptedResponseEnc ID tokens
+	// are encrypted with, to a key in the JWKS. If the alg is empty, ID
+	// tokens are not encrypted
+	IDTokenEncryptedResponseAlg jose.KeyAlgorithm
+	IDTokenEncryptedResponseEnc jose.ContentEncryption
+	// AllowServiceTokens lets ID tokens be issued for the client without
+	// going through the authorization flow
+	AllowServiceTokens bool
+	// AllowClientCredentials lets the client get access tokens for itself
+	AllowClientCredentials bool
+	// AllowedResources the client can request tokens for with resource
+	// indicators
+	AllowedResources []string
+	// AllowedIPRanges the client can use the token endpoint from, as CIDRs.
+	// If empty, it can be used from anywhere
+	AllowedIPRanges []string
 }
 
 type staticClients []client
@@ -38,19 +94,185 @@ func (s staticClients) ValidateClientSecret(clientID, clientSecret string) (ok b
 
 func (s staticClients) ValidateClientRedirectURI(clientID, redirectURI string) (ok bool, err error) {
 	var cl *client
-	for _, c := range s {
-		if c.ClientID == clientID {
-			cl = &c
+	for i := range s {
+		if s[i].ClientID == clientID {
+			cl = &s[i]
 		}
 	}
 	if cl == nil {
 		return false, fmt.Errorf("invalid client")
 	}
-	if cl.RedirectURL == redirectURI {
-		return true, nil
+	return core.MatchRedirectURI(cl.RedirectURL, redirectURI, cl.Public), nil
+}
+
+func (s staticClients) ValidateClientPostLogoutRedirectURI(clientID, redirectURI string) (ok bool, err error) {
+	for _, c := range s {
+		if c.ClientID != clientID {
+			continue
+		}
+		for _, u := range c.PostLogoutRedirectURIs {
+			if u == redirectURI {
+				return true, nil
+			}
+		}
 	}
-	if cl.Public && strings.HasPrefix(redirectURI, "http://localhost") { // hacky but probably fine here
-		return true, nil
+	return false, nil
+}
+
+func (s staticClients) ClientBackchannelLogout(clientID string) (uri string, sessionRequired bool, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.BackchannelLogoutURI, c.BackchannelLogoutSessionRequired, nil
+		}
+	}
+	return "", false, fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientFrontchannelLogout(clientID string) (uri string, sessionRequired bool, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.FrontchannelLogoutURI, c.FrontchannelLogoutSessionRequired, nil
+		}
+	}
+	return "", false, fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientSecret(clientID string) (string, error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.ClientSecret, nil
+		}
+	}
+	return "", fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientJWKS(clientID string) (*jose.JSONWebKeySet, error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.JWKS, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientTLSSubjectDN(clientID string) (subjectDN string, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.TLSClientAuthSubjectDN, nil
+		}
+	}
+	return "", fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientRequestObjectSigningAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.RequestObjectSigningAlg, nil
+		}
+	}
+	return "", fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ValidateClientRequestURI(clientID, requestURI string) (ok bool, err error) {
+	for _, c := range s {
+		if c.ClientID != clientID {
+			continue
+		}
+		for _, u := range c.RequestURIs {
+			if u == requestURI {
+				return true, nil
+			}
+		}
 	}
 	return false, nil
 }
+
+func (s staticClients) ClientUserinfoSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.UserinfoSignedResponseAlg, nil
+		}
+	}
+	return "", fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientIDTokenSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.IDTokenSignedResponseAlg, nil
+		}
+	}
+	return "", fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientIDTokenEncryption(clientID string) (jose.KeyAlgorithm, jose.ContentEncryption, error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.IDTokenEncryptedResponseAlg, c.IDTokenEncryptedResponseEnc, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientAllowServiceTokens(clientID string) (ok bool, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowServiceTokens, nil
+		}
+	}
+	return false, nil
+}
+
+func (s staticClients) ClientAllowClientCredentials(clientID string) (ok bool, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowClientCredentials, nil
+		}
+	}
+	return false, nil
+}
+
+func (s staticClients) ClientAllowTokenExchange(clientID string) (ok bool, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowTokenExchange, nil
+		}
+	}
+	return false, nil
+}
+
+func (s staticClients) ClientAllowedScopes(clientID string) (scopes []string, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowedScopes, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientAllowedResources(clientID string) (resources []string, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowedResources, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientAllowedGrantTypes(clientID string) (grantTypes []string, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowedGrantTypes, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid client")
+}
+
+func (s staticClients) ClientAllowedIPRanges(clientID string) (cidrs []string, err error) {
+	for _, c := range s {
+		if c.ClientID == clientID {
+			return c.AllowedIPRanges, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid client")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pardot/oidc/core"
+)
+
+// cookieOptions configures the cookie the session ID is tracked in, while the
+// user logs in.
+type cookieOptions struct {
+	Name     string
+	Domain   string
+	Path     string
+	MaxAge   int
+	HTTPOnly bool
+	SameSite http.SameSite
+	// Secure marks the cookie secure if the request was received over TLS.
+	Secure bool
+	// ForceSecure marks the cookie secure even if the request looks like
+	// plaintext, e.g when running behind a TLS terminating proxy.
+	ForceSecure bool
+}
+
+// defaultSessionCookie is used if the server has no cookie options set.
+var defaultSessionCookie = cookieOptions{
+	Name:     sessIDCookie,
+	Path:     "/",
+	MaxAge:   600,
+	HTTPOnly: true,
+	SameSite: http.SameSiteLaxMode,
+	Secure:   true,
+}
+
+func (s *server) cookieOptions() cookieOptions {
+	if s.sessionCookie == nil {
+		return defaultSessionCookie
+	}
+	return *s.sessionCookie
+}
+
+// setSessionCookie tracks the session ID in the user's browser.
+func (s *server) setSessionCookie(w http.ResponseWriter, req *http.Request, sessID string) {
+	opts := s.cookieOptions()
+	http.SetCookie(w, &http.Cookie{
+		Name:     opts.Name,
+		Value:    sessID,
+		Domain:   opts.Domain,
+		Path:     opts.Path,
+		MaxAge:   opts.MaxAge,
+		HttpOnly: opts.HTTPOnly,
+		SameSite: opts.SameSite,
+		Secure:   opts.ForceSecure || (opts.Secure && req.TLS != nil),
+	})
+}
+
+// sessionID returns the session ID tracked in the user's browser.
+func (s *server) sessionID(req *http.Request) (string, error) {
+	c, err := req.Cookie(s.cookieOptions().Name)
+	if err != nil {
+		return "", err
+	}
+	return c.Value, nil
+}
+
+// browserSID returns the ID of the user's session with us, issuing a new one
+// if the browser doesn't have one yet. Unlike the session ID, this lasts
+// across logins until the browser is closed, so all the tokens issued to it
+// share the same sid.
+//
+// It doubles as the browser state for session management, so is also set in
+// a cookie the check session iframe can read.
+func (s *server) browserSID(w http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(browserSIDCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	opts := s.cookieOptions()
+	sid := s.storage.NewID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     browserSIDCookie,
+		Value:    sid,
+		Domain:   opts.Domain,
+		Path:     opts.Path,
+		HttpOnly: opts.HTTPOnly,
+		SameSite: opts.SameSite,
+		Secure:   opts.ForceSecure || (opts.Secure && req.TLS != nil),
+	})
+	// the iframe is loaded by the clients' pages, so this must be sent
+	// cross-site.
+	http.SetCookie(w, &http.Cookie{
+		Name:     core.DefaultBrowserStateCookie,
+		Value:    sid,
+		Domain:   opts.Domain,
+		Path:     opts.Path,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+	return sid
+}
+
+// clearBrowserSID ends the user's session with us, so the next login gets a
+// new sid and browser state.
+func (s *server) clearBrowserSID(w http.ResponseWriter) {
+	opts := s.cookieOptions()
+	for _, name := range []string{browserSIDCookie, core.DefaultBrowserStateCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Domain: opts.Domain, Path: opts.Path, MaxAge: -1})
+	}
+}
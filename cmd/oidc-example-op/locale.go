@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+
+	"golang.org/x/text/language"
+)
+
+// templateProvider returns the login page template for a language. lang is
+// one of loginLanguages.
+type templateProvider func(ctx context.Context, lang string) (*template.Template, error)
+
+// loginLanguages are the languages the login page is translated to. The first
+// is the default.
+var loginLanguages = []language.Tag{language.English, language.French}
+
+var languageMatcher = language.NewMatcher(loginLanguages)
+
+// loginStrings are the translations of the login page text, by language.
+var loginStrings = map[string]map[string]string{
+	"en": {
+		"title":    "LOG IN",
+		"heading":  "Log in to IDP",
+		"subject":  "Subject",
+		"scopes":   "Granted Scopes (space delimited)",
+		"amr":      "AMR (comma delimited)",
+		"userinfo": "Userinfo",
+		"submit":   "Submit",
+	},
+	"fr": {
+		"title":    "CONNEXION",
+		"heading":  "Connexion à l'IDP",
+		"subject":  "Sujet",
+		"scopes":   "Scopes accordés (séparés par des espaces)",
+		"amr":      "AMR (séparés par des virgules)",
+		"userinfo": "Infos utilisateur",
+		"submit":   "Valider",
+	},
+}
+
+var loginTmpls = map[string]*template.Template{}
+
+func init() {
+	for _, tag := range loginLanguages {
+		lang := tag.String()
+		strs := loginStrings[lang]
+		loginTmpls[lang] = template.Must(template.New("loginPage").Funcs(template.FuncMap{
+			"t": func(k string) string { return strs[k] },
+		}).Parse(loginPage))
+	}
+}
+
+// defaultTemplates provides the built in login page translations.
+func defaultTemplates(_ context.Context, lang string) (*template.Template, error) {
+	if t, ok := loginTmpls[lang]; ok {
+		return t, nil
+	}
+	return loginTmpls[loginLanguages[0].String()], nil
+}
+
+// negotiateLanguage picks the login page language. The ui_locales the client
+// passed are preferred, falling back to the browser's Accept-Language.
+func negotiateLanguage(uiLocales []string, req *http.Request) string {
+	var prefs []language.Tag
+	for _, l := range uiLocales {
+		// unknown tags are ignored, as the spec asks.
+		if t, err := language.Parse(l); err == nil {
+			prefs = append(prefs, t)
+		}
+	}
+	if al, _, err := language.ParseAcceptLanguage(req.Header.Get("Accept-Language")); err == nil {
+		prefs = append(prefs, al...)
+	}
+
+	_, idx, _ := languageMatcher.Match(prefs...)
+	return loginLanguages[idx].String()
+}
+
+// loginTemplate returns the login page template to render for the request.
+// The built in templates are used if the server's provider has none for the
+// language.
+func (s *server) loginTemplate(req *http.Request, uiLocales []string) (*template.Template, error) {
+	lang := negotiateLanguage(uiLocales, req)
+	if s.templates != nil {
+		t, err := s.templates(req.Context(), lang)
+		if err != nil || t != nil {
+			return t, err
+		}
+	}
+	return defaultTemplates(req.Context(), lang)
+}
@@ -1,44 +1,65 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/pardot/oidc/core"
 	"github.com/pardot/oidc/discovery"
+	"gopkg.in/square/go-jose.v2"
 )
 
 func main() {
+	logRequests := flag.Bool("log-requests", false, "Log each request, with secrets redacted")
+	flag.Parse()
+
 	smgr := newStubSMGR()
 	signer := mustInitSigner()
 
 	clients := staticClients([]client{
 		{
-			ClientID:     "client-id",
-			ClientSecret: "client-secret",
-			RedirectURL:  "http://localhost:8084/callback",
+			ClientID:               "client-id",
+			ClientSecret:           "client-secret",
+			RedirectURL:            "http://localhost:8084/callback",
+			PostLogoutRedirectURIs: []string{"http://localhost:8084/"},
+			AllowTokenExchange:     true,
+			AllowClientCredentials: true,
+			AllowedResources:       []string{"https://api.example.com"},
 		},
 		{
 			ClientID:     "cli",
 			ClientSecret: "cli-client-secret",
+			RedirectURL:  "http://localhost/callback",
 			Public:       true,
 		},
 	})
 
-	oidc, err := core.New(&core.Config{
+	iss := "http://localhost:8085"
+
+	cfg := &core.Config{
+		Issuer:           iss,
+		TokenEndpoint:    iss + "/token",
 		AuthValidityTime: 5 * time.Minute,
 		CodeValidityTime: 5 * time.Minute,
-	}, smgr, clients, signer)
+		RateLimiter:      core.NewTokenBucketLimiter(20, 1*time.Second),
+	}
+	if *logRequests {
+		cfg.RequestLogger = func(e core.RequestLogEntry) {
+			log.Print(e)
+		}
+	}
+
+	oidc, err := core.New(cfg, smgr, clients, signer)
 	if err != nil {
 		log.Fatalf("Failed to create OIDC server instance: %v", err)
 	}
 
-	iss := "http://localhost:8085"
-
 	m := http.NewServeMux()
 
 	svr := &server{
+		issuer:          iss,
 		oidc:            oidc,
 		storage:         smgr,
 		tokenValidFor:   30 * time.Second,
@@ -47,25 +68,83 @@ func main() {
 
 	m.Handle("/", svr)
 
-	md := &discovery.ProviderMetadata{
-		Issuer:                iss,
-		AuthorizationEndpoint: iss + "/auth",
-		TokenEndpoint:         iss + "/token",
-		JWKSURI:               iss + "/jwks.json",
-	}
-
-	discoh, err := discovery.NewConfigurationHandler(md, discovery.WithCoreDefaults())
+	discoh, err := discovery.NewConfigurationHandler(providerMetadata(iss), discovery.WithCoreDefaults())
 	if err != nil {
 		log.Fatalf("Failed to initialize discovery handler: %v", err)
 	}
-	m.Handle("/.well-known/openid-configuration/", discoh)
+	m.Handle(svr.absPath("/.well-known/openid-configuration")+"/", discoh)
 
 	jwksh := discovery.NewKeysHandler(signer, 1*time.Second)
-	m.Handle("/jwks.json", jwksh)
+	m.Handle(svr.absPath("/jwks.json"), jwksh)
+
+	m.Handle("/.well-known/webfinger", discovery.NewWebFingerHandler(iss))
 
 	log.Printf("Listening on: %s", "localhost:8085")
-	err = http.ListenAndServe("localhost:8085", m)
+	err = http.ListenAndServe("localhost:8085", oidc.LogRequests(m))
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// providerMetadata describes the server's endpoints, under the issuer.
+func providerMetadata(iss string) *discovery.ProviderMetadata {
+	return &discovery.ProviderMetadata{
+		Issuer:                iss,
+		AuthorizationEndpoint: iss + "/auth",
+		TokenEndpoint:         iss + "/token",
+		JWKSURI:               iss + "/jwks.json",
+		RevocationEndpoint:    iss + "/revoke",
+		IntrospectionEndpoint: iss + "/introspect",
+		EndSessionEndpoint:    iss + "/end_session",
+		CheckSessionIframe:    iss + "/check_session",
+
+		DeviceAuthorizationEndpoint: iss + "/device/code",
+
+		PushedAuthorizationRequestEndpoint: iss + "/par",
+
+		GrantTypesSupported: []string{
+			"authorization_code",
+			"refresh_token",
+			"urn:ietf:params:oauth:grant-type:device_code",
+			"urn:ietf:params:oauth:grant-type:token-exchange",
+			"client_credentials",
+		},
+
+		// the login form lets any acr be entered, these are for demonstration.
+		ACRValuesSupported: []string{"pwd", "mfa"},
+
+		UILocalesSupported: []string{"en", "fr"},
+
+		DisplayValuesSupported: []string{"page", "popup"},
+
+		IDTokenSigningAlgValuesSupported:    []string{"RS256", "ES256"},
+		IDTokenEncryptionAlgValuesSupported: keyAlgStrings(core.IDTokenEncryptionAlgsSupported),
+		IDTokenEncryptionEncValuesSupported: contentEncStrings(core.IDTokenEncryptionEncsSupported),
+
+		ResponseModesSupported: []string{"query", "fragment", "form_post", "jwt", "query.jwt", "fragment.jwt", "form_post.jwt"},
+
+		RequestParameterSupported:    true,
+		RequestURIParameterSupported: true,
+
+		BackchannelLogoutSupported: true,
+
+		FrontchannelLogoutSupported:        true,
+		FrontchannelLogoutSessionSupported: true,
+	}
+}
+
+func keyAlgStrings(algs []jose.KeyAlgorithm) []string {
+	var ret []string
+	for _, a := range algs {
+		ret = append(ret, string(a))
+	}
+	return ret
+}
+
+func contentEncStrings(encs []jose.ContentEncryption) []string {
+	var ret []string
+	for _, e := range encs {
+		ret = append(ret, string(e))
+	}
+	return ret
+}
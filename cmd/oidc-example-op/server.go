@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
+	"net/url"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -16,83 +19,152 @@ import (
 
 const (
 	sessIDCookie = "sessID"
+	// browserSIDCookie tracks the user's session with us across logins, for
+	// the sid claim.
+	browserSIDCookie = "sid"
 )
 
 type server struct {
+	// issuer the server is serving as. It may have a path, which all the
+	// server's endpoints are under.
+	issuer          string
 	oidc            *core.OIDC
 	mux             *http.ServeMux
 	muxSetup        sync.Once
 	storage         *storage
 	tokenValidFor   time.Duration
 	refreshValidFor time.Duration
+	// sessionCookie configures the session ID cookie. If nil,
+	// defaultSessionCookie is used.
+	sessionCookie *cookieOptions
+	// templates provides the login page for the negotiated language. If nil,
+	// or it has none for the language, the built in translations are used.
+	templates templateProvider
 }
 
+// loginPage is rendered with a "t" function, that returns the page's text
+// translated to the negotiated language. The display the client asked for is
+// passed as .display, popups get a compact variant of the page.
 const loginPage = `<!DOCTYPE html>
 <html>
 	<head>
 		<meta charset="UTF-8">
-		<title>LOG IN</title>
+		<title>{{ t "title" }}</title>
+		{{- if eq .display "popup" }}
+		<style>body { margin: 0.5em; font-size: small; }</style>
+		{{- end }}
 	</head>
-	<body>
-		<h1>Log in to IDP</h1>
-		<form action="/finish" method="POST">
-			<p>Subject: <input type="text" name="subject" value="auser" required size="15"></p>
-			<p>Granted Scopes (space delimited): <input type="text" name="scopes" value="{{ .scopes }}" size="15"></p>
-			<p>ACR: <input type="text" name="acr" size="15"></p>
-			<p>AMR (comma delimited): <input type="text" name="amr" value="{{ .amr }}" size="15"></p>
-			<p>Userinfo: <textarea name="userinfo" rows="10" cols="30">{"name": "A User"}</textarea></p>
-    		<input type="submit" value="Submit">
+	<body class="display-{{ .display }}">
+		{{- if ne .display "popup" }}
+		<h1>{{ t "heading" }}</h1>
+		{{- end }}
+		<form action="{{ .action }}" method="POST">
+			<input type="hidden" name="csrf_token" value="{{ .csrfToken }}">
+			<p>{{ t "subject" }}: <input type="text" name="subject" value="{{ .subject }}" required size="15"></p>
+			<p>{{ t "scopes" }}: <input type="text" name="scopes" value="{{ .scopes }}" size="15"></p>
+			<p>ACR: <input type="text" name="acr" value="{{ .acr }}" size="15"></p>
+			<p>{{ t "amr" }}: <input type="text" name="amr" value="{{ .amr }}" size="15"></p>
+			<p>{{ t "userinfo" }}: <textarea name="userinfo" rows="10" cols="30">{"name": "A User"}</textarea></p>
+    		<input type="submit" value="{{ t "submit" }}">
 		</form>
 	</body>
 </html>`
 
-var loginTmpl = template.Must(template.New("loginPage").Parse(loginPage))
-
 func (s *server) authorization(w http.ResponseWriter, req *http.Request) {
 	ar, err := s.oidc.StartAuthorization(w, req)
 	if err != nil {
 		return
 	}
 
-	// set a cookie with the auth ID, so we can track it.
-	aidc := &http.Cookie{
-		Name:   sessIDCookie,
-		Value:  ar.SessionID,
-		MaxAge: 600,
+	// we have no way of logging a user in silently, so always reject these.
+	for _, p := range ar.Prompt {
+		if p == core.PromptNone {
+			if err := s.oidc.RejectAuthorization(w, req, ar.SessionID, core.AuthorizationErrorLoginRequired, "user must log in"); err != nil {
+				log.Printf("error rejecting authorization: %v", err)
+			}
+			return
+		}
 	}
-	http.SetCookie(w, aidc)
+
+	// set a cookie with the auth ID, so we can track it.
+	s.setSessionCookie(w, req, ar.SessionID)
 
 	var acr string
 	if len(ar.ACRValues) > 0 {
 		acr = ar.ACRValues[0]
 	}
+	// prefill the subject with who the client thinks is logging in. An
+	// upstream IDP would be passed this as its login_hint.
+	subject := "auser"
+	if ar.LoginHint != "" {
+		subject = ar.LoginHint
+	}
 	tmplData := map[string]interface{}{
-		"acr":    acr,
-		"scopes": strings.Join(ar.Scopes, " "),
+		"action":    s.absPath("/finish"),
+		"subject":   subject,
+		"acr":       acr,
+		"scopes":    strings.Join(ar.Scopes, " "),
+		"csrfToken": s.issueCSRFToken(ar.SessionID),
+		"display":   string(ar.Display),
 	}
 
-	if err := loginTmpl.Execute(w, tmplData); err != nil {
+	tmpl, err := s.loginTemplate(req, ar.UILocales)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// core has already set the security headers for this page.
+	if err := tmpl.Execute(w, tmplData); err != nil {
 		http.Error(w, fmt.Sprintf("failed to render template: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
 func (s *server) finishAuthorization(w http.ResponseWriter, req *http.Request) {
-	sessID, err := req.Cookie(sessIDCookie)
+	sessID, err := s.sessionID(req)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to get auth id cookie: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	auth, ok := s.authorizationFromForm(w, req, sessID)
+	if !ok {
+		return
+	}
+
+	// finalize it. this will redirect the user to the appropriate place
+	if err := s.oidc.FinishAuthorization(w, req, sessID, auth); err != nil {
+		log.Printf("error finishing authorization: %v", err)
+	}
+}
+
+// authorizationFromForm reads the submitted login form, tracking the metadata
+// against the session. If this returns false, an error has been written to
+// the user.
+func (s *server) authorizationFromForm(w http.ResponseWriter, req *http.Request, sessID string) (*core.Authorization, bool) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if !s.verifyCSRFToken(sessID, req.PostFormValue("csrf_token")) {
+		http.Error(w, "invalid or missing CSRF token", http.StatusBadRequest)
+		return nil, false
+	}
+
 	var amr []string
 	if req.FormValue("amr") != "" {
 		amr = strings.Split(req.FormValue("amr"), ",")
 	}
 
+	sid := s.browserSID(w, req)
 	auth := &core.Authorization{
-		Scopes: strings.Split(req.FormValue("scopes"), " "),
-		ACR:    req.FormValue("acr"),
-		AMR:    amr,
+		Scopes:       strings.Split(req.FormValue("scopes"), " "),
+		ACR:          req.FormValue("acr"),
+		AMR:          amr,
+		SID:          sid,
+		Subject:      req.FormValue("subject"),
+		BrowserState: sid,
+		TokenHandler: s.issueTokens,
 	}
 
 	// We have the session ID. This is stable for the session, so we can track
@@ -105,43 +177,323 @@ func (s *server) finishAuthorization(w http.ResponseWriter, req *http.Request) {
 	}
 	if err := json.Unmarshal([]byte(req.FormValue("userinfo")), &meta.Userinfo); err != nil {
 		http.Error(w, fmt.Sprintf("failed to unmarshal userinfo: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	s.storage.sessions[sessID].Meta = meta
+
+	return auth, true
+}
+
+// issueCSRFToken generates a token for the login page rendered for the
+// session, storing it alongside the session so the submission can be checked
+// against it.
+func (s *server) issueCSRFToken(sessID string) string {
+	tok := s.storage.NewID()
+	if sess, ok := s.storage.sessions[sessID]; ok {
+		sess.CSRFToken = tok
+	}
+	return tok
+}
+
+// verifyCSRFToken checks the submitted token matches the one issued for the
+// session. Tokens can only be used once.
+func (s *server) verifyCSRFToken(sessID, token string) bool {
+	sess, ok := s.storage.sessions[sessID]
+	if !ok || sess.CSRFToken == "" || token == "" {
+		return false
+	}
+	want := sess.CSRFToken
+	sess.CSRFToken = ""
+	return subtle.ConstantTimeCompare([]byte(want), []byte(token)) == 1
+}
+
+// setNoFrameHeaders prevents the page being framed by another site, to guard
+// against clickjacking on the device login pages. The authorization endpoint
+// gets these from core.
+func setNoFrameHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+}
+
+const deviceVerifyPage = `<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>DEVICE LOG IN</title>
+	</head>
+	<body>
+		<h1>Enter the code shown on your device</h1>
+		<form action="{{ .action }}" method="POST">
+			<p>Code: <input type="text" name="user_code" value="{{ .userCode }}" required size="15"></p>
+    		<input type="submit" value="Submit">
+		</form>
+	</body>
+</html>`
+
+var deviceVerifyTmpl = template.Must(template.New("deviceVerifyPage").Parse(deviceVerifyPage))
+
+func (s *server) pushedAuthorization(w http.ResponseWriter, req *http.Request) {
+	if err := s.oidc.PushedAuthorization(w, req); err != nil {
+		log.Printf("error in pushed authorization request endpoint: %v", err)
+	}
+}
+
+func (s *server) deviceAuthorization(w http.ResponseWriter, req *http.Request) {
+	if err := s.oidc.DeviceAuthorization(w, req, s.absURL("/device")); err != nil {
+		log.Printf("error in device authorization endpoint: %v", err)
+	}
+}
+
+// deviceVerify prompts the user for the code displayed on their device, and
+// once they've entered it has them log in.
+func (s *server) deviceVerify(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		setNoFrameHeaders(w)
+		tmplData := map[string]interface{}{
+			"action":   s.absPath("/device"),
+			"userCode": req.FormValue("user_code"),
+		}
+		if err := deviceVerifyTmpl.Execute(w, tmplData); err != nil {
+			http.Error(w, fmt.Sprintf("failed to render template: %v", err), http.StatusInternalServerError)
+		}
 		return
 	}
-	s.storage.sessions[sessID.Value].Meta = meta
 
-	// finalize it. this will redirect the user to the appropriate place
-	if err := s.oidc.FinishAuthorization(w, req, sessID.Value, auth); err != nil {
-		log.Printf("error finishing authorization: %v", err)
+	ar, err := s.oidc.VerifyUserCode(req.Context(), req.FormValue("user_code"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to verify user code: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if ar == nil {
+		http.Error(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
+
+	s.setSessionCookie(w, req, ar.SessionID)
+
+	tmplData := map[string]interface{}{
+		"action":    s.absPath("/device/finish"),
+		"scopes":    strings.Join(ar.Scopes, " "),
+		"csrfToken": s.issueCSRFToken(ar.SessionID),
+		"display":   string(core.DisplayPage),
+	}
+	tmpl, err := s.loginTemplate(req, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	setNoFrameHeaders(w)
+	if err := tmpl.Execute(w, tmplData); err != nil {
+		http.Error(w, fmt.Sprintf("failed to render template: %v", err), http.StatusInternalServerError)
+		return
 	}
 }
 
-func (s *server) token(w http.ResponseWriter, req *http.Request) {
-	err := s.oidc.Token(w, req, func(tr *core.TokenRequest) (*core.TokenResponse, error) {
-		// This is how we could update our metadata
-		meta := s.storage.sessions[tr.SessionID].Meta
-		s.storage.sessions[tr.SessionID].Meta = meta
+func (s *server) finishDeviceAuthorization(w http.ResponseWriter, req *http.Request) {
+	sessID, err := s.sessionID(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get auth id cookie: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	auth, ok := s.authorizationFromForm(w, req, sessID)
+	if !ok {
+		return
+	}
+
+	if err := s.oidc.FinishAuthorization(w, req, sessID, auth); err != nil {
+		log.Printf("error finishing device authorization: %v", err)
+		return
+	}
+
+	_, _ = w.Write([]byte("Device authorized, you can return to your device"))
+}
 
-		idt := tr.PrefillIDToken("http://localhost:8085", "subject", time.Now().Add(s.tokenValidFor))
+func (s *server) token(w http.ResponseWriter, req *http.Request) {
+	if err := s.oidc.Token(w, req, s.issueTokens); err != nil {
+		log.Printf("error in token endpoint: %v", err)
+	}
+}
 
+// issueTokens builds the tokens for the session. This is used by the token
+// endpoint, and for hybrid flow requests at the authorization endpoint.
+func (s *server) issueTokens(tr *core.TokenRequest) (*core.TokenResponse, error) {
+	// exchanged and client credentials tokens have no user session, so all
+	// we need to decide is how long they last.
+	if tr.TokenExchange != nil || tr.GrantType == core.GrantTypeClientCredentials {
 		return &core.TokenResponse{
-			AccessTokenValidUntil:  time.Now().Add(s.tokenValidFor),
-			RefreshTokenValidUntil: time.Now().Add(s.refreshValidFor),
-			IssueRefreshToken:      tr.SessionRefreshable, // always allow it if we want it
-			IDToken:                idt,
+			AccessTokenValidUntil: time.Now().Add(s.tokenValidFor),
+		}, nil
+	}
+
+	// This is how we could update our metadata
+	meta := s.storage.sessions[tr.SessionID].Meta
+	s.storage.sessions[tr.SessionID].Meta = meta
+
+	if tr.Authorization.SID != "" {
+		s.storage.recordLogin(tr.Authorization.SID, tr.ClientID)
+	}
+
+	idt := tr.PrefillIDToken(s.issuer, "subject", time.Now().Add(s.tokenValidFor))
+
+	return &core.TokenResponse{
+		AccessTokenValidUntil:  time.Now().Add(s.tokenValidFor),
+		RefreshTokenValidUntil: time.Now().Add(s.refreshValidFor),
+		IssueRefreshToken:      tr.SessionRefreshable, // always allow it if we want it
+		IDToken:                idt,
+	}, nil
+}
+
+func (s *server) revoke(w http.ResponseWriter, req *http.Request) {
+	if err := s.oidc.Revoke(w, req); err != nil {
+		log.Printf("error in revocation endpoint: %v", err)
+	}
+}
+
+func (s *server) introspect(w http.ResponseWriter, req *http.Request) {
+	err := s.oidc.Introspect(w, req, func(_ *core.IntrospectionRequest) (*core.IntrospectionResponse, error) {
+		return &core.IntrospectionResponse{
+			Issuer:  s.issuer,
+			Subject: "subject",
 		}, nil
 	})
 	if err != nil {
-		log.Printf("error in token endpoint: %v", err)
+		log.Printf("error in introspection endpoint: %v", err)
+	}
+}
+
+// logoutPage notifies the clients that took part in the session via the
+// front-channel, by loading their logout URIs in hidden iframes. If the client
+// asked for the user to be sent back, the page moves on once they've loaded.
+const logoutPage = `<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>LOGGED OUT</title>
+		{{- if .continue }}
+		<meta http-equiv="refresh" content="2;url={{ .continue }}">
+		{{- end }}
+	</head>
+	<body>
+		<p>Logged out</p>
+		{{- range .frontchannelURIs }}
+		<iframe src="{{ . }}" style="display: none"></iframe>
+		{{- end }}
+	</body>
+</html>`
+
+var logoutTmpl = template.Must(template.New("logoutPage").Parse(logoutPage))
+
+func (s *server) endSession(w http.ResponseWriter, req *http.Request) {
+	err := s.oidc.EndSession(w, req, func(w http.ResponseWriter, esreq *core.EndSessionRequest) error {
+		// we have no login session to clear here, but we can let the client
+		// the hint was issued to know via the back-channel.
+		if esreq.IDTokenHint != nil {
+			if err := s.oidc.BackchannelLogout(req.Context(), &core.BackchannelLogoutRequest{
+				Issuer:    s.issuer,
+				Subject:   esreq.IDTokenHint.Subject,
+				ClientIDs: esreq.IDTokenHint.Audience,
+			}); err != nil {
+				log.Printf("error in back-channel logout: %v", err)
+			}
+		}
+
+		// the clients that were issued tokens in this browser session can be
+		// told via the front-channel.
+		var frontchannelURIs []string
+		if c, err := req.Cookie(browserSIDCookie); err == nil && c.Value != "" {
+			frontchannelURIs, err = s.oidc.FrontchannelLogoutURIs(req.Context(), &core.FrontchannelLogoutRequest{
+				Issuer:    s.issuer,
+				SID:       c.Value,
+				ClientIDs: s.storage.logins[c.Value],
+			})
+			if err != nil {
+				log.Printf("error in front-channel logout: %v", err)
+			}
+			delete(s.storage.logins, c.Value)
+			s.clearBrowserSID(w)
+		}
+
+		if len(frontchannelURIs) == 0 {
+			if esreq.PostLogoutRedirectURI == "" {
+				_, _ = w.Write([]byte("Logged out"))
+			}
+			return nil
+		}
+
+		// we render the page, and send the user on from it.
+		tmplData := map[string]interface{}{
+			"continue":         esreq.PostLogoutRedirect(),
+			"frontchannelURIs": frontchannelURIs,
+		}
+		esreq.PostLogoutRedirectURI = ""
+		w.Header().Set("Content-Security-Policy", w.Header().Get("Content-Security-Policy")+"; frame-src "+frameSources(frontchannelURIs))
+		return logoutTmpl.Execute(w, tmplData)
+	})
+	if err != nil {
+		log.Printf("error in end session endpoint: %v", err)
+	}
+}
+
+// frameSources returns the origins of the URIs, for the frame-src of the
+// logout page's Content-Security-Policy.
+func frameSources(uris []string) string {
+	var srcs []string
+	for _, u := range uris {
+		pu, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		srcs = append(srcs, pu.Scheme+"://"+pu.Host)
+	}
+	return strings.Join(srcs, " ")
+}
+
+func (s *server) checkSession(w http.ResponseWriter, req *http.Request) {
+	if err := s.oidc.CheckSessionIframe(w, req); err != nil {
+		log.Printf("error serving check session iframe: %v", err)
+	}
+}
+
+func (s *server) readiness(w http.ResponseWriter, req *http.Request) {
+	if err := s.oidc.Readiness(w, req); err != nil {
+		log.Printf("readiness check failed: %v", err)
 	}
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.muxSetup.Do(func() {
 		s.mux = http.NewServeMux()
-		s.mux.HandleFunc("/auth", s.authorization)
-		s.mux.HandleFunc("/finish", s.finishAuthorization)
-		s.mux.HandleFunc("/token", s.token)
+		s.mux.HandleFunc(s.absPath("/auth"), s.authorization)
+		s.mux.HandleFunc(s.absPath("/finish"), s.finishAuthorization)
+		s.mux.HandleFunc(s.absPath("/token"), s.token)
+		s.mux.HandleFunc(s.absPath("/revoke"), s.revoke)
+		s.mux.HandleFunc(s.absPath("/introspect"), s.introspect)
+		s.mux.HandleFunc(s.absPath("/end_session"), s.endSession)
+		s.mux.HandleFunc(s.absPath("/check_session"), s.checkSession)
+		s.mux.HandleFunc(s.absPath("/par"), s.pushedAuthorization)
+		s.mux.HandleFunc(s.absPath("/device/code"), s.deviceAuthorization)
+		s.mux.HandleFunc(s.absPath("/device"), s.deviceVerify)
+		s.mux.HandleFunc(s.absPath("/device/finish"), s.finishDeviceAuthorization)
+		s.mux.HandleFunc(s.absPath("/healthz"), s.oidc.Liveness)
+		s.mux.HandleFunc(s.absPath("/readyz"), s.readiness)
 	})
 
 	s.mux.ServeHTTP(w, req)
 }
+
+// absURL returns the absolute URL of the server's endpoint at path p.
+func (s *server) absURL(p string) string {
+	return strings.TrimSuffix(s.issuer, "/") + p
+}
+
+// absPath returns the path of the server's endpoint at p, including the
+// issuer's path. This should be used for any link or form action, so they
+// work if the issuer has a path prefix.
+func (s *server) absPath(p string) string {
+	u, err := url.Parse(s.issuer)
+	if err != nil {
+		return p
+	}
+	return path.Join("/", u.Path, p)
+}
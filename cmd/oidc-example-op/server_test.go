@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc/core"
+	"github.com/pardot/oidc/discovery"
+)
+
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	smgr := newStubSMGR()
+	clients := staticClients([]client{
+		{
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+			RedirectURL:  "https://redirect",
+		},
+	})
+	oidc, err := core.New(&core.Config{
+		AuthValidityTime: 1 * time.Minute,
+		CodeValidityTime: 1 * time.Minute,
+	}, smgr, clients, mustInitSigner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &server{
+		oidc:            oidc,
+		storage:         smgr,
+		tokenValidFor:   1 * time.Minute,
+		refreshValidFor: 5 * time.Minute,
+	}
+}
+
+func authRequestURL() string {
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"client-id"},
+		"redirect_uri":  {"https://redirect"},
+		"scope":         {"openid"},
+	}
+	return "/auth?" + q.Encode()
+}
+
+func TestLoginCSRF(t *testing.T) {
+	svr := newTestServer(t)
+
+	csrfRE := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+	startLogin := func(t *testing.T) (*http.Cookie, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		svr.ServeHTTP(rec, httptest.NewRequest("GET", authRequestURL(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want 200 rendering login, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Frame-Options"); got != "DENY" {
+			t.Errorf("want X-Frame-Options DENY, got: %q", got)
+		}
+		m := csrfRE.FindStringSubmatch(rec.Body.String())
+		if m == nil {
+			t.Fatal("login page has no CSRF token")
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("want 1 cookie, got %d", len(cookies))
+		}
+		return cookies[0], m[1]
+	}
+
+	finish := func(cookie *http.Cookie, token string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"subject":  {"auser"},
+			"scopes":   {"openid"},
+			"userinfo": {"{}"},
+		}
+		if token != "" {
+			form.Set("csrf_token", token)
+		}
+		req := httptest.NewRequest("POST", "/finish", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		svr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("forged without token", func(t *testing.T) {
+		cookie, _ := startLogin(t)
+		if rec := finish(cookie, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("want 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		cookie, _ := startLogin(t)
+		if rec := finish(cookie, "forged"); rec.Code != http.StatusBadRequest {
+			t.Errorf("want 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("valid token", func(t *testing.T) {
+		cookie, token := startLogin(t)
+		rec := finish(cookie, token)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("want 302, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !strings.HasPrefix(rec.Header().Get("location"), "https://redirect") {
+			t.Errorf("want redirect to client, got: %s", rec.Header().Get("location"))
+		}
+	})
+
+	t.Run("token reused", func(t *testing.T) {
+		cookie, token := startLogin(t)
+		// a failed submission still uses the token up
+		if rec := finish(cookie, token+"x"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("want 400, got %d", rec.Code)
+		}
+		if rec := finish(cookie, token); rec.Code != http.StatusBadRequest {
+			t.Errorf("want 400 reusing token, got %d", rec.Code)
+		}
+	})
+}
+
+func TestSessionCookie(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Options *cookieOptions
+		TLS     bool
+		Want    http.Cookie
+	}{
+		{
+			Name: "Default over plaintext",
+			Want: http.Cookie{Name: "sessID", Path: "/", MaxAge: 600, HttpOnly: true, SameSite: http.SameSiteLaxMode},
+		},
+		{
+			Name: "Default over TLS",
+			TLS:  true,
+			Want: http.Cookie{Name: "sessID", Path: "/", MaxAge: 600, HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: true},
+		},
+		{
+			Name: "Forced secure behind a proxy",
+			Options: &cookieOptions{
+				Name:        "op-session",
+				Domain:      "example.com",
+				Path:        "/login",
+				MaxAge:      60,
+				HTTPOnly:    true,
+				SameSite:    http.SameSiteStrictMode,
+				ForceSecure: true,
+			},
+			Want: http.Cookie{Name: "op-session", Domain: "example.com", Path: "/login", MaxAge: 60, HttpOnly: true, SameSite: http.SameSiteStrictMode, Secure: true},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			svr := newTestServer(t)
+			svr.sessionCookie = tc.Options
+
+			req := httptest.NewRequest("GET", authRequestURL(), nil)
+			if tc.TLS {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			svr.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("want 1 cookie, got %d", len(cookies))
+			}
+			got := *cookies[0]
+			if got.Value == "" {
+				t.Error("want session ID in cookie")
+			}
+			got.Value, got.Raw = "", ""
+			if diff := cmp.Diff(tc.Want, got); diff != "" {
+				t.Errorf("unexpected cookie: %s", diff)
+			}
+		})
+	}
+}
+
+func TestLoginHint(t *testing.T) {
+	svr := newTestServer(t)
+
+	subjectRE := regexp.MustCompile(`name="subject" value="([^"]*)"`)
+
+	for _, tc := range []struct {
+		Name        string
+		Hint        string
+		WantSubject string
+	}{
+		{
+			Name:        "No hint",
+			WantSubject: "auser",
+		},
+		{
+			Name:        "Hint prefills subject",
+			Hint:        "user@example.com",
+			WantSubject: "user@example.com",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			u := authRequestURL()
+			if tc.Hint != "" {
+				u += "&login_hint=" + url.QueryEscape(tc.Hint)
+			}
+			rec := httptest.NewRecorder()
+			svr.ServeHTTP(rec, httptest.NewRequest("GET", u, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want 200 rendering login, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			m := subjectRE.FindStringSubmatch(rec.Body.String())
+			if m == nil {
+				t.Fatal("login page has no subject field")
+			}
+			if m[1] != tc.WantSubject {
+				t.Errorf("want subject prefilled with %q, got %q", tc.WantSubject, m[1])
+			}
+		})
+	}
+}
+
+func TestLoginLocale(t *testing.T) {
+	svr := newTestServer(t)
+
+	for _, tc := range []struct {
+		Name           string
+		UILocales      string
+		AcceptLanguage string
+		WantTitle      string
+	}{
+		{
+			Name:      "Default",
+			WantTitle: "LOG IN",
+		},
+		{
+			Name:      "ui_locales selects French",
+			UILocales: "fr",
+			WantTitle: "CONNEXION",
+		},
+		{
+			Name:           "ui_locales preferred over Accept-Language",
+			UILocales:      "en",
+			AcceptLanguage: "fr",
+			WantTitle:      "LOG IN",
+		},
+		{
+			Name:           "Accept-Language used without ui_locales",
+			AcceptLanguage: "fr-CA,fr;q=0.9",
+			WantTitle:      "CONNEXION",
+		},
+		{
+			Name:      "Unsupported locale falls back",
+			UILocales: "de",
+			WantTitle: "LOG IN",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			u := authRequestURL()
+			if tc.UILocales != "" {
+				u += "&ui_locales=" + url.QueryEscape(tc.UILocales)
+			}
+			req := httptest.NewRequest("GET", u, nil)
+			if tc.AcceptLanguage != "" {
+				req.Header.Set("Accept-Language", tc.AcceptLanguage)
+			}
+			rec := httptest.NewRecorder()
+			svr.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want 200 rendering login, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			if want := "<title>" + tc.WantTitle + "</title>"; !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("want login page with %s, got: %s", want, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("Provider overrides", func(t *testing.T) {
+		svr := newTestServer(t)
+		custom := template.Must(template.New("custom").Parse(`<title>CUSTOM</title>`))
+		svr.templates = func(_ context.Context, lang string) (*template.Template, error) {
+			if lang == "fr" {
+				return custom, nil
+			}
+			return nil, nil
+		}
+
+		for lang, want := range map[string]string{"fr": "CUSTOM", "en": "LOG IN"} {
+			rec := httptest.NewRecorder()
+			svr.ServeHTTP(rec, httptest.NewRequest("GET", authRequestURL()+"&ui_locales="+lang, nil))
+			if !strings.Contains(rec.Body.String(), "<title>"+want+"</title>") {
+				t.Errorf("want %s page for %s, got: %s", want, lang, rec.Body.String())
+			}
+		}
+	})
+}
+
+func TestLoginDisplay(t *testing.T) {
+	for _, tc := range []struct {
+		Name        string
+		Display     string
+		WantDisplay string
+		WantHeading bool
+	}{
+		{
+			Name:        "Default",
+			WantDisplay: "page",
+			WantHeading: true,
+		},
+		{
+			Name:        "Popup",
+			Display:     "popup",
+			WantDisplay: "popup",
+			WantHeading: false,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			u := authRequestURL()
+			if tc.Display != "" {
+				u += "&display=" + url.QueryEscape(tc.Display)
+			}
+
+			svr := newTestServer(t)
+			rec := httptest.NewRecorder()
+			svr.ServeHTTP(rec, httptest.NewRequest("GET", u, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want 200 rendering login, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := strings.Contains(rec.Body.String(), "<h1>"); got != tc.WantHeading {
+				t.Errorf("want heading %t, got: %s", tc.WantHeading, rec.Body.String())
+			}
+
+			svr = newTestServer(t)
+			custom := template.Must(template.New("custom").Parse(`{{ .display }}`))
+			svr.templates = func(_ context.Context, _ string) (*template.Template, error) {
+				return custom, nil
+			}
+			rec = httptest.NewRecorder()
+			svr.ServeHTTP(rec, httptest.NewRequest("GET", u, nil))
+			if got := rec.Body.String(); got != tc.WantDisplay {
+				t.Errorf("want template display %q, got: %q", tc.WantDisplay, got)
+			}
+		})
+	}
+}
+
+func TestIssuerPathPrefix(t *testing.T) {
+	const iss = "https://host/oidc"
+
+	svr := newTestServer(t)
+	svr.issuer = iss
+
+	t.Run("Discovery", func(t *testing.T) {
+		discoh, err := discovery.NewConfigurationHandler(providerMetadata(iss), discovery.WithCoreDefaults())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		discoh.ServeHTTP(rec, httptest.NewRequest("GET", svr.absPath("/.well-known/openid-configuration"), nil))
+
+		var md discovery.ProviderMetadata
+		if err := json.Unmarshal(rec.Body.Bytes(), &md); err != nil {
+			t.Fatal(err)
+		}
+		for name, got := range map[string]string{
+			"authorization_endpoint": md.AuthorizationEndpoint,
+			"token_endpoint":         md.TokenEndpoint,
+			"jwks_uri":               md.JWKSURI,
+			"device_authorization":   md.DeviceAuthorizationEndpoint,
+		} {
+			if !strings.HasPrefix(got, iss+"/") {
+				t.Errorf("want %s under %s, got %s", name, iss, got)
+			}
+		}
+	})
+
+	actionRE := regexp.MustCompile(`<form action="([^"]*)"`)
+	for _, tc := range []struct {
+		Name       string
+		Path       string
+		WantAction string
+	}{
+		{
+			Name:       "Login form",
+			Path:       "/oidc" + authRequestURL(),
+			WantAction: "/oidc/finish",
+		},
+		{
+			Name:       "Device verification form",
+			Path:       "/oidc/device",
+			WantAction: "/oidc/device",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			svr.ServeHTTP(rec, httptest.NewRequest("GET", tc.Path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			m := actionRE.FindStringSubmatch(rec.Body.String())
+			if m == nil {
+				t.Fatal("page has no form")
+			}
+			if m[1] != tc.WantAction {
+				t.Errorf("want form action %s, got %s", tc.WantAction, m[1])
+			}
+		})
+	}
+
+	t.Run("Unprefixed paths not served", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		svr.ServeHTTP(rec, httptest.NewRequest("GET", authRequestURL(), nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("want 404 outside the issuer path, got %d", rec.Code)
+		}
+	})
+}
+
+// login runs through the code flow for the client in the browser with the sid
+// cookie, returning the ID token's claims and the browser's sid cookie.
+func login(t *testing.T, svr *server, cl client, sidCookie *http.Cookie) (map[string]interface{}, *http.Cookie) {
+	t.Helper()
+
+	csrfRE := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {cl.ClientID},
+		"redirect_uri":  {cl.RedirectURL},
+		"scope":         {"openid"},
+	}
+	rec := httptest.NewRecorder()
+	svr.ServeHTTP(rec, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil))
+	m := csrfRE.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("login page has no CSRF token: %s", rec.Body.String())
+	}
+	sessCookie := rec.Result().Cookies()[0]
+
+	form := url.Values{
+		"subject":    {"auser"},
+		"scopes":     {"openid"},
+		"userinfo":   {"{}"},
+		"csrf_token": {m[1]},
+	}
+	req := httptest.NewRequest("POST", "/finish", strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.AddCookie(sessCookie)
+	if sidCookie != nil {
+		req.AddCookie(sidCookie)
+	}
+	rec = httptest.NewRecorder()
+	svr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("want 302 finishing login, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == browserSIDCookie {
+			sidCookie = c
+		}
+	}
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form = url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {loc.Query().Get("code")},
+		"redirect_uri": {cl.RedirectURL},
+	}
+	req = httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(cl.ClientID, cl.ClientSecret)
+	rec = httptest.NewRecorder()
+	svr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200 from token endpoint, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var tresp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &tresp); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(tresp.IDToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed id token: %s", tresp.IDToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims, sidCookie
+}
+
+func TestSIDClaim(t *testing.T) {
+	svr := newTestServer(t)
+	cl := client{ClientID: "client-id", ClientSecret: "client-secret", RedirectURL: "https://redirect"}
+
+	claims, sidCookie := login(t, svr, cl, nil)
+	sid1, _ := claims["sid"].(string)
+	if sid1 == "" {
+		t.Fatal("want sid in id token")
+	}
+	if sidCookie == nil {
+		t.Fatal("want sid cookie set")
+	}
+
+	claims, _ = login(t, svr, cl, sidCookie)
+	if sid2 := claims["sid"]; sid2 != sid1 {
+		t.Errorf("want logins in the same browser to share sid %s, got: %v", sid1, sid2)
+	}
+
+	claims, _ = login(t, svr, cl, nil)
+	if claims["sid"] == sid1 {
+		t.Error("want a new browser to get a new sid")
+	}
+}
+
+func TestFrontchannelLogout(t *testing.T) {
+	clients := staticClients([]client{
+		{
+			ClientID:              "client-a",
+			ClientSecret:          "secret-a",
+			RedirectURL:           "https://a/callback",
+			FrontchannelLogoutURI: "https://a/logout",
+		},
+		{
+			ClientID:                          "client-b",
+			ClientSecret:                      "secret-b",
+			RedirectURL:                       "https://b/callback",
+			FrontchannelLogoutURI:             "https://b/logout",
+			FrontchannelLogoutSessionRequired: true,
+		},
+		{
+			ClientID:     "client-c",
+			ClientSecret: "secret-c",
+			RedirectURL:  "https://c/callback",
+		},
+	})
+	svr := newTestServer(t)
+	smgr := newStubSMGR()
+	oidc, err := core.New(&core.Config{
+		AuthValidityTime: 1 * time.Minute,
+		CodeValidityTime: 1 * time.Minute,
+	}, smgr, clients, mustInitSigner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.oidc = oidc
+	svr.storage = smgr
+	svr.issuer = "https://issuer"
+
+	_, sidCookie := login(t, svr, clients[0], nil)
+	for _, cl := range clients[1:] {
+		login(t, svr, cl, sidCookie)
+	}
+
+	req := httptest.NewRequest("GET", "/end_session", nil)
+	req.AddCookie(sidCookie)
+	rec := httptest.NewRecorder()
+	svr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200 rendering logout, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var got []string
+	for _, m := range regexp.MustCompile(`<iframe src="([^"]+)"`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		got = append(got, html.UnescapeString(m[1]))
+	}
+	want := []string{
+		"https://a/logout?iss=https%3A%2F%2Fissuer&sid=" + url.QueryEscape(sidCookie.Value),
+		"https://b/logout?iss=https%3A%2F%2Fissuer&sid=" + url.QueryEscape(sidCookie.Value),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected iframes: %s", diff)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-src https://a https://b") {
+		t.Errorf("want CSP to allow the iframes, got: %s", csp)
+	}
+
+	// the session has ended, so logging out again notifies no one.
+	rec = httptest.NewRecorder()
+	svr.ServeHTTP(rec, req)
+	if strings.Contains(rec.Body.String(), "<iframe") {
+		t.Errorf("want no iframes after the session ended, got: %s", rec.Body.String())
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 
@@ -14,10 +16,22 @@ func mustInitSigner() *signer.StaticSigner {
 		panic(err)
 	}
 
-	signingKey := jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{
-		Key:   key,
-		KeyID: "testkey",
-	}}
+	// clients can register to have their ID tokens signed with ES256
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	signingKeys := []jose.SigningKey{
+		{Algorithm: jose.RS256, Key: &jose.JSONWebKey{
+			Key:   key,
+			KeyID: "testkey",
+		}},
+		{Algorithm: jose.ES256, Key: &jose.JSONWebKey{
+			Key:   ecKey,
+			KeyID: "testkey-ec",
+		}},
+	}
 
 	verificationKeys := []jose.JSONWebKey{
 		{
@@ -26,8 +40,17 @@ func mustInitSigner() *signer.StaticSigner {
 			Algorithm: "RS256",
 			Use:       "sig",
 		},
+		{
+			Key:       ecKey.Public(),
+			KeyID:     "testkey-ec",
+			Algorithm: "ES256",
+			Use:       "sig",
+		},
 	}
 
-	return signer.NewStatic(signingKey, verificationKeys)
-
+	s, err := signer.NewStaticMultiAlg(signingKeys, verificationKeys)
+	if err != nil {
+		panic(err)
+	}
+	return s
 }
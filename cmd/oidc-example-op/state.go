@@ -18,19 +18,36 @@ type metadata struct {
 type session struct {
 	Meta     *metadata
 	SessData string
+	// CSRFToken is embedded in the login page rendered for the session, and
+	// must be submitted back with it. It is cleared once used.
+	CSRFToken string
 }
 
 type storage struct {
 	// sessions maps session objects by the core session ID
 	sessions map[string]*session
+	// logins maps the browser's sid to the clients tokens were issued to in
+	// that session, so they can be notified when it ends.
+	logins map[string][]string
 }
 
 func newStubSMGR() *storage {
 	return &storage{
 		sessions: map[string]*session{},
+		logins:   map[string][]string{},
 	}
 }
 
+// recordLogin tracks that the client took part in the browser session.
+func (s *storage) recordLogin(sid, clientID string) {
+	for _, c := range s.logins[sid] {
+		if c == clientID {
+			return
+		}
+	}
+	s.logins[sid] = append(s.logins[sid], clientID)
+}
+
 func (s *storage) NewID() string {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
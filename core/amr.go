@@ -0,0 +1,54 @@
+package core
+
+// Authentication method reference values, for Authorization.AMR. These
+// describe how the user authenticated, and are returned to the client in the
+// amr claim. Several can be set, e.g a passkey that was unlocked with a
+// biometric is reported as AMRHardwareKey, AMRUserPresence and
+// AMRFingerprint.
+//
+// https://www.rfc-editor.org/rfc/rfc8176#section-2
+const (
+	// AMRFace is biometric authentication using facial recognition.
+	AMRFace = "face"
+	// AMRFingerprint is biometric authentication using a fingerprint.
+	AMRFingerprint = "fpt"
+	// AMRGeolocation is use of geolocation information for authentication.
+	AMRGeolocation = "geo"
+	// AMRHardwareKey is proof-of-possession of a hardware-secured key, e.g a
+	// security key or a device-bound passkey.
+	AMRHardwareKey = "hwk"
+	// AMRIris is biometric authentication using an iris scan.
+	AMRIris = "iris"
+	// AMRKnowledgeBased is knowledge-based authentication.
+	AMRKnowledgeBased = "kba"
+	// AMRMultipleChannel is authentication using multiple channels.
+	AMRMultipleChannel = "mca"
+	// AMRMultiFactor is authentication using multiple factors.
+	AMRMultiFactor = "mfa"
+	// AMROneTimePassword is a one-time password.
+	AMROneTimePassword = "otp"
+	// AMRPIN is a personal identification number or pattern.
+	AMRPIN = "pin"
+	// AMRPassword is password-based authentication.
+	AMRPassword = "pwd"
+	// AMRRiskBased is risk-based authentication.
+	AMRRiskBased = "rba"
+	// AMRRetina is biometric authentication using a retina scan.
+	AMRRetina = "retina"
+	// AMRSmartCard is a smart card.
+	AMRSmartCard = "sc"
+	// AMRSMS is confirmation using SMS to a phone number.
+	AMRSMS = "sms"
+	// AMRSoftwareKey is proof-of-possession of a software-secured key, e.g a
+	// synced passkey.
+	AMRSoftwareKey = "swk"
+	// AMRTelephone is confirmation by telephone call.
+	AMRTelephone = "tel"
+	// AMRUserPresence is a test of user presence, e.g touching a security
+	// key.
+	AMRUserPresence = "user"
+	// AMRVoice is biometric authentication using voiceprint.
+	AMRVoice = "vbm"
+	// AMRWindowsIntegrated is Windows integrated authentication.
+	AMRWindowsIntegrated = "wia"
+)
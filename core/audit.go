@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// AuditEventType identifies what happened in an AuditEvent.
+type AuditEventType string
+
+const (
+	// AuditEventAuthRequest is emitted when an authorization request is
+	// started.
+	AuditEventAuthRequest AuditEventType = "auth_request"
+	// AuditEventLoginSuccess is emitted when an authorization is finished
+	// for the user.
+	AuditEventLoginSuccess AuditEventType = "login_success"
+	// AuditEventLoginFailure is emitted when an authorization is rejected or
+	// denied.
+	AuditEventLoginFailure AuditEventType = "login_failure"
+	// AuditEventTokenIssued is emitted when the token endpoint issues tokens,
+	// or the authorization endpoint returns them for a hybrid response type.
+	AuditEventTokenIssued AuditEventType = "token_issued"
+	// AuditEventTokenRevoked is emitted when a token is revoked.
+	AuditEventTokenRevoked AuditEventType = "token_revoked"
+)
+
+// DefaultAuditTimeout is used if the AuditTimeout is not configured.
+const DefaultAuditTimeout = 1 * time.Second
+
+// AuditEvent records an authentication event, for an audit trail. It never
+// contains tokens, codes, secrets or session IDs.
+type AuditEvent struct {
+	// Type of event.
+	Type AuditEventType
+	// Time the event happened.
+	Time time.Time
+	// ClientID the event relates to.
+	ClientID string
+	// Subject the event relates to, if known. It is set for tokens issued.
+	Subject string
+	// Scopes requested or granted.
+	Scopes []string
+	// AMR are the methods the user authenticated with, for login_success
+	// events.
+	AMR []string
+	// GrantType used, for token_issued events.
+	GrantType GrantType
+	// ResponseType the tokens were returned for, for token_issued events from
+	// the authorization endpoint.
+	ResponseType string
+	// Reason the login failed, as an OAuth2 error code.
+	Reason string
+}
+
+// AuditLogger can be configured to receive AuditEvents. It is called
+// synchronously, but the request only waits for it for up to the
+// AuditTimeout, after which its context is canceled.
+type AuditLogger func(ctx context.Context, event AuditEvent)
+
+// audit sends the event to the configured AuditLogger, waiting at most the
+// audit timeout for it.
+func (o *OIDC) audit(ctx context.Context, event AuditEvent) {
+	if o.auditLogger == nil {
+		return
+	}
+	event.Time = o.now()
+
+	ctx, cancel := context.WithTimeout(ctx, o.auditTimeout)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		o.auditLogger(ctx, event)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
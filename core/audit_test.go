@@ -0,0 +1,178 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAuditCodeFlow(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	var events []AuditEvent
+	o, err := New(&Config{
+		AuditLogger: func(_ context.Context, ev AuditEvent) {
+			events = append(events, ev)
+		},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}, AMR: []string{"pwd"}}); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tresp, err := o.token(context.Background(), &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         loc.Query().Get("code"),
+		RedirectURI:  redirectURI,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+			IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := url.Values{"token": {tresp.AccessToken}}
+	req := httptest.NewRequest("POST", "/revoke", strings.NewReader(body.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+	if err := o.Revoke(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AuditEvent{
+		{Type: AuditEventAuthRequest, ClientID: clientID, Scopes: []string{"openid"}},
+		{Type: AuditEventLoginSuccess, ClientID: clientID, Scopes: []string{"openid"}, AMR: []string{"pwd"}},
+		{Type: AuditEventTokenIssued, ClientID: clientID, Subject: "subject", Scopes: []string{"openid"}, GrantType: GrantTypeAuthorizationCode},
+		{Type: AuditEventTokenRevoked, ClientID: clientID, Scopes: []string{"openid"}},
+	}
+	if diff := cmp.Diff(want, events, cmpopts.IgnoreFields(AuditEvent{}, "Time")); diff != "" {
+		t.Errorf("unexpected audit events: %s", diff)
+	}
+	for _, ev := range events {
+		if ev.Time.IsZero() {
+			t.Errorf("want time set on %s event", ev.Type)
+		}
+	}
+}
+
+func TestAuditHybridFlow(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	var events []AuditEvent
+	o, err := New(&Config{
+		AuditLogger: func(_ context.Context, ev AuditEvent) {
+			events = append(events, ev)
+		},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{
+		"response_type": {"code id_token token"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+		"nonce":         {"nonce"},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.FinishAuthorization(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{
+		Scopes: []string{"openid"},
+		TokenHandler: func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+			}, nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AuditEvent{
+		{Type: AuditEventAuthRequest, ClientID: clientID, Scopes: []string{"openid"}},
+		{Type: AuditEventLoginSuccess, ClientID: clientID, Scopes: []string{"openid"}},
+		{Type: AuditEventTokenIssued, ClientID: clientID, Subject: "subject", Scopes: []string{"openid"}, GrantType: GrantTypeImplicit, ResponseType: "code id_token token"},
+	}
+	if diff := cmp.Diff(want, events, cmpopts.IgnoreFields(AuditEvent{}, "Time")); diff != "" {
+		t.Errorf("unexpected audit events: %s", diff)
+	}
+}
+
+func TestAuditTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	canceled := make(chan struct{})
+	o, err := New(&Config{
+		AuditTimeout: 10 * time.Millisecond,
+		AuditLogger: func(ctx context.Context, _ AuditEvent) {
+			<-ctx.Done()
+			close(canceled)
+			<-release
+		},
+	}, newStubSMGR(), &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	o.audit(context.Background(), AuditEvent{Type: AuditEventAuthRequest})
+	if took := time.Since(start); took > 1*time.Second {
+		t.Errorf("audit blocked for %s", took)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(1 * time.Second):
+		t.Error("want audit logger context canceled after timeout")
+	}
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"fmt"
+)
+
+// ClaimMapping renames the claims an upstream connector provides to the
+// claims this provider issues. Keys are the upstream claim, and values the
+// claim it is issued as, e.g {"upn": "preferred_username"}. The upstream
+// claim is removed, and replaces any claim already issued with the new name.
+type ClaimMapping map[string]string
+
+// apply renames the claims in place. All claims are read before any are
+// written, so a mapping can swap or chain claims without depending on the
+// order they are applied in.
+func (m ClaimMapping) apply(claims map[string]interface{}) {
+	mapped := map[string]interface{}{}
+	for from, to := range m {
+		if v, ok := claims[from]; ok {
+			mapped[to] = v
+			delete(claims, from)
+		}
+	}
+	for c, v := range mapped {
+		claims[c] = v
+	}
+}
+
+// validateClaimMappings checks no mapping renames a protected claim, or
+// renames a claim to one. They're set by us, so can't come from upstream.
+func validateClaimMappings(mappings map[string]ClaimMapping) error {
+	for connector, m := range mappings {
+		for from, to := range m {
+			if strsContains(protectedClaims, from) || strsContains(protectedClaims, to) {
+				return fmt.Errorf("claim mapping for connector %q can not map protected claim %s to %s", connector, from, to)
+			}
+		}
+	}
+	return nil
+}
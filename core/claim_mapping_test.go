@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// stubConnector stands in for an upstream identity provider, returning the
+// attributes it knows about the user in its own naming.
+type stubConnector struct {
+	name       string
+	attributes map[string]interface{}
+}
+
+func (s *stubConnector) login(subject string) (*Authorization, map[string]interface{}) {
+	return &Authorization{
+		Scopes:    []string{"openid", "email", "profile"},
+		Subject:   subject,
+		Connector: s.name,
+	}, s.attributes
+}
+
+func TestClaimMapping(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	ldap := &stubConnector{name: "ldap", attributes: map[string]interface{}{
+		"mail": "user@example.com",
+		"upn":  "user@corp",
+	}}
+	other := &stubConnector{name: "other", attributes: map[string]interface{}{
+		"mail": "other@example.com",
+	}}
+
+	o, err := New(&Config{
+		ClaimMappings: map[string]ClaimMapping{
+			"ldap": {"mail": "email", "upn": "preferred_username"},
+		},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issue logs in via the connector and returns the ID token claims.
+	issue := func(t *testing.T, conn *stubConnector) map[string]interface{} {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid email profile"},
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		auth, attrs := conn.login("user-1")
+		rec := httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, auth); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tresp, err := o.token(context.Background(), &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         loc.Query().Get("code"),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, func(tr *TokenRequest) (*TokenResponse, error) {
+			if tr.Authorization.Connector != conn.name {
+				t.Errorf("want connector %s passed to the handler, got: %s", conn.name, tr.Authorization.Connector)
+			}
+			idt := tr.PrefillIDToken("https://issuer", "user-1", time.Now().Add(1*time.Minute))
+			idt.Extra = attrs
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               idt,
+			}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idtb, err := testSigner.VerifySignature(context.Background(), tresp.ExtraParams["id_token"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl := map[string]interface{}{}
+		if err := json.Unmarshal(idtb, &cl); err != nil {
+			t.Fatal(err)
+		}
+		return cl
+	}
+
+	cl := issue(t, ldap)
+	if cl["email"] != "user@example.com" || cl["preferred_username"] != "user@corp" {
+		t.Errorf("want mapped email and preferred_username claims, got: %v", cl)
+	}
+	if _, ok := cl["mail"]; ok {
+		t.Errorf("want upstream mail claim removed, got: %v", cl)
+	}
+	if cl["sub"] != "user-1" {
+		t.Errorf("want sub unchanged, got: %v", cl["sub"])
+	}
+
+	// connectors without a mapping are passed through as is.
+	cl = issue(t, other)
+	if cl["mail"] != "other@example.com" {
+		t.Errorf("want unmapped connector's claims unchanged, got: %v", cl)
+	}
+	if _, ok := cl["email"]; ok {
+		t.Errorf("want no email claim for unmapped connector, got: %v", cl)
+	}
+
+	if _, err := New(&Config{
+		ClaimMappings: map[string]ClaimMapping{"ldap": {"uid": "sub"}},
+	}, newStubSMGR(), &stubCS{}, testSigner); err == nil {
+		t.Error("want error mapping a claim to sub")
+	}
+}
+
+func TestClaimMappingApply(t *testing.T) {
+	claims := map[string]interface{}{"a": "1", "b": "2", "c": "3"}
+	// swap a and b, leaving c.
+	ClaimMapping{"a": "b", "b": "a"}.apply(claims)
+	if claims["a"] != "2" || claims["b"] != "1" || claims["c"] != "3" {
+		t.Errorf("want a and b swapped, got: %v", claims)
+	}
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// protectedClaims can't be changed by the ClaimsModifier. They identify the
+// issuer, user and recipient, and bind the ID token to the request it was
+// issued for.
+var protectedClaims = []string{"iss", "sub", "aud", "exp", "iat", "nonce", "at_hash", "c_hash"}
+
+// Identity describes who claims are being issued for, when they are passed to
+// the ClaimsModifier.
+type Identity struct {
+	// SessionID of the session the claims are issued for.
+	SessionID string
+	// ClientID the claims are being issued to.
+	ClientID string
+	// Subject the claims are about.
+	Subject string
+	// Authorization the session was granted.
+	Authorization Authorization
+}
+
+// ClaimsModifier can be configured to add or change the claims in ID tokens
+// and UserInfo responses. It is called with the full set of claims, after the
+// token or userinfo handler has built them, and before they are filtered by
+// the granted scopes. Protected claims (iss, sub, aud, exp, iat, nonce, at_hash
+// and c_hash) are restored after it returns, so changes to them are ignored.
+// If it returns an error, the request fails.
+type ClaimsModifier func(ctx context.Context, identity Identity, claims map[string]interface{}) error
+
+// finalizeClaims prepares the JSON encoded claims built by the consumer to be
+// returned to the client. They are first renamed by the ClaimMapping for the
+// connector that authenticated the user, then passed through the configured
+// ClaimsModifier. The sub is then replaced if the client gets pairwise
+// subjects, a single aud is made an array if configured, and any standard
+// claims not covered by the granted scopes or individually requested are
+// removed.
+func (o *OIDC) finalizeClaims(ctx context.Context, identity Identity, requested map[string]*ClaimRequest, claims []byte) ([]byte, error) {
+	// use numbers, so times etc. round trip unchanged.
+	dec := json.NewDecoder(bytes.NewReader(claims))
+	dec.UseNumber()
+	cm := map[string]interface{}{}
+	if err := dec.Decode(&cm); err != nil {
+		return nil, fmt.Errorf("decoding claims: %w", err)
+	}
+
+	if m, ok := o.claimMappings[identity.Authorization.Connector]; ok {
+		m.apply(cm)
+	}
+
+	if o.claimsModifier != nil {
+		if sub, ok := cm["sub"].(string); ok {
+			identity.Subject = sub
+		}
+
+		protected := map[string]interface{}{}
+		for _, c := range protectedClaims {
+			if v, ok := cm[c]; ok {
+				protected[c] = v
+			}
+		}
+
+		if err := o.claimsModifier(ctx, identity, cm); err != nil {
+			return nil, fmt.Errorf("modifying claims: %w", err)
+		}
+
+		for _, c := range protectedClaims {
+			if v, ok := protected[c]; ok {
+				cm[c] = v
+			} else {
+				delete(cm, c)
+			}
+		}
+	}
+
+	// clients registered for pairwise subjects get their own sub.
+	if sub, ok := cm["sub"].(string); ok {
+		csub, err := o.clientSubject(identity.ClientID, sub)
+		if err != nil {
+			return nil, err
+		}
+		cm["sub"] = csub
+	}
+
+	if aud, ok := cm["aud"].(string); ok && o.audienceAlwaysArray {
+		cm["aud"] = []string{aud}
+	}
+
+	filterScopedClaims(cm, identity.Authorization.Scopes, requested)
+
+	mb, err := json.Marshal(cm)
+	if err != nil {
+		return nil, fmt.Errorf("encoding claims: %w", err)
+	}
+	return mb, nil
+}
+
+// sessionIdentity returns the identity for claims issued for the session.
+func sessionIdentity(sess *sessionV2) Identity {
+	id := Identity{
+		SessionID: sess.ID,
+		ClientID:  sess.ClientID,
+	}
+	if sess.Authorization != nil {
+		id.Authorization = Authorization{
+			Scopes:    sess.Authorization.Scopes,
+			ACR:       sess.Authorization.ACR,
+			AMR:       sess.Authorization.AMR,
+			SID:       sess.Authorization.SID,
+			Connector: sess.Authorization.Connector,
+		}
+	}
+	return id
+}
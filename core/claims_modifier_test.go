@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestClaimsModifier(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	ctx := context.Background()
+
+	var gotIdentities []Identity
+	o := &OIDC{
+		smgr:   newStubSMGR(),
+		signer: testSigner,
+		clients: &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			},
+		},
+		claimsModifier: func(ctx context.Context, identity Identity, claims map[string]interface{}) error {
+			gotIdentities = append(gotIdentities, identity)
+			claims["groups"] = []string{"admins"}
+			// protected claims should be restored
+			claims["iss"] = "https://attacker"
+			claims["sub"] = "someone-else"
+			delete(claims, "exp")
+			return nil
+		},
+		now: time.Now,
+	}
+
+	utok, stok, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putSession(ctx, o.smgr, &sessionV2{
+		ID:            utok.SessionId,
+		AuthCode:      stok,
+		Authorization: &sessAuthorization{Scopes: []string{"openid", "profile", "groups"}},
+		ClientID:      clientID,
+		Expiry:        time.Now().Add(1 * time.Minute),
+		Request:       &sessAuthRequest{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tresp, err := o.token(ctx, &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         mustMarshal(utok),
+		RedirectURI:  redirectURI,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+			IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idtb, err := testSigner.VerifySignature(ctx, tresp.ExtraParams["id_token"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idt := map[string]interface{}{}
+	if err := json.Unmarshal(idtb, &idt); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]interface{}{"admins"}, idt["groups"]); diff != "" {
+		t.Errorf("want groups claim in ID token: %s", diff)
+	}
+	if idt["iss"] != "https://issuer" || idt["sub"] != "subject" || idt["exp"] == nil {
+		t.Errorf("want protected claims unchanged in ID token, got: %v", idt)
+	}
+
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("authorization", "Bearer "+tresp.AccessToken)
+	rec := httptest.NewRecorder()
+	if err := o.Userinfo(rec, req, func(w io.Writer, uireq *UserinfoRequest) error {
+		return json.NewEncoder(w).Encode(map[string]interface{}{"sub": "subject", "name": "Test User"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ui := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ui); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"sub":    "subject",
+		"name":   "Test User",
+		"groups": []interface{}{"admins"},
+	}
+	if diff := cmp.Diff(want, ui); diff != "" {
+		t.Errorf("unexpected userinfo response: %s", diff)
+	}
+
+	for _, id := range gotIdentities {
+		if id.Subject != "subject" || id.ClientID != clientID || !strsContains(id.Authorization.Scopes, "groups") {
+			t.Errorf("unexpected identity passed to modifier: %#v", id)
+		}
+	}
+	if len(gotIdentities) != 2 {
+		t.Errorf("want modifier called for ID token and userinfo, got %d calls", len(gotIdentities))
+	}
+}
+
+func TestAudienceAlwaysArray(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		Name                string
+		AudienceAlwaysArray bool
+		WantAud             string
+	}{
+		{
+			Name:    "Default",
+			WantAud: `"client-id"`,
+		},
+		{
+			Name:                "Always array",
+			AudienceAlwaysArray: true,
+			WantAud:             `["client-id"]`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			smgr := newStubSMGR()
+			o, err := New(&Config{AudienceAlwaysArray: tc.AudienceAlwaysArray}, smgr, &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			utok, stok, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := putSession(ctx, smgr, &sessionV2{
+				ID:            utok.SessionId,
+				Stage:         sessionStageCode,
+				AuthCode:      stok,
+				Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+				ClientID:      clientID,
+				Expiry:        time.Now().Add(1 * time.Minute),
+				Request:       &sessAuthRequest{RedirectURI: redirectURI},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			tresp, err := o.token(ctx, &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         mustMarshal(utok),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			idtb, err := testSigner.VerifySignature(ctx, tresp.ExtraParams["id_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(idtb, &raw); err != nil {
+				t.Fatalf("want valid JSON ID token: %v", err)
+			}
+			if got := string(raw["aud"]); got != tc.WantAud {
+				t.Errorf("want aud %s, got: %s", tc.WantAud, got)
+			}
+
+			// either form is read back as the same audience.
+			var cl oidc.Claims
+			if err := json.Unmarshal(idtb, &cl); err != nil {
+				t.Fatal(err)
+			}
+			if len(cl.Audience) != 1 || !cl.Audience.Contains(clientID) {
+				t.Errorf("want audience %s, got: %v", clientID, cl.Audience)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ClaimsRequest is the set of individual claims a client asked for via the
+// claims request parameter, in addition to those granted by scopes. A nil
+// ClaimRequest for a claim means it was requested with no further
+// constraints.
+//
+// Requested claims are no longer removed by scope filtering, but it is up to
+// the handlers to provide them. Claims that are not available, even essential
+// ones, should be omitted - as per the spec, the request should not fail. The
+// exception is an essential acr, which FinishAuthorization enforces.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#ClaimsParameter
+type ClaimsRequest struct {
+	// Userinfo are the claims requested to be returned from the UserInfo
+	// endpoint.
+	Userinfo map[string]*ClaimRequest `json:"userinfo,omitempty"`
+	// IDToken are the claims requested to be returned in the ID token.
+	IDToken map[string]*ClaimRequest `json:"id_token,omitempty"`
+}
+
+// ClaimRequest details how an individual claim was requested.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#IndividualClaimsRequests
+type ClaimRequest struct {
+	// Essential indicates the claim is needed for the client's use case to
+	// work smoothly.
+	Essential bool `json:"essential,omitempty"`
+	// Value is the value the claim is requested to have, if set.
+	Value interface{} `json:"value,omitempty"`
+	// Values are a set of values the claim is requested to have one of, in
+	// order of preference.
+	Values []interface{} `json:"values,omitempty"`
+}
+
+// idToken returns the claims requested for the ID token, handling a nil
+// request.
+func (c *ClaimsRequest) idToken() map[string]*ClaimRequest {
+	if c == nil {
+		return nil
+	}
+	return c.IDToken
+}
+
+// userinfo returns the claims requested for the UserInfo response, handling a
+// nil request.
+func (c *ClaimsRequest) userinfo() map[string]*ClaimRequest {
+	if c == nil {
+		return nil
+	}
+	return c.Userinfo
+}
+
+// acrSatisfied returns false if the acr claim was requested as essential for
+// the ID token with specific values, and acr is not one of them.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#acrSemantics
+func (c *ClaimsRequest) acrSatisfied(acr string) bool {
+	cr := c.idToken()["acr"]
+	if cr == nil || !cr.Essential {
+		return true
+	}
+
+	want := append([]interface{}{}, cr.Values...)
+	if cr.Value != nil {
+		want = append(want, cr.Value)
+	}
+	if len(want) == 0 {
+		// any acr will do
+		return true
+	}
+	for _, v := range want {
+		if s, ok := v.(string); ok && s == acr {
+			return true
+		}
+	}
+	return false
+}
+
+func parseClaimsRequest(s string) (*ClaimsRequest, error) {
+	cr := &ClaimsRequest{}
+	if err := json.Unmarshal([]byte(s), cr); err != nil {
+		return nil, fmt.Errorf("parsing claims request: %w", err)
+	}
+	return cr, nil
+}
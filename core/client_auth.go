@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ClientJWKSSource can be implemented by a ClientSource to allow clients to
+// authenticate with a JWT signed by their private key, rather than a secret.
+// If the ClientSource does not implement this, client assertions will be
+// rejected.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type ClientJWKSSource interface {
+	// ClientJWKS should return the public keys the given client signs its
+	// assertions with. These may be configured directly, or fetched from the
+	// client's jwks_uri. If the client has no keys, nil should be returned.
+	ClientJWKS(clientID string) (*jose.JSONWebKeySet, error)
+}
+
+// ClientSecretSource can be implemented by a ClientSource to allow clients to
+// authenticate with a JWT signed with an HMAC of their secret, the
+// client_secret_jwt method. This requires the secret itself, rather than just
+// being able to validate it. If the ClientSource does not implement this,
+// HMAC signed client assertions will be rejected.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type ClientSecretSource interface {
+	// ClientSecret should return the secret for the given client. If the
+	// client has no secret, an empty string should be returned.
+	ClientSecret(clientID string) (string, error)
+}
+
+// authenticateClient checks the credentials a client presented, either a
+// secret, a signed assertion, or a TLS client certificate. Callers are
+// responsible for deciding if unauthenticated clients can skip this.
+func (o *OIDC) authenticateClient(ctx context.Context, clientID, clientSecret, clientAssertion string, clientCert *x509.Certificate) (ok bool, err error) {
+	if clientAssertion != "" {
+		return o.verifyClientAssertion(ctx, clientID, clientAssertion)
+	}
+	if clientSecret == "" && clientCert != nil {
+		return o.validateClientCertificate(clientID, clientCert)
+	}
+	return o.clients.ValidateClientSecret(clientID, clientSecret)
+}
+
+// verifyClientAssertion checks a private_key_jwt or client_secret_jwt
+// assertion. It must be signed by one of the client's keys or with its secret,
+// issued by and for the client, intended for us, and not previously used.
+// Errors are only returned for failures in the checking process, invalid
+// assertions result in false.
+//
+// https://tools.ietf.org/html/rfc7523#section-3
+func (o *OIDC) verifyClientAssertion(ctx context.Context, clientID, assertion string) (ok bool, err error) {
+	// without knowing who we are, there's no way to check the assertion was
+	// intended for us.
+	iss := o.issuerFrom(ctx)
+	if iss == "" && o.tokenEndpoint == "" {
+		return false, nil
+	}
+
+	jws, err := jose.ParseSigned(assertion)
+	if err != nil {
+		return false, nil
+	}
+	if len(jws.Signatures) != 1 {
+		return false, nil
+	}
+
+	var payload []byte
+	switch jose.SignatureAlgorithm(jws.Signatures[0].Header.Algorithm) {
+	case jose.HS256, jose.HS384, jose.HS512:
+		payload, err = o.verifyClientSecretJWT(clientID, jws)
+	default:
+		payload, err = o.verifyPrivateKeyJWT(clientID, jws)
+	}
+	if err != nil {
+		return false, err
+	}
+	if payload == nil {
+		return false, nil
+	}
+
+	cl := oidc.Claims{}
+	if err := json.Unmarshal(payload, &cl); err != nil {
+		return false, nil
+	}
+
+	if cl.Issuer != clientID || cl.Subject != clientID {
+		return false, nil
+	}
+	if !((o.tokenEndpoint != "" && cl.Audience.Contains(o.tokenEndpoint)) || (iss != "" && cl.Audience.Contains(iss))) {
+		return false, nil
+	}
+	if cl.Expiry == 0 || o.now().After(cl.Expiry.Time()) {
+		return false, nil
+	}
+	jti, _ := cl.Extra["jti"].(string)
+	if jti == "" {
+		return false, nil
+	}
+
+	// Track the jti until the assertion expires, so it can't be replayed.
+	fresh, err := o.checkReplay(ctx, "jti/"+clientID+"/"+jti, cl.Expiry.Time().Sub(o.now()))
+	if err != nil {
+		return false, fmt.Errorf("checking assertion jti: %w", err)
+	}
+	return fresh, nil
+}
+
+// verifyPrivateKeyJWT returns the payload of an assertion signed by one of the
+// client's public keys, or nil if it isn't.
+func (o *OIDC) verifyPrivateKeyJWT(clientID string, jws *jose.JSONWebSignature) ([]byte, error) {
+	ks, ok := o.clients.(ClientJWKSSource)
+	if !ok {
+		return nil, nil
+	}
+	jwks, err := ks.ClientJWKS(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("getting keys for client %s: %w", clientID, err)
+	}
+	if jwks == nil {
+		return nil, nil
+	}
+
+	keys := jwks.Keys
+	if kid := jws.Signatures[0].Header.KeyID; kid != "" {
+		keys = jwks.Key(kid)
+	}
+	for _, k := range keys {
+		if k.IsPublic() && k.Use != "enc" {
+			if payload, err := jws.Verify(k); err == nil {
+				return payload, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// verifyClientSecretJWT returns the payload of an assertion signed with an
+// HMAC of the client's secret, or nil if it isn't.
+func (o *OIDC) verifyClientSecretJWT(clientID string, jws *jose.JSONWebSignature) ([]byte, error) {
+	ss, ok := o.clients.(ClientSecretSource)
+	if !ok {
+		return nil, nil
+	}
+	secret, err := ss.ClientSecret(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("getting secret for client %s: %w", clientID, err)
+	}
+	if secret == "" {
+		return nil, nil
+	}
+
+	payload, err := jws.Verify([]byte(secret))
+	if err != nil {
+		return nil, nil
+	}
+	return payload, nil
+}
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestVerifyClientAssertion(t *testing.T) {
+	const (
+		clientID      = "client-id"
+		secretClient  = "secret-client"
+		clientSecret  = "a-client-secret-long-enough-for-hs256"
+		tokenEndpoint = "https://issuer/token"
+	)
+
+	key := mustGenRSAKey(512)
+	otherKey := mustGenRSAKey(512)
+
+	clientSource := &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{
+				JWKS: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+					{Key: key.Public(), KeyID: "client-key", Algorithm: "RS256", Use: "sig"},
+				}},
+			},
+			"no-keys":    csClient{},
+			secretClient: csClient{Secret: clientSecret},
+		},
+	}
+
+	sign := func(t *testing.T, k interface{}, cl oidc.Claims) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: k, KeyID: "client-key"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	signHMAC := func(t *testing.T, secret string, cl oidc.Claims) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(secret)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	validClaims := func() oidc.Claims {
+		return oidc.Claims{
+			Issuer:   clientID,
+			Subject:  clientID,
+			Audience: oidc.Audience{tokenEndpoint},
+			Expiry:   oidc.NewUnixTime(time.Now().Add(1 * time.Minute)),
+			Extra: map[string]interface{}{
+				"jti": mustGenerateID(),
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		ClientID  string
+		Assertion func(t *testing.T) string
+		// Replay the assertion a second time, which should fail
+		Replay bool
+		WantOK bool
+	}{
+		{
+			Name: "Valid assertion",
+			Assertion: func(t *testing.T) string {
+				return sign(t, key, validClaims())
+			},
+			WantOK: true,
+		},
+		{
+			Name: "Replayed assertion",
+			Assertion: func(t *testing.T) string {
+				return sign(t, key, validClaims())
+			},
+			Replay: true,
+		},
+		{
+			Name: "Signed by the wrong key",
+			Assertion: func(t *testing.T) string {
+				return sign(t, otherKey, validClaims())
+			},
+		},
+		{
+			Name: "Wrong audience",
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Audience = oidc.Audience{"https://other/token"}
+				return sign(t, key, cl)
+			},
+		},
+		{
+			Name: "Issuer is not the client",
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Issuer = "other"
+				return sign(t, key, cl)
+			},
+		},
+		{
+			Name: "Expired",
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Expiry = oidc.NewUnixTime(time.Now().Add(-1 * time.Minute))
+				return sign(t, key, cl)
+			},
+		},
+		{
+			Name: "No jti",
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Extra = nil
+				return sign(t, key, cl)
+			},
+		},
+		{
+			Name:     "Valid client_secret_jwt assertion",
+			ClientID: secretClient,
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Issuer, cl.Subject = secretClient, secretClient
+				return signHMAC(t, clientSecret, cl)
+			},
+			WantOK: true,
+		},
+		{
+			Name:     "Replayed client_secret_jwt assertion",
+			ClientID: secretClient,
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Issuer, cl.Subject = secretClient, secretClient
+				return signHMAC(t, clientSecret, cl)
+			},
+			Replay: true,
+		},
+		{
+			Name:     "client_secret_jwt signed with the wrong secret",
+			ClientID: secretClient,
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Issuer, cl.Subject = secretClient, secretClient
+				return signHMAC(t, "not-the-client-secret-but-just-as-long", cl)
+			},
+		},
+		{
+			Name:     "client_secret_jwt for the wrong audience",
+			ClientID: secretClient,
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Issuer, cl.Subject = secretClient, secretClient
+				cl.Audience = oidc.Audience{"https://other/token"}
+				return signHMAC(t, clientSecret, cl)
+			},
+		},
+		{
+			Name: "Client without a secret",
+			Assertion: func(t *testing.T) string {
+				return signHMAC(t, clientSecret, validClaims())
+			},
+		},
+		{
+			Name:     "Client has no keys",
+			ClientID: "no-keys",
+			Assertion: func(t *testing.T) string {
+				cl := validClaims()
+				cl.Issuer, cl.Subject = "no-keys", "no-keys"
+				return sign(t, key, cl)
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				smgr:          newStubSMGR(),
+				clients:       clientSource,
+				tokenEndpoint: tokenEndpoint,
+				replayCache:   NewMemoryReplayCache(),
+				now:           time.Now,
+			}
+
+			cid := tc.ClientID
+			if cid == "" {
+				cid = clientID
+			}
+			assertion := tc.Assertion(t)
+
+			ok, err := o.verifyClientAssertion(context.Background(), cid, assertion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.Replay {
+				if !ok {
+					t.Fatal("first use of assertion should succeed")
+				}
+				ok, err = o.verifyClientAssertion(context.Background(), cid, assertion)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ok != tc.WantOK {
+				t.Errorf("want ok %t, got: %t", tc.WantOK, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// ClientCredentialsClientSource can be implemented by a ClientSource to allow
+// confidential clients to use the client credentials grant. If it is not
+// implemented, no client can.
+type ClientCredentialsClientSource interface {
+	// ClientAllowClientCredentials should return true if the client can get
+	// access tokens for itself.
+	ClientAllowClientCredentials(clientID string) (ok bool, err error)
+}
+
+// clientCredentials handles the client credentials grant. An access token is
+// issued for the client itself, so there is no ID or refresh token.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.4
+func (o *OIDC) clientCredentials(ctx context.Context, req *tokenRequest, handler func(req *TokenRequest) (*TokenResponse, error)) (*tokenResponse, error) {
+	// only confidential clients can use this grant.
+	public, err := o.clients.IsUnauthenticatedClient(req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client is public", Cause: err}
+	}
+	if public {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "public clients can not use the client credentials grant"}
+	}
+	if err := o.authenticateTokenClient(ctx, req); err != nil {
+		return nil, err
+	}
+
+	cccs, ok := o.clients.(ClientCredentialsClientSource)
+	if !ok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not use the client credentials grant"}
+	}
+	allowed, err := cccs.ClientAllowClientCredentials(req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client can use the client credentials grant", Cause: err}
+	}
+	if !allowed {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not use the client credentials grant"}
+	}
+
+	// if the client doesn't ask for specific scopes, it gets all it's allowed.
+	scopes := req.ClientCredentials.Scopes
+	if len(scopes) == 0 {
+		if crs, ok := o.clients.(ClientRestrictionsSource); ok {
+			scopes, err = crs.ClientAllowedScopes(req.ClientID)
+			if err != nil {
+				return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client scopes", Cause: err}
+			}
+		}
+	}
+	if err := o.checkClientRestrictions(req.ClientID, req.GrantType, scopes); err != nil {
+		return nil, err
+	}
+	if err := o.checkClientResources(req.ClientID, req.Resources); err != nil {
+		return nil, err
+	}
+
+	sess := &sessionV2{
+		ID:       o.smgr.NewID(),
+		ClientID: req.ClientID,
+		Request:  &sessAuthRequest{},
+		Authorization: &sessAuthorization{
+			Scopes:            scopes,
+			AuthorizedAt:      o.now(),
+			ClientCredentials: true,
+		},
+	}
+
+	tresp, err := handler(&TokenRequest{
+		SessionID:     sess.ID,
+		ClientID:      req.ClientID,
+		Issuer:        o.issuerFrom(ctx),
+		Authorization: Authorization{Scopes: scopes},
+		GrantType:     req.GrantType,
+		Resources:     req.Resources,
+
+		authReq: sess.Request,
+		now:     o.now,
+	})
+	if err != nil {
+		var uaerr unauthorizedErr
+		if errors.As(err, &uaerr); uaerr != nil && uaerr.Unauthorized() {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: uaerr.Error()}
+		}
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "handler returned error", Cause: err}
+	}
+	if err := o.applyClientTokenLifetimes(req.ClientID, tresp); err != nil {
+		return nil, err
+	}
+
+	if tresp.AccessTokenValidUntil.Before(o.now()) {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "access token must be valid > now"}
+	}
+
+	useratok, satok, err := newToken(sess.ID, tresp.AccessTokenValidUntil)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate access token", Cause: err}
+	}
+	satok.IssuedAt = o.now()
+	if o.certificateBoundAccessTokens && req.ClientCert != nil {
+		satok.CertThumbprint = certThumbprint(req.ClientCert)
+	}
+	satok.DPoPJKT = req.DPoPJKT
+	satok.Audience = req.Resources
+	satok.IPRanges, err = o.clientIPRanges(req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client IP ranges", Cause: err}
+	}
+	sess.Expiry = satok.Expiry
+	sess.AccessToken = satok
+	sess.Stage = sessionStageAccessTokenIssued
+
+	accessTok, err := marshalToken(useratok)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to marshal user token", Cause: err}
+	}
+	accessTok, err = o.formatAccessToken(ctx, accessTok, &jwtAccessToken{
+		Subject:  req.ClientID,
+		ClientID: req.ClientID,
+		Audience: req.Resources,
+		Scopes:   scopes,
+		Token:    satok,
+	})
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to format access token", Cause: err}
+	}
+
+	if err := putSession(ctx, o.smgr, sess); err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to put access token", Cause: err}
+	}
+
+	o.audit(ctx, AuditEvent{
+		Type:      AuditEventTokenIssued,
+		ClientID:  req.ClientID,
+		Subject:   req.ClientID,
+		Scopes:    scopes,
+		GrantType: req.GrantType,
+	})
+
+	return &tokenResponse{
+		AccessToken: accessTok,
+		TokenType:   accessTokenType(satok),
+		ExpiresIn:   tresp.AccessTokenValidUntil.Sub(o.now()),
+		Scopes:      scopes,
+	}, nil
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientCredentials(t *testing.T) {
+	const secret = "secret"
+
+	for _, tc := range []struct {
+		Name      string
+		ClientID  string
+		Secret    string
+		Scope     string
+		WantCode  int
+		WantError string
+		WantScope string
+	}{
+		{
+			Name:      "Allowed client",
+			ClientID:  "machine",
+			Secret:    secret,
+			Scope:     "read",
+			WantCode:  http.StatusOK,
+			WantScope: "read",
+		},
+		{
+			Name:      "Defaults to the client's allowed scopes",
+			ClientID:  "machine",
+			Secret:    secret,
+			WantCode:  http.StatusOK,
+			WantScope: "read write",
+		},
+		{
+			Name:      "Scope not allowed",
+			ClientID:  "machine",
+			Secret:    secret,
+			Scope:     "admin",
+			WantCode:  http.StatusBadRequest,
+			WantError: "invalid_scope",
+		},
+		{
+			Name:      "Wrong secret",
+			ClientID:  "machine",
+			Secret:    "wrong",
+			WantCode:  http.StatusBadRequest,
+			WantError: "unauthorized_client",
+		},
+		{
+			Name:      "Public client",
+			ClientID:  "public",
+			WantCode:  http.StatusBadRequest,
+			WantError: "unauthorized_client",
+		},
+		{
+			Name:      "Client not allowed",
+			ClientID:  "web",
+			Secret:    secret,
+			WantCode:  http.StatusBadRequest,
+			WantError: "unauthorized_client",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					"machine": csClient{Secret: secret, AllowClientCredentials: true, AllowedScopes: []string{"read", "write"}},
+					"public":  csClient{Public: true, AllowClientCredentials: true},
+					"web":     csClient{Secret: secret},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := url.Values{"grant_type": {"client_credentials"}}
+			if tc.Scope != "" {
+				body.Set("scope", tc.Scope)
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(tc.ClientID, tc.Secret)
+			rec := httptest.NewRecorder()
+			_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+				if tr.GrantType != GrantTypeClientCredentials {
+					t.Errorf("want grant type %s, got %s", GrantTypeClientCredentials, tr.GrantType)
+				}
+				return &TokenResponse{
+					AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+					IssueRefreshToken:      true,
+					RefreshTokenValidUntil: time.Now().Add(1 * time.Hour),
+				}, nil
+			})
+
+			if rec.Code != tc.WantCode {
+				t.Fatalf("want status %d, got %d: %s", tc.WantCode, rec.Code, rec.Body.String())
+			}
+			resp := map[string]interface{}{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if tc.WantError != "" {
+				if resp["error"] != tc.WantError {
+					t.Errorf("want error %s, got %v", tc.WantError, resp["error"])
+				}
+				return
+			}
+
+			if resp["scope"] != tc.WantScope {
+				t.Errorf("want scope %q, got %v", tc.WantScope, resp["scope"])
+			}
+			for _, k := range []string{"id_token", "refresh_token"} {
+				if _, ok := resp[k]; ok {
+					t.Errorf("want no %s issued", k)
+				}
+			}
+
+			// the access token should be introspectable, for the client
+			body = url.Values{"token": {resp["access_token"].(string)}}
+			req = httptest.NewRequest("POST", "/introspect", strings.NewReader(body.Encode()))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(tc.ClientID, tc.Secret)
+			rec = httptest.NewRecorder()
+			if err := o.Introspect(rec, req, func(ireq *IntrospectionRequest) (*IntrospectionResponse, error) {
+				return &IntrospectionResponse{}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			iresp := map[string]interface{}{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &iresp); err != nil {
+				t.Fatal(err)
+			}
+			if iresp["active"] != true || iresp["sub"] != tc.ClientID || iresp["scope"] != tc.WantScope {
+				t.Errorf("want active token for %s with scope %q, got %v", tc.ClientID, tc.WantScope, iresp)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// ClientIPRangesSource can be implemented by a ClientSource to restrict the
+// addresses each client can use the token endpoint from. Requests from outside
+// the ranges are rejected with invalid_client. Access tokens issued to the
+// client are bound to the ranges, so they can only be used at the userinfo
+// endpoint from them, and introspection returns them as allowed_ip_ranges. If
+// it is not implemented, or returns an empty list, the client is not
+// restricted.
+//
+// The address is resolved as for rate limiting, so TrustForwardedFor should be
+// set if there is a proxy in front of us.
+type ClientIPRangesSource interface {
+	// ClientAllowedIPRanges returns the CIDRs the client can make requests
+	// from, e.g "10.0.0.0/8".
+	ClientAllowedIPRanges(clientID string) (cidrs []string, err error)
+}
+
+// clientIPRanges returns the ranges the client is restricted to, if any.
+func (o *OIDC) clientIPRanges(clientID string) ([]string, error) {
+	irs, ok := o.clients.(ClientIPRangesSource)
+	if !ok {
+		return nil, nil
+	}
+	return irs.ClientAllowedIPRanges(clientID)
+}
+
+// checkClientIP returns a token endpoint error if the client can't make
+// requests from ip.
+func (o *OIDC) checkClientIP(clientID, ip string) error {
+	cidrs, err := o.clientIPRanges(clientID)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client IP ranges", Cause: err}
+	}
+	if len(cidrs) == 0 {
+		return nil
+	}
+	ok, err := ipInRanges(ip, cidrs)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client IP ranges", Cause: err}
+	}
+	if !ok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "client can not make requests from this address", Cause: fmt.Errorf("%s is not in %v", ip, cidrs)}
+	}
+	return nil
+}
+
+// ipInRanges checks if ip is in any of the CIDRs. An unparseable ip is never
+// in range, an unparseable CIDR is an error.
+func ipInRanges(ip string, cidrs []string) (bool, error) {
+	pip := net.ParseIP(ip)
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return false, fmt.Errorf("parsing %q: %w", c, err)
+		}
+		if pip != nil && n.Contains(pip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
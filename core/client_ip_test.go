@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientIPRanges(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	ranges := []string{"10.0.0.0/8", "2001:db8::/32"}
+
+	for _, tc := range []struct {
+		Name              string
+		RemoteAddr        string
+		ForwardedFor      string
+		TrustForwardedFor bool
+		WantOK            bool
+	}{
+		{
+			Name:       "In range",
+			RemoteAddr: "10.1.2.3:1234",
+			WantOK:     true,
+		},
+		{
+			Name:       "In IPv6 range",
+			RemoteAddr: "[2001:db8::1]:1234",
+			WantOK:     true,
+		},
+		{
+			Name:       "Out of range",
+			RemoteAddr: "192.0.2.1:1234",
+		},
+		{
+			Name:              "In range via trusted proxy",
+			RemoteAddr:        "192.0.2.1:1234",
+			ForwardedFor:      "10.1.2.3",
+			TrustForwardedFor: true,
+			WantOK:            true,
+		},
+		{
+			Name:              "Out of range via trusted proxy",
+			RemoteAddr:        "10.1.2.3:1234",
+			ForwardedFor:      "192.0.2.1",
+			TrustForwardedFor: true,
+		},
+		{
+			Name:         "Forwarded address not trusted",
+			RemoteAddr:   "192.0.2.1:1234",
+			ForwardedFor: "10.1.2.3",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			smgr := newStubSMGR()
+			o, err := New(&Config{TrustForwardedFor: tc.TrustForwardedFor}, smgr, &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI, AllowedIPRanges: ranges},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ucode, scode, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := putSession(context.Background(), smgr, &sessionV2{
+				ID:            ucode.SessionId,
+				ClientID:      clientID,
+				Stage:         sessionStageCode,
+				Request:       &sessAuthRequest{RedirectURI: redirectURI},
+				AuthCode:      scode,
+				Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+				Expiry:        time.Now().Add(1 * time.Minute),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			fromClient := func(req *http.Request) *http.Request {
+				req.RemoteAddr = tc.RemoteAddr
+				if tc.ForwardedFor != "" {
+					req.Header.Set("X-Forwarded-For", tc.ForwardedFor)
+				}
+				return req
+			}
+
+			body := url.Values{
+				"grant_type":   {"authorization_code"},
+				"code":         {mustMarshal(ucode)},
+				"redirect_uri": {redirectURI},
+			}
+			req := fromClient(httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body.Encode())))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(clientID, clientSecret)
+			rec := httptest.NewRecorder()
+			_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+
+			var tresp struct {
+				AccessToken string `json:"access_token"`
+				Error       string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &tresp); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.WantOK {
+				if rec.Code != http.StatusUnauthorized || tresp.Error != "invalid_client" {
+					t.Errorf("want %d invalid_client, got %d: %s", http.StatusUnauthorized, rec.Code, rec.Body.String())
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want token issued, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			iresp, err := o.introspect(context.Background(), &tokenHintRequest{
+				Token:        tresp.AccessToken,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+				return &IntrospectionResponse{}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(ranges, iresp["allowed_ip_ranges"]); diff != "" {
+				t.Errorf("want introspection to report the client's ranges: %s", diff)
+			}
+
+			userinfo := func(req *http.Request) int {
+				req.Header.Set("Authorization", "Bearer "+tresp.AccessToken)
+				rec := httptest.NewRecorder()
+				_ = o.Userinfo(rec, req, func(w io.Writer, _ *UserinfoRequest) error {
+					_, err := w.Write([]byte(`{"sub":"subject"}`))
+					return err
+				})
+				return rec.Code
+			}
+			if code := userinfo(fromClient(httptest.NewRequest(http.MethodGet, "/userinfo", nil))); code != http.StatusOK {
+				t.Errorf("want userinfo from in range address allowed, got: %d", code)
+			}
+			outside := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			outside.RemoteAddr = "198.51.100.1:1234"
+			if code := userinfo(outside); code != http.StatusUnauthorized {
+				t.Errorf("want userinfo from out of range address rejected, got: %d", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"net/http"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// GrantTypeImplicit is not used at the token endpoint, but is the grant type
+// clients must be allowed to use to receive tokens directly from the
+// authorization endpoint, i.e. in the hybrid flow.
+//
+// https://tools.ietf.org/html/rfc7591#section-2.1
+const GrantTypeImplicit GrantType = "implicit"
+
+// ClientRestrictionsSource can be implemented by a ClientSource to limit the
+// scopes and grant types each client can use. Requests for anything outside of
+// this are rejected with invalid_scope or unauthorized_client. If it is not
+// implemented, or returns an empty list, the client is not restricted.
+type ClientRestrictionsSource interface {
+	// ClientAllowedScopes returns the scopes the client can request.
+	ClientAllowedScopes(clientID string) (scopes []string, err error)
+	// ClientAllowedGrantTypes returns the grant types the client can use.
+	ClientAllowedGrantTypes(clientID string) (grantTypes []string, err error)
+}
+
+// ResponseTypeRestrictionsSource can be implemented by a ClientSource to limit
+// the response types each client can request at the authorization endpoint,
+// e.g so a confidential web client can't have tokens returned directly.
+// Requests for any other response type are rejected with unauthorized_client,
+// even if it is supported. If it is not implemented, or returns an empty list,
+// the client can use any supported response type.
+//
+// https://tools.ietf.org/html/rfc7591#section-2.1
+type ResponseTypeRestrictionsSource interface {
+	// ClientAllowedResponseTypes returns the response types the client can
+	// use, e.g "code" or "code id_token". The values in a combination can be
+	// in any order.
+	ClientAllowedResponseTypes(clientID string) (responseTypes []string, err error)
+}
+
+// clientScopesAllowed checks all the requested scopes are allowed for the
+// client.
+func (o *OIDC) clientScopesAllowed(clientID string, scopes []string) (bool, error) {
+	crs, ok := o.clients.(ClientRestrictionsSource)
+	if !ok {
+		return true, nil
+	}
+	allowed, err := crs.ClientAllowedScopes(clientID)
+	if err != nil {
+		return false, err
+	}
+	if len(allowed) == 0 {
+		return true, nil
+	}
+	for _, s := range scopes {
+		if !strsContains(allowed, s) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// clientGrantTypesAllowed checks the client can use all the given grant types.
+func (o *OIDC) clientGrantTypesAllowed(clientID string, grantTypes ...GrantType) (bool, error) {
+	crs, ok := o.clients.(ClientRestrictionsSource)
+	if !ok {
+		return true, nil
+	}
+	allowed, err := crs.ClientAllowedGrantTypes(clientID)
+	if err != nil {
+		return false, err
+	}
+	if len(allowed) == 0 {
+		return true, nil
+	}
+	for _, gt := range grantTypes {
+		if !strsContains(allowed, string(gt)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// clientResponseTypeAllowed checks the client can use the response type.
+func (o *OIDC) clientResponseTypeAllowed(clientID string, rt responseType) (bool, error) {
+	rrs, ok := o.clients.(ResponseTypeRestrictionsSource)
+	if !ok {
+		return true, nil
+	}
+	allowed, err := rrs.ClientAllowedResponseTypes(clientID)
+	if err != nil {
+		return false, err
+	}
+	if len(allowed) == 0 {
+		return true, nil
+	}
+	for _, a := range allowed {
+		if parseResponseType(a) == rt {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkClientRestrictions returns a token endpoint error if the client can't
+// use the grant type, or request the scopes.
+func (o *OIDC) checkClientRestrictions(clientID string, grantType GrantType, scopes []string) error {
+	gok, err := o.clientGrantTypesAllowed(clientID, grantType)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client grant types", Cause: err}
+	}
+	if !gok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not use this grant type"}
+	}
+	sok, err := o.clientScopesAllowed(clientID, scopes)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client scopes", Cause: err}
+	}
+	if !sok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidScope, Description: "client can not request these scopes"}
+	}
+	return nil
+}
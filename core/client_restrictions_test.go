@@ -0,0 +1,202 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClientRestrictionsAuthorization(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name         string
+		Client       csClient
+		ResponseType string
+		Scope        string
+		WantErrCode  string
+	}{
+		{
+			Name:         "Unrestricted client",
+			Client:       csClient{RedirectURI: redirectURI},
+			ResponseType: "code",
+			Scope:        "openid profile",
+		},
+		{
+			Name:         "Allowed scopes",
+			Client:       csClient{RedirectURI: redirectURI, AllowedScopes: []string{"openid", "email"}},
+			ResponseType: "code",
+			Scope:        "openid email",
+		},
+		{
+			Name:         "Scope not allowed",
+			Client:       csClient{RedirectURI: redirectURI, AllowedScopes: []string{"openid", "email"}},
+			ResponseType: "code",
+			Scope:        "openid profile",
+			WantErrCode:  "invalid_scope",
+		},
+		{
+			Name:         "Code flow not allowed",
+			Client:       csClient{RedirectURI: redirectURI, AllowedGrantTypes: []string{"refresh_token"}},
+			ResponseType: "code",
+			Scope:        "openid",
+			WantErrCode:  "unauthorized_client",
+		},
+		{
+			Name:         "Hybrid flow needs implicit",
+			Client:       csClient{RedirectURI: redirectURI, AllowedGrantTypes: []string{"authorization_code"}},
+			ResponseType: "code id_token",
+			Scope:        "openid",
+			WantErrCode:  "unauthorized_client",
+		},
+		{
+			Name:         "Implicit denied for code only client",
+			Client:       csClient{RedirectURI: redirectURI, AllowedResponseTypes: []string{"code"}},
+			ResponseType: "token",
+			Scope:        "openid",
+			WantErrCode:  "unauthorized_client",
+		},
+		{
+			Name:         "Hybrid denied for code only client",
+			Client:       csClient{RedirectURI: redirectURI, AllowedResponseTypes: []string{"code"}},
+			ResponseType: "code id_token",
+			Scope:        "openid",
+			WantErrCode:  "unauthorized_client",
+		},
+		{
+			Name:         "Allowed response type in any order",
+			Client:       csClient{RedirectURI: redirectURI, AllowedResponseTypes: []string{"code", "id_token code"}},
+			ResponseType: "code id_token",
+			Scope:        "openid",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				smgr: newStubSMGR(),
+				clients: &stubCS{
+					validClients: map[string]csClient{clientID: tc.Client},
+				},
+				authValidityTime: 1 * time.Minute,
+				now:              time.Now,
+			}
+
+			q := url.Values{
+				"response_type": {tc.ResponseType},
+				"response_mode": {"fragment"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {tc.Scope},
+				"state":         {"state"},
+				"nonce":         {"nonce"},
+			}
+
+			rec := httptest.NewRecorder()
+			_, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if tc.WantErrCode == "" {
+				if err != nil {
+					t.Fatalf("want no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("want error, got none")
+			}
+
+			// errors are returned in the requested fragment, like a
+			// successful response.
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			frag, err := url.ParseQuery(loc.Fragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frag.Get("error"); got != tc.WantErrCode {
+				t.Errorf("want error %s, got %s", tc.WantErrCode, got)
+			}
+		})
+	}
+}
+
+func TestClientRestrictionsToken(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+	)
+
+	for _, tc := range []struct {
+		Name              string
+		AllowedGrantTypes []string
+		WantErr           bool
+	}{
+		{
+			Name: "Unrestricted client can refresh",
+		},
+		{
+			Name:              "Client allowed to refresh",
+			AllowedGrantTypes: []string{"authorization_code", "refresh_token"},
+		},
+		{
+			Name:              "Client restricted to authorization_code",
+			AllowedGrantTypes: []string{"authorization_code"},
+			WantErr:           true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{Secret: clientSecret, AllowedGrantTypes: tc.AllowedGrantTypes},
+					},
+				},
+				now: time.Now,
+			}
+
+			utok, stok, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := putSession(ctx, o.smgr, &sessionV2{
+				ID:            utok.SessionId,
+				RefreshToken:  stok,
+				Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+				ClientID:      clientID,
+				Expiry:        time.Now().Add(1 * time.Minute),
+				Request:       &sessAuthRequest{},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = o.token(ctx, &tokenRequest{
+				GrantType:    GrantTypeRefreshToken,
+				RefreshToken: mustMarshal(utok),
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if tc.WantErr {
+				if !matchTokenErrCode("unauthorized_client")(err) {
+					t.Errorf("want unauthorized_client error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// Client is a client managed via a MutableClientSource.
+type Client struct {
+	// ID is the client's identifier. It is unique within the ClientSource.
+	ID string
+	// Secret the client authenticates with. It is empty for clients that use
+	// the none or private_key_jwt auth methods. The ClientSource is
+	// responsible for storing it in a form it can validate later.
+	Secret string
+	// IDIssuedAt is when the client was created.
+	IDIssuedAt time.Time
+	// RegistrationAccessTokenHash is the bcrypted registration access token,
+	// used to authenticate the client to its configuration endpoint. It is
+	// only set for dynamically registered clients.
+	RegistrationAccessTokenHash []byte
+	// IDTokenValidity, AccessTokenValidity and RefreshTokenValidity are how
+	// long the client's tokens are valid for, if they should differ from
+	// what the token handler returns. They are set by the provider, not the
+	// client.
+	IDTokenValidity      time.Duration
+	AccessTokenValidity  time.Duration
+	RefreshTokenValidity time.Duration
+	// Metadata describing the client.
+	Metadata ClientMetadata
+}
+
+// MutableClientSource can be implemented by a ClientSource that can have
+// clients added, changed and removed at runtime, rather than being statically
+// configured. It must be implemented to use the RegisterClient and
+// ManageClient handlers.
+//
+// Client IDs are unique. Errors follow the same conventions as
+// storage.Storage, so they can be checked with storage.IsNotFoundErr and
+// storage.IsConflictErr: CreateClient should return a conflict error if a
+// client with the ID already exists, and GetClient, UpdateClient and
+// DeleteClient a not found error if it doesn't. Changes should be visible to
+// the ClientSource methods as soon as they return.
+type MutableClientSource interface {
+	// GetClient returns the client with the given ID.
+	GetClient(ctx context.Context, clientID string) (*Client, error)
+	// CreateClient stores a new client.
+	CreateClient(ctx context.Context, client *Client) error
+	// UpdateClient replaces an existing client.
+	UpdateClient(ctx context.Context, client *Client) error
+	// DeleteClient removes a client. Any future use of the client should
+	// fail.
+	DeleteClient(ctx context.Context, clientID string) error
+	// ListClients returns all clients, in no particular order.
+	ListClients(ctx context.Context) ([]*Client, error)
+}
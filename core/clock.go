@@ -0,0 +1,26 @@
+package core
+
+import (
+	"time"
+)
+
+// Clocked can be implemented by the Signer, SessionManager, ReplayCache,
+// RateLimiter and LoginAttemptTracker to use the same clock as the OIDC. If
+// Config.Now is set, New passes it to each of them that implements this, so
+// their expiry decisions match the OIDC's. StorageSessionManager,
+// MemoryReplayCache, TokenBucketLimiter, LoginLockout and
+// signer.RotatingSigner implement it.
+type Clocked interface {
+	// SetNow sets the function used to get the current time. It is called
+	// before the OIDC is used.
+	SetNow(now func() time.Time)
+}
+
+// shareClock passes the configured clock to the components that can use it.
+func (o *OIDC) shareClock(now func() time.Time) {
+	for _, c := range []interface{}{o.signer, o.smgr, o.replayCache, o.rateLimiter, o.loginAttemptTracker} {
+		if cl, ok := c.(Clocked); ok {
+			cl.SetNow(now)
+		}
+	}
+}
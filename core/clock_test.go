@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/signer"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// TestConfigNowShared checks the components with their own expiries follow
+// Config.Now, rather than the wall clock.
+func TestConfigNowShared(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	rc := NewMemoryReplayCache()
+	rl := NewTokenBucketLimiter(1, 1*time.Minute)
+	ll := NewLoginLockout(1, 1*time.Minute)
+
+	oldKey, oldPub := mustRotatingKey(t, "old")
+	rs, err := signer.NewRotating(oldKey, oldPub, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := New(&Config{
+		ReplayCache:         rc,
+		RateLimiter:         rl,
+		LoginAttemptTracker: ll,
+		Now:                 func() time.Time { return now },
+	}, newStubSMGR(), &stubCS{}, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fresh, err := o.checkReplay(ctx, "jti", 1*time.Minute); err != nil || !fresh {
+		t.Fatalf("want first use fresh, got %t (err: %v)", fresh, err)
+	}
+	if fresh, _ := o.checkReplay(ctx, "jti", 1*time.Minute); fresh {
+		t.Error("want replay within the TTL rejected")
+	}
+	if !rl.Allow(ctx, "key") || rl.Allow(ctx, "key") {
+		t.Error("want the bucket emptied by the first request")
+	}
+	ll.RecordFailure(ctx, "user")
+	if !ll.IsLocked(ctx, "user") {
+		t.Error("want user locked after a failure")
+	}
+	newKey, newPub := mustRotatingKey(t, "new")
+	if err := rs.Rotate(newKey, newPub, time.Time{}, now.Add(1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if fresh, err := o.checkReplay(ctx, "jti", 1*time.Minute); err != nil || !fresh {
+		t.Errorf("want ID fresh once its TTL has passed, got %t (err: %v)", fresh, err)
+	}
+	if !rl.Allow(ctx, "key") {
+		t.Error("want the bucket refilled")
+	}
+	if ll.IsLocked(ctx, "user") {
+		t.Error("want user unlocked once the failure is outside the window")
+	}
+	keys, err := rs.PublicKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Keys) != 1 || keys.Keys[0].KeyID != "new" {
+		t.Errorf("want only the new key published once the old is retired, got %v", keys.Keys)
+	}
+}
+
+func mustRotatingKey(t *testing.T, kid string) (jose.SigningKey, jose.JSONWebKey) {
+	t.Helper()
+
+	key := mustGenRSAKey(512)
+	return jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		jose.JSONWebKey{Key: key.Public(), KeyID: kid, Algorithm: "RS256", Use: "sig"}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// AuthCodeRedeemer can be implemented by a SessionManager to make redeeming
+// authorization codes atomic across all instances sharing it. It is
+// implemented by StorageSessionManager. If it is not implemented, concurrent
+// redemptions are only prevented within this process, so a deployment with
+// several instances sharing a SessionManager that doesn't implement it can
+// redeem a code more than once.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.1.2
+type AuthCodeRedeemer interface {
+	// RedeemAuthCode records that the session's authorization code has been
+	// redeemed, returning true only for the first call for the session. It
+	// must be atomic, e.g a conditional write. The record must be kept until
+	// at least expiry.
+	RedeemAuthCode(ctx context.Context, sessionID string, expiry time.Time) (first bool, err error)
+}
+
+// localCodeRedemptions tracks the codes redeemed in this process. The zero
+// value is ready to use.
+type localCodeRedemptions struct {
+	mu        sync.Mutex
+	redeemed  map[string]time.Time
+	lastPrune time.Time
+}
+
+// redeem records the session's code as redeemed, returning true if it wasn't
+// already.
+func (l *localCodeRedemptions) redeem(sessionID string, now, expiry time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.redeemed == nil {
+		l.redeemed = map[string]time.Time{}
+	}
+	if now.Sub(l.lastPrune) > 1*time.Minute {
+		for id, exp := range l.redeemed {
+			if now.After(exp) {
+				delete(l.redeemed, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	if _, ok := l.redeemed[sessionID]; ok {
+		return false
+	}
+	l.redeemed[sessionID] = expiry
+	return true
+}
+
+// redeemAuthCode consumes the session's authorization code, so it can only be
+// exchanged once even if redeemed concurrently. If it was already redeemed the
+// session is dropped, as we are likely being replayed.
+//
+// https://tools.ietf.org/html/rfc6819#section-4.4.1.1
+func (o *OIDC) redeemAuthCode(ctx context.Context, sess *sessionV2) error {
+	var first bool
+	if acr, ok := o.smgr.(AuthCodeRedeemer); ok {
+		var err error
+		first, err = acr.RedeemAuthCode(ctx, sess.ID, sess.Expiry)
+		if err != nil {
+			return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to redeem code", Cause: err}
+		}
+	} else {
+		first = o.codeRedemptions.redeem(sess.ID, o.now(), sess.Expiry)
+	}
+
+	if !first {
+		if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
+			return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session from storage", Cause: err}
+		}
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "code already redeemed"}
+	}
+
+	sess.AuthCodeRedeemed = true
+	return nil
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redeemingSMGR implements AuthCodeRedeemer, as a shared store would.
+type redeemingSMGR struct {
+	*stubSMGR
+	mu       sync.Mutex
+	redeemed map[string]bool
+}
+
+func (r *redeemingSMGR) RedeemAuthCode(_ context.Context, sessionID string, _ time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.redeemed[sessionID] {
+		return false, nil
+	}
+	r.redeemed[sessionID] = true
+	return true, nil
+}
+
+func TestConcurrentCodeRedemption(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name string
+		SMGR SessionManager
+	}{
+		{
+			Name: "In process",
+			SMGR: newStubSMGR(),
+		},
+		{
+			Name: "Session manager redeems",
+			SMGR: &redeemingSMGR{stubSMGR: newStubSMGR(), redeemed: map[string]bool{}},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+
+			o, err := New(&Config{}, tc.SMGR, &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := loc.Query().Get("code")
+
+			const n = 2
+			var (
+				wg    sync.WaitGroup
+				start = make(chan struct{})
+				errs  = make([]error, n)
+			)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+					_, errs[i] = o.token(ctx, &tokenRequest{
+						GrantType:    GrantTypeAuthorizationCode,
+						Code:         code,
+						RedirectURI:  redirectURI,
+						ClientID:     clientID,
+						ClientSecret: clientSecret,
+					}, func(tr *TokenRequest) (*TokenResponse, error) {
+						return &TokenResponse{
+							AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+							IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+						}, nil
+					})
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+
+			var succeeded int
+			for _, err := range errs {
+				if err == nil {
+					succeeded++
+					continue
+				}
+				if code := metricsErrorCode(err); code != "invalid_grant" {
+					t.Errorf("want invalid_grant for the losing redemption, got: %v", err)
+				}
+			}
+			if succeeded != 1 {
+				t.Errorf("want exactly 1 redemption to succeed, got %d", succeeded)
+			}
+		})
+	}
+}
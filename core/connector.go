@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// Connector is an upstream identity provider users can log in with.
+//
+// Connectors only describe the providers, to the user choosing one and to
+// the ClaimMappings. Logging in with one, whether by SAML, LDAP or another
+// OIDC provider, is done by the caller's handler at the URL passed to
+// SelectConnector. Once it has authenticated the user it calls
+// FinishAuthorization, setting the Authorization's Connector to the ID.
+type Connector struct {
+	// ID identifies the connector. It should be set as the Connector of the
+	// Authorization for users that log in with it, so its ClaimMappings are
+	// applied.
+	ID string
+	// Name is shown to the user when choosing a connector.
+	Name string
+}
+
+// ConnectorChoice is a connector the user can choose, as passed to the
+// ConnectorSelectionTemplate.
+type ConnectorChoice struct {
+	ID   string
+	Name string
+	// URL the user is sent to, to log in with the connector.
+	URL string
+}
+
+// SelectConnector can be called with the session ID returned by
+// StartAuthorization, to send the user to the connector they will log in
+// with. connectorURL should return the URL of the caller's login handler for
+// the connector. It must carry the session ID through, so the handler can call
+// FinishAuthorization with it once the user has logged in.
+//
+// If only one connector is configured, the user is redirected straight to it.
+// Otherwise the ConnectorSelectionTemplate is rendered, listing them all. If
+// the session has no pending authorization request, e.g because it expired, a
+// BadRequest error is returned.
+func (o *OIDC) SelectConnector(w http.ResponseWriter, req *http.Request, sessionID string, connectorURL func(connectorID, sessionID string) string) error {
+	req = o.withErrorHandler(req)
+
+	o.setSecurityHeaders(w)
+
+	if len(o.connectors) == 0 {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", nil, "no connectors configured")
+	}
+
+	areq, err := o.PendingAuthorization(req.Context(), sessionID)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to get session")
+	}
+	if areq == nil {
+		return writeHTTPError(w, req, http.StatusBadRequest, "authorization request expired", nil, fmt.Sprintf("session %s has no pending authorization", sessionID))
+	}
+
+	if len(o.connectors) == 1 {
+		http.Redirect(w, req, connectorURL(o.connectors[0].ID, sessionID), http.StatusFound)
+		return nil
+	}
+
+	choices := make([]ConnectorChoice, len(o.connectors))
+	for i, c := range o.connectors {
+		choices[i] = ConnectorChoice{ID: c.ID, Name: c.Name, URL: connectorURL(c.ID, sessionID)}
+	}
+
+	tmpl := o.connectorSelectionTemplate
+	if tmpl == nil {
+		tmpl = defaultConnectorSelectionTemplate
+	}
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := tmpl.Execute(w, map[string]interface{}{
+		"ClientID":   areq.ClientID,
+		"Connectors": choices,
+	}); err != nil {
+		return fmt.Errorf("rendering connector selection: %w", err)
+	}
+	return nil
+}
+
+// validateConnectors checks each connector has an ID, and they are unique.
+func validateConnectors(connectors []Connector) error {
+	seen := map[string]bool{}
+	for _, c := range connectors {
+		if c.ID == "" {
+			return fmt.Errorf("connector %q has no ID", c.Name)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("connector ID %q is used more than once", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
+
+var defaultConnectorSelectionTemplate = template.Must(template.New("connectorSelection").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Log in</title></head>
+<body>
+<h1>Log in with</h1>
+<ul>
+{{- range .Connectors }}
+<li><a href="{{ .URL }}">{{ .Name }}</a></li>
+{{- end }}
+</ul>
+</body>
+</html>
+`))
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectConnector(t *testing.T) {
+	const (
+		clientID    = "client"
+		redirectURI = "https://client/callback"
+	)
+
+	ldap := Connector{ID: "ldap", Name: "Corporate LDAP"}
+	github := Connector{ID: "github", Name: "GitHub"}
+
+	connectorURL := func(connectorID, sessionID string) string {
+		return "/auth/" + connectorID + "?" + url.Values{"session": {sessionID}}.Encode()
+	}
+
+	for _, tc := range []struct {
+		Name       string
+		Connectors []Connector
+		Template   *template.Template
+		// Expire the authorization request before selecting
+		Expire bool
+		// WantRedirect is the connector the user should be sent straight to
+		WantRedirect string
+		// WantListed are the connectors that should be offered
+		WantListed []Connector
+		WantStatus int
+	}{
+		{
+			Name:         "Single connector redirects to it",
+			Connectors:   []Connector{ldap},
+			WantRedirect: "ldap",
+			WantStatus:   http.StatusFound,
+		},
+		{
+			Name:       "Multiple connectors are listed",
+			Connectors: []Connector{ldap, github},
+			WantListed: []Connector{ldap, github},
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Custom template",
+			Connectors: []Connector{ldap, github},
+			Template:   template.Must(template.New("").Parse(`{{ .ClientID }}:{{ range .Connectors }}<a href="{{ .URL }}">{{ .Name }}</a>{{ end }}`)),
+			WantListed: []Connector{ldap, github},
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Expired request",
+			Connectors: []Connector{ldap, github},
+			Expire:     true,
+			WantStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			now := time.Now()
+
+			o, err := New(&Config{
+				AuthValidityTime:           1 * time.Minute,
+				Connectors:                 tc.Connectors,
+				ConnectorSelectionTemplate: tc.Template,
+				Now:                        func() time.Time { return now },
+			}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/authorization?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.Expire {
+				now = now.Add(2 * time.Minute)
+			}
+
+			w := httptest.NewRecorder()
+			err = o.SelectConnector(w, httptest.NewRequest(http.MethodGet, "/authorization/select", nil), areq.SessionID, connectorURL)
+			if (err != nil) != (tc.WantStatus >= 400) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if w.Code != tc.WantStatus {
+				t.Fatalf("want status %d, got %d", tc.WantStatus, w.Code)
+			}
+
+			if tc.WantRedirect != "" {
+				if loc := w.Header().Get("Location"); loc != connectorURL(tc.WantRedirect, areq.SessionID) {
+					t.Errorf("want redirect to connector %s, got %s", tc.WantRedirect, loc)
+				}
+			}
+
+			body := w.Body.String()
+			for _, c := range tc.WantListed {
+				link := `<a href="` + template.HTMLEscapeString(connectorURL(c.ID, areq.SessionID)) + `">` + c.Name + `</a>`
+				if !strings.Contains(body, link) {
+					t.Errorf("want connector %s listed as %s, got:\n%s", c.ID, link, body)
+				}
+			}
+			if tc.Template != nil && !strings.HasPrefix(body, clientID+":") {
+				t.Errorf("want custom template rendered, got:\n%s", body)
+			}
+			if tc.WantStatus != http.StatusOK {
+				return
+			}
+
+			// choosing a connector proceeds to it with the session, which
+			// its login handler finishes.
+			u, err := url.Parse(connectorURL(tc.WantListed[1].ID, areq.SessionID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Path != "/auth/github" {
+				t.Errorf("want chosen connector's path, got %s", u.Path)
+			}
+			w = httptest.NewRecorder()
+			if err := o.FinishAuthorization(w, httptest.NewRequest(http.MethodGet, u.String(), nil), u.Query().Get("session"), &Authorization{
+				Scopes:    []string{"openid"},
+				Connector: tc.WantListed[1].ID,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, redirectURI+"?code=") {
+				t.Errorf("want redirect to client with code, got %s", loc)
+			}
+		})
+	}
+}
+
+func TestValidateConnectors(t *testing.T) {
+	for _, tc := range []struct {
+		Name       string
+		Connectors []Connector
+		WantErr    bool
+	}{
+		{
+			Name:       "Valid",
+			Connectors: []Connector{{ID: "ldap"}, {ID: "github"}},
+		},
+		{
+			Name:       "Missing ID",
+			Connectors: []Connector{{Name: "LDAP"}},
+			WantErr:    true,
+		},
+		{
+			Name:       "Duplicate ID",
+			Connectors: []Connector{{ID: "ldap"}, {ID: "ldap"}},
+			WantErr:    true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := New(&Config{Connectors: tc.Connectors}, newStubSMGR(), &stubCS{}, testSigner)
+			if (err != nil) != tc.WantErr {
+				t.Errorf("want error %t, got: %v", tc.WantErr, err)
+			}
+		})
+	}
+}
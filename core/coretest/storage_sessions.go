@@ -0,0 +1,214 @@
+// Package coretest contains helpers for testing implementations of the core
+// package's extension points.
+package coretest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/core"
+	"github.com/pardot/oidc/signer"
+	"github.com/pardot/oidc/storage"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	storageTestClientID     = "client"
+	storageTestClientSecret = "secret"
+	storageTestRedirectURI  = "https://client/callback"
+)
+
+// TestStorageSessionManager runs the flows that rely on
+// core.StorageSessionManager being atomic against s, with two OIDC instances
+// sharing it. Storage implementations can use it from their tests to check they
+// are safe to share sessions in.
+func TestStorageSessionManager(ctx context.Context, t *testing.T, s storage.Storage) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sgn := signer.NewStatic(
+		jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: key, KeyID: "testkey"}},
+		[]jose.JSONWebKey{{Key: key.Public(), KeyID: "testkey", Algorithm: "RS256", Use: "sig"}},
+	)
+
+	var (
+		instances []*core.OIDC
+		smgrs     []*core.StorageSessionManager
+	)
+	for i := 0; i < 2; i++ {
+		smgr := core.NewStorageSessionManager(s)
+		o, err := core.New(&core.Config{
+			Issuer:           "https://issuer",
+			AuthValidityTime: 1 * time.Minute,
+			CodeValidityTime: 1 * time.Minute,
+		}, smgr, storageTestClients{}, sgn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, o)
+		smgrs = append(smgrs, smgr)
+	}
+
+	t.Run("testCodeRedeemedOnce", func(t *testing.T) { testCodeRedeemedOnce(ctx, t, instances) })
+	t.Run("testReplayDetected", func(t *testing.T) { testReplayDetected(ctx, t, smgrs) })
+	t.Run("testGarbageCollectionKeepsLive", func(t *testing.T) { testGarbageCollectionKeepsLive(ctx, t, instances[0]) })
+}
+
+func testCodeRedeemedOnce(ctx context.Context, t *testing.T, instances []*core.OIDC) {
+	code := storageTestAuthorize(t, instances[0])
+
+	const concurrency = 10
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		redeemed int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(o *core.OIDC) {
+			defer wg.Done()
+			w, err := storageTestRedeem(ctx, o, code)
+			if err != nil {
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("want failed redemption to be a bad request, got %d: %v", w.Code, err)
+				}
+				return
+			}
+			mu.Lock()
+			redeemed++
+			mu.Unlock()
+		}(instances[i%len(instances)])
+	}
+	wg.Wait()
+
+	if redeemed != 1 {
+		t.Errorf("want code redeemed once, got %d", redeemed)
+	}
+}
+
+func testReplayDetected(ctx context.Context, t *testing.T, smgrs []*core.StorageSessionManager) {
+	// unique, so a persistent storage can be reused.
+	id := smgrs[0].NewID()
+
+	const concurrency = 10
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		fresh int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(smgr *core.StorageSessionManager) {
+			defer wg.Done()
+			ok, err := smgr.CheckAndStore(ctx, id, 1*time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				fresh++
+				mu.Unlock()
+			}
+		}(smgrs[i%len(smgrs)])
+	}
+	wg.Wait()
+
+	if fresh != 1 {
+		t.Errorf("want ID fresh once, got %d", fresh)
+	}
+}
+
+func testGarbageCollectionKeepsLive(ctx context.Context, t *testing.T, o *core.OIDC) {
+	code := storageTestAuthorize(t, o)
+
+	// RunGC collects once, then returns as the context is canceled.
+	gcCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	o.RunGC(gcCtx, 1*time.Minute)
+
+	if _, err := storageTestRedeem(ctx, o, code); err != nil {
+		t.Errorf("want code redeemable after collecting garbage, got: %v", err)
+	}
+}
+
+// storageTestAuthorize runs the authorization flow, returning the code issued.
+func storageTestAuthorize(t *testing.T, o *core.OIDC) string {
+	t.Helper()
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {storageTestClientID},
+		"redirect_uri":  {storageTestRedirectURI},
+		"scope":         {"openid"},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/authorization?"+q.Encode(), nil)
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := o.FinishAuthorization(w, req, areq.SessionID, &core.Authorization{Scopes: []string{"openid"}}); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in redirect %s", loc)
+	}
+	return code
+}
+
+// storageTestRedeem exchanges the code at the token endpoint.
+func storageTestRedeem(ctx context.Context, o *core.OIDC, code string) (*httptest.ResponseRecorder, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {storageTestRedirectURI},
+		"client_id":     {storageTestClientID},
+		"client_secret": {storageTestClientSecret},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode())).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	err := o.Token(w, req, func(tr *core.TokenRequest) (*core.TokenResponse, error) {
+		return &core.TokenResponse{
+			IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+			AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+		}, nil
+	})
+	return w, err
+}
+
+// storageTestClients is a ClientSource with a single confidential client.
+type storageTestClients struct{}
+
+func (storageTestClients) IsValidClientID(clientID string) (bool, error) {
+	return clientID == storageTestClientID, nil
+}
+
+func (storageTestClients) IsUnauthenticatedClient(string) (bool, error) {
+	return false, nil
+}
+
+func (storageTestClients) ValidateClientSecret(clientID, clientSecret string) (bool, error) {
+	return clientID == storageTestClientID && clientSecret == storageTestClientSecret, nil
+}
+
+func (storageTestClients) ValidateClientRedirectURI(clientID, redirectURI string) (bool, error) {
+	return clientID == storageTestClientID && redirectURI == storageTestRedirectURI, nil
+}
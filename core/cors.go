@@ -0,0 +1,82 @@
+package core
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultCORSMaxAge is how long browsers can cache preflight responses, if no
+// CORSMaxAge is configured.
+const DefaultCORSMaxAge = 1 * time.Hour
+
+const (
+	EndpointUserinfo      Endpoint = "userinfo"
+	EndpointIntrospection Endpoint = "introspection"
+	EndpointRevocation    Endpoint = "revocation"
+)
+
+// corsMethods are the methods each endpoint that can be called from browsers
+// accepts.
+var corsMethods = map[Endpoint]string{
+	EndpointToken:         "POST",
+	EndpointUserinfo:      "GET, POST",
+	EndpointIntrospection: "POST",
+	EndpointRevocation:    "POST",
+}
+
+// corsAllowedHeaders are the request headers browser clients can send. These
+// cover client and bearer authentication, and form bodies.
+const corsAllowedHeaders = "Authorization, Content-Type"
+
+// corsOrigins returns the origins allowed to call the endpoint.
+func (o *OIDC) corsOrigins(endpoint Endpoint) []string {
+	if origins, ok := o.corsEndpointAllowedOrigins[endpoint]; ok {
+		return origins
+	}
+	return o.corsAllowedOrigins
+}
+
+// handleCORS sets the CORS headers for a cross-origin request to the
+// endpoint, if its origin is allowed. Preflight requests are responded to
+// entirely, returning true, in which case the handler should not continue.
+// Preflights from origins that aren't allowed get a HTTP 403, other requests
+// from them are handled as normal without CORS headers, so the browser won't
+// let the page read the response.
+//
+// https://fetch.spec.whatwg.org/#http-cors-protocol
+func (o *OIDC) handleCORS(w http.ResponseWriter, req *http.Request, endpoint Endpoint) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+
+	w.Header().Add("Vary", "Origin")
+
+	allowed := false
+	for _, ao := range o.corsOrigins(endpoint) {
+		if ao == "*" || ao == origin {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		w.Header().Set("Access-Control-Expose-Headers", "WWW-Authenticate")
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", corsMethods[endpoint])
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(o.corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	const (
+		allowedOrigin = "https://app.example.com"
+		otherOrigin   = "https://evil.example.com"
+	)
+
+	o, err := New(&Config{
+		CORSAllowedOrigins: []string{allowedOrigin},
+		CORSEndpointAllowedOrigins: map[Endpoint][]string{
+			EndpointIntrospection: nil,
+		},
+	}, newStubSMGR(), &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := map[Endpoint]func(w http.ResponseWriter, req *http.Request) error{
+		EndpointToken: func(w http.ResponseWriter, req *http.Request) error {
+			return o.Token(w, req, func(*TokenRequest) (*TokenResponse, error) {
+				t.Fatal("token handler should not be called")
+				return nil, nil
+			})
+		},
+		EndpointUserinfo: func(w http.ResponseWriter, req *http.Request) error {
+			return o.Userinfo(w, req, func(io.Writer, *UserinfoRequest) error {
+				t.Fatal("userinfo handler should not be called")
+				return nil
+			})
+		},
+		EndpointIntrospection: func(w http.ResponseWriter, req *http.Request) error {
+			return o.Introspect(w, req, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+				t.Fatal("introspection handler should not be called")
+				return nil, nil
+			})
+		},
+		EndpointRevocation: o.Revoke,
+	}
+
+	preflight := func(endpoint Endpoint, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/"+string(endpoint), nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		rec := httptest.NewRecorder()
+		if err := handlers[endpoint](rec, req); err != nil {
+			t.Fatalf("preflight to %s returned error: %v", endpoint, err)
+		}
+		return rec
+	}
+
+	for _, endpoint := range []Endpoint{EndpointToken, EndpointUserinfo, EndpointRevocation} {
+		rec := preflight(endpoint, allowedOrigin)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("%s: want preflight status %d, got: %d", endpoint, http.StatusNoContent, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != allowedOrigin {
+			t.Errorf("%s: want allowed origin %s, got: %q", endpoint, allowedOrigin, got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Methods"); got != corsMethods[endpoint] {
+			t.Errorf("%s: want allowed methods %q, got: %q", endpoint, corsMethods[endpoint], got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Headers"); got != corsAllowedHeaders {
+			t.Errorf("%s: want allowed headers %q, got: %q", endpoint, corsAllowedHeaders, got)
+		}
+		if got := rec.Header().Get("Access-Control-Max-Age"); got != "3600" {
+			t.Errorf("%s: want max age 3600, got: %q", endpoint, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint Endpoint
+		origin   string
+	}{
+		{name: "other origin", endpoint: EndpointToken, origin: otherOrigin},
+		{name: "endpoint override", endpoint: EndpointIntrospection, origin: allowedOrigin},
+	} {
+		rec := preflight(tc.endpoint, tc.origin)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: want preflight status %d, got: %d", tc.name, http.StatusForbidden, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s: want no allowed origin, got: %q", tc.name, got)
+		}
+	}
+
+	// actual requests are still handled, but only get CORS headers for
+	// allowed origins.
+	for _, tc := range []struct {
+		origin     string
+		wantOrigin string
+	}{
+		{origin: allowedOrigin, wantOrigin: allowedOrigin},
+		{origin: otherOrigin, wantOrigin: ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		req.Header.Set("Origin", tc.origin)
+		rec := httptest.NewRecorder()
+		_ = handlers[EndpointUserinfo](rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: want unauthenticated userinfo status %d, got: %d", tc.origin, http.StatusUnauthorized, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tc.wantOrigin {
+			t.Errorf("%s: want allowed origin %q, got: %q", tc.origin, tc.wantOrigin, got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Origin" {
+			t.Errorf("%s: want Vary: Origin, got: %q", tc.origin, got)
+		}
+	}
+}
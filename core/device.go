@@ -0,0 +1,298 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// userCodeAttempts is how many times we'll try and generate a user code that
+// isn't in use before giving up.
+const userCodeAttempts = 5
+
+// DeviceAuthorization can be used to handle a request to the device
+// authorization endpoint. A device code and user code are issued to the client,
+// which should then direct the user to verificationURI to enter the user code.
+// The implementation should serve a page at this URI that accepts the code and
+// passes it to VerifyUserCode.
+//
+// This will always return a response to the user, regardless of success or
+// failure.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.1
+func (o *OIDC) DeviceAuthorization(w http.ResponseWriter, req *http.Request, verificationURI string) (err error) {
+	defer func() { o.observeError(EndpointDeviceAuthorization, err) }()
+
+	if req, err = o.withIssuer(req); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	if err := o.checkIPRateLimit(req); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	dreq, err := parseDeviceAuthRequest(req)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+	dreq.ClientCert = o.clientCertificate(req)
+
+	if err := o.checkClientRateLimit(req.Context(), dreq.ClientID); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	resp, err := o.deviceAuthorization(req.Context(), dreq, verificationURI)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	if err := writeDeviceAuthResponse(w, resp); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	return nil
+}
+
+func (o *OIDC) deviceAuthorization(ctx context.Context, dreq *deviceAuthRequest, verificationURI string) (*deviceAuthResponse, error) {
+	cidok, err := o.clients.IsValidClientID(dreq.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "error calling clientsource check client ID", Cause: err}
+	}
+	if !cidok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "Invalid client"}
+	}
+	public, err := o.clients.IsUnauthenticatedClient(dreq.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client is unauthenticated", Cause: err}
+	}
+	if !public || dreq.ClientAssertion != "" {
+		cok, err := o.authenticateClient(ctx, dreq.ClientID, dreq.ClientSecret, dreq.ClientAssertion, dreq.ClientCert)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client credentials", Cause: err}
+		}
+		if !cok {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "Invalid client credentials"}
+		}
+	}
+	if err := o.checkClientRestrictions(dreq.ClientID, GrantTypeDeviceCode, dreq.Scopes); err != nil {
+		return nil, err
+	}
+
+	// The session is keyed by the user code, so we can find it when the user
+	// enters it. Make sure we don't clobber one that's in use.
+	var userCode, sessID string
+	for i := 0; i < userCodeAttempts; i++ {
+		userCode, err = newUserCode()
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate user code", Cause: err}
+		}
+		sessID = deviceSessionID(userCode)
+		existing, err := getSession(ctx, o.smgr, sessID)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get session from storage", Cause: err}
+		}
+		if existing == nil {
+			break
+		}
+		sessID = ""
+	}
+	if sessID == "" {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to find unused user code"}
+	}
+
+	exp := o.now().Add(o.deviceCodeValidityTime)
+
+	udcode, sdcode, err := newToken(sessID, exp)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate device code", Cause: err}
+	}
+	deviceCode, err := marshalToken(udcode)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to marshal device code", Cause: err}
+	}
+
+	sess := &sessionV2{
+		ID:       sessID,
+		Stage:    sessionStageRequested,
+		ClientID: dreq.ClientID,
+		Request: &sessAuthRequest{
+			Scopes:       dreq.Scopes,
+			ResponseType: authRequestResponseTypeDevice,
+		},
+		DeviceCode:         sdcode,
+		DevicePollInterval: o.devicePollInterval,
+		Expiry:             exp,
+	}
+	if err := putSession(ctx, o.smgr, sess); err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to persist session", Cause: err}
+	}
+
+	resp := &deviceAuthResponse{
+		DeviceCode:      deviceCode,
+		UserCode:        formatUserCode(userCode),
+		VerificationURI: verificationURI,
+		ExpiresIn:       int(o.deviceCodeValidityTime.Seconds()),
+		Interval:        int(o.devicePollInterval.Seconds()),
+	}
+	if vu, err := url.Parse(verificationURI); err == nil {
+		q := vu.Query()
+		q.Set("user_code", resp.UserCode)
+		vu.RawQuery = q.Encode()
+		resp.VerificationURIComplete = vu.String()
+	}
+
+	return resp, nil
+}
+
+// VerifyUserCode looks up the pending device authorization for the user code
+// entered on the verification page. If there is no pending authorization for
+// the code, nil is returned. Otherwise the implementation should authenticate
+// the user, and once they approve the request call FinishAuthorization with the
+// returned SessionID, or DenyDeviceAuthorization if they do not.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.3
+func (o *OIDC) VerifyUserCode(ctx context.Context, userCode string) (*AuthorizationRequest, error) {
+	code := normalizeUserCode(userCode)
+	if len(code) != userCodeLen {
+		return nil, nil
+	}
+
+	sess, err := getSession(ctx, o.smgr, deviceSessionID(code))
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil || sess.Stage != sessionStageRequested || o.now().After(sess.Expiry) {
+		return nil, nil
+	}
+
+	return &AuthorizationRequest{
+		SessionID: sess.ID,
+		Scopes:    sess.Request.Scopes,
+		ClientID:  sess.ClientID,
+	}, nil
+}
+
+// DenyDeviceAuthorization marks the device authorization as denied by the user.
+// The next time the device polls it will be told access was denied, and the
+// session removed.
+func (o *OIDC) DenyDeviceAuthorization(ctx context.Context, sessionID string) error {
+	sess, err := getSession(ctx, o.smgr, sessionID)
+	if err != nil {
+		return err
+	}
+	if sess == nil || sess.Request == nil || sess.Request.ResponseType != authRequestResponseTypeDevice {
+		return nil
+	}
+
+	sess.Stage = sessionStageDeviceDenied
+	if err := putSession(ctx, o.smgr, sess); err != nil {
+		return err
+	}
+
+	o.audit(ctx, AuditEvent{
+		Type:     AuditEventLoginFailure,
+		ClientID: sess.ClientID,
+		Scopes:   sess.Request.Scopes,
+		Reason:   string(authErrorCodeAccessDenied),
+	})
+
+	return nil
+}
+
+func (o *OIDC) finishDeviceAuthorization(w http.ResponseWriter, req *http.Request, session *sessionV2) error {
+	if session.Stage != sessionStageRequested {
+		return writeHTTPError(w, req, http.StatusForbidden, "Access Denied", nil, "device authorization is not pending")
+	}
+
+	session.Stage = sessionStageDeviceAuthorized
+
+	if err := putSession(req.Context(), o.smgr, session); err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to put session to storage")
+	}
+
+	return nil
+}
+
+// fetchDeviceSession handles loading the session for a device code grant. If
+// the user has not yet approved the request, an appropriate error is returned
+// so the device knows to continue polling.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.5
+func (o *OIDC) fetchDeviceSession(ctx context.Context, treq *tokenRequest) (*sessionV2, error) {
+	udcode, err := unmarshalToken(treq.DeviceCode)
+	if err != nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid device code", Cause: err}
+	}
+
+	sess, err := getSession(ctx, o.smgr, udcode.SessionId)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get session from storage", Cause: err}
+	}
+	if sess == nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeExpiredToken, Description: "device code expired"}
+	}
+	if sess.DeviceCode == nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "device code already redeemed"}
+	}
+
+	ok, err := tokensMatch(udcode, sess.DeviceCode)
+	if err != nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid device code", Cause: err}
+	}
+	if !ok || sess.ClientID != treq.ClientID {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "invalid device code"}
+	}
+
+	if o.now().After(sess.DeviceCode.Expiry) {
+		if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session from storage", Cause: err}
+		}
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeExpiredToken, Description: "device code expired"}
+	}
+
+	switch sess.Stage {
+	case sessionStageDeviceAuthorized:
+		// Drop the code, it can only be redeemed once.
+		sess.DeviceCode = nil
+		return sess, nil
+
+	case sessionStageDeviceDenied:
+		if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session from storage", Cause: err}
+		}
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeAccessDenied, Description: "authorization was denied"}
+	}
+
+	// still pending. If the device is polling faster than it should, make it
+	// back off.
+	now := o.now()
+	terr := &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeAuthorizationPending}
+	if !sess.DeviceLastPolledAt.IsZero() && now.Sub(sess.DeviceLastPolledAt) < sess.DevicePollInterval {
+		sess.DevicePollInterval += deviceSlowDownIncrement
+		terr = &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeSlowDown}
+	}
+	sess.DeviceLastPolledAt = now
+
+	if err := putSession(ctx, o.smgr, sess); err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to put session to storage", Cause: err}
+	}
+
+	return nil, terr
+}
+
+// deviceSessionID returns the ID of the session for the given normalized user
+// code. This is hashed, so the codes aren't exposed to the session store.
+func deviceSessionID(userCode string) string {
+	h := sha256.Sum256([]byte("device/" + userCode))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
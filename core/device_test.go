@@ -0,0 +1,364 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	const (
+		clientID        = "device-client"
+		verificationURI = "https://issuer/device"
+	)
+
+	// steps are performed in order against the same device authorization.
+	// The clock is advanced by Advance before each is run.
+	type step struct {
+		Advance time.Duration
+		// Approve or Deny the request via the verification flow
+		Approve bool
+		Deny    bool
+		// WantErrMatch is checked against the result of polling the token
+		// endpoint. If nil, we expect tokens to be issued.
+		WantErrMatch func(error) bool
+	}
+
+	for _, tc := range []struct {
+		Name  string
+		Steps []step
+	}{
+		{
+			Name: "Polling before approval is pending",
+			Steps: []step{
+				{WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeAuthorizationPending)},
+				{Advance: 5 * time.Second, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeAuthorizationPending)},
+			},
+		},
+		{
+			Name: "Polling too fast slows down, and the interval is increased",
+			Steps: []step{
+				{WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeAuthorizationPending)},
+				{Advance: 1 * time.Second, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeSlowDown)},
+				// the interval is now 10s
+				{Advance: 6 * time.Second, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeSlowDown)},
+				{Advance: 16 * time.Second, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeAuthorizationPending)},
+			},
+		},
+		{
+			Name: "Approved request issues tokens once",
+			Steps: []step{
+				{WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeAuthorizationPending)},
+				{Advance: 5 * time.Second, Approve: true},
+				{Advance: 5 * time.Second, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant)},
+			},
+		},
+		{
+			Name: "Denied request is denied",
+			Steps: []step{
+				{Deny: true, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeAccessDenied)},
+				{Advance: 5 * time.Second, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeExpiredToken)},
+			},
+		},
+		{
+			Name: "Expired code",
+			Steps: []step{
+				{Advance: 11 * time.Minute, WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeExpiredToken)},
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			now := time.Now()
+
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{Public: true},
+					},
+				},
+
+				deviceCodeValidityTime: 10 * time.Minute,
+				devicePollInterval:     5 * time.Second,
+
+				now: func() time.Time { return now },
+			}
+
+			dresp, err := o.deviceAuthorization(context.Background(), &deviceAuthRequest{
+				ClientID: clientID,
+				Scopes:   []string{"openid"},
+			}, verificationURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dresp.VerificationURIComplete != verificationURI+"?user_code="+dresp.UserCode {
+				t.Errorf("unexpected verification_uri_complete %s", dresp.VerificationURIComplete)
+			}
+
+			for i, s := range tc.Steps {
+				now = now.Add(s.Advance)
+
+				if s.Approve || s.Deny {
+					areq, err := o.VerifyUserCode(context.Background(), dresp.UserCode)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if areq == nil {
+						t.Fatalf("step %d: user code not found", i)
+					}
+
+					if s.Approve {
+						w := httptest.NewRecorder()
+						req := httptest.NewRequest(http.MethodPost, "/device", nil)
+						if err := o.FinishAuthorization(w, req, areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+							t.Fatal(err)
+						}
+					} else {
+						if err := o.DenyDeviceAuthorization(context.Background(), areq.SessionID); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				_, err := o.token(context.Background(), &tokenRequest{
+					GrantType:  GrantTypeDeviceCode,
+					DeviceCode: dresp.DeviceCode,
+					ClientID:   clientID,
+				}, func(tr *TokenRequest) (*TokenResponse, error) {
+					return &TokenResponse{
+						AccessTokenValidUntil: now.Add(1 * time.Minute),
+						IDToken:               tr.PrefillIDToken("http://issuer", "subject", now.Add(1*time.Minute)),
+					}, nil
+				})
+				if s.WantErrMatch == nil && err != nil {
+					t.Fatalf("step %d: want no error, got: %v", i, err)
+				}
+				if s.WantErrMatch != nil && (err == nil || !s.WantErrMatch(err)) {
+					t.Fatalf("step %d: unexpected error: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyUserCode(t *testing.T) {
+	o := &OIDC{
+		smgr: newStubSMGR(),
+		clients: &stubCS{
+			validClients: map[string]csClient{
+				"client": csClient{Public: true},
+			},
+		},
+		deviceCodeValidityTime: 10 * time.Minute,
+		devicePollInterval:     5 * time.Second,
+		now:                    time.Now,
+	}
+
+	dresp, err := o.deviceAuthorization(context.Background(), &deviceAuthRequest{ClientID: "client"}, "https://issuer/device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// users might enter the code in any case, and without the separator
+	for _, code := range []string{dresp.UserCode, strings.ToLower(dresp.UserCode), " " + dresp.UserCode[:4] + " " + dresp.UserCode[5:]} {
+		areq, err := o.VerifyUserCode(context.Background(), code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if areq == nil || areq.ClientID != "client" {
+			t.Errorf("code %q: want request for client, got: %v", code, areq)
+		}
+	}
+
+	areq, err := o.VerifyUserCode(context.Background(), "BBBB-BBBB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if areq != nil {
+		t.Errorf("want no request for unknown code, got: %v", areq)
+	}
+}
+
+func TestWriteDeviceAuthResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := writeDeviceAuthResponse(w, &deviceAuthResponse{
+		DeviceCode:      "device",
+		UserCode:        "BCDF-GHJK",
+		VerificationURI: "https://issuer/device",
+		ExpiresIn:       600,
+		Interval:        5,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]interface{}{}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"device_code", "user_code", "verification_uri", "expires_in", "interval"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("response missing %s", k)
+		}
+	}
+}
+
+// TestDeviceCodeAsToken checks a device code is rejected by the endpoints
+// that take other tokens, rather than being compared against tokens its
+// session doesn't have.
+func TestDeviceCodeAsToken(t *testing.T) {
+	const (
+		clientID     = "device-client"
+		clientSecret = "device-secret"
+	)
+
+	for _, tc := range []struct {
+		Name    string
+		Approve bool
+	}{
+		{Name: "Pending authorization"},
+		{Name: "Approved authorization", Approve: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			smgr := newStubSMGR()
+
+			o := &OIDC{
+				smgr:   smgr,
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{Secret: clientSecret},
+					},
+				},
+
+				deviceCodeValidityTime: 10 * time.Minute,
+				devicePollInterval:     5 * time.Second,
+
+				now: time.Now,
+			}
+
+			dresp, err := o.deviceAuthorization(ctx, &deviceAuthRequest{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Scopes:       []string{"openid"},
+			}, "https://issuer/device")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.Approve {
+				areq, err := o.VerifyUserCode(ctx, dresp.UserCode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "/device", nil)
+				if err := o.FinishAuthorization(w, req, areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			handler := func(tr *TokenRequest) (*TokenResponse, error) {
+				t.Error("token handler should not be called")
+				return nil, nil
+			}
+
+			t.Run("Code grant", func(t *testing.T) {
+				_, err := o.token(ctx, &tokenRequest{
+					GrantType:    GrantTypeAuthorizationCode,
+					Code:         dresp.DeviceCode,
+					ClientID:     clientID,
+					ClientSecret: clientSecret,
+				}, handler)
+				if !matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant)(err) {
+					t.Errorf("want invalid_grant, got: %v", err)
+				}
+			})
+
+			t.Run("Refresh grant", func(t *testing.T) {
+				_, err := o.token(ctx, &tokenRequest{
+					GrantType:    GrantTypeRefreshToken,
+					RefreshToken: dresp.DeviceCode,
+					ClientID:     clientID,
+					ClientSecret: clientSecret,
+				}, handler)
+				if !matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant)(err) {
+					t.Errorf("want invalid_grant, got: %v", err)
+				}
+			})
+
+			t.Run("Userinfo", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+				req.Header.Set("authorization", "Bearer "+dresp.DeviceCode)
+				if err := o.Userinfo(w, req, func(w io.Writer, _ *UserinfoRequest) error {
+					t.Error("userinfo handler should not be called")
+					return nil
+				}); err == nil {
+					t.Error("want error")
+				}
+				if w.Code != http.StatusUnauthorized {
+					t.Errorf("want status %d, got %d", http.StatusUnauthorized, w.Code)
+				}
+				if !strings.Contains(w.Header().Get("WWW-Authenticate"), string(bearerErrorCodeInvalidToken)) {
+					t.Errorf("want invalid_token, got WWW-Authenticate: %s", w.Header().Get("WWW-Authenticate"))
+				}
+			})
+
+			t.Run("Introspect", func(t *testing.T) {
+				resp, err := o.introspect(ctx, &tokenHintRequest{
+					Token:        dresp.DeviceCode,
+					ClientID:     clientID,
+					ClientSecret: clientSecret,
+				}, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+					t.Error("introspection handler should not be called")
+					return &IntrospectionResponse{}, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp["active"] != false {
+					t.Errorf("want inactive, got: %v", resp)
+				}
+			})
+
+			t.Run("Revoke", func(t *testing.T) {
+				if err := o.revoke(ctx, &tokenHintRequest{
+					Token:        dresp.DeviceCode,
+					ClientID:     clientID,
+					ClientSecret: clientSecret,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			// none of the above should have disturbed the device flow, so the
+			// device can still poll for its tokens.
+			_, err = o.token(ctx, &tokenRequest{
+				GrantType:    GrantTypeDeviceCode,
+				DeviceCode:   dresp.DeviceCode,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("http://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if tc.Approve && err != nil {
+				t.Errorf("want tokens issued to the device, got: %v", err)
+			}
+			if !tc.Approve && !matchTokenErrCode(oauth2.TokenErrorCodeAuthorizationPending)(err) {
+				t.Errorf("want authorization_pending, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// DPoPSigningAlgsSupported are the algorithms DPoP proofs can be signed with,
+// for dpop_signing_alg_values_supported.
+var DPoPSigningAlgsSupported = []jose.SignatureAlgorithm{
+	jose.RS256,
+	jose.RS384,
+	jose.RS512,
+	jose.PS256,
+	jose.PS384,
+	jose.PS512,
+	jose.ES256,
+	jose.ES384,
+	jose.ES512,
+	jose.EdDSA,
+}
+
+const (
+	// dpopHeader is the request header the proof is passed in.
+	dpopHeader = "DPoP"
+	// dpopProofType is the typ header DPoP proofs must have.
+	dpopProofType = "dpop+jwt"
+	// dpopProofMaxAge is how far the proof's iat can be from now. The jti is
+	// tracked for twice this, so it can't be replayed while it is accepted.
+	dpopProofMaxAge = 1 * time.Minute
+
+	// tokenTypeDPoP is the token_type and Authorization scheme for DPoP bound
+	// access tokens.
+	tokenTypeDPoP = "DPoP"
+)
+
+type dpopProofClaims struct {
+	JTI             string `json:"jti"`
+	HTTPMethod      string `json:"htm"`
+	HTTPURI         string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+}
+
+// verifyDPoPProof checks the DPoP proof passed with the request, returning the
+// thumbprint of the key it was signed with. If accessToken is set, the proof
+// must be for it. If no proof was passed, an empty thumbprint is returned.
+// Invalid proofs return an error describing why.
+//
+// https://www.rfc-editor.org/rfc/rfc9449#section-4.3
+func (o *OIDC) verifyDPoPProof(req *http.Request, accessToken string) (jkt string, err error) {
+	proofs := req.Header[http.CanonicalHeaderKey(dpopHeader)]
+	if len(proofs) == 0 {
+		return "", nil
+	}
+	if len(proofs) > 1 {
+		return "", errors.New("only one DPoP proof can be passed")
+	}
+
+	jws, err := jose.ParseSigned(proofs[0])
+	if err != nil {
+		return "", errors.New("DPoP proof is malformed")
+	}
+	if len(jws.Signatures) != 1 {
+		return "", errors.New("DPoP proof must have one signature")
+	}
+	hdr := jws.Signatures[0].Header
+	if typ, _ := hdr.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return "", errors.New("DPoP proof has the wrong typ")
+	}
+	if !dpopAlgSupported(jose.SignatureAlgorithm(hdr.Algorithm)) {
+		return "", errors.New("DPoP proof is signed with an unsupported algorithm")
+	}
+	if hdr.JSONWebKey == nil || !hdr.JSONWebKey.IsPublic() {
+		return "", errors.New("DPoP proof must contain a public jwk")
+	}
+
+	payload, err := jws.Verify(hdr.JSONWebKey)
+	if err != nil {
+		return "", errors.New("DPoP proof signature is invalid")
+	}
+	cl := dpopProofClaims{}
+	if err := json.Unmarshal(payload, &cl); err != nil {
+		return "", errors.New("DPoP proof claims are malformed")
+	}
+
+	if cl.HTTPMethod != req.Method {
+		return "", errors.New("DPoP proof htm does not match the request")
+	}
+	if !dpopURIMatches(cl.HTTPURI, o.requestURI(req)) {
+		return "", errors.New("DPoP proof htu does not match the request")
+	}
+	iat := time.Unix(cl.IssuedAt, 0)
+	if cl.IssuedAt == 0 || o.now().Sub(iat) > dpopProofMaxAge || iat.Sub(o.now()) > dpopProofMaxAge {
+		return "", errors.New("DPoP proof iat is not recent")
+	}
+	if accessToken != "" {
+		h := sha256.Sum256([]byte(accessToken))
+		if cl.AccessTokenHash != base64.RawURLEncoding.EncodeToString(h[:]) {
+			return "", errors.New("DPoP proof ath does not match the access token")
+		}
+	}
+	if cl.JTI == "" {
+		return "", errors.New("DPoP proof must have a jti")
+	}
+
+	tp, err := hdr.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", errors.New("DPoP proof jwk is invalid")
+	}
+	jkt = base64.RawURLEncoding.EncodeToString(tp)
+
+	fresh, err := o.checkReplay(req.Context(), "dpop/"+jkt+"/"+cl.JTI, 2*dpopProofMaxAge)
+	if err != nil {
+		return "", &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check DPoP proof jti", Cause: err}
+	}
+	if !fresh {
+		return "", errors.New("DPoP proof has already been used")
+	}
+
+	return jkt, nil
+}
+
+// dpopProofError returns the error for the token endpoint to respond with when
+// a proof is invalid.
+func dpopProofError(err error) error {
+	var herr *httpError
+	if errors.As(err, &herr) {
+		return herr
+	}
+	return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidDPoPProof, Description: err.Error()}
+}
+
+// requestURI returns the URI the request was made to, without the query, for
+// comparing to the htu. The scheme is https if the request was received over
+// TLS. Otherwise it is taken from the issuer, as TLS is usually terminated in
+// front of us.
+func (o *OIDC) requestURI(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	} else if iu, err := url.Parse(o.issuerFrom(req.Context())); err == nil && iu.Scheme != "" {
+		scheme = iu.Scheme
+	}
+	return scheme + "://" + req.Host + req.URL.EscapedPath()
+}
+
+// dpopURIMatches compares the htu to the request URI, ignoring any query and
+// fragment.
+//
+// https://www.rfc-editor.org/rfc/rfc9449#section-4.3
+func dpopURIMatches(htu, requestURI string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String() == requestURI
+}
+
+// checkDPoPBoundToken makes sure the access token was presented with the DPoP
+// scheme if and only if it is bound, and with a proof for it signed by the key
+// it is bound to.
+func (o *OIDC) checkDPoPBoundToken(req *http.Request, isDPoP bool, token string, stok *accessToken) error {
+	dpopErr := func(code bearerErrorCode, desc string) error {
+		be := &bearerError{Scheme: tokenTypeDPoP, Code: code, Description: desc}
+		if code == "" {
+			be.Code = bearerErrorCode(oauth2.TokenErrorCodeInvalidDPoPProof)
+		}
+		return &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: desc}
+	}
+
+	if stok.DPoPJKT == "" {
+		return dpopErr(bearerErrorCodeInvalidToken, "token is not DPoP bound")
+	}
+	if !isDPoP {
+		return dpopErr(bearerErrorCodeInvalidToken, "token is DPoP bound")
+	}
+	jkt, err := o.verifyDPoPProof(req, token)
+	if err != nil {
+		var herr *httpError
+		if errors.As(err, &herr) {
+			return herr
+		}
+		return dpopErr("", err.Error())
+	}
+	if jkt == "" {
+		return dpopErr("", "DPoP proof is required")
+	}
+	if jkt != stok.DPoPJKT {
+		return dpopErr(bearerErrorCodeInvalidToken, "token is bound to a different DPoP key")
+	}
+	return nil
+}
+
+// accessTokenType returns the token_type for the access token.
+func accessTokenType(tok *accessToken) string {
+	if tok.DPoPJKT != "" {
+		return tokenTypeDPoP
+	}
+	return string(tokenTypeBearer)
+}
+
+func dpopAlgSupported(alg jose.SignatureAlgorithm) bool {
+	for _, a := range DPoPSigningAlgsSupported {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
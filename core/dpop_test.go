@@ -0,0 +1,254 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestDPoP(t *testing.T) {
+	const (
+		issuer       = "https://issuer"
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(tp)
+
+	proof := func(t *testing.T, k *ecdsa.PrivateKey, htm, htu, accessToken string) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k}, &jose.SignerOptions{
+			EmbedJWK:     true,
+			ExtraHeaders: map[jose.HeaderKey]interface{}{jose.HeaderType: "dpop+jwt"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl := dpopProofClaims{
+			JTI:        mustGenerateID(),
+			HTTPMethod: htm,
+			HTTPURI:    htu,
+			IssuedAt:   time.Now().Unix(),
+		}
+		if accessToken != "" {
+			h := sha256.Sum256([]byte(accessToken))
+			cl.AccessTokenHash = base64.RawURLEncoding.EncodeToString(h[:])
+		}
+		b, err := json.Marshal(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	smgr := newStubSMGR()
+	o, err := New(&Config{Issuer: issuer}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ucode, scode, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putSession(context.Background(), smgr, &sessionV2{
+		ID:            ucode.SessionId,
+		ClientID:      clientID,
+		Stage:         sessionStageCode,
+		Request:       &sessAuthRequest{RedirectURI: redirectURI},
+		AuthCode:      scode,
+		Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+		Expiry:        time.Now().Add(1 * time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	redeem := func(t *testing.T, dpop string) *httptest.ResponseRecorder {
+		t.Helper()
+		body := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {mustMarshal(ucode)},
+			"redirect_uri": {redirectURI},
+		}
+		req := httptest.NewRequest(http.MethodPost, issuer+"/token", strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		req.Header.Set("DPoP", dpop)
+		rec := httptest.NewRecorder()
+		_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken(issuer, "subject", time.Now().Add(1*time.Minute)),
+			}, nil
+		})
+		return rec
+	}
+
+	wantTokenError := func(t *testing.T, rec *httptest.ResponseRecorder, code string) {
+		t.Helper()
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusBadRequest || resp.Error != code {
+			t.Errorf("want %d %s, got %d: %s", http.StatusBadRequest, code, rec.Code, rec.Body.String())
+		}
+	}
+
+	// the proof is checked before the code is redeemed, so it can be
+	// retried with a valid one.
+	wantTokenError(t, redeem(t, proof(t, key, http.MethodPost, "https://other/token", "")), "invalid_dpop_proof")
+
+	valid := proof(t, key, http.MethodPost, issuer+"/token", "")
+	rec := redeem(t, valid)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want token issued, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var tresp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &tresp); err != nil {
+		t.Fatal(err)
+	}
+	if tresp.TokenType != "DPoP" {
+		t.Errorf("want token_type DPoP, got: %s", tresp.TokenType)
+	}
+
+	wantTokenError(t, redeem(t, valid), "invalid_dpop_proof")
+
+	iresp, err := o.introspect(context.Background(), &tokenHintRequest{
+		Token:        tresp.AccessToken,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+		return &IntrospectionResponse{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnf, _ := iresp["cnf"].(map[string]interface{}); cnf["jkt"] != jkt {
+		t.Errorf("want cnf with jkt %s, got: %v", jkt, iresp["cnf"])
+	}
+	if iresp["token_type"] != "DPoP" {
+		t.Errorf("want introspected token_type DPoP, got: %v", iresp["token_type"])
+	}
+
+	userinfoProof := proof(t, key, http.MethodGet, issuer+"/userinfo", tresp.AccessToken)
+
+	for _, tc := range []struct {
+		Name       string
+		Scheme     string
+		Proof      string
+		WantStatus int
+	}{
+		{
+			Name:       "Valid proof",
+			Scheme:     "DPoP",
+			Proof:      userinfoProof,
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Replayed proof",
+			Scheme:     "DPoP",
+			Proof:      userinfoProof,
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "Bearer scheme",
+			Scheme:     "Bearer",
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "No proof",
+			Scheme:     "DPoP",
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "Mismatched htu",
+			Scheme:     "DPoP",
+			Proof:      proof(t, key, http.MethodGet, issuer+"/other", tresp.AccessToken),
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "Mismatched htm",
+			Scheme:     "DPoP",
+			Proof:      proof(t, key, http.MethodPost, issuer+"/userinfo", tresp.AccessToken),
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "Proof for another token",
+			Scheme:     "DPoP",
+			Proof:      proof(t, key, http.MethodGet, issuer+"/userinfo", "other-token"),
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "Proof signed by another key",
+			Scheme:     "DPoP",
+			Proof:      proof(t, otherKey, http.MethodGet, issuer+"/userinfo", tresp.AccessToken),
+			WantStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, issuer+"/userinfo", nil)
+			req.Header.Set("Authorization", tc.Scheme+" "+tresp.AccessToken)
+			if tc.Proof != "" {
+				req.Header.Set("DPoP", tc.Proof)
+			}
+			rec := httptest.NewRecorder()
+
+			_ = o.Userinfo(rec, req, func(w io.Writer, _ *UserinfoRequest) error {
+				_, err := w.Write([]byte(`{"sub":"subject"}`))
+				return err
+			})
+
+			if rec.Code != tc.WantStatus {
+				t.Errorf("want status %d, got %d: %s", tc.WantStatus, rec.Code, rec.Body.String())
+			}
+			if tc.WantStatus == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "DPoP ") {
+				t.Errorf("want DPoP challenge, got: %s", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
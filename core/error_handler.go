@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorResponse describes an error being shown to the user, rather than
+// returned to the client.
+type ErrorResponse struct {
+	// Code is the OAuth 2.0 error code that best describes the error, e.g
+	// invalid_request, access_denied or server_error.
+	Code string
+	// Description is a message that is safe to show the user. Internal
+	// details are never included.
+	Description string
+}
+
+// ErrorHandler renders errors that can't be returned to the client, like a
+// request with an invalid redirect URI, or a failure to load the session.
+// status is the HTTP status that should be used. Any WWW-Authenticate
+// challenge has already been set on w. It can be configured to show branded
+// error pages, or JSON errors for API style usage.
+//
+// Errors that the protocol returns to the client, by redirecting to it or
+// as a JSON body from the token endpoint, are not passed to it.
+type ErrorHandler func(w http.ResponseWriter, req *http.Request, status int, errResp *ErrorResponse)
+
+type errorHandlerContextKey struct{}
+
+// withErrorHandler returns the request with the configured ErrorHandler in
+// its context, for writeError to use. If none is configured, the request is
+// returned as is.
+func (o *OIDC) withErrorHandler(req *http.Request) *http.Request {
+	if o.errorHandler == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), errorHandlerContextKey{}, o.errorHandler))
+}
+
+// errorHandlerFrom returns the ErrorHandler set in the request's context, or
+// nil.
+func errorHandlerFrom(req *http.Request) ErrorHandler {
+	if req == nil {
+		return nil
+	}
+	eh, _ := req.Context().Value(errorHandlerContextKey{}).(ErrorHandler)
+	return eh
+}
+
+// httpErrorCode returns the OAuth 2.0 error code for an error shown to the
+// user. Authorization errors that couldn't be redirected keep their code,
+// otherwise it is derived from the status.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+func httpErrorCode(status int, cause error) string {
+	var aerr *authError
+	if errors.As(cause, &aerr) {
+		return string(aerr.Code)
+	}
+	switch {
+	case status == http.StatusServiceUnavailable:
+		return string(authErrorCodeErrTemporarilyUnvailable)
+	case status >= 500:
+		return string(authErrorCodeErrServerError)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return string(authErrorCodeAccessDenied)
+	default:
+		return string(authErrorCodeInvalidRequest)
+	}
+}
+
+// renderError writes an error that is shown to the user. The ErrorHandler in
+// the request's context renders it if there is one. Otherwise it is written
+// as a JSON error body if the request prefers JSON, like an API client or a
+// single page app calling the endpoint, or as plain text.
+func renderError(w http.ResponseWriter, req *http.Request, status int, errResp *ErrorResponse) {
+	if eh := errorHandlerFrom(req); eh != nil {
+		eh(w, req, status, errResp)
+		return
+	}
+	if req == nil || !prefersJSON(req.Header.Get("Accept")) {
+		http.Error(w, errResp.Description, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}{
+		Error:            errResp.Code,
+		ErrorDescription: errResp.Description,
+	})
+}
+
+// prefersJSON returns true if the Accept header ranks application/json above
+// text/html. Wildcards count towards both, but a type that is listed wins
+// over one that only matches a wildcard with the same quality, so browsers
+// that send */* along with text/html still get the page.
+//
+// https://tools.ietf.org/html/rfc7231#section-5.3.2
+func prefersJSON(accept string) bool {
+	var (
+		jsonQ, htmlQ           float64
+		jsonListed, htmlListed bool
+	)
+	for _, a := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		switch mt {
+		case "application/json":
+			jsonQ, jsonListed = q, true
+		case "text/html":
+			htmlQ, htmlListed = q, true
+		case "application/*":
+			if !jsonListed {
+				jsonQ = q
+			}
+		case "text/*", "*/*":
+			if !htmlListed && htmlQ == 0 {
+				htmlQ = q
+			}
+		}
+	}
+	if jsonQ == htmlQ {
+		return jsonQ > 0 && jsonListed && !htmlListed
+	}
+	return jsonQ > htmlQ
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestErrorHandler(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	var (
+		called  bool
+		gotResp *ErrorResponse
+	)
+	o, err := New(&Config{
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, status int, errResp *ErrorResponse) {
+			called, gotResp = true, errResp
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": errResp.Code})
+		},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(q url.Values) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			_, _ = o.StartAuthorization(w, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		}
+	}
+
+	for _, tc := range []struct {
+		Name          string
+		Do            func(w http.ResponseWriter)
+		WantCalled    bool
+		WantStatus    int
+		WantCode      string
+		WantChallenge bool
+	}{
+		{
+			Name: "Unregistered redirect URI",
+			Do: authorize(url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {"https://attacker"},
+				"scope":         {"openid"},
+			}),
+			WantCalled: true,
+			WantStatus: http.StatusBadRequest,
+			WantCode:   "invalid_request",
+		},
+		{
+			Name: "Unknown session",
+			Do: func(w http.ResponseWriter) {
+				_ = o.FinishAuthorization(w, httptest.NewRequest("POST", "/", nil), mustGenerateID(), &Authorization{Scopes: []string{"openid"}})
+			},
+			WantCalled: true,
+			WantStatus: http.StatusForbidden,
+			WantCode:   "access_denied",
+		},
+		{
+			Name: "Userinfo without a token",
+			Do: func(w http.ResponseWriter) {
+				_ = o.Userinfo(w, httptest.NewRequest("GET", "/userinfo", nil), nil)
+			},
+			WantCalled:    true,
+			WantStatus:    http.StatusUnauthorized,
+			WantCode:      "access_denied",
+			WantChallenge: true,
+		},
+		{
+			// errors that can be returned to the client are redirected as
+			// usual.
+			Name: "Redirected error",
+			Do: authorize(url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"prompt":        {"none login"},
+			}),
+			WantStatus: http.StatusFound,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			called, gotResp = false, nil
+			rec := httptest.NewRecorder()
+			tc.Do(rec)
+
+			if called != tc.WantCalled {
+				t.Fatalf("want error handler called %t, got: %t", tc.WantCalled, called)
+			}
+			if rec.Code != tc.WantStatus {
+				t.Errorf("want status %d, got: %d", tc.WantStatus, rec.Code)
+			}
+			if !tc.WantCalled {
+				return
+			}
+			if gotResp.Code != tc.WantCode {
+				t.Errorf("want error code %s, got: %s", tc.WantCode, gotResp.Code)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != tc.WantCode {
+				t.Errorf("want handler's JSON body, got: %s", rec.Body.String())
+			}
+			if tc.WantChallenge && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("want WWW-Authenticate challenge set before the handler")
+			}
+		})
+	}
+}
+
+func TestErrorContentNegotiation(t *testing.T) {
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			"client-id": csClient{RedirectURI: "https://redirect"},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Accept   string
+		WantJSON bool
+	}{
+		{Accept: "", WantJSON: false},
+		{Accept: "text/html", WantJSON: false},
+		{Accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", WantJSON: false},
+		{Accept: "application/json", WantJSON: true},
+		{Accept: "application/json, text/plain, */*", WantJSON: true},
+		{Accept: "text/html;q=0.5, application/json", WantJSON: true},
+		{Accept: "application/json;q=0.5, text/html", WantJSON: false},
+	} {
+		t.Run(tc.Accept, func(t *testing.T) {
+			// an unregistered redirect URI can't be redirected to.
+			req := httptest.NewRequest("GET", "/?"+url.Values{
+				"response_type": {"code"},
+				"client_id":     {"client-id"},
+				"redirect_uri":  {"https://attacker"},
+				"scope":         {"openid"},
+			}.Encode(), nil)
+			if tc.Accept != "" {
+				req.Header.Set("Accept", tc.Accept)
+			}
+			rec := httptest.NewRecorder()
+			_, _ = o.StartAuthorization(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("want status %d, got: %d", http.StatusBadRequest, rec.Code)
+			}
+			ct := rec.Header().Get("Content-Type")
+			if !tc.WantJSON {
+				if !strings.HasPrefix(ct, "text/plain") {
+					t.Errorf("want text/plain content type, got: %s", ct)
+				}
+				return
+			}
+			if !strings.HasPrefix(ct, "application/json") {
+				t.Fatalf("want application/json content type, got: %s", ct)
+			}
+			var body struct {
+				Error            string `json:"error"`
+				ErrorDescription string `json:"error_description"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != "invalid_request" || body.ErrorDescription == "" {
+				t.Errorf("want invalid_request error with a description, got: %s", rec.Body.String())
+			}
+		})
+	}
+}
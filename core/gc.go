@@ -0,0 +1,50 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/pardot/oidc/storage"
+)
+
+// RunGC periodically deletes expired sessions, and with them their codes and
+// tokens, until the context is canceled or the OIDC is Shutdown. It only does
+// something if the SessionManager implements storage.GarbageCollector, as
+// StorageSessionManager does, otherwise it returns immediately. It is safe to
+// run on every instance sharing a SessionManager, as collection is
+// idempotent. Each run is reported to the Metrics, if they implement
+// GCMetrics.
+func (o *OIDC) RunGC(ctx context.Context, interval time.Duration) {
+	gc, ok := o.smgr.(storage.GarbageCollector)
+	if !ok {
+		return
+	}
+
+	stop, ok := o.background.start()
+	if !ok {
+		return
+	}
+	defer o.background.finished()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		o.collectGarbage(ctx, gc)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (o *OIDC) collectGarbage(ctx context.Context, gc storage.GarbageCollector) {
+	deleted, err := gc.GarbageCollectExpired(ctx, o.now())
+	if m, ok := o.metrics.(GCMetrics); ok {
+		m.GarbageCollected(deleted, err)
+	}
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// gcSMGR is a stubSMGR that can collect expired sessions.
+type gcSMGR struct {
+	*stubSMGR
+}
+
+func (s *gcSMGR) GarbageCollectExpired(_ context.Context, now time.Time) (deleted int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sb := range s.sessions {
+		var vs struct {
+			Session struct {
+				Expiry time.Time `json:"expiry"`
+			} `json:"session"`
+		}
+		if err := json.Unmarshal(sb, &vs); err != nil {
+			return deleted, err
+		}
+		if now.After(vs.Session.Expiry) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type gcRun struct {
+	deleted int
+	err     error
+}
+
+type gcRecordingMetrics struct {
+	recordingMetrics
+	collected chan gcRun
+}
+
+func (r *gcRecordingMetrics) GarbageCollected(deleted int, err error) {
+	select {
+	case r.collected <- gcRun{deleted: deleted, err: err}:
+	default:
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	smgr := &gcSMGR{stubSMGR: newStubSMGR()}
+	m := &gcRecordingMetrics{collected: make(chan gcRun, 10)}
+	o, err := New(&Config{Metrics: m}, smgr, &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codeSess := func(expiry time.Time) *sessionV2 {
+		utok, stok, err := newToken(mustGenerateID(), expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess := &sessionV2{
+			ID:       utok.SessionId,
+			Stage:    sessionStageCode,
+			AuthCode: stok,
+			ClientID: "client-id",
+			Expiry:   expiry,
+			Request:  &sessAuthRequest{},
+		}
+		if err := putSession(ctx, smgr, sess); err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+	expired := codeSess(time.Now().Add(-1 * time.Minute))
+	valid := codeSess(time.Now().Add(1 * time.Minute))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.RunGC(ctx, 10*time.Millisecond)
+	}()
+
+	select {
+	case run := <-m.collected:
+		if run.err != nil {
+			t.Fatal(run.err)
+		}
+		if run.deleted != 1 {
+			t.Errorf("want 1 session collected, got %d", run.deleted)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for garbage collection")
+	}
+
+	if found, err := smgr.GetSession(ctx, expired.ID, &versionedSession{}); err != nil || found {
+		t.Errorf("want expired code session removed, got found %t err %v", found, err)
+	}
+	if found, err := smgr.GetSession(ctx, valid.ID, &versionedSession{}); err != nil || !found {
+		t.Errorf("want valid code session kept, got found %t err %v", found, err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("want RunGC to return when the context is canceled")
+	}
+}
+
+func TestRunGCUnsupported(t *testing.T) {
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.RunGC(context.Background(), 10*time.Millisecond)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("want RunGC to return if the session manager can't collect")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("Stops RunGC", func(t *testing.T) {
+		m := &gcRecordingMetrics{collected: make(chan gcRun, 10)}
+		o, err := New(&Config{Metrics: m}, &gcSMGR{stubSMGR: newStubSMGR()}, &stubCS{}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			o.RunGC(context.Background(), 10*time.Millisecond)
+		}()
+		// wait for it to be running
+		select {
+		case <-m.collected:
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for garbage collection")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		if err := o.Shutdown(ctx); err != nil {
+			t.Fatalf("want shutdown to return promptly, got: %v", err)
+		}
+		select {
+		case <-done:
+		default:
+			t.Fatal("want RunGC returned once shutdown returns")
+		}
+
+		if err := o.Shutdown(ctx); err != nil {
+			t.Errorf("want second shutdown to be a no-op, got: %v", err)
+		}
+
+		// once shut down, nothing new is started.
+		rgDone := make(chan struct{})
+		go func() {
+			defer close(rgDone)
+			o.RunGC(context.Background(), 10*time.Millisecond)
+		}()
+		select {
+		case <-rgDone:
+		case <-time.After(1 * time.Second):
+			t.Fatal("want RunGC to return after shutdown")
+		}
+	})
+
+	t.Run("Nothing started", func(t *testing.T) {
+		o, err := New(&Config{}, newStubSMGR(), &stubCS{}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		for i := 0; i < 2; i++ {
+			if err := o.Shutdown(ctx); err != nil {
+				t.Fatalf("shutdown %d: %v", i, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// DefaultHealthCheckTimeout is used if the HealthCheckTimeout is not
+// configured.
+const DefaultHealthCheckTimeout = 2 * time.Second
+
+// HealthChecker can be implemented by the SessionManager or ClientSource, to
+// let Readiness confirm they can reach whatever backs them.
+type HealthChecker interface {
+	// CheckHealth returns an error if the component can't currently serve
+	// requests. It should respect the context's deadline.
+	CheckHealth(ctx context.Context) error
+}
+
+// publicKeySource is implemented by signers that publish their keys, e.g
+// those in the signer package.
+type publicKeySource interface {
+	PublicKeys(ctx context.Context) (*jose.JSONWebKeySet, error)
+}
+
+// healthResponse is the body returned from the health endpoints.
+type healthResponse struct {
+	Status string `json:"status"`
+	// Failed is the component that failed the check, if one did.
+	Failed string `json:"failed,omitempty"`
+}
+
+// Liveness can handle a liveness probe, e.g /healthz. It always succeeds, as
+// if this is called the process is able to serve requests.
+func (o *OIDC) Liveness(w http.ResponseWriter, req *http.Request) {
+	writeHealthResponse(w, http.StatusOK, &healthResponse{Status: "ok"})
+}
+
+// Readiness can handle a readiness probe, e.g /readyz. It checks the
+// SessionManager and ClientSource if they implement HealthChecker, and that
+// the signer can sign, and publishes at least one key if it publishes them.
+// The checks are bounded by the HealthCheckTimeout. If all pass a 200 is
+// returned, otherwise a 503 naming the failed component. The error is also
+// returned, for logging.
+func (o *OIDC) Readiness(w http.ResponseWriter, req *http.Request) error {
+	ctx, cancel := context.WithTimeout(req.Context(), o.healthCheckTimeout)
+	defer cancel()
+
+	if component, err := o.checkReadiness(ctx); err != nil {
+		writeHealthResponse(w, http.StatusServiceUnavailable, &healthResponse{Status: "unavailable", Failed: component})
+		return fmt.Errorf("%s is not ready: %w", component, err)
+	}
+
+	writeHealthResponse(w, http.StatusOK, &healthResponse{Status: "ok"})
+	return nil
+}
+
+// checkReadiness returns the first component that fails its check, and why.
+func (o *OIDC) checkReadiness(ctx context.Context) (component string, err error) {
+	if hc, ok := o.smgr.(HealthChecker); ok {
+		if err := hc.CheckHealth(ctx); err != nil {
+			return "session_manager", err
+		}
+	}
+	if hc, ok := o.clients.(HealthChecker); ok {
+		if err := hc.CheckHealth(ctx); err != nil {
+			return "client_source", err
+		}
+	}
+	if err := checkSigner(ctx, o.signer); err != nil {
+		return "signer", err
+	}
+	return "", nil
+}
+
+func checkSigner(ctx context.Context, s Signer) error {
+	if _, err := s.SignerAlg(ctx); err != nil {
+		return err
+	}
+	pks, ok := s.(publicKeySource)
+	if !ok {
+		return nil
+	}
+	ks, err := pks.PublicKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if ks == nil || len(ks.Keys) == 0 {
+		return fmt.Errorf("no public keys")
+	}
+	return nil
+}
+
+func writeHealthResponse(w http.ResponseWriter, code int, resp *healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+type healthCheckSMGR struct {
+	*stubSMGR
+	check func(ctx context.Context) error
+}
+
+func (h *healthCheckSMGR) CheckHealth(ctx context.Context) error {
+	return h.check(ctx)
+}
+
+type noKeysSigner struct {
+	Signer
+}
+
+func (noKeysSigner) PublicKeys(_ context.Context) (*jose.JSONWebKeySet, error) {
+	return &jose.JSONWebKeySet{}, nil
+}
+
+func TestReadiness(t *testing.T) {
+	for _, tc := range []struct {
+		Name       string
+		Check      func(ctx context.Context) error
+		Signer     Signer
+		WantCode   int
+		WantFailed string
+	}{
+		{
+			Name:     "Healthy",
+			Check:    func(_ context.Context) error { return nil },
+			Signer:   testSigner,
+			WantCode: http.StatusOK,
+		},
+		{
+			Name:       "Storage failing",
+			Check:      func(_ context.Context) error { return errors.New("connection refused") },
+			Signer:     testSigner,
+			WantCode:   http.StatusServiceUnavailable,
+			WantFailed: "session_manager",
+		},
+		{
+			Name: "Storage hangs",
+			Check: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			Signer:     testSigner,
+			WantCode:   http.StatusServiceUnavailable,
+			WantFailed: "session_manager",
+		},
+		{
+			Name:       "Signer has no keys",
+			Check:      func(_ context.Context) error { return nil },
+			Signer:     noKeysSigner{testSigner},
+			WantCode:   http.StatusServiceUnavailable,
+			WantFailed: "signer",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{
+				HealthCheckTimeout: 10 * time.Millisecond,
+			}, &healthCheckSMGR{stubSMGR: newStubSMGR(), check: tc.Check}, &stubCS{}, tc.Signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			err = o.Readiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if (err != nil) != (tc.WantCode != http.StatusOK) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if rec.Code != tc.WantCode {
+				t.Errorf("want code %d, got: %d", tc.WantCode, rec.Code)
+			}
+			var resp healthResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Failed != tc.WantFailed {
+				t.Errorf("want failed %q, got: %q", tc.WantFailed, resp.Failed)
+			}
+		})
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	o, err := New(&Config{}, &healthCheckSMGR{
+		stubSMGR: newStubSMGR(),
+		check:    func(_ context.Context) error { return errors.New("down") },
+	}, &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// liveness doesn't depend on anything else being up.
+	rec := httptest.NewRecorder()
+	o.Liveness(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("want 200, got: %d", rec.Code)
+	}
+}
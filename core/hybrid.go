@@ -0,0 +1,198 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// hybrid returns true if tokens are returned from the authorization endpoint
+// along with the code.
+func (r authRequestResponseType) hybrid() bool {
+	return r.includesIDToken() || r.includesToken()
+}
+
+func (r authRequestResponseType) includesIDToken() bool {
+	return r == authRequestResponseTypeCodeIDToken || r == authRequestResponseTypeCodeIDTokenToken
+}
+
+func (r authRequestResponseType) includesToken() bool {
+	return r == authRequestResponseTypeCodeToken || r == authRequestResponseTypeCodeIDTokenToken
+}
+
+// finishHybridAuthorization issues a code like the code flow, but also returns
+// an ID token and/or access token directly to the client. The handler is used to
+// build them.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#HybridAuthResponse
+func (o *OIDC) finishHybridAuthorization(w http.ResponseWriter, req *http.Request, session *sessionV2, sessState string, handler func(req *TokenRequest) (*TokenResponse, error)) error {
+	if handler == nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", nil, "TokenHandler must be set to finish hybrid authorizations")
+	}
+
+	redir, err := url.Parse(session.Request.RedirectURI)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to parse authreq's URI")
+	}
+
+	code, err := o.issueAuthCode(session)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to issue code")
+	}
+
+	tr := &TokenRequest{
+		SessionID: session.ID,
+		ClientID:  session.ClientID,
+		Issuer:    o.issuerFrom(req.Context()),
+		Authorization: Authorization{
+			Scopes:    session.Authorization.Scopes,
+			ACR:       session.Authorization.ACR,
+			AMR:       session.Authorization.AMR,
+			SID:       session.Authorization.SID,
+			Connector: session.Authorization.Connector,
+		},
+		SessionRefreshable: strsContains(session.Authorization.Scopes, "offline_access"),
+		Nonce:              session.Request.Nonce,
+		AuthTime:           session.Authorization.AuthorizedAt,
+		Claims:             session.Request.Claims,
+		Resources:          session.Request.Resources,
+
+		authReq: session.Request,
+		now:     o.now,
+	}
+
+	tresp, err := handler(tr)
+	if err != nil {
+		var uaerr unauthorizedErr
+		if errors.As(err, &uaerr); uaerr != nil && uaerr.Unauthorized() {
+			return o.writeSessionAuthError(w, req, session, authErrorCodeAccessDenied, uaerr.Error(), err)
+		}
+		return o.writeSessionAuthError(w, req, session, authErrorCodeErrServerError, "internal error", err)
+	}
+
+	if err := o.applyClientTokenLifetimes(session.ClientID, tresp); err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	params := url.Values{"code": {code}}
+	if session.Request.State != "" {
+		params.Set("state", session.Request.State)
+	}
+	if sessState != "" {
+		params.Set("session_state", sessState)
+	}
+
+	var accessTok string
+	if session.Request.ResponseType.includesToken() {
+		if tresp.AccessTokenValidUntil.Before(o.now()) {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", nil, "access token must be valid > now")
+		}
+		uatok, satok, err := newToken(session.ID, tresp.AccessTokenValidUntil)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to generate access token")
+		}
+		satok.IssuedAt = o.now()
+		satok.Audience = session.Request.Resources
+		satok.IPRanges, err = o.clientIPRanges(session.ClientID)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to get client IP ranges")
+		}
+		session.AccessToken = satok
+		if satok.Expiry.After(session.Expiry) {
+			session.Expiry = satok.Expiry
+		}
+
+		accessTok, err = marshalToken(uatok)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to marshal access token")
+		}
+		accessTok, err = o.formatAccessToken(req.Context(), accessTok, &jwtAccessToken{
+			Subject:  tresp.IDToken.Subject,
+			ClientID: session.ClientID,
+			Audience: session.Request.Resources,
+			Scopes:   session.Authorization.Scopes,
+			Token:    satok,
+			AuthTime: session.Authorization.AuthorizedAt,
+			ACR:      session.Authorization.ACR,
+			AMR:      session.Authorization.AMR,
+		})
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to format access token")
+		}
+		params.Set("access_token", accessTok)
+		params.Set("token_type", string(tokenTypeBearer))
+		params.Set("expires_in", fmt.Sprintf("%d", int(tresp.AccessTokenValidUntil.Sub(o.now()).Seconds())))
+	}
+
+	if session.Request.ResponseType.includesIDToken() {
+		alg, err := o.idTokenAlg(req.Context(), session.ClientID)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to get id token signing algorithm")
+		}
+		idt := tresp.IDToken
+		ensureAuthTime(&idt, session)
+		// https://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+		if idt.CodeHash, err = tokenHash(alg, code); err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to hash code")
+		}
+		if accessTok != "" {
+			if idt.AccessTokenHash, err = tokenHash(alg, accessTok); err != nil {
+				return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to hash access token")
+			}
+		}
+
+		idtb, err := json.Marshal(idt)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to marshal id token")
+		}
+		idtb, err = o.finalizeClaims(req.Context(), sessionIdentity(session), session.Request.Claims.idToken(), idtb)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to finalize id token claims")
+		}
+		sidt, err := o.signIDToken(req.Context(), alg, idtb)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to sign id token")
+		}
+		sidt, err = o.encryptIDToken(session.ClientID, sidt)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to encrypt id token")
+		}
+		params.Set("id_token", string(sidt))
+	}
+
+	if err := putSession(req.Context(), o.smgr, session); err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to put session to storage")
+	}
+
+	o.audit(req.Context(), AuditEvent{
+		Type:         AuditEventTokenIssued,
+		ClientID:     session.ClientID,
+		Subject:      tresp.IDToken.Subject,
+		Scopes:       session.Authorization.Scopes,
+		GrantType:    GrantTypeImplicit,
+		ResponseType: string(session.Request.ResponseType),
+	})
+
+	// tokens are returned in the fragment by default, so they aren't sent to
+	// the client's server.
+	mode := responseModeFor(session.Request.ResponseMode, true)
+
+	if mode.isJWT() {
+		claims := map[string]interface{}{}
+		for k := range params {
+			claims[k] = params.Get(k)
+		}
+		signed, err := o.signAuthResponse(req.Context(), session.ClientID, claims)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to sign authorization response")
+		}
+		params = url.Values{"response": {signed}}
+	}
+
+	sendAuthResponse(w, req, redir, mode, params, o.formPostTemplate)
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestHybridFlow(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name         string
+		ResponseType string
+		ResponseMode string
+		NoNonce      bool
+		// WantStartErr indicates StartAuthorization should redirect back with
+		// an error
+		WantStartErr   string
+		WantIDToken    bool
+		WantAccessTok  bool
+		WantInFragment bool
+		WantInQuery    bool
+	}{
+		{
+			Name:         "code defaults to query",
+			ResponseType: "code",
+			WantInQuery:  true,
+		},
+		{
+			Name:           "code id_token",
+			ResponseType:   "code id_token",
+			WantIDToken:    true,
+			WantInFragment: true,
+		},
+		{
+			Name:           "code token",
+			ResponseType:   "code token",
+			NoNonce:        true,
+			WantAccessTok:  true,
+			WantInFragment: true,
+		},
+		{
+			Name:           "code id_token token",
+			ResponseType:   "code id_token token",
+			WantIDToken:    true,
+			WantAccessTok:  true,
+			WantInFragment: true,
+		},
+		{
+			Name:           "Values in any order",
+			ResponseType:   "token id_token code",
+			WantIDToken:    true,
+			WantAccessTok:  true,
+			WantInFragment: true,
+		},
+		{
+			Name:         "form_post mode",
+			ResponseType: "code id_token",
+			ResponseMode: "form_post",
+			WantIDToken:  true,
+		},
+		{
+			Name:           "Missing nonce with id_token",
+			ResponseType:   "code id_token",
+			NoNonce:        true,
+			WantStartErr:   "invalid_request",
+			WantInFragment: true,
+		},
+		{
+			Name:         "Query response mode",
+			ResponseType: "code token",
+			ResponseMode: "query",
+			WantStartErr: "invalid_request",
+		},
+		{
+			Name:         "Query JWT response mode",
+			ResponseType: "code id_token",
+			ResponseMode: "query.jwt",
+			WantStartErr: "invalid_request",
+		},
+		{
+			Name:         "Implicit with query response mode",
+			ResponseType: "token",
+			ResponseMode: "query",
+			WantStartErr: "invalid_request",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+					},
+				},
+
+				authValidityTime: 1 * time.Minute,
+				codeValidityTime: 1 * time.Minute,
+
+				now: time.Now,
+			}
+
+			q := url.Values{
+				"response_type": {tc.ResponseType},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"state":         {"state"},
+			}
+			if !tc.NoNonce {
+				q.Set("nonce", "nonce")
+			}
+			if tc.ResponseMode != "" {
+				q.Set("response_mode", tc.ResponseMode)
+			}
+
+			rec := httptest.NewRecorder()
+			areq, err := o.StartAuthorization(rec, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+			if tc.WantStartErr != "" {
+				if err == nil {
+					t.Fatal("want error starting authorization, got none")
+				}
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				params := loc.Query()
+				if tc.WantInFragment {
+					if params, err = url.ParseQuery(loc.Fragment); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := params.Get("error"); got != tc.WantStartErr {
+					t.Errorf("want error %s, got: %s", tc.WantStartErr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec = httptest.NewRecorder()
+			err = o.FinishAuthorization(rec, httptest.NewRequest(http.MethodPost, "/", nil), areq.SessionID, &Authorization{
+				Scopes: []string{"openid"},
+				TokenHandler: func(tr *TokenRequest) (*TokenResponse, error) {
+					return &TokenResponse{
+						AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+						IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+					}, nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var resp url.Values
+			switch {
+			case tc.WantInFragment:
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if loc.RawQuery != "" {
+					t.Errorf("want no query parameters, got: %s", loc.RawQuery)
+				}
+				resp, err = url.ParseQuery(loc.Fragment)
+				if err != nil {
+					t.Fatal(err)
+				}
+			case tc.WantInQuery:
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if loc.Fragment != "" {
+					t.Errorf("want no fragment, got: %s", loc.Fragment)
+				}
+				resp = loc.Query()
+			default:
+				// pull the values out of the form
+				resp = formPostValues(t, rec.Body.String())
+			}
+
+			if resp.Get("state") != "state" {
+				t.Errorf("want state returned, got: %s", resp.Get("state"))
+			}
+			code := resp.Get("code")
+			if code == "" {
+				t.Fatal("want code returned, got none")
+			}
+
+			accessTok := resp.Get("access_token")
+			if tc.WantAccessTok && (accessTok == "" || resp.Get("token_type") != "Bearer" || resp.Get("expires_in") == "") {
+				t.Errorf("want access token returned, got: %v", resp)
+			}
+			if !tc.WantAccessTok && accessTok != "" {
+				t.Errorf("want no access token returned, got: %s", accessTok)
+			}
+
+			if tc.WantIDToken {
+				idtp, err := testSigner.VerifySignature(ctx, resp.Get("id_token"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				idt := oidc.Claims{}
+				if err := json.Unmarshal(idtp, &idt); err != nil {
+					t.Fatal(err)
+				}
+				if idt.Nonce != "nonce" {
+					t.Errorf("want nonce in ID token, got: %s", idt.Nonce)
+				}
+				if want, _ := tokenHash(jose.RS256, code); idt.CodeHash != want {
+					t.Errorf("want c_hash %s, got: %s", want, idt.CodeHash)
+				}
+				var wantATHash string
+				if accessTok != "" {
+					wantATHash, _ = tokenHash(jose.RS256, accessTok)
+				}
+				if idt.AccessTokenHash != wantATHash {
+					t.Errorf("want at_hash %q, got: %q", wantATHash, idt.AccessTokenHash)
+				}
+			} else if resp.Get("id_token") != "" {
+				t.Error("want no ID token returned")
+			}
+
+			// the code can still be exchanged as normal
+			if _, err := o.token(ctx, &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         code,
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{AccessTokenValidUntil: time.Now().Add(1 * time.Minute)}, nil
+			}); err != nil {
+				t.Errorf("exchanging code: %v", err)
+			}
+		})
+	}
+}
+
+// formPostValues extracts the hidden inputs from a form_post response page.
+func formPostValues(t *testing.T, body string) url.Values {
+	t.Helper()
+	v := url.Values{}
+	for {
+		const pfx = `<input type="hidden" name="`
+		i := strings.Index(body, pfx)
+		if i < 0 {
+			return v
+		}
+		body = body[i+len(pfx):]
+		name := body[:strings.Index(body, `"`)]
+		body = body[strings.Index(body, `value="`)+len(`value="`):]
+		v.Add(name, body[:strings.Index(body, `"`)])
+	}
+}
+
+func TestHybridError(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name         string
+		ResponseMode string
+		// Params extracts the parameters sent to the client
+		Params func(t *testing.T, rec *httptest.ResponseRecorder) url.Values
+	}{
+		{
+			Name: "Defaults to fragment",
+			Params: func(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if loc.RawQuery != "" {
+					t.Errorf("want no query parameters, got: %s", loc.RawQuery)
+				}
+				frag, err := url.ParseQuery(loc.Fragment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return frag
+			},
+		},
+		{
+			Name:         "form_post mode",
+			ResponseMode: "form_post",
+			Params: func(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+				return formPostValues(t, rec.Body.String())
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{RedirectURI: redirectURI},
+					},
+				},
+
+				authValidityTime: 1 * time.Minute,
+				codeValidityTime: 1 * time.Minute,
+
+				now: time.Now,
+			}
+
+			q := url.Values{
+				"response_type": {"code id_token"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"state":         {"state"},
+				"nonce":         {"nonce"},
+			}
+			if tc.ResponseMode != "" {
+				q.Set("response_mode", tc.ResponseMode)
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			err = o.FinishAuthorization(rec, httptest.NewRequest(http.MethodPost, "/", nil), areq.SessionID, &Authorization{
+				Scopes: []string{"openid"},
+				TokenHandler: func(tr *TokenRequest) (*TokenResponse, error) {
+					return nil, &unauthorizedErrImpl{errors.New("user is disabled")}
+				},
+			})
+			if err == nil {
+				t.Fatal("want error, got none")
+			}
+
+			params := tc.Params(t, rec)
+			if got := params.Get("error"); got != string(authErrorCodeAccessDenied) {
+				t.Errorf("want error %s, got: %s", authErrorCodeAccessDenied, got)
+			}
+			if params.Get("state") != "state" {
+				t.Errorf("want state returned, got: %s", params.Get("state"))
+			}
+		})
+	}
+}
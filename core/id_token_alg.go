@@ -0,0 +1,116 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// MultiAlgSigner can be implemented by a Signer that can sign with more than
+// one algorithm, so clients can have their ID tokens signed with the algorithm
+// they registered for. The SignerAlg is used as the default.
+type MultiAlgSigner interface {
+	// SupportedAlgs returns the algorithms the signer can sign with.
+	SupportedAlgs(ctx context.Context) ([]jose.SignatureAlgorithm, error)
+	// SignWithAlg signs the provided data with a key for the algorithm.
+	SignWithAlg(ctx context.Context, alg jose.SignatureAlgorithm, data []byte) (signed []byte, err error)
+}
+
+// IDTokenSigningClientSource can be implemented by a ClientSource to have ID
+// tokens for some clients signed with a different algorithm to the Signer's
+// default. The Signer must implement MultiAlgSigner, and support the
+// algorithm.
+//
+// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+type IDTokenSigningClientSource interface {
+	// ClientIDTokenSignedResponseAlg should return the algorithm the client's
+	// ID tokens should be signed with. If empty, the Signer's default is
+	// used.
+	ClientIDTokenSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error)
+}
+
+// signerSupportsAlg returns true if the signer can sign with alg.
+func (o *OIDC) signerSupportsAlg(ctx context.Context, alg jose.SignatureAlgorithm) (bool, error) {
+	salg, err := o.signer.SignerAlg(ctx)
+	if err != nil {
+		return false, fmt.Errorf("getting signer alg: %w", err)
+	}
+	if alg == salg {
+		return true, nil
+	}
+	mas, ok := o.signer.(MultiAlgSigner)
+	if !ok {
+		return false, nil
+	}
+	algs, err := mas.SupportedAlgs(ctx)
+	if err != nil {
+		return false, fmt.Errorf("getting signer supported algs: %w", err)
+	}
+	for _, a := range algs {
+		if a == alg {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clientIDTokenAlg returns the algorithm the client registered for its ID
+// tokens to be signed with, or empty if it did not.
+func (o *OIDC) clientIDTokenAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	ics, ok := o.clients.(IDTokenSigningClientSource)
+	if !ok {
+		return "", nil
+	}
+	alg, err := ics.ClientIDTokenSignedResponseAlg(clientID)
+	if err != nil {
+		return "", fmt.Errorf("getting client id token signing alg: %w", err)
+	}
+	return alg, nil
+}
+
+// clientIDTokenAlgSupported returns false if the client registered for an ID
+// token signing algorithm the signer does not support.
+func (o *OIDC) clientIDTokenAlgSupported(ctx context.Context, clientID string) (bool, error) {
+	alg, err := o.clientIDTokenAlg(clientID)
+	if err != nil || alg == "" {
+		return true, err
+	}
+	return o.signerSupportsAlg(ctx, alg)
+}
+
+// idTokenAlg returns the algorithm to sign ID tokens for the client with,
+// falling back to the signer's default.
+func (o *OIDC) idTokenAlg(ctx context.Context, clientID string) (jose.SignatureAlgorithm, error) {
+	alg, err := o.clientIDTokenAlg(clientID)
+	if err != nil {
+		return "", err
+	}
+	if alg == "" {
+		return o.signer.SignerAlg(ctx)
+	}
+	ok, err := o.signerSupportsAlg(ctx, alg)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("client %s wants id tokens signed with %s, which the signer does not support", clientID, alg)
+	}
+	return alg, nil
+}
+
+// signIDToken signs the ID token with the algorithm from idTokenAlg.
+func (o *OIDC) signIDToken(ctx context.Context, alg jose.SignatureAlgorithm, data []byte) ([]byte, error) {
+	salg, err := o.signer.SignerAlg(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting signer alg: %w", err)
+	}
+	if alg == salg {
+		return o.signer.Sign(ctx, data)
+	}
+	mas, ok := o.signer.(MultiAlgSigner)
+	if !ok {
+		return nil, fmt.Errorf("signer can not sign with %s", alg)
+	}
+	return mas.SignWithAlg(ctx, alg, data)
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/signer"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestIDTokenSigningAlg(t *testing.T) {
+	const (
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	rsaKey := mustGenRSAKey(512)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	multiSigner, err := signer.NewStaticMultiAlg(
+		[]jose.SigningKey{
+			{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: rsaKey, KeyID: "rsa"}},
+			{Algorithm: jose.ES256, Key: &jose.JSONWebKey{Key: ecKey, KeyID: "ec"}},
+		},
+		[]jose.JSONWebKey{
+			{Key: rsaKey.Public(), KeyID: "rsa", Algorithm: "RS256", Use: "sig"},
+			{Key: ecKey.Public(), KeyID: "ec", Algorithm: "ES256", Use: "sig"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		Signer    Signer
+		ClientAlg jose.SignatureAlgorithm
+		WantAlg   string
+		WantErr   bool
+	}{
+		{
+			Name:    "Signer default",
+			Signer:  multiSigner,
+			WantAlg: "RS256",
+		},
+		{
+			Name:      "Client registered alg",
+			Signer:    multiSigner,
+			ClientAlg: jose.ES256,
+			WantAlg:   "ES256",
+		},
+		{
+			Name:      "Client registered for an alg the signer does not support",
+			Signer:    multiSigner,
+			ClientAlg: jose.EdDSA,
+			WantErr:   true,
+		},
+		{
+			Name:      "Client registered for another alg with a single alg signer",
+			Signer:    testSigner,
+			ClientAlg: jose.ES256,
+			WantErr:   true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			const clientID = "client-id"
+
+			o, err := New(&Config{}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI, IDTokenSignedResponseAlg: tc.ClientAlg},
+				},
+			}, tc.Signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"state":         {"state"},
+			}
+			rec := httptest.NewRecorder()
+			areq, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error starting authorization")
+				}
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := loc.Query().Get("error"); got != string(authErrorCodeUnauthorizedClient) {
+					t.Errorf("want error %s, got %s", authErrorCodeUnauthorizedClient, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec = httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tresp, err := o.token(context.Background(), &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         loc.Query().Get("code"),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			idt, _ := tresp.ExtraParams["id_token"].(string)
+			jws, err := jose.ParseSigned(idt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := jws.Signatures[0].Header.Algorithm; got != tc.WantAlg {
+				t.Errorf("want id token signed with %s, got %s", tc.WantAlg, got)
+			}
+			if _, err := tc.Signer.VerifySignature(context.Background(), idt); err != nil {
+				t.Errorf("want id token to verify, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// IDTokenEncryptionAlgsSupported are the key management algorithms ID tokens
+// can be encrypted with, for id_token_encryption_alg_values_supported.
+var IDTokenEncryptionAlgsSupported = []jose.KeyAlgorithm{
+	jose.RSA_OAEP,
+	jose.RSA_OAEP_256,
+	jose.ECDH_ES,
+	jose.ECDH_ES_A128KW,
+	jose.ECDH_ES_A192KW,
+	jose.ECDH_ES_A256KW,
+}
+
+// IDTokenEncryptionEncsSupported are the content encryption algorithms ID
+// tokens can be encrypted with, for id_token_encryption_enc_values_supported.
+var IDTokenEncryptionEncsSupported = []jose.ContentEncryption{
+	jose.A128CBC_HS256,
+	jose.A192CBC_HS384,
+	jose.A256CBC_HS512,
+	jose.A128GCM,
+	jose.A192GCM,
+	jose.A256GCM,
+}
+
+// defaultIDTokenEncryptionEnc is used if a client sets an alg but no enc.
+//
+// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+const defaultIDTokenEncryptionEnc = jose.A128CBC_HS256
+
+// IDTokenEncryptionClientSource can be implemented by a ClientSource to have
+// ID tokens for some clients encrypted, as a nested JWT. The token is
+// encrypted to a key from the client's JWKS, so the ClientSource must also
+// implement ClientJWKSSource.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#SigningOrder
+type IDTokenEncryptionClientSource interface {
+	// ClientIDTokenEncryption should return the algorithms the client's ID
+	// tokens should be encrypted with. If alg is empty, ID tokens are not
+	// encrypted. If enc is empty, A128CBC-HS256 is used.
+	ClientIDTokenEncryption(clientID string) (alg jose.KeyAlgorithm, enc jose.ContentEncryption, err error)
+}
+
+func keyAlgSupported(alg jose.KeyAlgorithm) bool {
+	for _, a := range IDTokenEncryptionAlgsSupported {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func contentEncSupported(enc jose.ContentEncryption) bool {
+	for _, e := range IDTokenEncryptionEncsSupported {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptIDToken encrypts the signed ID token for the client, if it has
+// registered for encrypted ID tokens. Otherwise it is returned unchanged.
+func (o *OIDC) encryptIDToken(clientID string, signed []byte) ([]byte, error) {
+	ecs, ok := o.clients.(IDTokenEncryptionClientSource)
+	if !ok {
+		return signed, nil
+	}
+	alg, enc, err := ecs.ClientIDTokenEncryption(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("getting client id token encryption: %w", err)
+	}
+	if alg == "" {
+		return signed, nil
+	}
+	if enc == "" {
+		enc = defaultIDTokenEncryptionEnc
+	}
+
+	ks, ok := o.clients.(ClientJWKSSource)
+	if !ok {
+		return nil, fmt.Errorf("client %s wants encrypted id tokens, but client keys are not available", clientID)
+	}
+	jwks, err := ks.ClientJWKS(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("getting keys for client %s: %w", clientID, err)
+	}
+	key, ok := clientEncryptionKey(jwks, alg)
+	if !ok {
+		return nil, fmt.Errorf("client %s has no key to encrypt id tokens with %s", clientID, alg)
+	}
+
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{
+		Algorithm: alg,
+		Key:       key.Key,
+		KeyID:     key.KeyID,
+	}, (&jose.EncrypterOptions{}).WithContentType("JWT"))
+	if err != nil {
+		return nil, fmt.Errorf("creating encrypter: %w", err)
+	}
+	jwe, err := encrypter.Encrypt(signed)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting id token: %w", err)
+	}
+	ser, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, fmt.Errorf("serializing encrypted id token: %w", err)
+	}
+	return []byte(ser), nil
+}
+
+// clientEncryptionKey finds the first public key in the set that can be used
+// to encrypt with alg.
+func clientEncryptionKey(jwks *jose.JSONWebKeySet, alg jose.KeyAlgorithm) (jose.JSONWebKey, bool) {
+	if jwks == nil {
+		return jose.JSONWebKey{}, false
+	}
+	for _, k := range jwks.Keys {
+		if !k.IsPublic() || k.Use == "sig" {
+			continue
+		}
+		if k.Algorithm != "" && k.Algorithm != string(alg) {
+			continue
+		}
+		switch k.Key.(type) {
+		case *rsa.PublicKey:
+			if alg == jose.RSA_OAEP || alg == jose.RSA_OAEP_256 {
+				return k, true
+			}
+		case *ecdsa.PublicKey:
+			if alg == jose.ECDH_ES || alg == jose.ECDH_ES_A128KW || alg == jose.ECDH_ES_A192KW || alg == jose.ECDH_ES_A256KW {
+				return k, true
+			}
+		}
+	}
+	return jose.JSONWebKey{}, false
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestIDTokenEncryption(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	rsaKey := mustGenRSAKey(2048)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name       string
+		Alg        jose.KeyAlgorithm
+		Enc        jose.ContentEncryption
+		JWKS       *jose.JSONWebKeySet
+		DecryptKey interface{}
+		WantEnc    jose.ContentEncryption
+		WantErr    bool
+	}{
+		{
+			Name: "Not encrypted by default",
+		},
+		{
+			Name: "RSA-OAEP-256",
+			Alg:  jose.RSA_OAEP_256,
+			Enc:  jose.A256GCM,
+			JWKS: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: rsaKey.Public(), KeyID: "enc-rsa", Use: "enc"},
+			}},
+			DecryptKey: rsaKey,
+			WantEnc:    jose.A256GCM,
+		},
+		{
+			Name: "ECDH-ES with default enc",
+			Alg:  jose.ECDH_ES,
+			JWKS: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				// signing keys are skipped
+				{Key: rsaKey.Public(), KeyID: "sig-rsa", Use: "sig"},
+				{Key: ecKey.Public(), KeyID: "enc-ec"},
+			}},
+			DecryptKey: ecKey,
+			WantEnc:    jose.A128CBC_HS256,
+		},
+		{
+			Name: "No usable key",
+			Alg:  jose.ECDH_ES,
+			JWKS: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: rsaKey.Public(), KeyID: "enc-rsa", Use: "enc"},
+			}},
+			WantErr: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{
+						Secret:                      clientSecret,
+						RedirectURI:                 redirectURI,
+						JWKS:                        tc.JWKS,
+						IDTokenEncryptedResponseAlg: tc.Alg,
+						IDTokenEncryptedResponseEnc: tc.Enc,
+					},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tresp, err := o.token(context.Background(), &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         loc.Query().Get("code"),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error issuing token")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			idt, _ := tresp.ExtraParams["id_token"].(string)
+
+			signed := idt
+			if tc.Alg != "" {
+				jwe, err := jose.ParseEncrypted(idt)
+				if err != nil {
+					t.Fatalf("want encrypted id token, got: %v", err)
+				}
+				if got := jwe.Header.Algorithm; got != string(tc.Alg) {
+					t.Errorf("want alg %s, got %s", tc.Alg, got)
+				}
+				if got := jwe.Header.ExtraHeaders[jose.HeaderKey("enc")]; got != string(tc.WantEnc) {
+					t.Errorf("want enc %s, got %v", tc.WantEnc, got)
+				}
+				if got := jwe.Header.ExtraHeaders[jose.HeaderContentType]; got != "JWT" {
+					t.Errorf("want cty JWT, got %v", got)
+				}
+				dec, err := jwe.Decrypt(tc.DecryptKey)
+				if err != nil {
+					t.Fatalf("decrypting id token: %v", err)
+				}
+				signed = string(dec)
+			}
+
+			payload, err := testSigner.VerifySignature(context.Background(), signed)
+			if err != nil {
+				t.Fatalf("want signed id token, got: %v", err)
+			}
+			var cl oidc.Claims
+			if err := json.Unmarshal(payload, &cl); err != nil {
+				t.Fatal(err)
+			}
+			if cl.Subject != "subject" {
+				t.Errorf("want subject, got %s", cl.Subject)
+			}
+		})
+	}
+}
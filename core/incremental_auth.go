@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"fmt"
+)
+
+// GrantStore can be configured to track the scopes each user has granted each
+// client, so clients can use incremental authorization. This asks the user for
+// only the scopes the client doesn't have yet, and can have the new
+// authorization include those previously granted.
+//
+// https://developers.google.com/identity/protocols/oauth2/web-server#incrementalAuth
+type GrantStore interface {
+	// GrantedScopes returns the scopes the subject has previously granted
+	// the client, or nothing if they have not.
+	GrantedScopes(ctx context.Context, clientID, subject string) ([]string, error)
+	// PutGrantedScopes records the full set of scopes the subject has granted
+	// the client, replacing any previous set.
+	PutGrantedScopes(ctx context.Context, clientID, subject string, scopes []string) error
+}
+
+// NewScopes returns the scopes in the request that the subject has not already
+// granted the client. Consent UI can use this to only ask for the scopes being
+// added. If no GrantStore is configured, all the requested scopes are returned.
+func (o *OIDC) NewScopes(ctx context.Context, areq *AuthorizationRequest, subject string) ([]string, error) {
+	if o.grantStore == nil {
+		return areq.Scopes, nil
+	}
+	granted, err := o.grantStore.GrantedScopes(ctx, areq.ClientID, subject)
+	if err != nil {
+		return nil, fmt.Errorf("getting granted scopes: %w", err)
+	}
+	var scopes []string
+	for _, s := range areq.Scopes {
+		if !strsContains(granted, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// ConsentRequired returns true if the user should be shown the approval screen
+// for the request. If RememberConsent is set, this is only needed when the
+// client asks for scopes the subject has not already granted it, or passed
+// prompt=consent. Otherwise consent is always required.
+func (o *OIDC) ConsentRequired(ctx context.Context, areq *AuthorizationRequest, subject string) (bool, error) {
+	if !o.rememberConsent || promptsContain(areq.Prompt, PromptConsent) {
+		return true, nil
+	}
+	scopes, err := o.NewScopes(ctx, areq, subject)
+	if err != nil {
+		return false, err
+	}
+	return len(scopes) > 0, nil
+}
+
+// grantScopes records the scopes the subject granted the client in this
+// authorization, returning the scopes the session should be authorized for.
+// These include those previously granted if the client passed
+// include_granted_scopes.
+func (o *OIDC) grantScopes(ctx context.Context, sess *sessionV2, auth *Authorization) ([]string, error) {
+	if o.grantStore == nil || auth.Subject == "" {
+		return auth.Scopes, nil
+	}
+	granted, err := o.grantStore.GrantedScopes(ctx, sess.ClientID, auth.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("getting granted scopes: %w", err)
+	}
+	all := append([]string{}, granted...)
+	for _, s := range auth.Scopes {
+		if !strsContains(all, s) {
+			all = append(all, s)
+		}
+	}
+	if len(all) != len(granted) {
+		if err := o.grantStore.PutGrantedScopes(ctx, sess.ClientID, auth.Subject, all); err != nil {
+			return nil, fmt.Errorf("putting granted scopes: %w", err)
+		}
+	}
+	if sess.Request.IncludeGrantedScopes {
+		return all, nil
+	}
+	return auth.Scopes, nil
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIncrementalAuthorization(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+		subject      = "subject"
+	)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		Name       string
+		Include    bool
+		WantScopes []string
+	}{
+		{
+			Name:       "Include granted scopes",
+			Include:    true,
+			WantScopes: []string{"openid", "profile", "email"},
+		},
+		{
+			Name:       "Only new scopes",
+			WantScopes: []string{"openid", "email"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			grants := &stubGrantStore{grants: map[string][]string{}}
+			o, err := New(&Config{GrantStore: grants}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// authorize runs an authorization for scope, returning the
+			// scopes the user was asked for and the scopes the token was
+			// issued for.
+			authorize := func(t *testing.T, scope string, include bool) (asked, issued []string) {
+				t.Helper()
+				q := url.Values{
+					"response_type": {"code"},
+					"client_id":     {clientID},
+					"redirect_uri":  {redirectURI},
+					"scope":         {scope},
+				}
+				if include {
+					q.Set("include_granted_scopes", "true")
+				}
+				areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if areq.IncludeGrantedScopes != include {
+					t.Errorf("want IncludeGrantedScopes %t, got: %t", include, areq.IncludeGrantedScopes)
+				}
+				asked, err = o.NewScopes(ctx, areq, subject)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rec := httptest.NewRecorder()
+				if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: areq.Scopes, Subject: subject}); err != nil {
+					t.Fatal(err)
+				}
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := o.token(ctx, &tokenRequest{
+					GrantType:    GrantTypeAuthorizationCode,
+					Code:         loc.Query().Get("code"),
+					RedirectURI:  redirectURI,
+					ClientID:     clientID,
+					ClientSecret: clientSecret,
+				}, func(tr *TokenRequest) (*TokenResponse, error) {
+					issued = tr.Authorization.Scopes
+					return &TokenResponse{
+						AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+						IDToken:               tr.PrefillIDToken("https://issuer", subject, time.Now().Add(1*time.Minute)),
+					}, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return asked, issued
+			}
+
+			asked, issued := authorize(t, "openid profile", false)
+			if diff := cmp.Diff([]string{"openid", "profile"}, asked); diff != "" {
+				t.Errorf("first authorization should ask for all scopes: %s", diff)
+			}
+			if diff := cmp.Diff([]string{"openid", "profile"}, issued); diff != "" {
+				t.Errorf("unexpected scopes for first token: %s", diff)
+			}
+
+			asked, issued = authorize(t, "openid email", tc.Include)
+			if diff := cmp.Diff([]string{"email"}, asked); diff != "" {
+				t.Errorf("second authorization should only ask for new scopes: %s", diff)
+			}
+			if diff := cmp.Diff(tc.WantScopes, issued); diff != "" {
+				t.Errorf("unexpected scopes for second token: %s", diff)
+			}
+
+			if diff := cmp.Diff([]string{"openid", "profile", "email"}, grants.grants[clientID+"/"+subject]); diff != "" {
+				t.Errorf("want all granted scopes stored: %s", diff)
+			}
+		})
+	}
+}
+
+type stubGrantStore struct {
+	grants map[string][]string
+}
+
+func (s *stubGrantStore) GrantedScopes(_ context.Context, clientID, subject string) ([]string, error) {
+	return s.grants[clientID+"/"+subject], nil
+}
+
+func (s *stubGrantStore) PutGrantedScopes(_ context.Context, clientID, subject string, scopes []string) error {
+	s.grants[clientID+"/"+subject] = scopes
+	return nil
+}
+
+func TestRememberConsent(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+		subject     = "subject"
+	)
+	ctx := context.Background()
+
+	newOIDC := func(t *testing.T, remember bool) *OIDC {
+		t.Helper()
+		o, err := New(&Config{
+			GrantStore:      &stubGrantStore{grants: map[string][]string{}},
+			RememberConsent: remember,
+		}, newStubSMGR(), &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{RedirectURI: redirectURI},
+			},
+		}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	// authorize starts an authorization, returning if consent is required.
+	// The user approves, so the scopes are granted.
+	authorize := func(t *testing.T, o *OIDC, scope, prompt string) bool {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {scope},
+		}
+		if prompt != "" {
+			q.Set("prompt", prompt)
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		required, err := o.ConsentRequired(ctx, areq, subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := o.FinishAuthorization(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: areq.Scopes, Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+		return required
+	}
+
+	t.Run("Remembered", func(t *testing.T) {
+		o := newOIDC(t, true)
+		for _, step := range []struct {
+			Scope        string
+			Prompt       string
+			WantRequired bool
+		}{
+			{Scope: "openid profile", WantRequired: true},
+			{Scope: "openid profile", WantRequired: false},
+			{Scope: "openid", WantRequired: false},
+			{Scope: "openid profile", Prompt: "consent", WantRequired: true},
+			{Scope: "openid email", WantRequired: true},
+			{Scope: "openid email profile", WantRequired: false},
+		} {
+			if got := authorize(t, o, step.Scope, step.Prompt); got != step.WantRequired {
+				t.Errorf("scope %q prompt %q: want consent required %t, got: %t", step.Scope, step.Prompt, step.WantRequired, got)
+			}
+		}
+	})
+
+	t.Run("Not remembered", func(t *testing.T) {
+		o := newOIDC(t, false)
+		for i := 0; i < 2; i++ {
+			if !authorize(t, o, "openid profile", "") {
+				t.Errorf("attempt %d: want consent required", i)
+			}
+		}
+	})
+
+	t.Run("Requires GrantStore", func(t *testing.T) {
+		if _, err := New(&Config{RememberConsent: true}, newStubSMGR(), &stubCS{}, testSigner); err == nil {
+			t.Error("want error without a GrantStore")
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// IssuerResolver returns the issuer a request is for, for providers serving
+// more than one issuer, e.g one per tenant hostname.
+type IssuerResolver func(req *http.Request) (string, error)
+
+type issuerContextKey struct{}
+
+// withIssuer resolves the issuer the request is for, and returns the request
+// with it set in its context. If no IssuerResolver is configured, or the
+// issuer can't be resolved, the request is returned as is.
+func (o *OIDC) withIssuer(req *http.Request) (*http.Request, error) {
+	if o.issuerResolver == nil {
+		return req, nil
+	}
+	ctx, err := o.ContextWithIssuer(req)
+	if err != nil {
+		return req, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// ContextWithIssuer returns the request's context, with the issuer resolved
+// for it by the IssuerResolver. This context should be passed to the methods
+// that take one rather than a request, like IssueIDToken and
+// BackchannelLogout, so they use the issuer for the request. If no
+// IssuerResolver is configured, the configured Issuer is always used.
+func (o *OIDC) ContextWithIssuer(req *http.Request) (context.Context, error) {
+	if o.issuerResolver == nil {
+		return req.Context(), nil
+	}
+	iss, err := o.issuerResolver(req)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to resolve issuer", Cause: err}
+	}
+	if !strsContains(o.allowedIssuers, iss) {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "Unknown issuer", CauseMsg: fmt.Sprintf("issuer %s is not allowed", iss)}
+	}
+	return context.WithValue(req.Context(), issuerContextKey{}, iss), nil
+}
+
+// issuerFrom returns the issuer resolved for the request the context is for,
+// or the configured issuer.
+func (o *OIDC) issuerFrom(ctx context.Context) string {
+	if iss, ok := ctx.Value(issuerContextKey{}).(string); ok {
+		return iss
+	}
+	return o.issuer
+}
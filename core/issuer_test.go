@@ -0,0 +1,139 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+func TestIssuerResolver(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	ctx := context.Background()
+
+	resolver := func(req *http.Request) (string, error) {
+		return "https://" + req.Host, nil
+	}
+
+	if _, err := New(&Config{IssuerResolver: resolver}, newStubSMGR(), &stubCS{}, testSigner); err == nil {
+		t.Error("want error creating with a resolver but no allowed issuers")
+	}
+
+	o, err := New(&Config{
+		IssuerResolver: resolver,
+		AllowedIssuers: []string{"https://tenant-a.example.com", "https://tenant-b.example.com"},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(t *testing.T, host string) *httptest.ResponseRecorder {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"response_mode": {"query.jwt"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+		}
+		req := httptest.NewRequest("GET", "/?"+q.Encode(), nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		areq, err := o.StartAuthorization(rec, req)
+		if err != nil {
+			return rec
+		}
+
+		req = httptest.NewRequest("POST", "/", nil)
+		req.Host = host
+		rec = httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, req, areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	for _, host := range []string{"tenant-a.example.com", "tenant-b.example.com"} {
+		t.Run(host, func(t *testing.T) {
+			wantIss := "https://" + host
+
+			rec := authorize(t, host)
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := testSigner.VerifySignature(ctx, loc.Query().Get("response"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp struct {
+				Issuer string `json:"iss"`
+				Code   string `json:"code"`
+			}
+			if err := json.Unmarshal(payload, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Issuer != wantIss {
+				t.Errorf("want authorization response iss %s, got: %s", wantIss, resp.Issuer)
+			}
+
+			form := url.Values{
+				"grant_type":   {"authorization_code"},
+				"code":         {resp.Code},
+				"redirect_uri": {redirectURI},
+			}
+			req := httptest.NewRequest("POST", "/token", nil)
+			req.Host = host
+			req.Form = form
+			req.SetBasicAuth(clientID, clientSecret)
+			rec = httptest.NewRecorder()
+			err = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken(tr.Issuer, "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var tresp struct {
+				IDToken string `json:"id_token"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &tresp); err != nil {
+				t.Fatal(err)
+			}
+			idtb, err := testSigner.VerifySignature(ctx, tresp.IDToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var idt oidc.Claims
+			if err := json.Unmarshal(idtb, &idt); err != nil {
+				t.Fatal(err)
+			}
+			if idt.Issuer != wantIss {
+				t.Errorf("want id token iss %s, got: %s", wantIss, idt.Issuer)
+			}
+		})
+	}
+
+	t.Run("Unknown issuer", func(t *testing.T) {
+		rec := authorize(t, "other.example.com")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("want status %d, got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// jarmResponseValidity is how long a signed authorization response is valid
+// for. It only needs to last until the client receives it, so is kept short.
+//
+// https://openid.net/specs/oauth-v2-jarm.html#section-2.1
+const jarmResponseValidity = 10 * time.Minute
+
+// signAuthResponse returns the authorization response parameters encoded as a
+// JWT signed by us, for clients that requested a JWT response mode. This
+// protects the response from tampering, and lets the client confirm who it came
+// from.
+//
+// https://openid.net/specs/oauth-v2-jarm.html#section-2
+func (o *OIDC) signAuthResponse(ctx context.Context, clientID string, params map[string]interface{}) (string, error) {
+	cl := oidc.Claims{
+		Issuer:   o.issuerFrom(ctx),
+		Audience: oidc.Audience{clientID},
+		Expiry:   oidc.NewUnixTime(o.now().Add(jarmResponseValidity)),
+		Extra:    params,
+	}
+
+	clb, err := json.Marshal(cl)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal authorization response: %w", err)
+	}
+	signed, err := o.signer.Sign(ctx, clb)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign authorization response: %w", err)
+	}
+	return string(signed), nil
+}
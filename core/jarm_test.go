@@ -0,0 +1,278 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+func TestJARMResponse(t *testing.T) {
+	const (
+		clientID = "client-id"
+		issuer   = "https://issuer"
+	)
+
+	for _, tc := range []struct {
+		Name string
+		Mode responseMode
+		// Response extracts the response JWT from what was sent to the
+		// user.
+		Response func(t *testing.T, rec *httptest.ResponseRecorder) string
+	}{
+		{
+			Name: "jwt",
+			Mode: responseModeJWT,
+			Response: func(t *testing.T, rec *httptest.ResponseRecorder) string {
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return loc.Query().Get("response")
+			},
+		},
+		{
+			Name: "fragment.jwt",
+			Mode: responseModeFragmentJWT,
+			Response: func(t *testing.T, rec *httptest.ResponseRecorder) string {
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				frag, err := url.ParseQuery(loc.Fragment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return frag.Get("response")
+			},
+		},
+		{
+			Name: "form_post.jwt",
+			Mode: responseModeFormPostJWT,
+			Response: func(t *testing.T, rec *httptest.ResponseRecorder) string {
+				body := rec.Body.String()
+				if !strings.Contains(body, `action="https://redir"`) {
+					t.Errorf("form does not post to redirect URI: %s", body)
+				}
+				const pfx = `name="response" value="`
+				i := strings.Index(body, pfx)
+				if i < 0 {
+					t.Fatalf("response not found in form: %s", body)
+				}
+				v := body[i+len(pfx):]
+				return v[:strings.Index(v, `"`)]
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			smgr := newStubSMGR()
+
+			sess := &sessionV2{
+				ID:       mustGenerateID(),
+				ClientID: clientID,
+				Request: &sessAuthRequest{
+					RedirectURI:  "https://redir",
+					State:        "state",
+					Scopes:       []string{"openid"},
+					ResponseType: authRequestResponseTypeCode,
+					ResponseMode: tc.Mode,
+				},
+				Expiry: time.Now().Add(1 * time.Minute),
+			}
+			if err := putSession(ctx, smgr, sess); err != nil {
+				t.Fatal(err)
+			}
+
+			o := &OIDC{
+				smgr:   smgr,
+				signer: testSigner,
+				issuer: issuer,
+				now:    time.Now,
+
+				codeValidityTime: 1 * time.Minute,
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/", nil)
+			if err := o.FinishAuthorization(rec, req, sess.ID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			payload, err := testSigner.VerifySignature(ctx, tc.Response(t, rec))
+			if err != nil {
+				t.Fatalf("response is not signed by us: %v", err)
+			}
+			cl := oidc.Claims{}
+			if err := json.Unmarshal(payload, &cl); err != nil {
+				t.Fatal(err)
+			}
+
+			if cl.Issuer != issuer {
+				t.Errorf("want iss %s, got %s", issuer, cl.Issuer)
+			}
+			if !cl.Audience.Contains(clientID) {
+				t.Errorf("want aud %s, got %v", clientID, cl.Audience)
+			}
+			if cl.Expiry == 0 {
+				t.Error("want exp set")
+			}
+			if cl.Extra["state"] != "state" {
+				t.Errorf("want state in response, got %v", cl.Extra["state"])
+			}
+			code, _ := cl.Extra["code"].(string)
+			codetok, err := unmarshalToken(code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codetok.SessionId != sess.ID {
+				t.Errorf("code is for session %s, want %s", codetok.SessionId, sess.ID)
+			}
+		})
+	}
+}
+
+func TestJARMError(t *testing.T) {
+	const (
+		clientID = "client-id"
+		issuer   = "https://issuer"
+	)
+
+	for _, tc := range []struct {
+		Name string
+		Mode responseMode
+		// Fail writes the error for the session
+		Fail func(o *OIDC, rec *httptest.ResponseRecorder, sessionID string) error
+		// Params extracts the parameters sent to the client
+		Params    func(t *testing.T, rec *httptest.ResponseRecorder) url.Values
+		WantError authErrorCode
+	}{
+		{
+			Name: "Rejected jwt",
+			Mode: responseModeJWT,
+			Fail: func(o *OIDC, rec *httptest.ResponseRecorder, sessionID string) error {
+				return o.RejectAuthorization(rec, httptest.NewRequest("POST", "/", nil), sessionID, AuthorizationErrorAccessDenied, "denied")
+			},
+			Params: func(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return loc.Query()
+			},
+			WantError: authErrorCodeAccessDenied,
+		},
+		{
+			Name: "Rejected form_post.jwt",
+			Mode: responseModeFormPostJWT,
+			Fail: func(o *OIDC, rec *httptest.ResponseRecorder, sessionID string) error {
+				return o.RejectAuthorization(rec, httptest.NewRequest("POST", "/", nil), sessionID, AuthorizationErrorLoginRequired, "")
+			},
+			Params: func(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+				body := rec.Body.String()
+				if !strings.Contains(body, `action="https://redir"`) {
+					t.Errorf("form does not post to redirect URI: %s", body)
+				}
+				const pfx = `name="response" value="`
+				i := strings.Index(body, pfx)
+				if i < 0 {
+					t.Fatalf("response not found in form: %s", body)
+				}
+				v := body[i+len(pfx):]
+				return url.Values{"response": {v[:strings.Index(v, `"`)]}}
+			},
+			WantError: authErrorCodeLoginRequired,
+		},
+		{
+			Name: "Expired fragment.jwt",
+			Mode: responseModeFragmentJWT,
+			Fail: func(o *OIDC, rec *httptest.ResponseRecorder, sessionID string) error {
+				o.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+				err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), sessionID, &Authorization{Scopes: []string{"openid"}})
+				if _, ok := err.(*authError); !ok {
+					return err
+				}
+				return nil
+			},
+			Params: func(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if loc.RawQuery != "" {
+					t.Errorf("want nothing in the query, got %s", loc.RawQuery)
+				}
+				frag, err := url.ParseQuery(loc.Fragment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return frag
+			},
+			WantError: authErrorCodeLoginRequired,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			smgr := newStubSMGR()
+
+			sess := &sessionV2{
+				ID:       mustGenerateID(),
+				ClientID: clientID,
+				Request: &sessAuthRequest{
+					RedirectURI:  "https://redir",
+					State:        "state",
+					Scopes:       []string{"openid"},
+					ResponseType: authRequestResponseTypeCode,
+					ResponseMode: tc.Mode,
+				},
+				Expiry: time.Now().Add(1 * time.Minute),
+			}
+			if err := putSession(ctx, smgr, sess); err != nil {
+				t.Fatal(err)
+			}
+
+			o := &OIDC{
+				smgr:   smgr,
+				signer: testSigner,
+				issuer: issuer,
+				now:    time.Now,
+			}
+
+			rec := httptest.NewRecorder()
+			if err := tc.Fail(o, rec, sess.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			params := tc.Params(t, rec)
+			if params.Get("error") != "" {
+				t.Errorf("want error only in the signed response, got %s", params.Get("error"))
+			}
+			payload, err := testSigner.VerifySignature(ctx, params.Get("response"))
+			if err != nil {
+				t.Fatalf("response is not signed by us: %v", err)
+			}
+			cl := oidc.Claims{}
+			if err := json.Unmarshal(payload, &cl); err != nil {
+				t.Fatal(err)
+			}
+
+			if cl.Issuer != issuer {
+				t.Errorf("want iss %s, got %s", issuer, cl.Issuer)
+			}
+			if !cl.Audience.Contains(clientID) {
+				t.Errorf("want aud %s, got %v", clientID, cl.Audience)
+			}
+			if cl.Extra["error"] != string(tc.WantError) {
+				t.Errorf("want error %s, got %v", tc.WantError, cl.Extra["error"])
+			}
+			if cl.Extra["state"] != "state" {
+				t.Errorf("want state in response, got %v", cl.Extra["state"])
+			}
+		})
+	}
+}
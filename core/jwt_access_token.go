@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pardot/oidc"
+	corev1beta1 "github.com/pardot/oidc/proto/core/v1beta1"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// AccessTokenFormat is the form access tokens are issued in.
+type AccessTokenFormat string
+
+const (
+	// AccessTokenFormatOpaque tokens are random values, that resource servers
+	// validate with the introspection endpoint. This is the default.
+	AccessTokenFormatOpaque AccessTokenFormat = "opaque"
+	// AccessTokenFormatJWT tokens are signed JWTs, that resource servers can
+	// validate themselves with the provider's keys.
+	//
+	// https://www.rfc-editor.org/rfc/rfc9068
+	AccessTokenFormatJWT AccessTokenFormat = "jwt"
+)
+
+// jwtAccessTokenType is the typ header of JWT access tokens.
+//
+// https://www.rfc-editor.org/rfc/rfc9068#section-2.1
+const jwtAccessTokenType = "at+jwt"
+
+// TypedSigner can be implemented by a Signer to set the typ header of what it
+// signs. It is required to issue JWT access tokens, which must be
+// distinguishable from ID tokens.
+type TypedSigner interface {
+	// SignWithType signs the provided data, setting the typ header.
+	SignWithType(ctx context.Context, typ string, data []byte) (signed []byte, err error)
+}
+
+// jwtAccessToken describes the JWT access token to issue for an opaque one.
+type jwtAccessToken struct {
+	Subject  string
+	ClientID string
+	Audience []string
+	Scopes   []string
+	Token    *accessToken
+	AuthTime time.Time
+	ACR      string
+	AMR      []string
+}
+
+// formatAccessToken returns the access token to give to the client, in the
+// configured format. JWT access tokens carry the opaque token as their jti, so
+// they can be used anywhere the opaque one can.
+func (o *OIDC) formatAccessToken(ctx context.Context, opaque string, at *jwtAccessToken) (string, error) {
+	if o.accessTokenFormat != AccessTokenFormatJWT {
+		return opaque, nil
+	}
+
+	ts, ok := o.signer.(TypedSigner)
+	if !ok {
+		return "", fmt.Errorf("signer does not implement TypedSigner")
+	}
+
+	sub, err := o.clientSubject(at.ClientID, at.Subject)
+	if err != nil {
+		return "", err
+	}
+	aud := at.Audience
+	if len(aud) == 0 {
+		aud = []string{at.ClientID}
+	}
+	cl := oidc.Claims{
+		Issuer:   o.issuerFrom(ctx),
+		Subject:  sub,
+		Audience: oidc.Audience(aud),
+		Expiry:   oidc.NewUnixTime(at.Token.Expiry),
+		IssuedAt: oidc.NewUnixTime(at.Token.IssuedAt),
+		ACR:      at.ACR,
+		AMR:      at.AMR,
+		Extra: map[string]interface{}{
+			"jti":       opaque,
+			"client_id": at.ClientID,
+			"scope":     strings.Join(at.Scopes, " "),
+		},
+	}
+	if !at.AuthTime.IsZero() {
+		cl.AuthTime = oidc.NewUnixTime(at.AuthTime)
+	}
+	cnf := map[string]interface{}{}
+	if at.Token.CertThumbprint != "" {
+		cnf["x5t#S256"] = at.Token.CertThumbprint
+	}
+	if at.Token.DPoPJKT != "" {
+		cnf["jkt"] = at.Token.DPoPJKT
+	}
+	if len(cnf) > 0 {
+		cl.Extra["cnf"] = cnf
+	}
+
+	b, err := json.Marshal(cl)
+	if err != nil {
+		return "", fmt.Errorf("marshaling access token claims: %w", err)
+	}
+	signed, err := ts.SignWithType(ctx, jwtAccessTokenType, b)
+	if err != nil {
+		return "", fmt.Errorf("signing access token: %w", err)
+	}
+	return string(signed), nil
+}
+
+// unmarshalAccessToken parses an access token presented to us, in either
+// format. JWT access tokens must be signed by us, and are then treated as the
+// opaque token they carry. They are accepted regardless of the configured
+// format, so tokens issued before it changed remain valid.
+func (o *OIDC) unmarshalAccessToken(ctx context.Context, tok string) (*corev1beta1.UserToken, error) {
+	if strings.Count(tok, ".") != 2 {
+		return unmarshalToken(tok)
+	}
+
+	jws, err := jose.ParseSigned(tok)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWT access token: %w", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, fmt.Errorf("JWT access token must have one signature")
+	}
+	if typ, _ := jws.Signatures[0].Header.ExtraHeaders[jose.HeaderType].(string); typ != jwtAccessTokenType {
+		return nil, fmt.Errorf("JWT access token has typ %q", typ)
+	}
+	payload, err := o.signer.VerifySignature(ctx, tok)
+	if err != nil {
+		return nil, fmt.Errorf("verifying JWT access token: %w", err)
+	}
+	var cl struct {
+		JTI string `json:"jti"`
+	}
+	if err := json.Unmarshal(payload, &cl); err != nil {
+		return nil, fmt.Errorf("unmarshaling JWT access token: %w", err)
+	}
+	return unmarshalToken(cl.JTI)
+}
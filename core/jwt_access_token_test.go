@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/discovery"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestAccessTokenFormat(t *testing.T) {
+	const (
+		issuer      = "https://issuer"
+		clientID    = "client-id"
+		secret      = "client-secret"
+		redirectURI = "https://redirect"
+	)
+
+	ts := httptest.NewServer(discovery.NewKeysHandler(testSigner.(discovery.KeySource), 1*time.Second))
+	defer ts.Close()
+
+	fetchKeys := func(t *testing.T) *jose.JSONWebKeySet {
+		t.Helper()
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		jwks := &jose.JSONWebKeySet{}
+		if err := json.NewDecoder(resp.Body).Decode(jwks); err != nil {
+			t.Fatal(err)
+		}
+		return jwks
+	}
+
+	issue := func(t *testing.T, format AccessTokenFormat) (*OIDC, string) {
+		t.Helper()
+		smgr := newStubSMGR()
+		o, err := New(&Config{Issuer: issuer, AccessTokenFormat: format}, smgr, &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{Secret: secret, RedirectURI: redirectURI},
+			},
+		}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ucode, scode, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := putSession(context.Background(), smgr, &sessionV2{
+			ID:            ucode.SessionId,
+			ClientID:      clientID,
+			Stage:         sessionStageCode,
+			Request:       &sessAuthRequest{RedirectURI: redirectURI},
+			AuthCode:      scode,
+			Authorization: &sessAuthorization{Scopes: []string{"openid", "profile"}, ACR: "pwd"},
+			Expiry:        time.Now().Add(1 * time.Minute),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		tresp, err := o.token(context.Background(), &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         mustMarshal(ucode),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: secret,
+		}, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken(issuer, "subject", time.Now().Add(1*time.Minute)),
+			}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o, tresp.AccessToken
+	}
+
+	// userinfo checks the token can be used in the usual way.
+	userinfo := func(t *testing.T, o *OIDC, tok string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		_ = o.Userinfo(rec, req, func(w io.Writer, _ *UserinfoRequest) error {
+			_, err := w.Write([]byte(`{"sub":"subject"}`))
+			return err
+		})
+		return rec.Code
+	}
+
+	t.Run("JWT", func(t *testing.T) {
+		o, tok := issue(t, AccessTokenFormatJWT)
+
+		jws, err := jose.ParseSigned(tok)
+		if err != nil {
+			t.Fatalf("want access token to be a JWT: %v", err)
+		}
+		if typ := jws.Signatures[0].Header.ExtraHeaders[jose.HeaderType]; typ != "at+jwt" {
+			t.Errorf("want typ at+jwt, got: %v", typ)
+		}
+		keys := fetchKeys(t).Key(jws.Signatures[0].Header.KeyID)
+		if len(keys) != 1 {
+			t.Fatalf("want the signing key in the published keys, got: %v", keys)
+		}
+		payload, err := jws.Verify(keys[0])
+		if err != nil {
+			t.Fatalf("want access token to verify against the published keys: %v", err)
+		}
+
+		var cl map[string]interface{}
+		if err := json.Unmarshal(payload, &cl); err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range map[string]interface{}{
+			"iss":       issuer,
+			"sub":       "subject",
+			"aud":       clientID,
+			"client_id": clientID,
+			"scope":     "openid profile",
+			"acr":       "pwd",
+		} {
+			if cl[k] != want {
+				t.Errorf("want %s %v, got: %v", k, want, cl[k])
+			}
+		}
+		for _, k := range []string{"exp", "iat", "jti"} {
+			if _, ok := cl[k]; !ok {
+				t.Errorf("want %s claim, got: %v", k, cl)
+			}
+		}
+
+		if code := userinfo(t, o, tok); code != http.StatusOK {
+			t.Errorf("want JWT access token accepted by userinfo, got: %d", code)
+		}
+		iresp, err := o.introspect(context.Background(), &tokenHintRequest{
+			Token:        tok,
+			ClientID:     clientID,
+			ClientSecret: secret,
+		}, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+			return &IntrospectionResponse{}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if iresp["active"] != true {
+			t.Errorf("want JWT access token active, got: %v", iresp)
+		}
+	})
+
+	t.Run("Opaque", func(t *testing.T) {
+		o, tok := issue(t, "")
+
+		if _, err := jose.ParseSigned(tok); err == nil {
+			t.Error("want opaque access token to not parse as a JWT")
+		}
+		if code := userinfo(t, o, tok); code != http.StatusOK {
+			t.Errorf("want opaque access token accepted by userinfo, got: %d", code)
+		}
+	})
+
+	t.Run("Signer without typ support", func(t *testing.T) {
+		if _, err := New(&Config{AccessTokenFormat: AccessTokenFormatJWT}, newStubSMGR(), &stubCS{}, untypedSigner{testSigner}); err == nil {
+			t.Error("want error for a signer that can't set typ")
+		}
+	})
+}
+
+// untypedSigner hides any optional interfaces the Signer implements.
+type untypedSigner struct {
+	Signer
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// LoginAttemptTracker can be configured to lock out password grant logins
+// after repeated failures. Attempts are keyed by the username as
+// "user:<username>", and by the client's IP address as "ip:<address>". A
+// login is rejected without checking the credentials if any of its keys are
+// locked.
+type LoginAttemptTracker interface {
+	// RecordFailure is called when a login for the key failed.
+	RecordFailure(ctx context.Context, key string)
+	// RecordSuccess is called when a login for the key succeeded. It is only
+	// called for the username, so a valid login doesn't clear the failures
+	// from an address trying many users.
+	RecordSuccess(ctx context.Context, key string)
+	// IsLocked should return true if logins for the key should be rejected.
+	IsLocked(ctx context.Context, key string) bool
+}
+
+// loginLockedError is returned when a login is rejected by the
+// LoginAttemptTracker. It is written as a HTTP 429, like a rate limited
+// request.
+func loginLockedError() error {
+	return &rateLimitError{
+		TokenError: &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "too many failed login attempts, try again later"},
+	}
+}
+
+// loginAttemptKeys returns the keys a password login is tracked by.
+func loginAttemptKeys(username, clientIP string) []string {
+	keys := []string{"user:" + username}
+	if clientIP != "" {
+		keys = append(keys, "ip:"+clientIP)
+	}
+	return keys
+}
+
+// LoginLockout is a LoginAttemptTracker that locks a key once it has had
+// threshold failures within the sliding window. It is unlocked again once
+// enough of those failures are older than the window, or on a successful
+// login. State is held in memory, so it only tracks logins to this process.
+type LoginLockout struct {
+	threshold int
+	window    time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+
+	now func() time.Time
+}
+
+// loginLockoutSweepSize is how many keys we track before removing ones with
+// no failures inside the window.
+const loginLockoutSweepSize = 10000
+
+// NewLoginLockout creates a LoginLockout, locking a key after threshold failed
+// logins within window.
+func NewLoginLockout(threshold int, window time.Duration) *LoginLockout {
+	return &LoginLockout{
+		threshold: threshold,
+		window:    window,
+		failures:  map[string][]time.Time{},
+		now:       time.Now,
+	}
+}
+
+// SetNow sets the clock used to age failures out of the window.
+func (l *LoginLockout) SetNow(now func() time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = now
+}
+
+// RecordFailure records a failed login for the key.
+func (l *LoginLockout) RecordFailure(_ context.Context, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if len(l.failures) >= loginLockoutSweepSize {
+		for k, f := range l.failures {
+			if len(l.prune(f, now)) == 0 {
+				delete(l.failures, k)
+			}
+		}
+	}
+
+	l.failures[key] = append(l.prune(l.failures[key], now), now)
+}
+
+// RecordSuccess clears the failures for the key.
+func (l *LoginLockout) RecordSuccess(_ context.Context, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, key)
+}
+
+// IsLocked returns true if the key has had threshold failures within the
+// window.
+func (l *LoginLockout) IsLocked(_ context.Context, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.prune(l.failures[key], l.now())
+	if len(f) == 0 {
+		delete(l.failures, key)
+		return false
+	}
+	l.failures[key] = f
+	return len(f) >= l.threshold
+}
+
+// prune returns the failures that are still inside the window. They are
+// recorded in order, so everything after the first one inside is too.
+func (l *LoginLockout) prune(failures []time.Time, now time.Time) []time.Time {
+	for i, f := range failures {
+		if now.Sub(f) < l.window {
+			return failures[i:]
+		}
+	}
+	return nil
+}
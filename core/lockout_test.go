@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginLockout(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	l := NewLoginLockout(3, 1*time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if l.IsLocked(ctx, "key") {
+			t.Fatalf("want key unlocked after %d failures", i)
+		}
+		l.RecordFailure(ctx, "key")
+		now = now.Add(10 * time.Second)
+	}
+	if !l.IsLocked(ctx, "key") {
+		t.Fatal("want key locked after threshold failures")
+	}
+	if l.IsLocked(ctx, "other-key") {
+		t.Fatal("want other key tracked separately")
+	}
+
+	// the first failure was 30s ago, so ages out of the window 30s later.
+	now = now.Add(29 * time.Second)
+	if !l.IsLocked(ctx, "key") {
+		t.Fatal("want key locked while failures are in the window")
+	}
+	now = now.Add(1 * time.Second)
+	if l.IsLocked(ctx, "key") {
+		t.Fatal("want key unlocked once the oldest failure leaves the window")
+	}
+
+	l.RecordFailure(ctx, "key")
+	if !l.IsLocked(ctx, "key") {
+		t.Fatal("want key locked again after another failure")
+	}
+	l.RecordSuccess(ctx, "key")
+	if l.IsLocked(ctx, "key") {
+		t.Fatal("want key unlocked after a success")
+	}
+}
+
+func TestPasswordGrantLockout(t *testing.T) {
+	const (
+		clientID     = "first-party"
+		clientSecret = "client-secret"
+		threshold    = 3
+	)
+
+	var authenticatorCalls int
+	o, err := New(&Config{
+		PasswordAuthenticator: func(_ context.Context, req *PasswordRequest) (*Authorization, error) {
+			authenticatorCalls++
+			if req.Password != "correct horse" {
+				return nil, nil
+			}
+			return &Authorization{Scopes: req.Scopes}, nil
+		},
+		LoginAttemptTracker: NewLoginLockout(threshold, 1*time.Minute),
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, AllowPasswordGrant: true},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(username, password, remoteAddr string) *httptest.ResponseRecorder {
+		body := url.Values{
+			"grant_type": {"password"},
+			"username":   {username},
+			"password":   {password},
+			"scope":      {"openid"},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+			}, nil
+		})
+		return rec
+	}
+
+	for i := 0; i < threshold; i++ {
+		if rec := login("alice", "battery staple", "192.0.2.1:1234"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("want failed login %d rejected as invalid, got %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	calls := authenticatorCalls
+	rec := login("alice", "correct horse", "198.51.100.1:1234")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("want login after %d failures locked out, got %d: %s", threshold, rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != "invalid_grant" {
+		t.Errorf("want error invalid_grant, got %s", resp.Error)
+	}
+	if authenticatorCalls != calls {
+		t.Error("want credentials not checked while locked out")
+	}
+
+	if rec := login("bob", "correct horse", "192.0.2.1:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("want other users from the same address locked out, got %d", rec.Code)
+	}
+	if rec := login("bob", "correct horse", "198.51.100.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("want other users from other addresses allowed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
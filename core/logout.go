@@ -0,0 +1,504 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+const (
+	// backchannelLogoutEvent is the event type set on logout tokens
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// logoutTokenValidity is how long a logout token is valid for. These are
+	// delivered immediately, so this can be short.
+	logoutTokenValidity = 2 * time.Minute
+	// backchannelLogoutAttempts is the number of times delivery to a client
+	// is tried, if it responds with a server error.
+	backchannelLogoutAttempts = 3
+)
+
+// backchannelLogoutRetryWait is the time between delivery attempts. It is a
+// var so tests can shorten it.
+var backchannelLogoutRetryWait = 500 * time.Millisecond
+
+// PostLogoutRedirectValidator can be implemented by a ClientSource to allow
+// clients to have the user redirected back to them after logout. If the
+// ClientSource does not implement this, logout requests that specify a
+// post_logout_redirect_uri will be rejected.
+type PostLogoutRedirectValidator interface {
+	// ValidateClientPostLogoutRedirectURI should confirm if the given URI is
+	// registered as a post logout redirect for the client. It should compare
+	// as per https://tools.ietf.org/html/rfc3986#section-6
+	ValidateClientPostLogoutRedirectURI(clientID, redirectURI string) (ok bool, err error)
+}
+
+// LogoutConnector can be configured to propagate logouts to the upstream
+// identity provider that authenticated the user, e.g to end the user's session
+// with a SAML or OIDC IdP.
+type LogoutConnector interface {
+	// Logout ends the user's session with the upstream provider. If the
+	// provider requires the user's browser to be sent to it, the URL to
+	// redirect to should be returned. An empty URL means the logout is
+	// complete.
+	Logout(ctx context.Context, identity Identity) (redirectURL string, err error)
+}
+
+// EndSessionRequest contains the validated information from a request to the
+// end session endpoint.
+type EndSessionRequest struct {
+	// ClientID of the client that initiated the logout, if it could be
+	// determined.
+	ClientID string
+	// IDTokenHint contains the claims of the ID token passed as a hint, if
+	// one was. The signature will have been verified, but the token may be
+	// expired.
+	IDTokenHint *oidc.Claims
+	// PostLogoutRedirectURI the user will be redirected to after the handler
+	// returns. It has been validated for the client. If empty, the handler is
+	// responsible for writing the response. The handler can clear it to
+	// write its own response instead, e.g a front-channel logout page that
+	// continues on to PostLogoutRedirect once the clients are notified.
+	PostLogoutRedirectURI string
+	// State to pass back to the client on redirect
+	State string
+}
+
+// PostLogoutRedirect returns the URL the user should be sent to after logout,
+// with the state added. It is empty if there is no PostLogoutRedirectURI.
+func (e *EndSessionRequest) PostLogoutRedirect() string {
+	if e.PostLogoutRedirectURI == "" {
+		return ""
+	}
+	redir, err := url.Parse(e.PostLogoutRedirectURI)
+	if err != nil {
+		// it was validated against the client's registration, so this
+		// shouldn't happen.
+		return ""
+	}
+	return authResponse(redir, e.State).String()
+}
+
+// EndSession can handle a request to the end session endpoint, for RP-Initiated
+// Logout. The request is parsed and validated, and handler is invoked to end
+// the user's session with the provider. This is the implementations
+// responsibility, as the user's browser session is not tracked here.
+//
+// If the request contains a valid post logout redirect, the user will be
+// redirected to it once the handler returns. Otherwise, the handler should
+// write an appropriate response to w, e.g a page confirming the user has been
+// logged out. If the handler returns an error, an InternalServerError will be
+// returned to the user.
+//
+// If a LogoutConnector is configured, it is called after the handler has
+// returned, so the local session is always ended first, even if the upstream
+// logout fails. It is passed the client ID, and the subject and sid from the
+// id_token_hint if there was one. If it returns a redirect URL, the user is
+// sent there instead of to the post logout redirect. The handler should then
+// not write a response, and should keep PostLogoutRedirect if the user is to
+// be returned to the client once the upstream provider is done with them.
+//
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (o *OIDC) EndSession(w http.ResponseWriter, req *http.Request, handler func(w http.ResponseWriter, esreq *EndSessionRequest) error) error {
+	req = o.withErrorHandler(req)
+
+	o.setSecurityHeaders(w)
+
+	esreq, err := o.parseEndSessionRequest(req)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	if err := handler(w, esreq); err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "error in user handler"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	if o.logoutConnector != nil {
+		redir, err := o.logoutConnector.Logout(req.Context(), endSessionIdentity(esreq))
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "error in logout connector")
+		}
+		if redir != "" {
+			http.Redirect(w, req, redir, http.StatusFound)
+			return nil
+		}
+	}
+
+	if esreq.PostLogoutRedirectURI != "" {
+		redir, err := url.Parse(esreq.PostLogoutRedirectURI)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to parse post logout redirect URI")
+		}
+		http.Redirect(w, req, authResponse(redir, esreq.State).String(), http.StatusFound)
+	}
+
+	return nil
+}
+
+// endSessionIdentity returns what we know about who is logging out, for the
+// LogoutConnector.
+func endSessionIdentity(esreq *EndSessionRequest) Identity {
+	id := Identity{ClientID: esreq.ClientID}
+	if esreq.IDTokenHint != nil {
+		id.Subject = esreq.IDTokenHint.Subject
+		if sid, ok := esreq.IDTokenHint.Extra["sid"].(string); ok {
+			id.Authorization.SID = sid
+		}
+	}
+	return id
+}
+
+// verifyIDTokenHint checks an ID token passed back to us as a hint was signed
+// by us, returning its claims. Hints are usually expired, so this is not
+// checked.
+func (o *OIDC) verifyIDTokenHint(ctx context.Context, hint string) (*oidc.Claims, error) {
+	payload, err := o.signer.VerifySignature(ctx, hint)
+	if err != nil {
+		return nil, fmt.Errorf("verifying id_token_hint: %w", err)
+	}
+	cl := &oidc.Claims{}
+	if err := json.Unmarshal(payload, cl); err != nil {
+		return nil, fmt.Errorf("unmarshaling id_token_hint: %w", err)
+	}
+	return cl, nil
+}
+
+// parseEndSessionRequest parses and validates a logout request. Errors are never
+// redirected, as the redirect URI can only be trusted once validated.
+//
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+func (o *OIDC) parseEndSessionRequest(req *http.Request) (*EndSessionRequest, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "method must be POST or GET"}
+	}
+
+	esreq := &EndSessionRequest{
+		ClientID: req.FormValue("client_id"),
+		State:    req.FormValue("state"),
+	}
+
+	if hint := req.FormValue("id_token_hint"); hint != "" {
+		cl, err := o.verifyIDTokenHint(req.Context(), hint)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "Invalid id_token_hint", Cause: err}
+		}
+		esreq.IDTokenHint = cl
+
+		if esreq.ClientID == "" && len(cl.Audience) == 1 {
+			esreq.ClientID = cl.Audience[0]
+		}
+		if esreq.ClientID != "" && !cl.Audience.Contains(esreq.ClientID) {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "client_id does not match id_token_hint"}
+		}
+	}
+
+	if ruri := req.FormValue("post_logout_redirect_uri"); ruri != "" {
+		if esreq.ClientID == "" {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "id_token_hint or client_id is required with post_logout_redirect_uri"}
+		}
+
+		plv, ok := o.clients.(PostLogoutRedirectValidator)
+		if !ok {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "Invalid post_logout_redirect_uri", CauseMsg: "client source does not support post logout redirects"}
+		}
+		redirok, err := plv.ValidateClientPostLogoutRedirectURI(esreq.ClientID, ruri)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", Cause: err, CauseMsg: "error calling clientsource post logout redirect URI validation"}
+		}
+		if !redirok {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "Invalid post_logout_redirect_uri"}
+		}
+
+		esreq.PostLogoutRedirectURI = ruri
+	}
+
+	return esreq, nil
+}
+
+// BackchannelLogoutClientSource can be implemented by a ClientSource to
+// support notifying clients of logouts via the back-channel.
+type BackchannelLogoutClientSource interface {
+	// ClientBackchannelLogout returns the URI the client registered to receive
+	// logout tokens at, and if it requires the sid claim to be included. An
+	// empty URI indicates the client does not support back-channel logout.
+	ClientBackchannelLogout(clientID string) (uri string, sessionRequired bool, err error)
+}
+
+// BackchannelLogoutRequest details a logout that clients should be notified
+// of.
+type BackchannelLogoutRequest struct {
+	// Issuer to set on the logout tokens
+	Issuer string
+	// Subject of the user that was logged out. One of Subject or SID must be
+	// set.
+	Subject string
+	// SID of the session that was ended. This corresponds to the SID passed
+	// in the Authorization.
+	SID string
+	// ClientIDs that should be notified. These should be the clients that
+	// participated in the session. Clients that have not registered a
+	// back-channel logout URI are skipped.
+	ClientIDs []string
+}
+
+// BackchannelLogout notifies clients that a user's session has ended, by
+// POSTing a signed logout token to each client's registered back-channel
+// logout URI. This should be called by the implementation when it ends a
+// user's session, e.g from the EndSession handler.
+//
+// Clients are notified concurrently, and delivery is retried if the client
+// responds with a server error. The entire process is bounded by the
+// BackchannelLogoutTimeout. If any client could not be notified an error is
+// returned, however delivery to the other clients will still have been
+// attempted.
+//
+// https://openid.net/specs/openid-connect-backchannel-1_0.html
+func (o *OIDC) BackchannelLogout(ctx context.Context, blreq *BackchannelLogoutRequest) error {
+	if blreq.Subject == "" && blreq.SID == "" {
+		return fmt.Errorf("one of subject or sid must be set")
+	}
+
+	bcs, ok := o.clients.(BackchannelLogoutClientSource)
+	if !ok {
+		return fmt.Errorf("client source does not support back-channel logout")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.backchannelLogoutTimeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+
+	for _, clientID := range blreq.ClientIDs {
+		wg.Add(1)
+		go func(clientID string) {
+			defer wg.Done()
+			if err := o.backchannelLogoutClient(ctx, bcs, blreq, clientID); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("client %s: %v", clientID, err))
+				mu.Unlock()
+			}
+		}(clientID)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("back-channel logout failed: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (o *OIDC) backchannelLogoutClient(ctx context.Context, bcs BackchannelLogoutClientSource, blreq *BackchannelLogoutRequest, clientID string) error {
+	uri, sessionRequired, err := bcs.ClientBackchannelLogout(clientID)
+	if err != nil {
+		return fmt.Errorf("looking up back-channel logout URI: %w", err)
+	}
+	if uri == "" {
+		return nil
+	}
+	if sessionRequired && blreq.SID == "" {
+		return fmt.Errorf("client requires sid, but none was provided")
+	}
+
+	tok, err := o.logoutToken(ctx, blreq, clientID)
+	if err != nil {
+		return err
+	}
+
+	return postLogoutToken(ctx, uri, tok)
+}
+
+// logoutToken builds and signs the logout token for the given client.
+//
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+func (o *OIDC) logoutToken(ctx context.Context, blreq *BackchannelLogoutRequest, clientID string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("error reading random data: %w", err)
+	}
+
+	now := o.now()
+	cl := oidc.Claims{
+		Issuer:   blreq.Issuer,
+		Subject:  blreq.Subject,
+		Audience: oidc.Audience{clientID},
+		IssuedAt: oidc.NewUnixTime(now),
+		Expiry:   oidc.NewUnixTime(now.Add(logoutTokenValidity)),
+		Extra: map[string]interface{}{
+			"jti": base64.RawURLEncoding.EncodeToString(jti),
+			"events": map[string]interface{}{
+				backchannelLogoutEvent: map[string]interface{}{},
+			},
+		},
+	}
+	if blreq.SID != "" {
+		cl.Extra["sid"] = blreq.SID
+	}
+
+	clb, err := json.Marshal(cl)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal logout token: %w", err)
+	}
+	signed, err := o.signer.Sign(ctx, clb)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign logout token: %w", err)
+	}
+	return string(signed), nil
+}
+
+// postLogoutToken delivers the token to the client, retrying on server errors
+// until the attempts are exhausted or the context is done.
+//
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#BCRequest
+func postLogoutToken(ctx context.Context, uri, token string) error {
+	form := url.Values{"logout_token": []string{token}}.Encode()
+
+	var lastErr error
+	for attempt := 0; attempt < backchannelLogoutAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, lastErr)
+			case <-time.After(backchannelLogoutRetryWait):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form))
+		if err != nil {
+			return fmt.Errorf("creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("client responded with status %d", resp.StatusCode)
+		default:
+			return fmt.Errorf("client responded with status %d", resp.StatusCode)
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", backchannelLogoutAttempts, lastErr)
+}
+
+// FrontchannelLogoutClientSource can be implemented by a ClientSource to
+// support notifying clients of logouts via the front-channel.
+type FrontchannelLogoutClientSource interface {
+	// ClientFrontchannelLogout returns the URI the client registered to be
+	// loaded in an iframe on logout, and if it requires the iss and sid query
+	// parameters to be included. An empty URI indicates the client does not
+	// support front-channel logout.
+	ClientFrontchannelLogout(clientID string) (uri string, sessionRequired bool, err error)
+}
+
+// FrontchannelLogoutRequest details a logout that clients should be notified
+// of via the user's browser.
+type FrontchannelLogoutRequest struct {
+	// Issuer to pass to the clients as iss. If empty, the issuer for the
+	// context is used.
+	Issuer string
+	// SID of the session that was ended. This corresponds to the SID passed
+	// in the Authorization.
+	SID string
+	// ClientIDs that should be notified. These should be the clients that
+	// participated in the session. Clients that have not registered a
+	// front-channel logout URI are skipped.
+	ClientIDs []string
+}
+
+// FrontchannelLogoutURIs returns the URIs to notify clients that a user's
+// session has ended. The implementation should render these as hidden
+// iframes on the page shown after logout, e.g from the EndSession handler, so
+// the user's browser notifies each client. If the SID is set, it is passed to
+// the clients as the sid query parameter along with iss.
+//
+// Clients that require the sid when none was provided are skipped, and an
+// error returned along with the URIs for the other clients.
+//
+// https://openid.net/specs/openid-connect-frontchannel-1_0.html
+func (o *OIDC) FrontchannelLogoutURIs(ctx context.Context, flreq *FrontchannelLogoutRequest) ([]string, error) {
+	fcs, ok := o.clients.(FrontchannelLogoutClientSource)
+	if !ok {
+		return nil, fmt.Errorf("client source does not support front-channel logout")
+	}
+	iss := flreq.Issuer
+	if iss == "" {
+		iss = o.issuerFrom(ctx)
+	}
+
+	var (
+		uris []string
+		errs []string
+	)
+	for _, clientID := range flreq.ClientIDs {
+		uri, err := frontchannelLogoutURI(fcs, iss, flreq.SID, clientID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("client %s: %v", clientID, err))
+			continue
+		}
+		if uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	if len(errs) > 0 {
+		return uris, fmt.Errorf("front-channel logout failed: %s", strings.Join(errs, ", "))
+	}
+	return uris, nil
+}
+
+// frontchannelLogoutURI returns the URI to load for the client, with the
+// session parameters added.
+//
+// https://openid.net/specs/openid-connect-frontchannel-1_0.html#OPLogout
+func frontchannelLogoutURI(fcs FrontchannelLogoutClientSource, iss, sid, clientID string) (string, error) {
+	uri, sessionRequired, err := fcs.ClientFrontchannelLogout(clientID)
+	if err != nil {
+		return "", fmt.Errorf("looking up front-channel logout URI: %w", err)
+	}
+	if uri == "" {
+		return "", nil
+	}
+	if sessionRequired && sid == "" {
+		return "", fmt.Errorf("client requires sid, but none was provided")
+	}
+	if sid == "" {
+		return uri, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("parsing front-channel logout URI: %w", err)
+	}
+	q := u.Query()
+	q.Set("iss", iss)
+	q.Set("sid", sid)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
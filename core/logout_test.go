@@ -0,0 +1,419 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestEndSession(t *testing.T) {
+	const (
+		clientID       = "client-id"
+		otherClientID  = "other-client"
+		postLogoutURI  = "https://client/logged-out"
+		otherLogoutURI = "https://other/logged-out"
+	)
+
+	clientSource := &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{
+				PostLogoutRedirectURI: postLogoutURI,
+			},
+			otherClientID: csClient{
+				PostLogoutRedirectURI: otherLogoutURI,
+			},
+		},
+	}
+
+	signIDToken := func(aud string) string {
+		cl := oidc.Claims{
+			Issuer:   "http://issuer",
+			Subject:  "subject",
+			Audience: oidc.Audience{aud},
+			// hints may be expired, this should still be accepted
+			Expiry: oidc.NewUnixTime(time.Now().Add(-1 * time.Minute)),
+		}
+		b, err := json.Marshal(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := testSigner.Sign(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(sig)
+	}
+
+	for _, tc := range []struct {
+		Name         string
+		Query        map[string]string
+		WantErrMatch func(error) bool
+		// WantRedirect is the expected location. If empty, we expect the
+		// handler to have written the response.
+		WantRedirect string
+		WantClientID string
+	}{
+		{
+			Name:  "No parameters",
+			Query: map[string]string{},
+		},
+		{
+			Name: "Hint with valid redirect",
+			Query: map[string]string{
+				"id_token_hint":            signIDToken(clientID),
+				"post_logout_redirect_uri": postLogoutURI,
+				"state":                    "abc",
+			},
+			WantRedirect: postLogoutURI + "?state=abc",
+			WantClientID: clientID,
+		},
+		{
+			Name: "Client ID with valid redirect",
+			Query: map[string]string{
+				"client_id":                clientID,
+				"post_logout_redirect_uri": postLogoutURI,
+			},
+			WantRedirect: postLogoutURI,
+			WantClientID: clientID,
+		},
+		{
+			Name: "Redirect without client is rejected",
+			Query: map[string]string{
+				"post_logout_redirect_uri": postLogoutURI,
+			},
+			WantErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+		{
+			Name: "Redirect for another client is rejected",
+			Query: map[string]string{
+				"id_token_hint":            signIDToken(clientID),
+				"post_logout_redirect_uri": otherLogoutURI,
+			},
+			WantErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+		{
+			Name: "Client ID not matching hint is rejected",
+			Query: map[string]string{
+				"id_token_hint": signIDToken(clientID),
+				"client_id":     otherClientID,
+			},
+			WantErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+		{
+			Name: "Invalid hint is rejected",
+			Query: map[string]string{
+				"id_token_hint": "not.a.jwt",
+			},
+			WantErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				clients: clientSource,
+				signer:  testSigner,
+			}
+
+			var handlerCalled bool
+			var gotClientID string
+
+			w := httptest.NewRecorder()
+			err := o.EndSession(w, queryReq(tc.Query)(), func(w http.ResponseWriter, esreq *EndSessionRequest) error {
+				handlerCalled = true
+				gotClientID = esreq.ClientID
+				if esreq.PostLogoutRedirectURI == "" {
+					_, _ = w.Write([]byte("logged out"))
+				}
+				return nil
+			})
+			checkErrMatcher(t, tc.WantErrMatch, err)
+			if err != nil {
+				if handlerCalled {
+					t.Error("handler should not be called on error")
+				}
+				return
+			}
+
+			if !handlerCalled {
+				t.Fatal("handler was not called")
+			}
+			if gotClientID != tc.WantClientID {
+				t.Errorf("want client ID %q, got: %q", tc.WantClientID, gotClientID)
+			}
+
+			if tc.WantRedirect == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("want status %d, got: %d", http.StatusOK, w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusFound {
+				t.Fatalf("want status %d, got: %d", http.StatusFound, w.Code)
+			}
+			if loc := w.Header().Get("location"); loc != tc.WantRedirect {
+				t.Errorf("want redirect to %s, got: %s", tc.WantRedirect, loc)
+			}
+		})
+	}
+}
+
+func TestEndSessionLogoutConnector(t *testing.T) {
+	const (
+		clientID      = "client-id"
+		postLogoutURI = "https://client/logged-out"
+		upstreamURI   = "https://upstream/logout"
+	)
+
+	cl := oidc.Claims{
+		Issuer:   "http://issuer",
+		Subject:  "subject",
+		Audience: oidc.Audience{clientID},
+		Expiry:   oidc.NewUnixTime(time.Now().Add(1 * time.Minute)),
+		Extra:    map[string]interface{}{"sid": "session-id"},
+	}
+	b, err := json.Marshal(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint, err := testSigner.Sign(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name         string
+		Redirect     string
+		WantRedirect string
+	}{
+		{
+			Name:         "Connector redirects upstream",
+			Redirect:     upstreamURI,
+			WantRedirect: upstreamURI,
+		},
+		{
+			Name:         "Connector completes logout",
+			WantRedirect: postLogoutURI + "?state=abc",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var calls []string
+			conn := &stubLogoutConnector{redirect: tc.Redirect, calls: &calls}
+			o := &OIDC{
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{PostLogoutRedirectURI: postLogoutURI},
+					},
+				},
+				signer:          testSigner,
+				logoutConnector: conn,
+			}
+
+			w := httptest.NewRecorder()
+			err := o.EndSession(w, queryReq(map[string]string{
+				"id_token_hint":            string(hint),
+				"post_logout_redirect_uri": postLogoutURI,
+				"state":                    "abc",
+			})(), func(w http.ResponseWriter, esreq *EndSessionRequest) error {
+				calls = append(calls, "handler")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff([]string{"handler", "connector"}, calls); diff != "" {
+				t.Errorf("want local session ended before upstream: %s", diff)
+			}
+			want := Identity{ClientID: clientID, Subject: "subject", Authorization: Authorization{SID: "session-id"}}
+			if diff := cmp.Diff(want, conn.identity); diff != "" {
+				t.Errorf("unexpected identity: %s", diff)
+			}
+			if w.Code != http.StatusFound {
+				t.Fatalf("want status %d, got: %d", http.StatusFound, w.Code)
+			}
+			if loc := w.Header().Get("location"); loc != tc.WantRedirect {
+				t.Errorf("want redirect to %s, got: %s", tc.WantRedirect, loc)
+			}
+		})
+	}
+}
+
+type stubLogoutConnector struct {
+	redirect string
+	calls    *[]string
+	identity Identity
+}
+
+func (s *stubLogoutConnector) Logout(_ context.Context, identity Identity) (string, error) {
+	*s.calls = append(*s.calls, "connector")
+	s.identity = identity
+	return s.redirect, nil
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	backchannelLogoutRetryWait = 1 * time.Millisecond
+
+	// newRP returns a server that fails with a 500 for the first failures
+	// requests, then records the verified logout token claims.
+	newRP := func(t *testing.T, failures int, got *map[string]interface{}) *httptest.Server {
+		var calls int
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			if calls <= failures {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			payload, err := testSigner.VerifySignature(req.Context(), req.FormValue("logout_token"))
+			if err != nil {
+				t.Errorf("failed to verify logout token: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := json.Unmarshal(payload, got); err != nil {
+				t.Errorf("failed to unmarshal logout token: %v", err)
+			}
+		}))
+	}
+
+	for _, tc := range []struct {
+		Name string
+		// Failures is the number of 500 responses the RP returns before
+		// succeeding
+		Failures        int
+		SID             string
+		SessionRequired bool
+		WantErr         bool
+	}{
+		{
+			Name: "Delivered with sid",
+			SID:  "session-id",
+		},
+		{
+			Name:     "Retried after server error",
+			SID:      "session-id",
+			Failures: 1,
+		},
+		{
+			Name:     "Gives up after repeated server errors",
+			Failures: backchannelLogoutAttempts,
+			WantErr:  true,
+		},
+		{
+			Name:            "Client requiring sid without one fails",
+			SessionRequired: true,
+			WantErr:         true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			got := map[string]interface{}{}
+			rp := newRP(t, tc.Failures, &got)
+			defer rp.Close()
+
+			o := &OIDC{
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						"client-id": csClient{
+							BackchannelLogoutURI:             rp.URL,
+							BackchannelLogoutSessionRequired: tc.SessionRequired,
+						},
+						"no-backchannel": csClient{},
+					},
+				},
+				signer:                   testSigner,
+				backchannelLogoutTimeout: 5 * time.Second,
+				now:                      time.Now,
+			}
+
+			err := o.BackchannelLogout(context.Background(), &BackchannelLogoutRequest{
+				Issuer:    "http://issuer",
+				Subject:   "subject",
+				SID:       tc.SID,
+				ClientIDs: []string{"client-id", "no-backchannel"},
+			})
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got["aud"] != "client-id" {
+				t.Errorf("want aud client-id, got: %v", got["aud"])
+			}
+			if got["sid"] != tc.SID {
+				t.Errorf("want sid %q, got: %v", tc.SID, got["sid"])
+			}
+			if got["jti"] == nil || got["jti"] == "" {
+				t.Error("want jti to be set")
+			}
+			if _, ok := got["nonce"]; ok {
+				t.Error("logout token must not contain a nonce")
+			}
+			events, _ := got["events"].(map[string]interface{})
+			if _, ok := events[backchannelLogoutEvent]; !ok {
+				t.Errorf("want %s event, got: %v", backchannelLogoutEvent, got["events"])
+			}
+		})
+	}
+}
+
+func TestFrontchannelLogoutURIs(t *testing.T) {
+	o := &OIDC{
+		clients: &stubCS{
+			validClients: map[string]csClient{
+				"client-a": csClient{
+					FrontchannelLogoutURI: "https://a/logout",
+				},
+				"client-b": csClient{
+					FrontchannelLogoutURI:             "https://b/logout?tenant=1",
+					FrontchannelLogoutSessionRequired: true,
+				},
+				"no-frontchannel": csClient{},
+			},
+		},
+		issuer: "https://issuer",
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		Name     string
+		SID      string
+		WantURIs []string
+		WantErr  bool
+	}{
+		{
+			Name: "With sid",
+			SID:  "session-id",
+			WantURIs: []string{
+				"https://a/logout?iss=https%3A%2F%2Fissuer&sid=session-id",
+				"https://b/logout?iss=https%3A%2F%2Fissuer&sid=session-id&tenant=1",
+			},
+		},
+		{
+			Name:     "Client requiring sid without one is skipped",
+			WantURIs: []string{"https://a/logout"},
+			WantErr:  true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			uris, err := o.FrontchannelLogoutURIs(ctx, &FrontchannelLogoutRequest{
+				SID:       tc.SID,
+				ClientIDs: []string{"client-a", "client-b", "no-frontchannel"},
+			})
+			if (err != nil) != tc.WantErr {
+				t.Errorf("want error %t, got: %v", tc.WantErr, err)
+			}
+			if diff := cmp.Diff(tc.WantURIs, uris); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// Metrics can be configured to observe the requests handled. It can be used
+// to export counters and histograms to a metrics system, e.g Prometheus. The
+// methods are called inline with the request, so should not block.
+type Metrics interface {
+	// AuthorizationRequested is called when an authorization request is
+	// successfully started.
+	AuthorizationRequested(responseType string)
+	// TokenIssued is called when the token endpoint issues tokens.
+	TokenIssued(grantType GrantType)
+	// TokenRequestDuration is called with how long each request to the token
+	// endpoint took, successful or not. The grant type is empty if the
+	// request could not be parsed.
+	TokenRequestDuration(grantType GrantType, d time.Duration)
+	// Error is called when an endpoint returns an error. The code is the
+	// OAuth2 error code if there is one, e.g invalid_grant, otherwise
+	// server_error.
+	Error(endpoint Endpoint, code string)
+}
+
+// GCMetrics can also be implemented by the Metrics, to observe RunGC.
+type GCMetrics interface {
+	// GarbageCollected is called after each collection, with the number of
+	// sessions deleted and the error if it failed.
+	GarbageCollected(deleted int, err error)
+}
+
+// TokenRequestMetrics can also be implemented by the Metrics, to count token
+// requests by grant type and outcome, e.g to alert on a spike of invalid_grant
+// errors refreshing. It is separate from Error, so the grant type doesn't add
+// to the cardinality of every endpoint's errors.
+type TokenRequestMetrics interface {
+	// TokenRequest is called for each request to the token endpoint. The
+	// grant type is empty if the request could not be parsed. The error code
+	// is empty if tokens were issued, otherwise it is as for Error.
+	TokenRequest(grantType GrantType, errorCode string)
+}
+
+// Endpoint identifies the endpoint an error was returned from, for Metrics.
+type Endpoint string
+
+const (
+	EndpointAuthorization       Endpoint = "authorization"
+	EndpointToken               Endpoint = "token"
+	EndpointDeviceAuthorization Endpoint = "device_authorization"
+)
+
+func (o *OIDC) observeAuthorization(responseType string, err error) {
+	if o.metrics == nil {
+		return
+	}
+	if err != nil {
+		o.metrics.Error(EndpointAuthorization, metricsErrorCode(err))
+		return
+	}
+	o.metrics.AuthorizationRequested(responseType)
+}
+
+func (o *OIDC) observeToken(grantType GrantType, start time.Time, err error) {
+	if o.metrics == nil {
+		return
+	}
+	o.metrics.TokenRequestDuration(grantType, o.now().Sub(start))
+	var code string
+	if err != nil {
+		code = metricsErrorCode(err)
+	}
+	if m, ok := o.metrics.(TokenRequestMetrics); ok {
+		m.TokenRequest(grantType, code)
+	}
+	if err != nil {
+		o.metrics.Error(EndpointToken, code)
+		return
+	}
+	o.metrics.TokenIssued(grantType)
+}
+
+func (o *OIDC) observeError(endpoint Endpoint, err error) {
+	if o.metrics == nil || err == nil {
+		return
+	}
+	o.metrics.Error(endpoint, metricsErrorCode(err))
+}
+
+// metricsErrorCode returns the OAuth2 error code for the error, if it has one.
+// This keeps the number of codes bounded, for use as a metric label.
+func metricsErrorCode(err error) string {
+	var (
+		terr  *oauth2.TokenError
+		aerr  *authError
+		rlerr *rateLimitError
+		herr  *httpError
+	)
+	switch {
+	case errors.As(err, &rlerr):
+		return string(rlerr.TokenError.ErrorCode)
+	case errors.As(err, &terr):
+		return string(terr.ErrorCode)
+	case errors.As(err, &aerr):
+		return string(aerr.Code)
+	case errors.As(err, &herr) && herr.Code >= 400 && herr.Code < 500:
+		return string(authErrorCodeInvalidRequest)
+	default:
+		return string(authErrorCodeErrServerError)
+	}
+}
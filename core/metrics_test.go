@@ -0,0 +1,237 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type recordingMetrics struct {
+	authorizations []string
+	issued         []GrantType
+	durations      []GrantType
+	errors         []string
+	tokenRequests  []string
+}
+
+func (r *recordingMetrics) AuthorizationRequested(responseType string) {
+	r.authorizations = append(r.authorizations, responseType)
+}
+
+func (r *recordingMetrics) TokenIssued(grantType GrantType) {
+	r.issued = append(r.issued, grantType)
+}
+
+func (r *recordingMetrics) TokenRequestDuration(grantType GrantType, _ time.Duration) {
+	r.durations = append(r.durations, grantType)
+}
+
+func (r *recordingMetrics) Error(endpoint Endpoint, code string) {
+	r.errors = append(r.errors, string(endpoint)+":"+code)
+}
+
+func (r *recordingMetrics) TokenRequest(grantType GrantType, code string) {
+	r.tokenRequests = append(r.tokenRequests, string(grantType)+":"+code)
+}
+
+func TestMetrics(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	ctx := context.Background()
+
+	m := &recordingMetrics{}
+	smgr := newStubSMGR()
+	o, err := New(&Config{Metrics: m}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenReq := func(body url.Values) {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		_ = o.Token(httptest.NewRecorder(), req, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+			}, nil
+		})
+	}
+
+	// a successful authorization request
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+	}
+	if _, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// and a bad one
+	q.Set("response_type", "token")
+	if _, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil)); err == nil {
+		t.Fatal("want error for unsupported response type")
+	}
+
+	// issue a token
+	utok, stok, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putSession(ctx, smgr, &sessionV2{
+		ID:            utok.SessionId,
+		AuthCode:      stok,
+		Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+		ClientID:      clientID,
+		Expiry:        time.Now().Add(1 * time.Minute),
+		Request:       &sessAuthRequest{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tokenReq(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {mustMarshal(utok)},
+		"redirect_uri": {redirectURI},
+	})
+
+	// and fail to, with a code that has been used
+	tokenReq(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {mustMarshal(utok)},
+		"redirect_uri": {redirectURI},
+	})
+
+	// and with a malformed request
+	tokenReq(url.Values{
+		"grant_type": {"magic"},
+	})
+
+	if diff := cmp.Diff([]string{"code"}, m.authorizations); diff != "" {
+		t.Errorf("unexpected authorizations: %s", diff)
+	}
+	if diff := cmp.Diff([]GrantType{GrantTypeAuthorizationCode}, m.issued); diff != "" {
+		t.Errorf("unexpected tokens issued: %s", diff)
+	}
+	if diff := cmp.Diff([]GrantType{GrantTypeAuthorizationCode, GrantTypeAuthorizationCode, ""}, m.durations); diff != "" {
+		t.Errorf("unexpected token request durations: %s", diff)
+	}
+	wantErrs := []string{
+		"authorization:unsupported_response_type",
+		"token:invalid_grant",
+		"token:invalid_grant",
+	}
+	if diff := cmp.Diff(wantErrs, m.errors); diff != "" {
+		t.Errorf("unexpected errors: %s", diff)
+	}
+	wantTokenReqs := []string{
+		"authorization_code:",
+		"authorization_code:invalid_grant",
+		":invalid_grant",
+	}
+	if diff := cmp.Diff(wantTokenReqs, m.tokenRequests); diff != "" {
+		t.Errorf("unexpected token requests: %s", diff)
+	}
+}
+
+func TestTokenRequestMetrics(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	ctx := context.Background()
+
+	m := &recordingMetrics{}
+	smgr := newStubSMGR()
+	o, err := New(&Config{Metrics: m}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokenReq calls the endpoint, returning the refresh token issued.
+	tokenReq := func(body url.Values) string {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		rec := httptest.NewRecorder()
+		_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+				RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+				IssueRefreshToken:      true,
+				IDToken:                tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+			}, nil
+		})
+		var tresp struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &tresp)
+		return tresp.RefreshToken
+	}
+
+	utok, stok, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putSession(ctx, smgr, &sessionV2{
+		ID:            utok.SessionId,
+		Stage:         sessionStageCode,
+		AuthCode:      stok,
+		Authorization: &sessAuthorization{Scopes: []string{"openid", "offline_access"}},
+		ClientID:      clientID,
+		Expiry:        time.Now().Add(1 * time.Minute),
+		Request:       &sessAuthRequest{RedirectURI: redirectURI},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rt := tokenReq(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {mustMarshal(utok)},
+		"redirect_uri": {redirectURI},
+	})
+	if rt == "" {
+		t.Fatal("want refresh token issued")
+	}
+
+	if tokenReq(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {rt},
+	}) == "" {
+		t.Fatal("want refresh token rotated")
+	}
+	// reusing the old token fails
+	tokenReq(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {rt},
+	})
+
+	want := []string{
+		"authorization_code:",
+		"refresh_token:",
+		"refresh_token:invalid_grant",
+	}
+	if diff := cmp.Diff(want, m.tokenRequests); diff != "" {
+		t.Errorf("unexpected token requests: %s", diff)
+	}
+}
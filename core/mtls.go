@@ -0,0 +1,79 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+)
+
+// TLSClientAuthClientSource can be implemented by a ClientSource to allow
+// clients to authenticate with a TLS client certificate, when TLSClientAuth is
+// enabled in the Config.
+//
+// https://tools.ietf.org/html/rfc8705#section-2.1
+type TLSClientAuthClientSource interface {
+	// ClientTLSSubjectDN should return the subject distinguished name the
+	// client's certificate is expected to have, in RFC 4514 string form (e.g
+	// "CN=client,O=Example"). An empty value indicates the client can not
+	// authenticate with a certificate.
+	ClientTLSSubjectDN(clientID string) (subjectDN string, err error)
+}
+
+// clientCertificate returns the certificate the client presented for this
+// request, if any. It is taken from the TLS connection if it was terminated
+// by us, otherwise from the configured header if a proxy terminated TLS.
+func (o *OIDC) clientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0]
+	}
+
+	if o.tlsClientCertHeader == "" {
+		return nil
+	}
+	hv := req.Header.Get(o.tlsClientCertHeader)
+	if hv == "" {
+		return nil
+	}
+	// proxies generally URL encode the PEM, so it fits in a header
+	pemb, err := url.QueryUnescape(hv)
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(pemb))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// validateClientCertificate checks that the presented certificate's subject
+// matches the one registered for the client.
+func (o *OIDC) validateClientCertificate(clientID string, cert *x509.Certificate) (ok bool, err error) {
+	if !o.tlsClientAuth || cert == nil {
+		return false, nil
+	}
+	tcs, ok := o.clients.(TLSClientAuthClientSource)
+	if !ok {
+		return false, nil
+	}
+	dn, err := tcs.ClientTLSSubjectDN(clientID)
+	if err != nil {
+		return false, err
+	}
+	return dn != "" && dn == cert.Subject.String(), nil
+}
+
+// certThumbprint returns the value used to bind a token to the certificate.
+//
+// https://tools.ietf.org/html/rfc8705#section-3.1
+func certThumbprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
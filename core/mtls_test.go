@@ -0,0 +1,230 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClientCertificate(t *testing.T) {
+	cert := mustGenClientCert("client")
+	certHeader := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+
+	for _, tc := range []struct {
+		Name   string
+		Header string
+		Req    func() *http.Request
+		Want   *x509.Certificate
+	}{
+		{
+			Name: "From TLS connection",
+			Req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/token", nil)
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+				return req
+			},
+			Want: cert,
+		},
+		{
+			Name:   "From proxy header",
+			Header: "X-SSL-Client-Cert",
+			Req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/token", nil)
+				req.Header.Set("X-SSL-Client-Cert", certHeader)
+				return req
+			},
+			Want: cert,
+		},
+		{
+			Name: "Header ignored if not configured",
+			Req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/token", nil)
+				req.Header.Set("X-SSL-Client-Cert", certHeader)
+				return req
+			},
+		},
+		{
+			Name:   "Invalid header",
+			Header: "X-SSL-Client-Cert",
+			Req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/token", nil)
+				req.Header.Set("X-SSL-Client-Cert", "not a cert")
+				return req
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{tlsClientCertHeader: tc.Header}
+
+			got := o.clientCertificate(tc.Req())
+			if tc.Want == nil && got != nil {
+				t.Fatalf("want no certificate, got: %v", got.Subject)
+			}
+			if tc.Want != nil && (got == nil || !got.Equal(tc.Want)) {
+				t.Fatalf("want certificate %v, got: %v", tc.Want.Subject, got)
+			}
+		})
+	}
+}
+
+type stubTLSCS struct {
+	*stubCS
+	subjectDNs map[string]string
+}
+
+func (s *stubTLSCS) ClientTLSSubjectDN(clientID string) (string, error) {
+	return s.subjectDNs[clientID], nil
+}
+
+func TestCertificateBoundTokens(t *testing.T) {
+	const clientID = "mtls-client"
+
+	cert := mustGenClientCert("mtls-client")
+	otherCert := mustGenClientCert("other")
+
+	smgr := newStubSMGR()
+	o := &OIDC{
+		smgr:   smgr,
+		signer: testSigner,
+		clients: &stubTLSCS{
+			stubCS: &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{},
+				},
+			},
+			subjectDNs: map[string]string{
+				clientID: "CN=mtls-client",
+			},
+		},
+		tlsClientAuth:                true,
+		certificateBoundAccessTokens: true,
+		now:                          time.Now,
+	}
+
+	// authenticate with the wrong certificate
+	ok, err := o.authenticateClient(context.Background(), clientID, "", "", otherCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("client should not authenticate with another certificate")
+	}
+
+	// set up a session ready to have a code redeemed, and redeem it with the
+	// client certificate
+	ucode, scode, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putSession(context.Background(), smgr, &sessionV2{
+		ID:            ucode.SessionId,
+		ClientID:      clientID,
+		Stage:         sessionStageCode,
+		Request:       &sessAuthRequest{RedirectURI: "https://redirect"},
+		AuthCode:      scode,
+		Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+		Expiry:        time.Now().Add(1 * time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tresp, err := o.token(context.Background(), &tokenRequest{
+		GrantType:   GrantTypeAuthorizationCode,
+		Code:        mustMarshal(ucode),
+		RedirectURI: "https://redirect",
+		ClientID:    clientID,
+		ClientCert:  cert,
+	}, func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+			IDToken:               tr.PrefillIDToken("http://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iresp, err := o.introspect(context.Background(), &tokenHintRequest{
+		Token:      tresp.AccessToken,
+		ClientID:   clientID,
+		ClientCert: cert,
+	}, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+		return &IntrospectionResponse{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf, _ := iresp["cnf"].(map[string]interface{})
+	if cnf["x5t#S256"] != certThumbprint(cert) {
+		t.Errorf("want cnf with thumbprint %s, got: %v", certThumbprint(cert), iresp["cnf"])
+	}
+
+	for _, tc := range []struct {
+		Name       string
+		Cert       *x509.Certificate
+		WantStatus int
+	}{
+		{
+			Name:       "Userinfo with bound certificate",
+			Cert:       cert,
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Userinfo with other certificate",
+			Cert:       otherCert,
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "Userinfo without certificate",
+			WantStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			req.Header.Set("authorization", "Bearer "+tresp.AccessToken)
+			if tc.Cert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.Cert}}
+			}
+			w := httptest.NewRecorder()
+
+			_ = o.Userinfo(w, req, func(w io.Writer, _ *UserinfoRequest) error {
+				_, err := w.Write([]byte("{}"))
+				return err
+			})
+
+			if w.Code != tc.WantStatus {
+				t.Errorf("want status %d, got: %d", tc.WantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func mustGenClientCert(cn string) *x509.Certificate {
+	key := mustGenRSAKey(512)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-1 * time.Minute),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
@@ -2,8 +2,10 @@ package core
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,8 +15,115 @@ type responseType string
 const (
 	responseTypeCode     responseType = "code"
 	responseTypeImplicit responseType = "token"
+	// Hybrid flow response types. These are normalized to this order when
+	// parsed, as the values are a set.
+	//
+	// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#Combinations
+	responseTypeCodeIDToken      responseType = "code id_token"
+	responseTypeCodeToken        responseType = "code token"
+	responseTypeCodeIDTokenToken responseType = "code id_token token"
+	// responseTypeNone issues nothing, the client is only told the request
+	// was authorized. It can not be combined with other values.
+	//
+	// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#none
+	responseTypeNone responseType = "none"
 )
 
+// parseResponseType converts a response_type parameter to the response type it
+// represents, regardless of the order the values were passed in. Unknown
+// response types return an empty value.
+func parseResponseType(s string) responseType {
+	if strings.TrimSpace(s) == string(responseTypeNone) {
+		return responseTypeNone
+	}
+
+	var code, idToken, token bool
+	for _, v := range strings.Fields(s) {
+		switch {
+		case v == "code" && !code:
+			code = true
+		case v == "id_token" && !idToken:
+			idToken = true
+		case v == "token" && !token:
+			token = true
+		default:
+			return ""
+		}
+	}
+
+	switch {
+	case code && !idToken && !token:
+		return responseTypeCode
+	case !code && !idToken && token:
+		return responseTypeImplicit
+	case code && idToken && !token:
+		return responseTypeCodeIDToken
+	case code && !idToken && token:
+		return responseTypeCodeToken
+	case code && idToken && token:
+		return responseTypeCodeIDTokenToken
+	}
+	return ""
+}
+
+// returnsTokens returns true if the response type returns an access or ID
+// token directly from the authorization endpoint.
+func (r responseType) returnsTokens() bool {
+	switch r {
+	case responseTypeImplicit, responseTypeCodeIDToken, responseTypeCodeToken, responseTypeCodeIDTokenToken:
+		return true
+	}
+	return false
+}
+
+// responseMode is how the authorization response is returned to the client.
+//
+// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+// https://openid.net/specs/oauth-v2-jarm.html#section-2.3
+type responseMode string
+
+const (
+	responseModeQuery       responseMode = "query"
+	responseModeFragment    responseMode = "fragment"
+	responseModeFormPost    responseMode = "form_post"
+	responseModeJWT         responseMode = "jwt"
+	responseModeQueryJWT    responseMode = "query.jwt"
+	responseModeFragmentJWT responseMode = "fragment.jwt"
+	responseModeFormPostJWT responseMode = "form_post.jwt"
+)
+
+// isJWT returns true if the response should be returned as a signed JWT.
+func (r responseMode) isJWT() bool {
+	switch r {
+	case responseModeJWT, responseModeQueryJWT, responseModeFragmentJWT, responseModeFormPostJWT:
+		return true
+	}
+	return false
+}
+
+// responseModeFor returns the mode a response is sent with, given the mode the
+// client requested. Without one, responses that return tokens default to the
+// fragment, so the tokens aren't sent to the client's server, and other
+// responses to the query.
+//
+// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+// https://openid.net/specs/oauth-v2-jarm.html#section-2.3.4
+func responseModeFor(requested responseMode, returnsTokens bool) responseMode {
+	switch requested {
+	case "":
+		if returnsTokens {
+			return responseModeFragment
+		}
+		return responseModeQuery
+	case responseModeJWT:
+		if returnsTokens {
+			return responseModeFragmentJWT
+		}
+		return responseModeQueryJWT
+	}
+	return requested
+}
+
 type authRequest struct {
 	ClientID string
 	// RedirectURI the client specified. This is an OPTIONAL field, if not
@@ -23,6 +132,30 @@ type authRequest struct {
 	State        string
 	Scopes       []string
 	ResponseType responseType
+	// ResponseMode the client requested the response be returned with. If
+	// not specified, it will be empty and the default for the response type
+	// should be used.
+	ResponseMode responseMode
+	// CodeChallenge and CodeChallengeMethod are set if the client is using
+	// PKCE. If a challenge was passed without a method, the method defaults
+	// to plain.
+	//
+	// https://tools.ietf.org/html/rfc7636#section-4.3
+	CodeChallenge       string
+	CodeChallengeMethod codeChallengeMethod
+	// Claims are the individual claims the client requested, if it passed
+	// the claims parameter.
+	Claims *ClaimsRequest
+	// Prompt are the prompt values the client passed, if any.
+	Prompt []Prompt
+	// MaxAge is the maximum time since the user last authenticated, if the
+	// client passed max_age.
+	MaxAge *time.Duration
+	// Resources are the resource indicators the client requested a token
+	// for, if any.
+	//
+	// https://tools.ietf.org/html/rfc8707#section-2.1
+	Resources []string
 
 	// Raw is the full, unprocessed set of values passed to this request.
 	Raw url.Values
@@ -39,24 +172,28 @@ func parseAuthRequest(req *http.Request) (authReq *authRequest, err error) {
 	if req.Method != http.MethodGet && req.Method != http.MethodPost {
 		return nil, &httpError{Code: http.StatusBadRequest, Message: "method must be POST or GET"}
 	}
+	if err := req.ParseForm(); err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request", Cause: err}
+	}
 
-	rts := req.FormValue("response_type")
-	cid := req.FormValue("client_id")
-	ruri := req.FormValue("redirect_uri")
-	scope := req.FormValue("scope")
-	state := req.FormValue("state")
+	return parseAuthRequestValues(req.Form)
+}
 
-	var rt responseType
-	switch rts {
-	case string(responseTypeCode):
-		rt = responseTypeCode
-	case string(responseTypeImplicit):
-		rt = responseTypeImplicit
-	default:
+// parseAuthRequestValues processes the parameters of an authentication request,
+// wherever they were sourced from.
+func parseAuthRequestValues(params url.Values) (authReq *authRequest, err error) {
+	rts := params.Get("response_type")
+	cid := params.Get("client_id")
+	ruri := params.Get("redirect_uri")
+	scope := params.Get("scope")
+	state := params.Get("state")
+
+	rt := parseResponseType(rts)
+	if rt == "" {
 		return nil, &authError{
 			State:       state,
 			Code:        authErrorCodeInvalidRequest,
-			Description: `response_type must be "code" or "token"`,
+			Description: `response_type must be "code", "token", "none", or a combination of code with id_token and token`,
 			RedirectURI: ruri,
 		}
 	}
@@ -70,20 +207,106 @@ func parseAuthRequest(req *http.Request) (authReq *authRequest, err error) {
 		}
 	}
 
-	return &authRequest{
+	rm := responseMode(params.Get("response_mode"))
+	switch rm {
+	case "", responseModeQuery, responseModeFragment, responseModeFormPost, responseModeJWT, responseModeQueryJWT, responseModeFragmentJWT, responseModeFormPostJWT:
+	default:
+		return nil, &authError{
+			State:       state,
+			Code:        authErrorCodeInvalidRequest,
+			Description: "unsupported response_mode",
+			RedirectURI: ruri,
+		}
+	}
+
+	ar := &authRequest{
 		ClientID:     cid,
 		RedirectURI:  ruri,
 		State:        state,
 		Scopes:       strings.Split(strings.TrimSpace(scope), " "),
 		ResponseType: rt,
-		Raw:          req.Form,
-	}, nil
+		ResponseMode: rm,
+		Resources:    params["resource"],
+		Raw:          params,
+	}
+
+	if p := params.Get("prompt"); p != "" {
+		prompt, err := parsePrompt(p)
+		if err != nil {
+			return nil, &authError{
+				State:       state,
+				Code:        authErrorCodeInvalidRequest,
+				Description: err.Error(),
+				RedirectURI: ruri,
+			}
+		}
+		ar.Prompt = prompt
+	}
+
+	if ma := params.Get("max_age"); ma != "" {
+		secs, err := strconv.Atoi(ma)
+		if err != nil || secs < 0 {
+			return nil, &authError{
+				State:       state,
+				Code:        authErrorCodeInvalidRequest,
+				Description: "max_age must be a non-negative integer",
+				RedirectURI: ruri,
+				Cause:       err,
+			}
+		}
+		d := time.Duration(secs) * time.Second
+		ar.MaxAge = &d
+	}
+
+	if c := params.Get("claims"); c != "" {
+		cr, err := parseClaimsRequest(c)
+		if err != nil {
+			return nil, &authError{
+				State:       state,
+				Code:        authErrorCodeInvalidRequest,
+				Description: "claims must be a JSON object",
+				RedirectURI: ruri,
+				Cause:       err,
+			}
+		}
+		ar.Claims = cr
+	}
+
+	if cc := params.Get("code_challenge"); cc != "" {
+		ar.CodeChallenge = cc
+		switch ccm := codeChallengeMethod(params.Get("code_challenge_method")); ccm {
+		case "", codeChallengeMethodPlain:
+			ar.CodeChallengeMethod = codeChallengeMethodPlain
+		case codeChallengeMethodS256:
+			ar.CodeChallengeMethod = codeChallengeMethodS256
+		default:
+			return nil, &authError{
+				State:       state,
+				Code:        authErrorCodeInvalidRequest,
+				Description: "code_challenge_method must be S256 or plain",
+				RedirectURI: ruri,
+			}
+		}
+	}
+
+	return ar, nil
 }
 
 type codeAuthResponse struct {
 	RedirectURI *url.URL
 	State       string
 	Code        string
+	// SessionState is returned for OIDC Session Management, if set.
+	SessionState string
+	// ResponseMode the response should be sent with. If empty, the default
+	// of query is used.
+	ResponseMode responseMode
+	// Response is the signed JWT containing the response parameters, if a
+	// JWT response mode was requested.
+	Response string
+	// FormPostTemplate is used to render form_post responses. If nil,
+	// defaultFormPostTemplate is used.
+	FormPostTemplate *template.Template
 }
 
 // sendCodeAuthResponse sends the appropriate response to an auth request of
@@ -91,13 +314,77 @@ type codeAuthResponse struct {
 //
 // https://tools.ietf.org/html/rfc6749#section-4.1.2
 func sendCodeAuthResponse(w http.ResponseWriter, req *http.Request, resp *codeAuthResponse) {
-	redir := authResponse(resp.RedirectURI, resp.State)
-	v := redir.Query()
+	mode := responseModeFor(resp.ResponseMode, false)
+
+	if mode.isJWT() {
+		sendAuthResponse(w, req, resp.RedirectURI, mode, url.Values{"response": {resp.Response}}, resp.FormPostTemplate)
+		return
+	}
+
+	v := url.Values{}
+	if resp.State != "" {
+		v.Add("state", resp.State)
+	}
 	v.Add("code", resp.Code)
-	redir.RawQuery = v.Encode()
+	if resp.SessionState != "" {
+		v.Add("session_state", resp.SessionState)
+	}
+	sendAuthResponse(w, req, resp.RedirectURI, mode, v, resp.FormPostTemplate)
+}
+
+// sendAuthResponse returns the parameters to the client's redirect URI, using
+// the given response mode. formPostTmpl is used for the form_post modes, if nil
+// the default is used.
+//
+// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+func sendAuthResponse(w http.ResponseWriter, req *http.Request, redir *url.URL, mode responseMode, params url.Values, formPostTmpl *template.Template) {
+	switch mode {
+	case responseModeFragment, responseModeFragmentJWT:
+		redir.Fragment = params.Encode()
+	case responseModeFormPost, responseModeFormPostJWT:
+		writeFormPost(w, formPostTmpl, redir, params)
+		return
+	default:
+		v := redir.Query()
+		for k, pv := range params {
+			for _, p := range pv {
+				v.Add(k, p)
+			}
+		}
+		redir.RawQuery = v.Encode()
+	}
 	http.Redirect(w, req, redir.String(), http.StatusFound)
 }
 
+// defaultFormPostTemplate auto-submits the response parameters to the client.
+//
+// https://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html#FormPostResponseMode
+var defaultFormPostTemplate = template.Must(template.New("formPost").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Submit This Form</title></head>
+<body onload="javascript:document.forms[0].submit()">
+<form method="post" action="{{ .Action }}">
+{{- range $k, $vs := .Params }}{{ range $vs }}
+<input type="hidden" name="{{ $k }}" value="{{ . }}"/>
+{{- end }}{{ end }}
+<noscript><input type="submit" value="Continue"/></noscript>
+</form>
+</body>
+</html>
+`))
+
+func writeFormPost(w http.ResponseWriter, tmpl *template.Template, redir *url.URL, params url.Values) {
+	if tmpl == nil {
+		tmpl = defaultFormPostTemplate
+	}
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = tmpl.Execute(w, map[string]interface{}{
+		"Action": redir.String(),
+		"Params": params,
+	})
+}
+
 type tokenType string
 
 const ( // https://tools.ietf.org/html/rfc6749#section-7.1 , https://tools.ietf.org/html/rfc6750
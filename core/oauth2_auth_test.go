@@ -2,8 +2,10 @@ package core
 
 import (
 	"fmt"
+	"html/template"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,6 +38,12 @@ func TestParseAuthRequest(t *testing.T) {
 			WantErr:     true,
 			WantErrCode: authErrorCodeInvalidRequest,
 		},
+		{
+			Name:        "Unsupported response mode",
+			Query:       "response_type=code&client_id=client&response_mode=bad",
+			WantErr:     true,
+			WantErrCode: authErrorCodeInvalidRequest,
+		},
 		{
 			Name: "Complete request",
 			Query: fmt.Sprintf(
@@ -57,6 +65,40 @@ func TestParseAuthRequest(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:        "Invalid max_age",
+			Query:       "response_type=code&client_id=client&max_age=-1",
+			WantErr:     true,
+			WantErrCode: authErrorCodeInvalidRequest,
+		},
+		{
+			Name:        "Malformed claims",
+			Query:       "response_type=code&client_id=client&claims=" + url.QueryEscape(`["email"]`),
+			WantErr:     true,
+			WantErrCode: authErrorCodeInvalidRequest,
+		},
+		{
+			Name: "Claims request",
+			Query: "response_type=code&client_id=client&scope=openid&claims=" +
+				url.QueryEscape(`{"userinfo":{"email":null},"id_token":{"acr":{"essential":true,"values":["urn:mace:incommon:iap:silver"]}}}`),
+			CmpReq: &authRequest{
+				ClientID:     "client",
+				Scopes:       []string{"openid"},
+				ResponseType: responseTypeCode,
+				Claims: &ClaimsRequest{
+					Userinfo: map[string]*ClaimRequest{"email": nil},
+					IDToken: map[string]*ClaimRequest{
+						"acr": {Essential: true, Values: []interface{}{"urn:mace:incommon:iap:silver"}},
+					},
+				},
+				Raw: url.Values{
+					"client_id":     {"client"},
+					"response_type": {"code"},
+					"scope":         {"openid"},
+					"claims":        {`{"userinfo":{"email":null},"id_token":{"acr":{"essential":true,"values":["urn:mace:incommon:iap:silver"]}}}`},
+				},
+			},
+		},
 	} {
 		t.Run(tc.Name, func(t *testing.T) {
 			meth := tc.Method
@@ -107,6 +149,38 @@ func TestSendCodeAuthResponse(t *testing.T) {
 			},
 			WantRedirectTo: "https://redirect?code=code&state=state",
 		},
+		{
+			Name: "fragment response mode",
+			Resp: &codeAuthResponse{
+				RedirectURI:  mustURL("https://redirect"),
+				State:        "state",
+				Code:         "code",
+				ResponseMode: responseModeFragment,
+			},
+			WantRedirectTo: "https://redirect#code=code&state=state",
+		},
+		{
+			Name: "jwt response mode defaults to query",
+			Resp: &codeAuthResponse{
+				RedirectURI:  mustURL("https://redirect"),
+				State:        "state",
+				Code:         "code",
+				ResponseMode: responseModeJWT,
+				Response:     "signed",
+			},
+			WantRedirectTo: "https://redirect?response=signed",
+		},
+		{
+			Name: "fragment.jwt response mode",
+			Resp: &codeAuthResponse{
+				RedirectURI:  mustURL("https://redirect"),
+				State:        "state",
+				Code:         "code",
+				ResponseMode: responseModeFragmentJWT,
+				Response:     "signed",
+			},
+			WantRedirectTo: "https://redirect#response=signed",
+		},
 	} {
 		t.Run(tc.Name, func(t *testing.T) {
 			req := httptest.NewRequest("GET", "http://auth", nil)
@@ -172,3 +246,82 @@ func mustURL(str string) *url.URL {
 	}
 	return u
 }
+
+func TestSendFormPostAuthResponse(t *testing.T) {
+	for _, tc := range []struct {
+		Name         string
+		Resp         *codeAuthResponse
+		WantContains []string
+	}{
+		{
+			Name: "default template",
+			Resp: &codeAuthResponse{
+				RedirectURI:  mustURL("https://redirect"),
+				State:        `st"ate`,
+				Code:         "code",
+				ResponseMode: responseModeFormPost,
+			},
+			WantContains: []string{
+				`action="https://redirect"`,
+				`<input type="hidden" name="code" value="code"/>`,
+				`<input type="hidden" name="state" value="st&#34;ate"/>`,
+			},
+		},
+		{
+			Name: "custom template",
+			Resp: &codeAuthResponse{
+				RedirectURI:      mustURL("https://redirect"),
+				Code:             "code",
+				ResponseMode:     responseModeFormPost,
+				FormPostTemplate: template.Must(template.New("").Parse(`custom {{ .Action }} {{ .Params.Get "code" }}`)),
+			},
+			WantContains: []string{"custom https://redirect code"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://auth", nil)
+			w := httptest.NewRecorder()
+
+			sendCodeAuthResponse(w, req, tc.Resp)
+
+			if w.Result().StatusCode != 200 {
+				t.Errorf("want OK status, got %d", w.Result().StatusCode)
+			}
+
+			body := w.Body.String()
+			for _, c := range tc.WantContains {
+				if !strings.Contains(body, c) {
+					t.Errorf("want body to contain %s, got: %s", c, body)
+				}
+			}
+		})
+	}
+}
+
+func TestParseResponseType(t *testing.T) {
+	for _, tc := range []struct {
+		In   string
+		Want responseType
+	}{
+		{In: "code", Want: responseTypeCode},
+		{In: "token", Want: responseTypeImplicit},
+		{In: "code id_token", Want: responseTypeCodeIDToken},
+		{In: "id_token code", Want: responseTypeCodeIDToken},
+		{In: "code token", Want: responseTypeCodeToken},
+		{In: "token  code", Want: responseTypeCodeToken},
+		{In: "code id_token token", Want: responseTypeCodeIDTokenToken},
+		{In: "id_token token code", Want: responseTypeCodeIDTokenToken},
+		{In: "none", Want: responseTypeNone},
+		{In: "", Want: ""},
+		{In: "none code", Want: ""},
+		{In: "code code", Want: ""},
+		{In: "code other", Want: ""},
+		{In: "id_token", Want: ""},
+	} {
+		t.Run(tc.In, func(t *testing.T) {
+			if got := parseResponseType(tc.In); got != tc.Want {
+				t.Errorf("want %q, got: %q", tc.Want, got)
+			}
+		})
+	}
+}
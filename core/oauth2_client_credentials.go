@@ -0,0 +1,30 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// GrantTypeClientCredentials is used by clients to get an access token
+	// for themselves, rather than a user.
+	//
+	// https://tools.ietf.org/html/rfc6749#section-4.4
+	GrantTypeClientCredentials GrantType = "client_credentials"
+)
+
+// clientCredentialsRequest holds the parameters specific to the client
+// credentials grant.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.4.2
+type clientCredentialsRequest struct {
+	Scopes []string
+}
+
+func parseClientCredentialsRequest(req *http.Request) *clientCredentialsRequest {
+	ccr := &clientCredentialsRequest{}
+	if s := req.FormValue("scope"); s != "" {
+		ccr.Scopes = strings.Split(s, " ")
+	}
+	return ccr
+}
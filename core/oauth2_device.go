@@ -0,0 +1,129 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+const (
+	// GrantTypeDeviceCode is used to poll for tokens in the device flow.
+	//
+	// https://tools.ietf.org/html/rfc8628#section-3.4
+	GrantTypeDeviceCode GrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+const (
+	// userCodeAlphabet is the set of characters user codes are generated
+	// from. It has no vowels to avoid forming words, and is matched case
+	// insensitively.
+	//
+	// https://tools.ietf.org/html/rfc8628#section-6.1
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLen      = 8
+	// deviceSlowDownIncrement is how much the polling interval is increased
+	// by each time a client polls too quickly.
+	deviceSlowDownIncrement = 5 * time.Second
+)
+
+// deviceAuthRequest is a request to the device authorization endpoint.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.1
+type deviceAuthRequest struct {
+	ClientID     string
+	ClientSecret string
+	// ClientAssertion is a JWT the client authenticated with, instead of a
+	// secret.
+	ClientAssertion string
+	// ClientCert is the TLS client certificate presented with the request,
+	// if any. This is not parsed from the request, as how it is found
+	// depends on configuration.
+	ClientCert *x509.Certificate
+	Scopes     []string
+}
+
+func parseDeviceAuthRequest(req *http.Request) (*deviceAuthRequest, error) {
+	if req.Method != http.MethodPost {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "method must be POST"}
+	}
+
+	dr := &deviceAuthRequest{}
+	if s := req.FormValue("scope"); s != "" {
+		dr.Scopes = strings.Split(s, " ")
+	}
+
+	var err error
+	dr.ClientID, dr.ClientSecret, dr.ClientAssertion, err = parseClientAuth(req)
+	if err != nil {
+		return nil, err
+	}
+	if dr.ClientID == "" {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "client_id is required"}
+	}
+
+	return dr, nil
+}
+
+// deviceAuthResponse is returned from the device authorization endpoint.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.2
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+func writeDeviceAuthResponse(w http.ResponseWriter, resp *deviceAuthResponse) error {
+	w.Header().Add("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Add("Cache-Control", "no-store")
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return fmt.Errorf("failed to write device authorization response json body: %w", err)
+	}
+
+	return nil
+}
+
+// newUserCode generates a random user code, in its normalized form.
+func newUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLen)
+	b := make([]byte, 1)
+	for len(code) < userCodeLen {
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("error reading random data: %w", err)
+		}
+		// discard values that would bias the modulo
+		if int(b[0]) >= 256-(256%len(userCodeAlphabet)) {
+			continue
+		}
+		code = append(code, userCodeAlphabet[int(b[0])%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode converts a code as entered by the user to the form it was
+// generated in, ignoring case and any separators.
+func normalizeUserCode(code string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// formatUserCode splits a normalized code in half, to make it easier for the
+// user to read and enter.
+func formatUserCode(code string) string {
+	return code[:len(code)/2] + "-" + code[len(code)/2:]
+}
@@ -1,8 +1,11 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"strings"
@@ -14,10 +17,15 @@ import (
 // HTTP sequence should be considered complete.
 //
 // For errors in the authorization endpoint, the user will be redirected with
-// the code appended to the redirect URL.
+// the code appended to the redirect URL, in the fragment for the fragment
+// response modes, or for the form_post response modes the code is posted to
+// it.
 // https://tools.ietf.org/html/rfc6749#section-4.1.2.1
 //
-// For unknown errors, an InternalServerError response will be sent
+// For unknown errors, an InternalServerError response will be sent. Errors
+// that aren't returned to the client are rendered by the ErrorHandler, if one
+// is set in the request's context, otherwise as JSON or plain text depending
+// on the Accept header.
 func writeError(w http.ResponseWriter, req *http.Request, err error) error {
 	switch err := err.(type) {
 	case *authError:
@@ -25,26 +33,35 @@ func writeError(w http.ResponseWriter, req *http.Request, err error) error {
 		if perr != nil {
 			return fmt.Errorf("failed to parse redirect URI %q: %w", err.RedirectURI, perr)
 		}
-		v := redir.Query()
-		if err.State != "" {
-			v.Add("state", err.State)
+		mode := responseModeFor(err.ResponseMode, false)
+		params := err.params()
+		switch {
+		case mode.isJWT() && err.Response != "":
+			params = url.Values{"response": {err.Response}}
+		case mode == responseModeFormPost || mode == responseModeFragment:
+			// returned like a successful response. Posting keeps the
+			// details out of the URL.
+		default:
+			mode = responseModeQuery
 		}
-		v.Add("error", string(err.Code))
-		if err.Description != "" {
-			v.Add("error_description", err.Description)
-		}
-		redir.RawQuery = v.Encode()
-		http.Redirect(w, req, redir.String(), http.StatusFound)
+		sendAuthResponse(w, req, redir, mode, params, err.FormPostTemplate)
 
 	case *httpError:
 		m := err.Message
 		if m == "" {
 			m = "Internal error"
 		}
+		code := err.Code
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		if code == http.StatusInternalServerError && timedOut(err) {
+			code, m = http.StatusServiceUnavailable, "Service unavailable"
+		}
 		if err.WWWAuthenticate != "" {
 			w.Header().Add("WWW-Authenticate", err.WWWAuthenticate)
 		}
-		http.Error(w, m, err.Code)
+		renderError(w, req, code, &ErrorResponse{Code: httpErrorCode(code, err.Cause), Description: m})
 
 	case *oauth2.TokenError:
 		w.Header().Add("Content-Type", "application/json;charset=UTF-8")
@@ -61,10 +78,101 @@ func writeError(w http.ResponseWriter, req *http.Request, err error) error {
 			return fmt.Errorf("failed to write token error json body: %w", err)
 		}
 
+	case *rateLimitError:
+		w.Header().Add("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if err := json.NewEncoder(w).Encode(err.TokenError); err != nil {
+			return fmt.Errorf("failed to write rate limit error json body: %w", err)
+		}
+
+	default:
+		code, m := http.StatusInternalServerError, "Internal server error"
+		if timedOut(err) {
+			code, m = http.StatusServiceUnavailable, "Service unavailable"
+		}
+		renderError(w, req, code, &ErrorResponse{Code: httpErrorCode(code, nil), Description: m})
+	}
+
+	return nil
+}
+
+// timedOut returns true if err was caused by the request's context expiring,
+// e.g after the OperationTimeout. These are reported as a 503, so the caller
+// knows to retry.
+func timedOut(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// tokenErrorCodeServerError is returned from endpoints that respond with JSON
+// errors when something unexpected failed, so the client still gets a body it
+// can parse.
+const tokenErrorCodeServerError oauth2.TokenErrorCode = "server_error"
+
+// tokenErrorCodeTemporarilyUnavailable is returned from endpoints that respond
+// with JSON errors when the request timed out.
+const tokenErrorCodeTemporarilyUnavailable oauth2.TokenErrorCode = "temporarily_unavailable"
+
+// basicAuthChallenge is returned when a client's HTTP Basic credentials are
+// rejected.
+const basicAuthChallenge = `Basic realm="token"`
+
+// writeTokenError handles the error for endpoints that must always respond
+// with a JSON error, like the token endpoint. Errors that aren't already
+// token errors are converted to one, keeping their HTTP status. A client that
+// authenticated with HTTP Basic and was rejected is challenged for it, as
+// required.
+//
+// https://tools.ietf.org/html/rfc6749#section-5.2
+func writeTokenError(w http.ResponseWriter, req *http.Request, err error) error {
+	var (
+		terr  *oauth2.TokenError
+		rlerr *rateLimitError
+		herr  *httpError
+	)
+	switch {
+	case errors.As(err, &rlerr):
+		return writeError(w, req, rlerr)
+
+	case errors.As(err, &terr):
+		if terr.ErrorCode == oauth2.TokenErrorCodeInvalidClient && terr.WWWAuthenticate == "" {
+			if _, _, ok := req.BasicAuth(); ok {
+				challenged := *terr
+				challenged.WWWAuthenticate = basicAuthChallenge
+				terr = &challenged
+			}
+		}
+		return writeError(w, req, terr)
+
+	case errors.As(err, &herr):
+		code := herr.Code
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		if herr.WWWAuthenticate != "" {
+			w.Header().Add("WWW-Authenticate", herr.WWWAuthenticate)
+		}
+		if code >= 400 && code < 500 {
+			return writeTokenErrorJSON(w, code, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: herr.Message})
+		}
+		if code == http.StatusInternalServerError && timedOut(herr) {
+			return writeTokenErrorJSON(w, http.StatusServiceUnavailable, &oauth2.TokenError{ErrorCode: tokenErrorCodeTemporarilyUnavailable, Description: "request timed out"})
+		}
+		return writeTokenErrorJSON(w, code, &oauth2.TokenError{ErrorCode: tokenErrorCodeServerError, Description: "internal error"})
+
+	case timedOut(err):
+		return writeTokenErrorJSON(w, http.StatusServiceUnavailable, &oauth2.TokenError{ErrorCode: tokenErrorCodeTemporarilyUnavailable, Description: "request timed out"})
+
 	default:
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return writeTokenErrorJSON(w, http.StatusInternalServerError, &oauth2.TokenError{ErrorCode: tokenErrorCodeServerError, Description: "internal error"})
 	}
+}
 
+func writeTokenErrorJSON(w http.ResponseWriter, code int, terr *oauth2.TokenError) error {
+	w.Header().Add("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(terr); err != nil {
+		return fmt.Errorf("failed to write token error json body: %w", err)
+	}
 	return nil
 }
 
@@ -125,12 +233,54 @@ const (
 	authErrorCodeErrTemporarilyUnvailable authErrorCode = "temporarily_unavailable"
 )
 
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthError
+const (
+	authErrorCodeInteractionRequired      authErrorCode = "interaction_required"
+	authErrorCodeLoginRequired            authErrorCode = "login_required"
+	authErrorCodeAccountSelectionRequired authErrorCode = "account_selection_required"
+	authErrorCodeConsentRequired          authErrorCode = "consent_required"
+)
+
+// https://tools.ietf.org/html/rfc8707#section-2
+const (
+	authErrorCodeInvalidTarget authErrorCode = "invalid_target"
+)
+
+// https://openid.net/specs/openid-connect-unmet-authentication-requirements-1_0.html
+const (
+	authErrorCodeUnmetAuthenticationRequirements authErrorCode = "unmet_authentication_requirements"
+)
+
 type authError struct {
 	State       string
 	Code        authErrorCode
 	Description string
 	RedirectURI string
 	Cause       error
+	// ResponseMode the error is returned with, resolved with
+	// responseModeFor. If empty, it is returned in the query.
+	ResponseMode responseMode
+	// Response is the signed JWT containing the error parameters, if a JWT
+	// response mode was requested.
+	Response string
+	// FormPostTemplate is used to render form_post responses. If nil,
+	// defaultFormPostTemplate is used.
+	FormPostTemplate *template.Template
+}
+
+// params returns the parameters the error is returned to the client with.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+func (a *authError) params() url.Values {
+	v := url.Values{}
+	if a.State != "" {
+		v.Set("state", a.State)
+	}
+	v.Set("error", string(a.Code))
+	if a.Description != "" {
+		v.Set("error_description", a.Description)
+	}
+	return v
 }
 
 func (a *authError) Error() string {
@@ -148,18 +298,84 @@ func (a *authError) Unwrap() error {
 // writeAuthError will build and send an authError for this HTTP response cycle,
 // returning the error that was written. It will ignore any errors actually
 // writing the error to the user.
-func writeAuthError(w http.ResponseWriter, req *http.Request, redirectURI *url.URL, code authErrorCode, state, description string, cause error) error {
+func writeAuthError(w http.ResponseWriter, req *http.Request, redirectURI *url.URL, mode responseMode, code authErrorCode, state, description string, cause error) error {
 	err := &authError{
-		State:       state,
-		Code:        code,
-		Description: description,
-		RedirectURI: redirectURI.String(),
-		Cause:       cause,
+		State:        state,
+		Code:         code,
+		Description:  description,
+		RedirectURI:  redirectURI.String(),
+		Cause:        cause,
+		ResponseMode: mode,
 	}
 	_ = writeError(w, req, err)
 	return err
 }
 
+// writeSessionAuthError sends an authError for the session's authorization
+// request, returning the error that was written. It is returned in the
+// response mode the client requested, so for JWT response modes it is signed
+// like a successful response.
+//
+// https://openid.net/specs/oauth-v2-jarm.html#section-4.1
+func (o *OIDC) writeSessionAuthError(w http.ResponseWriter, req *http.Request, sess *sessionV2, code authErrorCode, description string, cause error) error {
+	redir, err := url.Parse(sess.Request.RedirectURI)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to parse authreq's URI")
+	}
+
+	aerr := &authError{
+		State:            sess.Request.State,
+		Code:             code,
+		Description:      description,
+		RedirectURI:      redir.String(),
+		Cause:            cause,
+		ResponseMode:     responseModeFor(sess.Request.ResponseMode, sess.Request.ResponseType.hybrid()),
+		FormPostTemplate: o.formPostTemplate,
+	}
+	if aerr.ResponseMode.isJWT() {
+		claims := map[string]interface{}{}
+		params := aerr.params()
+		for k := range params {
+			claims[k] = params.Get(k)
+		}
+		aerr.Response, err = o.signAuthResponse(req.Context(), sess.ClientID, claims)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to sign authorization error")
+		}
+	}
+
+	_ = writeError(w, req, aerr)
+	return aerr
+}
+
+// redirectableAuthError returns err unchanged if it is an authError for a
+// valid client, with a redirect URI registered for that client. Otherwise it
+// is converted to an httpError, to be shown to the user directly. Errors
+// found before the client and redirect URI have been validated must go
+// through this, so they are never redirected to an arbitrary URI.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+func (o *OIDC) redirectableAuthError(clientID string, err error) error {
+	aerr, ok := err.(*authError)
+	if !ok {
+		return err
+	}
+
+	valid, verr := o.clients.IsValidClientID(clientID)
+	if verr == nil && valid {
+		valid, verr = o.clients.ValidateClientRedirectURI(clientID, aerr.RedirectURI)
+		valid = valid && o.redirectURISchemeAllowed(aerr.RedirectURI)
+	}
+	if verr != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to validate client for authorization error", Cause: verr}
+	}
+	if !valid {
+		return &httpError{Code: http.StatusBadRequest, Message: aerr.Description, Cause: aerr}
+	}
+
+	return aerr
+}
+
 // addRedirectToError can attach a redirect URI to an error. This is uncommon,
 // but useful when the redirect URI is configured at the client only, and not
 // passed in the authorization request. If the error cannot make use of this, it
@@ -201,6 +417,9 @@ const (
 //
 // https://tools.ietf.org/html/rfc6750#section-3
 type bearerError struct {
+	// Scheme is the authentication scheme the error is for. If not set, it
+	// is Bearer.
+	Scheme      string
 	Realm       string
 	Code        bearerErrorCode
 	Description string
@@ -218,5 +437,9 @@ func (b *bearerError) String() string {
 	if b.Description != "" {
 		ret = append(ret, fmt.Sprintf("%s=%q", "error_description", b.Description))
 	}
-	return "Bearer " + strings.Join(ret, " ")
+	scheme := b.Scheme
+	if scheme == "" {
+		scheme = "Bearer"
+	}
+	return scheme + " " + strings.Join(ret, " ")
 }
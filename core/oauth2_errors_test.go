@@ -3,6 +3,7 @@ package core
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -95,6 +96,30 @@ func TestWriteError(t *testing.T) {
 				}
 			},
 		},
+		{
+			Name: "Auth error should be posted for form_post",
+			Err:  &authError{State: "state", Code: authErrorCodeAccessDenied, Description: "access denied", RedirectURI: "https://callback", ResponseMode: responseModeFormPost},
+			Cmp: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if rec.Code != http.StatusOK {
+					t.Errorf("want 200 form, got %d", rec.Code)
+				}
+				if loc := rec.Header().Get("location"); loc != "" {
+					t.Errorf("want no redirect, got: %s", loc)
+				}
+
+				body := rec.Body.String()
+				for _, want := range []string{
+					`action="https://callback"`,
+					`<input type="hidden" name="state" value="state"/>`,
+					`<input type="hidden" name="error" value="access_denied"/>`,
+					`<input type="hidden" name="error_description" value="access denied"/>`,
+				} {
+					if !strings.Contains(body, want) {
+						t.Errorf("want body to contain %s, got: %s", want, body)
+					}
+				}
+			},
+		},
 		{
 			Name: "Token error should return JSON details",
 			Err:  &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "grant is bad", ErrorURI: "https://error/info"},
@@ -159,6 +184,216 @@ func TestWriteError(t *testing.T) {
 	}
 }
 
+func TestWriteTokenError(t *testing.T) {
+	for _, tc := range []struct {
+		Name          string
+		Err           error
+		BasicAuth     bool
+		WantStatus    int
+		WantCode      oauth2.TokenErrorCode
+		WantChallenge string
+	}{
+		{
+			Name:       "Token error is passed through",
+			Err:        &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "grant is bad"},
+			WantStatus: http.StatusBadRequest,
+			WantCode:   oauth2.TokenErrorCodeInvalidGrant,
+		},
+		{
+			Name:       "Wrapped token error is passed through",
+			Err:        fmt.Errorf("wrapped: %w", &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidScope}),
+			WantStatus: http.StatusBadRequest,
+			WantCode:   oauth2.TokenErrorCodeInvalidScope,
+		},
+		{
+			Name:          "Invalid client with basic auth is challenged",
+			Err:           &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient},
+			BasicAuth:     true,
+			WantStatus:    http.StatusUnauthorized,
+			WantCode:      oauth2.TokenErrorCodeInvalidClient,
+			WantChallenge: basicAuthChallenge,
+		},
+		{
+			Name:       "Invalid client without basic auth is not challenged",
+			Err:        &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient},
+			WantStatus: http.StatusUnauthorized,
+			WantCode:   oauth2.TokenErrorCodeInvalidClient,
+		},
+		{
+			Name:       "Rate limit error",
+			Err:        &rateLimitError{TokenError: &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest}},
+			WantStatus: http.StatusTooManyRequests,
+			WantCode:   oauth2.TokenErrorCodeInvalidRequest,
+		},
+		{
+			Name:       "Client HTTP error is converted",
+			Err:        &httpError{Code: http.StatusBadRequest, Message: "bad request"},
+			WantStatus: http.StatusBadRequest,
+			WantCode:   oauth2.TokenErrorCodeInvalidRequest,
+		},
+		{
+			Name:          "HTTP error keeps its challenge",
+			Err:           &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: "Bearer"},
+			WantStatus:    http.StatusUnauthorized,
+			WantCode:      oauth2.TokenErrorCodeInvalidRequest,
+			WantChallenge: "Bearer",
+		},
+		{
+			Name:       "Server HTTP error is converted",
+			Err:        &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "causemsg"},
+			WantStatus: http.StatusInternalServerError,
+			WantCode:   tokenErrorCodeServerError,
+		},
+		{
+			Name:       "Generic error",
+			Err:        errors.New("errortext"),
+			WantStatus: http.StatusInternalServerError,
+			WantCode:   tokenErrorCodeServerError,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/token", nil)
+			if tc.BasicAuth {
+				req.SetBasicAuth("client", "secret")
+			}
+			rec := httptest.NewRecorder()
+
+			if err := writeTokenError(rec, req, tc.Err); err != nil {
+				t.Fatalf("unexpected error calling writeTokenError: %v", err)
+			}
+
+			if rec.Code != tc.WantStatus {
+				t.Errorf("want status %d, got %d", tc.WantStatus, rec.Code)
+			}
+			if ct := rec.Header().Get("content-type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("want JSON content type, got: %s", ct)
+			}
+			if containsInsensitive(rec.Body.String(), "causemsg") || containsInsensitive(rec.Body.String(), "errortext") {
+				t.Error("token error response body should never expose error details")
+			}
+			te := &oauth2.TokenError{}
+			if err := json.NewDecoder(rec.Body).Decode(te); err != nil {
+				t.Fatalf("failed to unmarshal response JSON: %v", err)
+			}
+			if te.ErrorCode != tc.WantCode {
+				t.Errorf("want code %s, got %s", tc.WantCode, te.ErrorCode)
+			}
+			if wwa := rec.Header().Get("www-authenticate"); wwa != tc.WantChallenge {
+				t.Errorf("want www-authenticate %q, got: %q", tc.WantChallenge, wwa)
+			}
+		})
+	}
+}
+
+func TestAuthorizationErrorRedirects(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: "secret", RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name         string
+		Query        url.Values
+		WantStatus   int
+		WantRedirect bool
+	}{
+		{
+			Name: "Invalid request for a valid client is redirected",
+			Query: url.Values{
+				"response_type": {"bad"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"state":         {"state"},
+			},
+			WantStatus:   http.StatusFound,
+			WantRedirect: true,
+		},
+		{
+			Name: "Invalid request with an unregistered redirect is shown directly",
+			Query: url.Values{
+				"response_type": {"bad"},
+				"client_id":     {clientID},
+				"redirect_uri":  {"https://attacker"},
+				"state":         {"state"},
+			},
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "Invalid request for an unknown client is shown directly",
+			Query: url.Values{
+				"response_type": {"code"},
+				"client_id":     {"unknown"},
+				"redirect_uri":  {redirectURI},
+				"max_age":       {"-1"},
+			},
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "Unknown client is shown directly",
+			Query: url.Values{
+				"response_type": {"code"},
+				"client_id":     {"unknown"},
+				"redirect_uri":  {redirectURI},
+			},
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "Error after validation is redirected",
+			Query: url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"resource":      {"not-absolute"},
+				"state":         {"state"},
+			},
+			WantStatus:   http.StatusFound,
+			WantRedirect: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if _, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+tc.Query.Encode(), nil)); err == nil {
+				t.Fatal("want error")
+			}
+
+			if rec.Code != tc.WantStatus {
+				t.Fatalf("want status %d, got %d", tc.WantStatus, rec.Code)
+			}
+			loc := rec.Header().Get("location")
+			if !tc.WantRedirect {
+				if loc != "" {
+					t.Errorf("want no redirect, got: %s", loc)
+				}
+				return
+			}
+
+			locp, err := url.Parse(loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(loc, redirectURI) {
+				t.Errorf("want redirect to %s, got: %s", redirectURI, loc)
+			}
+			if locp.Query().Get("error") == "" {
+				t.Error("want error on redirect")
+			}
+			if locp.Query().Get("state") != "state" {
+				t.Errorf("want state on redirect, got: %s", locp.Query().Get("state"))
+			}
+		})
+	}
+}
+
 func TestBearerError(t *testing.T) {
 	for _, tc := range []struct {
 		Name  string
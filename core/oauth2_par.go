@@ -0,0 +1,90 @@
+package core
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// pushedRequestURIPrefix is used for the request_uri values we issue for
+// pushed authorization requests.
+//
+// https://tools.ietf.org/html/rfc9126#section-2.2
+const pushedRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// pushedAuthRequest is a request to the pushed authorization request
+// endpoint. It contains the client's credentials, and the authorization
+// request parameters that should be stored.
+//
+// https://tools.ietf.org/html/rfc9126#section-2.1
+type pushedAuthRequest struct {
+	ClientID        string
+	ClientSecret    string
+	ClientAssertion string
+	// ClientCert is the TLS client certificate presented with the request,
+	// if any. This is not parsed from the request, as how it is found
+	// depends on configuration.
+	ClientCert *x509.Certificate
+	// Params are the authorization request parameters, with the client
+	// authentication parameters removed.
+	Params url.Values
+}
+
+func parsePushedAuthRequest(req *http.Request) (*pushedAuthRequest, error) {
+	if req.Method != http.MethodPost {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "method must be POST"}
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid form", Cause: err}
+	}
+
+	pr := &pushedAuthRequest{}
+
+	var err error
+	pr.ClientID, pr.ClientSecret, pr.ClientAssertion, err = parseClientAuth(req)
+	if err != nil {
+		return nil, err
+	}
+
+	pr.Params = url.Values{}
+	for k, v := range req.PostForm {
+		switch k {
+		case "client_secret", "client_assertion", "client_assertion_type":
+			continue
+		case "request_uri":
+			// https://tools.ietf.org/html/rfc9126#section-2.1
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "request_uri must not be pushed"}
+		}
+		pr.Params[k] = v
+	}
+	// the client ID must be available when the request is used, regardless
+	// of how the client authenticated.
+	pr.Params.Set("client_id", pr.ClientID)
+
+	return pr, nil
+}
+
+// pushedAuthResponse is returned from the pushed authorization request
+// endpoint.
+//
+// https://tools.ietf.org/html/rfc9126#section-2.2
+type pushedAuthResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+func writePushedAuthResponse(w http.ResponseWriter, resp *pushedAuthResponse) error {
+	w.Header().Add("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return fmt.Errorf("failed to write pushed authorization response json body: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+const (
+	// GrantTypePassword is the resource owner password credentials grant.
+	//
+	// https://tools.ietf.org/html/rfc6749#section-4.3
+	GrantTypePassword GrantType = "password"
+)
+
+// passwordRequest holds the parameters specific to the password grant.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.3.2
+type passwordRequest struct {
+	Username string
+	Password string
+	Scopes   []string
+}
+
+func parsePasswordRequest(req *http.Request) (*passwordRequest, error) {
+	pr := &passwordRequest{
+		Username: req.FormValue("username"),
+		Password: req.FormValue("password"),
+	}
+	if s := req.FormValue("scope"); s != "" {
+		pr.Scopes = strings.Split(s, " ")
+	}
+
+	if pr.Username == "" || pr.Password == "" {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "username and password are required for password grant"}
+	}
+
+	return pr, nil
+}
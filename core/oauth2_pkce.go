@@ -0,0 +1,33 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+type codeChallengeMethod string
+
+// https://tools.ietf.org/html/rfc7636#section-4.2
+const (
+	codeChallengeMethodPlain codeChallengeMethod = "plain"
+	codeChallengeMethodS256  codeChallengeMethod = "S256"
+)
+
+// verifyCodeChallenge checks that the verifier passed to the token endpoint
+// corresponds to the challenge passed to the authorization endpoint.
+//
+// https://tools.ietf.org/html/rfc7636#section-4.6
+func verifyCodeChallenge(method codeChallengeMethod, challenge, verifier string) bool {
+	var computed string
+	switch method {
+	case codeChallengeMethodPlain:
+		computed = verifier
+	case codeChallengeMethodS256:
+		h := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(h[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
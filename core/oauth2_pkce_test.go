@@ -0,0 +1,61 @@
+package core
+
+import "testing"
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7636#appendix-B
+	const (
+		rfcVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		rfcChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+
+	for _, tc := range []struct {
+		Name      string
+		Method    codeChallengeMethod
+		Challenge string
+		Verifier  string
+		Want      bool
+	}{
+		{
+			Name:      "S256 RFC example",
+			Method:    codeChallengeMethodS256,
+			Challenge: rfcChallenge,
+			Verifier:  rfcVerifier,
+			Want:      true,
+		},
+		{
+			Name:      "S256 wrong verifier",
+			Method:    codeChallengeMethodS256,
+			Challenge: rfcChallenge,
+			Verifier:  rfcVerifier + "x",
+			Want:      false,
+		},
+		{
+			Name:      "S256 verifier passed as challenge",
+			Method:    codeChallengeMethodS256,
+			Challenge: rfcVerifier,
+			Verifier:  rfcVerifier,
+			Want:      false,
+		},
+		{
+			Name:      "Plain match",
+			Method:    codeChallengeMethodPlain,
+			Challenge: rfcVerifier,
+			Verifier:  rfcVerifier,
+			Want:      true,
+		},
+		{
+			Name:      "Unknown method",
+			Method:    codeChallengeMethod("S512"),
+			Challenge: rfcVerifier,
+			Verifier:  rfcVerifier,
+			Want:      false,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := verifyCodeChallenge(tc.Method, tc.Challenge, tc.Verifier); got != tc.Want {
+				t.Errorf("want %t, got %t", tc.Want, got)
+			}
+		})
+	}
+}
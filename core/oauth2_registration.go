@@ -0,0 +1,262 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pardot/oidc/oauth2"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// registrationMaxSize is the largest client registration request body we'll
+// read.
+const registrationMaxSize = 64 << 10
+
+// ClientMetadata is the information a client registers itself with.
+//
+// https://tools.ietf.org/html/rfc7591#section-2
+type ClientMetadata struct {
+	RedirectURIs            []string            `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string              `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string            `json:"grant_types,omitempty"`
+	ResponseTypes           []string            `json:"response_types,omitempty"`
+	ClientName              string              `json:"client_name,omitempty"`
+	ClientURI               string              `json:"client_uri,omitempty"`
+	LogoURI                 string              `json:"logo_uri,omitempty"`
+	Scope                   string              `json:"scope,omitempty"`
+	Contacts                []string            `json:"contacts,omitempty"`
+	TOSURI                  string              `json:"tos_uri,omitempty"`
+	PolicyURI               string              `json:"policy_uri,omitempty"`
+	JWKSURI                 string              `json:"jwks_uri,omitempty"`
+	JWKS                    *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	SoftwareID              string              `json:"software_id,omitempty"`
+	SoftwareVersion         string              `json:"software_version,omitempty"`
+
+	// IDTokenSignedResponseAlg is the algorithm the client wants its ID
+	// tokens signed with.
+	//
+	// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+	IDTokenSignedResponseAlg jose.SignatureAlgorithm `json:"id_token_signed_response_alg,omitempty"`
+	// IDTokenEncryptedResponseAlg and IDTokenEncryptedResponseEnc are the
+	// algorithms the client wants its ID tokens encrypted with, to a key from
+	// its JWKS. ID tokens are only encrypted if the alg is set.
+	IDTokenEncryptedResponseAlg jose.KeyAlgorithm      `json:"id_token_encrypted_response_alg,omitempty"`
+	IDTokenEncryptedResponseEnc jose.ContentEncryption `json:"id_token_encrypted_response_enc,omitempty"`
+	// SubjectType is the type of sub the client wants its users identified
+	// by. SectorIdentifierURI is the URL whose host pairwise subs are
+	// derived for, so clients with redirect URIs on different hosts can share
+	// them.
+	SubjectType         SubjectType `json:"subject_type,omitempty"`
+	SectorIdentifierURI string      `json:"sector_identifier_uri,omitempty"`
+}
+
+const (
+	tokenEndpointAuthMethodClientSecretBasic = "client_secret_basic"
+	tokenEndpointAuthMethodClientSecretPost  = "client_secret_post"
+	tokenEndpointAuthMethodClientSecretJWT   = "client_secret_jwt"
+	tokenEndpointAuthMethodPrivateKeyJWT     = "private_key_jwt"
+	tokenEndpointAuthMethodNone              = "none"
+)
+
+// parseClientMetadata reads the client metadata from a registration or update
+// request body.
+//
+// https://tools.ietf.org/html/rfc7591#section-3.1
+func parseClientMetadata(req *http.Request) (*clientRegistrationRequest, error) {
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != "application/json" {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "request must be application/json"}
+	}
+
+	crr := &clientRegistrationRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, req.Body, registrationMaxSize)).Decode(crr); err != nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "invalid JSON body", Cause: err}
+	}
+
+	if err := validateClientMetadata(&crr.ClientMetadata); err != nil {
+		return nil, err
+	}
+
+	return crr, nil
+}
+
+// clientRegistrationRequest is the body of a registration or update request.
+// Updates also include the client's credentials, which must match.
+//
+// https://tools.ietf.org/html/rfc7592#section-2.2
+type clientRegistrationRequest struct {
+	ClientMetadata
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// validateClientMetadata checks the metadata is usable by us, filling in the
+// defaults for anything not set.
+func validateClientMetadata(md *ClientMetadata) error {
+	if md.TokenEndpointAuthMethod == "" {
+		md.TokenEndpointAuthMethod = tokenEndpointAuthMethodClientSecretBasic
+	}
+	switch md.TokenEndpointAuthMethod {
+	case tokenEndpointAuthMethodClientSecretBasic, tokenEndpointAuthMethodClientSecretPost, tokenEndpointAuthMethodClientSecretJWT, tokenEndpointAuthMethodNone:
+	case tokenEndpointAuthMethodPrivateKeyJWT:
+		if md.JWKS == nil && md.JWKSURI == "" {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "jwks or jwks_uri is required for private_key_jwt"}
+		}
+	default:
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "unsupported token_endpoint_auth_method"}
+	}
+	if md.JWKS != nil && md.JWKSURI != "" {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "jwks and jwks_uri can not both be set"}
+	}
+
+	if md.IDTokenEncryptedResponseEnc != "" && md.IDTokenEncryptedResponseAlg == "" {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "id_token_encrypted_response_enc requires id_token_encrypted_response_alg"}
+	}
+	if md.IDTokenEncryptedResponseAlg != "" {
+		if md.IDTokenEncryptedResponseEnc == "" {
+			md.IDTokenEncryptedResponseEnc = defaultIDTokenEncryptionEnc
+		}
+		if !keyAlgSupported(md.IDTokenEncryptedResponseAlg) {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "unsupported id_token_encrypted_response_alg"}
+		}
+		if !contentEncSupported(md.IDTokenEncryptedResponseEnc) {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "unsupported id_token_encrypted_response_enc"}
+		}
+		if md.JWKS == nil && md.JWKSURI == "" {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "jwks or jwks_uri is required for encrypted id tokens"}
+		}
+	}
+
+	switch md.SubjectType {
+	case "", SubjectTypePublic, SubjectTypePairwise:
+	default:
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "unsupported subject_type"}
+	}
+	if md.SectorIdentifierURI != "" {
+		if u, err := url.Parse(md.SectorIdentifierURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "sector_identifier_uri must be a https URL"}
+		}
+	}
+
+	if len(md.GrantTypes) == 0 {
+		md.GrantTypes = []string{string(GrantTypeAuthorizationCode)}
+	}
+	if len(md.ResponseTypes) == 0 {
+		md.ResponseTypes = []string{string(responseTypeCode)}
+	}
+
+	// clients using the authorization endpoint need somewhere to be sent back
+	// to.
+	if strsContains(md.GrantTypes, string(GrantTypeAuthorizationCode)) && len(md.RedirectURIs) == 0 {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRedirectURI, Description: "redirect_uris are required for the authorization_code grant"}
+	}
+	for _, ru := range md.RedirectURIs {
+		if err := validateRegisteredRedirectURI(ru); err != nil {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRedirectURI, Description: fmt.Sprintf("invalid redirect URI %s", ru), Cause: err}
+		}
+	}
+
+	// without a sector_identifier_uri, pairwise subs are derived from the
+	// redirect URI host, so there can only be one.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg
+	if md.SubjectType == SubjectTypePairwise && md.SectorIdentifierURI == "" {
+		hosts := map[string]bool{}
+		for _, ru := range md.RedirectURIs {
+			if u, err := url.Parse(ru); err == nil {
+				hosts[u.Host] = true
+			}
+		}
+		if len(hosts) > 1 {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "sector_identifier_uri is required for pairwise clients with redirect URIs on more than one host"}
+		}
+	}
+
+	return nil
+}
+
+// validateClientSubjectType checks we can issue the type of subject the
+// client asked for.
+func (o *OIDC) validateClientSubjectType(md *ClientMetadata) error {
+	if md.SubjectType == SubjectTypePairwise && o.subjectGenerator == nil {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: "pairwise subject_type is not supported"}
+	}
+	return nil
+}
+
+// validateClientSigningAlgs checks the signer can sign with the algorithms the
+// client asked for.
+func (o *OIDC) validateClientSigningAlgs(ctx context.Context, md *ClientMetadata) error {
+	if md.IDTokenSignedResponseAlg == "" {
+		return nil
+	}
+	ok, err := o.signerSupportsAlg(ctx, md.IDTokenSignedResponseAlg)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check signer algorithms", Cause: err}
+	}
+	if !ok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClientMetadata, Description: fmt.Sprintf("unsupported id_token_signed_response_alg %s", md.IDTokenSignedResponseAlg)}
+	}
+	return nil
+}
+
+// validateClientRedirectURISchemes checks the client's redirect URIs are
+// allowed by the RequireHTTPSRedirectURIs setting.
+func (o *OIDC) validateClientRedirectURISchemes(md *ClientMetadata) error {
+	for _, ru := range md.RedirectURIs {
+		if !o.redirectURISchemeAllowed(ru) {
+			return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRedirectURI, Description: fmt.Sprintf("redirect URI %s must use https", ru)}
+		}
+	}
+	return nil
+}
+
+// validateRegisteredRedirectURI checks a redirect URI can be registered. It
+// must be absolute, and not contain a fragment.
+//
+// https://tools.ietf.org/html/rfc6749#section-3.1.2
+func validateRegisteredRedirectURI(ru string) error {
+	u, err := url.Parse(ru)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() {
+		return fmt.Errorf("redirect URI must be absolute")
+	}
+	if strings.Contains(ru, "#") {
+		return fmt.Errorf("redirect URI must not contain a fragment")
+	}
+	return nil
+}
+
+// clientInformationResponse is returned after a client is registered, or when
+// its configuration is read or updated.
+//
+// https://tools.ietf.org/html/rfc7591#section-3.2.1
+// https://tools.ietf.org/html/rfc7592#section-3
+type clientInformationResponse struct {
+	ClientMetadata
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at,omitempty"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
+func writeClientInformationResponse(w http.ResponseWriter, code int, resp *clientInformationResponse) error {
+	w.Header().Add("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Pragma", "no-cache")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return fmt.Errorf("failed to write client information response json body: %w", err)
+	}
+
+	return nil
+}
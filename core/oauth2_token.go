@@ -1,6 +1,7 @@
 package core
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -8,7 +9,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pardot/oidc"
 	"github.com/pardot/oidc/oauth2"
+	"gopkg.in/square/go-jose.v2"
 )
 
 type GrantType string
@@ -25,6 +28,41 @@ type tokenRequest struct {
 	RedirectURI  string
 	ClientID     string
 	ClientSecret string
+	// CodeVerifier is the PKCE verifier for the authorization_code grant, if
+	// passed.
+	//
+	// https://tools.ietf.org/html/rfc7636#section-4.5
+	CodeVerifier string
+	// ClientAssertion is a JWT the client authenticated with, instead of a
+	// secret.
+	ClientAssertion string
+	// ClientCert is the TLS client certificate presented with the request,
+	// if any. This is not parsed from the request, as how it is found
+	// depends on configuration.
+	ClientCert *x509.Certificate
+	// ClientIP is the address the request came from, for tracking password
+	// logins. Like ClientCert, it is set by the handler.
+	ClientIP string
+	// DPoPJKT is the thumbprint of the key the DPoP proof passed with the
+	// request was signed with, if any. The tokens issued are bound to it.
+	DPoPJKT string
+	// DeviceCode is the code being polled for in the device code grant.
+	DeviceCode string
+	// TokenExchange is set for the token exchange grant.
+	TokenExchange *tokenExchangeRequest
+	// Password is set for the password grant.
+	Password *passwordRequest
+	// ClientCredentials is set for the client credentials grant.
+	ClientCredentials *clientCredentialsRequest
+	// Resources are the resource indicators the token is requested for, if
+	// any.
+	//
+	// https://tools.ietf.org/html/rfc8707#section-2.2
+	Resources []string
+	// Scopes the refresh grant asked the token be narrowed to, if any.
+	//
+	// https://tools.ietf.org/html/rfc6749#section-6
+	Scopes []string
 }
 
 // parseTokenRequest parses the information from a request for an access token.
@@ -39,25 +77,16 @@ func parseTokenRequest(req *http.Request) (*tokenRequest, error) {
 		RedirectURI:  req.FormValue("redirect_uri"),
 		Code:         req.FormValue("code"),
 		RefreshToken: req.FormValue("refresh_token"),
+		CodeVerifier: req.FormValue("code_verifier"),
+		DeviceCode:   req.FormValue("device_code"),
 	}
+	// FormValue has parsed the form
+	tr.Resources = req.Form["resource"]
 
-	// Auth the request
-	// https://tools.ietf.org/html/rfc6749#section-2.3
-	cid, cs, isBasic := req.BasicAuth()
-	if isBasic {
-		var err error
-		tr.ClientID, err = url.QueryUnescape(cid)
-		if err != nil {
-			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid encoding for client id"}
-		}
-		tr.ClientSecret, err = url.QueryUnescape(cs)
-		if err != nil {
-			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid encoding for client secret"}
-		}
-
-	} else {
-		tr.ClientID = req.FormValue("client_id")
-		tr.ClientSecret = req.FormValue("client_secret")
+	var err error
+	tr.ClientID, tr.ClientSecret, tr.ClientAssertion, err = parseClientAuth(req)
+	if err != nil {
+		return nil, err
 	}
 
 	switch req.FormValue("grant_type") {
@@ -75,8 +104,36 @@ func parseTokenRequest(req *http.Request) (*tokenRequest, error) {
 		if tr.RefreshToken == "" {
 			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "refresh_token is required for refresh grant"}
 		}
+		if scope := req.FormValue("scope"); scope != "" {
+			tr.Scopes = strings.Fields(scope)
+		}
 		tr.GrantType = GrantTypeRefreshToken
 
+	case string(GrantTypeDeviceCode):
+		// https://tools.ietf.org/html/rfc8628#section-3.4
+		if tr.DeviceCode == "" {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "device_code is required for device code grant"}
+		}
+		tr.GrantType = GrantTypeDeviceCode
+
+	case string(GrantTypeTokenExchange):
+		tr.TokenExchange, err = parseTokenExchangeRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		tr.GrantType = GrantTypeTokenExchange
+
+	case string(GrantTypePassword):
+		tr.Password, err = parsePasswordRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		tr.GrantType = GrantTypePassword
+
+	case string(GrantTypeClientCredentials):
+		tr.ClientCredentials = parseClientCredentialsRequest(req)
+		tr.GrantType = GrantTypeClientCredentials
+
 	default:
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: fmt.Sprintf("grant_type must be %s", GrantTypeAuthorizationCode)}
 	}
@@ -84,6 +141,68 @@ func parseTokenRequest(req *http.Request) (*tokenRequest, error) {
 	return tr, nil
 }
 
+// clientAssertionTypeJWTBearer is the only client_assertion_type we support.
+//
+// https://tools.ietf.org/html/rfc7523#section-2.2
+const clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// parseClientAuth extracts the client credentials from a request to the token
+// endpoint, or other endpoints that authenticate the client in the same way.
+// Credentials are read from the basic auth header if present, otherwise from
+// the form body. If the client authenticates with a JWT assertion rather than
+// a secret, it is returned as clientAssertion. The client ID will be taken from
+// the assertion's subject if not passed, but the assertion is not verified
+// here.
+//
+// https://tools.ietf.org/html/rfc6749#section-2.3
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+func parseClientAuth(req *http.Request) (clientID, clientSecret, clientAssertion string, err error) {
+	if ca := req.FormValue("client_assertion"); ca != "" {
+		if req.FormValue("client_assertion_type") != clientAssertionTypeJWTBearer {
+			return "", "", "", &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "unsupported client_assertion_type"}
+		}
+		clientID = req.FormValue("client_id")
+		if clientID == "" {
+			clientID, err = unverifiedAssertionSubject(ca)
+			if err != nil {
+				return "", "", "", &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid client_assertion", Cause: err}
+			}
+		}
+		return clientID, "", ca, nil
+	}
+
+	cid, cs, isBasic := req.BasicAuth()
+	if !isBasic {
+		return req.FormValue("client_id"), req.FormValue("client_secret"), "", nil
+	}
+
+	clientID, err = url.QueryUnescape(cid)
+	if err != nil {
+		return "", "", "", &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid encoding for client id"}
+	}
+	clientSecret, err = url.QueryUnescape(cs)
+	if err != nil {
+		return "", "", "", &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid encoding for client secret"}
+	}
+
+	return clientID, clientSecret, "", nil
+}
+
+// unverifiedAssertionSubject reads the sub claim from a client assertion,
+// without checking the signature. This is only used to find out which client
+// is authenticating, so we know which keys to verify the assertion with.
+func unverifiedAssertionSubject(assertion string) (string, error) {
+	jws, err := jose.ParseSigned(assertion)
+	if err != nil {
+		return "", fmt.Errorf("parsing assertion: %w", err)
+	}
+	cl := oidc.Claims{}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &cl); err != nil {
+		return "", fmt.Errorf("unmarshaling assertion claims: %w", err)
+	}
+	return cl.Subject, nil
+}
+
 // https://tools.ietf.org/html/rfc6749#section-5.1
 //
 // this does eventually end up as JSON, but because of how we want to handle the
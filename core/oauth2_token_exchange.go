@@ -0,0 +1,69 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+const (
+	// GrantTypeTokenExchange is used to exchange one token for another, for
+	// impersonation or delegation.
+	//
+	// https://tools.ietf.org/html/rfc8693#section-2.1
+	GrantTypeTokenExchange GrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// TokenTypeIdentifier identifies the type of a token passed to or issued from
+// the token exchange grant.
+//
+// https://tools.ietf.org/html/rfc8693#section-3
+type TokenTypeIdentifier string
+
+const (
+	// TokenTypeIdentifierAccessToken is an OAuth 2.0 access token.
+	TokenTypeIdentifierAccessToken TokenTypeIdentifier = "urn:ietf:params:oauth:token-type:access_token"
+	// TokenTypeIdentifierIDToken is an OIDC ID token.
+	TokenTypeIdentifierIDToken TokenTypeIdentifier = "urn:ietf:params:oauth:token-type:id_token"
+	// TokenTypeIdentifierJWT is any JWT.
+	TokenTypeIdentifierJWT TokenTypeIdentifier = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// tokenExchangeRequest holds the parameters specific to the token exchange
+// grant.
+//
+// https://tools.ietf.org/html/rfc8693#section-2.1
+type tokenExchangeRequest struct {
+	SubjectToken       string
+	SubjectTokenType   TokenTypeIdentifier
+	ActorToken         string
+	ActorTokenType     TokenTypeIdentifier
+	RequestedTokenType TokenTypeIdentifier
+	Audience           []string
+	Scopes             []string
+}
+
+func parseTokenExchangeRequest(req *http.Request) (*tokenExchangeRequest, error) {
+	ter := &tokenExchangeRequest{
+		SubjectToken:       req.FormValue("subject_token"),
+		SubjectTokenType:   TokenTypeIdentifier(req.FormValue("subject_token_type")),
+		ActorToken:         req.FormValue("actor_token"),
+		ActorTokenType:     TokenTypeIdentifier(req.FormValue("actor_token_type")),
+		RequestedTokenType: TokenTypeIdentifier(req.FormValue("requested_token_type")),
+		// audience can be passed multiple times
+		Audience: req.Form["audience"],
+	}
+	if s := req.FormValue("scope"); s != "" {
+		ter.Scopes = strings.Split(s, " ")
+	}
+
+	if ter.SubjectToken == "" || ter.SubjectTokenType == "" {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "subject_token and subject_token_type are required for token exchange grant"}
+	}
+	if (ter.ActorToken == "") != (ter.ActorTokenType == "") {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "actor_token_type must be passed with actor_token"}
+	}
+
+	return ter, nil
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+type tokenTypeHint string
+
+const (
+	tokenTypeHintAccessToken  tokenTypeHint = "access_token"
+	tokenTypeHintRefreshToken tokenTypeHint = "refresh_token"
+)
+
+// tokenHintRequest is a request that presents a single token for an operation,
+// with an optional hint as to what type of token it is.
+type tokenHintRequest struct {
+	Token         string
+	TokenTypeHint tokenTypeHint
+	ClientID      string
+	ClientSecret  string
+	// ClientAssertion is a JWT the client authenticated with, instead of a
+	// secret.
+	ClientAssertion string
+	// ClientCert is the TLS client certificate presented with the request,
+	// if any. This is not parsed from the request, as how it is found
+	// depends on configuration.
+	ClientCert *x509.Certificate
+}
+
+// parseTokenHintRequest parses the information from a request to the token
+// revocation or introspection endpoints, which share a request format.
+//
+// https://tools.ietf.org/html/rfc7009#section-2.1
+// https://tools.ietf.org/html/rfc7662#section-2.1
+func parseTokenHintRequest(req *http.Request) (*tokenHintRequest, error) {
+	if req.Method != http.MethodPost {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "method must be POST"}
+	}
+
+	rr := &tokenHintRequest{
+		Token: req.FormValue("token"),
+	}
+	if rr.Token == "" {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "token is required"}
+	}
+
+	// The hint is only an optimization for the lookup, unknown values should
+	// be ignored rather than rejected.
+	switch h := tokenTypeHint(req.FormValue("token_type_hint")); h {
+	case tokenTypeHintAccessToken, tokenTypeHintRefreshToken:
+		rr.TokenTypeHint = h
+	}
+
+	var err error
+	rr.ClientID, rr.ClientSecret, rr.ClientAssertion, err = parseClientAuth(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return rr, nil
+}
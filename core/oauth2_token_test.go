@@ -90,6 +90,46 @@ func TestParseToken(t *testing.T) {
 				ClientSecret: "secret",
 			},
 		},
+		{
+			Name: "Token exchange request",
+			Req: func() *http.Request {
+				f := url.Values{
+					"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+					"client_id":            {"client"},
+					"client_secret":        {"secret"},
+					"subject_token":        {"subject"},
+					"subject_token_type":   {"urn:ietf:params:oauth:token-type:id_token"},
+					"requested_token_type": {"urn:ietf:params:oauth:token-type:jwt"},
+					"scope":                {"read write"},
+					"audience":             {"https://api1", "https://api2"},
+				}
+				req := httptest.NewRequest("POST", "https://token", strings.NewReader(f.Encode()))
+				req.Header.Add("content-type", "application/x-www-form-urlencoded")
+				return req
+			},
+			Want: &tokenRequest{
+				GrantType:    GrantTypeTokenExchange,
+				ClientID:     "client",
+				ClientSecret: "secret",
+				TokenExchange: &tokenExchangeRequest{
+					SubjectToken:       "subject",
+					SubjectTokenType:   TokenTypeIdentifierIDToken,
+					RequestedTokenType: TokenTypeIdentifierJWT,
+					Audience:           []string{"https://api1", "https://api2"},
+					Scopes:             []string{"read", "write"},
+				},
+			},
+		},
+		{
+			Name: "Token exchange requires subject token",
+			Req: queryReq(map[string]string{
+				"grant_type":    "urn:ietf:params:oauth:grant-type:token-exchange",
+				"client_id":     "client",
+				"client_secret": "secret",
+			}),
+			WantErr:     true,
+			WantErrCode: oauth2.TokenErrorCodeInvalidRequest,
+		},
 		{
 			Name: "Refresh grant requires refresh token",
 			Req: queryReq(map[string]string{
@@ -120,6 +160,37 @@ func TestParseToken(t *testing.T) {
 				ClientSecret: "sec=ret%",
 			},
 		},
+		{
+			Name: "Client assertion",
+			Req: queryReq(map[string]string{
+				"code":                  "acode",
+				"redirect_uri":          "https://redirect",
+				"grant_type":            "authorization_code",
+				"client_id":             "client",
+				"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+				"client_assertion":      "assertion",
+			}),
+			Want: &tokenRequest{
+				GrantType:       GrantTypeAuthorizationCode,
+				Code:            "acode",
+				RedirectURI:     "https://redirect",
+				ClientID:        "client",
+				ClientAssertion: "assertion",
+			},
+		},
+		{
+			Name: "Unsupported client assertion type",
+			Req: queryReq(map[string]string{
+				"code":                  "acode",
+				"redirect_uri":          "https://redirect",
+				"grant_type":            "authorization_code",
+				"client_id":             "client",
+				"client_assertion_type": "urn:other",
+				"client_assertion":      "assertion",
+			}),
+			WantErr:     true,
+			WantErrCode: oauth2.TokenErrorCodeInvalidRequest,
+		},
 	} {
 		t.Run(tc.Name, func(t *testing.T) {
 			resp, err := parseTokenRequest(tc.Req())
@@ -1,10 +1,12 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"net/url"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/pardot/oidc"
 	"github.com/pardot/oidc/oauth2"
+	corev1beta1 "github.com/pardot/oidc/proto/core/v1beta1"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -48,10 +51,31 @@ const (
 	// DefaultCodeValidityTime is used if the CodeValidityTime is not
 	// configured.
 	DefaultCodeValidityTime = 60 * time.Second
+	// DefaultBackchannelLogoutTimeout is used if the BackchannelLogoutTimeout
+	// is not configured.
+	DefaultBackchannelLogoutTimeout = 10 * time.Second
+	// DefaultDeviceCodeValidityTime is used if the DeviceCodeValidityTime is
+	// not configured.
+	DefaultDeviceCodeValidityTime = 10 * time.Minute
+	// DefaultDevicePollInterval is used if the DevicePollInterval is not
+	// configured.
+	DefaultDevicePollInterval = 5 * time.Second
+	// DefaultPushedRequestValidityTime is used if the
+	// PushedRequestValidityTime is not configured.
+	DefaultPushedRequestValidityTime = 60 * time.Second
 )
 
 // Config sets configuration values for the OIDC flow implementation
 type Config struct {
+	// Issuer is the issuer identifier for this provider. If set, it is
+	// accepted as the audience of client assertions.
+	Issuer string
+	// TokenEndpoint is the full URL of the token endpoint. If set, it is
+	// accepted as the audience of client assertions. One of this or Issuer
+	// must be set for clients to authenticate with private_key_jwt.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+	TokenEndpoint string
 	// AuthValidityTime is the maximum time an authorization flow/AuthID is
 	// valid. This is the time from Starting to Finishing the authorization. The
 	// optimal time here will be application specific, and should encompass how
@@ -62,6 +86,227 @@ type Config struct {
 	// before it is exchanged for a token (code flow). This should be a short
 	// value, as the exhange should generally not take long
 	CodeValidityTime time.Duration
+	// RequirePKCEForPublicClients will reject authorization requests without a
+	// PKCE code_challenge, for clients that the ClientSource reports as
+	// unauthenticated. Challenges are always verified if passed, regardless
+	// of this setting.
+	//
+	// https://tools.ietf.org/html/rfc7636
+	RequirePKCEForPublicClients bool
+	// RequireHTTPSRedirectURIs rejects plain http redirect URIs, both in
+	// authorization requests and at client registration. http is still
+	// allowed for the loopback interface, for native apps.
+	//
+	// https://tools.ietf.org/html/rfc8252#section-8.3
+	RequireHTTPSRedirectURIs bool
+	// MaxParameterLength is the longest state or nonce an authorization
+	// request can pass, in bytes. They are stored with the session and echoed
+	// back, so this stops them being used to bloat storage. Longer values are
+	// rejected with invalid_request. If not set, there is no limit.
+	MaxParameterLength int
+	// BackchannelLogoutTimeout is the maximum time spent notifying clients
+	// of a logout via the back-channel, including retries. This bounds how
+	// long a slow or unavailable client can delay logout.
+	BackchannelLogoutTimeout time.Duration
+	// DeviceCodeValidityTime is the maximum time a device code is valid for.
+	// This is the time the user has to complete the authorization after the
+	// device requests it.
+	DeviceCodeValidityTime time.Duration
+	// DevicePollInterval is the minimum time a device should wait between
+	// polling the token endpoint.
+	DevicePollInterval time.Duration
+	// TLSClientAuth allows clients to authenticate with a TLS client
+	// certificate instead of a secret. The ClientSource must implement
+	// TLSClientAuthClientSource.
+	//
+	// https://tools.ietf.org/html/rfc8705#section-2
+	TLSClientAuth bool
+	// CertificateBoundAccessTokens binds access tokens to the TLS client
+	// certificate presented when they were issued. The token can then only
+	// be used with the same certificate, and introspection will return the
+	// certificate's thumbprint for resource servers to check.
+	//
+	// https://tools.ietf.org/html/rfc8705#section-3
+	CertificateBoundAccessTokens bool
+	// TLSClientCertHeader is the header a TLS terminating proxy passes the
+	// client certificate in, as URL encoded PEM (e.g X-SSL-Client-Cert). It is
+	// only used if the request was not received over TLS. Only set this if the
+	// proxy verifies the certificate, and always sets or strips this header -
+	// otherwise clients can forge it.
+	TLSClientCertHeader string
+	// PushedRequestValidityTime is the maximum time a pushed authorization
+	// request can be used for, before the user is sent to the authorization
+	// endpoint with it.
+	//
+	// https://tools.ietf.org/html/rfc9126#section-2.2
+	PushedRequestValidityTime time.Duration
+	// RequirePushedAuthorizationRequests rejects authorization requests that
+	// were not pushed to the PushedAuthorization endpoint first.
+	//
+	// https://tools.ietf.org/html/rfc9126#section-5
+	RequirePushedAuthorizationRequests bool
+	// FormPostTemplate is rendered to return the authorization response to
+	// clients that request the form_post or form_post.jwt response modes. It
+	// should render a form that automatically POSTs the parameters to the
+	// client. It is passed the redirect URI as .Action, and the response
+	// parameters as .Params (a url.Values). If not set, a minimal page is
+	// used.
+	//
+	// https://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html
+	FormPostTemplate *template.Template
+	// ClaimsModifier is called to add or change claims in the ID tokens
+	// issued, and the UserInfo responses returned. It is called after the
+	// token or userinfo handler, right before the ID token is signed or the
+	// response is written.
+	ClaimsModifier ClaimsModifier
+	// ClaimMappings rename the claims from each upstream connector to the
+	// claims issued, keyed by the Connector set on the Authorization. The
+	// mapping is applied to the ID token and UserInfo claims before the
+	// ClaimsModifier, so connectors don't each need to normalize them.
+	ClaimMappings map[string]ClaimMapping
+	// AudienceAlwaysArray issues the aud claim of ID tokens as an array, even
+	// when there is a single audience. By default a single audience is a
+	// string, which is what most clients expect.
+	AudienceAlwaysArray bool
+	// ErrorHandler renders the errors shown to the user, rather than
+	// returned to the client. If not set, they are written as plain text.
+	ErrorHandler ErrorHandler
+	// Connectors are the upstream identity providers users can log in with,
+	// for SelectConnector to choose between.
+	Connectors []Connector
+	// ConnectorSelectionTemplate is rendered by SelectConnector when there
+	// is more than one connector, to let the user choose one. It is passed
+	// the requesting client's ID as .ClientID, and the connectors as
+	// .Connectors (a []ConnectorChoice). If not set, a minimal page is used.
+	ConnectorSelectionTemplate *template.Template
+	// LogoutConnector is called by EndSession once the local session is
+	// ended, to end the user's session with the upstream identity provider.
+	LogoutConnector LogoutConnector
+	// GrantStore tracks the scopes users have granted clients, for
+	// incremental authorization. If not set, each authorization is only for
+	// the scopes granted in it.
+	GrantStore GrantStore
+	// RememberConsent lets ConsentRequired report that the user need not be
+	// asked to approve scopes they have already granted the client. It
+	// requires a GrantStore.
+	RememberConsent bool
+	// SubjectGenerator derives the sub given to clients registered for
+	// pairwise subject identifiers, via a SubjectTypeClientSource. If not
+	// set, only public subject identifiers are supported, and every client
+	// gets the subject the user was authorized as.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes
+	SubjectGenerator SubjectGenerator
+	// RegistrationEndpoint is the full URL the RegisterClient handler is
+	// served at. Registered clients are told to manage their configuration at
+	// this URL, followed by /<client_id>.
+	//
+	// https://tools.ietf.org/html/rfc7592#section-2
+	RegistrationEndpoint string
+	// RateLimiter limits how often the authorization, token and device
+	// authorization endpoints can be called. Rejected requests get a HTTP
+	// 429. If not set, requests are not limited.
+	RateLimiter RateLimiter
+	// TrustForwardedFor uses the address the proxy in front of us appended to
+	// the X-Forwarded-For header as the client's IP address for rate limiting.
+	// Only set this if there is a proxy that always sets this header,
+	// otherwise clients can forge it.
+	TrustForwardedFor bool
+	// Metrics observes the requests handled, so they can be exported to a
+	// metrics system.
+	Metrics Metrics
+	// AuditLogger receives events for authorization requests, logins and
+	// tokens issued or revoked, for an audit trail.
+	AuditLogger AuditLogger
+	// AuditTimeout is the maximum time a request waits for the AuditLogger.
+	AuditTimeout time.Duration
+	// RequestLogger receives an entry for each request handled by the
+	// LogRequests middleware, for debugging. Secrets and tokens are redacted.
+	RequestLogger RequestLogger
+	// OperationTimeout limits how long each request handled by the
+	// LimitOperationTime middleware can take. Once it passes, the context
+	// passed to the SessionManager, Signer and other dependencies is
+	// canceled, and the caller gets a 503. If not set, requests are only
+	// limited by the caller disconnecting.
+	OperationTimeout time.Duration
+	// ReplayCache records the jti of client assertions and request objects,
+	// so they can't be used twice. If not set, the SessionManager is used if
+	// it implements ReplayCache, like StorageSessionManager, so they are
+	// shared between instances. Otherwise they are only tracked in this
+	// process, with a MemoryReplayCache.
+	ReplayCache ReplayCache
+	// AccessTokenFormat is the form access tokens are issued in. If not set,
+	// they are opaque. JWT access tokens require the Signer to implement
+	// TypedSigner.
+	AccessTokenFormat AccessTokenFormat
+	// PasswordAuthenticator checks the credentials for the resource owner
+	// password credentials grant. The grant is only enabled if this is set,
+	// and then only for clients allowed it by a PasswordGrantClientSource. As
+	// the grant is discouraged, it should only be used for trusted first party
+	// clients, or testing. "password" should be advertised in the discovery
+	// grant_types_supported when this is set.
+	//
+	// https://tools.ietf.org/html/rfc6749#section-4.3
+	PasswordAuthenticator PasswordAuthenticator
+	// LoginAttemptTracker locks out password grant logins for a username or
+	// IP address after repeated failures, rejecting them with a HTTP 429.
+	// NewLoginLockout provides an in memory implementation. If not set,
+	// failures are not tracked.
+	LoginAttemptTracker LoginAttemptTracker
+	// ContentSecurityPolicy is sent on the responses from the endpoints the
+	// user's browser is sent to, i.e StartAuthorization, FinishAuthorization,
+	// RejectAuthorization and EndSession. Those also send nosniff,
+	// no-referrer and frame denying headers. Pages the caller renders to the
+	// same response get these headers too, so this must allow anything they
+	// load.
+	ContentSecurityPolicy string
+	// BrowserStateCookie is the name of the cookie the CheckSessionIframe
+	// reads the user's browser state from. If not set,
+	// DefaultBrowserStateCookie is used.
+	//
+	// https://openid.net/specs/openid-connect-session-1_0.html
+	BrowserStateCookie string
+	// CORSAllowedOrigins are the origins browser based clients can call the
+	// token, userinfo, introspection and revocation endpoints from. "*"
+	// allows any origin. If not set, cross-origin requests are not allowed.
+	CORSAllowedOrigins []string
+	// CORSEndpointAllowedOrigins overrides CORSAllowedOrigins for individual
+	// endpoints, keyed by one of EndpointToken, EndpointUserinfo,
+	// EndpointIntrospection or EndpointRevocation. An empty list disallows
+	// cross-origin requests to the endpoint.
+	CORSEndpointAllowedOrigins map[Endpoint][]string
+	// CORSMaxAge is how long browsers can cache the response to a CORS
+	// preflight request for. If not set, DefaultCORSMaxAge is used.
+	CORSMaxAge time.Duration
+	// MaxTokenValidity is the longest a TokenLifetimeClientSource can set
+	// any of a client's token lifetimes to. If not set, they are not
+	// limited.
+	MaxTokenValidity time.Duration
+	// HealthCheckTimeout is the maximum time the Readiness handler waits for
+	// its checks.
+	HealthCheckTimeout time.Duration
+	// Now returns the current time, for all expiries and issued at times. If
+	// not set, time.Now is used. It can be set to control the clock, e.g in
+	// tests. It is also passed to the Signer, ReplayCache, RateLimiter and
+	// LoginAttemptTracker if they implement Clocked.
+	Now func() time.Time
+	// OfflineAccessWithoutConsent passes the offline_access scope through to
+	// the AuthorizationRequest even if the client didn't request
+	// prompt=consent. This can be set if consent is obtained another way,
+	// e.g for first party clients. Otherwise the offline_access request is
+	// ignored without it.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#OfflineAccess
+	OfflineAccessWithoutConsent bool
+	// IssuerResolver returns the issuer for each request, for serving
+	// multiple issuers, e.g per tenant hostname. It is used in place of
+	// Issuer for the request, and the issuer the token handler should use is
+	// passed as TokenRequest.Issuer. The resolved issuer must be one of
+	// AllowedIssuers, or the request is rejected.
+	IssuerResolver IssuerResolver
+	// AllowedIssuers are the issuers the IssuerResolver may return. It is
+	// required if IssuerResolver is set.
+	AllowedIssuers []string
 }
 
 // OIDC can be used to handle the various parts of the OIDC auth flow.
@@ -70,9 +315,89 @@ type OIDC struct {
 	clients ClientSource
 	signer  Signer
 
+	issuer        string
+	tokenEndpoint string
+
+	issuerResolver IssuerResolver
+	allowedIssuers []string
+
+	offlineAccessWithoutConsent bool
+
 	authValidityTime time.Duration
 	codeValidityTime time.Duration
 
+	requirePKCEForPublicClients bool
+	requireHTTPSRedirectURIs    bool
+
+	maxParameterLength int
+
+	backchannelLogoutTimeout time.Duration
+
+	deviceCodeValidityTime time.Duration
+	devicePollInterval     time.Duration
+
+	tlsClientAuth                bool
+	certificateBoundAccessTokens bool
+	tlsClientCertHeader          string
+
+	pushedRequestValidityTime          time.Duration
+	requirePushedAuthorizationRequests bool
+
+	formPostTemplate *template.Template
+
+	claimsModifier ClaimsModifier
+	claimMappings  map[string]ClaimMapping
+
+	audienceAlwaysArray bool
+
+	errorHandler ErrorHandler
+
+	connectors                 []Connector
+	connectorSelectionTemplate *template.Template
+
+	logoutConnector LogoutConnector
+
+	grantStore      GrantStore
+	rememberConsent bool
+
+	subjectGenerator SubjectGenerator
+
+	registrationEndpoint string
+
+	rateLimiter       RateLimiter
+	trustForwardedFor bool
+
+	metrics Metrics
+
+	auditLogger  AuditLogger
+	auditTimeout time.Duration
+
+	requestLogger RequestLogger
+
+	operationTimeout time.Duration
+
+	replayCache ReplayCache
+
+	accessTokenFormat AccessTokenFormat
+
+	passwordAuthenticator PasswordAuthenticator
+	loginAttemptTracker   LoginAttemptTracker
+
+	contentSecurityPolicy string
+	browserStateCookie    string
+
+	corsAllowedOrigins         []string
+	corsEndpointAllowedOrigins map[Endpoint][]string
+	corsMaxAge                 time.Duration
+
+	maxTokenValidity time.Duration
+
+	healthCheckTimeout time.Duration
+
+	codeRedemptions localCodeRedemptions
+
+	background background
+
 	now func() time.Time
 }
 
@@ -82,9 +407,85 @@ func New(cfg *Config, smgr SessionManager, clientSource ClientSource, signer Sig
 		clients: clientSource,
 		signer:  signer,
 
+		issuer:        cfg.Issuer,
+		tokenEndpoint: cfg.TokenEndpoint,
+
+		issuerResolver: cfg.IssuerResolver,
+		allowedIssuers: cfg.AllowedIssuers,
+
+		offlineAccessWithoutConsent: cfg.OfflineAccessWithoutConsent,
+
 		authValidityTime: cfg.AuthValidityTime,
 		codeValidityTime: cfg.CodeValidityTime,
 
+		requirePKCEForPublicClients: cfg.RequirePKCEForPublicClients,
+		requireHTTPSRedirectURIs:    cfg.RequireHTTPSRedirectURIs,
+
+		maxParameterLength: cfg.MaxParameterLength,
+
+		backchannelLogoutTimeout: cfg.BackchannelLogoutTimeout,
+
+		deviceCodeValidityTime: cfg.DeviceCodeValidityTime,
+		devicePollInterval:     cfg.DevicePollInterval,
+
+		tlsClientAuth:                cfg.TLSClientAuth,
+		certificateBoundAccessTokens: cfg.CertificateBoundAccessTokens,
+		tlsClientCertHeader:          cfg.TLSClientCertHeader,
+
+		pushedRequestValidityTime:          cfg.PushedRequestValidityTime,
+		requirePushedAuthorizationRequests: cfg.RequirePushedAuthorizationRequests,
+
+		formPostTemplate: cfg.FormPostTemplate,
+
+		claimsModifier: cfg.ClaimsModifier,
+		claimMappings:  cfg.ClaimMappings,
+
+		audienceAlwaysArray: cfg.AudienceAlwaysArray,
+
+		errorHandler: cfg.ErrorHandler,
+
+		connectors:                 cfg.Connectors,
+		connectorSelectionTemplate: cfg.ConnectorSelectionTemplate,
+
+		logoutConnector: cfg.LogoutConnector,
+
+		grantStore:      cfg.GrantStore,
+		rememberConsent: cfg.RememberConsent,
+
+		subjectGenerator: cfg.SubjectGenerator,
+
+		registrationEndpoint: cfg.RegistrationEndpoint,
+
+		rateLimiter:       cfg.RateLimiter,
+		trustForwardedFor: cfg.TrustForwardedFor,
+
+		metrics: cfg.Metrics,
+
+		auditLogger:  cfg.AuditLogger,
+		auditTimeout: cfg.AuditTimeout,
+
+		requestLogger: cfg.RequestLogger,
+
+		operationTimeout: cfg.OperationTimeout,
+
+		replayCache: cfg.ReplayCache,
+
+		accessTokenFormat: cfg.AccessTokenFormat,
+
+		passwordAuthenticator: cfg.PasswordAuthenticator,
+		loginAttemptTracker:   cfg.LoginAttemptTracker,
+
+		contentSecurityPolicy: cfg.ContentSecurityPolicy,
+		browserStateCookie:    cfg.BrowserStateCookie,
+
+		corsAllowedOrigins:         cfg.CORSAllowedOrigins,
+		corsEndpointAllowedOrigins: cfg.CORSEndpointAllowedOrigins,
+		corsMaxAge:                 cfg.CORSMaxAge,
+
+		maxTokenValidity: cfg.MaxTokenValidity,
+
+		healthCheckTimeout: cfg.HealthCheckTimeout,
+
 		now: time.Now,
 	}
 
@@ -94,6 +495,67 @@ func New(cfg *Config, smgr SessionManager, clientSource ClientSource, signer Sig
 	if o.codeValidityTime == time.Duration(0) {
 		o.codeValidityTime = DefaultCodeValidityTime
 	}
+	if o.backchannelLogoutTimeout == time.Duration(0) {
+		o.backchannelLogoutTimeout = DefaultBackchannelLogoutTimeout
+	}
+	if o.deviceCodeValidityTime == time.Duration(0) {
+		o.deviceCodeValidityTime = DefaultDeviceCodeValidityTime
+	}
+	if o.devicePollInterval == time.Duration(0) {
+		o.devicePollInterval = DefaultDevicePollInterval
+	}
+	if o.pushedRequestValidityTime == time.Duration(0) {
+		o.pushedRequestValidityTime = DefaultPushedRequestValidityTime
+	}
+	if o.auditTimeout == time.Duration(0) {
+		o.auditTimeout = DefaultAuditTimeout
+	}
+	if o.healthCheckTimeout == time.Duration(0) {
+		o.healthCheckTimeout = DefaultHealthCheckTimeout
+	}
+	if o.contentSecurityPolicy == "" {
+		o.contentSecurityPolicy = DefaultContentSecurityPolicy
+	}
+	if o.browserStateCookie == "" {
+		o.browserStateCookie = DefaultBrowserStateCookie
+	}
+	if o.corsMaxAge == 0 {
+		o.corsMaxAge = DefaultCORSMaxAge
+	}
+	if o.replayCache == nil {
+		if rc, ok := smgr.(ReplayCache); ok {
+			o.replayCache = rc
+		} else {
+			o.replayCache = NewMemoryReplayCache()
+		}
+	}
+	if cfg.Now != nil {
+		o.now = cfg.Now
+		o.shareClock(cfg.Now)
+	}
+	if o.rememberConsent && o.grantStore == nil {
+		return nil, fmt.Errorf("GrantStore must be set to use RememberConsent")
+	}
+	if err := validateClaimMappings(o.claimMappings); err != nil {
+		return nil, err
+	}
+	if err := validateConnectors(o.connectors); err != nil {
+		return nil, err
+	}
+	if o.issuerResolver != nil && len(o.allowedIssuers) == 0 {
+		return nil, fmt.Errorf("AllowedIssuers must be set to use an IssuerResolver")
+	}
+	switch o.accessTokenFormat {
+	case "":
+		o.accessTokenFormat = AccessTokenFormatOpaque
+	case AccessTokenFormatOpaque:
+	case AccessTokenFormatJWT:
+		if _, ok := o.signer.(TypedSigner); !ok {
+			return nil, fmt.Errorf("Signer must implement TypedSigner to issue JWT access tokens")
+		}
+	default:
+		return nil, fmt.Errorf("unknown AccessTokenFormat %q", o.accessTokenFormat)
+	}
 
 	return o, nil
 }
@@ -113,6 +575,62 @@ type AuthorizationRequest struct {
 	Scopes []string
 	// ClientID that started this request
 	ClientID string
+	// Claims the client individually requested, if any.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#ClaimsParameter
+	Claims *ClaimsRequest
+	// Prompt is how the client asked the user to be prompted, if it did. If
+	// it contains PromptNone no UI may be shown - if the user can't be
+	// authorized without it, the request should be rejected with
+	// RejectAuthorization. PromptLogin and PromptConsent ask for the user to
+	// be re-authenticated and asked for consent respectively, even if they
+	// have previously.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	Prompt []Prompt
+	// MaxAge is set if the client passed max_age. If the user authenticated
+	// longer ago than this, they must be re-authenticated. The time they
+	// authenticated should be passed to FinishAuthorization as
+	// Authorization.AuthTime.
+	MaxAge *time.Duration
+	// Resources the client requested access to, if it passed resource
+	// indicators. They have been checked as allowed for the client.
+	//
+	// https://tools.ietf.org/html/rfc8707
+	Resources []string
+	// LoginHint is the identifier the client passed as login_hint, if it did.
+	// It can be used to prefill the login form, or passed on to an upstream
+	// identity provider. It is not verified, so must not be trusted as the
+	// user's identity.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	LoginHint string
+	// UILocales are the languages the client would prefer the UI in, most
+	// preferred first, if it passed ui_locales. They are BCP47 tags, but are
+	// not validated.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	UILocales []string
+	// Display is how the client would like the UI displayed. It is
+	// DisplayPage if the client didn't pass display, or passed an unknown
+	// value.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	Display Display
+	// IDTokenHint contains the claims of the ID token the client passed as
+	// id_token_hint, if it did. The signature has been verified, but the
+	// token may be expired. It identifies the user the client expects to be
+	// logged in, e.g for prompt=none. If the user authenticated is someone
+	// else, FinishAuthorization returns login_required to the client.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	IDTokenHint *oidc.Claims
+	// IncludeGrantedScopes is set if the client passed
+	// include_granted_scopes=true, asking for the scopes the user previously
+	// granted it to be included in this authorization. It requires a
+	// GrantStore, and the Subject to be set on the Authorization. NewScopes
+	// returns the scopes the user still needs to be asked for.
+	IncludeGrantedScopes bool
 }
 
 // StartAuthorization can be used to handle a request to the auth endpoint. It
@@ -125,12 +643,31 @@ type AuthorizationRequest struct {
 //
 // https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
 // https://openid.net/specs/openid-connect-core-1_0.html#ImplicitFlowAuth
-func (o *OIDC) StartAuthorization(w http.ResponseWriter, req *http.Request) (*AuthorizationRequest, error) {
-	authreq, err := parseAuthRequest(req)
+func (o *OIDC) StartAuthorization(w http.ResponseWriter, req *http.Request) (_ *AuthorizationRequest, err error) {
+	req = o.withErrorHandler(req)
+
+	var responseType string
+	defer func() { o.observeAuthorization(responseType, err) }()
+
+	o.setSecurityHeaders(w)
+
+	if req, err = o.withIssuer(req); err != nil {
+		_ = writeError(w, req, err)
+		return nil, err
+	}
+
+	if err := o.checkIPRateLimit(req); err != nil {
+		_ = writeError(w, req, err)
+		return nil, err
+	}
+
+	authreq, err := o.parseAuthorization(req)
 	if err != nil {
+		err = o.redirectableAuthError(req.Form.Get("client_id"), err)
 		_ = writeError(w, req, err)
 		return nil, fmt.Errorf("failed to parse auth endpoint request: %w", err)
 	}
+	responseType = string(authreq.ResponseType)
 
 	redir, err := url.Parse(authreq.RedirectURI)
 	if err != nil {
@@ -154,22 +691,151 @@ func (o *OIDC) StartAuthorization(w http.ResponseWriter, req *http.Request) (*Au
 	if err != nil {
 		return nil, writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "error calling clientsource redirect URI validation")
 	}
-	if !redirok {
+	if !redirok || !o.redirectURISchemeAllowed(authreq.RedirectURI) {
 		return nil, writeHTTPError(w, req, http.StatusBadRequest, "Invalid redirect URI", nil, "")
 	}
 
+	// errors are returned the same way a successful response would be. They
+	// can't be signed before we know who we are, so JWT modes fall back to
+	// the query.
+	errMode := responseModeFor(authreq.ResponseMode, authreq.ResponseType.returnsTokens())
+
+	if o.maxParameterLength > 0 {
+		// an over long state isn't echoed, that's what we're avoiding.
+		if len(authreq.State) > o.maxParameterLength {
+			return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, "", "state is too long", nil)
+		}
+		if len(authreq.Raw.Get("nonce")) > o.maxParameterLength {
+			return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, authreq.State, "nonce is too long", nil)
+		}
+	}
+
+	if o.requirePKCEForPublicClients && authreq.CodeChallenge == "" && authreq.ResponseType != responseTypeNone {
+		public, err := o.clients.IsUnauthenticatedClient(authreq.ClientID)
+		if err != nil {
+			return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "internal error", err)
+		}
+		if public {
+			return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, authreq.State, "code_challenge is required for public clients", nil)
+		}
+	}
+
+	// we can only sign responses if we know who we are.
+	if authreq.ResponseMode.isJWT() && o.issuerFrom(req.Context()) == "" {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, authreq.State, "response_mode is not supported", nil)
+	}
+
+	// offline access must be consented to.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#OfflineAccess
+	if !o.offlineAccessWithoutConsent && !promptsContain(authreq.Prompt, PromptConsent) {
+		authreq.Scopes = strsWithout(authreq.Scopes, "offline_access")
+	}
+
+	var idTokenHint *oidc.Claims
+	if hint := authreq.Raw.Get("id_token_hint"); hint != "" {
+		idTokenHint, err = o.verifyIDTokenHint(req.Context(), hint)
+		if err != nil {
+			return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, authreq.State, "invalid id_token_hint", err)
+		}
+	}
+
 	ar := &sessAuthRequest{
-		RedirectURI: redir.String(),
-		State:       authreq.State,
-		Scopes:      authreq.Scopes,
-		Nonce:       authreq.Raw.Get("nonce"),
+		RedirectURI:         redir.String(),
+		State:               authreq.State,
+		Scopes:              authreq.Scopes,
+		Nonce:               authreq.Raw.Get("nonce"),
+		ResponseMode:        authreq.ResponseMode,
+		CodeChallenge:       authreq.CodeChallenge,
+		CodeChallengeMethod: authreq.CodeChallengeMethod,
+		Claims:              authreq.Claims,
+		MaxAge:              authreq.MaxAge,
+		Resources:           authreq.Resources,
+
+		IncludeGrantedScopes: authreq.Raw.Get("include_granted_scopes") == "true",
+	}
+	if authreq.Raw.Get("acr_values") != "" {
+		ar.ACRValues = strings.Split(authreq.Raw.Get("acr_values"), " ")
+	}
+	if idTokenHint != nil {
+		ar.IDTokenHintSubject = idTokenHint.Subject
+	}
+
+	rtok, err := o.clientResponseTypeAllowed(authreq.ClientID, authreq.ResponseType)
+	if err != nil {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "internal error", err)
+	}
+	if !rtok {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeUnauthorizedClient, authreq.State, "client can not use this response type", nil)
+	}
+
+	// tokens must not be returned in the query, where they can leak via logs
+	// and the referrer. Without a response mode, they default to the
+	// fragment.
+	//
+	// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#Combinations
+	if authreq.ResponseType.returnsTokens() && (ar.ResponseMode == responseModeQuery || ar.ResponseMode == responseModeQueryJWT) {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, authreq.State, "query response mode can not be used with this response type", nil)
 	}
 
 	switch authreq.ResponseType {
 	case responseTypeCode:
 		ar.ResponseType = authRequestResponseTypeCode
+	case responseTypeCodeIDToken:
+		ar.ResponseType = authRequestResponseTypeCodeIDToken
+	case responseTypeCodeToken:
+		ar.ResponseType = authRequestResponseTypeCodeToken
+	case responseTypeCodeIDTokenToken:
+		ar.ResponseType = authRequestResponseTypeCodeIDTokenToken
+	case responseTypeNone:
+		ar.ResponseType = authRequestResponseTypeNone
 	default:
-		return nil, writeAuthError(w, req, redir, authErrorCodeUnsupportedResponseType, authreq.State, "response type must be code", nil)
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeUnsupportedResponseType, authreq.State, "response type must be code, none, or code combined with id_token and/or token", nil)
+	}
+
+	// https://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+	if ar.ResponseType.includesIDToken() && ar.Nonce == "" {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidRequest, authreq.State, "nonce is required for this response type", nil)
+	}
+
+	// tokens returned directly from here are covered by the implicit grant.
+	//
+	// https://tools.ietf.org/html/rfc7591#section-2.1
+	// none issues nothing, so needs no grant.
+	var grantTypes []GrantType
+	if ar.ResponseType != authRequestResponseTypeNone {
+		grantTypes = append(grantTypes, GrantTypeAuthorizationCode)
+	}
+	if ar.ResponseType.hybrid() {
+		grantTypes = append(grantTypes, GrantTypeImplicit)
+	}
+	gtok, err := o.clientGrantTypesAllowed(authreq.ClientID, grantTypes...)
+	if err != nil {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "internal error", err)
+	}
+	if !gtok {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeUnauthorizedClient, authreq.State, "client can not use this response type", nil)
+	}
+	scok, err := o.clientScopesAllowed(authreq.ClientID, authreq.Scopes)
+	if err != nil {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "internal error", err)
+	}
+	if !scok {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidScope, authreq.State, "client can not request these scopes", nil)
+	}
+	resok, err := o.clientResourcesAllowed(authreq.ClientID, authreq.Resources)
+	if err != nil {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "internal error", err)
+	}
+	if !resok {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeInvalidTarget, authreq.State, "client can not request tokens for this resource", nil)
+	}
+	algok, err := o.clientIDTokenAlgSupported(req.Context(), authreq.ClientID)
+	if err != nil {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "internal error", err)
+	}
+	if !algok {
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeUnauthorizedClient, authreq.State, "client id_token_signed_response_alg is not supported", nil)
 	}
 
 	sess := &sessionV2{
@@ -181,17 +847,33 @@ func (o *OIDC) StartAuthorization(w http.ResponseWriter, req *http.Request) (*Au
 	}
 
 	if err := putSession(req.Context(), o.smgr, sess); err != nil {
-		return nil, writeAuthError(w, req, redir, authErrorCodeErrServerError, authreq.State, "failed to persist session", err)
+		return nil, writeAuthError(w, req, redir, errMode, authErrorCodeErrServerError, authreq.State, "failed to persist session", err)
 	}
 
 	areq := &AuthorizationRequest{
 		SessionID: sess.ID,
 		Scopes:    authreq.Scopes,
 		ClientID:  authreq.ClientID,
+		ACRValues: ar.ACRValues,
+		Claims:    authreq.Claims,
+		Prompt:    authreq.Prompt,
+		MaxAge:    authreq.MaxAge,
+		Resources: authreq.Resources,
+		LoginHint: authreq.Raw.Get("login_hint"),
+		UILocales: strings.Fields(authreq.Raw.Get("ui_locales")),
+		Display:   parseDisplay(authreq.Raw.Get("display")),
+
+		IDTokenHint: idTokenHint,
+
+		IncludeGrantedScopes: ar.IncludeGrantedScopes,
 	}
-	if authreq.Raw.Get("acr_values") != "" {
-		areq.ACRValues = strings.Split(authreq.Raw.Get("acr_values"), " ")
-	}
+
+	o.audit(req.Context(), AuditEvent{
+		Type:     AuditEventAuthRequest,
+		ClientID: authreq.ClientID,
+		Scopes:   authreq.Scopes,
+	})
+
 	return areq, nil
 }
 
@@ -199,12 +881,48 @@ func (o *OIDC) StartAuthorization(w http.ResponseWriter, req *http.Request) (*Au
 type Authorization struct {
 	// Scopes are the list of scopes this session was granted
 	Scopes []string
+	// Subject is the user that was authorized. It is needed to record the
+	// scopes the user granted the client if a GrantStore is configured, for
+	// the session to be revoked by RevokeAllForSubject, and to check it
+	// against the IDTokenHint.
+	Subject string
 	// ACR is the Authentication Context Class Reference the session was
 	// authenticated with
 	ACR string
 	// AMR are the Authentication Methods Reference the session was
-	// authenticated with
+	// authenticated with, e.g AMRHardwareKey for a passkey
 	AMR []string
+	// SID identifies the user's session with the provider, that this
+	// authorization was made under. This is used for logout. It should be
+	// consistent across all authorizations made in the same session.
+	//
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html#BCRequest
+	SID string
+	// Connector identifies the upstream identity provider that authenticated
+	// the user, e.g "ldap" or "google". It selects the ClaimMapping applied to
+	// the claims issued for the session.
+	Connector string
+	// AuthTime is when the user actually authenticated, which may be before
+	// this authorization if they have an existing session with the
+	// provider. If not set, the time of the authorization is used. This is
+	// returned in the auth_time claim.
+	AuthTime time.Time
+	// BrowserState is the user's browser state for OIDC Session Management.
+	// If set, the client is returned a session_state it can check against
+	// the CheckSessionIframe. It should change when the user logs in or out,
+	// and the caller must set it in the BrowserStateCookie too.
+	//
+	// https://openid.net/specs/openid-connect-session-1_0.html#CreatingUpdatingSessions
+	BrowserState string
+	// TokenHandler is called to build the tokens returned directly from the
+	// authorization endpoint, for requests with a hybrid response type (e.g
+	// "code id_token"). It is passed the same information as the Token
+	// handler, and the IDToken and AccessTokenValidUntil it returns are used.
+	// Refresh tokens are only issued from the token endpoint. Hybrid requests
+	// will fail if this is not set.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#HybridFlowAuth
+	TokenHandler func(req *TokenRequest) (*TokenResponse, error)
 }
 
 // FinishAuthorization should be called once the consumer has validated the
@@ -219,8 +937,29 @@ type Authorization struct {
 // issue/refresh. This is application-specific, and should be used to track
 // information needed to serve those endpoints.
 //
+// For hybrid flow requests, auth.TokenHandler must be set to build the tokens
+// returned with the code.
+//
+// auth.ACR and auth.AMR should reflect how the user actually authenticated,
+// and are returned in the acr and amr claims. If the client requested acr as
+// an essential claim with specific values, and auth.ACR is not one of them,
+// the client is returned an unmet_authentication_requirements error.
+//
+// For device authorizations started via VerifyUserCode, no response is
+// written on success. The caller should let the user know they can return to
+// their device.
+//
 // https://openid.net/specs/openid-connect-core-1_0.html#IDToken
 func (o *OIDC) FinishAuthorization(w http.ResponseWriter, req *http.Request, sessionID string, auth *Authorization) error {
+	req = o.withErrorHandler(req)
+
+	o.setSecurityHeaders(w)
+
+	req, err := o.withIssuer(req)
+	if err != nil {
+		return writeError(w, req, err)
+	}
+
 	sess, err := getSession(req.Context(), o.smgr, sessionID)
 	if err != nil {
 		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to get session")
@@ -229,6 +968,22 @@ func (o *OIDC) FinishAuthorization(w http.ResponseWriter, req *http.Request, ses
 		return writeHTTPError(w, req, http.StatusForbidden, "Access Denied", err, "session not found in storage")
 	}
 
+	// the request may still be stored after it's expired, if the
+	// SessionManager hasn't cleaned it up yet. A login that took that long
+	// can't be trusted, so make the client start again.
+	if o.now().After(sess.Expiry) {
+		if err := o.smgr.DeleteSession(req.Context(), sess.ID); err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to delete session")
+		}
+		o.audit(req.Context(), AuditEvent{
+			Type:     AuditEventLoginFailure,
+			ClientID: sess.ClientID,
+			Scopes:   auth.Scopes,
+			Reason:   string(authErrorCodeLoginRequired),
+		})
+		return o.writeSessionAuthError(w, req, sess, authErrorCodeLoginRequired, "authorization request has expired", nil)
+	}
+
 	var openidScope bool
 	for _, s := range auth.Scopes {
 		if s == "openid" {
@@ -240,38 +995,189 @@ func (o *OIDC) FinishAuthorization(w http.ResponseWriter, req *http.Request, ses
 
 	}
 
+	authTime := auth.AuthTime
+	if authTime.IsZero() {
+		authTime = o.now()
+	}
+
+	// if the user authenticated too long ago they should have been asked to
+	// again. Fail closed, so the client can retry.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	if sess.Request.MaxAge != nil && o.now().Sub(authTime) > *sess.Request.MaxAge {
+		if err := o.smgr.DeleteSession(req.Context(), sess.ID); err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to delete session")
+		}
+		o.audit(req.Context(), AuditEvent{
+			Type:     AuditEventLoginFailure,
+			ClientID: sess.ClientID,
+			Scopes:   auth.Scopes,
+			Reason:   string(authErrorCodeLoginRequired),
+		})
+		return o.writeSessionAuthError(w, req, sess, authErrorCodeLoginRequired, "authentication is older than max_age", nil)
+	}
+
+	// the client expected a particular user, if it's someone else they need
+	// to log in as that user. The hint has the sub the client was given,
+	// which may be pairwise.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	authSub, err := o.clientSubject(sess.ClientID, auth.Subject)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to get client subject")
+	}
+	if sess.Request.IDTokenHintSubject != "" && authSub != "" && authSub != sess.Request.IDTokenHintSubject {
+		if err := o.smgr.DeleteSession(req.Context(), sess.ID); err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to delete session")
+		}
+		o.audit(req.Context(), AuditEvent{
+			Type:     AuditEventLoginFailure,
+			ClientID: sess.ClientID,
+			Scopes:   auth.Scopes,
+			Reason:   string(authErrorCodeLoginRequired),
+		})
+		return o.writeSessionAuthError(w, req, sess, authErrorCodeLoginRequired, "user does not match id_token_hint", nil)
+	}
+
+	// an essential acr must be met, rather than omitted like other claims.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#acrSemantics
+	if !sess.Request.Claims.acrSatisfied(auth.ACR) {
+		if err := o.smgr.DeleteSession(req.Context(), sess.ID); err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to delete session")
+		}
+		o.audit(req.Context(), AuditEvent{
+			Type:     AuditEventLoginFailure,
+			ClientID: sess.ClientID,
+			Scopes:   auth.Scopes,
+			AMR:      auth.AMR,
+			Reason:   string(authErrorCodeUnmetAuthenticationRequirements),
+		})
+		return o.writeSessionAuthError(w, req, sess, authErrorCodeUnmetAuthenticationRequirements, "essential acr was not met", nil)
+	}
+
+	scopes, err := o.grantScopes(req.Context(), sess, auth)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to grant scopes")
+	}
+
 	sess.Authorization = &sessAuthorization{
-		Scopes:       auth.Scopes,
+		Scopes:       scopes,
 		ACR:          auth.ACR,
 		AMR:          auth.AMR,
-		AuthorizedAt: o.now(),
+		SID:          auth.SID,
+		Connector:    auth.Connector,
+		Subject:      auth.Subject,
+		AuthorizedAt: authTime,
+	}
+
+	o.audit(req.Context(), AuditEvent{
+		Type:     AuditEventLoginSuccess,
+		ClientID: sess.ClientID,
+		Scopes:   auth.Scopes,
+		AMR:      auth.AMR,
+	})
+
+	var sessState string
+	if auth.BrowserState != "" {
+		sessState, err = sessionState(sess.ClientID, sess.Request.RedirectURI, auth.BrowserState)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to calculate session state")
+		}
 	}
 
 	switch sess.Request.ResponseType {
 	case authRequestResponseTypeCode:
-		return o.finishCodeAuthorization(w, req, sess)
+		return o.finishCodeAuthorization(w, req, sess, sessState)
+	case authRequestResponseTypeCodeIDToken, authRequestResponseTypeCodeToken, authRequestResponseTypeCodeIDTokenToken:
+		return o.finishHybridAuthorization(w, req, sess, sessState, auth.TokenHandler)
+	case authRequestResponseTypeNone:
+		return o.finishNoneAuthorization(w, req, sess, sessState)
+	case authRequestResponseTypeDevice:
+		return o.finishDeviceAuthorization(w, req, sess)
 	default:
 		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", nil, fmt.Sprintf("unknown ResponseType %s", sess.Request.ResponseType))
 	}
 }
 
-func (o *OIDC) finishCodeAuthorization(w http.ResponseWriter, req *http.Request, session *sessionV2) error {
-	codeExp := o.now().Add(o.codeValidityTime)
+// AuthorizationErrorCode is returned to the client when an authorization is
+// rejected with RejectAuthorization.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthError
+type AuthorizationErrorCode string
 
-	ucode, scode, err := newToken(session.ID, codeExp)
+const (
+	// AuthorizationErrorAccessDenied indicates the user or provider denied
+	// the request.
+	AuthorizationErrorAccessDenied = AuthorizationErrorCode(authErrorCodeAccessDenied)
+	// AuthorizationErrorLoginRequired indicates the user needs to
+	// authenticate, but prompt=none was requested.
+	AuthorizationErrorLoginRequired = AuthorizationErrorCode(authErrorCodeLoginRequired)
+	// AuthorizationErrorConsentRequired indicates the user needs to consent
+	// to the request, but prompt=none was requested.
+	AuthorizationErrorConsentRequired = AuthorizationErrorCode(authErrorCodeConsentRequired)
+	// AuthorizationErrorInteractionRequired indicates some other interaction
+	// with the user is needed, but prompt=none was requested.
+	AuthorizationErrorInteractionRequired = AuthorizationErrorCode(authErrorCodeInteractionRequired)
+	// AuthorizationErrorAccountSelectionRequired indicates the user needs to
+	// select which account to use, but prompt=none was requested.
+	AuthorizationErrorAccountSelectionRequired = AuthorizationErrorCode(authErrorCodeAccountSelectionRequired)
+	// AuthorizationErrorTemporarilyUnavailable indicates the provider, or
+	// an upstream it depends on, can not currently handle the request.
+	AuthorizationErrorTemporarilyUnavailable = AuthorizationErrorCode(authErrorCodeErrTemporarilyUnvailable)
+	// AuthorizationErrorServerError indicates the provider encountered an
+	// unexpected condition.
+	AuthorizationErrorServerError = AuthorizationErrorCode(authErrorCodeErrServerError)
+	// AuthorizationErrorUnmetAuthenticationRequirements indicates the user
+	// could not be authenticated in a way that meets the requested ACR
+	// values.
+	//
+	// https://openid.net/specs/openid-connect-unmet-authentication-requirements-1_0.html
+	AuthorizationErrorUnmetAuthenticationRequirements = AuthorizationErrorCode(authErrorCodeUnmetAuthenticationRequirements)
+)
+
+// RejectAuthorization can be called instead of FinishAuthorization, if the
+// user can not be authorized. The user is redirected back to the client with
+// the error code and description, and the session removed. For requests with
+// prompt=none, this should be used to return one of the *Required errors
+// rather than showing the user any UI.
+func (o *OIDC) RejectAuthorization(w http.ResponseWriter, req *http.Request, sessionID string, code AuthorizationErrorCode, description string) error {
+	req = o.withErrorHandler(req)
+
+	o.setSecurityHeaders(w)
+
+	sess, err := getSession(req.Context(), o.smgr, sessionID)
 	if err != nil {
-		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to generate code token")
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to get session")
+	}
+	if sess == nil || sess.Request == nil || sess.Request.ResponseType == authRequestResponseTypeDevice {
+		return writeHTTPError(w, req, http.StatusForbidden, "Access Denied", nil, "session not found in storage")
 	}
 
-	code, err := marshalToken(ucode)
-	if err != nil {
-		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to marshal code token")
+	if err := o.smgr.DeleteSession(req.Context(), sess.ID); err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to delete session")
 	}
 
-	session.AuthCode = scode
-	session.Stage = sessionStageCode
-	// switch expiry to the max lifetime of the code
-	session.Expiry = codeExp
+	o.audit(req.Context(), AuditEvent{
+		Type:     AuditEventLoginFailure,
+		ClientID: sess.ClientID,
+		Scopes:   sess.Request.Scopes,
+		Reason:   string(code),
+	})
+
+	if err := o.writeSessionAuthError(w, req, sess, authErrorCode(code), description, nil); err != nil {
+		if _, ok := err.(*authError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OIDC) finishCodeAuthorization(w http.ResponseWriter, req *http.Request, session *sessionV2, sessState string) error {
+	code, err := o.issueAuthCode(session)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to issue code")
+	}
 
 	if err := putSession(req.Context(), o.smgr, session); err != nil {
 		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to put authReq to storage")
@@ -283,9 +1189,25 @@ func (o *OIDC) finishCodeAuthorization(w http.ResponseWriter, req *http.Request,
 	}
 
 	codeResp := &codeAuthResponse{
-		RedirectURI: redir,
-		State:       session.Request.State,
-		Code:        code,
+		RedirectURI:      redir,
+		State:            session.Request.State,
+		Code:             code,
+		SessionState:     sessState,
+		ResponseMode:     session.Request.ResponseMode,
+		FormPostTemplate: o.formPostTemplate,
+	}
+	if codeResp.ResponseMode.isJWT() {
+		params := map[string]interface{}{"code": code}
+		if codeResp.State != "" {
+			params["state"] = codeResp.State
+		}
+		if sessState != "" {
+			params["session_state"] = sessState
+		}
+		codeResp.Response, err = o.signAuthResponse(req.Context(), session.ClientID, params)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to sign authorization response")
+		}
 	}
 
 	sendCodeAuthResponse(w, req, codeResp)
@@ -293,6 +1215,70 @@ func (o *OIDC) finishCodeAuthorization(w http.ResponseWriter, req *http.Request,
 	return nil
 }
 
+// finishNoneAuthorization redirects back to the client with only the state, as
+// nothing is issued. The session is no longer needed, so is removed.
+//
+// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#none
+func (o *OIDC) finishNoneAuthorization(w http.ResponseWriter, req *http.Request, session *sessionV2, sessState string) error {
+	if err := o.smgr.DeleteSession(req.Context(), session.ID); err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to delete session")
+	}
+
+	redir, err := url.Parse(session.Request.RedirectURI)
+	if err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to parse authreq's URI")
+	}
+
+	mode := responseModeFor(session.Request.ResponseMode, false)
+
+	params := url.Values{}
+	if session.Request.State != "" {
+		params.Set("state", session.Request.State)
+	}
+	if sessState != "" {
+		params.Set("session_state", sessState)
+	}
+	if mode.isJWT() {
+		claims := map[string]interface{}{}
+		for k := range params {
+			claims[k] = params.Get(k)
+		}
+		signed, err := o.signAuthResponse(req.Context(), session.ClientID, claims)
+		if err != nil {
+			return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to sign authorization response")
+		}
+		params = url.Values{"response": {signed}}
+	}
+
+	sendAuthResponse(w, req, redir, mode, params, o.formPostTemplate)
+
+	return nil
+}
+
+// issueAuthCode generates a new authorization code for the session, and moves
+// the session to the code stage. The caller is responsible for persisting the
+// session.
+func (o *OIDC) issueAuthCode(session *sessionV2) (string, error) {
+	codeExp := o.now().Add(o.codeValidityTime)
+
+	ucode, scode, err := newToken(session.ID, codeExp)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code token: %w", err)
+	}
+
+	code, err := marshalToken(ucode)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal code token: %w", err)
+	}
+
+	session.AuthCode = scode
+	session.Stage = sessionStageCode
+	// switch expiry to the max lifetime of the code
+	session.Expiry = codeExp
+
+	return code, nil
+}
+
 // TokenRequest encapsulates the information from the request to the token
 // endpoint. This is passed to the handler, to generate an appropriate response.
 type TokenRequest struct {
@@ -300,6 +1286,9 @@ type TokenRequest struct {
 	SessionID string
 	// ClientID of the client this session is bound to.
 	ClientID string
+	// Issuer tokens should be issued as. This is the configured Issuer, or
+	// the one the IssuerResolver returned for this request.
+	Issuer string
 	// Authorization information this session was authorized with
 	Authorization Authorization
 	// GrantType indicates the grant that was requested for this invocation of
@@ -311,10 +1300,26 @@ type TokenRequest struct {
 	// IsRefresh is true if the token endpoint was called with the refresh token
 	// grant (i.e called with a refresh, rather than access token)
 	IsRefresh bool
-	// Nonce from the authentication request, if specified
+	// Nonce from the authentication request, if specified. This is not set
+	// for refresh requests.
 	Nonce string
 	// AuthTime Time when the End-User authentication occurred
 	AuthTime time.Time
+	// Claims the client individually requested in the authorization
+	// request, if any. Those requested for the ID token should be included
+	// in it if available.
+	Claims *ClaimsRequest
+	// TokenExchange is set for the token exchange grant. There is no session
+	// for these requests, only the ClientID and GrantType are set. Only
+	// AccessTokenValidUntil is used from the response, to set the expiry of
+	// the issued token.
+	TokenExchange *TokenExchange
+	// Resources the access token is issued for, if the client requested
+	// specific resources. These are the token's audience, and are added to
+	// the ID token's audience by PrefillIDToken.
+	//
+	// https://tools.ietf.org/html/rfc8707
+	Resources []string
 
 	authReq *sessAuthRequest
 	now     func() time.Time
@@ -326,31 +1331,52 @@ type TokenRequest struct {
 // appropriate time base on the validity period
 //
 // Aside from the explicitly passed fields, the following information will be set:
-// * Audience (aud) will contain the Client ID
+// * Audience (aud) will contain the Client ID, followed by any Resources
+// * Authorized party (azp) set to the Client ID, if there are Resources
 // * ACR claim set
 // * AMR claim set
 // * Issued At (iat) time set
 // * Auth Time (auth_time) time set
 // * Nonce that was originally passed in, if there was one
+// * Session ID (sid) set, if the authorization had one
 func (t *TokenRequest) PrefillIDToken(iss, sub string, expires time.Time) oidc.Claims {
-	return oidc.Claims{
+	aud := oidc.Audience{t.ClientID}
+	for _, r := range t.Resources {
+		if r != t.ClientID {
+			aud = append(aud, r)
+		}
+	}
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	var azp string
+	if len(aud) > 1 {
+		azp = t.ClientID
+	}
+	cl := oidc.Claims{
 		Issuer:   iss,
 		Subject:  sub,
 		Expiry:   oidc.NewUnixTime(expires),
-		Audience: oidc.Audience{t.ClientID},
+		Audience: aud,
 		ACR:      t.Authorization.ACR,
 		AMR:      t.Authorization.AMR,
 		IssuedAt: oidc.NewUnixTime(t.now()),
 		AuthTime: oidc.NewUnixTime(t.AuthTime),
 		Nonce:    t.Nonce,
+		AZP:      azp,
 		Extra:    map[string]interface{}{},
 	}
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html#Claims
+	if t.Authorization.SID != "" {
+		cl.Extra["sid"] = t.Authorization.SID
+	}
+	return cl
 }
 
 // TokenResponse is returned by the token endpoint handler, indicating what it
 // should actually return to the user.
 type TokenResponse struct {
-	// IssueRefreshToken indicates if we should issue a refresh token.
+	// IssueRefreshToken indicates if we should issue a refresh token. One is
+	// only issued if the session was granted the offline_access scope, i.e
+	// TokenRequest.SessionRefreshable is set.
 	IssueRefreshToken bool
 
 	// IDToken is returned as the id_token for the request to this endpoint. It
@@ -376,6 +1402,14 @@ type unauthorizedErr interface {
 // This can handle both the initial access token request, as well as subsequent
 // calls for refreshes.
 //
+// Token exchange grant requests are also handled, if the ClientSource
+// implements TokenExchangeClientSource. For these the handler is passed the
+// verified tokens in TokenRequest.TokenExchange.
+//
+// Client credentials grant requests are handled if the ClientSource implements
+// ClientCredentialsClientSource. The handler is only used to get the
+// AccessTokenValidUntil for these, as there is no ID or refresh token.
+//
 // If a handler returns an error, it will be checked and the endpoint will
 // respond to the user appropriately. The session will not be invalidated
 // automatically, it it the responsibility of the handler to delete if it
@@ -391,21 +1425,54 @@ type unauthorizedErr interface {
 //
 // https://openid.net/specs/openid-connect-core-1_0.html#TokenEndpoint
 // https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokens
-func (o *OIDC) Token(w http.ResponseWriter, req *http.Request, handler func(req *TokenRequest) (*TokenResponse, error)) error {
+func (o *OIDC) Token(w http.ResponseWriter, req *http.Request, handler func(req *TokenRequest) (*TokenResponse, error)) (err error) {
+	if o.handleCORS(w, req, EndpointToken) {
+		return nil
+	}
+
+	start := o.now()
+	var grantType GrantType
+	defer func() { o.observeToken(grantType, start, err) }()
+
+	if req, err = o.withIssuer(req); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	if err := o.checkIPRateLimit(req); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
 	treq, err := parseTokenRequest(req)
 	if err != nil {
-		_ = writeError(w, req, err)
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+	treq.ClientCert = o.clientCertificate(req)
+	treq.ClientIP = o.clientIP(req)
+	grantType = treq.GrantType
+
+	treq.DPoPJKT, err = o.verifyDPoPProof(req, "")
+	if err != nil {
+		err = dpopProofError(err)
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	if err := o.checkClientRateLimit(req.Context(), treq.ClientID); err != nil {
+		_ = writeTokenError(w, req, err)
 		return err
 	}
 
 	resp, err := o.token(req.Context(), treq, handler)
 	if err != nil {
-		_ = writeError(w, req, err)
+		_ = writeTokenError(w, req, err)
 		return err
 	}
 
 	if err := writeTokenResponse(w, resp); err != nil {
-		_ = writeError(w, req, err)
+		_ = writeTokenError(w, req, err)
 		return err
 	}
 
@@ -417,13 +1484,36 @@ func (o *OIDC) token(ctx context.Context, req *tokenRequest, handler func(req *T
 	var err error
 
 	var isRefresh bool
+	var clientAuthenticated bool
 
 	switch req.GrantType {
+	case GrantTypeTokenExchange:
+		// these aren't tied to a session, so are handled separately.
+		return o.tokenExchange(ctx, req, handler)
+	case GrantTypeClientCredentials:
+		// these have no user, so are handled separately.
+		return o.clientCredentials(ctx, req, handler)
 	case GrantTypeAuthorizationCode:
 		sess, err = o.fetchCodeSession(ctx, req)
 	case GrantTypeRefreshToken:
 		isRefresh = true
 		sess, err = o.fetchRefreshSession(ctx, req)
+	case GrantTypeDeviceCode:
+		// the device polls with this code, so make sure the client is who
+		// they say they are before revealing anything about its state.
+		if err := o.authenticateTokenClient(ctx, req); err != nil {
+			return nil, err
+		}
+		clientAuthenticated = true
+		sess, err = o.fetchDeviceSession(ctx, req)
+	case GrantTypePassword:
+		// the credentials are checked against the user store, so only do
+		// this for clients that are who they say they are.
+		if err := o.authenticateTokenClient(ctx, req); err != nil {
+			return nil, err
+		}
+		clientAuthenticated = true
+		sess, err = o.passwordSession(ctx, req)
 
 	default:
 		err = &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "invalid grant type", Cause: fmt.Errorf("grant type %s not handled", req.GrantType)}
@@ -441,34 +1531,71 @@ func (o *OIDC) token(ctx context.Context, req *tokenRequest, handler func(req *T
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "", Cause: fmt.Errorf("code redeemed for wrong client")}
 	}
 
-	// validate the client
-	cok, err := o.clients.ValidateClientSecret(req.ClientID, req.ClientSecret)
+	if !clientAuthenticated {
+		if err := o.authenticateTokenClient(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	// scopes were checked when the authorization was requested.
+	if err := o.checkClientRestrictions(req.ClientID, req.GrantType, nil); err != nil {
+		return nil, err
+	}
+
+	resources, err := o.tokenResources(req, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	// Call the handler with information about the request, and get the response.
+	if sess.Authorization == nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "session authorization is nil"}
+	}
+
+	scopes, narrowed, err := tokenScopes(req, sess)
 	if err != nil {
-		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client id & secret", Cause: err}
-
+		return nil, err
 	}
-	if !cok {
-		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "Invalid client secret"}
+
+	// if the code was issued with a PKCE challenge, the verifier must match
+	// it.
+	if req.GrantType == GrantTypeAuthorizationCode && sess.Request != nil && sess.Request.CodeChallenge != "" {
+		if req.CodeVerifier == "" {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "code_verifier is required"}
+		}
+		if !verifyCodeChallenge(sess.Request.CodeChallengeMethod, sess.Request.CodeChallenge, req.CodeVerifier) {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "code_verifier does not match challenge"}
+		}
 	}
 
-	// Call the handler with information about the request, and get the response.
-	if sess.Authorization == nil {
-		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "session authorization is nil"}
+	// The nonce ties the ID token to the authentication request, so it is only
+	// returned for the initial grant. Refreshed ID tokens should not contain
+	// it.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokenResponse
+	var nonce string
+	if !isRefresh {
+		nonce = sess.Request.Nonce
 	}
 
 	tr := &TokenRequest{
 		SessionID: sess.ID,
 		ClientID:  req.ClientID,
+		Issuer:    o.issuerFrom(ctx),
 		Authorization: Authorization{
-			Scopes: sess.Authorization.Scopes,
-			ACR:    sess.Authorization.ACR,
-			AMR:    sess.Authorization.AMR,
+			Scopes:    scopes,
+			ACR:       sess.Authorization.ACR,
+			AMR:       sess.Authorization.AMR,
+			SID:       sess.Authorization.SID,
+			Connector: sess.Authorization.Connector,
 		},
 		GrantType:          req.GrantType,
 		SessionRefreshable: strsContains(sess.Authorization.Scopes, "offline_access"),
 		IsRefresh:          isRefresh,
-		Nonce:              sess.Request.Nonce,
+		Nonce:              nonce,
 		AuthTime:           sess.Authorization.AuthorizedAt,
+		Claims:             sess.Request.Claims,
+		Resources:          resources,
 
 		authReq: sess.Request,
 		now:     o.now,
@@ -483,6 +1610,10 @@ func (o *OIDC) token(ctx context.Context, req *tokenRequest, handler func(req *T
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "handler returned error", Cause: err}
 	}
 
+	if err := o.applyClientTokenLifetimes(req.ClientID, tresp); err != nil {
+		return nil, err
+	}
+
 	if tresp.AccessTokenValidUntil.Before(o.now()) {
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "access token must be valid > now"}
 	}
@@ -496,23 +1627,64 @@ func (o *OIDC) token(ctx context.Context, req *tokenRequest, handler func(req *T
 	if err != nil {
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate access token", Cause: err}
 	}
+	satok.IssuedAt = o.now()
+	if o.certificateBoundAccessTokens && req.ClientCert != nil {
+		satok.CertThumbprint = certThumbprint(req.ClientCert)
+	}
+	satok.DPoPJKT = req.DPoPJKT
+	satok.Audience = resources
+	satok.IPRanges, err = o.clientIPRanges(req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client IP ranges", Cause: err}
+	}
+	if narrowed {
+		satok.Scopes = scopes
+	}
 	sess.Expiry = satok.Expiry
 	sess.AccessToken = satok
 	sess.Stage = sessionStageAccessTokenIssued
+	sess.LastUsedAt = o.now()
 
 	accessTok, err := marshalToken(useratok)
 	if err != nil {
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to marshal user token", Cause: err}
 	}
+	accessTok, err = o.formatAccessToken(ctx, accessTok, &jwtAccessToken{
+		Subject:  tresp.IDToken.Subject,
+		ClientID: req.ClientID,
+		Audience: resources,
+		Scopes:   scopes,
+		Token:    satok,
+		AuthTime: sess.Authorization.AuthorizedAt,
+		ACR:      sess.Authorization.ACR,
+		AMR:      sess.Authorization.AMR,
+	})
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to format access token", Cause: err}
+	}
 
 	// If we're allowing refresh, issue one of those too.
 	// do this after, as it'll set a longer expiration on the session
 	var refreshTok string
-	if tresp.IssueRefreshToken {
+	if tresp.IssueRefreshToken && strsContains(sess.Authorization.Scopes, "offline_access") {
 		urefreshtok, srefreshtok, err := newToken(sess.ID, tresp.RefreshTokenValidUntil)
 		if err != nil {
 			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate access token", Cause: err}
 		}
+		srefreshtok.IssuedAt = o.now()
+		// refresh tokens for public clients are bound to the DPoP key too,
+		// as there are no client credentials protecting them.
+		//
+		// https://www.rfc-editor.org/rfc/rfc9449#section-5
+		if req.DPoPJKT != "" {
+			public, err := o.clients.IsUnauthenticatedClient(req.ClientID)
+			if err != nil {
+				return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client is public", Cause: err}
+			}
+			if public {
+				srefreshtok.DPoPJKT = req.DPoPJKT
+			}
+		}
 		sess.Expiry = srefreshtok.Expiry
 		sess.RefreshToken = srefreshtok
 		sess.Stage = sessionStageRefreshable
@@ -530,25 +1702,108 @@ func (o *OIDC) token(ctx context.Context, req *tokenRequest, handler func(req *T
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to put access token", Cause: err}
 	}
 
+	// let the client check the access token was issued alongside the ID token.
+	//
+	// https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+	alg, err := o.idTokenAlg(ctx, req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get id token signing algorithm", Cause: err}
+	}
+	tresp.IDToken.AccessTokenHash, err = tokenHash(alg, accessTok)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to hash access token", Cause: err}
+	}
+
+	ensureAuthTime(&tresp.IDToken, sess)
+
 	idtb, err := json.Marshal(tresp.IDToken)
 	if err != nil {
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to marshal id token", Cause: err}
 	}
+	idtb, err = o.finalizeClaims(ctx, sessionIdentity(sess), sess.Request.Claims.idToken(), idtb)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to finalize id token claims", Cause: err}
+	}
 
-	sidt, err := o.signer.Sign(ctx, idtb)
+	sidt, err := o.signIDToken(ctx, alg, idtb)
 	if err != nil {
 		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to sign id token", Cause: err}
 	}
+	sidt, err = o.encryptIDToken(req.ClientID, sidt)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to encrypt id token", Cause: err}
+	}
+
+	o.audit(ctx, AuditEvent{
+		Type:      AuditEventTokenIssued,
+		ClientID:  req.ClientID,
+		Subject:   tresp.IDToken.Subject,
+		Scopes:    scopes,
+		GrantType: req.GrantType,
+	})
 
-	return &tokenResponse{
+	resp := &tokenResponse{
 		AccessToken:  accessTok,
 		RefreshToken: refreshTok,
-		TokenType:    "bearer",
+		TokenType:    accessTokenType(satok),
 		ExpiresIn:    tresp.AccessTokenValidUntil.Sub(o.now()),
 		ExtraParams: map[string]interface{}{
 			"id_token": string(sidt),
 		},
-	}, nil
+	}
+	// the scope must be returned if it differs from what the client
+	// requested. For a code, that's when the authorization granted something
+	// other than what was asked for. A refresh is requesting the narrowed
+	// scopes, but we return them so the client knows they took effect.
+	//
+	// https://tools.ietf.org/html/rfc6749#section-5.1
+	if narrowed || (req.GrantType == GrantTypeAuthorizationCode && sess.Request != nil && !strsEqualSet(sess.Request.Scopes, scopes)) {
+		resp.Scopes = scopes
+	}
+	return resp, nil
+}
+
+// tokenScopes returns the scopes a token endpoint request for the session is
+// for. A refresh grant can narrow the scopes to a subset of those the session
+// was authorized for, but not add to them. Narrowing only applies to the
+// tokens issued, later refreshes can request any of the original scopes. If
+// the scopes were narrowed, narrowed is true.
+//
+// https://tools.ietf.org/html/rfc6749#section-6
+func tokenScopes(req *tokenRequest, sess *sessionV2) (scopes []string, narrowed bool, err error) {
+	granted := sess.Authorization.Scopes
+	if len(req.Scopes) == 0 {
+		return granted, false, nil
+	}
+	for _, s := range req.Scopes {
+		if !strsContains(granted, s) {
+			return nil, false, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidScope, Description: "scope exceeds that originally granted"}
+		}
+	}
+	return req.Scopes, true, nil
+}
+
+// authenticateTokenClient validates the client credentials passed to the token
+// endpoint. Public clients have no secret to check, but are verified if they
+// present an assertion.
+func (o *OIDC) authenticateTokenClient(ctx context.Context, req *tokenRequest) error {
+	if req.ClientAssertion == "" {
+		public, err := o.clients.IsUnauthenticatedClient(req.ClientID)
+		if err != nil {
+			return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client is unauthenticated", Cause: err}
+		}
+		if public {
+			return o.checkClientIP(req.ClientID, req.ClientIP)
+		}
+	}
+	cok, err := o.authenticateClient(ctx, req.ClientID, req.ClientSecret, req.ClientAssertion, req.ClientCert)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client credentials", Cause: err}
+	}
+	if !cok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "Invalid client credentials"}
+	}
+	return o.checkClientIP(req.ClientID, req.ClientIP)
 }
 
 // fetchCodeSession handles loading the session for a code grant.
@@ -565,6 +1820,9 @@ func (o *OIDC) fetchCodeSession(ctx context.Context, treq *tokenRequest) (*sessi
 	if sess == nil {
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "sesion expired"}
 	}
+	if !sess.issuedTokens() || sess.AuthCode == nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "invalid code"}
+	}
 
 	if sess.AuthCodeRedeemed || o.now().After(sess.AuthCode.Expiry) {
 		// Drop the session too, assume we're under some kind of replay.
@@ -587,7 +1845,9 @@ func (o *OIDC) fetchCodeSession(ctx context.Context, treq *tokenRequest) (*sessi
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "invalid code", Cause: err}
 	}
 
-	sess.AuthCodeRedeemed = true
+	if err := o.redeemAuthCode(ctx, sess); err != nil {
+		return nil, err
+	}
 
 	return sess, nil
 }
@@ -607,7 +1867,7 @@ func (o *OIDC) fetchRefreshSession(ctx context.Context, treq *tokenRequest) (*se
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "token expired", Cause: err}
 	}
 
-	if sess.RefreshToken == nil {
+	if !sess.issuedTokens() || sess.RefreshToken == nil {
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "no refresh token issued for session"}
 	}
 
@@ -623,13 +1883,23 @@ func (o *OIDC) fetchRefreshSession(ctx context.Context, treq *tokenRequest) (*se
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid refresh token", Cause: err}
 	}
 	if !ok {
-		// if we're passed an invalid refresh token, assume we're under attack and drop the session
+		// if we're passed an invalid refresh token, assume we're under attack
+		// and drop the session. This is usually a previously rotated token
+		// being replayed. Every token descended from the original grant lives
+		// in this one session, so deleting it revokes the whole family at
+		// once - there is no window where part of it is still usable.
+		//
+		// https://datatracker.ietf.org/doc/html/draft-ietf-oauth-security-topics#section-4.14.2
 		if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
 			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session from storage", Cause: err}
 		}
 		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "invalid refresh token", Cause: err}
 	}
 
+	if sess.RefreshToken.DPoPJKT != "" && sess.RefreshToken.DPoPJKT != treq.DPoPJKT {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "refresh token is bound to a different DPoP key"}
+	}
+
 	// Drop the current token, it's been redeemed. The caller can decide to
 	// issue a new one.
 	sess.RefreshToken = nil
@@ -642,24 +1912,49 @@ func (o *OIDC) fetchRefreshSession(ctx context.Context, treq *tokenRequest) (*se
 type UserinfoRequest struct {
 	// SessionID of the session this request is for.
 	SessionID string
+	// Claims the client individually requested in the authorization
+	// request, if any. Those requested for userinfo should be returned if
+	// available.
+	Claims *ClaimsRequest
 }
 
 // Userinfo can handle a request to the userinfo endpoint. If the request is not
 // valid, an error will be returned. Otherwise handler will be invoked with
 // information about the requestor passed in. This handler should write the
-// appropriate response data in JSON format to the passed writer.
+// appropriate response data in JSON format to the passed writer. If a
+// ClaimsModifier is configured, the handler's output is passed through it
+// before being returned. Standard claims not covered by the scopes the session
+// was granted are removed.
+//
+// The response is returned as a signed JWT if the client asks for one with an
+// Accept: application/jwt header, or the ClientSource implements
+// UserinfoSigningClientSource and the client is registered for signed
+// responses.
 //
 // https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
 func (o *OIDC) Userinfo(w http.ResponseWriter, req *http.Request, handler func(w io.Writer, uireq *UserinfoRequest) error) error {
+	req = o.withErrorHandler(req)
+
+	if o.handleCORS(w, req, EndpointUserinfo) {
+		return nil
+	}
+
+	req, err := o.withIssuer(req)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
 	authSp := strings.SplitN(req.Header.Get("authorization"), " ", 2)
-	if !strings.EqualFold(authSp[0], "bearer") || len(authSp) != 2 {
+	isDPoP := strings.EqualFold(authSp[0], tokenTypeDPoP)
+	if !(strings.EqualFold(authSp[0], "bearer") || isDPoP) || len(authSp) != 2 {
 		be := &bearerError{} // no content, just request auth
 		herr := &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: "malformed Authorization header"}
 		_ = writeError(w, req, herr)
 		return herr
 	}
 
-	uaccess, err := unmarshalToken(authSp[1])
+	uaccess, err := o.unmarshalAccessToken(req.Context(), authSp[1])
 	if err != nil {
 		be := &bearerError{Code: bearerErrorCodeInvalidRequest, Description: "malformed token"}
 		herr := &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), Cause: err}
@@ -676,7 +1971,7 @@ func (o *OIDC) Userinfo(w http.ResponseWriter, req *http.Request, handler func(w
 	}
 
 	// make sure we have a valid, unexpired session and an unexpired token
-	if sess == nil || o.now().After(sess.Expiry) || o.now().After(sess.AccessToken.Expiry) {
+	if sess == nil || !sess.issuedTokens() || sess.AccessToken == nil || o.now().After(sess.Expiry) || o.now().After(sess.AccessToken.Expiry) {
 		be := &bearerError{Code: bearerErrorCodeInvalidToken, Description: "token no longer valid"}
 		herr := &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: "Access token expired"}
 		_ = writeError(w, req, herr)
@@ -704,22 +1999,417 @@ func (o *OIDC) Userinfo(w http.ResponseWriter, req *http.Request, handler func(w
 		return herr
 	}
 
+	// certificate bound tokens can only be used with the same certificate
+	//
+	// https://tools.ietf.org/html/rfc8705#section-3
+	if sess.AccessToken.CertThumbprint != "" {
+		cert := o.clientCertificate(req)
+		if cert == nil || certThumbprint(cert) != sess.AccessToken.CertThumbprint {
+			be := &bearerError{Code: bearerErrorCodeInvalidToken, Description: "token is bound to a different certificate"}
+			herr := &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: "certificate thumbprint mismatch"}
+			_ = writeError(w, req, herr)
+			return herr
+		}
+	}
+
+	if len(sess.AccessToken.IPRanges) > 0 {
+		ok, err := ipInRanges(o.clientIP(req), sess.AccessToken.IPRanges)
+		if err != nil {
+			herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "failed to check token IP ranges"}
+			_ = writeError(w, req, herr)
+			return herr
+		}
+		if !ok {
+			be := &bearerError{Code: bearerErrorCodeInvalidToken, Description: "token can not be used from this address"}
+			herr := &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: "client IP not in token IP ranges"}
+			_ = writeError(w, req, herr)
+			return herr
+		}
+	}
+
+	// DPoP bound tokens must be presented with a proof signed by the same
+	// key, and unbound tokens can't claim to be.
+	//
+	// https://www.rfc-editor.org/rfc/rfc9449#section-7
+	if sess.AccessToken.DPoPJKT != "" || isDPoP {
+		if err := o.checkDPoPBoundToken(req, isDPoP, authSp[1], sess.AccessToken); err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+	}
+
 	// If we make it to here, we have been presented a valid token for a valid session. Run the handler.
 	uireq := &UserinfoRequest{
 		SessionID: uaccess.SessionId,
 	}
+	if sess.Request != nil {
+		uireq.Claims = sess.Request.Claims
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	signed, err := o.userinfoWantsJWT(req.Context(), req, sess.ClientID)
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "failed to check if userinfo should be signed"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
 
-	if err := handler(w, uireq); err != nil {
+	// the claims need to be finalized before they are written, so capture
+	// them.
+	var buf bytes.Buffer
+	if err := handler(&buf, uireq); err != nil {
 		herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "error in user handler"}
 		_ = writeError(w, req, herr)
 		return herr
 	}
+	claims, err := o.finalizeClaims(req.Context(), sessionIdentity(sess), uireq.Claims.userinfo(), buf.Bytes())
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "failed to finalize userinfo claims"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	contentType := "application/json"
+	if signed {
+		jwt, err := o.signUserinfo(req.Context(), sess.ClientID, claims)
+		if err != nil {
+			herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "failed to sign userinfo response"}
+			_ = writeError(w, req, herr)
+			return herr
+		}
+		contentType = "application/jwt"
+		claims = []byte(jwt)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(claims); err != nil {
+		return fmt.Errorf("writing userinfo response: %w", err)
+	}
+
+	return nil
+}
+
+// Revoke can handle a request to the token revocation endpoint. The client
+// must authenticate in the same way as for the token endpoint. If the passed
+// token is a valid access or refresh token for the client, the session it
+// belongs to is deleted, invalidating all tokens issued for it.
+//
+// As required by the spec, a 200 response is returned for tokens that are
+// unknown or already invalid. Errors are only returned to the caller for
+// malformed requests, failed client authentication, or tokens that belong to a
+// different client.
+//
+// https://tools.ietf.org/html/rfc7009
+func (o *OIDC) Revoke(w http.ResponseWriter, req *http.Request) error {
+	if o.handleCORS(w, req, EndpointRevocation) {
+		return nil
+	}
+
+	req, err := o.withIssuer(req)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	rreq, err := parseTokenHintRequest(req)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+	rreq.ClientCert = o.clientCertificate(req)
+
+	if err := o.revoke(req.Context(), rreq); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (o *OIDC) revoke(ctx context.Context, rreq *tokenHintRequest) error {
+	cok, err := o.authenticateClient(ctx, rreq.ClientID, rreq.ClientSecret, rreq.ClientAssertion, rreq.ClientCert)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client credentials", Cause: err}
+	}
+	if !cok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "Invalid client credentials"}
+	}
+
+	utok, err := o.unmarshalAccessToken(ctx, rreq.Token)
+	if err != nil {
+		// invalid tokens do not cause an error response
+		// https://tools.ietf.org/html/rfc7009#section-2.2
+		return nil
+	}
+
+	sess, err := getSession(ctx, o.smgr, utok.SessionId)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get session from storage", Cause: err}
+	}
+	if sess == nil || !sess.issuedTokens() {
+		return nil
+	}
+
+	if sess.ClientID != rreq.ClientID {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "token was not issued to this client"}
+	}
+
+	stok, _, err := matchSessionToken(utok, sess, rreq.TokenTypeHint)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to compare tokens", Cause: err}
+	}
+	if stok == nil {
+		return nil
+	}
+
+	if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session from storage", Cause: err}
+	}
+
+	var scopes []string
+	if sess.Authorization != nil {
+		scopes = sess.Authorization.Scopes
+	}
+	o.audit(ctx, AuditEvent{
+		Type:     AuditEventTokenRevoked,
+		ClientID: sess.ClientID,
+		Scopes:   scopes,
+	})
+
+	return nil
+}
+
+// IntrospectionRequest contains information about the token presented to the
+// introspection endpoint.
+type IntrospectionRequest struct {
+	// SessionID of the session the token belongs to.
+	SessionID string
+	// ClientID the token was issued to.
+	ClientID string
+	// Authorization information the session was authorized with
+	Authorization Authorization
+	// IsRefreshToken is true if the presented token is a refresh token, rather
+	// than an access token
+	IsRefreshToken bool
+}
+
+// IntrospectionResponse is returned by the introspection handler, to supply
+// the information about the token that only the implementation knows.
+type IntrospectionResponse struct {
+	// Issuer of the token
+	Issuer string
+	// Subject the token was issued for
+	Subject string
+	// Audience the token is intended for. If not set, the resources the token
+	// was issued for are used, or if it was not issued for specific resources
+	// the client ID it was issued to.
+	Audience oidc.Audience
+	// Extra contains any additional fields to include in the response. If a
+	// key clashes with a standard field, the standard field wins.
+	Extra map[string]interface{}
+}
+
+// Introspect can handle a request to the token introspection endpoint, used by
+// resource servers to check the state of an access or refresh token. The
+// calling client must authenticate in the same way as for the token endpoint.
+//
+// If the token is valid and was issued to the calling client, handler will be
+// invoked to supply the information about the token's subject. Any other
+// token, including expired, malformed and other client's tokens, results in an
+// inactive response with no further information. If the handler returns an
+// error that implements an `Unauthorized() bool` method returning true, the
+// token will also be reported as inactive. All other handler errors will
+// result in an InternalServerError.
+//
+// https://tools.ietf.org/html/rfc7662
+func (o *OIDC) Introspect(w http.ResponseWriter, req *http.Request, handler func(ireq *IntrospectionRequest) (*IntrospectionResponse, error)) error {
+	if o.handleCORS(w, req, EndpointIntrospection) {
+		return nil
+	}
+
+	req, err := o.withIssuer(req)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	ireq, err := parseTokenHintRequest(req)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+	ireq.ClientCert = o.clientCertificate(req)
+
+	resp, err := o.introspect(req.Context(), ireq, handler)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Cause: err, CauseMsg: "failed to write introspection response"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
 
 	return nil
 }
 
+func (o *OIDC) introspect(ctx context.Context, ireq *tokenHintRequest, handler func(ireq *IntrospectionRequest) (*IntrospectionResponse, error)) (map[string]interface{}, error) {
+	inactive := map[string]interface{}{"active": false}
+
+	cok, err := o.authenticateClient(ctx, ireq.ClientID, ireq.ClientSecret, ireq.ClientAssertion, ireq.ClientCert)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client credentials", Cause: err}
+	}
+	if !cok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "Invalid client credentials"}
+	}
+
+	utok, err := o.unmarshalAccessToken(ctx, ireq.Token)
+	if err != nil {
+		return inactive, nil
+	}
+
+	sess, err := getSession(ctx, o.smgr, utok.SessionId)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get session from storage", Cause: err}
+	}
+	if sess == nil || !sess.issuedTokens() || sess.Authorization == nil || sess.ClientID != ireq.ClientID || o.now().After(sess.Expiry) {
+		return inactive, nil
+	}
+
+	stok, isRefresh, err := matchSessionToken(utok, sess, ireq.TokenTypeHint)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to compare tokens", Cause: err}
+	}
+	if stok == nil || o.now().After(stok.Expiry) {
+		return inactive, nil
+	}
+
+	// the token may have been issued for fewer scopes than the session.
+	scopes := sess.Authorization.Scopes
+	if stok.Scopes != nil {
+		scopes = stok.Scopes
+	}
+
+	iresp, err := handler(&IntrospectionRequest{
+		SessionID: sess.ID,
+		ClientID:  sess.ClientID,
+		Authorization: Authorization{
+			Scopes:    scopes,
+			ACR:       sess.Authorization.ACR,
+			AMR:       sess.Authorization.AMR,
+			SID:       sess.Authorization.SID,
+			Connector: sess.Authorization.Connector,
+		},
+		IsRefreshToken: isRefresh,
+	})
+	if err != nil {
+		var uaerr unauthorizedErr
+		if errors.As(err, &uaerr); uaerr != nil && uaerr.Unauthorized() {
+			return inactive, nil
+		}
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "handler returned error", Cause: err}
+	}
+
+	resp := map[string]interface{}{}
+	for k, v := range iresp.Extra {
+		resp[k] = v
+	}
+
+	aud := iresp.Audience
+	if len(aud) == 0 {
+		aud = oidc.Audience(stok.Audience)
+	}
+	if len(aud) == 0 {
+		aud = oidc.Audience{sess.ClientID}
+	}
+
+	resp["active"] = true
+	resp["scope"] = strings.Join(scopes, " ")
+	resp["client_id"] = sess.ClientID
+	resp["exp"] = oidc.NewUnixTime(stok.Expiry)
+	resp["aud"] = aud
+	if !stok.IssuedAt.IsZero() {
+		resp["iat"] = oidc.NewUnixTime(stok.IssuedAt)
+	}
+	if iresp.Subject != "" {
+		resp["sub"] = iresp.Subject
+	} else if sess.Authorization.ClientCredentials {
+		// the token was issued to the client for itself.
+		resp["sub"] = sess.ClientID
+	}
+	if iresp.Issuer != "" {
+		resp["iss"] = iresp.Issuer
+	}
+	if !isRefresh {
+		resp["token_type"] = string(tokenTypeBearer)
+		if stok.DPoPJKT != "" {
+			resp["token_type"] = tokenTypeDPoP
+		}
+	}
+	// resource servers are responsible for checking the token is presented
+	// with the certificate or DPoP proof it is bound to.
+	cnf := map[string]interface{}{}
+	if stok.CertThumbprint != "" {
+		cnf["x5t#S256"] = stok.CertThumbprint
+	}
+	if stok.DPoPJKT != "" {
+		cnf["jkt"] = stok.DPoPJKT
+	}
+	if len(cnf) > 0 {
+		resp["cnf"] = cnf
+	}
+	if len(stok.IPRanges) > 0 {
+		resp["allowed_ip_ranges"] = stok.IPRanges
+	}
+
+	return resp, nil
+}
+
+// matchSessionToken finds the token stored in the session that corresponds to
+// the presented user token. If the token matches none of the session's tokens,
+// a nil token is returned. The hinted type is checked first, to save a bcrypt
+// comparison in the common case.
+func matchSessionToken(utok *corev1beta1.UserToken, sess *sessionV2, hint tokenTypeHint) (stok *accessToken, isRefresh bool, err error) {
+	order := []bool{false, true}
+	if hint == tokenTypeHintRefreshToken {
+		order = []bool{true, false}
+	}
+
+	for _, refresh := range order {
+		stok := sess.AccessToken
+		if refresh {
+			stok = sess.RefreshToken
+		}
+		if stok == nil {
+			continue
+		}
+		ok, err := tokensMatch(utok, stok)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return stok, refresh, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// ensureAuthTime sets the auth_time claim on the ID token, if the client passed
+// max_age and the handler didn't set it. It is required in this case.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+func ensureAuthTime(idt *oidc.Claims, sess *sessionV2) {
+	if sess.Request == nil || sess.Request.MaxAge == nil || idt.AuthTime != 0 {
+		return
+	}
+	idt.AuthTime = oidc.NewUnixTime(sess.Authorization.AuthorizedAt)
+}
+
 func strsContains(strs []string, s string) bool {
 	for _, str := range strs {
 		if str == s {
@@ -728,3 +2418,30 @@ func strsContains(strs []string, s string) bool {
 	}
 	return false
 }
+
+// strsEqualSet returns true if a and b contain the same strings, ignoring
+// order and duplicates.
+func strsEqualSet(a, b []string) bool {
+	for _, s := range a {
+		if !strsContains(b, s) {
+			return false
+		}
+	}
+	for _, s := range b {
+		if !strsContains(a, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// strsWithout returns strs with any s removed.
+func strsWithout(strs []string, s string) []string {
+	var ret []string
+	for _, str := range strs {
+		if str != s {
+			ret = append(ret, str)
+		}
+	}
+	return ret
+}
@@ -6,8 +6,10 @@ import (
 	"errors"
 	"io"
 	"math"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/pardot/oidc"
 	"github.com/pardot/oidc/oauth2"
 	corev1beta1 "github.com/pardot/oidc/proto/core/v1beta1"
+	"gopkg.in/square/go-jose.v2"
 )
 
 func TestStartAuthorization(t *testing.T) {
@@ -25,18 +28,27 @@ func TestStartAuthorization(t *testing.T) {
 		redirectURI  = "https://redirect"
 	)
 
+	const (
+		publicClientID = "public-client"
+	)
+
 	clientSource := &stubCS{
 		validClients: map[string]csClient{
 			clientID: csClient{
 				Secret:      clientSecret,
 				RedirectURI: redirectURI,
 			},
+			publicClientID: csClient{
+				RedirectURI: redirectURI,
+				Public:      true,
+			},
 		},
 	}
 
 	for _, tc := range []struct {
 		Name                 string
 		Query                url.Values
+		RequirePKCE          bool
 		WantReturnedErrMatch func(error) bool
 		WantHTTPStatus       int
 		CheckResponse        func(*testing.T, SessionManager, *AuthorizationRequest)
@@ -102,6 +114,62 @@ func TestStartAuthorization(t *testing.T) {
 				}
 			},
 		},
+		{
+			Name: "Login hint is passed",
+			Query: url.Values{
+				"client_id":     []string{clientID},
+				"response_type": []string{"code"},
+				"redirect_uri":  []string{redirectURI},
+				"login_hint":    []string{"user@example.com"},
+			},
+			CheckResponse: func(t *testing.T, smgr SessionManager, areq *AuthorizationRequest) {
+				if areq.LoginHint != "user@example.com" {
+					t.Errorf("want login hint user@example.com, got: %q", areq.LoginHint)
+				}
+			},
+		},
+		{
+			Name: "Display is passed",
+			Query: url.Values{
+				"client_id":     []string{clientID},
+				"response_type": []string{"code"},
+				"redirect_uri":  []string{redirectURI},
+				"display":       []string{"popup"},
+			},
+			CheckResponse: func(t *testing.T, smgr SessionManager, areq *AuthorizationRequest) {
+				if areq.Display != DisplayPopup {
+					t.Errorf("want display popup, got: %q", areq.Display)
+				}
+			},
+		},
+		{
+			Name: "Unknown display defaults to page",
+			Query: url.Values{
+				"client_id":     []string{clientID},
+				"response_type": []string{"code"},
+				"redirect_uri":  []string{redirectURI},
+				"display":       []string{"hologram"},
+			},
+			CheckResponse: func(t *testing.T, smgr SessionManager, areq *AuthorizationRequest) {
+				if areq.Display != DisplayPage {
+					t.Errorf("want display page, got: %q", areq.Display)
+				}
+			},
+		},
+		{
+			Name: "UI locales are passed through",
+			Query: url.Values{
+				"client_id":     []string{clientID},
+				"response_type": []string{"code"},
+				"redirect_uri":  []string{redirectURI},
+				"ui_locales":    []string{"fr-CA fr en"},
+			},
+			CheckResponse: func(t *testing.T, smgr SessionManager, areq *AuthorizationRequest) {
+				if diff := cmp.Diff([]string{"fr-CA", "fr", "en"}, areq.UILocales); diff != "" {
+					t.Errorf("unexpected ui locales: %s", diff)
+				}
+			},
+		},
 		{
 			Name: "Implicit flow fails",
 			Query: url.Values{
@@ -112,6 +180,46 @@ func TestStartAuthorization(t *testing.T) {
 			WantReturnedErrMatch: matchAuthErrCode(authErrorCodeUnsupportedResponseType),
 			WantHTTPStatus:       302,
 		},
+		{
+			Name: "PKCE challenge is persisted",
+			Query: url.Values{
+				"client_id":             []string{publicClientID},
+				"response_type":         []string{"code"},
+				"redirect_uri":          []string{redirectURI},
+				"code_challenge":        []string{"challenge"},
+				"code_challenge_method": []string{"S256"},
+			},
+			RequirePKCE: true,
+			CheckResponse: func(t *testing.T, smgr SessionManager, areq *AuthorizationRequest) {
+				sess, err := getSession(context.Background(), smgr, areq.SessionID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sess.Request.CodeChallenge != "challenge" || sess.Request.CodeChallengeMethod != codeChallengeMethodS256 {
+					t.Errorf("want S256 challenge persisted, got %s %q", sess.Request.CodeChallengeMethod, sess.Request.CodeChallenge)
+				}
+			},
+		},
+		{
+			Name: "Public client without PKCE fails when required",
+			Query: url.Values{
+				"client_id":     []string{publicClientID},
+				"response_type": []string{"code"},
+				"redirect_uri":  []string{redirectURI},
+			},
+			RequirePKCE:          true,
+			WantReturnedErrMatch: matchAuthErrCode(authErrorCodeInvalidRequest),
+			WantHTTPStatus:       302,
+		},
+		{
+			Name: "Confidential client without PKCE succeeds when required for public",
+			Query: url.Values{
+				"client_id":     []string{clientID},
+				"response_type": []string{"code"},
+				"redirect_uri":  []string{redirectURI},
+			},
+			RequirePKCE: true,
+		},
 	} {
 		t.Run(tc.Name, func(t *testing.T) {
 			smgr := newStubSMGR()
@@ -123,6 +231,8 @@ func TestStartAuthorization(t *testing.T) {
 				authValidityTime: 1 * time.Minute,
 				codeValidityTime: 1 * time.Minute,
 
+				requirePKCEForPublicClients: tc.RequirePKCE,
+
 				now: time.Now,
 			}
 
@@ -166,6 +276,7 @@ func TestFinishAuthorization(t *testing.T) {
 			Nonce:        "nonce",
 			ResponseType: authRequestResponseTypeCode,
 		},
+		Expiry: time.Now().Add(1 * time.Minute),
 	}
 
 	for _, tc := range []struct {
@@ -295,35 +406,1278 @@ func TestIDTokenPrefill(t *testing.T) {
 				AuthTime: now,
 				Nonce:    "nonce",
 
-				now: nowFn,
-			},
-			Want: oidc.Claims{
-				Issuer:   "issuer",
-				Subject:  "subject",
-				Audience: oidc.Audience{"client"},
-				Expiry:   1574686451,
-				IssuedAt: 1574686451,
-				AuthTime: 1574686451,
-				ACR:      "acr",
-				Nonce:    "nonce",
-				AMR:      []string{"amr"},
-				Extra:    map[string]interface{}{},
-			},
-		},
-	} {
-		t.Run(tc.Name, func(t *testing.T) {
-			tok := tc.TReq.PrefillIDToken("issuer", "subject", now)
-			if diff := cmp.Diff(tc.Want, tok, cmpopts.IgnoreUnexported(oidc.Claims{})); diff != "" {
-				t.Error(diff)
+				now: nowFn,
+			},
+			Want: oidc.Claims{
+				Issuer:   "issuer",
+				Subject:  "subject",
+				Audience: oidc.Audience{"client"},
+				Expiry:   1574686451,
+				IssuedAt: 1574686451,
+				AuthTime: 1574686451,
+				ACR:      "acr",
+				Nonce:    "nonce",
+				AMR:      []string{"amr"},
+				Extra:    map[string]interface{}{},
+			},
+		},
+		{
+			Name: "Session ID",
+			TReq: TokenRequest{
+				ClientID: "client",
+
+				Authorization: Authorization{
+					SID: "sid",
+				},
+
+				AuthTime: now,
+
+				now: nowFn,
+			},
+			Want: oidc.Claims{
+				Issuer:   "issuer",
+				Subject:  "subject",
+				Audience: oidc.Audience{"client"},
+				Expiry:   1574686451,
+				IssuedAt: 1574686451,
+				AuthTime: 1574686451,
+				Extra:    map[string]interface{}{"sid": "sid"},
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			tok := tc.TReq.PrefillIDToken("issuer", "subject", now)
+			if diff := cmp.Diff(tc.Want, tok, cmpopts.IgnoreUnexported(oidc.Claims{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestNonce(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+		// includes characters that need escaping, to make sure it isn't
+		// mangled along the way
+		nonce = "n-0S6_WzA2Mj +/=&ü"
+	)
+
+	o := &OIDC{
+		smgr:   newStubSMGR(),
+		signer: testSigner,
+		clients: &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			},
+		},
+
+		authValidityTime: 1 * time.Minute,
+		codeValidityTime: 1 * time.Minute,
+
+		now: time.Now,
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid offline_access"},
+		"nonce":         {nonce},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid", "offline_access"}}); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotNonces []string
+	handler := func(tr *TokenRequest) (*TokenResponse, error) {
+		idt := tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute))
+		gotNonces = append(gotNonces, idt.Nonce)
+		return &TokenResponse{
+			IssueRefreshToken:      tr.SessionRefreshable,
+			AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+			RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+			IDToken:                idt,
+		}, nil
+	}
+
+	codeReq := &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         loc.Query().Get("code"),
+		RedirectURI:  redirectURI,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+	tresp, err := o.token(context.Background(), codeReq, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotNonces) != 1 || gotNonces[0] != nonce {
+		t.Fatalf("want nonce %q in ID token, got: %q", nonce, gotNonces)
+	}
+
+	// replaying the code should fail outright, rather than issuing another
+	// token with the nonce.
+	if _, err := o.token(context.Background(), codeReq, handler); err == nil {
+		t.Fatal("want error replaying code")
+	}
+	if len(gotNonces) != 1 {
+		t.Fatalf("handler should not be called for replayed code, got nonces: %q", gotNonces)
+	}
+
+	// the session was dropped by the replay, so start again to check refresh.
+	areq, err = o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid", "offline_access"}}); err != nil {
+		t.Fatal(err)
+	}
+	loc, err = url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeReq.Code = loc.Query().Get("code")
+	tresp, err = o.token(context.Background(), codeReq, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.token(context.Background(), &tokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		RefreshToken: tresp.RefreshToken,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, handler); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotNonces) != 3 || gotNonces[1] != nonce || gotNonces[2] != "" {
+		t.Errorf("want nonce only in the initial ID token, got: %q", gotNonces)
+	}
+}
+
+func TestMaxParameterLength(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+		maxLen      = 64
+	)
+
+	o, err := New(&Config{MaxParameterLength: maxLen}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(state, nonce string) (*AuthorizationRequest, *httptest.ResponseRecorder) {
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+			"state":         {state},
+			"nonce":         {nonce},
+		}
+		rec := httptest.NewRecorder()
+		areq, _ := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		return areq, rec
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		State     string
+		Nonce     string
+		WantState string
+	}{
+		{
+			Name:  "State too long",
+			State: strings.Repeat("s", maxLen+1),
+			Nonce: "nonce",
+		},
+		{
+			Name:      "Nonce too long",
+			State:     "state",
+			Nonce:     strings.Repeat("n", maxLen+1),
+			WantState: "state",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			areq, rec := start(tc.State, tc.Nonce)
+			if areq != nil {
+				t.Fatal("want request rejected")
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("error"); got != string(authErrorCodeInvalidRequest) {
+				t.Errorf("want error %s, got: %s", authErrorCodeInvalidRequest, got)
+			}
+			if got := loc.Query().Get("state"); got != tc.WantState {
+				t.Errorf("want state %q, got: %q", tc.WantState, got)
+			}
+		})
+	}
+
+	t.Run("At the limit", func(t *testing.T) {
+		// includes characters that need escaping, to make sure it isn't
+		// mangled along the way
+		state := "s-0S6_WzA2Mj +/=&ü" + strings.Repeat("s", maxLen-len("s-0S6_WzA2Mj +/=&ü"))
+
+		areq, rec := start(state, strings.Repeat("n", maxLen))
+		if areq == nil {
+			t.Fatalf("want request accepted, got: %s", rec.Header().Get("location"))
+		}
+
+		rec = httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loc.Query().Get("state"); got != state {
+			t.Errorf("want state %q echoed verbatim, got: %q", state, got)
+		}
+	})
+}
+
+func TestMaxAge(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name string
+		// AuthAge is how long ago the user authenticated
+		AuthAge time.Duration
+		// WantLoginRequired indicates the authorization should be rejected
+		WantLoginRequired bool
+	}{
+		{
+			Name:    "Recent authentication",
+			AuthAge: 1 * time.Minute,
+		},
+		{
+			Name:              "Authentication older than max_age",
+			AuthAge:           10 * time.Minute,
+			WantLoginRequired: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+					},
+				},
+
+				authValidityTime: 1 * time.Minute,
+				codeValidityTime: 1 * time.Minute,
+
+				now: time.Now,
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"state":         {"state"},
+				"max_age":       {"300"},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if areq.MaxAge == nil || *areq.MaxAge != 5*time.Minute {
+				t.Fatalf("want max age of 5m, got: %v", areq.MaxAge)
+			}
+
+			authTime := time.Now().Add(-tc.AuthAge).Truncate(time.Second)
+
+			rec := httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{
+				Scopes:   []string{"openid"},
+				AuthTime: authTime,
+			}); err != nil && !tc.WantLoginRequired {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.WantLoginRequired {
+				if got := loc.Query().Get("error"); got != "login_required" {
+					t.Errorf("want login_required error, got: %s", got)
+				}
+				sess, err := getSession(context.Background(), o.smgr, areq.SessionID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sess != nil {
+					t.Error("want session deleted")
+				}
+				return
+			}
+
+			tresp, err := o.token(context.Background(), &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         loc.Query().Get("code"),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				if !tr.AuthTime.Equal(authTime) {
+					t.Errorf("want auth time %s, got: %s", authTime, tr.AuthTime)
+				}
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					// auth_time deliberately not set, it should be added
+					IDToken: oidc.Claims{
+						Issuer:   "https://issuer",
+						Subject:  "subject",
+						Audience: oidc.Audience{clientID},
+						Expiry:   oidc.NewUnixTime(time.Now().Add(1 * time.Minute)),
+					},
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			idtb, err := testSigner.VerifySignature(context.Background(), tresp.ExtraParams["id_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			idt := oidc.Claims{}
+			if err := json.Unmarshal(idtb, &idt); err != nil {
+				t.Fatal(err)
+			}
+			if !idt.AuthTime.Time().Equal(authTime) {
+				t.Errorf("want auth_time %s, got: %s", authTime, idt.AuthTime.Time())
+			}
+		})
+	}
+}
+
+func TestACR(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	essentialMFA := `{"id_token":{"acr":{"essential":true,"values":["mfa","phr"]}}}`
+
+	for _, tc := range []struct {
+		Name      string
+		Query     url.Values
+		ACR       string
+		AMR       []string
+		WantError string
+	}{
+		{
+			Name:  "Requested acr_values are voluntary",
+			Query: url.Values{"acr_values": {"mfa"}},
+			ACR:   "pwd",
+			AMR:   []string{"pwd"},
+		},
+		{
+			Name:  "Essential acr met",
+			Query: url.Values{"claims": {essentialMFA}},
+			ACR:   "mfa",
+			AMR:   []string{"pwd", "otp"},
+		},
+		{
+			Name: "Passkey",
+			ACR:  "phr",
+			AMR:  []string{AMRHardwareKey},
+		},
+		{
+			Name:      "Essential acr not met",
+			Query:     url.Values{"claims": {essentialMFA}},
+			ACR:       "pwd",
+			AMR:       []string{"pwd"},
+			WantError: "unmet_authentication_requirements",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+			}
+			for k, v := range tc.Query {
+				q[k] = v
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			err = o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{
+				Scopes: []string{"openid"},
+				ACR:    tc.ACR,
+				AMR:    tc.AMR,
+			})
+			if err != nil && tc.WantError == "" {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.WantError != "" {
+				if got := loc.Query().Get("error"); got != tc.WantError {
+					t.Errorf("want %s error, got: %s", tc.WantError, got)
+				}
+				sess, err := getSession(context.Background(), o.smgr, areq.SessionID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sess != nil {
+					t.Error("want session deleted")
+				}
+				return
+			}
+
+			tresp, err := o.token(context.Background(), &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         loc.Query().Get("code"),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			idtb, err := testSigner.VerifySignature(context.Background(), tresp.ExtraParams["id_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			idt := oidc.Claims{}
+			if err := json.Unmarshal(idtb, &idt); err != nil {
+				t.Fatal(err)
+			}
+			if idt.ACR != tc.ACR {
+				t.Errorf("want acr %s, got: %s", tc.ACR, idt.ACR)
+			}
+			if diff := cmp.Diff(tc.AMR, idt.AMR); diff != "" {
+				t.Errorf("unexpected amr: %s", diff)
+			}
+		})
+	}
+}
+
+func TestIDTokenHint(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	cl := oidc.Claims{
+		Issuer:   "https://issuer",
+		Subject:  "alice",
+		Audience: oidc.Audience{clientID},
+		// hints are usually expired
+		Expiry: oidc.NewUnixTime(time.Now().Add(-1 * time.Minute)),
+		Extra:  map[string]interface{}{"sid": "browser-session"},
+	}
+	b, err := json.Marshal(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint, err := testSigner.Sign(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name        string
+		Hint        string
+		Subject     string
+		WantStarted bool
+		WantError   string
+	}{
+		{
+			Name:        "Matching hint",
+			Hint:        string(hint),
+			Subject:     "alice",
+			WantStarted: true,
+		},
+		{
+			Name:        "Mismatched hint",
+			Hint:        string(hint),
+			Subject:     "bob",
+			WantStarted: true,
+			WantError:   "login_required",
+		},
+		{
+			Name:      "Invalid hint",
+			Hint:      "not.a.jwt",
+			WantError: "invalid_request",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"prompt":        {"none"},
+				"id_token_hint": {tc.Hint},
+			}
+			rec := httptest.NewRecorder()
+			areq, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if !tc.WantStarted {
+				if err == nil {
+					t.Fatal("want error starting authorization")
+				}
+				loc, err := url.Parse(rec.Header().Get("location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := loc.Query().Get("error"); got != tc.WantError {
+					t.Errorf("want error %s, got: %s", tc.WantError, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if areq.IDTokenHint == nil || areq.IDTokenHint.Subject != "alice" || areq.IDTokenHint.Extra["sid"] != "browser-session" {
+				t.Fatalf("want hint claims passed, got: %#v", areq.IDTokenHint)
+			}
+
+			// the user is already logged in, so is authorized silently.
+			rec = httptest.NewRecorder()
+			err = o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{
+				Scopes:  []string{"openid"},
+				Subject: tc.Subject,
+			})
+			if err != nil && tc.WantError == "" {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("error"); got != tc.WantError {
+				t.Errorf("want error %q, got: %q", tc.WantError, got)
+			}
+			if got := loc.Query().Get("code") != ""; got != (tc.WantError == "") {
+				t.Errorf("want code issued %t, got: %s", tc.WantError == "", loc)
+			}
+		})
+	}
+}
+
+func TestResponseTypeNone(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	smgr := newStubSMGR()
+	o, err := New(&Config{}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: "client-secret", RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{
+		"response_type": {"none"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+		"state":         {"a-state"},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusFound {
+		t.Fatalf("want status %d, got: %d", http.StatusFound, rec.Code)
+	}
+
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Query().Get("state"); got != "a-state" {
+		t.Errorf("want state a-state, got: %s", got)
+	}
+	for _, p := range []string{"code", "access_token", "id_token"} {
+		if loc.Query().Get(p) != "" || strings.Contains(loc.Fragment, p) {
+			t.Errorf("want no %s in the response, got: %s", p, loc)
+		}
+	}
+
+	sess, err := getSession(context.Background(), smgr, areq.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess != nil {
+		t.Error("want session deleted")
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	ctx := context.Background()
+
+	smgr := newStubSMGR()
+	o, err := New(&Config{}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ucode, scode, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putSession(ctx, smgr, &sessionV2{
+		ID:            ucode.SessionId,
+		ClientID:      clientID,
+		Stage:         sessionStageCode,
+		Request:       &sessAuthRequest{RedirectURI: redirectURI},
+		AuthCode:      scode,
+		Authorization: &sessAuthorization{Scopes: []string{"openid", "offline_access"}},
+		Expiry:        time.Now().Add(1 * time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+			RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+			IssueRefreshToken:      true,
+			IDToken:                tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	}
+	refresh := func(rt string) (*tokenResponse, error) {
+		return o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeRefreshToken,
+			RefreshToken: rt,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, handler)
+	}
+
+	first, err := o.token(ctx, &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         mustMarshal(ucode),
+		RedirectURI:  redirectURI,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each refresh rotates the token, extending the family.
+	second, err := refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := refresh(second.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replaying a consumed token revokes every member of the family.
+	var terr *oauth2.TokenError
+	if _, err := refresh(first.RefreshToken); !errors.As(err, &terr) || terr.ErrorCode != oauth2.TokenErrorCodeInvalidGrant {
+		t.Fatalf("want replayed refresh token rejected with invalid_grant, got: %v", err)
+	}
+	if _, err := refresh(third.RefreshToken); !errors.As(err, &terr) || terr.ErrorCode != oauth2.TokenErrorCodeInvalidGrant {
+		t.Errorf("want latest refresh token revoked with invalid_grant, got: %v", err)
+	}
+	iresp, err := o.introspect(ctx, &tokenHintRequest{
+		Token:        third.AccessToken,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, func(*IntrospectionRequest) (*IntrospectionResponse, error) {
+		return &IntrospectionResponse{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iresp["active"] != false {
+		t.Errorf("want latest access token revoked, got: %v", iresp)
+	}
+}
+
+func TestTokenResponseFields(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, tc := range []struct {
+		Name             string
+		Requested        string
+		Granted          []string
+		IssueRefresh     bool
+		WantScope        string
+		WantRefreshToken bool
+	}{
+		{
+			Name:      "Granted as requested",
+			Requested: "openid profile",
+			Granted:   []string{"profile", "openid"},
+		},
+		{
+			Name:      "Granted less than requested",
+			Requested: "openid profile",
+			Granted:   []string{"openid"},
+			WantScope: "openid",
+		},
+		{
+			Name:             "Refresh token issued",
+			Requested:        "openid offline_access",
+			Granted:          []string{"openid", "offline_access"},
+			IssueRefresh:     true,
+			WantRefreshToken: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{
+				OfflineAccessWithoutConsent: true,
+				Now:                         func() time.Time { return now },
+			}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {tc.Requested},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: tc.Granted}); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := url.Values{
+				"grant_type":   {"authorization_code"},
+				"code":         {loc.Query().Get("code")},
+				"redirect_uri": {redirectURI},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(clientID, clientSecret)
+			rec = httptest.NewRecorder()
+			if err := o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil:  now.Add(5 * time.Minute),
+					RefreshTokenValidUntil: now.Add(10 * time.Minute),
+					IssueRefreshToken:      tc.IssueRefresh,
+					IDToken:                tr.PrefillIDToken("https://issuer", "subject", now.Add(5*time.Minute)),
+				}, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var resp map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp["access_token"] == "" || resp["id_token"] == "" {
+				t.Errorf("want access_token and id_token, got: %v", resp)
+			}
+			if resp["token_type"] != "Bearer" {
+				t.Errorf("want token_type Bearer, got: %v", resp["token_type"])
+			}
+			// the expiry is relative to our clock, and a whole number.
+			if !strings.Contains(rec.Body.String(), `"expires_in":300`) {
+				t.Errorf("want expires_in 300, got: %s", rec.Body.String())
+			}
+			if _, ok := resp["refresh_token"]; ok != tc.WantRefreshToken {
+				t.Errorf("want refresh_token %t, got: %v", tc.WantRefreshToken, resp["refresh_token"])
+			}
+			scope, ok := resp["scope"]
+			if tc.WantScope == "" && ok {
+				t.Errorf("want no scope, got: %v", scope)
+			}
+			if tc.WantScope != "" && scope != tc.WantScope {
+				t.Errorf("want scope %q, got: %v", tc.WantScope, scope)
+			}
+		})
+	}
+}
+
+func TestFinishAuthorizationExpired(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+	ctx := context.Background()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// the stub never expires sessions, like a store that is slow to clean
+	// them up.
+	smgr := newStubSMGR()
+	o, err := New(&Config{
+		AuthValidityTime: 5 * time.Minute,
+		Now:              func() time.Time { return now },
+	}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+		"state":         {"state"},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(5*time.Minute + 1*time.Second)
+
+	rec := httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err == nil {
+		t.Error("want error approving expired authorization request")
+	}
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Query().Get("error") != "login_required" || loc.Query().Get("code") != "" || loc.Query().Get("state") != "state" {
+		t.Errorf("want login_required redirect without a code, got: %s", loc)
+	}
+	if sess, err := getSession(ctx, smgr, areq.SessionID); err != nil || sess != nil {
+		t.Errorf("want expired request deleted, got: %v (err %v)", sess, err)
+	}
+}
+
+func TestNowFunc(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	ctx := context.Background()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	smgr := newStubSMGR()
+	o, err := New(&Config{
+		AuthValidityTime: 5 * time.Minute,
+		CodeValidityTime: 1 * time.Minute,
+		Now:              func() time.Time { return now },
+	}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := getSession(ctx, smgr, areq.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(5 * time.Minute); !sess.Expiry.Equal(want) {
+		t.Errorf("want auth request expiry %s, got: %s", want, sess.Expiry)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+		t.Fatal(err)
+	}
+	sess, err = getSession(ctx, smgr, areq.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(1 * time.Minute); !sess.Expiry.Equal(want) {
+		t.Errorf("want code expiry %s, got: %s", want, sess.Expiry)
+	}
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tresp, err := o.token(ctx, &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         loc.Query().Get("code"),
+		RedirectURI:  redirectURI,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil: now.Add(10 * time.Minute),
+			IDToken:               tr.PrefillIDToken("https://issuer", "subject", now.Add(10*time.Minute)),
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tresp.ExpiresIn != 10*time.Minute {
+		t.Errorf("want expires_in exactly 10m, got: %s", tresp.ExpiresIn)
+	}
+
+	idtb, err := testSigner.VerifySignature(ctx, tresp.ExtraParams["id_token"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idt oidc.Claims
+	if err := json.Unmarshal(idtb, &idt); err != nil {
+		t.Fatal(err)
+	}
+	if !idt.IssuedAt.Time().Equal(now) {
+		t.Errorf("want id token iat %s, got: %s", now, idt.IssuedAt.Time())
+	}
+
+	resp, err := o.introspect(ctx, &tokenHintRequest{Token: tresp.AccessToken, ClientID: clientID, ClientSecret: clientSecret}, func(_ *IntrospectionRequest) (*IntrospectionResponse, error) {
+		return &IntrospectionResponse{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp["iat"].(oidc.UnixTime).Time(); !got.Equal(now) {
+		t.Errorf("want access token iat %s, got: %s", now, got)
+	}
+	if got := resp["exp"].(oidc.UnixTime).Time(); !got.Equal(now.Add(10 * time.Minute)) {
+		t.Errorf("want access token exp %s, got: %s", now.Add(10*time.Minute), got)
+	}
+}
+
+func TestRefreshScopes(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	ctx := context.Background()
+
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := []string{"openid", "offline_access", "profile"}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {strings.Join(granted, " ")},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: granted}); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := url.Parse(rec.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handlerScopes []string
+	handler := func(tr *TokenRequest) (*TokenResponse, error) {
+		handlerScopes = tr.Authorization.Scopes
+		return &TokenResponse{
+			IssueRefreshToken:      true,
+			AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+			RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+			IDToken:                tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	}
+
+	tresp, err := o.token(ctx, &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         loc.Query().Get("code"),
+		RedirectURI:  redirectURI,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshTok := tresp.RefreshToken
+
+	refresh := func(scopes []string) (*tokenResponse, error) {
+		return o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeRefreshToken,
+			RefreshToken: refreshTok,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       scopes,
+		}, handler)
+	}
+
+	t.Run("Superset denied", func(t *testing.T) {
+		_, err := refresh([]string{"openid", "profile", "email"})
+		if err == nil {
+			t.Fatal("want error refreshing with more scopes than granted")
+		}
+		if code := metricsErrorCode(err); code != string(oauth2.TokenErrorCodeInvalidScope) {
+			t.Errorf("want invalid_scope error, got: %s", code)
+		}
+	})
+
+	t.Run("Subset narrows", func(t *testing.T) {
+		tresp, err := refresh([]string{"openid"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		refreshTok = tresp.RefreshToken
+
+		if diff := cmp.Diff([]string{"openid"}, handlerScopes); diff != "" {
+			t.Errorf("unexpected handler scopes: %s", diff)
+		}
+		if diff := cmp.Diff([]string{"openid"}, tresp.Scopes); diff != "" {
+			t.Errorf("unexpected response scopes: %s", diff)
+		}
+
+		iresp, err := o.introspect(ctx, &tokenHintRequest{Token: tresp.AccessToken, ClientID: clientID, ClientSecret: clientSecret}, func(_ *IntrospectionRequest) (*IntrospectionResponse, error) {
+			return &IntrospectionResponse{}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if iresp["scope"] != "openid" {
+			t.Errorf("want access token scope openid, got: %v", iresp["scope"])
+		}
+	})
+
+	t.Run("Omitted scope keeps original grant", func(t *testing.T) {
+		tresp, err := refresh(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(granted, handlerScopes); diff != "" {
+			t.Errorf("unexpected handler scopes: %s", diff)
+		}
+		if tresp.Scopes != nil {
+			t.Errorf("want no scope in response, got: %v", tresp.Scopes)
+		}
+	})
+}
+
+type unauthorizedErrImpl struct{ error }
+
+func (u *unauthorizedErrImpl) Unauthorized() bool { return true }
+
+func TestOfflineAccess(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		Name           string
+		WithoutConsent bool
+		Prompt         string
+		GrantOffline   bool
+		WantRequested  bool
+		WantRefresh    bool
+	}{
+		{
+			Name:          "No consent prompt",
+			GrantOffline:  false,
+			WantRequested: false,
+			WantRefresh:   false,
+		},
+		{
+			Name:          "Consent prompt",
+			Prompt:        "consent",
+			GrantOffline:  true,
+			WantRequested: true,
+			WantRefresh:   true,
+		},
+		{
+			Name:           "Without consent configured",
+			WithoutConsent: true,
+			GrantOffline:   true,
+			WantRequested:  true,
+			WantRefresh:    true,
+		},
+		{
+			Name:          "Not granted",
+			Prompt:        "consent",
+			GrantOffline:  false,
+			WantRequested: true,
+			WantRefresh:   false,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{
+				OfflineAccessWithoutConsent: tc.WithoutConsent,
+			}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid offline_access"},
+			}
+			if tc.Prompt != "" {
+				q.Set("prompt", tc.Prompt)
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strsContains(areq.Scopes, "offline_access"); got != tc.WantRequested {
+				t.Errorf("want offline_access requested %t, got: %t", tc.WantRequested, got)
+			}
+
+			granted := []string{"openid"}
+			if tc.GrantOffline {
+				granted = append(granted, "offline_access")
+			}
+			rec := httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: granted}); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tresp, err := o.token(ctx, &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         loc.Query().Get("code"),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+					RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+					IssueRefreshToken:      true,
+					IDToken:                tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tresp.RefreshToken != ""; got != tc.WantRefresh {
+				t.Errorf("want refresh token issued %t, got: %t", tc.WantRefresh, got)
 			}
 		})
 	}
 }
 
-type unauthorizedErrImpl struct{ error }
-
-func (u *unauthorizedErrImpl) Unauthorized() bool { return true }
-
 func TestToken(t *testing.T) {
 	const (
 		clientID     = "client-id"
@@ -373,7 +1727,7 @@ func TestToken(t *testing.T) {
 		sess := &sessionV2{
 			ID:            utok.SessionId,
 			AuthCode:      stok,
-			Authorization: &sessAuthorization{},
+			Authorization: &sessAuthorization{Scopes: []string{"openid", "offline_access"}},
 			ClientID:      clientID,
 			Expiry:        time.Now().Add(1 * time.Minute),
 			Request:       &sessAuthRequest{},
@@ -414,6 +1768,22 @@ func TestToken(t *testing.T) {
 		if tresp.AccessToken == "" {
 			t.Error("token request should have returned an access token, but got none")
 		}
+
+		idtp, err := testSigner.VerifySignature(context.Background(), tresp.ExtraParams["id_token"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		idt := oidc.Claims{}
+		if err := json.Unmarshal(idtp, &idt); err != nil {
+			t.Fatal(err)
+		}
+		wantHash, err := tokenHash(jose.RS256, tresp.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idt.AccessTokenHash != wantHash {
+			t.Errorf("want at_hash %s, got: %s", wantHash, idt.AccessTokenHash)
+		}
 	})
 
 	t.Run("Redeeming an already redeemed code should fail", func(t *testing.T) {
@@ -440,6 +1810,89 @@ func TestToken(t *testing.T) {
 		}
 	})
 
+	t.Run("PKCE code requires a matching verifier", func(t *testing.T) {
+		// https://tools.ietf.org/html/rfc7636#appendix-B
+		const (
+			verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+			challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+		)
+
+		for _, tc := range []struct {
+			Name         string
+			Verifier     string
+			WantErrMatch func(error) bool
+		}{
+			{
+				Name:     "Matching verifier",
+				Verifier: verifier,
+			},
+			{
+				Name:         "Missing verifier",
+				WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant),
+			},
+			{
+				Name:         "Wrong verifier",
+				Verifier:     "wrong-verifier",
+				WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant),
+			},
+		} {
+			t.Run(tc.Name, func(t *testing.T) {
+				o := newOIDC()
+				codeToken := newCodeSess(t, o.smgr)
+
+				ucode, err := unmarshalToken(codeToken)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sess, err := getSession(context.Background(), o.smgr, ucode.SessionId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sess.Request.CodeChallenge = challenge
+				sess.Request.CodeChallengeMethod = codeChallengeMethodS256
+				if err := putSession(context.Background(), o.smgr, sess); err != nil {
+					t.Fatal(err)
+				}
+
+				treq := &tokenRequest{
+					GrantType:    GrantTypeAuthorizationCode,
+					Code:         codeToken,
+					RedirectURI:  redirectURI,
+					ClientID:     clientID,
+					ClientSecret: clientSecret,
+					CodeVerifier: tc.Verifier,
+				}
+
+				_, err = o.token(context.Background(), treq, newHandler(t))
+				checkErrMatcher(t, tc.WantErrMatch, err)
+			})
+		}
+	})
+
+	t.Run("Public client redeems code without a secret", func(t *testing.T) {
+		o := newOIDC()
+		o.clients = &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{
+					RedirectURI: redirectURI,
+					Public:      true,
+				},
+			},
+		}
+		codeToken := newCodeSess(t, o.smgr)
+
+		treq := &tokenRequest{
+			GrantType:   GrantTypeAuthorizationCode,
+			Code:        codeToken,
+			RedirectURI: redirectURI,
+			ClientID:    clientID,
+		}
+
+		if _, err := o.token(context.Background(), treq, newHandler(t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
 	t.Run("Invalid client secret should fail", func(t *testing.T) {
 		o := newOIDC()
 		codeToken := newCodeSess(t, o.smgr)
@@ -1013,6 +2466,391 @@ func TestUserinfo(t *testing.T) {
 	}
 }
 
+func TestRevoke(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+
+		otherClientID     = "other-client"
+		otherClientSecret = "other-secret"
+	)
+
+	clientSource := &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{
+				Secret: clientSecret,
+			},
+			otherClientID: csClient{
+				Secret: otherClientSecret,
+			},
+		},
+	}
+
+	// newSess persists a session with access and refresh tokens, returning the
+	// session ID and the user versions of the tokens
+	newSess := func(t *testing.T, smgr SessionManager) (sessID, accessTok, refreshTok string) {
+		t.Helper()
+
+		sid := mustGenerateID()
+		ua, sa, err := newToken(sid, time.Now().Add(1*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ur, sr, err := newToken(sid, time.Now().Add(1*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sess := &sessionV2{
+			ID:           sid,
+			ClientID:     clientID,
+			AccessToken:  sa,
+			RefreshToken: sr,
+			Expiry:       time.Now().Add(1 * time.Minute),
+		}
+		if err := putSession(context.Background(), smgr, sess); err != nil {
+			t.Fatal(err)
+		}
+
+		return sid, mustMarshal(ua), mustMarshal(ur)
+	}
+
+	for _, tc := range []struct {
+		Name string
+		// Form returns the revocation request form, given the tokens for the
+		// persisted session
+		Form func(accessTok, refreshTok string) map[string]string
+		// WantErrMatch signifies that we expect an error
+		WantErrMatch   func(error) bool
+		WantHTTPStatus int
+		// WantSessionDeleted indicates the session should no longer exist
+		WantSessionDeleted bool
+	}{
+		{
+			Name: "Refresh token revokes session",
+			Form: func(_, refreshTok string) map[string]string {
+				return map[string]string{
+					"token":           refreshTok,
+					"token_type_hint": "refresh_token",
+					"client_id":       clientID,
+					"client_secret":   clientSecret,
+				}
+			},
+			WantHTTPStatus:     200,
+			WantSessionDeleted: true,
+		},
+		{
+			Name: "Access token without hint revokes session",
+			Form: func(accessTok, _ string) map[string]string {
+				return map[string]string{
+					"token":         accessTok,
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			WantHTTPStatus:     200,
+			WantSessionDeleted: true,
+		},
+		{
+			Name: "Unknown token succeeds without revoking",
+			Form: func(_, _ string) map[string]string {
+				u, _, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return map[string]string{
+					"token":         mustMarshal(u),
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			WantHTTPStatus: 200,
+		},
+		{
+			Name: "Malformed token succeeds without revoking",
+			Form: func(_, _ string) map[string]string {
+				return map[string]string{
+					"token":         "not-a-token",
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			WantHTTPStatus: 200,
+		},
+		{
+			Name: "Token for other client is rejected",
+			Form: func(_, refreshTok string) map[string]string {
+				return map[string]string{
+					"token":         refreshTok,
+					"client_id":     otherClientID,
+					"client_secret": otherClientSecret,
+				}
+			},
+			WantErrMatch:   matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant),
+			WantHTTPStatus: 400,
+		},
+		{
+			Name: "Invalid client secret is rejected",
+			Form: func(_, refreshTok string) map[string]string {
+				return map[string]string{
+					"token":         refreshTok,
+					"client_id":     clientID,
+					"client_secret": "bad-secret",
+				}
+			},
+			WantErrMatch:   matchTokenErrCode(oauth2.TokenErrorCodeInvalidClient),
+			WantHTTPStatus: 401,
+		},
+		{
+			Name: "Missing token is rejected",
+			Form: func(_, _ string) map[string]string {
+				return map[string]string{
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			WantErrMatch:   matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+			WantHTTPStatus: 400,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			smgr := newStubSMGR()
+
+			oidc, err := New(&Config{}, smgr, clientSource, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sid, at, rt := newSess(t, smgr)
+
+			rec := httptest.NewRecorder()
+			err = oidc.Revoke(rec, queryReq(tc.Form(at, rt))())
+			checkErrMatcher(t, tc.WantErrMatch, err)
+
+			if rec.Code != tc.WantHTTPStatus {
+				t.Errorf("want HTTP status code %d, got: %d", tc.WantHTTPStatus, rec.Code)
+			}
+
+			sess, err := getSession(context.Background(), smgr, sid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.WantSessionDeleted && sess != nil {
+				t.Error("want session deleted, but it still exists")
+			}
+			if !tc.WantSessionDeleted && sess == nil {
+				t.Error("want session to exist, but it was deleted")
+			}
+		})
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+
+		otherClientID     = "other-client"
+		otherClientSecret = "other-secret"
+	)
+
+	clientSource := &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{
+				Secret: clientSecret,
+			},
+			otherClientID: csClient{
+				Secret: otherClientSecret,
+			},
+		},
+	}
+
+	issuedAt := time.Now().Add(-1 * time.Minute).Truncate(time.Second)
+	expires := time.Now().Add(1 * time.Minute).Truncate(time.Second)
+
+	handler := func(ireq *IntrospectionRequest) (*IntrospectionResponse, error) {
+		return &IntrospectionResponse{
+			Issuer:  "https://issuer",
+			Subject: "subject",
+		}, nil
+	}
+
+	for _, tc := range []struct {
+		Name string
+		// Setup returns the session to persist, and the form to send
+		Setup        func(t *testing.T) (*sessionV2, map[string]string)
+		WantErrMatch func(error) bool
+		Want         map[string]interface{}
+	}{
+		{
+			Name: "Valid access token",
+			Setup: func(t *testing.T) (*sessionV2, map[string]string) {
+				sid := mustGenerateID()
+				u, s, err := newToken(sid, expires)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.IssuedAt = issuedAt
+
+				return &sessionV2{
+					ID:            sid,
+					ClientID:      clientID,
+					AccessToken:   s,
+					Authorization: &sessAuthorization{Scopes: []string{"openid", "profile"}},
+					Expiry:        expires,
+				}, map[string]string{
+					"token":         mustMarshal(u),
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			Want: map[string]interface{}{
+				"active":     true,
+				"scope":      "openid profile",
+				"client_id":  clientID,
+				"sub":        "subject",
+				"iss":        "https://issuer",
+				"aud":        clientID,
+				"exp":        float64(expires.Unix()),
+				"iat":        float64(issuedAt.Unix()),
+				"token_type": "Bearer",
+			},
+		},
+		{
+			Name: "Valid refresh token",
+			Setup: func(t *testing.T) (*sessionV2, map[string]string) {
+				sid := mustGenerateID()
+				u, s, err := newToken(sid, expires)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return &sessionV2{
+					ID:            sid,
+					ClientID:      clientID,
+					RefreshToken:  s,
+					Authorization: &sessAuthorization{Scopes: []string{"openid", "offline_access"}},
+					Expiry:        expires,
+				}, map[string]string{
+					"token":           mustMarshal(u),
+					"token_type_hint": "refresh_token",
+					"client_id":       clientID,
+					"client_secret":   clientSecret,
+				}
+			},
+			Want: map[string]interface{}{
+				"active":    true,
+				"scope":     "openid offline_access",
+				"client_id": clientID,
+				"sub":       "subject",
+				"iss":       "https://issuer",
+				"aud":       clientID,
+				"exp":       float64(expires.Unix()),
+			},
+		},
+		{
+			Name: "Expired token is inactive",
+			Setup: func(t *testing.T) (*sessionV2, map[string]string) {
+				sid := mustGenerateID()
+				u, s, err := newToken(sid, time.Now().Add(-1*time.Minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return &sessionV2{
+					ID:            sid,
+					ClientID:      clientID,
+					AccessToken:   s,
+					Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+					Expiry:        expires,
+				}, map[string]string{
+					"token":         mustMarshal(u),
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			Want: map[string]interface{}{"active": false},
+		},
+		{
+			Name: "Token from another client is inactive",
+			Setup: func(t *testing.T) (*sessionV2, map[string]string) {
+				sid := mustGenerateID()
+				u, s, err := newToken(sid, expires)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return &sessionV2{
+					ID:            sid,
+					ClientID:      clientID,
+					AccessToken:   s,
+					Authorization: &sessAuthorization{Scopes: []string{"openid"}},
+					Expiry:        expires,
+				}, map[string]string{
+					"token":         mustMarshal(u),
+					"client_id":     otherClientID,
+					"client_secret": otherClientSecret,
+				}
+			},
+			Want: map[string]interface{}{"active": false},
+		},
+		{
+			Name: "Malformed token is inactive",
+			Setup: func(t *testing.T) (*sessionV2, map[string]string) {
+				return nil, map[string]string{
+					"token":         "$$not-a-token$$",
+					"client_id":     clientID,
+					"client_secret": clientSecret,
+				}
+			},
+			Want: map[string]interface{}{"active": false},
+		},
+		{
+			Name: "Invalid client credentials are rejected",
+			Setup: func(t *testing.T) (*sessionV2, map[string]string) {
+				return nil, map[string]string{
+					"token":         "token",
+					"client_id":     clientID,
+					"client_secret": "bad-secret",
+				}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidClient),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			smgr := newStubSMGR()
+
+			oidc, err := New(&Config{}, smgr, clientSource, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sess, form := tc.Setup(t)
+			if sess != nil {
+				if err := putSession(context.Background(), smgr, sess); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			err = oidc.Introspect(rec, queryReq(form)(), handler)
+			checkErrMatcher(t, tc.WantErrMatch, err)
+			if tc.WantErrMatch != nil {
+				return
+			}
+
+			got := map[string]interface{}{}
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
 func mustMarshal(u *corev1beta1.UserToken) string {
 	t, err := marshalToken(u)
 	if err != nil {
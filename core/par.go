@@ -0,0 +1,179 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// PushedAuthorization can be used to handle a request to the pushed
+// authorization request endpoint. The client posts the authorization request
+// parameters here, and is issued a request_uri it can then send the user to the
+// authorization endpoint with. StartAuthorization will resolve the request_uri
+// to the pushed parameters.
+//
+// This will always return a response to the client, regardless of success or
+// failure.
+//
+// https://tools.ietf.org/html/rfc9126
+func (o *OIDC) PushedAuthorization(w http.ResponseWriter, req *http.Request) error {
+	req, err := o.withIssuer(req)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	preq, err := parsePushedAuthRequest(req)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+	preq.ClientCert = o.clientCertificate(req)
+
+	resp, err := o.pushedAuthorization(req.Context(), preq)
+	if err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	if err := writePushedAuthResponse(w, resp); err != nil {
+		_ = writeTokenError(w, req, err)
+		return err
+	}
+
+	return nil
+}
+
+func (o *OIDC) pushedAuthorization(ctx context.Context, preq *pushedAuthRequest) (*pushedAuthResponse, error) {
+	if preq.ClientID == "" {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "client_id is required"}
+	}
+	cidok, err := o.clients.IsValidClientID(preq.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "error calling clientsource check client ID", Cause: err}
+	}
+	if !cidok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "Invalid client"}
+	}
+	public, err := o.clients.IsUnauthenticatedClient(preq.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client is unauthenticated", Cause: err}
+	}
+	if !public || preq.ClientAssertion != "" {
+		cok, err := o.authenticateClient(ctx, preq.ClientID, preq.ClientSecret, preq.ClientAssertion, preq.ClientCert)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client credentials", Cause: err}
+		}
+		if !cok {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidClient, Description: "Invalid client credentials"}
+		}
+	}
+
+	params, err := o.resolveRequestObject(ctx, preq.Params)
+	if err != nil {
+		var herr *httpError
+		if errors.As(err, &herr) && herr.Code == http.StatusBadRequest {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequestObject, Description: herr.Message, Cause: herr.Cause}
+		}
+		return nil, err
+	}
+
+	// Validate the request now, so the client finds out about problems
+	// before sending the user anywhere.
+	//
+	// https://tools.ietf.org/html/rfc9126#section-2.1
+	authreq, err := parseAuthRequestValues(params)
+	if err != nil {
+		var aerr *authError
+		if errors.As(err, &aerr) {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: aerr.Description}
+		}
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid authorization request"}
+	}
+	redirok, err := o.clients.ValidateClientRedirectURI(authreq.ClientID, authreq.RedirectURI)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "error calling clientsource redirect URI validation", Cause: err}
+	}
+	if !redirok || !o.redirectURISchemeAllowed(authreq.RedirectURI) {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "Invalid redirect URI"}
+	}
+
+	sess := &sessionV2{
+		ID:           o.smgr.NewID(),
+		Stage:        sessionStagePushed,
+		ClientID:     preq.ClientID,
+		PushedParams: params,
+		Expiry:       o.now().Add(o.pushedRequestValidityTime),
+	}
+	if err := putSession(ctx, o.smgr, sess); err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to persist session", Cause: err}
+	}
+
+	return &pushedAuthResponse{
+		RequestURI: pushedRequestURIPrefix + sess.ID,
+		ExpiresIn:  int(o.pushedRequestValidityTime.Seconds()),
+	}, nil
+}
+
+// parseAuthorization parses the request to the authorization endpoint. If it
+// references a pushed request, the pushed parameters are used.
+func (o *OIDC) parseAuthorization(req *http.Request) (*authRequest, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "method must be POST or GET"}
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request", Cause: err}
+	}
+
+	ruri := req.Form.Get("request_uri")
+	if !strings.HasPrefix(ruri, pushedRequestURIPrefix) {
+		if o.requirePushedAuthorizationRequests {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "authorization request must be pushed"}
+		}
+		params, err := o.resolveRequestObject(req.Context(), req.Form)
+		if err != nil {
+			return nil, err
+		}
+		return parseAuthRequestValues(params)
+	}
+
+	// pushed requests had any request object resolved when they were pushed.
+	params, err := o.consumePushedRequest(req.Context(), req.Form.Get("client_id"), strings.TrimPrefix(ruri, pushedRequestURIPrefix))
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthRequestValues(params)
+}
+
+// consumePushedRequest returns the parameters of the pushed request. A request
+// can only be used once, so it is removed from storage.
+//
+// https://tools.ietf.org/html/rfc9126#section-4
+func (o *OIDC) consumePushedRequest(ctx context.Context, clientID, sessionID string) (url.Values, error) {
+	sess, err := getSession(ctx, o.smgr, sessionID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get session from storage", Cause: err}
+	}
+	if sess == nil || sess.Stage != sessionStagePushed {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request_uri"}
+	}
+	if sess.ClientID != clientID {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request_uri was issued to a different client"}
+	}
+
+	// an expired request is left for the SessionManager to expire, it may
+	// already consider it gone.
+	if o.now().After(sess.Expiry) {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request_uri has expired"}
+	}
+
+	if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session from storage", Cause: err}
+	}
+
+	return sess.PushedParams, nil
+}
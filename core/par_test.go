@@ -0,0 +1,342 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc/oauth2"
+)
+
+func TestPushedAuthorization(t *testing.T) {
+	const (
+		clientID     = "client"
+		clientSecret = "secret"
+		redirectURI  = "https://redirect"
+	)
+
+	pushParams := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+		"state":         {"pushed-state"},
+	}
+
+	for _, tc := range []struct {
+		Name string
+		// Push modifies the request that is pushed
+		Push func(*pushedAuthRequest)
+		// WantPushErrMatch is checked against the result of pushing. If it
+		// matches, the authorization is not attempted.
+		WantPushErrMatch func(error) bool
+		Advance          time.Duration
+		// AuthParams are the parameters the user is sent to the authorization
+		// endpoint with, in addition to the request_uri
+		AuthParams url.Values
+		// Authorizations is how many times the request_uri is used.
+		Authorizations int
+		RequirePAR     bool
+		// WantAuthErrMatch is checked against the result of the last
+		// authorization. If nil, it should succeed.
+		WantAuthErrMatch func(error) bool
+		// WantAuthErrMessage is the message the last authorization's error
+		// should have, if set.
+		WantAuthErrMessage string
+	}{
+		{
+			Name:           "Pushed request is used",
+			AuthParams:     url.Values{"client_id": {clientID}},
+			Authorizations: 1,
+		},
+		{
+			Name:           "Pushed request is used when required",
+			AuthParams:     url.Values{"client_id": {clientID}},
+			Authorizations: 1,
+			RequirePAR:     true,
+		},
+		{
+			Name:             "Pushed request can only be used once",
+			AuthParams:       url.Values{"client_id": {clientID}},
+			Authorizations:   2,
+			WantAuthErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+		{
+			Name:               "Expired pushed request",
+			AuthParams:         url.Values{"client_id": {clientID}},
+			Advance:            2 * time.Minute,
+			Authorizations:     1,
+			WantAuthErrMatch:   matchHTTPErrStatus(http.StatusBadRequest),
+			WantAuthErrMessage: "request_uri has expired",
+		},
+		{
+			Name:             "Pushed request for a different client",
+			AuthParams:       url.Values{"client_id": {"other"}},
+			Authorizations:   1,
+			WantAuthErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+		{
+			Name: "Bad client credentials",
+			Push: func(preq *pushedAuthRequest) {
+				preq.ClientSecret = "wrong"
+			},
+			WantPushErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidClient),
+		},
+		{
+			Name: "Bad redirect URI",
+			Push: func(preq *pushedAuthRequest) {
+				preq.Params.Set("redirect_uri", "https://other")
+			},
+			WantPushErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+		},
+		{
+			Name: "Invalid authorization request",
+			Push: func(preq *pushedAuthRequest) {
+				preq.Params.Del("response_type")
+			},
+			WantPushErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+		},
+		{
+			Name: "Request not pushed when required",
+			AuthParams: url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+			},
+			Authorizations:   1,
+			RequirePAR:       true,
+			WantAuthErrMatch: matchHTTPErrStatus(http.StatusBadRequest),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			now := time.Now()
+
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+					},
+				},
+
+				authValidityTime:                   1 * time.Minute,
+				pushedRequestValidityTime:          1 * time.Minute,
+				requirePushedAuthorizationRequests: tc.RequirePAR,
+
+				now: func() time.Time { return now },
+			}
+
+			params := url.Values{}
+			for k, v := range pushParams {
+				params[k] = v
+			}
+			preq := &pushedAuthRequest{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Params:       params,
+			}
+			if tc.Push != nil {
+				tc.Push(preq)
+			}
+
+			presp, err := o.pushedAuthorization(context.Background(), preq)
+			if tc.WantPushErrMatch != nil {
+				if err == nil || !tc.WantPushErrMatch(err) {
+					t.Fatalf("want push error to match, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(presp.RequestURI, pushedRequestURIPrefix) {
+				t.Errorf("request_uri %s does not have the expected prefix", presp.RequestURI)
+			}
+			if presp.ExpiresIn != 60 {
+				t.Errorf("want expires_in 60, got %d", presp.ExpiresIn)
+			}
+
+			now = now.Add(tc.Advance)
+
+			aparams := url.Values{}
+			for k, v := range tc.AuthParams {
+				aparams[k] = v
+			}
+			if tc.AuthParams.Get("response_type") == "" {
+				aparams.Set("request_uri", presp.RequestURI)
+			}
+
+			var areq *AuthorizationRequest
+			for i := 0; i < tc.Authorizations; i++ {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/?"+aparams.Encode(), nil)
+				areq, err = o.StartAuthorization(rec, req)
+			}
+
+			if tc.WantAuthErrMatch != nil {
+				if err == nil {
+					t.Fatal("want authorization error, got none")
+				}
+				if !tc.WantAuthErrMatch(errors.Unwrap(err)) {
+					t.Fatalf("want authorization error to match, got %v", err)
+				}
+				var herr *httpError
+				if tc.WantAuthErrMessage != "" && (!errors.As(err, &herr) || herr.Message != tc.WantAuthErrMessage) {
+					t.Fatalf("want authorization error %q, got %v", tc.WantAuthErrMessage, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sess, err := getSession(context.Background(), o.smgr, areq.SessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sess.Request.State != "pushed-state" || sess.Request.RedirectURI != redirectURI {
+				t.Errorf("session was not started with the pushed request: %#v", sess.Request)
+			}
+		})
+	}
+}
+
+func TestParsePushedAuthRequest(t *testing.T) {
+	for _, tc := range []struct {
+		Name        string
+		Req         func() *http.Request
+		WantErrCode oauth2.TokenErrorCode
+		WantParams  url.Values
+	}{
+		{
+			Name: "Client credentials are not stored",
+			Req: func() *http.Request {
+				req := queryReq(map[string]string{
+					"response_type": "code",
+					"redirect_uri":  "https://redirect",
+				})()
+				req.SetBasicAuth("client", "secret")
+				return req
+			},
+			WantParams: url.Values{
+				"client_id":     {"client"},
+				"response_type": {"code"},
+				"redirect_uri":  {"https://redirect"},
+			},
+		},
+		{
+			Name: "request_uri can not be pushed",
+			Req: queryReq(map[string]string{
+				"client_id":     "client",
+				"client_secret": "secret",
+				"request_uri":   pushedRequestURIPrefix + "abc",
+			}),
+			WantErrCode: oauth2.TokenErrorCodeInvalidRequest,
+		},
+		{
+			Name: "Must be POST",
+			Req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/?client_id=client", nil)
+			},
+			WantErrCode: oauth2.TokenErrorCodeInvalidRequest,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			preq, err := parsePushedAuthRequest(tc.Req())
+			if tc.WantErrCode != "" {
+				if !matchTokenErrCode(tc.WantErrCode)(err) {
+					t.Fatalf("want error code %s, got %v", tc.WantErrCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.WantParams, preq.Params); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+// TestPushedRequestURIAsToken checks the session behind a request_uri can't be
+// used with a token, as its ID is known to the client and browser.
+func TestPushedRequestURIAsToken(t *testing.T) {
+	const (
+		clientID     = "client"
+		clientSecret = "secret"
+		redirectURI  = "https://redirect"
+	)
+	ctx := context.Background()
+
+	o := &OIDC{
+		smgr:   newStubSMGR(),
+		signer: testSigner,
+		clients: &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			},
+		},
+
+		pushedRequestValidityTime: 1 * time.Minute,
+
+		now: time.Now,
+	}
+
+	presp, err := o.pushedAuthorization(ctx, &pushedAuthRequest{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Params: url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _, err := newToken(strings.TrimPrefix(presp.RequestURI, pushedRequestURIPrefix), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := mustMarshal(u)
+
+	_, err = o.token(ctx, &tokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         tok,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}, func(*TokenRequest) (*TokenResponse, error) {
+		t.Error("token handler should not be called")
+		return nil, nil
+	})
+	if !matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant)(err) {
+		t.Errorf("want code grant to fail with invalid_grant, got: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("authorization", "Bearer "+tok)
+	if err := o.Userinfo(w, req, func(io.Writer, *UserinfoRequest) error {
+		t.Error("userinfo handler should not be called")
+		return nil
+	}); err == nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("want userinfo to be unauthorized, got status %d: %v", w.Code, err)
+	}
+
+	// the pushed request is still usable.
+	rec := httptest.NewRecorder()
+	areq := httptest.NewRequest(http.MethodGet, "/?"+url.Values{"client_id": {clientID}, "request_uri": {presp.RequestURI}}.Encode(), nil)
+	if _, err := o.StartAuthorization(rec, areq); err != nil {
+		t.Errorf("want pushed request to be usable, got: %v", err)
+	}
+}
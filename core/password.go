@@ -0,0 +1,147 @@
+package core
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// PasswordGrantClientSource can be implemented by a ClientSource to allow
+// clients to use the password grant. If it is not implemented, no client can.
+type PasswordGrantClientSource interface {
+	// ClientAllowPasswordGrant should return true if the client can exchange
+	// a user's username and password for tokens.
+	ClientAllowPasswordGrant(clientID string) (ok bool, err error)
+}
+
+// PasswordRequest details a request to the password grant, for the
+// PasswordAuthenticator to check.
+type PasswordRequest struct {
+	// SessionID of the session tokens will be issued for, if the credentials
+	// are valid. This is passed to the token handler in TokenRequest, as for
+	// sessions from the authorization flow.
+	SessionID string
+	// ClientID the user's credentials were presented by.
+	ClientID string
+	// Username and Password the client presented.
+	Username string
+	Password string
+	// Scopes the client requested.
+	Scopes []string
+}
+
+// PasswordAuthenticator checks the username and password for the password
+// grant. If they are valid, it should return what the session is authorized
+// for, as it would be passed to FinishAuthorization. If the scopes are not
+// set, the requested scopes are granted. If the credentials are invalid, it
+// should return nil and no error - the client is not told why they were
+// rejected, so unknown users can't be distinguished from wrong passwords.
+type PasswordAuthenticator func(ctx context.Context, req *PasswordRequest) (*Authorization, error)
+
+// passwordSession checks the user's credentials, returning a new session
+// authorized for them.
+func (o *OIDC) passwordSession(ctx context.Context, req *tokenRequest) (*sessionV2, error) {
+	if o.passwordAuthenticator == nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnsupportedGrantType, Description: "password grant is not supported"}
+	}
+
+	pgcs, ok := o.clients.(PasswordGrantClientSource)
+	if !ok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not use the password grant"}
+	}
+	allowed, err := pgcs.ClientAllowPasswordGrant(req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client can use the password grant", Cause: err}
+	}
+	if !allowed {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not use the password grant"}
+	}
+
+	scok, err := o.clientScopesAllowed(req.ClientID, req.Password.Scopes)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client scopes", Cause: err}
+	}
+	if !scok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidScope, Description: "client can not request these scopes"}
+	}
+
+	// don't even check the credentials if they're locked out, so guesses
+	// tell the attacker nothing.
+	attemptKeys := loginAttemptKeys(req.Password.Username, req.ClientIP)
+	if o.loginAttemptTracker != nil {
+		for _, k := range attemptKeys {
+			if o.loginAttemptTracker.IsLocked(ctx, k) {
+				o.audit(ctx, AuditEvent{
+					Type:     AuditEventLoginFailure,
+					ClientID: req.ClientID,
+					Scopes:   req.Password.Scopes,
+					Reason:   string(oauth2.TokenErrorCodeInvalidGrant),
+				})
+				return nil, loginLockedError()
+			}
+		}
+	}
+
+	sess := &sessionV2{
+		ID:       o.smgr.NewID(),
+		ClientID: req.ClientID,
+		Request:  &sessAuthRequest{},
+		Expiry:   o.now().Add(o.codeValidityTime),
+	}
+
+	auth, err := o.passwordAuthenticator(ctx, &PasswordRequest{
+		SessionID: sess.ID,
+		ClientID:  req.ClientID,
+		Username:  req.Password.Username,
+		Password:  req.Password.Password,
+		Scopes:    req.Password.Scopes,
+	})
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check password", Cause: err}
+	}
+	if auth == nil {
+		if o.loginAttemptTracker != nil {
+			for _, k := range attemptKeys {
+				o.loginAttemptTracker.RecordFailure(ctx, k)
+			}
+		}
+		o.audit(ctx, AuditEvent{
+			Type:     AuditEventLoginFailure,
+			ClientID: req.ClientID,
+			Scopes:   req.Password.Scopes,
+			Reason:   string(oauth2.TokenErrorCodeInvalidGrant),
+		})
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: "invalid username or password"}
+	}
+
+	if o.loginAttemptTracker != nil {
+		o.loginAttemptTracker.RecordSuccess(ctx, attemptKeys[0])
+	}
+
+	scopes := auth.Scopes
+	if len(scopes) == 0 {
+		scopes = req.Password.Scopes
+	}
+	authTime := auth.AuthTime
+	if authTime.IsZero() {
+		authTime = o.now()
+	}
+	sess.Authorization = &sessAuthorization{
+		Scopes:       scopes,
+		ACR:          auth.ACR,
+		AMR:          auth.AMR,
+		SID:          auth.SID,
+		Subject:      auth.Subject,
+		AuthorizedAt: authTime,
+	}
+
+	o.audit(ctx, AuditEvent{
+		Type:     AuditEventLoginSuccess,
+		ClientID: req.ClientID,
+		Scopes:   scopes,
+		AMR:      auth.AMR,
+	})
+
+	return sess, nil
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordGrant(t *testing.T) {
+	const (
+		clientSecret = "client-secret"
+	)
+
+	users := map[string]string{"alice": "correct horse"}
+
+	var authSessionID string
+	authenticator := func(_ context.Context, req *PasswordRequest) (*Authorization, error) {
+		if pw, ok := users[req.Username]; !ok || pw != req.Password {
+			return nil, nil
+		}
+		authSessionID = req.SessionID
+		return &Authorization{Scopes: req.Scopes, AMR: []string{"pwd"}}, nil
+	}
+
+	for _, tc := range []struct {
+		Name          string
+		Authenticator PasswordAuthenticator
+		ClientID      string
+		Username      string
+		Password      string
+		WantCode      int
+		WantError     string
+	}{
+		{
+			Name:          "Valid credentials",
+			Authenticator: authenticator,
+			ClientID:      "first-party",
+			Username:      "alice",
+			Password:      "correct horse",
+			WantCode:      http.StatusOK,
+		},
+		{
+			Name:          "Wrong password",
+			Authenticator: authenticator,
+			ClientID:      "first-party",
+			Username:      "alice",
+			Password:      "battery staple",
+			WantCode:      http.StatusBadRequest,
+			WantError:     "invalid_grant",
+		},
+		{
+			Name:          "Unknown user",
+			Authenticator: authenticator,
+			ClientID:      "first-party",
+			Username:      "bob",
+			Password:      "correct horse",
+			WantCode:      http.StatusBadRequest,
+			WantError:     "invalid_grant",
+		},
+		{
+			Name:          "Client not allowed",
+			Authenticator: authenticator,
+			ClientID:      "third-party",
+			Username:      "alice",
+			Password:      "correct horse",
+			WantCode:      http.StatusBadRequest,
+			WantError:     "unauthorized_client",
+		},
+		{
+			Name:      "Grant not enabled",
+			ClientID:  "first-party",
+			Username:  "alice",
+			Password:  "correct horse",
+			WantCode:  http.StatusBadRequest,
+			WantError: "unsupported_grant_type",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			authSessionID = ""
+
+			o, err := New(&Config{PasswordAuthenticator: tc.Authenticator}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					"first-party": csClient{Secret: clientSecret, AllowPasswordGrant: true},
+					"third-party": csClient{Secret: clientSecret},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := url.Values{
+				"grant_type": {"password"},
+				"username":   {tc.Username},
+				"password":   {tc.Password},
+				"scope":      {"openid"},
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(tc.ClientID, clientSecret)
+			rec := httptest.NewRecorder()
+
+			var handlerReq *TokenRequest
+			_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+				handlerReq = tr
+				return &TokenResponse{
+					AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+					IDToken:               tr.PrefillIDToken("https://issuer", "alice", time.Now().Add(1*time.Minute)),
+				}, nil
+			})
+
+			if rec.Code != tc.WantCode {
+				t.Fatalf("want status %d, got %d: %s", tc.WantCode, rec.Code, rec.Body.String())
+			}
+
+			var resp struct {
+				Error       string `json:"error"`
+				Description string `json:"error_description"`
+				AccessToken string `json:"access_token"`
+				IDToken     string `json:"id_token"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.WantError != "" {
+				if resp.Error != tc.WantError {
+					t.Errorf("want error %s, got %s", tc.WantError, resp.Error)
+				}
+				if handlerReq != nil {
+					t.Error("handler should not be called")
+				}
+				return
+			}
+
+			if resp.AccessToken == "" || resp.IDToken == "" {
+				t.Errorf("want access and id tokens issued, got %s", rec.Body.String())
+			}
+			if handlerReq.GrantType != GrantTypePassword {
+				t.Errorf("want grant type %s, got %s", GrantTypePassword, handlerReq.GrantType)
+			}
+			if handlerReq.SessionID == "" || handlerReq.SessionID != authSessionID {
+				t.Errorf("want handler session %s to match authenticator's, got %s", authSessionID, handlerReq.SessionID)
+			}
+			if len(handlerReq.Authorization.AMR) != 1 || handlerReq.Authorization.AMR[0] != "pwd" {
+				t.Errorf("want authenticator's authorization passed to handler, got %v", handlerReq.Authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"context"
+)
+
+// PendingAuthorization returns the authorization request the session was
+// started for, for login code that runs after the request to
+// StartAuthorization, e.g when an upstream identity provider redirects back.
+// It can be used for policy decisions during login, like requiring MFA for
+// certain clients, scopes or ACR values. nil is returned if the session has
+// no pending request, because it has expired, or has already been finished
+// or rejected.
+//
+// The request is read from storage on each call, so changing the returned
+// value has no effect. Only what is stored with the session is set: Prompt,
+// LoginHint, UILocales, Display and IDTokenHint are only returned by
+// StartAuthorization.
+func (o *OIDC) PendingAuthorization(ctx context.Context, sessionID string) (*AuthorizationRequest, error) {
+	sess, err := getSession(ctx, o.smgr, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil || sess.Request == nil || sess.Stage != sessionStageRequested || o.now().After(sess.Expiry) {
+		return nil, nil
+	}
+
+	return &AuthorizationRequest{
+		SessionID: sess.ID,
+		ClientID:  sess.ClientID,
+		Scopes:    sess.Request.Scopes,
+		ACRValues: sess.Request.ACRValues,
+		Claims:    sess.Request.Claims,
+		MaxAge:    sess.Request.MaxAge,
+		Resources: sess.Request.Resources,
+
+		IncludeGrantedScopes: sess.Request.IncludeGrantedScopes,
+	}, nil
+}
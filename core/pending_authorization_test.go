@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mfaConnector stands in for login code that requires MFA for some clients.
+// It only has the session ID when the user returns from upstream, so looks up
+// the request.
+type mfaConnector struct {
+	o          *OIDC
+	mfaClients []string
+}
+
+func (m *mfaConnector) requireMFA(ctx context.Context, sessionID string) (*AuthorizationRequest, bool, error) {
+	areq, err := m.o.PendingAuthorization(ctx, sessionID)
+	if err != nil || areq == nil {
+		return nil, false, err
+	}
+	return areq, strsContains(m.mfaClients, areq.ClientID) || strsContains(areq.ACRValues, "mfa"), nil
+}
+
+func TestPendingAuthorization(t *testing.T) {
+	const redirectURI = "https://redirect"
+
+	ctx := context.Background()
+
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			"admin-console": csClient{RedirectURI: redirectURI},
+			"web":           csClient{RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &mfaConnector{o: o, mfaClients: []string{"admin-console"}}
+
+	start := func(t *testing.T, clientID, acrValues string) string {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid profile"},
+		}
+		if acrValues != "" {
+			q.Set("acr_values", acrValues)
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return areq.SessionID
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		ClientID  string
+		ACRValues string
+		WantMFA   bool
+	}{
+		{
+			Name:     "MFA client",
+			ClientID: "admin-console",
+			WantMFA:  true,
+		},
+		{
+			Name:     "Other client",
+			ClientID: "web",
+		},
+		{
+			Name:      "MFA requested",
+			ClientID:  "web",
+			ACRValues: "mfa pwd",
+			WantMFA:   true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			sessID := start(t, tc.ClientID, tc.ACRValues)
+
+			areq, mfa, err := conn.requireMFA(ctx, sessID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if areq == nil {
+				t.Fatal("want pending authorization request")
+			}
+			if areq.SessionID != sessID || areq.ClientID != tc.ClientID {
+				t.Errorf("want session %s for client %s, got: %s for %s", sessID, tc.ClientID, areq.SessionID, areq.ClientID)
+			}
+			if want := []string{"openid", "profile"}; !reflect.DeepEqual(want, areq.Scopes) {
+				t.Errorf("want scopes %v, got: %v", want, areq.Scopes)
+			}
+			if mfa != tc.WantMFA {
+				t.Errorf("want MFA required %t, got: %t", tc.WantMFA, mfa)
+			}
+
+			// it's a copy, the stored request is unchanged.
+			areq.ClientID = "someone-else"
+			areq.Scopes[0] = "admin"
+			again, err := o.PendingAuthorization(ctx, sessID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.ClientID != tc.ClientID || again.Scopes[0] != "openid" {
+				t.Errorf("want stored request unchanged, got: %#v", again)
+			}
+		})
+	}
+
+	t.Run("No longer pending", func(t *testing.T) {
+		sessID := start(t, "web", "")
+		if err := o.FinishAuthorization(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), sessID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{sessID, mustGenerateID()} {
+			areq, err := o.PendingAuthorization(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if areq != nil {
+				t.Errorf("want no pending request for %s, got: %#v", id, areq)
+			}
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		sessID := start(t, "web", "")
+		o.now = func() time.Time { return time.Now().Add(2 * DefaultAuthValidityTime) }
+		defer func() { o.now = time.Now }()
+
+		if areq, err := o.PendingAuthorization(ctx, sessID); err != nil || areq != nil {
+			t.Errorf("want no pending request once expired, got: %#v, %v", areq, err)
+		}
+	})
+}
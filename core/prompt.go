@@ -0,0 +1,85 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prompt is a value of the prompt authorization request parameter.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+type Prompt string
+
+const (
+	// PromptNone means no authentication or consent UI should be shown.
+	PromptNone Prompt = "none"
+	// PromptLogin means the user should be re-authenticated.
+	PromptLogin Prompt = "login"
+	// PromptConsent means the user should be asked for consent before
+	// returning to the client.
+	PromptConsent Prompt = "consent"
+	// PromptSelectAccount means the user should be asked to select an
+	// account, if they have several.
+	PromptSelectAccount Prompt = "select_account"
+)
+
+// Display is a value of the display authorization request parameter, how the
+// client would like the login and consent UI displayed.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+type Display string
+
+const (
+	// DisplayPage means the UI should be a full page view. This is the
+	// default.
+	DisplayPage Display = "page"
+	// DisplayPopup means the UI should suit a popup window.
+	DisplayPopup Display = "popup"
+	// DisplayTouch means the UI should suit a touch interface.
+	DisplayTouch Display = "touch"
+	// DisplayWAP means the UI should suit a feature phone.
+	DisplayWAP Display = "wap"
+)
+
+// parseDisplay parses the display value. Values we don't know are treated as
+// the default, rather than failing the request.
+func parseDisplay(s string) Display {
+	switch Display(s) {
+	case DisplayPopup, DisplayTouch, DisplayWAP:
+		return Display(s)
+	default:
+		return DisplayPage
+	}
+}
+
+// parsePrompt parses the space separated list of prompt values. none can not
+// be combined with any other value.
+func parsePrompt(s string) ([]Prompt, error) {
+	var prompt []Prompt
+	for _, p := range strings.Fields(s) {
+		switch Prompt(p) {
+		case PromptNone, PromptLogin, PromptConsent, PromptSelectAccount:
+			prompt = append(prompt, Prompt(p))
+		default:
+			return nil, fmt.Errorf("unknown prompt value %q", p)
+		}
+	}
+	if len(prompt) > 1 {
+		for _, p := range prompt {
+			if p == PromptNone {
+				return nil, fmt.Errorf("prompt none can not be combined with other values")
+			}
+		}
+	}
+	return prompt, nil
+}
+
+// promptsContain returns true if the prompt values include p.
+func promptsContain(prompt []Prompt, p Prompt) bool {
+	for _, v := range prompt {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
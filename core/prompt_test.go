@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePrompt(t *testing.T) {
+	for _, tc := range []struct {
+		Prompt  string
+		Want    []Prompt
+		WantErr bool
+	}{
+		{Prompt: "none", Want: []Prompt{PromptNone}},
+		{Prompt: "login consent", Want: []Prompt{PromptLogin, PromptConsent}},
+		{Prompt: "select_account", Want: []Prompt{PromptSelectAccount}},
+		{Prompt: "none login", WantErr: true},
+		{Prompt: "consent none", WantErr: true},
+		{Prompt: "bad", WantErr: true},
+	} {
+		t.Run(tc.Prompt, func(t *testing.T) {
+			got, err := parsePrompt(tc.Prompt)
+			if tc.WantErr {
+				if err == nil {
+					t.Fatalf("want error, got: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestSilentAuthorization(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name     string
+		Prompt   string
+		Reject   AuthorizationErrorCode
+		WantCode string
+	}{
+		{
+			Name:     "Login required",
+			Prompt:   "none",
+			Reject:   AuthorizationErrorLoginRequired,
+			WantCode: "login_required",
+		},
+		{
+			Name:     "Consent required",
+			Prompt:   "none",
+			Reject:   AuthorizationErrorConsentRequired,
+			WantCode: "consent_required",
+		},
+		{
+			Name:     "Interaction required",
+			Prompt:   "none",
+			Reject:   AuthorizationErrorInteractionRequired,
+			WantCode: "interaction_required",
+		},
+		{
+			Name:     "none combined with login",
+			Prompt:   "none login",
+			WantCode: "invalid_request",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				smgr: newStubSMGR(),
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID: csClient{RedirectURI: redirectURI},
+					},
+				},
+				authValidityTime: 1 * time.Minute,
+				now:              time.Now,
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"state":         {"state"},
+				"prompt":        {tc.Prompt},
+			}
+
+			rec := httptest.NewRecorder()
+			areq, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if tc.Reject == "" {
+				// the request itself should be rejected
+				if err == nil {
+					t.Fatal("want error starting authorization, got none")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff([]Prompt{PromptNone}, areq.Prompt); diff != "" {
+					t.Errorf("want prompt none on request: %s", diff)
+				}
+
+				rec = httptest.NewRecorder()
+				if err := o.RejectAuthorization(rec, httptest.NewRequest("GET", "/", nil), areq.SessionID, tc.Reject, "user is not logged in"); err != nil {
+					t.Fatal(err)
+				}
+
+				sess, err := getSession(context.Background(), o.smgr, areq.SessionID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sess != nil {
+					t.Error("want session deleted after rejection")
+				}
+			}
+
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("error"); got != tc.WantCode {
+				t.Errorf("want error %s, got: %s", tc.WantCode, got)
+			}
+			if got := loc.Query().Get("state"); got != "state" {
+				t.Errorf("want state returned, got: %s", got)
+			}
+		})
+	}
+}
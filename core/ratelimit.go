@@ -0,0 +1,162 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// RateLimiter can be configured to limit how often the authorization, token
+// and device authorization endpoints can be called. Requests are keyed by the
+// client's IP address as "ip:<address>", and for the token and device
+// authorization endpoints also by the client ID as "client:<client_id>". A
+// request is rejected if any of its keys are not allowed.
+type RateLimiter interface {
+	// Allow should return true if a request for the key can proceed.
+	Allow(ctx context.Context, key string) bool
+}
+
+// rateLimitError is returned when a request was rejected by the RateLimiter.
+// It is written as a HTTP 429, with the token error as the body.
+type rateLimitError struct {
+	TokenError *oauth2.TokenError
+}
+
+func (r *rateLimitError) Error() string {
+	return "rate limited: " + r.TokenError.Error()
+}
+
+func (r *rateLimitError) Unwrap() error {
+	return r.TokenError
+}
+
+// checkIPRateLimit returns an error if requests from the client's IP address
+// should be rejected.
+func (o *OIDC) checkIPRateLimit(req *http.Request) error {
+	return o.checkRateLimit(req.Context(), "ip:"+o.clientIP(req))
+}
+
+// checkClientRateLimit returns an error if requests from the client should be
+// rejected.
+func (o *OIDC) checkClientRateLimit(ctx context.Context, clientID string) error {
+	if clientID == "" {
+		return nil
+	}
+	return o.checkRateLimit(ctx, "client:"+clientID)
+}
+
+func (o *OIDC) checkRateLimit(ctx context.Context, key string) error {
+	if o.rateLimiter == nil || o.rateLimiter.Allow(ctx, key) {
+		return nil
+	}
+	return &rateLimitError{
+		TokenError: &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeSlowDown, Description: "too many requests"},
+	}
+}
+
+// clientIP returns the IP address the request came from. If configured, the
+// address the proxy in front of us appended to X-Forwarded-For is used.
+func (o *OIDC) clientIP(req *http.Request) string {
+	if o.trustForwardedFor {
+		if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			// the last entry was added by our proxy, anything before it was
+			// passed by the client and can't be trusted.
+			hops := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// TokenBucketLimiter is a RateLimiter that gives each key a bucket of burst
+// requests, refilled at one request every interval. State is held in memory,
+// so it only limits requests to this process.
+type TokenBucketLimiter struct {
+	burst    float64
+	interval time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketSweepSize is how many buckets we track before removing ones that
+// are full, and so are the same as not tracking them.
+const tokenBucketSweepSize = 10000
+
+// NewTokenBucketLimiter creates a TokenBucketLimiter, allowing each key burst
+// requests at once, and then one request every interval.
+func NewTokenBucketLimiter(burst int, interval time.Duration) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		burst:    float64(burst),
+		interval: interval,
+		buckets:  map[string]*tokenBucket{},
+		now:      time.Now,
+	}
+}
+
+// SetNow sets the clock used to refill buckets.
+func (t *TokenBucketLimiter) SetNow(now func() time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.now = now
+}
+
+// Allow takes a token from the key's bucket, returning false if it is empty.
+func (t *TokenBucketLimiter) Allow(_ context.Context, key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	if len(t.buckets) >= tokenBucketSweepSize {
+		for k, b := range t.buckets {
+			if t.refill(b, now) >= t.burst {
+				delete(t.buckets, k)
+			}
+		}
+	}
+
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[key] = b
+	}
+	b.tokens = t.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns how many tokens the bucket has at the given time.
+func (t *TokenBucketLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens
+	if t.interval > 0 {
+		tokens += float64(now.Sub(b.last)) / float64(t.interval)
+	}
+	if tokens > t.burst {
+		tokens = t.burst
+	}
+	return tokens
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	l := NewTokenBucketLimiter(3, 1*time.Second)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow(ctx, "key") {
+			t.Fatalf("want request %d in burst allowed", i)
+		}
+	}
+	if l.Allow(ctx, "key") {
+		t.Fatal("want request after burst rejected")
+	}
+	if !l.Allow(ctx, "other-key") {
+		t.Fatal("want other key to have its own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if l.Allow(ctx, "key") {
+		t.Fatal("want request rejected before a token is refilled")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !l.Allow(ctx, "key") {
+		t.Fatal("want request allowed after refill")
+	}
+	if l.Allow(ctx, "key") {
+		t.Fatal("want only one token refilled")
+	}
+
+	// refilling should stop at the burst size
+	now = now.Add(1 * time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.Allow(ctx, "key") {
+			t.Fatalf("want request %d in refilled burst allowed", i)
+		}
+	}
+	if l.Allow(ctx, "key") {
+		t.Fatal("want request after refilled burst rejected")
+	}
+}
+
+type recordingLimiter struct {
+	deny map[string]bool
+	keys []string
+}
+
+func (r *recordingLimiter) Allow(_ context.Context, key string) bool {
+	r.keys = append(r.keys, key)
+	return !r.deny[key]
+}
+
+func TestRateLimitToken(t *testing.T) {
+	for _, tc := range []struct {
+		Name              string
+		TrustForwardedFor bool
+		ForwardedFor      []string
+		Deny              string
+		WantKeys          []string
+		WantLimited       bool
+	}{
+		{
+			Name:        "Limited by IP",
+			Deny:        "ip:192.0.2.1",
+			WantKeys:    []string{"ip:192.0.2.1"},
+			WantLimited: true,
+		},
+		{
+			Name:        "Limited by client",
+			Deny:        "client:client-id",
+			WantKeys:    []string{"ip:192.0.2.1", "client:client-id"},
+			WantLimited: true,
+		},
+		{
+			Name:         "Forwarded for ignored by default",
+			ForwardedFor: []string{"198.51.100.1"},
+			Deny:         "ip:198.51.100.1",
+			WantKeys:     []string{"ip:192.0.2.1", "client:client-id"},
+		},
+		{
+			Name:              "Forwarded for trusted",
+			TrustForwardedFor: true,
+			ForwardedFor:      []string{"203.0.113.9, 198.51.100.1"},
+			Deny:              "ip:198.51.100.1",
+			WantKeys:          []string{"ip:198.51.100.1"},
+			WantLimited:       true,
+		},
+		{
+			Name:              "Last forwarded for header used",
+			TrustForwardedFor: true,
+			ForwardedFor:      []string{"203.0.113.9", "198.51.100.1"},
+			Deny:              "ip:203.0.113.9",
+			WantKeys:          []string{"ip:198.51.100.1", "client:client-id"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			rl := &recordingLimiter{deny: map[string]bool{tc.Deny: true}}
+			o, err := New(&Config{RateLimiter: rl, TrustForwardedFor: tc.TrustForwardedFor}, newStubSMGR(), &stubCS{}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {"client-id"},
+				"refresh_token": {"token"},
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = "192.0.2.1:1234"
+			for _, ff := range tc.ForwardedFor {
+				req.Header.Add("X-Forwarded-For", ff)
+			}
+			rec := httptest.NewRecorder()
+
+			_ = o.Token(rec, req, func(tr *TokenRequest) (*TokenResponse, error) {
+				t.Fatal("handler should not be called")
+				return nil, nil
+			})
+
+			if got := strings.Join(rl.keys, ","); got != strings.Join(tc.WantKeys, ",") {
+				t.Errorf("want keys %v, got %v", tc.WantKeys, rl.keys)
+			}
+
+			if !tc.WantLimited {
+				if rec.Code == http.StatusTooManyRequests {
+					t.Error("request should not have been limited")
+				}
+				return
+			}
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("want status 429, got %d", rec.Code)
+			}
+			var errResp struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &errResp); err != nil {
+				t.Fatal(err)
+			}
+			if errResp.Error != "slow_down" {
+				t.Errorf("want slow_down error, got %s", errResp.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"net"
+	"net/url"
+)
+
+// MatchRedirectURI compares a redirect URI from a request against one
+// registered for the client, for use by ClientSource implementations. URIs
+// must match exactly, as per https://tools.ietf.org/html/rfc3986#section-6.
+//
+// The exception is for public clients with a loopback redirect URI
+// registered. Native apps listen on an ephemeral port, so any port is
+// allowed. Everything else, including the path and query, must still match
+// exactly.
+//
+// https://tools.ietf.org/html/rfc8252#section-7.3
+func MatchRedirectURI(registered, requested string, public bool) bool {
+	if registered == requested {
+		return true
+	}
+	if !public {
+		return false
+	}
+
+	reg, err := url.Parse(registered)
+	if err != nil || !isLoopbackRedirectURI(reg) {
+		return false
+	}
+	req, err := url.Parse(requested)
+	if err != nil || !isLoopbackRedirectURI(req) {
+		return false
+	}
+
+	// ignoring the port, everything should be identical.
+	reg.Host = reg.Hostname()
+	req.Host = req.Hostname()
+	return reg.String() == req.String()
+}
+
+// isLoopbackRedirectURI returns true if the URI is a http URI for the loopback
+// interface. localhost is allowed, although RFC 8252 recommends against it.
+//
+// https://tools.ietf.org/html/rfc8252#section-7.3
+func isLoopbackRedirectURI(u *url.URL) bool {
+	if u.Scheme != "http" || u.Opaque != "" || u.User != nil {
+		return false
+	}
+	h := u.Hostname()
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redirectURISchemeAllowed returns false if HTTPS redirect URIs are required,
+// and the URI is a plain http URI for something other than the loopback
+// interface. Custom schemes used by native apps are unaffected.
+//
+// https://tools.ietf.org/html/rfc8252#section-8.3
+func (o *OIDC) redirectURISchemeAllowed(ru string) bool {
+	if !o.requireHTTPSRedirectURIs {
+		return true
+	}
+	u, err := url.Parse(ru)
+	if err != nil {
+		return false
+	}
+	return u.Scheme != "http" || isLoopbackRedirectURI(u)
+}
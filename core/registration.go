@@ -0,0 +1,315 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pardot/oidc/oauth2"
+	"github.com/pardot/oidc/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	registeredClientIDLen     = 16
+	registeredClientSecretLen = 32
+	registrationTokenLen      = 32
+)
+
+// RegisterClient handles a dynamic client registration request. The authorize
+// function is called with the request and the client's metadata, it should
+// return true if the caller is allowed to register the client, e.g by checking
+// an initial access token. It can also modify the metadata before it is
+// stored. On success the client's ID, secret and registration access token are
+// returned to the caller.
+//
+// The ClientSource must implement MutableClientSource, and
+// Config.RegistrationEndpoint should be set to the URL this handler is served
+// at.
+//
+// https://tools.ietf.org/html/rfc7591#section-3
+func (o *OIDC) RegisterClient(w http.ResponseWriter, req *http.Request, authorize func(req *http.Request, md *ClientMetadata) (ok bool, err error)) error {
+	req = o.withErrorHandler(req)
+
+	mcs, err := o.registrationClientSource()
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	if req.Method != http.MethodPost {
+		herr := &httpError{Code: http.StatusMethodNotAllowed, Message: "method not allowed", CauseMsg: fmt.Sprintf("method %s not allowed", req.Method)}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	crr, err := parseClientMetadata(req)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	ok, err := authorize(req, &crr.ClientMetadata)
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to authorize client registration", Cause: err}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+	if !ok {
+		be := &bearerError{Code: bearerErrorCodeInvalidToken, Description: "not authorized to register clients"}
+		herr := &httpError{Code: http.StatusUnauthorized, Message: "not authorized", WWWAuthenticate: be.String(), CauseMsg: "client registration not authorized"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+	// the handler may have changed the metadata, so make sure it's still
+	// something we can use.
+	if err := validateClientMetadata(&crr.ClientMetadata); err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+	if err := o.validateClientSigningAlgs(req.Context(), &crr.ClientMetadata); err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+	if err := o.validateClientSubjectType(&crr.ClientMetadata); err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+	if err := o.validateClientRedirectURISchemes(&crr.ClientMetadata); err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	resp, err := o.registerClient(req.Context(), mcs, &crr.ClientMetadata)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	if err := writeClientInformationResponse(w, http.StatusCreated, resp); err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	return nil
+}
+
+func (o *OIDC) registerClient(ctx context.Context, mcs MutableClientSource, md *ClientMetadata) (*clientInformationResponse, error) {
+	clientID, err := randomString(registeredClientIDLen)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate client ID", Cause: err}
+	}
+
+	rc := &Client{
+		ID:         clientID,
+		IDIssuedAt: o.now(),
+		Metadata:   *md,
+	}
+	if clientUsesSecret(md) {
+		rc.Secret, err = randomString(registeredClientSecretLen)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate client secret", Cause: err}
+		}
+	}
+	rat, err := o.newRegistrationAccessToken(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mcs.CreateClient(ctx, rc); err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to create client", Cause: err}
+	}
+
+	resp := o.clientInformation(rc)
+	resp.RegistrationAccessToken = rat
+	return resp, nil
+}
+
+// ManageClient handles requests to a registered client's configuration
+// endpoint. The client ID should be extracted from the request path by the
+// caller, the path is expected to be Config.RegistrationEndpoint followed by
+// /<client_id>. Requests must be authenticated with the registration access
+// token issued when the client was registered. GET reads the client's
+// configuration, PUT replaces its metadata and DELETE removes the client.
+//
+// The ClientSource must implement MutableClientSource.
+//
+// https://tools.ietf.org/html/rfc7592#section-2
+func (o *OIDC) ManageClient(w http.ResponseWriter, req *http.Request, clientID string) error {
+	req = o.withErrorHandler(req)
+
+	mcs, err := o.registrationClientSource()
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	rc, err := o.authenticateRegistrationRequest(req, mcs, clientID)
+	if err != nil {
+		_ = writeError(w, req, err)
+		return err
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if err := writeClientInformationResponse(w, http.StatusOK, o.clientInformation(rc)); err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+
+	case http.MethodPut:
+		crr, err := parseClientMetadata(req)
+		if err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+		if err := o.validateClientSigningAlgs(req.Context(), &crr.ClientMetadata); err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+		if err := o.validateClientSubjectType(&crr.ClientMetadata); err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+		if err := o.validateClientRedirectURISchemes(&crr.ClientMetadata); err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+		// https://tools.ietf.org/html/rfc7592#section-2.2
+		if crr.ClientID != rc.ID {
+			terr := &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "client_id does not match"}
+			_ = writeError(w, req, terr)
+			return terr
+		}
+		if crr.ClientSecret != "" && crr.ClientSecret != rc.Secret {
+			terr := &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "client_secret does not match"}
+			_ = writeError(w, req, terr)
+			return terr
+		}
+		rc.Metadata = crr.ClientMetadata
+		switch {
+		case !clientUsesSecret(&rc.Metadata):
+			rc.Secret = ""
+		case rc.Secret == "":
+			rc.Secret, err = randomString(registeredClientSecretLen)
+			if err != nil {
+				herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate client secret", Cause: err}
+				_ = writeError(w, req, herr)
+				return herr
+			}
+		}
+		if err := mcs.UpdateClient(req.Context(), rc); err != nil {
+			herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to update client", Cause: err}
+			_ = writeError(w, req, herr)
+			return herr
+		}
+		if err := writeClientInformationResponse(w, http.StatusOK, o.clientInformation(rc)); err != nil {
+			_ = writeError(w, req, err)
+			return err
+		}
+
+	case http.MethodDelete:
+		if err := mcs.DeleteClient(req.Context(), rc.ID); err != nil {
+			herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete client", Cause: err}
+			_ = writeError(w, req, herr)
+			return herr
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		herr := &httpError{Code: http.StatusMethodNotAllowed, Message: "method not allowed", CauseMsg: fmt.Sprintf("method %s not allowed", req.Method)}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	return nil
+}
+
+// authenticateRegistrationRequest checks the request has a valid registration
+// access token for the client, returning the client if so. Unknown clients
+// are treated the same as invalid tokens, so they can't be probed for.
+//
+// https://tools.ietf.org/html/rfc7592#section-3
+func (o *OIDC) authenticateRegistrationRequest(req *http.Request, mcs MutableClientSource, clientID string) (*Client, error) {
+	authSp := strings.SplitN(req.Header.Get("authorization"), " ", 2)
+	if !strings.EqualFold(authSp[0], "bearer") || len(authSp) != 2 {
+		be := &bearerError{} // no content, just request auth
+		return nil, &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: "malformed Authorization header"}
+	}
+
+	be := &bearerError{Code: bearerErrorCodeInvalidToken, Description: "token not valid"}
+	rc, err := mcs.GetClient(req.Context(), clientID)
+	if err != nil {
+		if storage.IsNotFoundErr(err) {
+			return nil, &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), CauseMsg: "client not found", Cause: err}
+		}
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client", Cause: err}
+	}
+	if err := bcrypt.CompareHashAndPassword(rc.RegistrationAccessTokenHash, []byte(authSp[1])); err != nil {
+		return nil, &httpError{Code: http.StatusUnauthorized, WWWAuthenticate: be.String(), Cause: err}
+	}
+
+	return rc, nil
+}
+
+// newRegistrationAccessToken generates a registration access token for the
+// client, storing its hash on the client.
+func (o *OIDC) newRegistrationAccessToken(rc *Client) (string, error) {
+	rat, err := randomString(registrationTokenLen)
+	if err != nil {
+		return "", &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to generate registration access token", Cause: err}
+	}
+	rc.RegistrationAccessTokenHash, err = bcrypt.GenerateFromPassword([]byte(rat), bcrypt.DefaultCost)
+	if err != nil {
+		return "", &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to hash registration access token", Cause: err}
+	}
+	return rat, nil
+}
+
+// clientInformation builds the response describing the registered client.
+// The registration access token is only returned when it is issued.
+func (o *OIDC) clientInformation(rc *Client) *clientInformationResponse {
+	resp := &clientInformationResponse{
+		ClientMetadata:   rc.Metadata,
+		ClientID:         rc.ID,
+		ClientSecret:     rc.Secret,
+		ClientIDIssuedAt: rc.IDIssuedAt.Unix(),
+	}
+	if rc.Secret != "" {
+		// our secrets don't expire
+		var never int64
+		resp.ClientSecretExpiresAt = &never
+	}
+	if o.registrationEndpoint != "" {
+		resp.RegistrationClientURI = strings.TrimSuffix(o.registrationEndpoint, "/") + "/" + url.PathEscape(rc.ID)
+	}
+	return resp
+}
+
+func (o *OIDC) registrationClientSource() (MutableClientSource, error) {
+	mcs, ok := o.clients.(MutableClientSource)
+	if !ok {
+		return nil, &httpError{Code: http.StatusNotFound, Message: "not found", CauseMsg: "client source is not mutable"}
+	}
+	return mcs, nil
+}
+
+// clientUsesSecret returns true if the client authenticates with a secret we
+// issue.
+func clientUsesSecret(md *ClientMetadata) bool {
+	return md.TokenEndpointAuthMethod == tokenEndpointAuthMethodClientSecretBasic ||
+		md.TokenEndpointAuthMethod == tokenEndpointAuthMethodClientSecretPost ||
+		md.TokenEndpointAuthMethod == tokenEndpointAuthMethodClientSecretJWT
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error reading random data: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
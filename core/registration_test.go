@@ -0,0 +1,274 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type stubMutableCS struct {
+	stubCS
+	registered map[string]*Client
+}
+
+type stubNotFoundErr struct {
+	error
+}
+
+func (*stubNotFoundErr) NotFoundErr() {}
+
+func (s *stubMutableCS) GetClient(_ context.Context, clientID string) (*Client, error) {
+	cl, ok := s.registered[clientID]
+	if !ok {
+		return nil, &stubNotFoundErr{errors.New("client not found")}
+	}
+	return cl, nil
+}
+
+func (s *stubMutableCS) CreateClient(_ context.Context, client *Client) error {
+	s.registered[client.ID] = client
+	return nil
+}
+
+func (s *stubMutableCS) UpdateClient(_ context.Context, client *Client) error {
+	s.registered[client.ID] = client
+	return nil
+}
+
+func (s *stubMutableCS) DeleteClient(_ context.Context, clientID string) error {
+	delete(s.registered, clientID)
+	return nil
+}
+
+func (s *stubMutableCS) ListClients(_ context.Context) ([]*Client, error) {
+	var ret []*Client
+	for _, cl := range s.registered {
+		ret = append(ret, cl)
+	}
+	return ret, nil
+}
+
+func TestRegisterClient(t *testing.T) {
+	const regEndpoint = "https://issuer/register"
+
+	for _, tc := range []struct {
+		Name       string
+		Body       string
+		Authorized bool
+		WantCode   int
+		WantError  string
+	}{
+		{
+			Name:       "Valid registration",
+			Body:       `{"redirect_uris": ["https://client/callback"], "client_name": "test"}`,
+			Authorized: true,
+			WantCode:   http.StatusCreated,
+		},
+		{
+			Name:       "Public client",
+			Body:       `{"redirect_uris": ["https://client/callback"], "token_endpoint_auth_method": "none"}`,
+			Authorized: true,
+			WantCode:   http.StatusCreated,
+		},
+		{
+			Name:       "Not authorized",
+			Body:       `{"redirect_uris": ["https://client/callback"]}`,
+			Authorized: false,
+			WantCode:   http.StatusUnauthorized,
+		},
+		{
+			Name:       "Missing redirect URIs",
+			Body:       `{"client_name": "test"}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_redirect_uri",
+		},
+		{
+			Name:       "Relative redirect URI",
+			Body:       `{"redirect_uris": ["/callback"]}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_redirect_uri",
+		},
+		{
+			Name:       "Redirect URI with fragment",
+			Body:       `{"redirect_uris": ["https://client/callback#frag"]}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_redirect_uri",
+		},
+		{
+			Name:       "private_key_jwt without keys",
+			Body:       `{"redirect_uris": ["https://client/callback"], "token_endpoint_auth_method": "private_key_jwt"}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_client_metadata",
+		},
+		{
+			Name:       "Unsupported ID token signing alg",
+			Body:       `{"redirect_uris": ["https://client/callback"], "id_token_signed_response_alg": "ES256"}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_client_metadata",
+		},
+		{
+			Name:       "Encrypted ID tokens without keys",
+			Body:       `{"redirect_uris": ["https://client/callback"], "id_token_encrypted_response_alg": "RSA-OAEP"}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_client_metadata",
+		},
+		{
+			Name:       "Pairwise without a subject generator",
+			Body:       `{"redirect_uris": ["https://client/callback"], "subject_type": "pairwise"}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_client_metadata",
+		},
+		{
+			Name:       "Pairwise with redirect URIs on many hosts",
+			Body:       `{"redirect_uris": ["https://a/callback", "https://b/callback"], "subject_type": "pairwise"}`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_client_metadata",
+		},
+		{
+			Name:       "Malformed body",
+			Body:       `{`,
+			Authorized: true,
+			WantCode:   http.StatusBadRequest,
+			WantError:  "invalid_client_metadata",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			cs := &stubMutableCS{registered: map[string]*Client{}}
+			o, err := New(&Config{RegistrationEndpoint: regEndpoint}, newStubSMGR(), cs, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/register", strings.NewReader(tc.Body))
+			req.Header.Set("content-type", "application/json")
+			rec := httptest.NewRecorder()
+
+			_ = o.RegisterClient(rec, req, func(_ *http.Request, _ *ClientMetadata) (bool, error) {
+				return tc.Authorized, nil
+			})
+
+			if rec.Code != tc.WantCode {
+				t.Fatalf("want code %d, got %d: %s", tc.WantCode, rec.Code, rec.Body.String())
+			}
+			if tc.WantError != "" {
+				var errResp struct {
+					Error string `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+				if errResp.Error != tc.WantError {
+					t.Errorf("want error %s, got %s", tc.WantError, errResp.Error)
+				}
+			}
+			if tc.WantCode != http.StatusCreated {
+				if len(cs.registered) != 0 {
+					t.Error("client should not have been registered")
+				}
+				return
+			}
+
+			resp := clientInformationResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			rc, ok := cs.registered[resp.ClientID]
+			if !ok {
+				t.Fatalf("client %s not registered", resp.ClientID)
+			}
+			if resp.ClientSecret != rc.Secret {
+				t.Error("returned secret does not match stored secret")
+			}
+			if (resp.ClientSecret == "") != (rc.Metadata.TokenEndpointAuthMethod == "none") {
+				t.Errorf("unexpected secret %q for auth method %s", resp.ClientSecret, rc.Metadata.TokenEndpointAuthMethod)
+			}
+			if resp.RegistrationAccessToken == "" {
+				t.Error("want registration access token")
+			}
+			if want := regEndpoint + "/" + resp.ClientID; resp.RegistrationClientURI != want {
+				t.Errorf("want registration_client_uri %s, got %s", want, resp.RegistrationClientURI)
+			}
+		})
+	}
+}
+
+func TestManageClient(t *testing.T) {
+	cs := &stubMutableCS{registered: map[string]*Client{}}
+	o, err := New(&Config{RegistrationEndpoint: "https://issuer/register"}, newStubSMGR(), cs, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regResp, err := o.registerClient(context.Background(), cs, &ClientMetadata{
+		RedirectURIs:            []string{"https://client/callback"},
+		TokenEndpointAuthMethod: tokenEndpointAuthMethodClientSecretBasic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, token := regResp.ClientID, regResp.RegistrationAccessToken
+
+	do := func(method, tok, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "/register/"+clientID, strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		if tok != "" {
+			req.Header.Set("authorization", "Bearer "+tok)
+		}
+		rec := httptest.NewRecorder()
+		_ = o.ManageClient(rec, req, clientID)
+		return rec
+	}
+
+	if rec := do("GET", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("want unauthenticated read rejected, got %d", rec.Code)
+	}
+	if rec := do("GET", "wrong-token", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("want read with wrong token rejected, got %d", rec.Code)
+	}
+
+	rec := do("GET", token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want read to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	got := clientInformationResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ClientID != clientID || got.RegistrationAccessToken != "" {
+		t.Errorf("unexpected read response: %#v", got)
+	}
+
+	if rec := do("PUT", token, `{"client_id": "other", "redirect_uris": ["https://client/new"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("want update of mismatched client rejected, got %d", rec.Code)
+	}
+	rec = do("PUT", token, `{"client_id": "`+clientID+`", "redirect_uris": ["https://client/new"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want update to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ru := cs.registered[clientID].Metadata.RedirectURIs; len(ru) != 1 || ru[0] != "https://client/new" {
+		t.Errorf("want redirect URIs updated, got: %v", ru)
+	}
+
+	if rec := do("DELETE", token, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("want delete to succeed, got %d", rec.Code)
+	}
+	if _, ok := cs.registered[clientID]; ok {
+		t.Error("want client deleted")
+	}
+	if rec := do("GET", token, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("want read of deleted client rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReplayCache records the IDs of single use values, like the jti of a client
+// assertion or request object, so they can't be replayed within their
+// lifetime.
+type ReplayCache interface {
+	// CheckAndStore should record the id for ttl, returning true if it was not
+	// already recorded. It must be atomic, so only one of several concurrent
+	// calls for the same id is fresh.
+	CheckAndStore(ctx context.Context, id string, ttl time.Duration) (fresh bool, err error)
+}
+
+// MemoryReplayCache is a ReplayCache that holds the IDs in memory, so only
+// detects replays to this process. IDs are evicted once their TTL passes.
+type MemoryReplayCache struct {
+	mu        sync.Mutex
+	expiry    map[string]time.Time
+	nextSweep time.Time
+
+	now func() time.Time
+}
+
+// memoryReplayCacheSweepInterval is how often expired IDs are removed from a
+// MemoryReplayCache.
+const memoryReplayCacheSweepInterval = 1 * time.Minute
+
+// NewMemoryReplayCache creates an empty MemoryReplayCache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		expiry: map[string]time.Time{},
+		now:    time.Now,
+	}
+}
+
+// CheckAndStore records the id until ttl has passed, returning false if it is
+// already recorded.
+func (m *MemoryReplayCache) CheckAndStore(_ context.Context, id string, ttl time.Duration) (fresh bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	if now.After(m.nextSweep) {
+		for k, exp := range m.expiry {
+			if !now.Before(exp) {
+				delete(m.expiry, k)
+			}
+		}
+		m.nextSweep = now.Add(memoryReplayCacheSweepInterval)
+	}
+
+	if exp, ok := m.expiry[id]; ok && now.Before(exp) {
+		return false, nil
+	}
+	m.expiry[id] = now.Add(ttl)
+	return true, nil
+}
+
+// SetNow sets the clock used to expire IDs.
+func (m *MemoryReplayCache) SetNow(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+// checkReplay records the id in the configured ReplayCache, returning false if
+// it has already been used.
+func (o *OIDC) checkReplay(ctx context.Context, id string, ttl time.Duration) (fresh bool, err error) {
+	if o.replayCache == nil {
+		return false, fmt.Errorf("no replay cache configured")
+	}
+	return o.replayCache.CheckAndStore(ctx, id, ttl)
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	c := NewMemoryReplayCache()
+	c.now = func() time.Time { return now }
+
+	for _, step := range []struct {
+		id        string
+		advance   time.Duration
+		wantFresh bool
+	}{
+		{id: "a", wantFresh: true},
+		{id: "a", advance: 10 * time.Second, wantFresh: false},
+		{id: "b", wantFresh: true},
+		// a expires at 30s
+		{id: "a", advance: 19 * time.Second, wantFresh: false},
+		{id: "a", advance: 1 * time.Second, wantFresh: true},
+	} {
+		now = now.Add(step.advance)
+		fresh, err := c.CheckAndStore(ctx, step.id, 30*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh != step.wantFresh {
+			t.Errorf("%s after %s: want fresh %t, got: %t", step.id, step.advance, step.wantFresh, fresh)
+		}
+	}
+
+	// expired IDs are swept out
+	now = now.Add(2 * memoryReplayCacheSweepInterval)
+	if _, err := c.CheckAndStore(ctx, "c", 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.expiry) != 1 {
+		t.Errorf("want expired IDs evicted, got: %v", c.expiry)
+	}
+}
+
+func TestDefaultReplayCache(t *testing.T) {
+	ctx := context.Background()
+
+	smgr := newStubSMGR()
+	o, err := New(&Config{}, smgr, &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []bool{true, false} {
+		fresh, err := o.checkReplay(ctx, "jti", 1*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh != want {
+			t.Errorf("want fresh %t, got: %t", want, fresh)
+		}
+	}
+
+	// IDs must not be stored as sessions, where they could be loaded in
+	// place of one.
+	if len(smgr.sessions) != 0 {
+		t.Errorf("want no sessions stored, got: %d", len(smgr.sessions))
+	}
+}
+
+func TestReplayConcurrent(t *testing.T) {
+	const (
+		clientID = "client-id"
+		issuer   = "https://issuer"
+		attempts = 20
+	)
+
+	key := mustGenRSAKey(512)
+
+	sign := func(t *testing.T, claims map[string]interface{}) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: key, KeyID: "client-key"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	o := &OIDC{
+		smgr: newStubSMGR(),
+		clients: &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{
+					JWKS: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+						{Key: key.Public(), KeyID: "client-key", Algorithm: "RS256", Use: "sig"},
+					}},
+				},
+			},
+		},
+		issuer:      issuer,
+		replayCache: NewMemoryReplayCache(),
+		now:         time.Now,
+	}
+
+	// countFresh runs use concurrently, returning how many calls succeeded.
+	countFresh := func(t *testing.T, use func() bool) int {
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			fresh int
+		)
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if use() {
+					mu.Lock()
+					fresh++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return fresh
+	}
+
+	t.Run("Client assertion", func(t *testing.T) {
+		assertion := sign(t, map[string]interface{}{
+			"iss": clientID,
+			"sub": clientID,
+			"aud": issuer,
+			"exp": time.Now().Add(1 * time.Minute).Unix(),
+			"jti": mustGenerateID(),
+		})
+
+		n := countFresh(t, func() bool {
+			ok, err := o.verifyClientAssertion(context.Background(), clientID, assertion)
+			if err != nil {
+				t.Error(err)
+			}
+			return ok
+		})
+		if n != 1 {
+			t.Errorf("want exactly 1 use of the assertion accepted, got: %d", n)
+		}
+	})
+
+	t.Run("Request object", func(t *testing.T) {
+		params := url.Values{
+			"client_id": {clientID},
+			"request": {sign(t, map[string]interface{}{
+				"iss":           clientID,
+				"aud":           issuer,
+				"exp":           time.Now().Add(1 * time.Minute).Unix(),
+				"jti":           mustGenerateID(),
+				"client_id":     clientID,
+				"response_type": "code",
+			})},
+		}
+
+		n := countFresh(t, func() bool {
+			_, err := o.resolveRequestObject(context.Background(), params)
+			return err == nil
+		})
+		if n != 1 {
+			t.Errorf("want exactly 1 use of the request object accepted, got: %d", n)
+		}
+	})
+}
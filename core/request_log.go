@@ -0,0 +1,238 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// redacted replaces sensitive values in RequestLogEntries.
+const redacted = "REDACTED"
+
+// redactedParams are the query and form parameters that carry secrets,
+// credentials or tokens, and are never logged.
+var redactedParams = map[string]bool{
+	"access_token":              true,
+	"actor_token":               true,
+	"assertion":                 true,
+	"client_assertion":          true,
+	"client_secret":             true,
+	"code":                      true,
+	"code_verifier":             true,
+	"device_code":               true,
+	"id_token":                  true,
+	"id_token_hint":             true,
+	"logout_token":              true,
+	"password":                  true,
+	"refresh_token":             true,
+	"registration_access_token": true,
+	"request":                   true,
+	"subject_token":             true,
+	"token":                     true,
+}
+
+// redactedHeaders are the request headers that carry credentials.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "DPoP"}
+
+// maxLoggedErrorBody is how much of an error response is buffered to find the
+// error code in.
+const maxLoggedErrorBody = 4096
+
+// RequestLogEntry describes a request handled by LogRequests. Secrets,
+// credentials and tokens are replaced with "REDACTED" in the query, form and
+// header.
+type RequestLogEntry struct {
+	Method string
+	Path   string
+	Query  url.Values
+	// Form is the url-encoded request body, if there was one.
+	Form   url.Values
+	Header http.Header
+	// Status code of the response.
+	Status  int
+	Latency time.Duration
+	// ClientID is taken from the basic auth credentials, or the client_id
+	// parameter.
+	ClientID string
+	// ErrorCode is the OAuth2 error code of the response, if it returned one
+	// in the body or a redirect.
+	ErrorCode string
+}
+
+// String formats the entry as a single log line. Headers are omitted.
+func (e RequestLogEntry) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "method=%s path=%s status=%d latency=%s", e.Method, e.Path, e.Status, e.Latency)
+	if e.ClientID != "" {
+		fmt.Fprintf(&sb, " client_id=%q", e.ClientID)
+	}
+	if e.ErrorCode != "" {
+		fmt.Fprintf(&sb, " error=%s", e.ErrorCode)
+	}
+	if len(e.Query) > 0 {
+		fmt.Fprintf(&sb, " query=%q", e.Query.Encode())
+	}
+	if len(e.Form) > 0 {
+		fmt.Fprintf(&sb, " form=%q", e.Form.Encode())
+	}
+	return sb.String()
+}
+
+// RequestLogger can be configured to receive a RequestLogEntry for each
+// request handled by LogRequests. It is called after the response has been
+// written.
+type RequestLogger func(entry RequestLogEntry)
+
+// LogRequests wraps h, logging each request it handles to the configured
+// RequestLogger. It is intended for debugging, so should be opt-in. If no
+// RequestLogger is configured, h is returned as-is.
+func (o *OIDC) LogRequests(h http.Handler) http.Handler {
+	if o.requestLogger == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := o.now()
+
+		entry := RequestLogEntry{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  redactParams(req.URL.Query()),
+			Header: redactHeader(req.Header),
+		}
+
+		var params url.Values
+		if req.Body != nil && isFormRequest(req) {
+			body, err := ioutil.ReadAll(req.Body)
+			_ = req.Body.Close()
+			// the handler gets the same body back, including any read error
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if err == nil {
+				params, _ = url.ParseQuery(string(body))
+			}
+		}
+		entry.Form = redactParams(params)
+		entry.ClientID = requestLogClientID(req, params)
+
+		rw := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, req)
+
+		entry.Status = rw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Latency = o.now().Sub(start)
+		entry.ErrorCode = rw.errorCode()
+
+		o.requestLogger(entry)
+	})
+}
+
+func isFormRequest(req *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mt == "application/x-www-form-urlencoded"
+}
+
+func requestLogClientID(req *http.Request, form url.Values) string {
+	if u, _, ok := req.BasicAuth(); ok {
+		if cid, err := url.QueryUnescape(u); err == nil {
+			return cid
+		}
+		return u
+	}
+	if cid := form.Get("client_id"); cid != "" {
+		return cid
+	}
+	return req.URL.Query().Get("client_id")
+}
+
+func redactParams(v url.Values) url.Values {
+	if len(v) == 0 {
+		return nil
+	}
+	ret := make(url.Values, len(v))
+	for k, vs := range v {
+		if redactedParams[k] {
+			ret[k] = []string{redacted}
+			continue
+		}
+		ret[k] = vs
+	}
+	return ret
+}
+
+func redactHeader(h http.Header) http.Header {
+	ret := h.Clone()
+	for _, k := range redactedHeaders {
+		if _, ok := ret[http.CanonicalHeaderKey(k)]; ok {
+			ret.Set(k, redacted)
+		}
+	}
+	return ret
+}
+
+// loggingResponseWriter captures the status of the response, and the start of
+// the body for errors, so the error code can be logged.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (l *loggingResponseWriter) WriteHeader(code int) {
+	if l.status == 0 {
+		l.status = code
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *loggingResponseWriter) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	if l.status >= 400 && l.body.Len() < maxLoggedErrorBody {
+		n := len(b)
+		if rem := maxLoggedErrorBody - l.body.Len(); n > rem {
+			n = rem
+		}
+		l.body.Write(b[:n])
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+func (l *loggingResponseWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// errorCode returns the OAuth2 error code from the JSON error body, or the
+// redirect the error was returned to the client in.
+func (l *loggingResponseWriter) errorCode() string {
+	if loc := l.Header().Get("Location"); loc != "" {
+		if u, err := url.Parse(loc); err == nil {
+			if e := u.Query().Get("error"); e != "" {
+				return e
+			}
+			if fq, err := url.ParseQuery(u.Fragment); err == nil {
+				return fq.Get("error")
+			}
+		}
+		return ""
+	}
+	if l.body.Len() == 0 {
+		return ""
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(l.body.Bytes(), &resp); err != nil {
+		return ""
+	}
+	return resp.Error
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLogRequests(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "very-secret-value"
+		code         = "secret-auth-code"
+	)
+
+	var lines []string
+	var entries []RequestLogEntry
+	o, err := New(&Config{
+		RequestLogger: func(e RequestLogEntry) {
+			entries = append(entries, e)
+			lines = append(lines, e.String())
+		},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: "https://redirect"},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handlerForm url.Values
+	h := o.LogRequests(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		handlerForm = req.PostForm
+		_ = o.Token(w, req, func(*TokenRequest) (*TokenResponse, error) {
+			t.Fatal("handler should not be called for a malformed code")
+			return nil, nil
+		})
+	}))
+
+	body := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://redirect"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+	}
+	req := httptest.NewRequest("POST", "/token?password="+clientSecret, strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+clientSecret)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if handlerForm.Get("client_secret") != clientSecret {
+		t.Errorf("want the handler to get the unmodified body, got: %v", handlerForm)
+	}
+
+	if len(lines) != 1 {
+		t.Fatalf("want 1 line logged, got: %v", lines)
+	}
+	line := lines[0]
+	for _, want := range []string{"method=POST", "path=/token", "status=400", `client_id="client-id"`, "error=invalid_request"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("want %s in log line, got: %s", want, line)
+		}
+	}
+	for _, secret := range []string{clientSecret, code} {
+		if strings.Contains(line, secret) {
+			t.Errorf("log line contains secret %s: %s", secret, line)
+		}
+	}
+
+	e := entries[0]
+	if e.Form.Get("client_secret") != redacted || e.Form.Get("code") != redacted || e.Query.Get("password") != redacted {
+		t.Errorf("want secrets redacted, got form %v, query %v", e.Form, e.Query)
+	}
+	if e.Form.Get("grant_type") != "authorization_code" {
+		t.Errorf("want other params logged, got: %v", e.Form)
+	}
+	if e.Header.Get("Authorization") != redacted {
+		t.Errorf("want authorization header redacted, got: %s", e.Header.Get("Authorization"))
+	}
+	if req.Header.Get("Authorization") == redacted {
+		t.Error("request header should not be modified")
+	}
+}
@@ -0,0 +1,244 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// requestURIFetchTimeout bounds how long we wait for a client to serve
+	// the request object referenced by a request_uri.
+	requestURIFetchTimeout = 5 * time.Second
+	// requestObjectMaxSize is the largest request object we'll accept from a
+	// request_uri.
+	requestObjectMaxSize = 64 << 10
+)
+
+// RequestObjectClientSource can be implemented by a ClientSource to allow
+// clients to pass their authorization request parameters in a signed request
+// object. The client's keys are retrieved via ClientJWKSSource, which must also
+// be implemented.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#JWTRequests
+type RequestObjectClientSource interface {
+	// ClientRequestObjectSigningAlg should return the algorithm the client's
+	// request objects must be signed with. If empty, any algorithm the
+	// client's keys support is accepted. Unsigned request objects are never
+	// accepted.
+	ClientRequestObjectSigningAlg(clientID string) (jose.SignatureAlgorithm, error)
+	// ValidateClientRequestURI should confirm if the request object can be
+	// fetched from the given URI for the client. Generally these should be
+	// registered with the client, to avoid fetching arbitrary URLs.
+	ValidateClientRequestURI(clientID, requestURI string) (ok bool, err error)
+}
+
+// resolveRequestObject returns the authorization request parameters, with any
+// passed in a request object via the request or request_uri parameter merged
+// in. Parameters in the request object take precedence, however client_id and
+// response_type must match if passed in both.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#RequestObject
+// https://openid.net/specs/openid-connect-core-1_0.html#RequestUriParameter
+func (o *OIDC) resolveRequestObject(ctx context.Context, params url.Values) (url.Values, error) {
+	reqObj := params.Get("request")
+	reqURI := params.Get("request_uri")
+	if reqObj == "" && reqURI == "" {
+		return params, nil
+	}
+	if reqObj != "" && reqURI != "" {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request and request_uri can not both be passed"}
+	}
+
+	clientID := params.Get("client_id")
+	if clientID == "" {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "client_id is required"}
+	}
+
+	rcs, ok := o.clients.(RequestObjectClientSource)
+	if !ok {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request objects are not supported"}
+	}
+
+	if reqURI != "" {
+		uriok, err := rcs.ValidateClientRequestURI(clientID, reqURI)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "error calling clientsource request URI validation", Cause: err}
+		}
+		if !uriok {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request_uri"}
+		}
+		reqObj, err = fetchRequestObject(ctx, reqURI)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "failed to fetch request_uri", Cause: err}
+		}
+	}
+
+	claims, err := o.verifyRequestObject(ctx, rcs, clientID, reqObj)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := url.Values{}
+	for k, v := range params {
+		if k == "request" || k == "request_uri" {
+			continue
+		}
+		merged[k] = v
+	}
+	for k, v := range claims {
+		switch k {
+		case "iss", "aud", "exp", "iat", "nbf", "jti":
+			// these describe the request object itself
+			continue
+		case "client_id", "response_type":
+			if pv := params.Get(k); pv != "" && pv != v {
+				return nil, &httpError{Code: http.StatusBadRequest, Message: k + " does not match request object"}
+			}
+		case "request", "request_uri":
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "request object must not contain " + k}
+		}
+		merged.Set(k, v)
+	}
+
+	return merged, nil
+}
+
+// verifyRequestObject checks the request object is signed by the client, and
+// returns its claims as authorization request parameters.
+func (o *OIDC) verifyRequestObject(ctx context.Context, rcs RequestObjectClientSource, clientID, reqObj string) (map[string]string, error) {
+	ks, ok := o.clients.(ClientJWKSSource)
+	if !ok {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request objects are not supported"}
+	}
+	jwks, err := ks.ClientJWKS(clientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client keys", Cause: err}
+	}
+	if jwks == nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "client has no keys to verify request object"}
+	}
+	wantAlg, err := rcs.ClientRequestObjectSigningAlg(clientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client request object signing alg", Cause: err}
+	}
+
+	jws, err := jose.ParseSigned(reqObj)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request object", Cause: err}
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request object"}
+	}
+	hdr := jws.Signatures[0].Header
+	if wantAlg != "" && hdr.Algorithm != string(wantAlg) {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request object signed with unexpected algorithm"}
+	}
+
+	keys := jwks.Keys
+	if hdr.KeyID != "" {
+		keys = jwks.Key(hdr.KeyID)
+	}
+	var payload []byte
+	for _, k := range keys {
+		if k.IsPublic() && k.Use != "enc" {
+			if payload, err = jws.Verify(k); err == nil {
+				break
+			}
+		}
+	}
+	if payload == nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request object signature is invalid"}
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request object", Cause: err}
+	}
+
+	// the JWT claims are optional, but if present must be valid.
+	cl := oidc.Claims{}
+	if err := json.Unmarshal(payload, &cl); err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "invalid request object", Cause: err}
+	}
+	if cl.Issuer != "" && cl.Issuer != clientID {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request object issuer is not the client"}
+	}
+	if iss := o.issuerFrom(ctx); len(cl.Audience) > 0 && iss != "" && !cl.Audience.Contains(iss) {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request object audience is invalid"}
+	}
+	if cl.Expiry != 0 && o.now().After(cl.Expiry.Time()) {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: "request object has expired"}
+	}
+	if jti, _ := cl.Extra["jti"].(string); jti != "" {
+		// without an expiry, it could only be used for as long as the
+		// authorization it starts.
+		ttl := o.authValidityTime
+		if cl.Expiry != 0 {
+			ttl = cl.Expiry.Time().Sub(o.now())
+		}
+		fresh, err := o.checkReplay(ctx, "request_object_jti/"+clientID+"/"+jti, ttl)
+		if err != nil {
+			return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check request object jti", Cause: err}
+		}
+		if !fresh {
+			return nil, &httpError{Code: http.StatusBadRequest, Message: "request object has already been used"}
+		}
+	}
+
+	claims := map[string]string{}
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			claims[k] = s
+			continue
+		}
+		// non-string values (e.g claims, max_age) are passed on in their
+		// JSON form, as they would be as a query parameter.
+		claims[k] = string(bytes.TrimSpace(v))
+	}
+
+	return claims, nil
+}
+
+// fetchRequestObject retrieves the request object the client is serving at the
+// request_uri.
+func fetchRequestObject(ctx context.Context, requestURI string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestURIFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
+	if err != nil {
+		return "", fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt, application/jwt")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %w", requestURI, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: status %d", requestURI, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, requestObjectMaxSize+1))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", requestURI, err)
+	}
+	if len(b) > requestObjectMaxSize {
+		return "", fmt.Errorf("request object at %s exceeds %d bytes", requestURI, requestObjectMaxSize)
+	}
+
+	return string(bytes.TrimSpace(b)), nil
+}
@@ -0,0 +1,288 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestResolveRequestObject(t *testing.T) {
+	const (
+		clientID = "client"
+		issuer   = "https://issuer"
+	)
+
+	key := mustGenRSAKey(512)
+	otherKey := mustGenRSAKey(512)
+
+	sign := func(t *testing.T, k interface{}, claims map[string]interface{}) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: k, KeyID: "client-key"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":           clientID,
+			"aud":           issuer,
+			"exp":           time.Now().Add(1 * time.Minute).Unix(),
+			"client_id":     clientID,
+			"response_type": "code",
+			"redirect_uri":  "https://redirect",
+			"scope":         "openid",
+			"state":         "object-state",
+			"max_age":       60,
+		}
+	}
+
+	var served string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(served))
+	}))
+	defer ts.Close()
+
+	newCS := func(alg jose.SignatureAlgorithm) *stubCS {
+		return &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{
+					JWKS: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+						{Key: key.Public(), KeyID: "client-key", Algorithm: "RS256", Use: "sig"},
+					}},
+					RequestObjectSigningAlg: alg,
+					RequestURI:              ts.URL + "/request.jwt",
+				},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		Name       string
+		Params     func(t *testing.T) url.Values
+		Served     func(t *testing.T) string
+		SigningAlg jose.SignatureAlgorithm
+		WantErr    bool
+		Want       url.Values
+	}{
+		{
+			Name: "No request object",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{"client_id": {clientID}, "state": {"query-state"}}
+			},
+			Want: url.Values{"client_id": {clientID}, "state": {"query-state"}},
+		},
+		{
+			Name: "Request object overrides parameters",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id": {clientID},
+					"state":     {"query-state"},
+					"request":   {sign(t, key, validClaims())},
+				}
+			},
+			Want: url.Values{
+				"client_id":     {clientID},
+				"response_type": {"code"},
+				"redirect_uri":  {"https://redirect"},
+				"scope":         {"openid"},
+				"state":         {"object-state"},
+				"max_age":       {"60"},
+			},
+		},
+		{
+			Name: "Request object fetched from request_uri",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id":   {clientID},
+					"request_uri": {ts.URL + "/request.jwt"},
+				}
+			},
+			Served: func(t *testing.T) string {
+				return sign(t, key, validClaims())
+			},
+			Want: url.Values{
+				"client_id":     {clientID},
+				"response_type": {"code"},
+				"redirect_uri":  {"https://redirect"},
+				"scope":         {"openid"},
+				"state":         {"object-state"},
+				"max_age":       {"60"},
+			},
+		},
+		{
+			Name: "Unregistered request_uri",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id":   {clientID},
+					"request_uri": {ts.URL + "/other.jwt"},
+				}
+			},
+			Served: func(t *testing.T) string {
+				return sign(t, key, validClaims())
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Oversized request_uri response",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id":   {clientID},
+					"request_uri": {ts.URL + "/request.jwt"},
+				}
+			},
+			Served: func(t *testing.T) string {
+				return strings.Repeat("a", requestObjectMaxSize+1)
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Signed by the wrong key",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id": {clientID},
+					"request":   {sign(t, otherKey, validClaims())},
+				}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Signed with the wrong alg",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id": {clientID},
+					"request":   {sign(t, key, validClaims())},
+				}
+			},
+			SigningAlg: jose.ES256,
+			WantErr:    true,
+		},
+		{
+			Name: "Mismatched client_id",
+			Params: func(t *testing.T) url.Values {
+				cl := validClaims()
+				cl["client_id"] = "other"
+				return url.Values{
+					"client_id": {clientID},
+					"request":   {sign(t, key, cl)},
+				}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Mismatched response_type",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id":     {clientID},
+					"response_type": {"token"},
+					"request":       {sign(t, key, validClaims())},
+				}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Expired request object",
+			Params: func(t *testing.T) url.Values {
+				cl := validClaims()
+				cl["exp"] = time.Now().Add(-1 * time.Minute).Unix()
+				return url.Values{
+					"client_id": {clientID},
+					"request":   {sign(t, key, cl)},
+				}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Wrong audience",
+			Params: func(t *testing.T) url.Values {
+				cl := validClaims()
+				cl["aud"] = "https://other"
+				return url.Values{
+					"client_id": {clientID},
+					"request":   {sign(t, key, cl)},
+				}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Both request and request_uri",
+			Params: func(t *testing.T) url.Values {
+				return url.Values{
+					"client_id":   {clientID},
+					"request":     {sign(t, key, validClaims())},
+					"request_uri": {ts.URL + "/request.jwt"},
+				}
+			},
+			WantErr: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			served = ""
+			if tc.Served != nil {
+				served = tc.Served(t)
+			}
+
+			o := &OIDC{
+				smgr:    newStubSMGR(),
+				clients: newCS(tc.SigningAlg),
+				issuer:  issuer,
+				now:     time.Now,
+			}
+
+			got, err := o.resolveRequestObject(context.Background(), tc.Params(t))
+			if tc.WantErr {
+				if err == nil {
+					t.Fatalf("want error, got params: %v", got)
+				}
+				if !matchHTTPErrStatus(http.StatusBadRequest)(err) {
+					t.Fatalf("want bad request error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestFetchRequestObjectTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := fetchRequestObject(ctx, ts.URL); err == nil {
+		t.Fatal("want error fetching from a server that never responds")
+	}
+}
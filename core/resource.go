@@ -0,0 +1,101 @@
+package core
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+// ResourceClientSource can be implemented by a ClientSource to let clients
+// request tokens for specific resource servers, with the resource parameter.
+// The issued access token's audience is the requested resources. If it is not
+// implemented, requests for a resource are rejected with invalid_target.
+//
+// https://tools.ietf.org/html/rfc8707
+type ResourceClientSource interface {
+	// ClientAllowedResources returns the resource indicators the client can
+	// request tokens for. These are absolute URIs, compared exactly.
+	ClientAllowedResources(clientID string) (resources []string, err error)
+}
+
+// validResourceIndicator checks the resource is an absolute URI without a
+// fragment.
+//
+// https://tools.ietf.org/html/rfc8707#section-2
+func validResourceIndicator(resource string) bool {
+	u, err := url.Parse(resource)
+	return err == nil && u.IsAbs() && !strings.Contains(resource, "#")
+}
+
+// clientResourcesAllowed checks all the requested resources are valid, and
+// allowed for the client.
+func (o *OIDC) clientResourcesAllowed(clientID string, resources []string) (bool, error) {
+	if len(resources) == 0 {
+		return true, nil
+	}
+	for _, r := range resources {
+		if !validResourceIndicator(r) {
+			return false, nil
+		}
+	}
+	rcs, ok := o.clients.(ResourceClientSource)
+	if !ok {
+		return false, nil
+	}
+	allowed, err := rcs.ClientAllowedResources(clientID)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources {
+		if !strsContains(allowed, r) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// tokenResources returns the resources a token endpoint request for the
+// session is for. If the request names none, the token is for all those
+// granted by the authorization. Otherwise they must be a subset of those
+// granted, or if the authorization was not for specific resources, allowed for
+// the client.
+//
+// https://tools.ietf.org/html/rfc8707#section-2.2
+func (o *OIDC) tokenResources(req *tokenRequest, sess *sessionV2) ([]string, error) {
+	var granted []string
+	if sess.Request != nil {
+		granted = sess.Request.Resources
+	}
+	if len(req.Resources) == 0 {
+		return granted, nil
+	}
+
+	if len(granted) > 0 {
+		for _, r := range req.Resources {
+			if !strsContains(granted, r) {
+				return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidTarget, Description: "resource was not granted"}
+			}
+		}
+		return req.Resources, nil
+	}
+
+	if err := o.checkClientResources(req.ClientID, req.Resources); err != nil {
+		return nil, err
+	}
+	return req.Resources, nil
+}
+
+// checkClientResources returns a token endpoint error if the client can't
+// request tokens for the resources.
+func (o *OIDC) checkClientResources(clientID string, resources []string) error {
+	ok, err := o.clientResourcesAllowed(clientID, resources)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check client resources", Cause: err}
+	}
+	if !ok {
+		return &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidTarget, Description: "client can not request tokens for this resource"}
+	}
+	return nil
+}
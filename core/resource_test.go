@@ -0,0 +1,259 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestResourceIndicators(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+
+		apiA = "https://a.example.com"
+		apiB = "https://b.example.com/api"
+	)
+
+	ctx := context.Background()
+
+	newOIDC := func(t *testing.T) *OIDC {
+		t.Helper()
+		o, err := New(&Config{}, newStubSMGR(), &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{
+					Secret:                 clientSecret,
+					RedirectURI:            redirectURI,
+					AllowClientCredentials: true,
+					AllowedResources:       []string{apiA, apiB},
+				},
+			},
+		}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	authorize := func(t *testing.T, o *OIDC, resources ...string) (*AuthorizationRequest, *httptest.ResponseRecorder, error) {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+			"state":         {"state"},
+			"resource":      resources,
+		}
+		rec := httptest.NewRecorder()
+		areq, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		return areq, rec, err
+	}
+
+	code := func(t *testing.T, o *OIDC, areq *AuthorizationRequest) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query().Get("code")
+	}
+
+	handler := func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+			IDToken:               tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	}
+
+	introspectAud := func(t *testing.T, o *OIDC, token string) interface{} {
+		t.Helper()
+		resp, err := o.introspect(ctx, &tokenHintRequest{Token: token, ClientID: clientID, ClientSecret: clientSecret}, func(_ *IntrospectionRequest) (*IntrospectionResponse, error) {
+			return &IntrospectionResponse{}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp["active"] != true {
+			t.Fatalf("want active token, got: %v", resp)
+		}
+		return resp["aud"]
+	}
+
+	t.Run("disallowed resource at authorization", func(t *testing.T) {
+		o := newOIDC(t)
+		for _, res := range []string{"https://other.example.com", "not-absolute", "https://a.example.com#frag"} {
+			_, rec, err := authorize(t, o, apiA, res)
+			if err == nil {
+				t.Fatalf("%s: want error", res)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("error"); got != "invalid_target" {
+				t.Errorf("%s: want invalid_target, got: %q", res, got)
+			}
+			if got := loc.Query().Get("state"); got != "state" {
+				t.Errorf("%s: want state returned, got: %q", res, got)
+			}
+		}
+	})
+
+	t.Run("audience ordering", func(t *testing.T) {
+		o := newOIDC(t)
+		areq, _, err := authorize(t, o, apiB, apiA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{apiB, apiA}, areq.Resources); diff != "" {
+			t.Errorf("unexpected requested resources: %s", diff)
+		}
+
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         code(t, o, areq),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := testSigner.VerifySignature(ctx, tresp.ExtraParams["id_token"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cl oidc.Claims
+		if err := json.Unmarshal(payload, &cl); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(oidc.Audience{clientID, apiB, apiA}, cl.Audience); diff != "" {
+			t.Errorf("unexpected id token aud: %s", diff)
+		}
+		if cl.AZP != clientID {
+			t.Errorf("want azp %s, got: %s", clientID, cl.AZP)
+		}
+
+		if diff := cmp.Diff(oidc.Audience{apiB, apiA}, introspectAud(t, o, tresp.AccessToken)); diff != "" {
+			t.Errorf("unexpected access token aud: %s", diff)
+		}
+	})
+
+	t.Run("token downscoped to a granted resource", func(t *testing.T) {
+		o := newOIDC(t)
+		areq, _, err := authorize(t, o, apiA, apiB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         code(t, o, areq),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Resources:    []string{apiB},
+		}, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(oidc.Audience{apiB}, introspectAud(t, o, tresp.AccessToken)); diff != "" {
+			t.Errorf("unexpected access token aud: %s", diff)
+		}
+	})
+
+	t.Run("token for a resource not granted", func(t *testing.T) {
+		o := newOIDC(t)
+		areq, _, err := authorize(t, o, apiA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code(t, o, areq)},
+			"redirect_uri": {redirectURI},
+			"resource":     {apiB},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		rec := httptest.NewRecorder()
+		if err := o.Token(rec, req, handler); err == nil {
+			t.Fatal("want error")
+		}
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("want 400, got: %d", rec.Code)
+		}
+		var terr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&terr); err != nil {
+			t.Fatal(err)
+		}
+		if terr.Error != "invalid_target" {
+			t.Errorf("want invalid_target, got: %s", terr.Error)
+		}
+	})
+
+	t.Run("no resources", func(t *testing.T) {
+		o := newOIDC(t)
+		areq, _, err := authorize(t, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         code(t, o, areq),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(oidc.Audience{clientID}, introspectAud(t, o, tresp.AccessToken)); diff != "" {
+			t.Errorf("unexpected access token aud: %s", diff)
+		}
+	})
+
+	t.Run("client credentials", func(t *testing.T) {
+		o := newOIDC(t)
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:         GrantTypeClientCredentials,
+			ClientID:          clientID,
+			ClientSecret:      clientSecret,
+			ClientCredentials: &clientCredentialsRequest{},
+			Resources:         []string{apiA},
+		}, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(oidc.Audience{apiA}, introspectAud(t, o, tresp.AccessToken)); diff != "" {
+			t.Errorf("unexpected access token aud: %s", diff)
+		}
+
+		if _, err := o.token(ctx, &tokenRequest{
+			GrantType:         GrantTypeClientCredentials,
+			ClientID:          clientID,
+			ClientSecret:      clientSecret,
+			ClientCredentials: &clientCredentialsRequest{},
+			Resources:         []string{"https://other.example.com"},
+		}, handler); err == nil || metricsErrorCode(err) != "invalid_target" {
+			t.Errorf("want invalid_target, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// SessionLister can be implemented by a SessionManager to allow all of a
+// user's sessions to be revoked at once, with RevokeAllForSubject.
+type SessionLister interface {
+	// ListSessionIDs returns the IDs of all the sessions currently stored.
+	ListSessionIDs(ctx context.Context) ([]string, error)
+}
+
+// RevokeAllForSubject deletes every session authorized for the subject, across
+// all clients, invalidating their codes, access and refresh tokens. It can be
+// used when a user is deactivated. Only sessions where the subject was passed
+// in the Authorization can be found. The number of sessions deleted is
+// returned.
+//
+// The SessionManager must implement SessionLister. Every session is loaded to
+// find the subject's, so this should be used sparingly on large stores.
+func (o *OIDC) RevokeAllForSubject(ctx context.Context, subject string) (revoked int, err error) {
+	sessions, err := o.subjectSessions(ctx, subject)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sess := range sessions {
+		if err := o.smgr.DeleteSession(ctx, sess.ID); err != nil {
+			return revoked, fmt.Errorf("deleting session %s: %w", sess.ID, err)
+		}
+		revoked++
+
+		o.audit(ctx, AuditEvent{
+			Type:     AuditEventTokenRevoked,
+			ClientID: sess.ClientID,
+			Scopes:   sess.Authorization.Scopes,
+		})
+	}
+
+	return revoked, nil
+}
+
+// subjectSessions returns every stored session authorized for the subject.
+// The SessionManager must implement SessionLister.
+func (o *OIDC) subjectSessions(ctx context.Context, subject string) ([]*sessionV2, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("subject must be set")
+	}
+	sl, ok := o.smgr.(SessionLister)
+	if !ok {
+		return nil, fmt.Errorf("session manager does not implement SessionLister")
+	}
+
+	ids, err := sl.ListSessionIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+
+	var sessions []*sessionV2
+	for _, id := range ids {
+		sess, err := getSession(ctx, o.smgr, id)
+		if err != nil {
+			return nil, fmt.Errorf("getting session %s: %w", id, err)
+		}
+		if sess == nil || sess.Authorization == nil || sess.Authorization.Subject != subject {
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, nil
+}
+
+// RevokeSubject can handle an admin request to revoke all of a user's
+// sessions, with RevokeAllForSubject. The subject is passed as the subject
+// form parameter of a POST. The authorize function is called with the request,
+// and should return true if the caller is allowed to revoke sessions, e.g by
+// checking an admin credential. On success, the number of sessions revoked is
+// returned as {"revoked": n}.
+func (o *OIDC) RevokeSubject(w http.ResponseWriter, req *http.Request, authorize func(req *http.Request) (ok bool, err error)) error {
+	req = o.withErrorHandler(req)
+
+	if req.Method != http.MethodPost {
+		herr := &httpError{Code: http.StatusMethodNotAllowed, Message: "method not allowed", CauseMsg: fmt.Sprintf("method %s not allowed", req.Method)}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	ok, err := authorize(req)
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to authorize subject revocation", Cause: err}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+	if !ok {
+		be := &bearerError{Code: bearerErrorCodeInvalidToken, Description: "not authorized to revoke sessions"}
+		herr := &httpError{Code: http.StatusUnauthorized, Message: "not authorized", WWWAuthenticate: be.String(), CauseMsg: "subject revocation not authorized"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	subject := req.PostFormValue("subject")
+	if subject == "" {
+		herr := &httpError{Code: http.StatusBadRequest, Message: "subject is required"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	revoked, err := o.RevokeAllForSubject(req.Context(), subject)
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to revoke subject", Cause: err}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"revoked": revoked})
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+func TestRevokeAllForSubject(t *testing.T) {
+	const (
+		clientID      = "client-id"
+		otherClientID = "other-client"
+		clientSecret  = "client-secret"
+		redirectURI   = "https://redirect"
+	)
+	ctx := context.Background()
+
+	o, err := New(&Config{OfflineAccessWithoutConsent: true}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID:      csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			otherClientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenHandler := func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+			RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+			IssueRefreshToken:      true,
+			IDToken:                tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+		}, nil
+	}
+
+	// issue runs the code flow for the subject, returning the refresh token.
+	issue := func(t *testing.T, clientID, subject string) string {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid offline_access"},
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: areq.Scopes, Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         loc.Query().Get("code"),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, tokenHandler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tresp.RefreshToken
+	}
+
+	refresh := func(clientID, refreshToken string) error {
+		_, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeRefreshToken,
+			RefreshToken: refreshToken,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, tokenHandler)
+		return err
+	}
+
+	revokedTokens := map[string]string{
+		clientID:      issue(t, clientID, "alice"),
+		otherClientID: issue(t, otherClientID, "alice"),
+	}
+	keptToken := issue(t, clientID, "bob")
+
+	revoked, err := o.RevokeAllForSubject(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != 2 {
+		t.Errorf("want 2 sessions revoked, got: %d", revoked)
+	}
+
+	for cid, rt := range revokedTokens {
+		var terr *oauth2.TokenError
+		if err := refresh(cid, rt); !errors.As(err, &terr) || terr.ErrorCode != oauth2.TokenErrorCodeInvalidGrant {
+			t.Errorf("want refresh for %s to fail with invalid_grant, got: %v", cid, err)
+		}
+	}
+	if err := refresh(clientID, keptToken); err != nil {
+		t.Errorf("want other subject's refresh to succeed, got: %v", err)
+	}
+}
+
+func TestRevokeSubject(t *testing.T) {
+	smgr := newStubSMGR()
+	o := &OIDC{smgr: smgr, now: time.Now}
+
+	if err := putSession(context.Background(), smgr, &sessionV2{
+		ID:            "sess",
+		Authorization: &sessAuthorization{Subject: "alice"},
+		Expiry:        time.Now().Add(1 * time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	revoke := func(authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/revoke", strings.NewReader(url.Values{"subject": {"alice"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		_ = o.RevokeSubject(rec, req, func(*http.Request) (bool, error) {
+			return authorized, nil
+		})
+		return rec
+	}
+
+	if rec := revoke(false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("want unauthorized caller rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := revoke(true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Revoked int `json:"revoked"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Revoked != 1 {
+		t.Errorf("want 1 session revoked, got: %d", resp.Revoked)
+	}
+}
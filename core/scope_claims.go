@@ -0,0 +1,32 @@
+package core
+
+// scopeClaims maps the scopes used to request access to the standard claims,
+// to the claims they grant.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#ScopeClaims
+var scopeClaims = map[string][]string{
+	"profile": {
+		"name", "family_name", "given_name", "middle_name", "nickname",
+		"preferred_username", "profile", "picture", "website", "gender",
+		"birthdate", "zoneinfo", "locale", "updated_at",
+	},
+	"email":   {"email", "email_verified"},
+	"address": {"address"},
+	"phone":   {"phone_number", "phone_number_verified"},
+}
+
+// filterScopedClaims removes the standard claims that were not granted by
+// one of the scopes, or individually requested. Other claims are left as-is.
+func filterScopedClaims(claims map[string]interface{}, scopes []string, requested map[string]*ClaimRequest) {
+	for scope, scs := range scopeClaims {
+		if strsContains(scopes, scope) {
+			continue
+		}
+		for _, c := range scs {
+			if _, ok := requested[c]; ok {
+				continue
+			}
+			delete(claims, c)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScopeClaimsFiltering(t *testing.T) {
+	const clientID = "client-id"
+
+	allClaims := map[string]interface{}{
+		"sub":                   "subject",
+		"name":                  "Test User",
+		"given_name":            "Test",
+		"email":                 "user@example.com",
+		"email_verified":        true,
+		"phone_number":          "+1 555 0100",
+		"phone_number_verified": false,
+		"address":               map[string]interface{}{"country": "NZ"},
+		"groups":                []interface{}{"admins"},
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Scopes []string
+		Claims *ClaimsRequest
+		Want   []string
+		// WantUserinfo is set if userinfo should return different claims
+		// to the ID token
+		WantUserinfo []string
+	}{
+		{
+			Name:   "openid only",
+			Scopes: []string{"openid"},
+			Want:   []string{"sub", "groups"},
+		},
+		{
+			Name:   "profile",
+			Scopes: []string{"openid", "profile"},
+			Want:   []string{"sub", "groups", "name", "given_name"},
+		},
+		{
+			Name:   "email and phone",
+			Scopes: []string{"openid", "email", "phone"},
+			Want:   []string{"sub", "groups", "email", "email_verified", "phone_number", "phone_number_verified"},
+		},
+		{
+			Name:   "all scopes",
+			Scopes: []string{"openid", "profile", "email", "phone", "address"},
+			Want:   []string{"sub", "groups", "name", "given_name", "email", "email_verified", "phone_number", "phone_number_verified", "address"},
+		},
+		{
+			Name:   "Claims requested for each target",
+			Scopes: []string{"openid"},
+			Claims: &ClaimsRequest{
+				IDToken:  map[string]*ClaimRequest{"name": {Essential: true}},
+				Userinfo: map[string]*ClaimRequest{"email": nil, "phone_number": nil},
+			},
+			Want:         []string{"sub", "groups", "name"},
+			WantUserinfo: []string{"sub", "groups", "email", "phone_number"},
+		},
+		{
+			Name:   "Claims requested in addition to scopes",
+			Scopes: []string{"openid", "email"},
+			Claims: &ClaimsRequest{
+				Userinfo: map[string]*ClaimRequest{"given_name": nil},
+			},
+			Want:         []string{"sub", "groups", "email", "email_verified"},
+			WantUserinfo: []string{"sub", "groups", "email", "email_verified", "given_name"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			want := map[string]interface{}{}
+			for _, c := range tc.Want {
+				want[c] = allClaims[c]
+			}
+			wantUserinfo := want
+			if tc.WantUserinfo != nil {
+				wantUserinfo = map[string]interface{}{}
+				for _, c := range tc.WantUserinfo {
+					wantUserinfo[c] = allClaims[c]
+				}
+			}
+
+			t.Run("ID token", func(t *testing.T) {
+				o := &OIDC{
+					smgr:   newStubSMGR(),
+					signer: testSigner,
+					clients: &stubCS{
+						validClients: map[string]csClient{
+							clientID: csClient{},
+						},
+					},
+					now: time.Now,
+				}
+
+				utok, stok, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := putSession(ctx, o.smgr, &sessionV2{
+					ID:            utok.SessionId,
+					AuthCode:      stok,
+					Authorization: &sessAuthorization{Scopes: tc.Scopes},
+					ClientID:      clientID,
+					Expiry:        time.Now().Add(1 * time.Minute),
+					Request:       &sessAuthRequest{Claims: tc.Claims},
+				}); err != nil {
+					t.Fatal(err)
+				}
+
+				tresp, err := o.token(ctx, &tokenRequest{
+					GrantType: GrantTypeAuthorizationCode,
+					Code:      mustMarshal(utok),
+					ClientID:  clientID,
+				}, func(tr *TokenRequest) (*TokenResponse, error) {
+					if diff := cmp.Diff(tc.Claims, tr.Claims); diff != "" {
+						t.Errorf("want claims request passed to handler: %s", diff)
+					}
+					idt := tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute))
+					for k, v := range allClaims {
+						idt.Extra[k] = v
+					}
+					return &TokenResponse{
+						AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+						IDToken:               idt,
+					}, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				idtb, err := testSigner.VerifySignature(ctx, tresp.ExtraParams["id_token"].(string))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := map[string]interface{}{}
+				if err := json.Unmarshal(idtb, &got); err != nil {
+					t.Fatal(err)
+				}
+				// only compare the user claims, not those describing the
+				// token.
+				for _, c := range []string{"iss", "aud", "exp", "iat", "auth_time", "at_hash"} {
+					delete(got, c)
+				}
+
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Error(diff)
+				}
+			})
+
+			t.Run("Userinfo", func(t *testing.T) {
+				smgr := newStubSMGR()
+				o, err := New(&Config{}, smgr, &stubCS{}, testSigner)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				u, s, err := newToken("session-id", time.Now().Add(1*time.Minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := putSession(ctx, smgr, &sessionV2{
+					ID:            "session-id",
+					AccessToken:   s,
+					Authorization: &sessAuthorization{Scopes: tc.Scopes},
+					Request:       &sessAuthRequest{Claims: tc.Claims},
+					Expiry:        time.Now().Add(1 * time.Minute),
+				}); err != nil {
+					t.Fatal(err)
+				}
+
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", "/userinfo", nil)
+				req.Header.Set("authorization", "Bearer "+mustMarshal(u))
+
+				if err := o.Userinfo(rec, req, func(w io.Writer, uireq *UserinfoRequest) error {
+					if diff := cmp.Diff(tc.Claims, uireq.Claims); diff != "" {
+						t.Errorf("want claims request passed to handler: %s", diff)
+					}
+					return json.NewEncoder(w).Encode(allClaims)
+				}); err != nil {
+					t.Fatal(err)
+				}
+
+				got := map[string]interface{}{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(wantUserinfo, got); diff != "" {
+					t.Error(diff)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package core
+
+import "net/http"
+
+// DefaultContentSecurityPolicy is used if the ContentSecurityPolicy is not
+// configured. It allows pages to load resources from the provider's own
+// origin, e.g /static assets, and the inline script the default form_post
+// page submits itself with.
+const DefaultContentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// setSecurityHeaders sets the headers for responses that are shown to the
+// user in their browser, rather than consumed by a client. The headers stay
+// set on w, so also apply to any page the caller goes on to render.
+func (o *OIDC) setSecurityHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	if o.contentSecurityPolicy != "" {
+		h.Set("Content-Security-Policy", o.contentSecurityPolicy)
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Frame-Options", "DENY")
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	newOIDC := func(t *testing.T, cfg *Config) *OIDC {
+		t.Helper()
+		o, err := New(cfg, newStubSMGR(), &stubCS{
+			validClients: map[string]csClient{
+				clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			},
+		}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	authReq := func() url.Values {
+		return url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+		}
+	}
+
+	wantHeaders := func(t *testing.T, rec *httptest.ResponseRecorder, csp string) {
+		t.Helper()
+		for h, want := range map[string]string{
+			"Content-Security-Policy": csp,
+			"X-Content-Type-Options":  "nosniff",
+			"Referrer-Policy":         "no-referrer",
+			"X-Frame-Options":         "DENY",
+		} {
+			if got := rec.Header().Get(h); got != want {
+				t.Errorf("want %s %q, got: %q", h, want, got)
+			}
+		}
+	}
+
+	t.Run("authorization", func(t *testing.T) {
+		o := newOIDC(t, &Config{})
+
+		rec := httptest.NewRecorder()
+		areq, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/auth?"+authReq().Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantHeaders(t, rec, DefaultContentSecurityPolicy)
+
+		rec = httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/finish", nil), areq.SessionID, &Authorization{Scopes: []string{"openid"}}); err != nil {
+			t.Fatal(err)
+		}
+		wantHeaders(t, rec, DefaultContentSecurityPolicy)
+	})
+
+	t.Run("authorization error", func(t *testing.T) {
+		o := newOIDC(t, &Config{})
+
+		q := authReq()
+		q.Set("response_type", "bad")
+		rec := httptest.NewRecorder()
+		if _, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/auth?"+q.Encode(), nil)); err == nil {
+			t.Fatal("want error")
+		}
+		wantHeaders(t, rec, DefaultContentSecurityPolicy)
+	})
+
+	t.Run("custom policy", func(t *testing.T) {
+		const csp = "default-src 'self' https://cdn.example.com"
+		o := newOIDC(t, &Config{ContentSecurityPolicy: csp})
+
+		rec := httptest.NewRecorder()
+		if _, err := o.StartAuthorization(rec, httptest.NewRequest("GET", "/auth?"+authReq().Encode(), nil)); err != nil {
+			t.Fatal(err)
+		}
+		wantHeaders(t, rec, csp)
+	})
+
+	t.Run("token", func(t *testing.T) {
+		o := newOIDC(t, &Config{})
+
+		body := url.Values{"grant_type": {"authorization_code"}, "code": {"bad"}, "redirect_uri": {redirectURI}}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		rec := httptest.NewRecorder()
+		_ = o.Token(rec, req, func(_ *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{AccessTokenValidUntil: time.Now().Add(1 * time.Minute)}, nil
+		})
+
+		for _, h := range []string{"Content-Security-Policy", "X-Frame-Options", "Referrer-Policy"} {
+			if got := rec.Header().Get(h); got != "" {
+				t.Errorf("want no %s on token response, got: %q", h, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// ServiceTokenClientSource can be implemented by a ClientSource to let
+// clients have ID tokens issued for them directly with IssueIDToken, e.g for
+// service accounts. If it is not implemented, no client can.
+type ServiceTokenClientSource interface {
+	// ClientAllowServiceTokens should return true if ID tokens can be issued
+	// for the client without a user going through the authorization flow.
+	ClientAllowServiceTokens(clientID string) (ok bool, err error)
+}
+
+// IssueRequest details an ID token to issue with IssueIDToken.
+type IssueRequest struct {
+	// ClientID the token is issued to. The client must be allowed service
+	// tokens.
+	ClientID string
+	// Subject the token is about.
+	Subject string
+	// Audience of the token. If empty, it is the client ID. If it is set and
+	// is not just the client ID, the azp claim is set to the client ID.
+	Audience []string
+	// Scopes the token is granted. Standard claims are filtered by these, as
+	// for tokens issued via the token endpoint.
+	Scopes []string
+	// Extra claims to include in the token.
+	Extra map[string]interface{}
+	// ValidUntil is when the token expires.
+	ValidUntil time.Time
+}
+
+// IssueResponse is the token issued by IssueIDToken.
+type IssueResponse struct {
+	// IDToken is the signed, and if the client is registered for it
+	// encrypted, ID token.
+	IDToken string
+	// Claims the token was issued with.
+	Claims oidc.Claims
+}
+
+// ErrServiceTokensNotAllowed is returned by IssueIDToken if the client is not
+// allowed to have tokens issued for it.
+var ErrServiceTokensNotAllowed = errors.New("client is not allowed service tokens")
+
+// IssueIDToken issues an ID token for a trusted service, without going through
+// the browser flow. The token is built, modified by the ClaimsModifier, signed
+// and encrypted the same way as tokens from the token endpoint. It is up to the
+// caller to make sure the service requesting this is who it claims to be.
+func (o *OIDC) IssueIDToken(ctx context.Context, req IssueRequest) (*IssueResponse, error) {
+	iss := o.issuerFrom(ctx)
+	if iss == "" {
+		return nil, fmt.Errorf("issuer must be configured to issue tokens")
+	}
+	if req.ClientID == "" || req.Subject == "" {
+		return nil, fmt.Errorf("client ID and subject are required")
+	}
+	if req.ValidUntil.IsZero() || !req.ValidUntil.After(o.now()) {
+		return nil, fmt.Errorf("valid until must be in the future")
+	}
+
+	stcs, ok := o.clients.(ServiceTokenClientSource)
+	if !ok {
+		return nil, ErrServiceTokensNotAllowed
+	}
+	allowed, err := stcs.ClientAllowServiceTokens(req.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("checking if client %s is allowed service tokens: %w", req.ClientID, err)
+	}
+	if !allowed {
+		return nil, ErrServiceTokensNotAllowed
+	}
+	scok, err := o.clientScopesAllowed(req.ClientID, req.Scopes)
+	if err != nil {
+		return nil, fmt.Errorf("checking client %s scopes: %w", req.ClientID, err)
+	}
+	if !scok {
+		return nil, fmt.Errorf("client %s can not be granted these scopes", req.ClientID)
+	}
+
+	extra := map[string]interface{}{}
+	for k, v := range req.Extra {
+		extra[k] = v
+	}
+	cl := oidc.Claims{
+		Issuer:   iss,
+		Subject:  req.Subject,
+		Audience: oidc.Audience{req.ClientID},
+		Expiry:   oidc.NewUnixTime(req.ValidUntil),
+		IssuedAt: oidc.NewUnixTime(o.now()),
+		Extra:    extra,
+	}
+	if len(req.Audience) > 0 {
+		cl.Audience = oidc.Audience(req.Audience)
+		if len(req.Audience) > 1 || req.Audience[0] != req.ClientID {
+			cl.AZP = req.ClientID
+		}
+	}
+
+	clb, err := json.Marshal(cl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal id token: %w", err)
+	}
+	identity := Identity{
+		ClientID:      req.ClientID,
+		Subject:       req.Subject,
+		Authorization: Authorization{Scopes: req.Scopes},
+	}
+	clb, err = o.finalizeClaims(ctx, identity, nil, clb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize id token claims: %w", err)
+	}
+
+	alg, err := o.idTokenAlg(ctx, req.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get id token signing algorithm: %w", err)
+	}
+	sidt, err := o.signIDToken(ctx, alg, clb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign id token: %w", err)
+	}
+	sidt, err = o.encryptIDToken(req.ClientID, sidt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt id token: %w", err)
+	}
+
+	var issued oidc.Claims
+	if err := json.Unmarshal(clb, &issued); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal issued claims: %w", err)
+	}
+
+	o.audit(ctx, AuditEvent{
+		Type:     AuditEventTokenIssued,
+		ClientID: req.ClientID,
+		Subject:  req.Subject,
+		Scopes:   req.Scopes,
+	})
+
+	return &IssueResponse{
+		IDToken: string(sidt),
+		Claims:  issued,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+	"github.com/pardot/oidc/discovery"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestIssueIDToken(t *testing.T) {
+	const issuer = "https://issuer"
+
+	ctx := context.Background()
+
+	ts := httptest.NewServer(discovery.NewKeysHandler(testSigner.(discovery.KeySource), 1*time.Second))
+	defer ts.Close()
+
+	var modified []Identity
+	o, err := New(&Config{
+		Issuer: issuer,
+		ClaimsModifier: func(_ context.Context, identity Identity, claims map[string]interface{}) error {
+			modified = append(modified, identity)
+			claims["modified"] = true
+			return nil
+		},
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			"service":   csClient{AllowServiceTokens: true},
+			"web":       csClient{},
+			"email-svc": csClient{AllowServiceTokens: true, AllowedScopes: []string{"openid"}},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name       string
+		Req        IssueRequest
+		WantErr    bool
+		WantAud    oidc.Audience
+		WantAZP    string
+		WantClaims map[string]interface{}
+	}{
+		{
+			Name: "Issued to the client",
+			Req: IssueRequest{
+				ClientID:   "service",
+				Subject:    "svc-account",
+				Scopes:     []string{"openid"},
+				Extra:      map[string]interface{}{"team": "platform"},
+				ValidUntil: time.Now().Add(1 * time.Minute),
+			},
+			WantAud:    oidc.Audience{"service"},
+			WantClaims: map[string]interface{}{"team": "platform", "modified": true},
+		},
+		{
+			Name: "Other audience",
+			Req: IssueRequest{
+				ClientID:   "service",
+				Subject:    "svc-account",
+				Audience:   []string{"downstream"},
+				ValidUntil: time.Now().Add(1 * time.Minute),
+			},
+			WantAud: oidc.Audience{"downstream"},
+			WantAZP: "service",
+		},
+		{
+			Name: "Standard claims filtered by scope",
+			Req: IssueRequest{
+				ClientID:   "service",
+				Subject:    "svc-account",
+				Scopes:     []string{"openid"},
+				Extra:      map[string]interface{}{"email": "svc@example.com"},
+				ValidUntil: time.Now().Add(1 * time.Minute),
+			},
+			WantAud:    oidc.Audience{"service"},
+			WantClaims: map[string]interface{}{"email": nil},
+		},
+		{
+			Name: "Client not allowed",
+			Req: IssueRequest{
+				ClientID:   "web",
+				Subject:    "user",
+				ValidUntil: time.Now().Add(1 * time.Minute),
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Scope not allowed",
+			Req: IssueRequest{
+				ClientID:   "email-svc",
+				Subject:    "svc-account",
+				Scopes:     []string{"openid", "email"},
+				ValidUntil: time.Now().Add(1 * time.Minute),
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Expired",
+			Req: IssueRequest{
+				ClientID:   "service",
+				Subject:    "svc-account",
+				ValidUntil: time.Now().Add(-1 * time.Minute),
+			},
+			WantErr: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp, err := o.IssueIDToken(ctx, tc.Req)
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error issuing token")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the token should verify against the published keys
+			kresp, err := http.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer kresp.Body.Close()
+			var jwks jose.JSONWebKeySet
+			if err := json.NewDecoder(kresp.Body).Decode(&jwks); err != nil {
+				t.Fatal(err)
+			}
+			jws, err := jose.ParseSigned(resp.IDToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := jwks.Key(jws.Signatures[0].Header.KeyID)
+			if len(keys) != 1 {
+				t.Fatalf("want signing key published, got %d keys", len(keys))
+			}
+			payload, err := jws.Verify(keys[0])
+			if err != nil {
+				t.Fatalf("want token to verify against published keys, got: %v", err)
+			}
+
+			var cl oidc.Claims
+			if err := json.Unmarshal(payload, &cl); err != nil {
+				t.Fatal(err)
+			}
+			if cl.Issuer != issuer || cl.Subject != tc.Req.Subject {
+				t.Errorf("want iss %s and sub %s, got %s and %s", issuer, tc.Req.Subject, cl.Issuer, cl.Subject)
+			}
+			if len(cl.Audience) != len(tc.WantAud) || cl.Audience[0] != tc.WantAud[0] {
+				t.Errorf("want aud %v, got %v", tc.WantAud, cl.Audience)
+			}
+			if cl.AZP != tc.WantAZP {
+				t.Errorf("want azp %q, got %q", tc.WantAZP, cl.AZP)
+			}
+			if cl.Expiry.Time().Unix() != tc.Req.ValidUntil.Unix() {
+				t.Errorf("want exp %d, got %d", tc.Req.ValidUntil.Unix(), cl.Expiry.Time().Unix())
+			}
+			for k, want := range tc.WantClaims {
+				if got := cl.Extra[k]; got != want {
+					t.Errorf("want claim %s %v, got %v", k, want, got)
+				}
+			}
+			if resp.Claims.Subject != cl.Subject {
+				t.Errorf("want returned claims to match token, got sub %s", resp.Claims.Subject)
+			}
+		})
+	}
+
+	if _, err := o.IssueIDToken(ctx, IssueRequest{ClientID: "web", Subject: "user", ValidUntil: time.Now().Add(1 * time.Minute)}); !errors.Is(err, ErrServiceTokensNotAllowed) {
+		t.Errorf("want ErrServiceTokensNotAllowed, got %v", err)
+	}
+	if len(modified) == 0 || modified[0].Subject != "svc-account" || modified[0].ClientID != "service" {
+		t.Errorf("want claims modifier called with the identity, got %v", modified)
+	}
+}
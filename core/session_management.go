@@ -0,0 +1,128 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// DefaultBrowserStateCookie is the cookie the check session iframe reads the
+// browser state from, if no BrowserStateCookie is configured.
+const DefaultBrowserStateCookie = "op_browser_state"
+
+// sessionStateSaltLen is the number of random bytes salting the session state.
+const sessionStateSaltLen = 16
+
+// sessionState calculates the session_state returned to the client, from the
+// client ID, the origin of its redirect URI and the browser state. The salt is
+// appended, so the check session iframe can repeat the calculation.
+//
+// https://openid.net/specs/openid-connect-session-1_0.html#CreatingUpdatingSessions
+func sessionState(clientID, redirectURI, browserState string) (string, error) {
+	ru, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse redirect URI: %w", err)
+	}
+	origin := ru.Scheme + "://" + ru.Host
+
+	sb := make([]byte, sessionStateSaltLen)
+	if _, err := rand.Read(sb); err != nil {
+		return "", fmt.Errorf("error reading random data: %w", err)
+	}
+	salt := base64.RawURLEncoding.EncodeToString(sb)
+
+	return sessionStateHash(clientID, origin, browserState, salt) + "." + salt, nil
+}
+
+func sessionStateHash(clientID, origin, browserState, salt string) string {
+	h := sha256.Sum256([]byte(clientID + " " + origin + " " + browserState + " " + salt))
+	return hex.EncodeToString(h[:])
+}
+
+// checkSessionIframe repeats the session state calculation in the browser, for
+// the client's RP iframe to poll with postMessage.
+//
+// https://openid.net/specs/openid-connect-session-1_0.html#OPiframe
+var checkSessionIframe = template.Must(template.New("checkSessionIframe").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>check session</title>
+		<script>
+			var cookieName = {{ .cookie }};
+
+			function browserState() {
+				var cookies = document.cookie.split(";");
+				for (var i = 0; i < cookies.length; i++) {
+					var c = cookies[i].trim();
+					if (c.indexOf(cookieName + "=") === 0) {
+						return decodeURIComponent(c.substring(cookieName.length + 1));
+					}
+				}
+				return "";
+			}
+
+			function hex(buf) {
+				return Array.prototype.map.call(new Uint8Array(buf), function(b) {
+					return ("0" + b.toString(16)).slice(-2);
+				}).join("");
+			}
+
+			window.addEventListener("message", function(e) {
+				if (typeof e.data !== "string") {
+					return;
+				}
+				var parts = e.data.split(" ");
+				var dot = parts.length === 2 ? parts[1].lastIndexOf(".") : -1;
+				if (dot < 0) {
+					e.source.postMessage("error", e.origin);
+					return;
+				}
+				var clientID = parts[0];
+				var hash = parts[1].substring(0, dot);
+				var salt = parts[1].substring(dot + 1);
+				var data = new TextEncoder().encode(clientID + " " + e.origin + " " + browserState() + " " + salt);
+				window.crypto.subtle.digest("SHA-256", data).then(function(digest) {
+					e.source.postMessage(hex(digest) === hash ? "unchanged" : "changed", e.origin);
+				}, function() {
+					e.source.postMessage("error", e.origin);
+				});
+			}, false);
+		</script>
+	</head>
+	<body></body>
+</html>`))
+
+// CheckSessionIframe serves the OP iframe for OIDC Session Management. Clients
+// load it in a hidden iframe, and poll it with postMessage to find out if the
+// user's session with the provider has changed since the session_state they
+// were given. It should be mounted at the check_session_iframe advertised in
+// discovery.
+//
+// The iframe compares against the browser state in the BrowserStateCookie,
+// which the caller is responsible for setting to the Authorization's
+// BrowserState. It must be readable by scripts on this page, so can't be
+// HttpOnly.
+//
+// https://openid.net/specs/openid-connect-session-1_0.html#OPiframe
+func (o *OIDC) CheckSessionIframe(w http.ResponseWriter, req *http.Request) error {
+	req = o.withErrorHandler(req)
+
+	if req.Method != http.MethodGet {
+		return writeHTTPError(w, req, http.StatusMethodNotAllowed, "method not allowed", nil, fmt.Sprintf("method %s not allowed", req.Method))
+	}
+
+	// this is loaded in an iframe by the clients, so can't deny framing like
+	// the other pages.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := checkSessionIframe.Execute(w, map[string]interface{}{"cookie": o.browserStateCookie}); err != nil {
+		return writeHTTPError(w, req, http.StatusInternalServerError, "internal error", err, "failed to render check session iframe")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSessionState(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://client.example.com/callback"
+		origin      = "https://client.example.com"
+	)
+
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(t *testing.T, browserState string) url.Values {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+			"state":         {"state"},
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{
+			Scopes:       []string{"openid"},
+			BrowserState: browserState,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query()
+	}
+
+	// verify repeats the check the iframe makes.
+	verify := func(sessState, browserState string) bool {
+		dot := strings.LastIndex(sessState, ".")
+		if dot < 0 {
+			return false
+		}
+		return sessionStateHash(clientID, origin, browserState, sessState[dot+1:]) == sessState[:dot]
+	}
+
+	first := authorize(t, "browser-state")
+	second := authorize(t, "browser-state")
+	for _, q := range []url.Values{first, second} {
+		ss := q.Get("session_state")
+		if ss == "" {
+			t.Fatalf("want session_state in the response, got: %v", q)
+		}
+		if q.Get("code") == "" || q.Get("state") != "state" {
+			t.Errorf("want code and state alongside session_state, got: %v", q)
+		}
+		if !verify(ss, "browser-state") {
+			t.Errorf("want session_state %s to match the browser state", ss)
+		}
+		if verify(ss, "other-state") {
+			t.Errorf("want session_state %s not to match another browser state", ss)
+		}
+	}
+	if first.Get("session_state") == second.Get("session_state") {
+		t.Error("want session_state to be salted")
+	}
+
+	if q := authorize(t, ""); q.Get("session_state") != "" {
+		t.Errorf("want no session_state without browser state, got: %s", q.Get("session_state"))
+	}
+}
+
+func TestCheckSessionIframe(t *testing.T) {
+	o, err := New(&Config{BrowserStateCookie: "bs"}, newStubSMGR(), &stubCS{}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := o.CheckSessionIframe(rec, httptest.NewRequest("GET", "/check_session", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status %d, got: %d", http.StatusOK, rec.Code)
+	}
+	if rec.Header().Get("X-Frame-Options") != "" {
+		t.Error("iframe must be frameable by clients")
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `var cookieName = "bs";`) {
+		t.Errorf("want iframe to read the configured cookie, got: %s", body)
+	}
+	for _, msg := range []string{`"changed"`, `"unchanged"`, `"error"`} {
+		if !strings.Contains(body, msg) {
+			t.Errorf("want iframe to respond with %s", msg)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"time"
 
 	"github.com/golang/protobuf/jsonpb"
@@ -72,6 +73,14 @@ const (
 	sessionStageAccessTokenIssued sessionStage = "access_token_issued"
 	// An access token has been issued, along with a refresh token.
 	sessionStageRefreshable sessionStage = "refreshable"
+	// A device authorization has been approved by the user, and the device
+	// can redeem its code.
+	sessionStageDeviceAuthorized sessionStage = "device_authorized"
+	// A device authorization was denied by the user.
+	sessionStageDeviceDenied sessionStage = "device_denied"
+	// An authorization request was pushed by the client, and is waiting for
+	// the user to be sent to the authorization endpoint with it.
+	sessionStagePushed sessionStage = "pushed"
 )
 
 // Session represents an authenticated user from the time they are issued a
@@ -98,17 +107,53 @@ type sessionV2 struct {
 	AccessToken *accessToken `json:"access_token,omitempty"`
 	// The currently valid refresh token for this session. I
 	RefreshToken *accessToken `json:"refresh_token,omitempty"`
+	// The device code that was issued for the device flow, until it is
+	// redeemed.
+	DeviceCode *accessToken `json:"device_code,omitempty"`
+	// The minimum interval the device should poll at. This is increased if
+	// the device polls too quickly.
+	DevicePollInterval time.Duration `json:"device_poll_interval,omitempty"`
+	// When the device last polled for tokens.
+	DeviceLastPolledAt time.Time `json:"device_last_polled_at,omitempty"`
+	// The parameters of a pushed authorization request, until it is used.
+	PushedParams url.Values `json:"pushed_params,omitempty"`
+	// When tokens were last issued for the session, by redeeming its code
+	// or a refresh.
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
 	// The time the whole session should be expired at. It should be garbage
 	// collected at this time.
 	Expiry time.Time `json:"expiry,omitempty"`
 }
 
+// issuedTokens returns false if the session is for a request that has not had
+// a code or tokens issued for it yet. Sessions for requests in progress,
+// pushed requests and device authorizations share the SessionManager, and
+// their IDs are handed to clients and browsers, so tokens presented for them
+// must be rejected rather than compared against tokens they don't have.
+func (s *sessionV2) issuedTokens() bool {
+	switch s.Stage {
+	case sessionStageRequested, sessionStagePushed, sessionStageDeviceAuthorized, sessionStageDeviceDenied:
+		return false
+	}
+	return true
+}
+
 type authRequestResponseType string
 
 const (
 	authRequestResponseTypeUnknown authRequestResponseType = "unknown"
 	authRequestResponseTypeCode    authRequestResponseType = "code"
 	authRequestResponseTypeToken   authRequestResponseType = "token"
+	// Hybrid flows, where a code is issued along with tokens from the
+	// authorization endpoint.
+	authRequestResponseTypeCodeIDToken      authRequestResponseType = "code id_token"
+	authRequestResponseTypeCodeToken        authRequestResponseType = "code token"
+	authRequestResponseTypeCodeIDTokenToken authRequestResponseType = "code id_token token"
+	// nothing is issued, the client is redirected back with only the state.
+	authRequestResponseTypeNone authRequestResponseType = "none"
+	// the request was made to the device authorization endpoint, rather than
+	// the auth endpoint. Tokens are returned when the device polls.
+	authRequestResponseTypeDevice authRequestResponseType = "device"
 )
 
 // AuthRequest represents the information that the caller requested
@@ -119,6 +164,24 @@ type sessAuthRequest struct {
 	Scopes       []string                `json:"scopes,omitempty"`
 	Nonce        string                  `json:"nonce,omitempty"`
 	ResponseType authRequestResponseType `json:"response_type,omitempty"`
+	ResponseMode responseMode            `json:"response_mode,omitempty"`
+	// PKCE challenge, if the client requested with one
+	CodeChallenge       string              `json:"code_challenge,omitempty"`
+	CodeChallengeMethod codeChallengeMethod `json:"code_challenge_method,omitempty"`
+	// Claims individually requested via the claims parameter
+	Claims *ClaimsRequest `json:"claims,omitempty"`
+	// MaxAge is the maximum time since the user authenticated, if requested
+	MaxAge *time.Duration `json:"max_age,omitempty"`
+	// Resources the client requested tokens for, if any
+	Resources []string `json:"resources,omitempty"`
+	// IncludeGrantedScopes is set if the client asked for previously
+	// granted scopes to be included
+	IncludeGrantedScopes bool `json:"include_granted_scopes,omitempty"`
+	// IDTokenHintSubject is the subject of the id_token_hint, if the client
+	// passed one
+	IDTokenHintSubject string `json:"id_token_hint_subject,omitempty"`
+	// ACRValues the client requested, if any
+	ACRValues []string `json:"acr_values,omitempty"`
 }
 
 type accessToken struct {
@@ -126,6 +189,23 @@ type accessToken struct {
 	Bcrypted []byte `json:"bcrypted,omitempty"`
 	// when this token expires
 	Expiry time.Time `json:"expires_at,omitempty"`
+	// when this token was issued
+	IssuedAt time.Time `json:"issued_at,omitempty"`
+	// CertThumbprint is the SHA-256 thumbprint of the client certificate
+	// this token is bound to, if any.
+	CertThumbprint string `json:"x5t_s256,omitempty"`
+	// DPoPJKT is the thumbprint of the DPoP key this token is bound to, if
+	// any.
+	DPoPJKT string `json:"dpop_jkt,omitempty"`
+	// Audience is the resources this token was issued for, if it was for
+	// specific resources.
+	Audience []string `json:"aud,omitempty"`
+	// Scopes this token was issued for, if they were narrowed from those
+	// the session was authorized for.
+	Scopes []string `json:"scope,omitempty"`
+	// IPRanges are the CIDRs the client was restricted to when this token
+	// was issued, if any.
+	IPRanges []string `json:"ip_ranges,omitempty"`
 }
 
 // sessAuthorization represents the information that the authentication process
@@ -134,7 +214,13 @@ type sessAuthorization struct {
 	Scopes       []string  `json:"scopes,omitempty"`
 	ACR          string    `json:"acr,omitempty"`
 	AMR          []string  `json:"amr,omitempty"`
+	SID          string    `json:"sid,omitempty"`
+	Connector    string    `json:"connector,omitempty"`
+	Subject      string    `json:"subject,omitempty"`
 	AuthorizedAt time.Time `json:"authorized_at,omitempty"`
+	// ClientCredentials is set if the session was authorized for the client
+	// itself, via the client credentials grant.
+	ClientCredentials bool `json:"client_credentials,omitempty"`
 }
 
 // we need something that looks like the interface we can pass in to get, but
@@ -159,7 +245,7 @@ func getSession(ctx context.Context, sm SessionManager, sessionID string) (*sess
 	var raw rawSession
 	found, err := sm.GetSession(ctx, sessionID, &raw)
 	if err != nil {
-		return nil, fmt.Errorf("getting raw session data: %v", err)
+		return nil, fmt.Errorf("getting raw session data: %w", err)
 	}
 	if !found {
 		return nil, nil
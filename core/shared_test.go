@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/pardot/oidc/signer"
 	"gopkg.in/square/go-jose.v2"
@@ -17,6 +18,58 @@ import (
 type csClient struct {
 	Secret      string
 	RedirectURI string
+	// Public clients are unauthenticated, and have no secret
+	Public bool
+	// PostLogoutRedirectURI is the single allowed post logout redirect
+	PostLogoutRedirectURI string
+	// BackchannelLogoutURI logout tokens are delivered to
+	BackchannelLogoutURI string
+	// BackchannelLogoutSessionRequired indicates the sid is required
+	BackchannelLogoutSessionRequired bool
+	// FrontchannelLogoutURI is loaded in an iframe on logout
+	FrontchannelLogoutURI string
+	// FrontchannelLogoutSessionRequired indicates iss and sid are required
+	FrontchannelLogoutSessionRequired bool
+	// JWKS the client signs assertions with
+	JWKS *jose.JSONWebKeySet
+	// RequestObjectSigningAlg request objects must be signed with
+	RequestObjectSigningAlg jose.SignatureAlgorithm
+	// RequestURI is the single allowed request_uri
+	RequestURI string
+	// UserinfoSignedResponseAlg userinfo responses should be signed with
+	UserinfoSignedResponseAlg jose.SignatureAlgorithm
+	// AllowTokenExchange lets the client use the token exchange grant
+	AllowTokenExchange bool
+	// AllowedScopes the client can request, any if empty
+	AllowedScopes []string
+	// AllowedGrantTypes the client can use, any if empty
+	AllowedGrantTypes []string
+	// AllowedResponseTypes the client can use, any if empty
+	AllowedResponseTypes []string
+	// IDTokenSignedResponseAlg ID tokens should be signed with
+	IDTokenSignedResponseAlg jose.SignatureAlgorithm
+	// IDTokenEncryptedResponseAlg ID tokens should be encrypted with, to a
+	// key in JWKS
+	IDTokenEncryptedResponseAlg jose.KeyAlgorithm
+	// IDTokenEncryptedResponseEnc ID tokens should be encrypted with
+	IDTokenEncryptedResponseEnc jose.ContentEncryption
+	// AllowServiceTokens lets ID tokens be issued directly for the client
+	AllowServiceTokens bool
+	// AllowPasswordGrant lets the client use the password grant
+	AllowPasswordGrant bool
+	// AllowClientCredentials lets the client use the client credentials
+	// grant
+	AllowClientCredentials bool
+	// AllowedResources the client can request tokens for
+	AllowedResources []string
+	// TokenLifetimes override the handler's token validity times
+	TokenLifetimes TokenLifetimes
+	// AllowedIPRanges the client can use the token endpoint from, any if
+	// empty
+	AllowedIPRanges []string
+	// SubjectType and SectorIdentifier the client's sub is derived for
+	SubjectType      SubjectType
+	SectorIdentifier string
 }
 
 type stubCS struct {
@@ -29,7 +82,8 @@ func (s *stubCS) IsValidClientID(clientID string) (ok bool, err error) {
 }
 
 func (s *stubCS) IsUnauthenticatedClient(clientID string) (ok bool, err error) {
-	return false, nil
+	cl, ok := s.validClients[clientID]
+	return ok && cl.Public, nil
 }
 
 func (s *stubCS) ValidateClientSecret(clientID, clientSecret string) (ok bool, err error) {
@@ -42,7 +96,104 @@ func (s *stubCS) ValidateClientRedirectURI(clientID, redirectURI string) (ok boo
 	return ok && redirectURI == cl.RedirectURI, nil
 }
 
+func (s *stubCS) ValidateClientPostLogoutRedirectURI(clientID, redirectURI string) (ok bool, err error) {
+	cl, ok := s.validClients[clientID]
+	return ok && cl.PostLogoutRedirectURI != "" && redirectURI == cl.PostLogoutRedirectURI, nil
+}
+
+func (s *stubCS) ClientBackchannelLogout(clientID string) (uri string, sessionRequired bool, err error) {
+	cl, ok := s.validClients[clientID]
+	if !ok {
+		return "", false, fmt.Errorf("invalid client %s", clientID)
+	}
+	return cl.BackchannelLogoutURI, cl.BackchannelLogoutSessionRequired, nil
+}
+
+func (s *stubCS) ClientFrontchannelLogout(clientID string) (uri string, sessionRequired bool, err error) {
+	cl, ok := s.validClients[clientID]
+	if !ok {
+		return "", false, fmt.Errorf("invalid client %s", clientID)
+	}
+	return cl.FrontchannelLogoutURI, cl.FrontchannelLogoutSessionRequired, nil
+}
+
+func (s *stubCS) ClientSecret(clientID string) (string, error) {
+	return s.validClients[clientID].Secret, nil
+}
+
+func (s *stubCS) ClientJWKS(clientID string) (*jose.JSONWebKeySet, error) {
+	return s.validClients[clientID].JWKS, nil
+}
+
+func (s *stubCS) ClientRequestObjectSigningAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	return s.validClients[clientID].RequestObjectSigningAlg, nil
+}
+
+func (s *stubCS) ValidateClientRequestURI(clientID, requestURI string) (ok bool, err error) {
+	cl, ok := s.validClients[clientID]
+	return ok && cl.RequestURI != "" && requestURI == cl.RequestURI, nil
+}
+
+func (s *stubCS) ClientUserinfoSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	return s.validClients[clientID].UserinfoSignedResponseAlg, nil
+}
+
+func (s *stubCS) ClientIDTokenSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	return s.validClients[clientID].IDTokenSignedResponseAlg, nil
+}
+
+func (s *stubCS) ClientIDTokenEncryption(clientID string) (jose.KeyAlgorithm, jose.ContentEncryption, error) {
+	cl := s.validClients[clientID]
+	return cl.IDTokenEncryptedResponseAlg, cl.IDTokenEncryptedResponseEnc, nil
+}
+
+func (s *stubCS) ClientAllowServiceTokens(clientID string) (ok bool, err error) {
+	return s.validClients[clientID].AllowServiceTokens, nil
+}
+
+func (s *stubCS) ClientAllowPasswordGrant(clientID string) (ok bool, err error) {
+	return s.validClients[clientID].AllowPasswordGrant, nil
+}
+
+func (s *stubCS) ClientAllowClientCredentials(clientID string) (ok bool, err error) {
+	return s.validClients[clientID].AllowClientCredentials, nil
+}
+
+func (s *stubCS) ClientAllowedResources(clientID string) (resources []string, err error) {
+	return s.validClients[clientID].AllowedResources, nil
+}
+
+func (s *stubCS) ClientTokenLifetimes(clientID string) (TokenLifetimes, error) {
+	return s.validClients[clientID].TokenLifetimes, nil
+}
+
+func (s *stubCS) ClientAllowTokenExchange(clientID string) (ok bool, err error) {
+	return s.validClients[clientID].AllowTokenExchange, nil
+}
+
+func (s *stubCS) ClientAllowedScopes(clientID string) (scopes []string, err error) {
+	return s.validClients[clientID].AllowedScopes, nil
+}
+
+func (s *stubCS) ClientAllowedGrantTypes(clientID string) (grantTypes []string, err error) {
+	return s.validClients[clientID].AllowedGrantTypes, nil
+}
+
+func (s *stubCS) ClientAllowedResponseTypes(clientID string) (responseTypes []string, err error) {
+	return s.validClients[clientID].AllowedResponseTypes, nil
+}
+
+func (s *stubCS) ClientAllowedIPRanges(clientID string) (cidrs []string, err error) {
+	return s.validClients[clientID].AllowedIPRanges, nil
+}
+
+func (s *stubCS) ClientSubjectType(clientID string) (SubjectType, string, error) {
+	cl := s.validClients[clientID]
+	return cl.SubjectType, cl.SectorIdentifier, nil
+}
+
 type stubSMGR struct {
+	mu sync.Mutex
 	// sessions maps JSON session objects by their ID
 	// JSON > proto here for better debug output
 	sessions map[string][]byte
@@ -67,6 +218,9 @@ func mustGenerateID() string {
 }
 
 func (s *stubSMGR) GetSession(_ context.Context, sessionID string, into Session) (found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	sess, ok := s.sessions[sessionID]
 	if !ok {
 		return false, nil
@@ -85,15 +239,31 @@ func (s *stubSMGR) PutSession(_ context.Context, sess Session) error {
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.sessions[sess.ID()] = sb
 	return nil
 }
 
 func (s *stubSMGR) DeleteSession(ctx context.Context, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	delete(s.sessions, sessionID)
 	return nil
 }
 
+func (s *stubSMGR) ListSessionIDs(_ context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 var testSigner = func() Signer {
 	key := mustGenRSAKey(512)
 
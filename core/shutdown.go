@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"sync"
+)
+
+// background tracks the long running goroutines started by the OIDC, like
+// RunGC, so they can be stopped on Shutdown. The zero value is ready to use.
+type background struct {
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// start registers a goroutine. It returns a channel closed when it should
+// stop, and false if the OIDC is already shut down. finished must be called
+// when the goroutine returns.
+func (b *background) start() (stop <-chan struct{}, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, false
+	}
+	if b.done == nil {
+		b.done = make(chan struct{})
+	}
+	b.wg.Add(1)
+	return b.done, true
+}
+
+func (b *background) finished() {
+	b.wg.Done()
+}
+
+// Shutdown stops any background work started on the OIDC, like RunGC, and
+// waits for it to return. If the context expires first, its error is
+// returned. Once called, later calls to RunGC return immediately. It is safe
+// to call more than once, and before any background work has started.
+//
+// It does not affect requests being handled, those should be drained by the
+// caller's http.Server.
+func (o *OIDC) Shutdown(ctx context.Context) error {
+	b := &o.background
+
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		if b.done != nil {
+			close(b.done)
+		}
+	}
+	b.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,241 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/pardot/oidc/storage"
+)
+
+const (
+	// storageSessionsKeyspace holds the serialized sessions.
+	storageSessionsKeyspace = "oidc_sessions"
+	// storageAuthCodesKeyspace holds a marker for each session with an
+	// authorization code that hasn't been redeemed. Redeeming the code
+	// removes the marker, so only one redemption can succeed.
+	storageAuthCodesKeyspace = "oidc_auth_codes"
+	// storageReplayKeyspace holds a marker for each single use ID seen, until
+	// its TTL passes.
+	storageReplayKeyspace = "oidc_replay"
+)
+
+var (
+	_ SessionManager           = (*StorageSessionManager)(nil)
+	_ AuthCodeRedeemer         = (*StorageSessionManager)(nil)
+	_ ReplayCache              = (*StorageSessionManager)(nil)
+	_ SessionLister            = (*StorageSessionManager)(nil)
+	_ Clocked                  = (*StorageSessionManager)(nil)
+	_ storage.GarbageCollector = (*StorageSessionManager)(nil)
+)
+
+// StorageSessionManager is a SessionManager that keeps sessions in a
+// storage.Storage, each until it expires. Authorization codes are redeemed
+// atomically in the storage, so it is safe to share between instances. It is
+// also a ReplayCache, keeping the IDs apart from the sessions.
+type StorageSessionManager struct {
+	s storage.Storage
+
+	now func() time.Time
+}
+
+// NewStorageSessionManager creates a StorageSessionManager that keeps its
+// state in s.
+func NewStorageSessionManager(s storage.Storage) *StorageSessionManager {
+	return &StorageSessionManager{s: s, now: time.Now}
+}
+
+// SetNow sets the clock used to expire replay records.
+func (m *StorageSessionManager) SetNow(now func() time.Time) {
+	m.now = now
+}
+
+// NewID returns a random session ID.
+func (m *StorageSessionManager) NewID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("can't create ID, rand.Read failed: %w", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// GetSession loads the session in to into. If it doesn't exist or has
+// expired, found is false.
+func (m *StorageSessionManager) GetSession(ctx context.Context, sessionID string, into Session) (found bool, err error) {
+	data := &wrappers.BytesValue{}
+	if _, err := m.s.Get(ctx, storageSessionsKeyspace, sessionID, data); err != nil {
+		if storage.IsNotFoundErr(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("getting session %s: %w", sessionID, err)
+	}
+	if err := json.Unmarshal(data.Value, into); err != nil {
+		return false, fmt.Errorf("unmarshaling session %s: %w", sessionID, err)
+	}
+	return true, nil
+}
+
+// PutSession stores the session until its expiry. If the session has an
+// authorization code that hasn't been redeemed, it is recorded so it can be
+// redeemed once.
+func (m *StorageSessionManager) PutSession(ctx context.Context, sess Session) error {
+	if sess.ID() == "" {
+		return fmt.Errorf("session has no ID")
+	}
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("marshaling session: %w", err)
+	}
+
+	ver, err := m.s.Get(ctx, storageSessionsKeyspace, sess.ID(), &wrappers.BytesValue{})
+	if err != nil && !storage.IsNotFoundErr(err) {
+		return fmt.Errorf("getting session %s: %w", sess.ID(), err)
+	}
+	if sess.Expiry().IsZero() {
+		_, err = m.s.Put(ctx, storageSessionsKeyspace, sess.ID(), ver, &wrappers.BytesValue{Value: b})
+	} else {
+		_, err = m.s.PutWithExpiry(ctx, storageSessionsKeyspace, sess.ID(), ver, &wrappers.BytesValue{Value: b}, sess.Expiry())
+	}
+	if err != nil {
+		return fmt.Errorf("putting session %s: %w", sess.ID(), err)
+	}
+
+	if vs, ok := sess.(*versionedSession); ok && vs.sess != nil {
+		if code := vs.sess.AuthCode; code != nil && vs.sess.Stage == sessionStageCode && !vs.sess.AuthCodeRedeemed {
+			_, err := m.s.PutWithExpiry(ctx, storageAuthCodesKeyspace, sess.ID(), 0, &wrappers.BytesValue{}, code.Expiry)
+			if err != nil && !storage.IsConflictErr(err) {
+				return fmt.Errorf("putting code for session %s: %w", sess.ID(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteSession removes the session, even if it is concurrently updated.
+// Sessions that don't exist are ignored.
+func (m *StorageSessionManager) DeleteSession(ctx context.Context, sessionID string) error {
+	return m.delete(ctx, storageSessionsKeyspace, sessionID)
+}
+
+// RedeemAuthCode removes the record of the session's unredeemed code,
+// returning true if this call removed it. If the storage implements
+// storage.Consumer the record is consumed, otherwise it is deleted at the
+// version read. Either way, of concurrent calls only one can succeed.
+func (m *StorageSessionManager) RedeemAuthCode(ctx context.Context, sessionID string, _ time.Time) (first bool, err error) {
+	if c, ok := m.s.(storage.Consumer); ok {
+		err := c.Consume(ctx, storageAuthCodesKeyspace, sessionID, &wrappers.BytesValue{})
+		if storage.IsNotFoundErr(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("consuming code for session %s: %w", sessionID, err)
+		}
+		return true, nil
+	}
+
+	ver, err := m.s.Get(ctx, storageAuthCodesKeyspace, sessionID, &wrappers.BytesValue{})
+	if storage.IsNotFoundErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting code for session %s: %w", sessionID, err)
+	}
+	err = m.s.Delete(ctx, storageAuthCodesKeyspace, sessionID, ver)
+	if storage.IsNotFoundErr(err) || storage.IsConflictErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("deleting code for session %s: %w", sessionID, err)
+	}
+	return true, nil
+}
+
+// CheckAndStore records the id until ttl has passed, returning false if it is
+// already recorded. The record is created only if it doesn't exist, or
+// replaced at the version read once it has expired, so of concurrent calls
+// only one is fresh. Expiry is decided by our clock. The storage is only
+// asked to remove the record once it has expired by both its clock and ours.
+func (m *StorageSessionManager) CheckAndStore(ctx context.Context, id string, ttl time.Duration) (fresh bool, err error) {
+	h := sha256.Sum256([]byte(id))
+	key := base64.RawURLEncoding.EncodeToString(h[:])
+
+	expires := m.now().Add(ttl)
+	storageExpires := expires
+	if t := time.Now().Add(ttl); t.After(storageExpires) {
+		storageExpires = t
+	}
+	record := &wrappers.Int64Value{Value: expires.UnixNano()}
+
+	var ver int64
+	for {
+		_, err := m.s.PutWithExpiry(ctx, storageReplayKeyspace, key, ver, record, storageExpires)
+		if err == nil {
+			return true, nil
+		}
+		if !storage.IsConflictErr(err) {
+			return false, fmt.Errorf("putting replay record: %w", err)
+		}
+
+		existing := &wrappers.Int64Value{}
+		ver, err = m.s.Get(ctx, storageReplayKeyspace, key, existing)
+		if storage.IsNotFoundErr(err) {
+			ver = 0
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("getting replay record: %w", err)
+		}
+		if m.now().Before(time.Unix(0, existing.Value)) {
+			return false, nil
+		}
+	}
+}
+
+// ListSessionIDs returns the IDs of the sessions that haven't expired.
+func (m *StorageSessionManager) ListSessionIDs(ctx context.Context) ([]string, error) {
+	ids, err := m.s.List(ctx, storageSessionsKeyspace)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+	return ids, nil
+}
+
+// GarbageCollectExpired deletes the expired sessions, code and replay records,
+// if the storage implements storage.GarbageCollector. Storages that remove
+// expired items themselves, like Redis, have nothing to collect, so 0 is
+// returned.
+func (m *StorageSessionManager) GarbageCollectExpired(ctx context.Context, now time.Time) (deleted int, err error) {
+	gc, ok := m.s.(storage.GarbageCollector)
+	if !ok {
+		return 0, nil
+	}
+	return gc.GarbageCollectExpired(ctx, now)
+}
+
+// delete removes the item, ignoring it if it doesn't exist. If it is updated
+// between reading its version and deleting it, the delete is retried.
+func (m *StorageSessionManager) delete(ctx context.Context, keyspace, key string) error {
+	for {
+		ver, err := m.s.Get(ctx, keyspace, key, &wrappers.BytesValue{})
+		if storage.IsNotFoundErr(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("getting %s/%s: %w", keyspace, key, err)
+		}
+		err = m.s.Delete(ctx, keyspace, key, ver)
+		if storage.IsConflictErr(err) {
+			continue
+		}
+		if err != nil && !storage.IsNotFoundErr(err) {
+			return fmt.Errorf("deleting %s/%s: %w", keyspace, key, err)
+		}
+		return nil
+	}
+}
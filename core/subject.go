@@ -0,0 +1,114 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// SubjectType is how the sub claim for a client is derived from the user's
+// subject.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes
+type SubjectType string
+
+const (
+	// SubjectTypePublic clients all get the same sub for the user, the
+	// subject the user was authorized as. This is the default.
+	SubjectTypePublic SubjectType = "public"
+	// SubjectTypePairwise clients get a sub from the SubjectGenerator, that
+	// differs for each sector identifier so clients can't correlate users.
+	SubjectTypePairwise SubjectType = "pairwise"
+)
+
+// SubjectGenerator derives the sub claim for pairwise clients, from the
+// subject the user was authorized as and the client's sector identifier. It
+// must return the same value for the same inputs, as clients use it to
+// identify the user.
+type SubjectGenerator interface {
+	// Subject returns the sub claim for the subject, within the sector.
+	Subject(subject, sectorIdentifier string) (string, error)
+}
+
+// SubjectTypeClientSource can be implemented by a ClientSource to have some
+// clients issued pairwise subject identifiers. A SubjectGenerator must be
+// configured for them to be.
+//
+// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+type SubjectTypeClientSource interface {
+	// ClientSubjectType should return the subject type the client is
+	// registered for, and its sector identifier. The sector identifier is
+	// the host of the client's sector_identifier_uri, or of its redirect URI
+	// if it has no sector_identifier_uri. If it is empty, the client ID is
+	// used, so the client is in a sector of its own. An empty subject type
+	// is public.
+	ClientSubjectType(clientID string) (subjectType SubjectType, sectorIdentifier string, err error)
+}
+
+// pairwiseSubjectGenerator derives subs as described in the spec, from a hash
+// of the sector identifier, subject and a salt.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg
+type pairwiseSubjectGenerator struct {
+	salt []byte
+}
+
+// NewPairwiseSubjectGenerator returns a SubjectGenerator that derives opaque
+// subs that are stable for a subject within a sector, and unrelated between
+// sectors. The salt must be kept secret, or the subject can be guessed from
+// the sub. It must not change, or every pairwise client will see their users
+// change.
+func NewPairwiseSubjectGenerator(salt []byte) SubjectGenerator {
+	return &pairwiseSubjectGenerator{salt: salt}
+}
+
+func (p *pairwiseSubjectGenerator) Subject(subject, sectorIdentifier string) (string, error) {
+	if len(p.salt) == 0 {
+		return "", fmt.Errorf("pairwise subject generator has no salt")
+	}
+	// the sector is length prefixed, so the boundary between it and the
+	// subject is unambiguous.
+	h := hmac.New(sha256.New, p.salt)
+	fmt.Fprintf(h, "%d:%s%s", len(sectorIdentifier), sectorIdentifier, subject)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// SubjectTypesSupported returns the subject types clients can be issued, for
+// the subject_types_supported discovery metadata.
+func (o *OIDC) SubjectTypesSupported() []string {
+	if o.subjectGenerator == nil {
+		return []string{string(SubjectTypePublic)}
+	}
+	return []string{string(SubjectTypePublic), string(SubjectTypePairwise)}
+}
+
+// clientSubject returns the sub the client should be given for the subject.
+// It is the subject, unless the client is registered for pairwise subjects.
+func (o *OIDC) clientSubject(clientID, subject string) (string, error) {
+	if subject == "" {
+		return "", nil
+	}
+	scs, ok := o.clients.(SubjectTypeClientSource)
+	if !ok {
+		return subject, nil
+	}
+	st, sector, err := scs.ClientSubjectType(clientID)
+	if err != nil {
+		return "", fmt.Errorf("getting client subject type: %w", err)
+	}
+	switch st {
+	case "", SubjectTypePublic:
+		return subject, nil
+	case SubjectTypePairwise:
+	default:
+		return "", fmt.Errorf("client %s has unknown subject type %s", clientID, st)
+	}
+	if o.subjectGenerator == nil {
+		return "", fmt.Errorf("client %s wants pairwise subjects, but no SubjectGenerator is configured", clientID)
+	}
+	if sector == "" {
+		sector = clientID
+	}
+	return o.subjectGenerator.Subject(subject, sector)
+}
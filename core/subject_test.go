@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestPairwiseSubjects(t *testing.T) {
+	const (
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+		subject      = "user-1"
+	)
+
+	smgr := newStubSMGR()
+	o, err := New(&Config{
+		SubjectGenerator: NewPairwiseSubjectGenerator([]byte("salt")),
+	}, smgr, &stubCS{
+		validClients: map[string]csClient{
+			"pairwise-a":      csClient{Secret: clientSecret, RedirectURI: redirectURI, SubjectType: SubjectTypePairwise, SectorIdentifier: "a.example"},
+			"pairwise-a-peer": csClient{Secret: clientSecret, RedirectURI: redirectURI, SubjectType: SubjectTypePairwise, SectorIdentifier: "a.example"},
+			"pairwise-b":      csClient{Secret: clientSecret, RedirectURI: redirectURI, SubjectType: SubjectTypePairwise, SectorIdentifier: "b.example"},
+			"public":          csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"public", "pairwise"}, o.SubjectTypesSupported(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want subject types %v, got: %v", want, got)
+	}
+
+	// login runs the code flow for the client, returning the sub in the ID
+	// token and the access token.
+	login := func(t *testing.T, clientID string) (string, string) {
+		t.Helper()
+		ctx := context.Background()
+
+		ucode, scode, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := putSession(ctx, smgr, &sessionV2{
+			ID:            ucode.SessionId,
+			ClientID:      clientID,
+			Stage:         sessionStageCode,
+			Request:       &sessAuthRequest{RedirectURI: redirectURI},
+			AuthCode:      scode,
+			Authorization: &sessAuthorization{Scopes: []string{"openid"}, Subject: subject},
+			Expiry:        time.Now().Add(1 * time.Minute),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         mustMarshal(ucode),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken("https://issuer", subject, time.Now().Add(1*time.Minute)),
+			}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jws, err := jose.ParseSigned(tresp.ExtraParams["id_token"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cl struct {
+			Subject string `json:"sub"`
+		}
+		if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &cl); err != nil {
+			t.Fatal(err)
+		}
+		return cl.Subject, tresp.AccessToken
+	}
+
+	subA, atA := login(t, "pairwise-a")
+	subPeer, _ := login(t, "pairwise-a-peer")
+	subB, _ := login(t, "pairwise-b")
+	subPublic, _ := login(t, "public")
+
+	if subA == subject || subB == subject {
+		t.Errorf("want pairwise subs to differ from the subject, got: %s and %s", subA, subB)
+	}
+	if subA == subB {
+		t.Errorf("want clients in different sectors to get different subs, both got: %s", subA)
+	}
+	if subA != subPeer {
+		t.Errorf("want clients in the same sector to get the same sub, got: %s and %s", subA, subPeer)
+	}
+	if again, _ := login(t, "pairwise-a"); again != subA {
+		t.Errorf("want pairwise sub to be stable, got: %s then %s", subA, again)
+	}
+	if subPublic != subject {
+		t.Errorf("want public client to get the subject %s, got: %s", subject, subPublic)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+atA)
+	rec := httptest.NewRecorder()
+	if err := o.Userinfo(rec, req, func(w io.Writer, _ *UserinfoRequest) error {
+		return json.NewEncoder(w).Encode(map[string]interface{}{"sub": subject})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var ui struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ui); err != nil {
+		t.Fatal(err)
+	}
+	if ui.Subject != subA {
+		t.Errorf("want userinfo sub to match the ID token's %s, got: %s", subA, ui.Subject)
+	}
+}
+
+func TestPairwiseSubjectsNotConfigured(t *testing.T) {
+	o, err := New(&Config{}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			"client-id": csClient{SubjectType: SubjectTypePairwise},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"public"}, o.SubjectTypesSupported(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want subject types %v, got: %v", want, got)
+	}
+	// issuing the real subject would defeat the point, so fail instead.
+	if _, err := o.clientSubject("client-id", "user-1"); err == nil {
+		t.Error("want error for a pairwise client without a SubjectGenerator")
+	}
+}
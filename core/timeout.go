@@ -0,0 +1,22 @@
+package core
+
+import (
+	"context"
+	"net/http"
+)
+
+// LimitOperationTime wraps h, so the context of each request it handles
+// expires after the configured OperationTimeout. The handlers pass this context
+// on to the SessionManager, Signer and other dependencies, so slow operations
+// are canceled rather than holding the request open. If no OperationTimeout is
+// configured, h is returned as-is.
+func (o *OIDC) LimitOperationTime(h http.Handler) http.Handler {
+	if o.operationTimeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), o.operationTimeout)
+		defer cancel()
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitOperationTime(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	o, err := New(&Config{OperationTimeout: 50 * time.Millisecond}, &slowSMGR{stubSMGR: newStubSMGR()}, &stubCS{
+		validClients: map[string]csClient{
+			clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ucode, _, err := newToken(mustGenerateID(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name    string
+		Handler http.HandlerFunc
+		Request func() *http.Request
+		WantErr string
+	}{
+		{
+			Name: "Token",
+			Handler: func(w http.ResponseWriter, req *http.Request) {
+				_ = o.Token(w, req, func(*TokenRequest) (*TokenResponse, error) {
+					t.Error("handler should not be called")
+					return nil, nil
+				})
+			},
+			Request: func() *http.Request {
+				body := url.Values{
+					"grant_type":   {"authorization_code"},
+					"code":         {mustMarshal(ucode)},
+					"redirect_uri": {redirectURI},
+				}
+				req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.SetBasicAuth(clientID, clientSecret)
+				return req
+			},
+			WantErr: "temporarily_unavailable",
+		},
+		{
+			Name: "Userinfo",
+			Handler: func(w http.ResponseWriter, req *http.Request) {
+				_ = o.Userinfo(w, req, func(io.Writer, *UserinfoRequest) error {
+					t.Error("handler should not be called")
+					return nil
+				})
+			},
+			Request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+				req.Header.Set("Authorization", "Bearer "+mustMarshal(ucode))
+				return req
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				o.LimitOperationTime(tc.Handler).ServeHTTP(rec, tc.Request())
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("request was not canceled")
+			}
+
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("want status %d, got %d: %s", http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+			}
+			if tc.WantErr != "" {
+				var resp struct {
+					Error string `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error != tc.WantErr {
+					t.Errorf("want error %s, got: %s", tc.WantErr, resp.Error)
+				}
+			}
+		})
+	}
+}
+
+// slowSMGR is a SessionManager whose reads never complete, until the context
+// is done.
+type slowSMGR struct {
+	*stubSMGR
+}
+
+func (s *slowSMGR) GetSession(ctx context.Context, _ string, _ Session) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
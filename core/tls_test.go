@@ -0,0 +1,129 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTLSServer(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-1 * time.Minute),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTLSServer(l.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	go func() { _ = srv.ServeTLS(l, certFile, keyFile) }()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	for _, tc := range []struct {
+		Name      string
+		Version   uint16
+		WantProto string
+	}{
+		{
+			Name:    "TLS 1.0",
+			Version: tls.VersionTLS10,
+		},
+		{
+			Name:    "TLS 1.1",
+			Version: tls.VersionTLS11,
+		},
+		{
+			Name:      "TLS 1.2",
+			Version:   tls.VersionTLS12,
+			WantProto: "HTTP/2.0",
+		},
+		{
+			Name:      "TLS 1.3",
+			Version:   tls.VersionTLS13,
+			WantProto: "HTTP/2.0",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:    roots,
+					MinVersion: tc.Version,
+					MaxVersion: tc.Version,
+				},
+				ForceAttemptHTTP2: true,
+			}}
+			resp, err := client.Get("https://" + l.Addr().String())
+			if tc.WantProto == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("want connection to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.Proto != tc.WantProto {
+				t.Errorf("want proto %s, got: %s", tc.WantProto, resp.Proto)
+			}
+		})
+	}
+
+	t.Run("Configurable minimum version", func(t *testing.T) {
+		srv := NewTLSServer("", nil, WithMinTLSVersion(tls.VersionTLS13))
+		if srv.TLSConfig.MinVersion != tls.VersionTLS13 {
+			t.Errorf("want min version TLS 1.3, got: %x", srv.TLSConfig.MinVersion)
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pardot/oidc"
+	"github.com/pardot/oidc/oauth2"
+)
+
+// TokenExchangeClientSource can be implemented by a ClientSource to allow
+// clients to use the token exchange grant. If it is not implemented, no
+// clients can exchange tokens.
+//
+// https://tools.ietf.org/html/rfc8693
+type TokenExchangeClientSource interface {
+	// ClientAllowTokenExchange should return true if the client can exchange
+	// tokens.
+	ClientAllowTokenExchange(clientID string) (ok bool, err error)
+}
+
+// TokenExchange details a request to the token exchange grant. The subject and
+// actor tokens have been verified as issued by us.
+type TokenExchange struct {
+	// Subject are the claims of the token being exchanged. This is who the
+	// issued token represents.
+	Subject oidc.Claims
+	// Actor are the claims of the actor token, if one was passed. The actor
+	// is acting on behalf of the subject, and will be recorded in the act
+	// claim of the issued token.
+	Actor *oidc.Claims
+	// Audience the issued token is requested for. If empty, the token is
+	// issued for the client.
+	Audience []string
+	// Scopes the issued token is requested for.
+	Scopes []string
+}
+
+// tokenExchange handles the token exchange grant. The subject token is
+// verified, and if the handler approves a new token is signed for the subject.
+// No session is created, the issued token is a self-contained JWT.
+//
+// https://tools.ietf.org/html/rfc8693#section-2
+func (o *OIDC) tokenExchange(ctx context.Context, req *tokenRequest, handler func(req *TokenRequest) (*TokenResponse, error)) (*tokenResponse, error) {
+	if err := o.authenticateTokenClient(ctx, req); err != nil {
+		return nil, err
+	}
+
+	tecs, ok := o.clients.(TokenExchangeClientSource)
+	if !ok {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not exchange tokens"}
+	}
+	allowed, err := tecs.ClientAllowTokenExchange(req.ClientID)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to check if client can exchange tokens", Cause: err}
+	}
+	if !allowed {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeUnauthorizedClient, Description: "client can not exchange tokens"}
+	}
+
+	ter := req.TokenExchange
+	if err := o.checkClientRestrictions(req.ClientID, req.GrantType, ter.Scopes); err != nil {
+		return nil, err
+	}
+
+	issuedType := ter.RequestedTokenType
+	switch issuedType {
+	case "":
+		issuedType = TokenTypeIdentifierAccessToken
+	case TokenTypeIdentifierAccessToken, TokenTypeIdentifierJWT:
+	default:
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "unsupported requested_token_type"}
+	}
+
+	subject, err := o.verifyExchangedToken(ctx, ter.SubjectToken, ter.SubjectTokenType)
+	if err != nil {
+		return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid subject_token", Cause: err}
+	}
+	te := &TokenExchange{
+		Subject:  *subject,
+		Audience: ter.Audience,
+		Scopes:   ter.Scopes,
+	}
+	if ter.ActorToken != "" {
+		te.Actor, err = o.verifyExchangedToken(ctx, ter.ActorToken, ter.ActorTokenType)
+		if err != nil {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidRequest, Description: "invalid actor_token", Cause: err}
+		}
+	}
+
+	tresp, err := handler(&TokenRequest{
+		ClientID:      req.ClientID,
+		Issuer:        o.issuerFrom(ctx),
+		GrantType:     req.GrantType,
+		TokenExchange: te,
+
+		now: o.now,
+	})
+	if err != nil {
+		var uaerr unauthorizedErr
+		if errors.As(err, &uaerr); uaerr != nil && uaerr.Unauthorized() {
+			return nil, &oauth2.TokenError{ErrorCode: oauth2.TokenErrorCodeInvalidGrant, Description: uaerr.Error()}
+		}
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "handler returned error", Cause: err}
+	}
+
+	if err := o.applyClientTokenLifetimes(req.ClientID, tresp); err != nil {
+		return nil, err
+	}
+
+	if tresp.AccessTokenValidUntil.Before(o.now()) {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "access token must be valid > now"}
+	}
+
+	aud := oidc.Audience(te.Audience)
+	if len(aud) == 0 {
+		aud = oidc.Audience{req.ClientID}
+	}
+	extra := map[string]interface{}{
+		"client_id": req.ClientID,
+	}
+	if len(te.Scopes) > 0 {
+		extra["scope"] = strings.Join(te.Scopes, " ")
+	}
+	if te.Actor != nil {
+		// https://tools.ietf.org/html/rfc8693#section-4.1
+		act := map[string]interface{}{"sub": te.Actor.Subject}
+		if te.Actor.Issuer != "" {
+			act["iss"] = te.Actor.Issuer
+		}
+		// retain the chain of delegation, if the subject was already
+		// delegated.
+		if prev, ok := te.Subject.Extra["act"]; ok {
+			act["act"] = prev
+		}
+		extra["act"] = act
+	}
+
+	cl := oidc.Claims{
+		Issuer:   o.issuerFrom(ctx),
+		Subject:  te.Subject.Subject,
+		Audience: aud,
+		Expiry:   oidc.NewUnixTime(tresp.AccessTokenValidUntil),
+		IssuedAt: oidc.NewUnixTime(o.now()),
+		Extra:    extra,
+	}
+	clb, err := json.Marshal(cl)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to marshal exchanged token", Cause: err}
+	}
+	signed, err := o.signer.Sign(ctx, clb)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to sign exchanged token", Cause: err}
+	}
+
+	o.audit(ctx, AuditEvent{
+		Type:      AuditEventTokenIssued,
+		ClientID:  req.ClientID,
+		Subject:   te.Subject.Subject,
+		Scopes:    te.Scopes,
+		GrantType: req.GrantType,
+	})
+
+	// JWTs that are not access tokens can't be used as bearer tokens.
+	//
+	// https://tools.ietf.org/html/rfc8693#section-2.2.1
+	tokenType := "Bearer"
+	if issuedType != TokenTypeIdentifierAccessToken {
+		tokenType = "N_A"
+	}
+
+	return &tokenResponse{
+		AccessToken: string(signed),
+		TokenType:   tokenType,
+		ExpiresIn:   tresp.AccessTokenValidUntil.Sub(o.now()),
+		Scopes:      te.Scopes,
+		ExtraParams: map[string]interface{}{
+			"issued_token_type": string(issuedType),
+		},
+	}, nil
+}
+
+// verifyExchangedToken checks a token passed to the token exchange grant was
+// signed by us and is still valid, returning its claims. Only ID tokens and
+// other JWTs we signed are accepted.
+func (o *OIDC) verifyExchangedToken(ctx context.Context, token string, typ TokenTypeIdentifier) (*oidc.Claims, error) {
+	if typ != TokenTypeIdentifierIDToken && typ != TokenTypeIdentifierJWT {
+		return nil, fmt.Errorf("unsupported token type %s", typ)
+	}
+
+	payload, err := o.signer.VerifySignature(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("verifying token: %w", err)
+	}
+	cl := oidc.Claims{}
+	if err := json.Unmarshal(payload, &cl); err != nil {
+		return nil, fmt.Errorf("unmarshaling token claims: %w", err)
+	}
+
+	if cl.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	if cl.Expiry == 0 || o.now().After(cl.Expiry.Time()) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if iss := o.issuerFrom(ctx); iss != "" && cl.Issuer != iss {
+		return nil, fmt.Errorf("token issued by %s, not %s", cl.Issuer, iss)
+	}
+
+	return &cl, nil
+}
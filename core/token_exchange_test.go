@@ -0,0 +1,268 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+	"github.com/pardot/oidc/oauth2"
+	"github.com/pardot/oidc/signer"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestTokenExchange(t *testing.T) {
+	const (
+		clientID      = "client-id"
+		clientSecret  = "client-secret"
+		otherClientID = "other-client"
+		issuer        = "https://issuer"
+	)
+
+	otherKey := mustGenRSAKey(512)
+	otherSigner := signer.NewStatic(
+		jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: otherKey, KeyID: "other"}},
+		[]jose.JSONWebKey{{Key: otherKey.Public(), KeyID: "other", Algorithm: "RS256", Use: "sig"}},
+	)
+
+	sign := func(t *testing.T, s Signer, cl oidc.Claims) string {
+		t.Helper()
+		b, err := json.Marshal(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := s.Sign(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(signed)
+	}
+
+	subjectClaims := func() oidc.Claims {
+		return oidc.Claims{
+			Issuer:   issuer,
+			Subject:  "user",
+			Audience: oidc.Audience{"https://frontend"},
+			Expiry:   oidc.NewUnixTime(time.Now().Add(1 * time.Minute)),
+		}
+	}
+
+	approve := func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{AccessTokenValidUntil: time.Now().Add(1 * time.Minute)}, nil
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		ClientID string
+		Exchange func(t *testing.T) *tokenExchangeRequest
+		Handler  func(tr *TokenRequest) (*TokenResponse, error)
+		// WantErrMatch signifies that we expect an error
+		WantErrMatch  func(error) bool
+		WantTokenType string
+		WantIssued    TokenTypeIdentifier
+		WantClaims    map[string]interface{}
+	}{
+		{
+			Name: "Impersonation",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, testSigner, subjectClaims()),
+					SubjectTokenType: TokenTypeIdentifierIDToken,
+					Scopes:           []string{"read"},
+				}
+			},
+			WantTokenType: "Bearer",
+			WantIssued:    TokenTypeIdentifierAccessToken,
+			WantClaims: map[string]interface{}{
+				"iss":       issuer,
+				"sub":       "user",
+				"aud":       clientID,
+				"client_id": clientID,
+				"scope":     "read",
+			},
+		},
+		{
+			Name: "Delegation to an actor",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				actor := subjectClaims()
+				actor.Subject = "service"
+				return &tokenExchangeRequest{
+					SubjectToken:       sign(t, testSigner, subjectClaims()),
+					SubjectTokenType:   TokenTypeIdentifierIDToken,
+					ActorToken:         sign(t, testSigner, actor),
+					ActorTokenType:     TokenTypeIdentifierJWT,
+					RequestedTokenType: TokenTypeIdentifierJWT,
+					Audience:           []string{"https://backend"},
+				}
+			},
+			WantTokenType: "N_A",
+			WantIssued:    TokenTypeIdentifierJWT,
+			WantClaims: map[string]interface{}{
+				"iss":       issuer,
+				"sub":       "user",
+				"aud":       "https://backend",
+				"client_id": clientID,
+				"act":       map[string]interface{}{"sub": "service", "iss": issuer},
+			},
+		},
+		{
+			Name: "Delegation chain is retained",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				subject := subjectClaims()
+				subject.Extra = map[string]interface{}{"act": map[string]interface{}{"sub": "first-service"}}
+				actor := subjectClaims()
+				actor.Subject = "second-service"
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, testSigner, subject),
+					SubjectTokenType: TokenTypeIdentifierJWT,
+					ActorToken:       sign(t, testSigner, actor),
+					ActorTokenType:   TokenTypeIdentifierJWT,
+				}
+			},
+			WantTokenType: "Bearer",
+			WantIssued:    TokenTypeIdentifierAccessToken,
+			WantClaims: map[string]interface{}{
+				"iss":       issuer,
+				"sub":       "user",
+				"aud":       clientID,
+				"client_id": clientID,
+				"act": map[string]interface{}{
+					"sub": "second-service",
+					"iss": issuer,
+					"act": map[string]interface{}{"sub": "first-service"},
+				},
+			},
+		},
+		{
+			Name:     "Client not allowed to exchange",
+			ClientID: otherClientID,
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, testSigner, subjectClaims()),
+					SubjectTokenType: TokenTypeIdentifierIDToken,
+				}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeUnauthorizedClient),
+		},
+		{
+			Name: "Subject token signed by someone else",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, otherSigner, subjectClaims()),
+					SubjectTokenType: TokenTypeIdentifierIDToken,
+				}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+		},
+		{
+			Name: "Expired subject token",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				cl := subjectClaims()
+				cl.Expiry = oidc.NewUnixTime(time.Now().Add(-1 * time.Minute))
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, testSigner, cl),
+					SubjectTokenType: TokenTypeIdentifierIDToken,
+				}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+		},
+		{
+			Name: "Unsupported subject token type",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, testSigner, subjectClaims()),
+					SubjectTokenType: TokenTypeIdentifierAccessToken,
+				}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+		},
+		{
+			Name: "Unsupported requested token type",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				return &tokenExchangeRequest{
+					SubjectToken:       sign(t, testSigner, subjectClaims()),
+					SubjectTokenType:   TokenTypeIdentifierIDToken,
+					RequestedTokenType: TokenTypeIdentifierIDToken,
+				}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidRequest),
+		},
+		{
+			Name: "Handler rejects exchange",
+			Exchange: func(t *testing.T) *tokenExchangeRequest {
+				return &tokenExchangeRequest{
+					SubjectToken:     sign(t, testSigner, subjectClaims()),
+					SubjectTokenType: TokenTypeIdentifierIDToken,
+					Audience:         []string{"https://forbidden"},
+				}
+			},
+			Handler: func(tr *TokenRequest) (*TokenResponse, error) {
+				return nil, &unauthorizedErrImpl{error: errors.New("audience not allowed")}
+			},
+			WantErrMatch: matchTokenErrCode(oauth2.TokenErrorCodeInvalidGrant),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := &OIDC{
+				smgr:   newStubSMGR(),
+				signer: testSigner,
+				clients: &stubCS{
+					validClients: map[string]csClient{
+						clientID:      csClient{Secret: clientSecret, AllowTokenExchange: true},
+						otherClientID: csClient{Secret: clientSecret},
+					},
+				},
+				issuer: issuer,
+				now:    time.Now,
+			}
+
+			cid := tc.ClientID
+			if cid == "" {
+				cid = clientID
+			}
+			handler := tc.Handler
+			if handler == nil {
+				handler = approve
+			}
+
+			tresp, err := o.token(context.Background(), &tokenRequest{
+				GrantType:     GrantTypeTokenExchange,
+				ClientID:      cid,
+				ClientSecret:  clientSecret,
+				TokenExchange: tc.Exchange(t),
+			}, handler)
+			checkErrMatcher(t, tc.WantErrMatch, err)
+			if tc.WantErrMatch != nil {
+				return
+			}
+
+			if tresp.TokenType != tc.WantTokenType {
+				t.Errorf("want token type %s, got: %s", tc.WantTokenType, tresp.TokenType)
+			}
+			if got := tresp.ExtraParams["issued_token_type"]; got != string(tc.WantIssued) {
+				t.Errorf("want issued token type %s, got: %v", tc.WantIssued, got)
+			}
+
+			payload, err := testSigner.VerifySignature(context.Background(), tresp.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]interface{}{}
+			if err := json.Unmarshal(payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got["exp"] == nil || got["iat"] == nil {
+				t.Errorf("want exp and iat set, got: %v", got)
+			}
+			delete(got, "exp")
+			delete(got, "iat")
+
+			if diff := cmp.Diff(tc.WantClaims, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// tokenHash returns the value for the at_hash or c_hash claims of an ID token
+// signed with alg. This is the base64url encoded left-most half of the token's
+// hash, using the hash function alg is based on.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+func tokenHash(alg jose.SignatureAlgorithm, token string) (string, error) {
+	var h hash.Hash
+	switch alg {
+	case jose.RS256, jose.ES256, jose.PS256, jose.HS256:
+		h = sha256.New()
+	case jose.RS384, jose.ES384, jose.PS384, jose.HS384:
+		h = sha512.New384()
+	case jose.RS512, jose.ES512, jose.PS512, jose.HS512, jose.EdDSA:
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("no hash function for algorithm %s", alg)
+	}
+	_, _ = h.Write([]byte(token))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
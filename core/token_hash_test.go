@@ -0,0 +1,54 @@
+package core
+
+import (
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestTokenHash(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Alg     jose.SignatureAlgorithm
+		Token   string
+		Want    string
+		WantErr bool
+	}{
+		{
+			// from the examples in OIDC core appendix A
+			Name:  "RS256 access token",
+			Alg:   jose.RS256,
+			Token: "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y",
+			Want:  "77QmUPtjPfzWtF2AnpK9RQ",
+		},
+		{
+			// from the examples in OIDC core appendix A
+			Name:  "RS256 code",
+			Alg:   jose.RS256,
+			Token: "Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk",
+			Want:  "LDktKdoQak3Pk0cnXxCltA",
+		},
+		{
+			Name:    "Unknown algorithm",
+			Alg:     jose.SignatureAlgorithm("none"),
+			Token:   "token",
+			WantErr: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := tokenHash(tc.Alg, tc.Token)
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.Want {
+				t.Errorf("want %s, got: %s", tc.Want, got)
+			}
+		})
+	}
+}
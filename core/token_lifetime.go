@@ -0,0 +1,68 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// TokenLifetimes are how long the tokens issued to a client are valid for.
+// Zero values leave the lifetime returned by the token handler unchanged.
+type TokenLifetimes struct {
+	IDToken      time.Duration
+	AccessToken  time.Duration
+	RefreshToken time.Duration
+}
+
+// TokenLifetimeClientSource can be implemented by a ClientSource to set how
+// long the tokens issued to each client are valid for, overriding the times
+// the token handler returns. Lifetimes longer than the configured
+// MaxTokenValidity are rejected, and the client will fail to get tokens until
+// they are corrected.
+type TokenLifetimeClientSource interface {
+	// ClientTokenLifetimes returns the lifetimes for the client's tokens.
+	ClientTokenLifetimes(clientID string) (TokenLifetimes, error)
+}
+
+// clientTokenLifetimes returns the lifetimes configured for the client, if
+// any.
+func (o *OIDC) clientTokenLifetimes(clientID string) (TokenLifetimes, error) {
+	tlcs, ok := o.clients.(TokenLifetimeClientSource)
+	if !ok {
+		return TokenLifetimes{}, nil
+	}
+	l, err := tlcs.ClientTokenLifetimes(clientID)
+	if err != nil {
+		return TokenLifetimes{}, err
+	}
+	if o.maxTokenValidity > 0 {
+		for _, d := range []time.Duration{l.IDToken, l.AccessToken, l.RefreshToken} {
+			if d > o.maxTokenValidity {
+				return TokenLifetimes{}, fmt.Errorf("client token lifetime %s exceeds maximum %s", d, o.maxTokenValidity)
+			}
+		}
+	}
+	return l, nil
+}
+
+// applyClientTokenLifetimes overrides the validity times in the handler's
+// response with those configured for the client.
+func (o *OIDC) applyClientTokenLifetimes(clientID string, tresp *TokenResponse) error {
+	l, err := o.clientTokenLifetimes(clientID)
+	if err != nil {
+		return &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get client token lifetimes", Cause: err}
+	}
+	now := o.now()
+	if l.IDToken > 0 {
+		tresp.IDToken.Expiry = oidc.NewUnixTime(now.Add(l.IDToken))
+	}
+	if l.AccessToken > 0 {
+		tresp.AccessTokenValidUntil = now.Add(l.AccessToken)
+	}
+	if l.RefreshToken > 0 {
+		tresp.RefreshTokenValidUntil = now.Add(l.RefreshToken)
+	}
+	return nil
+}
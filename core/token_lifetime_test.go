@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+func TestClientTokenLifetimes(t *testing.T) {
+	const (
+		clientID     = "client-id"
+		clientSecret = "client-secret"
+		redirectURI  = "https://redirect"
+	)
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	for _, tc := range []struct {
+		Name        string
+		Lifetimes   TokenLifetimes
+		MaxValidity time.Duration
+		WantErr     bool
+		WantAccess  time.Duration
+		WantRefresh time.Duration
+		WantID      time.Duration
+	}{
+		{
+			Name:        "Handler defaults",
+			WantAccess:  1 * time.Hour,
+			WantRefresh: 24 * time.Hour,
+			WantID:      1 * time.Hour,
+		},
+		{
+			Name: "Client's shorter lifetimes win",
+			Lifetimes: TokenLifetimes{
+				IDToken:      5 * time.Minute,
+				AccessToken:  1 * time.Minute,
+				RefreshToken: 10 * time.Minute,
+			},
+			MaxValidity: 1 * time.Hour,
+			WantAccess:  1 * time.Minute,
+			WantRefresh: 10 * time.Minute,
+			WantID:      5 * time.Minute,
+		},
+		{
+			Name:        "Only access token set",
+			Lifetimes:   TokenLifetimes{AccessToken: 2 * time.Minute},
+			WantAccess:  2 * time.Minute,
+			WantRefresh: 24 * time.Hour,
+			WantID:      1 * time.Hour,
+		},
+		{
+			Name:        "Exceeds maximum",
+			Lifetimes:   TokenLifetimes{RefreshToken: 48 * time.Hour},
+			MaxValidity: 24 * time.Hour,
+			WantErr:     true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{MaxTokenValidity: tc.MaxValidity}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{Secret: clientSecret, RedirectURI: redirectURI, TokenLifetimes: tc.Lifetimes},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o.now = func() time.Time { return now }
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid offline_access"},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: []string{"openid", "offline_access"}}); err != nil {
+				t.Fatal(err)
+			}
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tresp, err := o.token(ctx, &tokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				Code:         loc.Query().Get("code"),
+				RedirectURI:  redirectURI,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, func(tr *TokenRequest) (*TokenResponse, error) {
+				return &TokenResponse{
+					IssueRefreshToken:      true,
+					AccessTokenValidUntil:  now.Add(1 * time.Hour),
+					RefreshTokenValidUntil: now.Add(24 * time.Hour),
+					IDToken:                tr.PrefillIDToken("https://issuer", "subject", now.Add(1*time.Hour)),
+				}, nil
+			})
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tresp.ExpiresIn != tc.WantAccess {
+				t.Errorf("want expires_in %s, got: %s", tc.WantAccess, tresp.ExpiresIn)
+			}
+
+			payload, err := testSigner.VerifySignature(ctx, tresp.ExtraParams["id_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cl oidc.Claims
+			if err := json.Unmarshal(payload, &cl); err != nil {
+				t.Fatal(err)
+			}
+			if got := cl.Expiry.Time(); !got.Equal(now.Add(tc.WantID)) {
+				t.Errorf("want id token exp %s, got: %s", now.Add(tc.WantID), got)
+			}
+
+			for tok, want := range map[string]time.Duration{
+				tresp.AccessToken:  tc.WantAccess,
+				tresp.RefreshToken: tc.WantRefresh,
+			} {
+				resp, err := o.introspect(ctx, &tokenHintRequest{Token: tok, ClientID: clientID, ClientSecret: clientSecret}, func(_ *IntrospectionRequest) (*IntrospectionResponse, error) {
+					return &IntrospectionResponse{}, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := resp["exp"].(oidc.UnixTime).Time(); !got.Equal(now.Add(want)) {
+					t.Errorf("want introspection exp %s, got: %s", now.Add(want), got)
+				}
+			}
+		})
+	}
+}
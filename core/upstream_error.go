@@ -0,0 +1,62 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// UpstreamError is returned by whatever authenticates the user, e.g an
+// upstream identity provider, when it fails in a way the client should be
+// told about. FailAuthorization maps it to the OAuth2 error returned.
+type UpstreamError struct {
+	// Code returned to the client.
+	Code AuthorizationErrorCode
+	// Description returned to the client. It should not contain anything
+	// sensitive.
+	Description string
+	// Err is the underlying error, which is not returned to the client.
+	Err error
+}
+
+func (u *UpstreamError) Error() string {
+	if u.Err != nil {
+		return fmt.Sprintf("upstream %s: %s: %v", u.Code, u.Description, u.Err)
+	}
+	return fmt.Sprintf("upstream %s: %s", u.Code, u.Description)
+}
+
+func (u *UpstreamError) Unwrap() error {
+	return u.Err
+}
+
+// FailAuthorization can be called instead of FinishAuthorization when
+// authenticating the user failed with err. If err is an UpstreamError its code
+// and description are returned to the client, otherwise the client is sent a
+// server_error. The user is redirected back to the client as with
+// RejectAuthorization.
+func (o *OIDC) FailAuthorization(w http.ResponseWriter, req *http.Request, sessionID string, err error) error {
+	code, desc := upstreamErrorCode(err)
+	return o.RejectAuthorization(w, req, sessionID, code, desc)
+}
+
+// upstreamErrorCode returns the code and description to send the client for
+// err. Codes a client could not act on are returned as server_error.
+func upstreamErrorCode(err error) (AuthorizationErrorCode, string) {
+	var uerr *UpstreamError
+	if !errors.As(err, &uerr) {
+		return AuthorizationErrorServerError, "authentication failed"
+	}
+	switch uerr.Code {
+	case AuthorizationErrorAccessDenied,
+		AuthorizationErrorTemporarilyUnavailable,
+		AuthorizationErrorLoginRequired,
+		AuthorizationErrorConsentRequired,
+		AuthorizationErrorInteractionRequired,
+		AuthorizationErrorAccountSelectionRequired,
+		AuthorizationErrorUnmetAuthenticationRequirements:
+		return uerr.Code, uerr.Description
+	default:
+		return AuthorizationErrorServerError, uerr.Description
+	}
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFailAuthorization(t *testing.T) {
+	const (
+		clientID    = "client-id"
+		redirectURI = "https://redirect"
+	)
+
+	for _, tc := range []struct {
+		Name     string
+		Err      error
+		WantCode string
+		WantDesc string
+	}{
+		{
+			Name:     "access denied",
+			Err:      &UpstreamError{Code: AuthorizationErrorAccessDenied, Description: "user denied the request"},
+			WantCode: "access_denied",
+			WantDesc: "user denied the request",
+		},
+		{
+			Name:     "temporarily unavailable",
+			Err:      &UpstreamError{Code: AuthorizationErrorTemporarilyUnavailable, Description: "upstream is down", Err: errors.New("dial tcp: connection refused")},
+			WantCode: "temporarily_unavailable",
+			WantDesc: "upstream is down",
+		},
+		{
+			Name:     "wrapped upstream error",
+			Err:      fmt.Errorf("checking groups: %w", &UpstreamError{Code: AuthorizationErrorAccessDenied, Description: "not in group"}),
+			WantCode: "access_denied",
+			WantDesc: "not in group",
+		},
+		{
+			Name:     "unmapped code",
+			Err:      &UpstreamError{Code: AuthorizationErrorCode("invalid_scope"), Description: "bad upstream scope"},
+			WantCode: "server_error",
+			WantDesc: "bad upstream scope",
+		},
+		{
+			Name:     "plain error",
+			Err:      errors.New("secret internal detail"),
+			WantCode: "server_error",
+			WantDesc: "authentication failed",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o, err := New(&Config{}, newStubSMGR(), &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{RedirectURI: redirectURI},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := url.Values{
+				"response_type": {"code"},
+				"client_id":     {clientID},
+				"redirect_uri":  {redirectURI},
+				"scope":         {"openid"},
+				"state":         {"state"},
+			}
+			areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			if err := o.FailAuthorization(rec, httptest.NewRequest("GET", "/", nil), areq.SessionID, tc.Err); err != nil {
+				t.Fatal(err)
+			}
+
+			loc, err := url.Parse(rec.Header().Get("location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("error"); got != tc.WantCode {
+				t.Errorf("want error %s, got: %s", tc.WantCode, got)
+			}
+			if got := loc.Query().Get("error_description"); got != tc.WantDesc {
+				t.Errorf("want error_description %q, got: %q", tc.WantDesc, got)
+			}
+			if got := loc.Query().Get("state"); got != "state" {
+				t.Errorf("want state returned, got: %s", got)
+			}
+		})
+	}
+
+	t.Run("no session", func(t *testing.T) {
+		o, err := New(&Config{}, newStubSMGR(), &stubCS{}, testSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		if err := o.FailAuthorization(rec, httptest.NewRequest("GET", "/", nil), "missing", &UpstreamError{Code: AuthorizationErrorAccessDenied}); err == nil {
+			t.Fatal("want error for missing session")
+		}
+		if rec.Code != 403 {
+			t.Errorf("want 403, got: %d", rec.Code)
+		}
+	})
+}
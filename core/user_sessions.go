@@ -0,0 +1,156 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pardot/oidc/storage"
+)
+
+// UserSession describes a client a user is currently signed in to.
+type UserSession struct {
+	// ID of the session, to revoke it with RevokeUserSession.
+	ID string `json:"id"`
+	// ClientID the session is for.
+	ClientID string `json:"client_id"`
+	// ClientName is the client's registered client_name, if the ClientSource
+	// implements MutableClientSource.
+	ClientName string `json:"client_name,omitempty"`
+	// Scopes the user granted the client.
+	Scopes []string `json:"scopes"`
+	// CreatedAt is when the user authorized the client.
+	CreatedAt time.Time `json:"created_at"`
+	// LastUsedAt is when the client last redeemed the session's code or
+	// refresh token.
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// ListUserSessions returns the sessions the subject is signed in to clients
+// with, most recently used first. Only sessions that tokens have been issued
+// for and that have not expired are returned, and only those where the
+// subject was passed in the Authorization can be found. If the ClientSource
+// implements MutableClientSource, sessions for clients that have been deleted
+// are skipped.
+//
+// The SessionManager must implement SessionLister. Every session is loaded to
+// find the subject's, so this should be used sparingly on large stores.
+func (o *OIDC) ListUserSessions(ctx context.Context, subject string) ([]UserSession, error) {
+	sessions, err := o.subjectSessions(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	mcs, _ := o.clients.(MutableClientSource)
+
+	ret := []UserSession{}
+	for _, sess := range sessions {
+		if !userSessionActive(sess, o.now()) {
+			continue
+		}
+		us := UserSession{
+			ID:         sess.ID,
+			ClientID:   sess.ClientID,
+			Scopes:     sess.Authorization.Scopes,
+			CreatedAt:  sess.Authorization.AuthorizedAt,
+			LastUsedAt: sess.LastUsedAt,
+		}
+		if mcs != nil {
+			cl, err := mcs.GetClient(ctx, sess.ClientID)
+			if storage.IsNotFoundErr(err) {
+				// the client was deleted, so can't use the session.
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("getting client %s: %w", sess.ClientID, err)
+			}
+			us.ClientName = cl.Metadata.ClientName
+		}
+		ret = append(ret, us)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LastUsedAt.After(ret[j].LastUsedAt)
+	})
+	return ret, nil
+}
+
+// userSessionActive returns true if the session has issued tokens the client
+// can still use.
+func userSessionActive(sess *sessionV2, now time.Time) bool {
+	if sess.Stage != sessionStageAccessTokenIssued && sess.Stage != sessionStageRefreshable {
+		return false
+	}
+	return now.Before(sess.Expiry)
+}
+
+// UserSessions can handle a request from a signed in user for the clients
+// they are signed in to, with ListUserSessions. The caller is responsible for
+// authenticating the user, e.g with its own session cookie, and passes the
+// subject they are signed in as. The sessions are returned as a JSON array.
+func (o *OIDC) UserSessions(w http.ResponseWriter, req *http.Request, subject string) error {
+	req = o.withErrorHandler(req)
+
+	if req.Method != http.MethodGet {
+		herr := &httpError{Code: http.StatusMethodNotAllowed, Message: "method not allowed", CauseMsg: fmt.Sprintf("method %s not allowed", req.Method)}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	sessions, err := o.ListUserSessions(req.Context(), subject)
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to list user sessions", Cause: err}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeUserSession can handle a DELETE from a signed in user to sign out of
+// one of the sessions returned by UserSessions, invalidating its access and
+// refresh tokens. The session ID should be extracted from the request path by
+// the caller, and the subject is the authenticated user, as for UserSessions.
+// Sessions that don't exist or belong to someone else get a 404.
+func (o *OIDC) RevokeUserSession(w http.ResponseWriter, req *http.Request, subject, sessionID string) error {
+	req = o.withErrorHandler(req)
+
+	if req.Method != http.MethodDelete {
+		herr := &httpError{Code: http.StatusMethodNotAllowed, Message: "method not allowed", CauseMsg: fmt.Sprintf("method %s not allowed", req.Method)}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	sess, err := getSession(req.Context(), o.smgr, sessionID)
+	if err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to get session", Cause: err}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+	if subject == "" || sess == nil || sess.Authorization == nil || sess.Authorization.Subject != subject {
+		herr := &httpError{Code: http.StatusNotFound, Message: "session not found"}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	if err := o.smgr.DeleteSession(req.Context(), sess.ID); err != nil {
+		herr := &httpError{Code: http.StatusInternalServerError, Message: "internal error", CauseMsg: "failed to delete session", Cause: err}
+		_ = writeError(w, req, herr)
+		return herr
+	}
+
+	o.audit(req.Context(), AuditEvent{
+		Type:     AuditEventTokenRevoked,
+		ClientID: sess.ClientID,
+		Subject:  subject,
+		Scopes:   sess.Authorization.Scopes,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
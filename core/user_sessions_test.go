@@ -0,0 +1,257 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/oauth2"
+)
+
+func TestUserSessions(t *testing.T) {
+	const (
+		clientID      = "client-id"
+		otherClientID = "other-client"
+		clientSecret  = "client-secret"
+		redirectURI   = "https://redirect"
+		subject       = "user-1"
+	)
+	ctx := context.Background()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	o, err := New(&Config{
+		OfflineAccessWithoutConsent: true,
+		Now:                         func() time.Time { return now },
+	}, newStubSMGR(), &stubCS{
+		validClients: map[string]csClient{
+			clientID:      csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			otherClientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+		},
+	}, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenHandler := func(tr *TokenRequest) (*TokenResponse, error) {
+		return &TokenResponse{
+			AccessTokenValidUntil:  now.Add(1 * time.Minute),
+			RefreshTokenValidUntil: now.Add(10 * time.Minute),
+			IssueRefreshToken:      true,
+			IDToken:                tr.PrefillIDToken("https://issuer", subject, now.Add(1*time.Minute)),
+		}, nil
+	}
+
+	// issue runs the code flow for the subject, returning the refresh token.
+	issue := func(t *testing.T, clientID, subject, scope string) string {
+		t.Helper()
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"scope":         {scope},
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: areq.Scopes, Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         loc.Query().Get("code"),
+			RedirectURI:  redirectURI,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}, tokenHandler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tresp.RefreshToken
+	}
+
+	list := func(t *testing.T, subject string) []UserSession {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := o.UserSessions(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil), subject); err != nil {
+			t.Fatal(err)
+		}
+		var sessions []UserSession
+		if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+			t.Fatal(err)
+		}
+		return sessions
+	}
+
+	issue(t, clientID, subject, "openid offline_access")
+	now = now.Add(1 * time.Minute)
+	refreshTok := issue(t, otherClientID, subject, "openid profile offline_access")
+	issue(t, clientID, "user-2", "openid")
+
+	// a session that hasn't issued tokens yet isn't signed in.
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid"},
+	}
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.FinishAuthorization(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: areq.Scopes, Subject: subject}); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := list(t, subject)
+	if len(sessions) != 2 {
+		t.Fatalf("want 2 sessions for the subject, got: %v", sessions)
+	}
+	// most recently used first
+	if sessions[0].ClientID != otherClientID || sessions[1].ClientID != clientID {
+		t.Errorf("want sessions for %s then %s, got: %v", otherClientID, clientID, sessions)
+	}
+	if want := []string{"openid", "profile", "offline_access"}; !strsEqualSet(sessions[0].Scopes, want) {
+		t.Errorf("want scopes %v, got: %v", want, sessions[0].Scopes)
+	}
+	if !sessions[0].CreatedAt.Equal(now) || !sessions[0].LastUsedAt.Equal(now) {
+		t.Errorf("want created and last used at %s, got: %v", now, sessions[0])
+	}
+
+	// refreshing updates the last use.
+	now = now.Add(1 * time.Minute)
+	refreshTok = func() string {
+		tresp, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeRefreshToken,
+			RefreshToken: refreshTok,
+			ClientID:     otherClientID,
+			ClientSecret: clientSecret,
+		}, tokenHandler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tresp.RefreshToken
+	}()
+	sessions = list(t, subject)
+	if !sessions[0].LastUsedAt.Equal(now) || sessions[0].CreatedAt.Equal(now) {
+		t.Errorf("want only last used updated to %s, got: %v", now, sessions[0])
+	}
+
+	del := func(t *testing.T, subject, sessionID string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		_ = o.RevokeUserSession(rec, httptest.NewRequest(http.MethodDelete, "/sessions/"+sessionID, nil), subject, sessionID)
+		return rec.Code
+	}
+
+	if code := del(t, "user-2", sessions[0].ID); code != http.StatusNotFound {
+		t.Errorf("want 404 revoking another user's session, got: %d", code)
+	}
+	if code := del(t, subject, sessions[0].ID); code != http.StatusNoContent {
+		t.Errorf("want 204 revoking session, got: %d", code)
+	}
+
+	_, err = o.token(ctx, &tokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		RefreshToken: refreshTok,
+		ClientID:     otherClientID,
+		ClientSecret: clientSecret,
+	}, tokenHandler)
+	var terr *oauth2.TokenError
+	if !errors.As(err, &terr) || terr.ErrorCode != oauth2.TokenErrorCodeInvalidGrant {
+		t.Errorf("want revoked session's refresh token rejected with invalid_grant, got: %v", err)
+	}
+
+	if sessions := list(t, subject); len(sessions) != 1 || sessions[0].ClientID != clientID {
+		t.Errorf("want only the %s session left, got: %v", clientID, sessions)
+	}
+}
+
+func TestUserSessionsDeletedClient(t *testing.T) {
+	const (
+		clientID        = "client-id"
+		deletedClientID = "deleted-client"
+		clientSecret    = "client-secret"
+		redirectURI     = "https://redirect"
+		subject         = "user-1"
+	)
+	ctx := context.Background()
+
+	cs := &stubMutableCS{
+		stubCS: stubCS{
+			validClients: map[string]csClient{
+				clientID:        csClient{Secret: clientSecret, RedirectURI: redirectURI},
+				deletedClientID: csClient{Secret: clientSecret, RedirectURI: redirectURI},
+			},
+		},
+		registered: map[string]*Client{
+			clientID:        {ID: clientID, Metadata: ClientMetadata{ClientName: "Client"}},
+			deletedClientID: {ID: deletedClientID, Metadata: ClientMetadata{ClientName: "Deleted"}},
+		},
+	}
+	o, err := New(&Config{}, newStubSMGR(), cs, testSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cid := range []string{clientID, deletedClientID} {
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {cid},
+			"redirect_uri":  {redirectURI},
+			"scope":         {"openid"},
+		}
+		areq, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+q.Encode(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		if err := o.FinishAuthorization(rec, httptest.NewRequest("POST", "/", nil), areq.SessionID, &Authorization{Scopes: areq.Scopes, Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+		loc, err := url.Parse(rec.Header().Get("location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.token(ctx, &tokenRequest{
+			GrantType:    GrantTypeAuthorizationCode,
+			Code:         loc.Query().Get("code"),
+			RedirectURI:  redirectURI,
+			ClientID:     cid,
+			ClientSecret: clientSecret,
+		}, func(tr *TokenRequest) (*TokenResponse, error) {
+			return &TokenResponse{
+				AccessTokenValidUntil: time.Now().Add(1 * time.Minute),
+				IDToken:               tr.PrefillIDToken("https://issuer", subject, time.Now().Add(1*time.Minute)),
+			}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cs.DeleteClient(ctx, deletedClientID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := o.UserSessions(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil), subject); err != nil {
+		t.Fatalf("want sessions listed with a client deleted, got: %v", err)
+	}
+	var sessions []UserSession
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ClientID != clientID || sessions[0].ClientName != "Client" {
+		t.Errorf("want only the %s session, got: %v", clientID, sessions)
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// UserinfoSigningClientSource can be implemented by a ClientSource to have
+// UserInfo responses for some clients returned as a signed JWT.
+//
+// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+type UserinfoSigningClientSource interface {
+	// ClientUserinfoSignedResponseAlg should return the algorithm the
+	// client's UserInfo responses should be signed with. If empty, responses
+	// are only signed if the client asks for them via the Accept header. As
+	// responses are signed with the Signer, this must match its algorithm.
+	ClientUserinfoSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error)
+}
+
+// userinfoWantsJWT returns true if the response to the UserInfo request should
+// be signed, either because the client is registered for it, or asked for it.
+func (o *OIDC) userinfoWantsJWT(ctx context.Context, req *http.Request, clientID string) (bool, error) {
+	if ucs, ok := o.clients.(UserinfoSigningClientSource); ok && clientID != "" {
+		alg, err := ucs.ClientUserinfoSignedResponseAlg(clientID)
+		if err != nil {
+			return false, fmt.Errorf("getting client userinfo signing alg: %w", err)
+		}
+		if alg != "" {
+			salg, err := o.signer.SignerAlg(ctx)
+			if err != nil {
+				return false, fmt.Errorf("getting signer alg: %w", err)
+			}
+			if salg != alg {
+				return false, fmt.Errorf("client wants userinfo signed with %s, signer uses %s", alg, salg)
+			}
+			return true, nil
+		}
+	}
+
+	for _, a := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err == nil && mt == "application/jwt" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// signUserinfo returns the JSON encoded UserInfo claims as a JWT signed by us,
+// with the iss and aud claims set.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+func (o *OIDC) signUserinfo(ctx context.Context, clientID string, claims []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(claims))
+	dec.UseNumber()
+	cm := map[string]interface{}{}
+	if err := dec.Decode(&cm); err != nil {
+		return "", fmt.Errorf("decoding userinfo claims: %w", err)
+	}
+	if _, ok := cm["sub"]; !ok {
+		return "", fmt.Errorf("userinfo response has no sub claim")
+	}
+
+	cl := oidc.Claims{
+		Issuer:   o.issuerFrom(ctx),
+		Audience: oidc.Audience{clientID},
+		Extra:    cm,
+	}
+	clb, err := json.Marshal(cl)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal userinfo response: %w", err)
+	}
+	signed, err := o.signer.Sign(ctx, clb)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign userinfo response: %w", err)
+	}
+	return string(signed), nil
+}
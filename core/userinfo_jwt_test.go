@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestUserinfoJWT(t *testing.T) {
+	const (
+		clientID = "client-id"
+		issuer   = "https://issuer"
+	)
+
+	for _, tc := range []struct {
+		Name       string
+		Accept     string
+		ClientAlg  jose.SignatureAlgorithm
+		WantErr    bool
+		WantSigned bool
+	}{
+		{
+			Name: "Plain JSON by default",
+		},
+		{
+			Name:       "Requested via Accept header",
+			Accept:     "application/jwt",
+			WantSigned: true,
+		},
+		{
+			Name:       "Requested alongside other types",
+			Accept:     "application/json;q=0.5, application/jwt",
+			WantSigned: true,
+		},
+		{
+			Name:       "Client registered for signed responses",
+			ClientAlg:  jose.RS256,
+			WantSigned: true,
+		},
+		{
+			Name:      "Client registered for an alg we don't sign with",
+			ClientAlg: jose.ES256,
+			WantErr:   true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			smgr := newStubSMGR()
+
+			oidc, err := New(&Config{Issuer: issuer}, smgr, &stubCS{
+				validClients: map[string]csClient{
+					clientID: csClient{UserinfoSignedResponseAlg: tc.ClientAlg},
+				},
+			}, testSigner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, s, err := newToken("session-id", time.Now().Add(1*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := putSession(context.Background(), smgr, &sessionV2{
+				ID:            "session-id",
+				ClientID:      clientID,
+				AccessToken:   s,
+				Authorization: &sessAuthorization{Scopes: []string{"openid", "email"}},
+				Expiry:        time.Now().Add(1 * time.Minute),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/userinfo", nil)
+			req.Header.Set("authorization", "Bearer "+mustMarshal(u))
+			if tc.Accept != "" {
+				req.Header.Set("accept", tc.Accept)
+			}
+
+			err = oidc.Userinfo(rec, req, func(w io.Writer, uireq *UserinfoRequest) error {
+				return json.NewEncoder(w).Encode(map[string]interface{}{"sub": "subject", "email": "user@example.com"})
+			})
+			if tc.WantErr {
+				if err == nil {
+					t.Fatal("want error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]interface{}{}
+			want := map[string]interface{}{
+				"sub":   "subject",
+				"email": "user@example.com",
+			}
+
+			if tc.WantSigned {
+				if ct := rec.Header().Get("content-type"); ct != "application/jwt" {
+					t.Errorf("want application/jwt content type, got: %s", ct)
+				}
+				payload, err := testSigner.VerifySignature(context.Background(), rec.Body.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(payload, &got); err != nil {
+					t.Fatal(err)
+				}
+				want["iss"] = issuer
+				want["aud"] = clientID
+			} else {
+				if ct := rec.Header().Get("content-type"); ct != "application/json" {
+					t.Errorf("want application/json content type, got: %s", ct)
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
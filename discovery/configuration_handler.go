@@ -1,7 +1,9 @@
 package discovery
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 
 	"gopkg.in/square/go-jose.v2/json"
 )
@@ -15,7 +17,16 @@ var _ http.Handler = (*ConfigurationHandler)(nil)
 // subpaths. This can be achieved with the stdlib mux by using a trailing slash.
 // Any prefix should be stripped before calling this ConfigurationHandler
 type ConfigurationHandler struct {
-	md *ProviderMetadata
+	md       *ProviderMetadata
+	modifier func(doc map[string]interface{}) error
+
+	issuerResolver func(req *http.Request) (string, error)
+	allowedIssuers []string
+
+	doc []byte
+	// issuerDocs are the documents for each allowed issuer, if an issuer
+	// resolver is configured.
+	issuerDocs map[string][]byte
 }
 
 // ConfigurationHandlerOpt is an option that can configure
@@ -28,11 +39,32 @@ func WithCoreDefaults() func(h *ConfigurationHandler) {
 		if len(h.md.ResponseTypesSupported) == 0 {
 			h.md.ResponseTypesSupported = []string{
 				"code",
-				"id_token",
-				"id_token token",
+				"code id_token",
+				"code token",
+				"code id_token token",
+				"none",
 			}
 		}
 
+		if len(h.md.ScopesSupported) == 0 {
+			h.md.ScopesSupported = []string{"openid", "profile", "email", "address", "phone", "offline_access"}
+		}
+
+		if len(h.md.ClaimsSupported) == 0 {
+			h.md.ClaimsSupported = []string{
+				"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "azp", "at_hash", "c_hash",
+				// granted by the profile scope
+				"name", "family_name", "given_name", "middle_name", "nickname", "preferred_username",
+				"profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale", "updated_at",
+				// granted by the email, address and phone scopes
+				"email", "email_verified", "address", "phone_number", "phone_number_verified",
+			}
+		}
+
+		// individually requested claims are passed to the handlers, and not
+		// filtered out.
+		h.md.ClaimsParameterSupported = true
+
 		if len(h.md.SubjectTypesSupported) == 0 {
 			h.md.SubjectTypesSupported = []string{"public"}
 		}
@@ -43,7 +75,84 @@ func WithCoreDefaults() func(h *ConfigurationHandler) {
 
 		if len(h.md.GrantTypesSupported) == 0 {
 			h.md.GrantTypesSupported = []string{"authorization_code"}
+			if h.md.DeviceAuthorizationEndpoint != "" {
+				h.md.GrantTypesSupported = append(h.md.GrantTypesSupported, "urn:ietf:params:oauth:grant-type:device_code")
+			}
+		}
+
+		if len(h.md.TokenEndpointAuthMethodsSupported) == 0 {
+			h.md.TokenEndpointAuthMethodsSupported = []string{
+				"client_secret_basic",
+				"client_secret_post",
+				"client_secret_jwt",
+				"private_key_jwt",
+			}
+		}
+
+		if len(h.md.CodeChallengeMethodsSupported) == 0 {
+			h.md.CodeChallengeMethodsSupported = []string{"S256", "plain"}
+		}
+
+		if len(h.md.AuthorizationSigningAlgValuesSupported) == 0 {
+			for _, rm := range h.md.ResponseModesSupported {
+				if strings.HasSuffix(rm, "jwt") {
+					// responses are signed with the signer's default key,
+					// the first ID token alg. Only ID tokens can be signed
+					// with the others.
+					h.md.AuthorizationSigningAlgValuesSupported = h.md.IDTokenSigningAlgValuesSupported[:1]
+					break
+				}
+			}
+		}
+
+		if h.md.UserinfoEndpoint != "" && len(h.md.UserinfoSigningAlgValuesSupported) == 0 {
+			// userinfo is signed with the signer's default key
+			h.md.UserinfoSigningAlgValuesSupported = h.md.IDTokenSigningAlgValuesSupported[:1]
+		}
+
+		if (h.md.RequestParameterSupported || h.md.RequestURIParameterSupported) && len(h.md.RequestObjectSigningAlgValuesSupported) == 0 {
+			h.md.RequestObjectSigningAlgValuesSupported = []string{"RS256"}
 		}
+
+		if len(h.md.DPoPSigningAlgValuesSupported) == 0 {
+			// matches core.DPoPSigningAlgsSupported
+			h.md.DPoPSigningAlgValuesSupported = []string{
+				"RS256", "RS384", "RS512",
+				"PS256", "PS384", "PS512",
+				"ES256", "ES384", "ES512",
+				"EdDSA",
+			}
+		}
+	}
+}
+
+// WithDiscoveryModifier is an option that lets the served document be
+// customized, e.g to advertise externally visible endpoints, or add fields
+// that ProviderMetadata does not have. The modifier is called once, when the
+// handler is created, with the document built from the metadata.
+//
+// The modifier can change any field, but the issuer must not be changed, and
+// the fields required by the spec (issuer, authorization_endpoint, jwks_uri,
+// response_types_supported, subject_types_supported and
+// id_token_signing_alg_values_supported) must not be removed or emptied, as
+// clients depend on them. NewConfigurationHandler returns an error if they
+// are.
+func WithDiscoveryModifier(modifier func(doc map[string]interface{}) error) func(h *ConfigurationHandler) {
+	return func(h *ConfigurationHandler) {
+		h.modifier = modifier
+	}
+}
+
+// WithIssuerResolver is an option for providers serving more than one issuer,
+// e.g one per tenant hostname. The resolver returns the issuer for each
+// request, and the document is served with the issuer, and every URL under it,
+// rewritten to that issuer. The metadata's issuer is used as the template, so
+// its endpoints should be under it. Requests for issuers not in allowed are
+// answered with Not Found.
+func WithIssuerResolver(resolver func(req *http.Request) (string, error), allowed []string) func(h *ConfigurationHandler) {
+	return func(h *ConfigurationHandler) {
+		h.issuerResolver = resolver
+		h.allowedIssuers = allowed
 	}
 }
 
@@ -61,12 +170,125 @@ func NewConfigurationHandler(metadata *ProviderMetadata, opts ...ConfigurationHa
 		return nil, err
 	}
 
+	doc, err := json.Marshal(h.md)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling provider metadata: %w", err)
+	}
+	if h.modifier != nil {
+		if doc, err = modifyDocument(doc, h.md.Issuer, h.modifier); err != nil {
+			return nil, err
+		}
+	}
+	h.doc = doc
+
+	if h.issuerResolver != nil {
+		h.issuerDocs = map[string][]byte{}
+		for _, iss := range h.allowedIssuers {
+			idoc, err := rewriteIssuer(doc, h.md.Issuer, iss)
+			if err != nil {
+				return nil, err
+			}
+			h.issuerDocs[iss] = idoc
+		}
+	}
+
 	return h, nil
 }
 
 func (h *ConfigurationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if err := json.NewEncoder(w).Encode(h.md); err != nil {
+	doc := h.doc
+	if h.issuerResolver != nil {
+		iss, err := h.issuerResolver(req)
+		if err != nil {
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		var ok bool
+		if doc, ok = h.issuerDocs[iss]; !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(doc); err != nil {
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// modifyDocument runs the modifier over the marshaled document, checking it
+// kept to its contract.
+func modifyDocument(doc []byte, issuer string, modifier func(doc map[string]interface{}) error) ([]byte, error) {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, fmt.Errorf("unmarshaling provider metadata: %w", err)
+	}
+
+	if err := modifier(m); err != nil {
+		return nil, fmt.Errorf("modifying provider metadata: %w", err)
+	}
+
+	var errs []string
+	if iss, _ := m["issuer"].(string); iss != issuer {
+		errs = append(errs, "issuer must not be changed")
+	}
+	for _, f := range []string{"authorization_endpoint", "jwks_uri"} {
+		if v, _ := m[f].(string); v == "" {
+			errs = append(errs, fmt.Sprintf("%s is required", f))
+		}
+	}
+	for _, f := range []string{"response_types_supported", "subject_types_supported", "id_token_signing_alg_values_supported"} {
+		if !nonEmptyList(m[f]) {
+			errs = append(errs, fmt.Sprintf("%s is required", f))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid modified provider metadata: %s", strings.Join(errs, ", "))
+	}
+
+	return json.Marshal(m)
+}
+
+// rewriteIssuer returns the document for another issuer, replacing the issuer
+// and the issuer prefix of all URLs under it.
+func rewriteIssuer(doc []byte, from, to string) ([]byte, error) {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, fmt.Errorf("unmarshaling provider metadata: %w", err)
+	}
+
+	rewrite := func(s string) string {
+		if s == from || strings.HasPrefix(s, strings.TrimSuffix(from, "/")+"/") {
+			return to + strings.TrimPrefix(s, from)
+		}
+		return s
+	}
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			m[k] = rewrite(v)
+		case []interface{}:
+			for i, lv := range v {
+				if s, ok := lv.(string); ok {
+					v[i] = rewrite(s)
+				}
+			}
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+// nonEmptyList returns true if v is a list with items in it, either as
+// unmarshaled or as set by a modifier.
+func nonEmptyList(v interface{}) bool {
+	switch l := v.(type) {
+	case []interface{}:
+		return len(l) > 0
+	case []string:
+		return len(l) > 0
+	default:
+		return false
+	}
+}
@@ -2,10 +2,16 @@ package discovery
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
@@ -74,3 +80,376 @@ func TestDiscovery(t *testing.T) {
 		t.Errorf("wanted error getting non-existent key, but got none")
 	}
 }
+
+type mockRotatingKeysource struct {
+	mockKeysource
+	nextRotation time.Time
+}
+
+func (m *mockRotatingKeysource) NextRotation(ctx context.Context) (time.Time, error) {
+	return m.nextRotation, nil
+}
+
+func TestKeysHandlerRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	// during the overlap window, the new key is signing but the old is still
+	// published.
+	ks := &mockRotatingKeysource{
+		mockKeysource: mockKeysource{
+			keys: []jose.JSONWebKey{
+				{Key: newKey.Public(), KeyID: "new", Algorithm: "RS256", Use: "sig"},
+				{Key: oldKey.Public(), KeyID: "old", Algorithm: "RS256", Use: "sig"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		opts         []KeysHandlerOpt
+		wantMaxAge   string
+		nextRotation time.Time
+	}{
+		{
+			name:         "capped to next rotation",
+			opts:         []KeysHandlerOpt{WithKeysCacheTTL(1 * time.Hour)},
+			nextRotation: now.Add(10 * time.Minute),
+			wantMaxAge:   "public, max-age=600",
+		},
+		{
+			name:         "ttl before next rotation",
+			opts:         []KeysHandlerOpt{WithKeysCacheTTL(5 * time.Minute)},
+			nextRotation: now.Add(10 * time.Minute),
+			wantMaxAge:   "public, max-age=300",
+		},
+		{
+			name:       "defaults to cacheFor",
+			wantMaxAge: "public, max-age=60",
+		},
+		{
+			name:         "rotation overdue",
+			opts:         []KeysHandlerOpt{WithKeysCacheTTL(1 * time.Hour)},
+			nextRotation: now.Add(-1 * time.Minute),
+			wantMaxAge:   "public, max-age=0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ks.nextRotation = tc.nextRotation
+
+			kh := NewKeysHandler(ks, 1*time.Minute, append(tc.opts, WithKeysNow(func() time.Time { return now }))...)
+
+			rec := httptest.NewRecorder()
+			kh.ServeHTTP(rec, httptest.NewRequest("GET", "/jwks.json", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want status 200, got %d", rec.Code)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tc.wantMaxAge {
+				t.Errorf("want Cache-Control %q, got %q", tc.wantMaxAge, got)
+			}
+
+			var jwks jose.JSONWebKeySet
+			if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil {
+				t.Fatal(err)
+			}
+			for _, kid := range []string{"new", "old"} {
+				if len(jwks.Key(kid)) != 1 {
+					t.Errorf("want key %s published", kid)
+				}
+			}
+		})
+	}
+}
+
+func TestKeysHandlerKeyTypes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the EC key is passed in its private form, which must not be published.
+	ks := &mockKeysource{
+		keys: []jose.JSONWebKey{
+			{Key: rsaKey.Public(), KeyID: "rsa", Algorithm: "RS256", Use: "sig"},
+			{Key: ecKey, KeyID: "ec", Algorithm: "ES256", Use: "sig"},
+			{Key: []byte("symmetric"), KeyID: "hmac", Algorithm: "HS256", Use: "sig"},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	NewKeysHandler(ks, 1*time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d", rec.Code)
+	}
+
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]interface{}{
+		"rsa": {"kty": "RSA", "alg": "RS256", "use": "sig"},
+		"ec":  {"kty": "EC", "alg": "ES256", "use": "sig", "crv": "P-256"},
+	}
+	if len(jwks.Keys) != len(want) {
+		t.Errorf("want %d keys, got: %v", len(want), jwks.Keys)
+	}
+	for _, k := range jwks.Keys {
+		kid, _ := k["kid"].(string)
+		wk, ok := want[kid]
+		if !ok {
+			t.Errorf("unexpected key published: %v", k)
+			continue
+		}
+		for f, v := range wk {
+			if k[f] != v {
+				t.Errorf("key %s: want %s %v, got: %v", kid, f, v, k[f])
+			}
+		}
+		if _, ok := k["d"]; ok {
+			t.Errorf("key %s: private part published", kid)
+		}
+	}
+}
+
+func TestDiscoveryModifier(t *testing.T) {
+	newMetadata := func() *ProviderMetadata {
+		return &ProviderMetadata{
+			Issuer:                "https://issuer",
+			JWKSURI:               "https://issuer/jwks.json",
+			AuthorizationEndpoint: "https://issuer/auth",
+			TokenEndpoint:         "https://issuer/token",
+		}
+	}
+
+	t.Run("Fields added and overridden", func(t *testing.T) {
+		ch, err := NewConfigurationHandler(newMetadata(), WithCoreDefaults(), WithDiscoveryModifier(func(doc map[string]interface{}) error {
+			doc["service_documentation"] = "https://docs.example.com"
+			doc["token_endpoint"] = "https://gateway.example.com/token"
+			doc["claims_supported"] = []string{"sub", "custom"}
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := httptest.NewServer(ch)
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + oidcwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var doc struct {
+			Issuer               string   `json:"issuer"`
+			ServiceDocumentation string   `json:"service_documentation"`
+			TokenEndpoint        string   `json:"token_endpoint"`
+			ClaimsSupported      []string `json:"claims_supported"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+
+		if doc.Issuer != "https://issuer" {
+			t.Errorf("want issuer retained, got %s", doc.Issuer)
+		}
+		if doc.ServiceDocumentation != "https://docs.example.com" {
+			t.Errorf("want service_documentation added, got %s", doc.ServiceDocumentation)
+		}
+		if doc.TokenEndpoint != "https://gateway.example.com/token" {
+			t.Errorf("want token_endpoint overridden, got %s", doc.TokenEndpoint)
+		}
+		if len(doc.ClaimsSupported) != 2 || doc.ClaimsSupported[1] != "custom" {
+			t.Errorf("want claims_supported overridden, got %v", doc.ClaimsSupported)
+		}
+	})
+
+	for _, tc := range []struct {
+		name     string
+		modifier func(doc map[string]interface{}) error
+	}{
+		{
+			name: "Issuer changed",
+			modifier: func(doc map[string]interface{}) error {
+				doc["issuer"] = "https://other"
+				return nil
+			},
+		},
+		{
+			name: "Required field removed",
+			modifier: func(doc map[string]interface{}) error {
+				delete(doc, "jwks_uri")
+				return nil
+			},
+		},
+		{
+			name: "Required list emptied",
+			modifier: func(doc map[string]interface{}) error {
+				doc["response_types_supported"] = []string{}
+				return nil
+			},
+		},
+		{
+			name: "Modifier error",
+			modifier: func(doc map[string]interface{}) error {
+				return errors.New("failed")
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfigurationHandler(newMetadata(), WithCoreDefaults(), WithDiscoveryModifier(tc.modifier)); err == nil {
+				t.Error("want error creating handler")
+			}
+		})
+	}
+}
+
+func TestWebFinger(t *testing.T) {
+	ts := httptest.NewServer(NewWebFingerHandler("https://issuer"))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name       string
+		query      url.Values
+		wantStatus int
+		wantLinks  []jrdLink
+	}{
+		{
+			name:       "Issuer requested for account",
+			query:      url.Values{"resource": {"acct:user@example.com"}, "rel": {IssuerRel}},
+			wantStatus: http.StatusOK,
+			wantLinks:  []jrdLink{{Rel: IssuerRel, Href: "https://issuer"}},
+		},
+		{
+			name:       "Issuer requested for URL",
+			query:      url.Values{"resource": {"https://example.com/user"}, "rel": {IssuerRel}},
+			wantStatus: http.StatusOK,
+			wantLinks:  []jrdLink{{Rel: IssuerRel, Href: "https://issuer"}},
+		},
+		{
+			name:       "No rel returns all links",
+			query:      url.Values{"resource": {"acct:user@example.com"}},
+			wantStatus: http.StatusOK,
+			wantLinks:  []jrdLink{{Rel: IssuerRel, Href: "https://issuer"}},
+		},
+		{
+			name:       "Other rel",
+			query:      url.Values{"resource": {"acct:user@example.com"}, "rel": {"http://webfinger.net/rel/avatar"}},
+			wantStatus: http.StatusOK,
+			wantLinks:  []jrdLink{},
+		},
+		{
+			name:       "Missing resource",
+			query:      url.Values{"rel": {IssuerRel}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Unsupported resource scheme",
+			query:      url.Values{"resource": {"mailto:user@example.com"}, "rel": {IssuerRel}},
+			wantStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + "/.well-known/webfinger?" + tc.query.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("want status %d, got %d", tc.wantStatus, resp.StatusCode)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			if ct := resp.Header.Get("Content-Type"); ct != "application/jrd+json" {
+				t.Errorf("want jrd content type, got %s", ct)
+			}
+			var doc jrd
+			if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Subject != tc.query.Get("resource") {
+				t.Errorf("want subject %s, got %s", tc.query.Get("resource"), doc.Subject)
+			}
+			if !reflect.DeepEqual(doc.Links, tc.wantLinks) {
+				t.Errorf("want links %v, got %v", tc.wantLinks, doc.Links)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerResolver(t *testing.T) {
+	md := &ProviderMetadata{
+		Issuer:                "https://tenant-a.example.com",
+		JWKSURI:               "https://tenant-a.example.com/jwks.json",
+		AuthorizationEndpoint: "https://tenant-a.example.com/auth",
+		TokenEndpoint:         "https://tenant-a.example.com/token",
+		ServiceDocumentation:  "https://docs.example.com",
+	}
+	resolver := func(req *http.Request) (string, error) {
+		return "https://" + req.Host, nil
+	}
+	ch, err := NewConfigurationHandler(md, WithCoreDefaults(), WithIssuerResolver(resolver, []string{
+		"https://tenant-a.example.com",
+		"https://tenant-b.example.com",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"tenant-a.example.com", "tenant-b.example.com"} {
+		t.Run(host, func(t *testing.T) {
+			req := httptest.NewRequest("GET", oidcwk, nil)
+			req.Host = host
+			rec := httptest.NewRecorder()
+			ch.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want 200, got %d", rec.Code)
+			}
+
+			var got ProviderMetadata
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			iss := "https://" + host
+			if got.Issuer != iss {
+				t.Errorf("want issuer %s, got %s", iss, got.Issuer)
+			}
+			if got.TokenEndpoint != iss+"/token" || got.JWKSURI != iss+"/jwks.json" {
+				t.Errorf("want endpoints under %s, got %s and %s", iss, got.TokenEndpoint, got.JWKSURI)
+			}
+			if got.ServiceDocumentation != "https://docs.example.com" {
+				t.Errorf("want URLs outside the issuer unchanged, got %s", got.ServiceDocumentation)
+			}
+		})
+	}
+
+	t.Run("Unknown issuer", func(t *testing.T) {
+		req := httptest.NewRequest("GET", oidcwk, nil)
+		req.Host = "other.example.com"
+		rec := httptest.NewRecorder()
+		ch.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("want 404, got %d", rec.Code)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package discovery
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -16,43 +17,128 @@ type KeySource interface {
 	PublicKeys(ctx context.Context) (*jose.JSONWebKeySet, error)
 }
 
+// RotatingKeySource can optionally be implemented by a KeySource that rotates
+// its keys. The handler will not cache the keys, or let clients cache them,
+// past the next rotation.
+type RotatingKeySource interface {
+	// NextRotation returns when the key set is next expected to change. A
+	// zero time means no rotation is scheduled.
+	NextRotation(ctx context.Context) (time.Time, error)
+}
+
 // KeysHandler is a http.Handler that correctly serves the "keys" endpoint from a keysource
 type KeysHandler struct {
 	ks       KeySource
 	cacheFor time.Duration
+	cacheTTL time.Duration
 
 	currKeys   *jose.JSONWebKeySet
 	currKeysMu sync.Mutex
 
-	lastKeysUpdate time.Time
+	keysValidUntil time.Time
+
+	now func() time.Time
+}
+
+// KeysHandlerOpt is an option that can configure a KeysHandler
+type KeysHandlerOpt func(h *KeysHandler)
+
+// WithKeysCacheTTL sets the maximum time clients are told they can cache the
+// keys for, via the Cache-Control header. It is capped to the next rotation if
+// the KeySource is a RotatingKeySource. Defaults to the cacheFor duration.
+func WithKeysCacheTTL(ttl time.Duration) func(h *KeysHandler) {
+	return func(h *KeysHandler) {
+		h.cacheTTL = ttl
+	}
+}
+
+// WithKeysNow sets the clock used to expire the cached keys. It should be the
+// same as any set in core.Config.Now, so the keys published match those the
+// signer considers current.
+func WithKeysNow(now func() time.Time) func(h *KeysHandler) {
+	return func(h *KeysHandler) {
+		h.now = now
+	}
 }
 
 // NewKeysHandler returns a KeysHandler configured to serve the keys froom
 // KeySource. It will cache key lookups for the cacheFor duration
-func NewKeysHandler(s KeySource, cacheFor time.Duration) *KeysHandler {
-	return &KeysHandler{
+func NewKeysHandler(s KeySource, cacheFor time.Duration, opts ...KeysHandlerOpt) *KeysHandler {
+	h := &KeysHandler{
 		ks:       s,
 		cacheFor: cacheFor,
+		cacheTTL: cacheFor,
+		now:      time.Now,
+	}
+
+	for _, o := range opts {
+		o(h)
 	}
+
+	return h
 }
 
 func (h *KeysHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.currKeysMu.Lock()
 	defer h.currKeysMu.Unlock()
 
-	if h.currKeys == nil || time.Now().After(h.lastKeysUpdate) {
+	now := h.now()
+
+	var nextRotation time.Time
+	if rks, ok := h.ks.(RotatingKeySource); ok {
+		nr, err := rks.NextRotation(req.Context())
+		if err != nil {
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		nextRotation = nr
+	}
+
+	if h.currKeys == nil || !now.Before(h.keysValidUntil) {
 		ks, err := h.ks.PublicKeys(req.Context())
 		if err != nil {
 			http.Error(w, "Internal Error", http.StatusInternalServerError)
 			return
 		}
 
-		h.currKeys = ks
-		h.lastKeysUpdate = time.Now()
+		h.currKeys = publicKeys(ks)
+		h.keysValidUntil = capTo(now.Add(h.cacheFor), nextRotation)
+	}
+
+	maxAge := capTo(now.Add(h.cacheTTL), nextRotation).Sub(now)
+	if maxAge < 0 {
+		maxAge = 0
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second)))
+
 	if err := json.NewEncoder(w).Encode(h.currKeys); err != nil {
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// publicKeys returns the public part of every key in the set, so private keys
+// can never be published. Each key keeps its kid, alg and use, so keys of
+// different types can be told apart during a rotation between algorithms.
+// Keys with no public part, i.e symmetric keys, are dropped.
+func publicKeys(ks *jose.JSONWebKeySet) *jose.JSONWebKeySet {
+	pub := &jose.JSONWebKeySet{}
+	for _, k := range ks.Keys {
+		pk := k.Public()
+		if !pk.Valid() {
+			continue
+		}
+		pub.Keys = append(pub.Keys, pk)
+	}
+	return pub
+}
+
+// capTo returns t, or limit if that is set and earlier.
+func capTo(t, limit time.Time) time.Time {
+	if !limit.IsZero() && limit.Before(t) {
+		return limit
+	}
+	return t
+}
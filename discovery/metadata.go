@@ -180,6 +180,90 @@ type ProviderMetadata struct {
 	// registration process SHOULD display this URL to the person registering
 	// the Client if it is given.
 	OPTOSURI string `json:"op_tos_uri,omitempty"`
+	// OPTIONAL. URL of the authorization server's OAuth 2.0 revocation
+	// endpoint [RFC7009].
+	//
+	// https://tools.ietf.org/html/rfc8414#section-2
+	RevocationEndpoint string `json:"revocation_endpoint,omitempty"`
+	// OPTIONAL. URL of the authorization server's OAuth 2.0 introspection
+	// endpoint [RFC7662].
+	//
+	// https://tools.ietf.org/html/rfc8414#section-2
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+	// OPTIONAL. JSON array containing a list of Proof Key for Code Exchange
+	// (PKCE) [RFC7636] code challenge methods supported by this authorization
+	// server.
+	//
+	// https://tools.ietf.org/html/rfc8414#section-2
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+	// URL at the OP to which an RP can perform a redirect to request that the
+	// End-User be logged out at the OP.
+	//
+	// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#OPMetadata
+	EndSessionEndpoint string `json:"end_session_endpoint,omitempty"`
+	// URL of an OP iframe that supports cross-origin communications for
+	// session state information with the RP Client, using the HTML5
+	// postMessage API.
+	//
+	// https://openid.net/specs/openid-connect-session-1_0.html#OPMetadata
+	CheckSessionIframe string `json:"check_session_iframe,omitempty"`
+	// Boolean value specifying whether the OP supports back-channel logout,
+	// with true indicating support. If omitted, the default value is false.
+	//
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html#BCSupport
+	BackchannelLogoutSupported bool `json:"backchannel_logout_supported,omitempty"`
+	// Boolean value specifying whether the OP can pass a sid (session ID)
+	// Claim in the Logout Token to identify the RP session with the OP. If
+	// supported, the sid Claim is also included in ID Tokens issued by the OP.
+	// If omitted, the default value is false.
+	//
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html#BCSupport
+	BackchannelLogoutSessionSupported bool `json:"backchannel_logout_session_supported,omitempty"`
+	// Boolean value specifying whether the OP supports HTTP-based logout,
+	// with true indicating support. If omitted, the default value is false.
+	//
+	// https://openid.net/specs/openid-connect-frontchannel-1_0.html#OPLogout
+	FrontchannelLogoutSupported bool `json:"frontchannel_logout_supported,omitempty"`
+	// Boolean value specifying whether the OP can pass iss (issuer) and sid
+	// (session ID) query parameters to identify the RP session with the OP
+	// when the frontchannel_logout_uri is used. If supported, the sid Claim is
+	// also included in ID Tokens issued by the OP. If omitted, the default
+	// value is false.
+	//
+	// https://openid.net/specs/openid-connect-frontchannel-1_0.html#OPLogout
+	FrontchannelLogoutSessionSupported bool `json:"frontchannel_logout_session_supported,omitempty"`
+	// URL of the authorization server's device authorization endpoint.
+	//
+	// https://tools.ietf.org/html/rfc8628#section-4
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+	// Boolean value indicating server support for mutual-TLS client
+	// certificate-bound access tokens. If omitted, the default value is
+	// false.
+	//
+	// https://tools.ietf.org/html/rfc8705#section-3.3
+	TLSClientCertificateBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens,omitempty"`
+	// OPTIONAL. URL of the authorization server's pushed authorization request
+	// endpoint.
+	//
+	// https://tools.ietf.org/html/rfc9126#section-5
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint,omitempty"`
+	// OPTIONAL. Boolean parameter indicating whether the authorization server
+	// accepts authorization request data only via PAR. If omitted, the default
+	// value is false.
+	//
+	// https://tools.ietf.org/html/rfc9126#section-5
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
+	// OPTIONAL. JSON array containing a list of the JWS signing algorithms
+	// supported by the authorization server for signing authorization
+	// responses, when a JWT response mode is used.
+	//
+	// https://openid.net/specs/oauth-v2-jarm.html#section-4
+	AuthorizationSigningAlgValuesSupported []string `json:"authorization_signing_alg_values_supported,omitempty"`
+	// OPTIONAL. A JSON array containing a list of the JWS alg values
+	// supported by the authorization server for DPoP proof JWTs.
+	//
+	// https://www.rfc-editor.org/rfc/rfc9449#section-5.1
+	DPoPSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported,omitempty"`
 }
 
 func (p *ProviderMetadata) validate() error {
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// IssuerRel is the WebFinger link relation used to discover the issuer for a
+// user.
+//
+// https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery
+const IssuerRel = "http://openid.net/specs/connect/1.0/issuer"
+
+var _ http.Handler = (*WebFingerHandler)(nil)
+
+// WebFingerHandler is a http.Handler that serves WebFinger issuer discovery, so
+// a client can find the issuer from an identifier the user enters, like
+// user@example.com.
+//
+// It should be mounted at `/.well-known/webfinger` on the host of the
+// identifiers, which may differ from the issuer's. Every valid resource is
+// answered with the same issuer.
+//
+// https://tools.ietf.org/html/rfc7033
+type WebFingerHandler struct {
+	issuer string
+}
+
+// NewWebFingerHandler returns a WebFingerHandler that responds with the given
+// issuer.
+func NewWebFingerHandler(issuer string) *WebFingerHandler {
+	return &WebFingerHandler{issuer: issuer}
+}
+
+// jrd is a JSON Resource Descriptor, the WebFinger response document.
+//
+// https://tools.ietf.org/html/rfc7033#section-4.4
+type jrd struct {
+	Subject string    `json:"subject"`
+	Links   []jrdLink `json:"links"`
+}
+
+type jrdLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+func (h *WebFingerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+
+	resource := q.Get("resource")
+	if resource == "" {
+		http.Error(w, "resource is required", http.StatusBadRequest)
+		return
+	}
+	ru, err := url.Parse(resource)
+	if err != nil || (ru.Scheme != "acct" && ru.Scheme != "https") || (ru.Opaque == "" && ru.Host == "") {
+		http.Error(w, "resource must be an acct: or https: URI", http.StatusBadRequest)
+		return
+	}
+
+	resp := jrd{
+		Subject: resource,
+		Links:   []jrdLink{},
+	}
+	// with no rel all links are returned, otherwise only those requested.
+	//
+	// https://tools.ietf.org/html/rfc7033#section-4.3
+	rels, ok := q["rel"]
+	if !ok || strsContains(rels, IssuerRel) {
+		resp.Links = append(resp.Links, jrdLink{Rel: IssuerRel, Href: h.issuer})
+	}
+
+	// https://tools.ietf.org/html/rfc7033#section-5
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/jrd+json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func strsContains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
@@ -39,6 +39,59 @@ const (
 	TokenErrorCodeInvalidScope TokenErrorCode = "invalid_scope"
 )
 
+// https://tools.ietf.org/html/rfc8628#section-3.5
+// nolint:unused,varcheck,deadcode
+const (
+	// TokenErrorCodeAuthorizationPending: The authorization request is still
+	// pending as the end user hasn't yet completed the user-interaction steps.
+	TokenErrorCodeAuthorizationPending TokenErrorCode = "authorization_pending"
+	// TokenErrorCodeSlowDown: A variant of "authorization_pending", the
+	// authorization request is still pending and polling should continue, but
+	// the interval MUST be increased by 5 seconds for this and all subsequent
+	// requests.
+	TokenErrorCodeSlowDown TokenErrorCode = "slow_down"
+	// TokenErrorCodeAccessDenied: The authorization request was denied.
+	TokenErrorCodeAccessDenied TokenErrorCode = "access_denied"
+	// TokenErrorCodeExpiredToken: The "device_code" has expired, and the
+	// device authorization session has concluded.
+	TokenErrorCodeExpiredToken TokenErrorCode = "expired_token"
+)
+
+// https://tools.ietf.org/html/rfc9126#section-2.3
+// nolint:unused,varcheck,deadcode
+const (
+	// TokenErrorCodeInvalidRequestObject: The request object contained in a
+	// pushed authorization request is invalid.
+	TokenErrorCodeInvalidRequestObject TokenErrorCode = "invalid_request_object"
+)
+
+// https://tools.ietf.org/html/rfc7591#section-3.2.2
+// nolint:unused,varcheck,deadcode
+const (
+	// TokenErrorCodeInvalidRedirectURI: The value of one or more redirection
+	// URIs is invalid.
+	TokenErrorCodeInvalidRedirectURI TokenErrorCode = "invalid_redirect_uri"
+	// TokenErrorCodeInvalidClientMetadata: The value of one of the client
+	// metadata fields is invalid and the server has rejected this request.
+	TokenErrorCodeInvalidClientMetadata TokenErrorCode = "invalid_client_metadata"
+)
+
+// https://tools.ietf.org/html/rfc8707#section-2
+// nolint:unused,varcheck,deadcode
+const (
+	// TokenErrorCodeInvalidTarget: The requested resource is invalid,
+	// missing, unknown, or malformed.
+	TokenErrorCodeInvalidTarget TokenErrorCode = "invalid_target"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9449#section-12.2
+// nolint:unused,varcheck,deadcode
+const (
+	// TokenErrorCodeInvalidDPoPProof: The DPoP proof JWT is missing,
+	// malformed or invalid.
+	TokenErrorCodeInvalidDPoPProof TokenErrorCode = "invalid_dpop_proof"
+)
+
 // TokenError represents an error returned from calling the token endpoint.
 //
 // https://tools.ietf.org/html/rfc6749#section-5.2
@@ -12,9 +12,10 @@ import (
 )
 
 type CryptoSigner struct {
-	signer  jose.Signer
-	pubKeys *jose.JSONWebKeySet
-	keyID   string
+	signer     jose.Signer
+	signingKey jose.SigningKey
+	pubKeys    *jose.JSONWebKeySet
+	keyID      string
 
 	alg jose.SignatureAlgorithm
 }
@@ -40,18 +41,16 @@ func NewFromCrypto(signer crypto.Signer, keyID string) (*CryptoSigner, error) {
 
 	opaqueSigner := cryptosigner.Opaque(signer)
 
-	s, err := jose.NewSigner(
-		jose.SigningKey{
-			Algorithm: c.alg,
-			Key: &jose.JSONWebKey{
-				Algorithm: string(c.alg),
-				Key:       opaqueSigner,
-				KeyID:     keyID,
-				Use:       "sig",
-			},
+	c.signingKey = jose.SigningKey{
+		Algorithm: c.alg,
+		Key: &jose.JSONWebKey{
+			Algorithm: string(c.alg),
+			Key:       opaqueSigner,
+			KeyID:     keyID,
+			Use:       "sig",
 		},
-		nil,
-	)
+	}
+	s, err := jose.NewSigner(c.signingKey, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create signer: %w", err)
 	}
@@ -75,6 +74,11 @@ func (c *CryptoSigner) PublicKeys(_ context.Context) (*jose.JSONWebKeySet, error
 	return c.pubKeys, nil
 }
 
+// SigningKeyID returns the key ID the signer signs with
+func (c *CryptoSigner) SigningKeyID(_ context.Context) (string, error) {
+	return c.keyID, nil
+}
+
 // SignerAlg returns the algorithm this signer uses
 func (c *CryptoSigner) SignerAlg(_ context.Context) (jose.SignatureAlgorithm, error) {
 	return c.alg, nil
@@ -95,6 +99,15 @@ func (c *CryptoSigner) Sign(ctx context.Context, data []byte) (signed []byte, er
 	return []byte(ser), nil
 }
 
+// SignWithType signs the provided data, setting the typ header
+func (c *CryptoSigner) SignWithType(ctx context.Context, typ string, data []byte) (signed []byte, err error) {
+	signed, err = signWithType(ctx, c.signingKey, typ, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign payload: %w", err)
+	}
+	return signed, nil
+}
+
 // VerifySignature verifies the signature given token against the current signers
 func (c *CryptoSigner) VerifySignature(ctx context.Context, jwt string) (payload []byte, err error) {
 	jws, err := jose.ParseSigned(jwt)
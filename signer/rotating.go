@@ -0,0 +1,165 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// RotatingSigner signs with a current key, which can be rotated to a new one.
+// Keys that are rotated out continue to be published and used for verification
+// until they are retired, so tokens they signed remain valid until they
+// expire. Every key must have a distinct key ID.
+type RotatingSigner struct {
+	mu sync.RWMutex
+
+	signingKey   jose.SigningKey
+	current      jose.JSONWebKey
+	previous     []retainedKey
+	nextRotation time.Time
+
+	now func() time.Time
+}
+
+type retainedKey struct {
+	key   jose.JSONWebKey
+	until time.Time
+}
+
+// NewRotating returns a RotatingSigner that signs with signingKey, publishing
+// publicKey for verification. nextRotation is when the caller plans to rotate
+// the key, and can be zero if it is not known.
+func NewRotating(signingKey jose.SigningKey, publicKey jose.JSONWebKey, nextRotation time.Time) (*RotatingSigner, error) {
+	if publicKey.KeyID == "" {
+		return nil, fmt.Errorf("public key must have a key ID")
+	}
+
+	return &RotatingSigner{
+		signingKey:   withKeyID(signingKey, publicKey.KeyID),
+		current:      publicKey,
+		nextRotation: nextRotation,
+		now:          time.Now,
+	}, nil
+}
+
+// SetNow sets the clock used to expire retained keys. It satisfies
+// core.Clocked, so the signer shares the clock set in core.Config.Now.
+func (s *RotatingSigner) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Rotate starts signing with signingKey, publishing publicKey. The previously
+// current key remains published until retainUntil, which should be after any
+// token it signed expires. nextRotation is when the caller next plans to
+// rotate.
+func (s *RotatingSigner) Rotate(signingKey jose.SigningKey, publicKey jose.JSONWebKey, nextRotation, retainUntil time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if publicKey.KeyID == "" {
+		return fmt.Errorf("public key must have a key ID")
+	}
+	for _, k := range s.publishedKeys() {
+		if k.KeyID == publicKey.KeyID {
+			return fmt.Errorf("key ID %s is already in use", publicKey.KeyID)
+		}
+	}
+
+	now := s.now()
+	var previous []retainedKey
+	for _, k := range s.previous {
+		if now.Before(k.until) {
+			previous = append(previous, k)
+		}
+	}
+
+	s.previous = append(previous, retainedKey{key: s.current, until: retainUntil})
+	s.signingKey = withKeyID(signingKey, publicKey.KeyID)
+	s.current = publicKey
+	s.nextRotation = nextRotation
+
+	return nil
+}
+
+// NextRotation returns when the keys are next planned to be rotated.
+func (s *RotatingSigner) NextRotation(_ context.Context) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.nextRotation, nil
+}
+
+// PublicKeys returns the current key, and any previous keys that have not
+// been retired.
+func (s *RotatingSigner) PublicKeys(_ context.Context) (*jose.JSONWebKeySet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &jose.JSONWebKeySet{
+		Keys: s.publishedKeys(),
+	}, nil
+}
+
+// SigningKeyID returns the key ID of the current key, that Sign uses.
+func (s *RotatingSigner) SigningKeyID(_ context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current.KeyID, nil
+}
+
+// SignerAlg returns the algorithm the signer uses
+func (s *RotatingSigner) SignerAlg(_ context.Context) (jose.SignatureAlgorithm, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.signingKey.Algorithm, nil
+}
+
+// Sign the provided data with the current key
+func (s *RotatingSigner) Sign(ctx context.Context, data []byte) (signed []byte, err error) {
+	s.mu.RLock()
+	signingKey := s.signingKey
+	s.mu.RUnlock()
+
+	return sign(ctx, signingKey, data)
+}
+
+// SignWithType signs the provided data with the current key, setting the typ
+// header
+func (s *RotatingSigner) SignWithType(ctx context.Context, typ string, data []byte) (signed []byte, err error) {
+	s.mu.RLock()
+	signingKey := s.signingKey
+	s.mu.RUnlock()
+
+	return signWithType(ctx, signingKey, typ, data)
+}
+
+// VerifySignature verifies the signature given token against the published
+// keys
+func (s *RotatingSigner) VerifySignature(ctx context.Context, jwt string) (payload []byte, err error) {
+	s.mu.RLock()
+	keys := s.publishedKeys()
+	s.mu.RUnlock()
+
+	return verifySignature(ctx, keys, jwt)
+}
+
+// publishedKeys returns the current key followed by the unretired previous
+// keys, newest first. The lock must be held.
+func (s *RotatingSigner) publishedKeys() []jose.JSONWebKey {
+	now := s.now()
+
+	keys := []jose.JSONWebKey{s.current}
+	for i := len(s.previous) - 1; i >= 0; i-- {
+		if now.Before(s.previous[i].until) {
+			keys = append(keys, s.previous[i].key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,107 @@
+package signer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestRotatingSigner(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+
+	sk, pk := mustRSASigningKey("old")
+	s, err := NewRotating(sk, pk, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetNow(func() time.Time { return now })
+
+	oldTok, err := s.Sign(ctx, []byte("old payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk, pk = mustRSASigningKey("old")
+	if err := s.Rotate(sk, pk, time.Time{}, now.Add(1*time.Hour)); err == nil {
+		t.Error("want error rotating to a key ID in use")
+	}
+
+	nextRotation := now.Add(24 * time.Hour)
+	sk, pk = mustRSASigningKey("new")
+	if err := s.Rotate(sk, pk, nextRotation, now.Add(1*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if nr, err := s.NextRotation(ctx); err != nil || !nr.Equal(nextRotation) {
+		t.Errorf("want next rotation %s, got %s (err: %v)", nextRotation, nr, err)
+	}
+
+	newTok, err := s.Sign(ctx, []byte("new payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := jose.ParseSigned(string(newTok))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := jws.Signatures[0].Header.KeyID; kid != "new" {
+		t.Errorf("want token signed with new key, got %s", kid)
+	}
+
+	// during the overlap both keys are published, and verify
+	if got := publishedKIDs(t, s); len(got) != 2 || got[0] != "new" || got[1] != "old" {
+		t.Errorf("want kids [new old] published, got %v", got)
+	}
+	if _, err := s.VerifySignature(ctx, string(oldTok)); err != nil {
+		t.Errorf("want token signed by old key to verify during overlap, got: %v", err)
+	}
+	if _, err := s.VerifySignature(ctx, string(newTok)); err != nil {
+		t.Errorf("want token signed by new key to verify, got: %v", err)
+	}
+
+	// once the old key is retired it is no longer published, or valid
+	now = now.Add(1 * time.Hour)
+	if got := publishedKIDs(t, s); len(got) != 1 || got[0] != "new" {
+		t.Errorf("want kids [new] published, got %v", got)
+	}
+	if _, err := s.VerifySignature(ctx, string(oldTok)); err == nil {
+		t.Error("want token signed by retired key to fail verification")
+	}
+}
+
+func publishedKIDs(t *testing.T, s *RotatingSigner) []string {
+	t.Helper()
+
+	ks, err := s.PublicKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kids []string
+	for _, k := range ks.Keys {
+		kids = append(kids, k.KeyID)
+	}
+	return kids
+}
+
+func mustRSASigningKey(kid string) (jose.SigningKey, jose.JSONWebKey) {
+	key := mustGenRSAKey(512)
+
+	signingKey := jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{
+		Key:   key,
+		KeyID: kid,
+	}}
+
+	publicKey := jose.JSONWebKey{
+		Key:       key.Public(),
+		KeyID:     kid,
+		Algorithm: "RS256",
+		Use:       "sig",
+	}
+
+	return signingKey, publicKey
+}
@@ -1,14 +1,25 @@
 package signer
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"errors"
 
 	"gopkg.in/square/go-jose.v2"
 )
 
-func sign(_ context.Context, signingKey jose.SigningKey, data []byte) (signed []byte, err error) {
-	signer, err := jose.NewSigner(signingKey, nil)
+func sign(ctx context.Context, signingKey jose.SigningKey, data []byte) (signed []byte, err error) {
+	return signWithType(ctx, signingKey, "", data)
+}
+
+// signWithType signs the data, setting the typ header if it is not empty.
+func signWithType(_ context.Context, signingKey jose.SigningKey, typ string, data []byte) (signed []byte, err error) {
+	opts := &jose.SignerOptions{}
+	if typ != "" {
+		opts = opts.WithType(jose.ContentType(typ))
+	}
+	signer, err := jose.NewSigner(signingKey, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -44,3 +55,72 @@ func verifySignature(_ context.Context, verificationKeys []jose.JSONWebKey, jwt
 
 	return nil, errors.New("failed to verify id token signature")
 }
+
+// withKeyID returns the signing key wrapped in a JWK with the key ID, so the
+// kid header is set on what it signs. Keys that are already JWKs with a key
+// ID are returned as is.
+func withKeyID(signingKey jose.SigningKey, keyID string) jose.SigningKey {
+	if keyID == "" {
+		return signingKey
+	}
+	switch k := signingKey.Key.(type) {
+	case jose.JSONWebKey:
+		if k.KeyID == "" {
+			k.KeyID = keyID
+		}
+		signingKey.Key = &k
+	case *jose.JSONWebKey:
+		if k.KeyID == "" {
+			kc := *k
+			kc.KeyID = keyID
+			signingKey.Key = &kc
+		}
+	default:
+		signingKey.Key = &jose.JSONWebKey{Key: k, KeyID: keyID}
+	}
+	return signingKey
+}
+
+// signingKeyID returns the key ID of the signing key. If it is a JWK with a
+// key ID, that is used. Otherwise it is the ID of the verification key with
+// the same public key, or empty if there isn't one.
+func signingKeyID(signingKey jose.SigningKey, verificationKeys []jose.JSONWebKey) string {
+	var pub interface{}
+	switch k := signingKey.Key.(type) {
+	case jose.JSONWebKey:
+		if k.KeyID != "" {
+			return k.KeyID
+		}
+		pub = k.Public().Key
+	case *jose.JSONWebKey:
+		if k.KeyID != "" {
+			return k.KeyID
+		}
+		pub = k.Public().Key
+	case jose.OpaqueSigner:
+		if jwk := k.Public(); jwk != nil {
+			if jwk.KeyID != "" {
+				return jwk.KeyID
+			}
+			pub = jwk.Key
+		}
+	case crypto.Signer:
+		pub = k.Public()
+	}
+	if pub == nil {
+		return ""
+	}
+
+	tp, err := (&jose.JSONWebKey{Key: pub}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return ""
+	}
+	for _, vk := range verificationKeys {
+		vpub := vk.Public()
+		vtp, err := vpub.Thumbprint(crypto.SHA256)
+		if err == nil && bytes.Equal(tp, vtp) {
+			return vk.KeyID
+		}
+	}
+	return ""
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"testing"
+	"time"
 
 	jose "gopkg.in/square/go-jose.v2"
 )
@@ -13,6 +14,7 @@ type signer interface {
 	PublicKeys(_ context.Context) (*jose.JSONWebKeySet, error)
 	SignerAlg(_ context.Context) (jose.SignatureAlgorithm, error)
 	Sign(_ context.Context, data []byte) (signed []byte, err error)
+	SignWithType(_ context.Context, typ string, data []byte) (signed []byte, err error)
 	VerifySignature(ctx context.Context, jwt string) (payload []byte, err error)
 }
 
@@ -48,6 +50,25 @@ func TestSigner(t *testing.T) {
 				return NewStatic(signingKey, verificationKeys)
 			},
 		},
+		{
+			name: "rotating",
+			signer: func(t *testing.T) signer {
+				t.Helper()
+
+				sk, pk := mustRSASigningKey("key-1")
+				s, err := NewRotating(sk, pk, time.Time{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				sk, pk = mustRSASigningKey("key-2")
+				if err := s.Rotate(sk, pk, time.Time{}, time.Now().Add(1*time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+
+				return s
+			},
+		},
 	} {
 		t.Run(otc.name, func(t *testing.T) {
 			signer := otc.signer(t)
@@ -55,6 +76,7 @@ func TestSigner(t *testing.T) {
 			tests := []struct {
 				name           string
 				tokenGenerator func() (jwt string, err error)
+				wantTyp        string
 				wantErr        bool
 			}{
 				{
@@ -65,6 +87,15 @@ func TestSigner(t *testing.T) {
 					},
 					wantErr: false,
 				},
+				{
+					name: "valid typed token",
+					tokenGenerator: func() (string, error) {
+						s, err := signer.SignWithType(ctx, "at+jwt", []byte("payload"))
+						return string(s), err
+					},
+					wantTyp: "at+jwt",
+					wantErr: false,
+				},
 				{
 					name: "token signed by different key",
 					tokenGenerator: func() (string, error) {
@@ -112,6 +143,10 @@ func TestSigner(t *testing.T) {
 						t.Error("Signed token has empty Key ID")
 					}
 
+					if typ, _ := jws.Signatures[0].Header.ExtraHeaders[jose.HeaderType].(string); typ != tc.wantTyp {
+						t.Errorf("want typ %q, got %q", tc.wantTyp, typ)
+					}
+
 					_, err = signer.VerifySignature(context.Background(), jwt)
 					if (err != nil && !tc.wantErr) || (err == nil && tc.wantErr) {
 						t.Fatalf("wantErr = %v, but got err = %v", tc.wantErr, err)
@@ -122,6 +157,94 @@ func TestSigner(t *testing.T) {
 	}
 }
 
+func TestSigningKeyID(t *testing.T) {
+	ctx := context.Background()
+
+	key := mustGenRSAKey(512)
+	other := mustGenRSAKey(512)
+	verificationKeys := []jose.JSONWebKey{
+		{Key: other.Public(), KeyID: "other", Algorithm: "RS256", Use: "sig"},
+		{Key: key.Public(), KeyID: "current", Algorithm: "RS256", Use: "sig"},
+	}
+
+	rotating, err := NewRotating(jose.SigningKey{Algorithm: jose.RS256, Key: other}, verificationKeys[0], time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotating.Rotate(jose.SigningKey{Algorithm: jose.RS256, Key: key}, verificationKeys[1], time.Time{}, time.Now().Add(1*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := NewFromCrypto(key, "current")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		signer interface {
+			signer
+			SigningKeyID(ctx context.Context) (string, error)
+		}
+	}{
+		{
+			// the signing key is a bare key, so the ID comes from the
+			// matching verification key.
+			name:   "static",
+			signer: NewStatic(jose.SigningKey{Algorithm: jose.RS256, Key: key}, verificationKeys),
+		},
+		{
+			name:   "rotating",
+			signer: rotating,
+		},
+		{
+			name:   "crypto",
+			signer: cs,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kid, err := tc.signer.SigningKeyID(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kid != "current" {
+				t.Errorf("want signing key ID current, got: %q", kid)
+			}
+
+			signed, err := tc.signer.Sign(ctx, []byte("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			jws, err := jose.ParseSigned(string(signed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := jws.Signatures[0].Header.KeyID; got != kid {
+				t.Errorf("want kid header %s, got: %q", kid, got)
+			}
+
+			ks, err := tc.signer.PublicKeys(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := ks.Key(kid)
+			if len(keys) != 1 {
+				t.Fatalf("want one published key for kid %s, got: %v", kid, keys)
+			}
+			if _, err := jws.Verify(keys[0]); err != nil {
+				t.Errorf("want token to verify with the published key for its kid: %v", err)
+			}
+		})
+	}
+
+	t.Run("unknown key", func(t *testing.T) {
+		s := NewStatic(jose.SigningKey{Algorithm: jose.RS256, Key: mustGenRSAKey(512)}, verificationKeys)
+		if kid, _ := s.SigningKeyID(ctx); kid != "" {
+			t.Errorf("want no key ID for an unpublished key, got: %s", kid)
+		}
+	})
+}
+
 func mustGenRSAKey(bits int) *rsa.PrivateKey {
 	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
@@ -2,6 +2,7 @@ package signer
 
 import (
 	"context"
+	"fmt"
 
 	jose "gopkg.in/square/go-jose.v2"
 )
@@ -9,17 +10,47 @@ import (
 // StaticSigner uses a fixed set of keys to manage signing operations
 type StaticSigner struct {
 	signingKey       jose.SigningKey
+	signingKeys      []jose.SigningKey
 	verificationKeys []jose.JSONWebKey
 }
 
-// NewStatic returns a StaticSigner with the provided keys
+// NewStatic returns a StaticSigner with the provided keys. If the signing key
+// doesn't have a key ID, it is signed with the ID of the verification key
+// with the same public key, so tokens can be matched to the published key.
 func NewStatic(signingKey jose.SigningKey, verificationKeys []jose.JSONWebKey) *StaticSigner {
+	signingKey = withKeyID(signingKey, signingKeyID(signingKey, verificationKeys))
 	return &StaticSigner{
 		signingKey:       signingKey,
+		signingKeys:      []jose.SigningKey{signingKey},
 		verificationKeys: verificationKeys,
 	}
 }
 
+// NewStaticMultiAlg returns a StaticSigner that can sign with multiple
+// algorithms, one key per algorithm. The first key is the default used by
+// Sign, the others can be used with SignWithAlg.
+func NewStaticMultiAlg(signingKeys []jose.SigningKey, verificationKeys []jose.JSONWebKey) (*StaticSigner, error) {
+	if len(signingKeys) == 0 {
+		return nil, fmt.Errorf("at least one signing key is required")
+	}
+	seen := map[jose.SignatureAlgorithm]bool{}
+	keys := make([]jose.SigningKey, len(signingKeys))
+	for i, k := range signingKeys {
+		if seen[k.Algorithm] {
+			return nil, fmt.Errorf("multiple signing keys for %s", k.Algorithm)
+		}
+		seen[k.Algorithm] = true
+		keys[i] = withKeyID(k, signingKeyID(k, verificationKeys))
+	}
+	signingKeys = keys
+
+	return &StaticSigner{
+		signingKey:       signingKeys[0],
+		signingKeys:      signingKeys,
+		verificationKeys: verificationKeys,
+	}, nil
+}
+
 // PublicKeys returns a keyset of all valid signer public keys considered
 // valid for signed tokens
 func (s *StaticSigner) PublicKeys(_ context.Context) (*jose.JSONWebKeySet, error) {
@@ -33,11 +64,42 @@ func (s *StaticSigner) SignerAlg(_ context.Context) (jose.SignatureAlgorithm, er
 	return s.signingKey.Algorithm, nil
 }
 
+// SigningKeyID returns the key ID of the key Sign uses, which is published in
+// PublicKeys. It is empty if the signing key has no key ID, and none of the
+// verification keys match it.
+func (s *StaticSigner) SigningKeyID(_ context.Context) (string, error) {
+	return signingKeyID(s.signingKey, s.verificationKeys), nil
+}
+
+// SupportedAlgs returns the algorithms the signer has keys for
+func (s *StaticSigner) SupportedAlgs(_ context.Context) ([]jose.SignatureAlgorithm, error) {
+	var algs []jose.SignatureAlgorithm
+	for _, k := range s.signingKeys {
+		algs = append(algs, k.Algorithm)
+	}
+	return algs, nil
+}
+
 // Sign the provided data
 func (s *StaticSigner) Sign(ctx context.Context, data []byte) (signed []byte, err error) {
 	return sign(ctx, s.signingKey, data)
 }
 
+// SignWithAlg signs the provided data with the key for the algorithm
+func (s *StaticSigner) SignWithAlg(ctx context.Context, alg jose.SignatureAlgorithm, data []byte) (signed []byte, err error) {
+	for _, k := range s.signingKeys {
+		if k.Algorithm == alg {
+			return sign(ctx, k, data)
+		}
+	}
+	return nil, fmt.Errorf("no signing key for %s", alg)
+}
+
+// SignWithType signs the provided data, setting the typ header
+func (s *StaticSigner) SignWithType(ctx context.Context, typ string, data []byte) (signed []byte, err error) {
+	return signWithType(ctx, s.signingKey, typ, data)
+}
+
 // VerifySignature verifies the signature given token against the current signers
 func (s *StaticSigner) VerifySignature(ctx context.Context, jwt string) (payload []byte, err error) {
 	return verifySignature(ctx, s.verificationKeys, jwt)
@@ -0,0 +1,281 @@
+package memory
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pardot/oidc/core"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Clients is an in-memory implementation of core.ClientSource,
+// core.MutableClientSource, core.ClientRestrictionsSource,
+// core.IDTokenSigningClientSource, core.IDTokenEncryptionClientSource,
+// core.SubjectTypeClientSource and core.ClientJWKSSource. Only keys registered in the jwks metadata are used,
+// the jwks_uri is not fetched. It should only be used for testing or similar. All clients will be lost when the process ends.
+type Clients struct {
+	mu sync.Mutex
+	m  map[string]*core.Client
+}
+
+var (
+	_ core.ClientSource                  = (*Clients)(nil)
+	_ core.MutableClientSource           = (*Clients)(nil)
+	_ core.ClientRestrictionsSource      = (*Clients)(nil)
+	_ core.IDTokenSigningClientSource    = (*Clients)(nil)
+	_ core.IDTokenEncryptionClientSource = (*Clients)(nil)
+	_ core.ClientJWKSSource              = (*Clients)(nil)
+	_ core.TokenLifetimeClientSource     = (*Clients)(nil)
+)
+
+func NewClients() *Clients {
+	return &Clients{
+		m: make(map[string]*core.Client),
+	}
+}
+
+func (c *Clients) GetClient(ctx context.Context, clientID string) (*core.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return nil, &errNotFound{errors.New("client not found")}
+	}
+	return copyClient(cl), nil
+}
+
+func (c *Clients) CreateClient(ctx context.Context, client *core.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client.ID == "" {
+		return errors.New("client ID is required")
+	}
+	if _, ok := c.m[client.ID]; ok {
+		return &errConflict{errors.New("client already exists")}
+	}
+	c.m[client.ID] = copyClient(client)
+	return nil
+}
+
+func (c *Clients) UpdateClient(ctx context.Context, client *core.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.m[client.ID]; !ok {
+		return &errNotFound{errors.New("client not found")}
+	}
+	c.m[client.ID] = copyClient(client)
+	return nil
+}
+
+func (c *Clients) DeleteClient(ctx context.Context, clientID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.m[clientID]; !ok {
+		return &errNotFound{errors.New("client not found")}
+	}
+	delete(c.m, clientID)
+	return nil
+}
+
+func (c *Clients) ListClients(ctx context.Context) ([]*core.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]*core.Client, 0, len(c.m))
+	for _, cl := range c.m {
+		ret = append(ret, copyClient(cl))
+	}
+	return ret, nil
+}
+
+func (c *Clients) IsValidClientID(clientID string) (ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok = c.m[clientID]
+	return ok, nil
+}
+
+func (c *Clients) IsUnauthenticatedClient(clientID string) (ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	return ok && cl.Metadata.TokenEndpointAuthMethod == "none", nil
+}
+
+func (c *Clients) ValidateClientSecret(clientID, clientSecret string) (ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok || cl.Secret == "" {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(cl.Secret), []byte(clientSecret)) == 1, nil
+}
+
+func (c *Clients) ValidateClientRedirectURI(clientID, redirectURI string) (ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return false, nil
+	}
+	public := cl.Metadata.TokenEndpointAuthMethod == "none"
+	for _, u := range cl.Metadata.RedirectURIs {
+		if core.MatchRedirectURI(u, redirectURI, public) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClientAllowedScopes returns the scopes in the client's metadata.
+func (c *Clients) ClientAllowedScopes(clientID string) (scopes []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return nil, &errNotFound{errors.New("client not found")}
+	}
+	return strings.Fields(cl.Metadata.Scope), nil
+}
+
+// ClientAllowedGrantTypes returns the grant types in the client's metadata.
+func (c *Clients) ClientAllowedGrantTypes(clientID string) (grantTypes []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return nil, &errNotFound{errors.New("client not found")}
+	}
+	return append([]string(nil), cl.Metadata.GrantTypes...), nil
+}
+
+// ClientAllowedResponseTypes returns the response types in the client's
+// metadata.
+func (c *Clients) ClientAllowedResponseTypes(clientID string) (responseTypes []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return nil, &errNotFound{errors.New("client not found")}
+	}
+	return append([]string(nil), cl.Metadata.ResponseTypes...), nil
+}
+
+// ClientTokenLifetimes returns the token lifetimes set on the client.
+func (c *Clients) ClientTokenLifetimes(clientID string) (core.TokenLifetimes, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return core.TokenLifetimes{}, &errNotFound{errors.New("client not found")}
+	}
+	return core.TokenLifetimes{
+		IDToken:      cl.IDTokenValidity,
+		AccessToken:  cl.AccessTokenValidity,
+		RefreshToken: cl.RefreshTokenValidity,
+	}, nil
+}
+
+// ClientIDTokenSignedResponseAlg returns the ID token signing algorithm in
+// the client's metadata.
+func (c *Clients) ClientIDTokenSignedResponseAlg(clientID string) (jose.SignatureAlgorithm, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return "", &errNotFound{errors.New("client not found")}
+	}
+	return cl.Metadata.IDTokenSignedResponseAlg, nil
+}
+
+// ClientSubjectType returns the subject type in the client's metadata, and
+// the host of its sector_identifier_uri or first redirect URI.
+func (c *Clients) ClientSubjectType(clientID string) (core.SubjectType, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return "", "", &errNotFound{errors.New("client not found")}
+	}
+	sectorURI := cl.Metadata.SectorIdentifierURI
+	if sectorURI == "" && len(cl.Metadata.RedirectURIs) > 0 {
+		sectorURI = cl.Metadata.RedirectURIs[0]
+	}
+	var sector string
+	if u, err := url.Parse(sectorURI); err == nil {
+		sector = u.Host
+	}
+	return cl.Metadata.SubjectType, sector, nil
+}
+
+// ClientIDTokenEncryption returns the ID token encryption algorithms in the
+// client's metadata.
+func (c *Clients) ClientIDTokenEncryption(clientID string) (alg jose.KeyAlgorithm, enc jose.ContentEncryption, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return "", "", &errNotFound{errors.New("client not found")}
+	}
+	return cl.Metadata.IDTokenEncryptedResponseAlg, cl.Metadata.IDTokenEncryptedResponseEnc, nil
+}
+
+// ClientSecret returns the client's secret, for verifying client_secret_jwt
+// assertions.
+func (c *Clients) ClientSecret(clientID string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return "", &errNotFound{errors.New("client not found")}
+	}
+	return cl.Secret, nil
+}
+
+// ClientJWKS returns the keys registered in the client's jwks metadata.
+func (c *Clients) ClientJWKS(clientID string) (*jose.JSONWebKeySet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.m[clientID]
+	if !ok {
+		return nil, &errNotFound{errors.New("client not found")}
+	}
+	if cl.Metadata.JWKS == nil {
+		return nil, nil
+	}
+	return &jose.JSONWebKeySet{Keys: append([]jose.JSONWebKey(nil), cl.Metadata.JWKS.Keys...)}, nil
+}
+
+// copyClient returns a copy of the client, so callers can't modify what we
+// have stored.
+func copyClient(cl *core.Client) *core.Client {
+	cp := *cl
+	cp.RegistrationAccessTokenHash = append([]byte(nil), cl.RegistrationAccessTokenHash...)
+	cp.Metadata.RedirectURIs = append([]string(nil), cl.Metadata.RedirectURIs...)
+	cp.Metadata.GrantTypes = append([]string(nil), cl.Metadata.GrantTypes...)
+	cp.Metadata.ResponseTypes = append([]string(nil), cl.Metadata.ResponseTypes...)
+	cp.Metadata.Contacts = append([]string(nil), cl.Metadata.Contacts...)
+	return &cp
+}
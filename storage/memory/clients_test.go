@@ -0,0 +1,116 @@
+package memory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pardot/oidc/core"
+	"github.com/pardot/oidc/storage"
+)
+
+func TestClients(t *testing.T) {
+	ctx := context.Background()
+
+	c := NewClients()
+
+	if _, err := c.GetClient(ctx, "client"); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found getting missing client, got: %v", err)
+	}
+	if err := c.UpdateClient(ctx, &core.Client{ID: "client"}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found updating missing client, got: %v", err)
+	}
+	if err := c.DeleteClient(ctx, "client"); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found deleting missing client, got: %v", err)
+	}
+
+	cl := &core.Client{
+		ID:     "client",
+		Secret: "secret",
+		Metadata: core.ClientMetadata{
+			RedirectURIs: []string{"https://client/callback"},
+		},
+	}
+	if err := c.CreateClient(ctx, cl); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateClient(ctx, &core.Client{ID: "client"}); !storage.IsConflictErr(err) {
+		t.Errorf("want conflict creating duplicate client, got: %v", err)
+	}
+
+	// changes to the passed client shouldn't be reflected in the store
+	cl.Metadata.RedirectURIs[0] = "https://attacker/callback"
+
+	if ok, _ := c.IsValidClientID("client"); !ok {
+		t.Error("want client valid")
+	}
+	if ok, _ := c.ValidateClientSecret("client", "secret"); !ok {
+		t.Error("want secret valid")
+	}
+	if ok, _ := c.ValidateClientSecret("client", "wrong"); ok {
+		t.Error("want wrong secret invalid")
+	}
+	if ok, _ := c.ValidateClientRedirectURI("client", "https://client/callback"); !ok {
+		t.Error("want registered redirect URI valid")
+	}
+	if ok, _ := c.ValidateClientRedirectURI("client", "https://attacker/callback"); ok {
+		t.Error("want unregistered redirect URI invalid")
+	}
+
+	got, err := c.GetClient(ctx, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Metadata.TokenEndpointAuthMethod = "none"
+	got.Secret = ""
+	if err := c.UpdateClient(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.IsUnauthenticatedClient("client"); !ok {
+		t.Error("want client unauthenticated after update")
+	}
+	if ok, _ := c.ValidateClientSecret("client", ""); ok {
+		t.Error("want empty secret invalid")
+	}
+
+	got.Metadata.RedirectURIs = []string{"http://127.0.0.1/callback"}
+	if err := c.UpdateClient(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.ValidateClientRedirectURI("client", "http://127.0.0.1:51004/callback"); !ok {
+		t.Error("want any loopback port valid for public client")
+	}
+
+	got.Metadata.Scope = "openid email"
+	got.Metadata.GrantTypes = []string{"authorization_code"}
+	got.Metadata.ResponseTypes = []string{"code"}
+	if err := c.UpdateClient(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if scopes, _ := c.ClientAllowedScopes("client"); len(scopes) != 2 || scopes[1] != "email" {
+		t.Errorf("want allowed scopes from metadata, got: %v", scopes)
+	}
+	if gts, _ := c.ClientAllowedGrantTypes("client"); len(gts) != 1 || gts[0] != "authorization_code" {
+		t.Errorf("want allowed grant types from metadata, got: %v", gts)
+	}
+	if rts, _ := c.ClientAllowedResponseTypes("client"); len(rts) != 1 || rts[0] != "code" {
+		t.Errorf("want allowed response types from metadata, got: %v", rts)
+	}
+
+	if err := c.CreateClient(ctx, &core.Client{ID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := c.ListClients(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("want 2 clients listed, got %d", len(list))
+	}
+
+	if err := c.DeleteClient(ctx, "client"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.IsValidClientID("client"); ok {
+		t.Error("want deleted client invalid")
+	}
+}
@@ -1,3 +1,10 @@
+// Package memory implements storage.Storage in memory, for tests and single
+// process deployments. Nothing is persisted, all data is lost when the process
+// exits, and it can't be shared between processes.
+//
+// Sessions can be kept in it with core.NewStorageSessionManager, which
+// redeems authorization codes with Consume and expires sessions with
+// GarbageCollectExpired when core.OIDC.RunGC is running.
 package memory
 
 import (
@@ -8,10 +15,19 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/pardot/oidc/storage"
 )
 
-// Storage is an in-memory implementation of storage.Storage. It should only be
-// used for testing or similar. All data will be lost when the process ends.
+var (
+	_ storage.Storage          = (*Storage)(nil)
+	_ storage.Consumer         = (*Storage)(nil)
+	_ storage.GarbageCollector = (*Storage)(nil)
+)
+
+// Storage is an in-memory implementation of storage.Storage. It is safe for
+// concurrent use. Expired items are hidden from reads, and removed by
+// GarbageCollectExpired. It should only be used for testing, or deployments
+// that run a single process and can lose their state on restart.
 type Storage struct {
 	sync.Mutex
 	m map[string]map[string]*record
@@ -23,6 +39,10 @@ type record struct {
 	Expires *time.Time
 }
 
+func (r *record) expired(now time.Time) bool {
+	return r.Expires != nil && now.After(*r.Expires)
+}
+
 func New() *Storage {
 	return &Storage{
 		m: make(map[string]map[string]*record),
@@ -43,7 +63,7 @@ func (s *Storage) Get(ctx context.Context, keyspace, key string, into proto.Mess
 		return 0, &errNotFound{errors.New("key not found")}
 	}
 
-	if r.Expires != nil && time.Now().After(*r.Expires) {
+	if r.expired(time.Now()) {
 		return 0, &errNotFound{errors.New("key not found")}
 	}
 
@@ -72,13 +92,14 @@ func (s *Storage) putWithOptionalExpiry(_ context.Context, keyspace, key string,
 		s.m[keyspace] = mm
 	}
 
-	var oldversion int64
 	r, ok := mm[key]
-	if ok {
-		oldversion = r.Version
-
-		if oldversion != version && (r.Expires == nil || time.Now().Before(*r.Expires)) {
-			return 0, &errConflict{errors.New("conflict")}
+	if ok && !r.expired(time.Now()) {
+		if r.Version != version {
+			return 0, &errConflict{fmt.Errorf("%s/%s version conflict, want to update version %d but current version is %d", keyspace, key, version, r.Version)}
+		}
+		// updates keep the item's expiry, unless a new one is set.
+		if expires == nil {
+			expires = r.Expires
 		}
 	}
 
@@ -108,7 +129,7 @@ func (s *Storage) List(ctx context.Context, keyspace string) (keys []string, err
 
 	keys = make([]string, 0, len(mm))
 	for k, r := range mm {
-		if r.Expires != nil && time.Now().After(*r.Expires) {
+		if r.expired(time.Now()) {
 			continue
 		}
 
@@ -122,13 +143,8 @@ func (s *Storage) Delete(ctx context.Context, keyspace, key string, version int6
 	s.Lock()
 	defer s.Unlock()
 
-	mm, ok := s.m[keyspace]
-	if !ok {
-		return nil
-	}
-
-	r, ok := mm[key]
-	if !ok {
+	r, ok := s.m[keyspace][key]
+	if !ok || r.expired(time.Now()) {
 		return &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
 	}
 
@@ -136,6 +152,38 @@ func (s *Storage) Delete(ctx context.Context, keyspace, key string, version int6
 		return &errConflict{fmt.Errorf("%s/%s version conflict, want to delete version %d but current version is %d", keyspace, key, version, r.Version)}
 	}
 
-	delete(mm, key)
+	delete(s.m[keyspace], key)
 	return nil
 }
+
+// Consume atomically gets and deletes the item, regardless of its version. Of
+// concurrent callers only one will get it, the rest will get an IsNotFoundErr.
+// This is intended for single use values like authorization codes.
+func (s *Storage) Consume(_ context.Context, keyspace, key string, into proto.Message) error {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.m[keyspace][key]
+	if !ok || r.expired(time.Now()) {
+		return &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	}
+	delete(s.m[keyspace], key)
+
+	return proto.Unmarshal(r.Data, into)
+}
+
+func (s *Storage) GarbageCollectExpired(_ context.Context, now time.Time) (deleted int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, mm := range s.m {
+		for k, r := range mm {
+			if r.expired(now) {
+				delete(mm, k)
+				deleted++
+			}
+		}
+	}
+
+	return deleted, nil
+}
@@ -2,8 +2,11 @@ package memory
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
+	jpbpb "github.com/golang/protobuf/jsonpb/jsonpb_test_proto"
 	"github.com/pardot/oidc/storage"
 )
 
@@ -13,3 +16,173 @@ func TestStorage(t *testing.T) {
 	s := New()
 	storage.Test(ctx, t, s)
 }
+
+func TestGarbageCollectExpired(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	now := time.Now()
+	if _, err := s.PutWithExpiry(ctx, "codes", "expired", 0, &jpbpb.Simple{}, now.Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutWithExpiry(ctx, "codes", "valid", 0, &jpbpb.Simple{}, now.Add(1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "clients", "forever", 0, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := s.GarbageCollectExpired(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("want 1 item deleted, got %d", deleted)
+	}
+	if _, ok := s.m["codes"]["expired"]; ok {
+		t.Error("want expired item removed")
+	}
+	if _, err := s.Get(ctx, "codes", "valid", &jpbpb.Simple{}); err != nil {
+		t.Errorf("want unexpired item kept, got %v", err)
+	}
+	if _, err := s.Get(ctx, "clients", "forever", &jpbpb.Simple{}); err != nil {
+		t.Errorf("want item without expiry kept, got %v", err)
+	}
+
+	// running again, e.g from another process, is a no-op
+	if deleted, err := s.GarbageCollectExpired(ctx, now); err != nil || deleted != 0 {
+		t.Errorf("want nothing deleted on second run, got %d, %v", deleted, err)
+	}
+}
+
+func TestExpiryPreserved(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	ver, err := s.PutWithExpiry(ctx, "ks", "item", 0, &jpbpb.Simple{}, time.Now().Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "ks", "item", ver, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := s.Get(ctx, "ks", "item", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found after expiry, got %v", err)
+	}
+	if err := s.Delete(ctx, "ks", "item", ver+1); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found deleting expired item, got %v", err)
+	}
+
+	// an expired item can be replaced as if it didn't exist, without keeping
+	// its expiry.
+	if _, err := s.Put(ctx, "ks", "item", 0, &jpbpb.Simple{}); err != nil {
+		t.Fatalf("want expired item replaced, got %v", err)
+	}
+	if s.m["ks"]["item"].Expires != nil {
+		t.Error("want replacement item to not expire")
+	}
+}
+
+func TestConsume(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	str := "code"
+	if _, err := s.Put(ctx, "codes", "c1", 0, &jpbpb.Simple{OString: &str}); err != nil {
+		t.Fatal(err)
+	}
+
+	const concurrency = 10
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		consumed int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := &jpbpb.Simple{}
+			err := s.Consume(ctx, "codes", "c1", got)
+			if storage.IsNotFoundErr(err) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got.GetOString() != str {
+				t.Errorf("want %q, got %q", str, got.GetOString())
+			}
+			mu.Lock()
+			consumed++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if consumed != 1 {
+		t.Errorf("want item consumed once, got %d", consumed)
+	}
+	if _, err := s.Get(ctx, "codes", "c1", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found after consume, got %v", err)
+	}
+
+	if _, err := s.PutWithExpiry(ctx, "codes", "c2", 0, &jpbpb.Simple{}, time.Now().Add(-1*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Consume(ctx, "codes", "c2", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found consuming expired item, got %v", err)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	if _, err := s.Put(ctx, "ks", "counter", 0, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// each writer retries on conflict until its update lands, so every
+	// update should be applied exactly once.
+	const writers, updates = 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := 0; u < updates; {
+				msg := &jpbpb.Simple{}
+				ver, err := s.Get(ctx, "ks", "counter", msg)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := msg.GetOInt64() + 1
+				msg.OInt64 = &n
+				_, err = s.Put(ctx, "ks", "counter", ver, msg)
+				if storage.IsConflictErr(err) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				u++
+			}
+		}()
+	}
+	wg.Wait()
+
+	msg := &jpbpb.Simple{}
+	if _, err := s.Get(ctx, "ks", "counter", msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetOInt64() != writers*updates {
+		t.Errorf("want counter %d, got %d", writers*updates, msg.GetOInt64())
+	}
+}
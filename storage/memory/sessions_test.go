@@ -0,0 +1,322 @@
+package memory
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc/core"
+	"github.com/pardot/oidc/core/coretest"
+	"github.com/pardot/oidc/signer"
+	"github.com/pardot/oidc/storage"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testRedirectURI  = "https://client/callback"
+)
+
+// newTestOIDC returns an OIDC keeping its sessions in st, so several can be
+// created to act as instances sharing the storage. It uses now as its clock,
+// or time.Now if nil.
+func newTestOIDC(t *testing.T, st storage.Storage, sgn core.Signer, now func() time.Time) *core.OIDC {
+	t.Helper()
+
+	clients := NewClients()
+	if err := clients.CreateClient(context.Background(), &core.Client{
+		ID:     testClientID,
+		Secret: testClientSecret,
+		Metadata: core.ClientMetadata{
+			RedirectURIs: []string{testRedirectURI},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := core.New(&core.Config{
+		Issuer:           "https://issuer",
+		AuthValidityTime: 1 * time.Minute,
+		CodeValidityTime: 1 * time.Minute,
+		Now:              now,
+	}, core.NewStorageSessionManager(st), clients, sgn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func newTestSigner(t *testing.T) core.Signer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.NewStatic(
+		jose.SigningKey{Algorithm: jose.RS256, Key: &jose.JSONWebKey{Key: key, KeyID: "testkey"}},
+		[]jose.JSONWebKey{{Key: key.Public(), KeyID: "testkey", Algorithm: "RS256", Use: "sig"}},
+	)
+}
+
+// authorize runs the authorization flow granting the scope, returning the code
+// issued.
+func authorize(t *testing.T, o *core.OIDC, scope string) string {
+	t.Helper()
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {scope},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/authorization?"+q.Encode(), nil)
+	areq, err := o.StartAuthorization(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := o.FinishAuthorization(w, req, areq.SessionID, &core.Authorization{Scopes: strings.Fields(scope)}); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in redirect %s", loc)
+	}
+	return code
+}
+
+func TestSessionManager(t *testing.T) {
+	ctx := context.Background()
+
+	coretest.TestStorageSessionManager(ctx, t, New())
+
+	// hide Consume, so codes are redeemed by deleting them at the version
+	// read.
+	t.Run("Without Consume", func(t *testing.T) {
+		coretest.TestStorageSessionManager(ctx, t, struct{ storage.Storage }{New()})
+	})
+}
+
+func TestSessionManagerFlow(t *testing.T) {
+	st := New()
+	o := newTestOIDC(t, st, newTestSigner(t), nil)
+
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	token := func(t *testing.T, form url.Values) *tokenResponse {
+		t.Helper()
+		form.Set("client_id", testClientID)
+		form.Set("client_secret", testClientSecret)
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		if err := o.Token(w, req, func(tr *core.TokenRequest) (*core.TokenResponse, error) {
+			return &core.TokenResponse{
+				IDToken:                tr.PrefillIDToken("https://issuer", "subject", time.Now().Add(1*time.Minute)),
+				AccessTokenValidUntil:  time.Now().Add(1 * time.Minute),
+				RefreshTokenValidUntil: time.Now().Add(10 * time.Minute),
+				IssueRefreshToken:      true,
+			}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var tresp tokenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &tresp); err != nil {
+			t.Fatal(err)
+		}
+		return &tresp
+	}
+
+	userinfo := func(t *testing.T, accessToken string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		_ = o.Userinfo(w, req, func(w io.Writer, _ *core.UserinfoRequest) error {
+			return json.NewEncoder(w).Encode(map[string]string{"sub": "subject"})
+		})
+		return w.Code
+	}
+
+	code := authorize(t, o, "openid offline_access")
+	tresp := token(t, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {testRedirectURI},
+	})
+	if tresp.AccessToken == "" || tresp.RefreshToken == "" {
+		t.Fatalf("want access and refresh tokens, got: %#v", tresp)
+	}
+	if c := userinfo(t, tresp.AccessToken); c != http.StatusOK {
+		t.Errorf("want userinfo for the access token, got %d", c)
+	}
+
+	// the code was consumed from the storage.
+	if n := len(st.m["oidc_auth_codes"]); n != 0 {
+		t.Errorf("want redeemed code removed from the storage, got %d", n)
+	}
+
+	refreshed := token(t, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tresp.RefreshToken},
+	})
+	if c := userinfo(t, refreshed.AccessToken); c != http.StatusOK {
+		t.Errorf("want userinfo for the refreshed access token, got %d", c)
+	}
+	if c := userinfo(t, tresp.AccessToken); c != http.StatusUnauthorized {
+		t.Errorf("want the replaced access token rejected, got %d", c)
+	}
+}
+
+func TestSessionManagerGC(t *testing.T) {
+	st := New()
+	now := time.Now()
+	o := newTestOIDC(t, st, newTestSigner(t), func() time.Time { return now })
+
+	// an issued code, and a request that was never finished.
+	authorize(t, o, "openid")
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+	}
+	if _, err := o.StartAuthorization(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/authorization?"+q.Encode(), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// RunGC collects once, then returns as the context is canceled.
+	runGC := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		o.RunGC(ctx, 1*time.Minute)
+	}
+	stored := func() int {
+		var n int
+		for _, ks := range st.m {
+			n += len(ks)
+		}
+		return n
+	}
+
+	runGC()
+	if n := stored(); n != 3 {
+		t.Fatalf("want both sessions and the code kept before they expire, got %d items", n)
+	}
+
+	now = now.Add(2 * time.Hour)
+	runGC()
+	if n := stored(); n != 0 {
+		t.Errorf("want everything collected once expired, got %d items", n)
+	}
+}
+
+func TestSessionManagerReplayCache(t *testing.T) {
+	ctx := context.Background()
+	st := New()
+	smgr := core.NewStorageSessionManager(st)
+
+	const concurrency = 10
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		fresh int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := smgr.CheckAndStore(ctx, "jti", 1*time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				fresh++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fresh != 1 {
+		t.Errorf("want the ID fresh once, got %d", fresh)
+	}
+
+	// the record is kept apart from the sessions, so can't be listed or
+	// loaded as one.
+	ids, err := smgr.ListSessionIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("want no sessions listed, got: %v", ids)
+	}
+	if n := len(st.m["oidc_sessions"]); n != 0 {
+		t.Errorf("want no sessions stored, got %d", n)
+	}
+}
+
+func TestSessionManagerReplayCacheClock(t *testing.T) {
+	ctx := context.Background()
+	st := New()
+	smgr := core.NewStorageSessionManager(st)
+
+	// the OIDC passes its clock on, which runs behind the real time.
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := core.New(&core.Config{
+		Issuer:           "https://issuer",
+		AuthValidityTime: 1 * time.Minute,
+		CodeValidityTime: 1 * time.Minute,
+		Now:              func() time.Time { return now },
+	}, smgr, NewClients(), newTestSigner(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false} {
+		fresh, err := smgr.CheckAndStore(ctx, "jti", 1*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh != want {
+			t.Errorf("check %d: want fresh %t, got %t", i, want, fresh)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	fresh, err := smgr.CheckAndStore(ctx, "jti", 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh {
+		t.Error("want the ID fresh once expired by the OIDC's clock")
+	}
+	fresh, err = smgr.CheckAndStore(ctx, "jti", 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh {
+		t.Error("want the ID recorded again")
+	}
+}
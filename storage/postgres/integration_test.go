@@ -0,0 +1,193 @@
+//go:build postgres
+// +build postgres
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	jpbpb "github.com/golang/protobuf/jsonpb/jsonpb_test_proto"
+	_ "github.com/lib/pq"
+	"github.com/pardot/oidc/core/coretest"
+	"github.com/pardot/oidc/storage"
+)
+
+// newTestStorage connects to the database at POSTGRES_DSN, or a local
+// oidc_test database, and applies the migrations to an empty table. Run with
+// `go test -tags postgres`.
+func newTestStorage(t *testing.T) (*Storage, *sql.DB) {
+	t.Helper()
+	ctx := context.Background()
+
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		dsn = "postgres://localhost/oidc_test?sslmode=disable"
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatalf("connecting to postgres at %s: %v", dsn, err)
+	}
+
+	for _, m := range []string{"0001_create_oidc_items.down.sql", "0001_create_oidc_items.up.sql"} {
+		q, err := ioutil.ReadFile("migrations/" + m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, string(q)); err != nil {
+			t.Fatalf("applying %s: %v", m, err)
+		}
+	}
+
+	s, err := New(ctx, db, &Options{MaxOpenConns: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+func TestIntegration(t *testing.T) {
+	ctx := context.Background()
+
+	s, db := newTestStorage(t)
+	defer db.Close()
+	defer s.Close()
+
+	storage.Test(ctx, t, s)
+	coretest.TestStorageSessionManager(ctx, t, s)
+}
+
+func TestExpiryPreserved(t *testing.T) {
+	ctx := context.Background()
+
+	s, db := newTestStorage(t)
+	defer db.Close()
+	defer s.Close()
+
+	ver, err := s.PutWithExpiry(ctx, "ks", "item", 0, &jpbpb.Simple{}, time.Now().Add(1*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "ks", "item", ver, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	if _, err := s.Get(ctx, "ks", "item", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found after expiry, got %v", err)
+	}
+	keys, err := s.List(ctx, "ks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("want no keys listed after expiry, got %v", keys)
+	}
+
+	// an expired item can be replaced as if it didn't exist, without
+	// keeping its expiry.
+	if _, err := s.Put(ctx, "ks", "item", 0, &jpbpb.Simple{}); err != nil {
+		t.Fatalf("want expired item replaced, got %v", err)
+	}
+	if _, err := s.Get(ctx, "ks", "item", &jpbpb.Simple{}); err != nil {
+		t.Errorf("want replacement item, got %v", err)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	ctx := context.Background()
+
+	s, db := newTestStorage(t)
+	defer db.Close()
+	defer s.Close()
+
+	str := "code"
+	if _, err := s.Put(ctx, "codes", "c1", 0, &jpbpb.Simple{OString: &str}); err != nil {
+		t.Fatal(err)
+	}
+
+	const concurrency = 10
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		consumed int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := &jpbpb.Simple{}
+			err := s.Consume(ctx, "codes", "c1", got)
+			if storage.IsNotFoundErr(err) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got.GetOString() != str {
+				t.Errorf("want %q, got %q", str, got.GetOString())
+			}
+			mu.Lock()
+			consumed++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if consumed != 1 {
+		t.Errorf("want item consumed once, got %d", consumed)
+	}
+	if _, err := s.Get(ctx, "codes", "c1", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found after consume, got %v", err)
+	}
+}
+
+func TestGarbageCollectExpired(t *testing.T) {
+	ctx := context.Background()
+
+	s, db := newTestStorage(t)
+	defer db.Close()
+	defer s.Close()
+
+	now := time.Now()
+	if _, err := s.PutWithExpiry(ctx, "ks", "expired", 0, &jpbpb.Simple{}, now.Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutWithExpiry(ctx, "ks", "live", 0, &jpbpb.Simple{}, now.Add(1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "ks", "forever", 0, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := s.GarbageCollectExpired(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("want 1 item collected, got %d", deleted)
+	}
+	// collection is idempotent
+	if deleted, err := s.GarbageCollectExpired(ctx, now); err != nil || deleted != 0 {
+		t.Errorf("want nothing collected the second time, got %d, %v", deleted, err)
+	}
+
+	var rows int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM oidc_items`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Errorf("want 2 rows left, got %d", rows)
+	}
+}
@@ -0,0 +1,15 @@
+-- oidc_items holds every keyspace of storage.Storage. Sessions, and the
+-- authorization requests, codes and refresh tokens they track, are each
+-- stored as a single versioned item.
+CREATE TABLE IF NOT EXISTS oidc_items (
+	keyspace   text        NOT NULL,
+	key        text        NOT NULL,
+	version    bigint      NOT NULL,
+	data       bytea       NOT NULL,
+	-- expires_at is NULL for items that don't expire.
+	expires_at timestamptz,
+	PRIMARY KEY (keyspace, key)
+);
+
+-- for GarbageCollectExpired.
+CREATE INDEX IF NOT EXISTS oidc_items_expires_at ON oidc_items (expires_at) WHERE expires_at IS NOT NULL;
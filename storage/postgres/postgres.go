@@ -0,0 +1,317 @@
+// Package postgres implements storage.Storage on PostgreSQL.
+//
+// Every keyspace is stored in the oidc_items table, with a row per item
+// holding its version, serialized data and expiry. The table is created by the
+// migrations in the migrations directory, which should be applied with the
+// deployment's migration tool before use. Version checks are done in the
+// statements' WHERE clauses, so updates are atomic. Expired items are hidden
+// from reads, and removed by GarbageCollectExpired.
+//
+// The caller opens the *sql.DB, with the PostgreSQL driver of their choice.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pardot/oidc/storage"
+)
+
+// DefaultTimeout is the deadline applied to each operation if no Timeout is
+// configured.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	_ storage.Storage          = (*Storage)(nil)
+	_ storage.Consumer         = (*Storage)(nil)
+	_ storage.GarbageCollector = (*Storage)(nil)
+)
+
+// Options configure the Storage.
+type Options struct {
+	// Timeout applied to each operation, if the context does not already have
+	// an earlier deadline. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the database's
+	// connection pool, if set. Otherwise the pool is left as the caller
+	// configured it.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Storage is a storage.Storage backed by PostgreSQL.
+type Storage struct {
+	db      *sql.DB
+	timeout time.Duration
+
+	getStmt     *sql.Stmt
+	putStmt     *sql.Stmt
+	listStmt    *sql.Stmt
+	deleteStmt  *sql.Stmt
+	consumeStmt *sql.Stmt
+	gcStmt      *sql.Stmt
+}
+
+// Items that have expired are treated as if they don't exist, until they are
+// collected. $N is the current time in each.
+const (
+	getQuery = `SELECT version, data FROM oidc_items
+WHERE keyspace = $1 AND key = $2 AND (expires_at IS NULL OR expires_at > $3)`
+
+	// putQuery stores the item if the version matches the current one, or the
+	// item doesn't exist. An expiry is set if one is passed, otherwise any
+	// existing expiry is kept. No row is returned on a version conflict.
+	putQuery = `INSERT INTO oidc_items (keyspace, key, version, data, expires_at)
+VALUES ($1, $2, $3 + 1, $4, $5)
+ON CONFLICT (keyspace, key) DO UPDATE SET
+	version = EXCLUDED.version,
+	data = EXCLUDED.data,
+	expires_at = CASE
+		WHEN oidc_items.expires_at <= $6 THEN EXCLUDED.expires_at
+		ELSE COALESCE(EXCLUDED.expires_at, oidc_items.expires_at)
+	END
+WHERE oidc_items.version = $3 OR oidc_items.expires_at <= $6
+RETURNING version`
+
+	listQuery = `SELECT key FROM oidc_items
+WHERE keyspace = $1 AND (expires_at IS NULL OR expires_at > $2)
+ORDER BY key`
+
+	deleteQuery = `DELETE FROM oidc_items
+WHERE keyspace = $1 AND key = $2 AND version = $3 AND (expires_at IS NULL OR expires_at > $4)`
+
+	consumeQuery = `DELETE FROM oidc_items
+WHERE keyspace = $1 AND key = $2 AND (expires_at IS NULL OR expires_at > $3)
+RETURNING data`
+
+	gcQuery = `DELETE FROM oidc_items WHERE expires_at <= $1`
+)
+
+// New returns a Storage using the given database, which must have had the
+// migrations applied. The statements used are prepared up front, so this fails
+// if the database can't be reached. The database is not closed by the
+// Storage. opts can be nil to use the defaults.
+func New(ctx context.Context, db *sql.DB, opts *Options) (*Storage, error) {
+	s := &Storage{
+		db:      db,
+		timeout: DefaultTimeout,
+	}
+	if opts != nil {
+		if opts.Timeout != 0 {
+			s.timeout = opts.Timeout
+		}
+		if opts.MaxOpenConns != 0 {
+			db.SetMaxOpenConns(opts.MaxOpenConns)
+		}
+		if opts.MaxIdleConns != 0 {
+			db.SetMaxIdleConns(opts.MaxIdleConns)
+		}
+		if opts.ConnMaxLifetime != 0 {
+			db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+		}
+	}
+
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.getStmt, getQuery},
+		{&s.putStmt, putQuery},
+		{&s.listStmt, listQuery},
+		{&s.deleteStmt, deleteQuery},
+		{&s.consumeStmt, consumeQuery},
+		{&s.gcStmt, gcQuery},
+	} {
+		stmt, err := db.PrepareContext(ctx, p.query)
+		if err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("preparing statement: %w", err)
+		}
+		*p.stmt = stmt
+	}
+
+	return s, nil
+}
+
+// Close releases the prepared statements. The database is left open.
+func (s *Storage) Close() error {
+	var errs []error
+	for _, stmt := range []*sql.Stmt{s.getStmt, s.putStmt, s.listStmt, s.deleteStmt, s.consumeStmt, s.gcStmt} {
+		if stmt == nil {
+			continue
+		}
+		if err := stmt.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("closing statements: %v", errs)
+	}
+	return nil
+}
+
+// Get returns the given item. If it doesn't exist, an IsNotFoundErr will be
+// returned.
+func (s *Storage) Get(ctx context.Context, keyspace, key string, into proto.Message) (version int64, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var d []byte
+	err = s.getStmt.QueryRowContext(ctx, keyspace, key, time.Now()).Scan(&version, &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("getting %s/%s: %w", keyspace, key, err)
+	}
+	if err := proto.Unmarshal(d, into); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Put stores the item, preserving any existing expiry. The version must match
+// the stored item's, or be 0 for new items, otherwise an IsConflictErr will be
+// returned.
+func (s *Storage) Put(ctx context.Context, keyspace, key string, version int64, obj proto.Message) (newVersion int64, err error) {
+	return s.put(ctx, keyspace, key, version, obj, nil)
+}
+
+// PutWithExpiry is a Put that also sets when the item expires. It is hidden
+// from then on, and removed by GarbageCollectExpired.
+func (s *Storage) PutWithExpiry(ctx context.Context, keyspace, key string, version int64, obj proto.Message, expires time.Time) (newVersion int64, err error) {
+	return s.put(ctx, keyspace, key, version, obj, &expires)
+}
+
+func (s *Storage) put(ctx context.Context, keyspace, key string, version int64, obj proto.Message, expires *time.Time) (newVersion int64, err error) {
+	data, err := proto.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// a nil *time.Time isn't a valid driver value, so pass a typed NULL.
+	exp := sql.NullTime{}
+	if expires != nil {
+		exp = sql.NullTime{Time: *expires, Valid: true}
+	}
+
+	err = s.putStmt.QueryRowContext(ctx, keyspace, key, version, data, exp, time.Now()).Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, &errConflict{fmt.Errorf("%s/%s version conflict, want to update version %d", keyspace, key, version)}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("putting %s/%s: %w", keyspace, key, err)
+	}
+
+	return newVersion, nil
+}
+
+// List returns the keys of all unexpired items in the keyspace.
+func (s *Storage) List(ctx context.Context, keyspace string) (keys []string, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.listStmt.QueryContext(ctx, keyspace, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", keyspace, err)
+	}
+	defer rows.Close()
+
+	keys = []string{}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, fmt.Errorf("listing %s: %w", keyspace, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing %s: %w", keyspace, err)
+	}
+
+	return keys, nil
+}
+
+// Delete removes the item. If it doesn't exist, an IsNotFoundErr will be
+// returned. If the version isn't the current one, an IsConflictErr will be
+// returned.
+func (s *Storage) Delete(ctx context.Context, keyspace, key string, version int64) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	res, err := s.deleteStmt.ExecContext(ctx, keyspace, key, version, now)
+	if err != nil {
+		return fmt.Errorf("deleting %s/%s: %w", keyspace, key, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting %s/%s: %w", keyspace, key, err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	// nothing matched, find out why.
+	var cur int64
+	var d []byte
+	err = s.getStmt.QueryRowContext(ctx, keyspace, key, now).Scan(&cur, &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	}
+	if err != nil {
+		return fmt.Errorf("deleting %s/%s: %w", keyspace, key, err)
+	}
+	return &errConflict{fmt.Errorf("%s/%s version conflict, want to delete version %d", keyspace, key, version)}
+}
+
+// Consume atomically gets and deletes the item, regardless of its version. Of
+// concurrent callers only one will get it, the rest will get an IsNotFoundErr.
+// This is intended for single use values like authorization codes.
+func (s *Storage) Consume(ctx context.Context, keyspace, key string, into proto.Message) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var d []byte
+	err := s.consumeStmt.QueryRowContext(ctx, keyspace, key, time.Now()).Scan(&d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	}
+	if err != nil {
+		return fmt.Errorf("consuming %s/%s: %w", keyspace, key, err)
+	}
+
+	return proto.Unmarshal(d, into)
+}
+
+// GarbageCollectExpired deletes the items that expired before now, returning
+// how many were deleted.
+func (s *Storage) GarbageCollectExpired(ctx context.Context, now time.Time) (deleted int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.gcStmt.ExecContext(ctx, now)
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired items: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired items: %w", err)
+	}
+	return int(n), nil
+}
+
+// withTimeout returns a context with the operation timeout, unless it already
+// has an earlier deadline.
+func (s *Storage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.timeout)
+}
@@ -0,0 +1,13 @@
+package redis
+
+type errNotFound struct {
+	error
+}
+
+func (*errNotFound) NotFoundErr() {}
+
+type errConflict struct {
+	error
+}
+
+func (*errConflict) ConflictErr() {}
@@ -0,0 +1,44 @@
+//go:build redis
+// +build redis
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pardot/oidc/core/coretest"
+	"github.com/pardot/oidc/storage"
+)
+
+// TestIntegration runs the storage tests against a real Redis, at
+// REDIS_ADDR or localhost:6379. Run with `go test -tags redis`.
+func TestIntegration(t *testing.T) {
+	ctx := context.Background()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	defer pool.Close()
+
+	conn := pool.Get()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("connecting to redis at %s: %v", addr, err)
+	}
+	conn.Close()
+
+	s := New(pool, &Options{Prefix: fmt.Sprintf("oidc-test-%d", time.Now().UnixNano())})
+	storage.Test(ctx, t, s)
+	coretest.TestStorageSessionManager(ctx, t, s)
+}
@@ -0,0 +1,316 @@
+// Package redis implements storage.Storage on Redis.
+//
+// Each item is stored as a hash holding its version and serialized data, and
+// each keyspace has a set indexing its keys for List. Keys are namespaced
+// under a configurable prefix, with the keyspace as the hash tag so a
+// keyspace's keys share a slot if they are sharded. Version checks are done in
+// Lua scripts, so updates are atomic.
+//
+// The client is github.com/gomodule/redigo rather than go-redis. go-redis v8
+// requires github.com/golang/protobuf 1.4, which no longer ships the
+// jsonpb_test_proto package storage.Test is written against, so couldn't be
+// used without rewriting the shared storage tests. redigo has no such
+// dependencies, and its Pool lets callers configure connections as they need.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pardot/oidc/storage"
+)
+
+// DefaultPrefix is used to namespace keys if no Prefix is configured.
+const DefaultPrefix = "oidc"
+
+// DefaultTimeout is the deadline applied to each operation if no Timeout is
+// configured.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	_ storage.Storage  = (*Storage)(nil)
+	_ storage.Consumer = (*Storage)(nil)
+)
+
+// Options configure the Storage.
+type Options struct {
+	// Prefix all keys are namespaced under, to allow sharing a Redis
+	// instance. Defaults to DefaultPrefix.
+	Prefix string
+	// Timeout applied to each operation, if the context does not already have
+	// an earlier deadline. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Storage is a storage.Storage backed by Redis.
+type Storage struct {
+	pool    *redis.Pool
+	prefix  string
+	timeout time.Duration
+}
+
+// New returns a Storage that gets connections from the given pool. The pool is
+// not closed by the Storage. opts can be nil to use the defaults.
+func New(pool *redis.Pool, opts *Options) *Storage {
+	s := &Storage{
+		pool:    pool,
+		prefix:  DefaultPrefix,
+		timeout: DefaultTimeout,
+	}
+	if opts != nil {
+		if opts.Prefix != "" {
+			s.prefix = opts.Prefix
+		}
+		if opts.Timeout != 0 {
+			s.timeout = opts.Timeout
+		}
+	}
+	return s
+}
+
+// putScript stores the item if the version matches the current one, or the
+// item doesn't exist. An expiry is set if one is passed, otherwise any existing
+// expiry is kept. It returns the new version, or -1 on a version conflict.
+//
+// KEYS: item, index. ARGV: version, data, expires (unix ms or empty), key.
+var putScript = redis.NewScript(2, `
+local cur = redis.call('HGET', KEYS[1], 'v')
+if cur and tonumber(cur) ~= tonumber(ARGV[1]) then
+	return -1
+end
+local nv = tonumber(ARGV[1]) + 1
+redis.call('HMSET', KEYS[1], 'v', nv, 'd', ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+end
+redis.call('SADD', KEYS[2], ARGV[4])
+return nv
+`)
+
+// deleteScript removes the item if the version matches the current one. It
+// returns 1 if deleted, 0 if not found, or -1 on a version conflict.
+//
+// KEYS: item, index. ARGV: version, key.
+var deleteScript = redis.NewScript(2, `
+local cur = redis.call('HGET', KEYS[1], 'v')
+if not cur then
+	return 0
+end
+if tonumber(cur) ~= tonumber(ARGV[1]) then
+	return -1
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[2])
+return 1
+`)
+
+// consumeScript returns the item's data and deletes it, or returns false if
+// it doesn't exist.
+//
+// KEYS: item, index. ARGV: key.
+var consumeScript = redis.NewScript(2, `
+local d = redis.call('HGET', KEYS[1], 'd')
+if not d then
+	return false
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+return d
+`)
+
+// listScript returns the keys in the index that still exist, pruning those
+// that have expired.
+//
+// KEYS: index. ARGV: item key prefix.
+var listScript = redis.NewScript(1, `
+local keys = {}
+for _, k in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	if redis.call('EXISTS', ARGV[1] .. k) == 1 then
+		table.insert(keys, k)
+	else
+		redis.call('SREM', KEYS[1], k)
+	end
+end
+return keys
+`)
+
+// Get returns the given item. If it doesn't exist, an IsNotFoundErr will be
+// returned.
+func (s *Storage) Get(ctx context.Context, keyspace, key string, into proto.Message) (version int64, err error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	vals, err := redis.Values(conn.Do("HMGET", s.itemKey(keyspace, key), "v", "d"))
+	if err != nil {
+		return 0, fmt.Errorf("getting %s/%s: %w", keyspace, key, err)
+	}
+	if vals[0] == nil || vals[1] == nil {
+		return 0, &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	}
+
+	version, err = redis.Int64(vals[0], nil)
+	if err != nil {
+		return 0, fmt.Errorf("parsing version of %s/%s: %w", keyspace, key, err)
+	}
+	d, err := redis.Bytes(vals[1], nil)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s/%s: %w", keyspace, key, err)
+	}
+	if err := proto.Unmarshal(d, into); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Put stores the item, preserving any existing expiry. The version must match
+// the stored item's, or be 0 for new items, otherwise an IsConflictErr will be
+// returned.
+func (s *Storage) Put(ctx context.Context, keyspace, key string, version int64, obj proto.Message) (newVersion int64, err error) {
+	return s.put(ctx, keyspace, key, version, obj, "")
+}
+
+// PutWithExpiry is a Put that also sets when the item expires. Redis removes
+// it at that time.
+func (s *Storage) PutWithExpiry(ctx context.Context, keyspace, key string, version int64, obj proto.Message, expires time.Time) (newVersion int64, err error) {
+	return s.put(ctx, keyspace, key, version, obj, strconv.FormatInt(expires.UnixNano()/int64(time.Millisecond), 10))
+}
+
+func (s *Storage) put(ctx context.Context, keyspace, key string, version int64, obj proto.Message, expires string) (newVersion int64, err error) {
+	data, err := proto.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	newVersion, err = redis.Int64(putScript.Do(conn,
+		s.itemKey(keyspace, key), s.indexKey(keyspace),
+		version, data, expires, key,
+	))
+	if err != nil {
+		return 0, fmt.Errorf("putting %s/%s: %w", keyspace, key, err)
+	}
+	if newVersion < 0 {
+		return 0, &errConflict{fmt.Errorf("%s/%s version conflict, want to update version %d", keyspace, key, version)}
+	}
+
+	return newVersion, nil
+}
+
+// List returns the keys of all unexpired items in the keyspace.
+func (s *Storage) List(ctx context.Context, keyspace string) (keys []string, err error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys, err = redis.Strings(listScript.Do(conn, s.indexKey(keyspace), s.itemKey(keyspace, "")))
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", keyspace, err)
+	}
+
+	return keys, nil
+}
+
+// Delete removes the item. If it doesn't exist, an IsNotFoundErr will be
+// returned. If the version isn't the current one, an IsConflictErr will be
+// returned.
+func (s *Storage) Delete(ctx context.Context, keyspace, key string, version int64) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := redis.Int64(deleteScript.Do(conn, s.itemKey(keyspace, key), s.indexKey(keyspace), version, key))
+	if err != nil {
+		return fmt.Errorf("deleting %s/%s: %w", keyspace, key, err)
+	}
+
+	switch res {
+	case 0:
+		return &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	case -1:
+		return &errConflict{fmt.Errorf("%s/%s version conflict, want to delete version %d", keyspace, key, version)}
+	}
+	return nil
+}
+
+// Consume atomically gets and deletes the item, regardless of its version. Of
+// concurrent callers only one will get it, the rest will get an IsNotFoundErr.
+// This is intended for single use values like authorization codes.
+func (s *Storage) Consume(ctx context.Context, keyspace, key string, into proto.Message) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	d, err := redis.Bytes(consumeScript.Do(conn, s.itemKey(keyspace, key), s.indexKey(keyspace), key))
+	if errors.Is(err, redis.ErrNil) {
+		return &errNotFound{fmt.Errorf("%s/%s not found", keyspace, key)}
+	}
+	if err != nil {
+		return fmt.Errorf("consuming %s/%s: %w", keyspace, key, err)
+	}
+
+	return proto.Unmarshal(d, into)
+}
+
+// conn gets a connection from the pool, which runs each command with a
+// deadline of the operation timeout, or the context's deadline if that is
+// sooner. It must be closed to return it to the pool.
+func (s *Storage) conn(ctx context.Context) (redis.Conn, error) {
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting redis connection: %w", err)
+	}
+	return &deadlineConn{Conn: conn, deadline: deadline}, nil
+}
+
+// deadlineConn runs commands with a timeout, so they don't exceed the
+// deadline.
+type deadlineConn struct {
+	redis.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	timeout := time.Until(c.deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+}
+
+// indexKey is the set of keys in the keyspace. The keyspace is the hash tag,
+// so it is in the same slot as the items.
+func (s *Storage) indexKey(keyspace string) string {
+	return s.prefix + ":{" + keyspace + "}"
+}
+
+func (s *Storage) itemKey(keyspace, key string) string {
+	return s.indexKey(keyspace) + ":" + key
+}
@@ -0,0 +1,193 @@
+package redis
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	jpbpb "github.com/golang/protobuf/jsonpb/jsonpb_test_proto"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pardot/oidc/core/coretest"
+	"github.com/pardot/oidc/storage"
+)
+
+func newTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", mr.Addr())
+		},
+	}
+	return New(pool, &Options{Prefix: "test"}), mr
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	// miniredis only expires keys when its clock is moved, so run it at double
+	// speed. Items will have expired by the time the real clock passes their
+	// expiry, however the ticks line up.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		last := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-time.After(10 * time.Millisecond):
+				mr.FastForward(2 * now.Sub(last))
+				last = now
+			}
+		}
+	}()
+
+	storage.Test(ctx, t, s)
+}
+
+func TestSessionManager(t *testing.T) {
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	coretest.TestStorageSessionManager(context.Background(), t, s)
+}
+
+func TestKeyNamespacing(t *testing.T) {
+	ctx := context.Background()
+
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	if _, err := s.Put(ctx, "sessions", "abc", 0, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !mr.Exists("test:{sessions}:abc") {
+		t.Errorf("want item stored under the prefix, got keys %v", mr.Keys())
+	}
+}
+
+func TestExpiryPreserved(t *testing.T) {
+	ctx := context.Background()
+
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	ver, err := s.PutWithExpiry(ctx, "ks", "item", 0, &jpbpb.Simple{}, time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "ks", "item", ver, &jpbpb.Simple{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := mr.TTL("test:{ks}:item"); ttl <= 0 {
+		t.Errorf("want expiry preserved after put, got ttl %s", ttl)
+	}
+
+	mr.FastForward(2 * time.Minute)
+
+	if _, err := s.Get(ctx, "ks", "item", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found after expiry, got %v", err)
+	}
+	keys, err := s.List(ctx, "ks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("want no keys listed after expiry, got %v", keys)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	ctx := context.Background()
+
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	str := "code"
+	if _, err := s.Put(ctx, "codes", "c1", 0, &jpbpb.Simple{OString: &str}); err != nil {
+		t.Fatal(err)
+	}
+
+	const concurrency = 10
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		consumed int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := &jpbpb.Simple{}
+			err := s.Consume(ctx, "codes", "c1", got)
+			if storage.IsNotFoundErr(err) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got.GetOString() != str {
+				t.Errorf("want %q, got %q", str, got.GetOString())
+			}
+			mu.Lock()
+			consumed++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if consumed != 1 {
+		t.Errorf("want item consumed once, got %d", consumed)
+	}
+	if _, err := s.Get(ctx, "codes", "c1", &jpbpb.Simple{}); !storage.IsNotFoundErr(err) {
+		t.Errorf("want not found after consume, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// a server that accepts connections, but never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", l.Addr().String())
+		},
+	}
+	s := New(pool, &Options{Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := s.Get(context.Background(), "ks", "item", &jpbpb.Simple{}); err == nil {
+		t.Fatal("want error with server not replying")
+	}
+	if took := time.Since(start); took > 1*time.Second {
+		t.Errorf("operation took %s, want it bounded by the timeout", took)
+	}
+}
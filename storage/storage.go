@@ -32,6 +32,26 @@ type Storage interface {
 	Delete(ctx context.Context, keyspace, key string, version int64) error
 }
 
+// Consumer is implemented by a Storage that can atomically get and delete an
+// item, for single use values like authorization codes. Without it, the same
+// can be done with a Get and a Delete of the version read.
+type Consumer interface {
+	// Consume gets the item and deletes it, regardless of its version. Of
+	// concurrent calls for the same item only one gets it, the rest get an
+	// IsNotFoundErr.
+	Consume(ctx context.Context, keyspace, key string, into proto.Message) error
+}
+
+// GarbageCollector is implemented by a Storage that doesn't remove expired
+// items on its own. Get won't return them, but they take up space until they
+// are collected.
+type GarbageCollector interface {
+	// GarbageCollectExpired deletes the items that expired before now,
+	// returning how many were deleted. It is idempotent, so it is safe for
+	// several processes sharing the storage to run it concurrently.
+	GarbageCollectExpired(ctx context.Context, now time.Time) (deleted int, err error)
+}
+
 type errNotFound interface {
 	NotFoundErr()
 }